@@ -16,13 +16,34 @@ import (
 	"time"
 
 	"github.com/aratan/dbp2p/pkg/api"
+	"github.com/aratan/dbp2p/pkg/binary"
 	"github.com/aratan/dbp2p/pkg/config"
 	"github.com/aratan/dbp2p/pkg/db"
 	"github.com/aratan/dbp2p/pkg/p2p"
 	"github.com/aratan/dbp2p/pkg/ws"
+
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 func main() {
+	// Subcomandos que se ejecutan sin arrancar el nodo
+	if len(os.Args) > 1 && os.Args[1] == "migrate-storage" {
+		runMigrateStorage(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		runIdentity(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "datakey" {
+		runDataKey(os.Args[2:])
+		return
+	}
+
 	// Parsear flags de línea de comandos
 	configFile := flag.String("config", "config.yaml", "Ruta al archivo de configuración")
 	apiPort := flag.Int("api-port", 0, "Puerto para la API REST (anula la configuración)")
@@ -84,13 +105,17 @@ func main() {
 	}
 
 	// Inicializar la base de datos con persistencia
-	database, err := db.NewDatabaseWithPersistence(dataDir)
+	database, err := db.NewDatabaseWithPersistence(dataDir, db.WithStorageEngine(cfg.Database.StorageEngine))
 	if err != nil {
 		log.Printf("Error al inicializar base de datos con persistencia: %v. Usando modo sin persistencia.", err)
 		database = db.NewDatabase()
 	} else {
 		log.Printf("Base de datos inicializada con persistencia en: %s", dataDir)
 	}
+	if cfg.Database.TombstoneGracePeriod > 0 {
+		database.SetTombstoneGracePeriod(time.Duration(cfg.Database.TombstoneGracePeriod) * time.Second)
+	}
+	defer database.Close()
 
 	// Inicializar el gestor de autenticación con configuración
 	authManager, err := auth.NewAuthManager(dataDir)
@@ -106,16 +131,34 @@ func main() {
 		log.Fatalf("Error al configurar la base de datos en el nodo P2P: %v", err)
 	}
 
+	// Inicializar el gestor de binarios y replicar sus archivos
+	binaryManager, err := binary.NewBinaryManager(
+		filepath.Join(dataDir, "binaries"),
+		binary.WithCompression(true),
+		binary.WithChunkSize(cfg.Sync.Binaries.ChunkSize),
+	)
+	if err != nil {
+		log.Fatalf("Error al inicializar el gestor de binarios: %v", err)
+	}
+	if err := node.SetBinaryManager(binaryManager); err != nil {
+		log.Fatalf("Error al configurar la replicación de archivos: %v", err)
+	}
+
 	// Obtener la referencia a la sincronización
 	dbSync := node.Sync
 
 	// Mostrar información de sincronización
 	log.Println("Sincronización de base de datos inicializada correctamente")
+	log.Printf("Sincronización punto a punto iniciada (%s)", p2p.SyncProtocol)
 
 	// Iniciar servidores si están habilitados
 	if cfg.API.Enabled {
 		// Inicializar y arrancar el servidor API
 		apiServer := api.NewAPIServer(database, authManager)
+		apiServer.SetBootstrapper(node.Bootstrap)
+		apiServer.SetConsensus(node.Consensus)
+		apiServer.SetSharding(node.Sharding)
+		apiServer.SetQueries(node.Queries)
 		go func() {
 			if err := apiServer.Start(cfg.API.Port); err != nil {
 				log.Fatalf("Error al iniciar el servidor API: %v", err)
@@ -127,6 +170,8 @@ func main() {
 	if cfg.WebSocket.Enabled {
 		// Inicializar y arrancar el servidor WebSocket
 		wsServer := ws.NewWSServer(database, authManager)
+		wsServer.SetBinaryManager(binaryManager)
+		wsServer.SetQueries(node.Queries)
 		wsServer.Start()
 
 		// Registrar callback para eventos de la base de datos
@@ -197,7 +242,7 @@ func main() {
 	// Manejar modo CLI o esperar señales de terminación
 	if len(os.Args) == 1 || (len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-")) {
 		// Modo CLI
-		runCLI(database, dbSync)
+		runCLI(database, dbSync, node.SyncManager, node.Bootstrap)
 	} else {
 		// Esperar señales de terminación
 		log.Println("Servidores iniciados. Presiona Ctrl+C para salir.")
@@ -205,7 +250,7 @@ func main() {
 	}
 }
 
-func runCLI(database *db.Database, _ *db.DBSync) {
+func runCLI(database *db.Database, _ *db.DBSync, syncManager *p2p.SyncManager, bootstrapper *p2p.Bootstrapper) {
 	// Añadir comando para sincronizar todos los documentos
 	fmt.Println("  sync - Sincronizar todos los documentos con la red")
 	// Iniciar la interfaz de línea de comandos
@@ -216,12 +261,15 @@ func runCLI(database *db.Database, _ *db.DBSync) {
 	fmt.Println("  create <colección> <json_data> - Crear un nuevo documento")
 	fmt.Println("  get <id> - Obtener un documento por ID")
 	fmt.Println("  query <colección> <json_query> - Buscar documentos")
-	fmt.Println("  update <id> <json_data> - Actualizar un documento")
+	fmt.Println("  update <id> <json_data> - Actualizar un documento (admite $set, $unset, $inc, $push y $pull)")
 	fmt.Println("  delete <id> - Eliminar un documento")
 	fmt.Println("  list <colección> - Listar todos los documentos de una colección")
 	fmt.Println("  backup - Crear una copia de seguridad de la base de datos")
 	fmt.Println("  restore <nombre_backup> - Restaurar la base de datos desde una copia de seguridad")
 	fmt.Println("  list_backups - Listar todas las copias de seguridad disponibles")
+	fmt.Println("  join [peer_id] - Copiar los datos de un peer, o del más cercano, sin admitir escrituras hasta terminar")
+	fmt.Println("  join_status - Mostrar el progreso de la incorporación del nodo")
+	fmt.Println("  join_override - Admitir escrituras tras una incorporación fallida")
 	fmt.Println("  exit - Salir del programa")
 	fmt.Println()
 
@@ -432,25 +480,237 @@ func runCLI(database *db.Database, _ *db.DBSync) {
 				fmt.Printf("Error al sincronizar documentos: %v\n", err)
 				continue
 			}
+			// Traer también los documentos de los peers conectados
+			if syncManager != nil {
+				syncManager.SyncNow()
+			}
 			fmt.Println("Sincronización completada")
 
+		case "join":
+			if bootstrapper == nil {
+				fmt.Println("La incorporación del nodo no está disponible")
+				continue
+			}
+
+			var pid peer.ID
+			if len(args) > 1 {
+				var err error
+				if pid, err = peer.Decode(args[1]); err != nil {
+					fmt.Printf("ID de peer no válido: %v\n", err)
+					continue
+				}
+			}
+
+			if err := bootstrapper.StartJoin(pid); err != nil {
+				fmt.Printf("Error al iniciar la incorporación: %v\n", err)
+				continue
+			}
+			fmt.Println("Incorporación iniciada; la base de datos no admite escrituras hasta que termine (consulta join_status)")
+
+		case "join_status":
+			if bootstrapper == nil {
+				fmt.Println("La incorporación del nodo no está disponible")
+				continue
+			}
+
+			progress := bootstrapper.Progress()
+			fmt.Printf("Fase: %s\n", progress.Phase)
+			if progress.Peer != "" {
+				fmt.Printf("Peer: %s (intento %d)\n", progress.Peer, progress.Attempt)
+			}
+			fmt.Printf("Documentos: %d/%d, eliminaciones: %d\n", progress.DocumentsReceived, progress.DocumentsTotal, progress.TombstonesReceived)
+			fmt.Printf("Cambios posteriores aplicados: %d (punto %d)\n", progress.ChangesApplied, progress.Seq)
+			if progress.FilesFetched > 0 {
+				fmt.Printf("Archivos obtenidos: %d\n", progress.FilesFetched)
+			}
+			if progress.Error != "" {
+				fmt.Printf("Error: %s\n", progress.Error)
+			}
+			fmt.Printf("Solo lectura: %v\n", database.IsReadOnly())
+			if progress.Phase == p2p.BootstrapFailed && progress.ReadOnly {
+				fmt.Println("Usa join para reintentar o join_override para admitir escrituras sin todos los datos")
+			}
+
+		case "join_override":
+			if bootstrapper == nil {
+				fmt.Println("La incorporación del nodo no está disponible")
+				continue
+			}
+
+			if err := bootstrapper.Override(); err != nil {
+				fmt.Printf("Error al habilitar las escrituras: %v\n", err)
+				continue
+			}
+			fmt.Println("Escrituras habilitadas; los datos que falten llegarán con la sincronización")
+
 		default:
 			fmt.Println("Comando desconocido. Comandos disponibles:")
 			fmt.Println("  create <colección> <json_data> - Crear un nuevo documento")
 			fmt.Println("  get <id> - Obtener un documento por ID")
 			fmt.Println("  query <colección> <json_query> - Buscar documentos")
-			fmt.Println("  update <id> <json_data> - Actualizar un documento")
+			fmt.Println("  update <id> <json_data> - Actualizar un documento (admite $set, $unset, $inc, $push y $pull)")
 			fmt.Println("  delete <id> - Eliminar un documento")
 			fmt.Println("  list <colección> - Listar todos los documentos de una colección")
 			fmt.Println("  backup - Crear una copia de seguridad de la base de datos")
 			fmt.Println("  restore <nombre_backup> - Restaurar la base de datos desde una copia de seguridad")
 			fmt.Println("  list_backups - Listar todas las copias de seguridad disponibles")
 			fmt.Println("  sync - Sincronizar todos los documentos con la red")
+			fmt.Println("  join [peer_id] - Copiar los datos de un peer, o del más cercano, sin admitir escrituras hasta terminar")
+			fmt.Println("  join_status - Mostrar el progreso de la incorporación del nodo")
+			fmt.Println("  join_override - Admitir escrituras tras una incorporación fallida")
 			fmt.Println("  exit - Salir del programa")
 		}
 	}
 }
 
+// runMigrateStorage convierte el directorio de datos a otro motor de
+// almacenamiento. El nodo debe estar detenido.
+func runMigrateStorage(args []string) {
+	flags := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Ruta al archivo de configuración")
+	dataDir := flags.String("data-dir", "", "Directorio de datos (anula la configuración)")
+	target := flags.String("to", "", "Motor de destino: file o segment")
+	flags.Parse(args)
+
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "Uso: dbp2p migrate-storage -to <file|segment> [-config config.yaml] [-data-dir ./data]")
+		os.Exit(2)
+	}
+
+	if *dataDir == "" {
+		cfg, err := config.LoadConfig(*configFile)
+		if err != nil {
+			log.Printf("Error al cargar configuración: %v. Usando valores predeterminados.", err)
+			cfg = config.GetConfig()
+		}
+		*dataDir = cfg.General.DataDir
+	}
+
+	start := time.Now()
+	count, err := db.MigrateStorage(*dataDir, *target)
+	if err != nil {
+		log.Fatalf("Error al migrar el almacenamiento: %v", err)
+	}
+
+	fmt.Printf("Migrados %d documentos de %s al motor %s en %v\n", count, *dataDir, *target, time.Since(start).Round(time.Millisecond))
+	fmt.Printf("Recuerda establecer database.storage_engine: %q en la configuración\n", *target)
+}
+
+// runIdentity muestra, importa o rota la clave del nodo. Tras importarla o
+// rotarla el nodo arranca con otro ID, así que debe estar detenido.
+func runIdentity(args []string) {
+	flags := flag.NewFlagSet("identity", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Ruta al archivo de configuración")
+	dataDir := flags.String("data-dir", "", "Directorio de datos (anula la configuración)")
+	importFile := flags.String("import", "", "Archivo con la clave privada libp2p que se importa")
+	rotate := flags.Bool("rotate", false, "Generar una nueva clave para el nodo")
+	flags.Parse(args)
+
+	if *importFile != "" && *rotate {
+		fmt.Fprintln(os.Stderr, "Uso: dbp2p identity [-import <archivo> | -rotate] [-config config.yaml] [-data-dir ./data]")
+		os.Exit(2)
+	}
+
+	if *dataDir == "" {
+		cfg, err := config.LoadConfig(*configFile)
+		if err != nil {
+			log.Printf("Error al cargar configuración: %v. Usando valores predeterminados.", err)
+			cfg = config.GetConfig()
+		}
+		*dataDir = cfg.General.DataDir
+	}
+
+	switch {
+	case *importFile != "":
+		id, err := p2p.ImportIdentity(*dataDir, *importFile)
+		if err != nil {
+			log.Fatalf("Error al importar la clave del nodo: %v", err)
+		}
+		fmt.Printf("Clave importada. Nuevo ID del nodo: %s\n", id)
+	case *rotate:
+		id, err := p2p.RotateIdentity(*dataDir)
+		if err != nil {
+			log.Fatalf("Error al rotar la clave del nodo: %v", err)
+		}
+		fmt.Printf("Clave rotada. Nuevo ID del nodo: %s\n", id)
+		fmt.Println("Recuerda actualizar el ID en las ACL y listas de bootstrap de los demás nodos")
+	default:
+		id, err := p2p.IdentityID(*dataDir)
+		if err != nil {
+			log.Fatalf("Error al cargar la clave del nodo: %v", err)
+		}
+		fmt.Printf("ID del nodo: %s\n", id)
+	}
+}
+
+// runKeygen genera la clave precompartida de la red privada. Se copia el mismo
+// archivo a todos los nodos del clúster.
+func runKeygen(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Ruta al archivo de configuración")
+	out := flags.String("out", "", "Archivo de la clave (anula network.private_network.psk_file)")
+	force := flags.Bool("force", false, "Sobrescribir la clave si ya existe")
+	flags.Parse(args)
+
+	if *out == "" {
+		cfg, err := config.LoadConfig(*configFile)
+		if err != nil {
+			log.Printf("Error al cargar configuración: %v. Usando valores predeterminados.", err)
+			cfg = config.GetConfig()
+		}
+		*out = p2p.PSKPath(cfg)
+	}
+
+	if err := p2p.GeneratePSK(*out, *force); err != nil {
+		log.Fatalf("Error al generar la clave de la red privada: %v", err)
+	}
+
+	fmt.Printf("Clave de la red privada guardada en %s\n", *out)
+	fmt.Println("Cópiala a todos los nodos del clúster y establece network.private_network.enabled: true")
+}
+
+// runDataKey muestra las claves de datos del clúster del nodo o genera una nueva.
+// Con el nodo parado; la nueva clave llega a los demás nodos cuando la usa.
+func runDataKey(args []string) {
+	flags := flag.NewFlagSet("datakey", flag.ExitOnError)
+	configFile := flags.String("config", "config.yaml", "Ruta al archivo de configuración")
+	dataDir := flags.String("data-dir", "", "Directorio de datos (anula la configuración)")
+	rotate := flags.Bool("rotate", false, "Generar una nueva clave de datos")
+	flags.Parse(args)
+
+	cfg, err := config.LoadConfig(*configFile)
+	if err != nil {
+		log.Printf("Error al cargar configuración: %v. Usando valores predeterminados.", err)
+		cfg = config.GetConfig()
+	}
+	if *dataDir == "" {
+		*dataDir = cfg.General.DataDir
+	}
+
+	retention := time.Duration(cfg.Sync.Encryption.KeyRetention) * time.Second
+	crypto, err := p2p.LoadCryptoService(p2p.DataKeysPath(*dataDir), retention)
+	if err != nil {
+		log.Fatalf("Error al cargar las claves de datos: %v", err)
+	}
+
+	if *rotate {
+		id, err := crypto.RotateKey()
+		if err != nil {
+			log.Fatalf("Error al rotar la clave de datos: %v", err)
+		}
+		fmt.Printf("Nueva clave de datos: %s\n", id)
+	}
+
+	current := crypto.KeyID()
+	for _, key := range crypto.Keys() {
+		mark := " "
+		if key.ID == current {
+			mark = "*"
+		}
+		fmt.Printf("%s %s  %s\n", mark, key.ID, key.Created.Format(time.RFC3339))
+	}
+}
+
 func waitForSignal() {
 
 	sigCh := make(chan os.Signal, 1)
@@ -3,18 +3,23 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aratan/dbp2p/pkg/auth"
 	"github.com/aratan/dbp2p/pkg/binary"
 	"github.com/aratan/dbp2p/pkg/db"
+	"github.com/aratan/dbp2p/pkg/p2p"
+	"github.com/aratan/dbp2p/pkg/raft"
 
 	"github.com/gorilla/mux"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // APIServer representa el servidor de la API REST
@@ -23,6 +28,10 @@ type APIServer struct {
 	authManager   *auth.AuthManager
 	router        *mux.Router
 	binaryManager *binary.BinaryManager
+	bootstrapper  *p2p.Bootstrapper
+	consensus     *p2p.Consensus
+	sharding      *p2p.Sharding
+	queries       *p2p.DistributedQuery
 }
 
 // NewAPIServer crea un nuevo servidor de API
@@ -39,6 +48,30 @@ func NewAPIServer(database *db.Database, authManager *auth.AuthManager) *APIServ
 	return server
 }
 
+// SetBootstrapper establece el servicio de incorporación del nodo, cuyo estado
+// se consulta y se inicia en /api/bootstrap
+func (s *APIServer) SetBootstrapper(bootstrapper *p2p.Bootstrapper) {
+	s.bootstrapper = bootstrapper
+}
+
+// SetConsensus establece el consenso de las colecciones de consistencia fuerte,
+// cuyo estado y miembros se gestionan en /api/consensus
+func (s *APIServer) SetConsensus(consensus *p2p.Consensus) {
+	s.consensus = consensus
+}
+
+// SetSharding establece el reparto de las colecciones fragmentadas, cuyo estado
+// se consulta en /api/sharding
+func (s *APIServer) SetSharding(sharding *p2p.Sharding) {
+	s.sharding = sharding
+}
+
+// SetQueries establece el servicio de consultas distribuidas, que atiende las
+// consultas de las colecciones con ?scope=cluster
+func (s *APIServer) SetQueries(queries *p2p.DistributedQuery) {
+	s.queries = queries
+}
+
 // setupRoutes configura las rutas de la API
 func (s *APIServer) setupRoutes() {
 	// Rutas públicas
@@ -73,6 +106,13 @@ func (s *APIServer) setupRoutes() {
 	api.HandleFunc("/collections", s.handleListCollections).Methods("GET")
 	api.HandleFunc("/collections/{collection}", s.handleGetCollection).Methods("GET")
 	api.HandleFunc("/collections/{collection}", s.handleCreateDocument).Methods("POST")
+	api.HandleFunc("/collections/{collection}/aggregate", s.handleAggregate).Methods("POST")
+	api.HandleFunc("/collections/{collection}/schema", s.handleGetSchema).Methods("GET")
+	api.HandleFunc("/collections/{collection}/schema", s.handleSetSchema).Methods("PUT")
+	api.HandleFunc("/collections/{collection}/schema", s.handleDeleteSchema).Methods("DELETE")
+	api.HandleFunc("/collections/{collection}/schema/validate", s.handleValidateCollection).Methods("GET", "POST")
+	api.HandleFunc("/collections/{collection}/crdt", s.handleGetCRDTSpec).Methods("GET")
+	api.HandleFunc("/collections/{collection}/crdt", s.handleSetCRDTSpec).Methods("PUT")
 	api.HandleFunc("/collections/{collection}/{id}", s.handleGetDocument).Methods("GET")
 	api.HandleFunc("/collections/{collection}/{id}", s.handleUpdateDocument).Methods("PUT")
 	api.HandleFunc("/collections/{collection}/{id}", s.handleDeleteDocument).Methods("DELETE")
@@ -82,6 +122,20 @@ func (s *APIServer) setupRoutes() {
 	api.HandleFunc("/backups", s.handleCreateBackup).Methods("POST")
 	api.HandleFunc("/backups/{name}", s.handleRestoreBackup).Methods("POST")
 	api.HandleFunc("/backups/{name}", s.handleDeleteBackup).Methods("DELETE")
+
+	// Rutas de incorporación del nodo (solo admin)
+	api.HandleFunc("/bootstrap", s.handleGetBootstrap).Methods("GET")
+	api.HandleFunc("/bootstrap", s.handleStartBootstrap).Methods("POST")
+	api.HandleFunc("/bootstrap/override", s.handleOverrideBootstrap).Methods("POST")
+
+	// Rutas del consenso de las colecciones de consistencia fuerte (solo admin)
+	api.HandleFunc("/consensus", s.handleGetConsensus).Methods("GET")
+	api.HandleFunc("/consensus/members", s.handleAddConsensusMember).Methods("POST")
+	api.HandleFunc("/consensus/members/{id}", s.handleRemoveConsensusMember).Methods("DELETE")
+
+	// Rutas de la fragmentación de colecciones (solo admin)
+	api.HandleFunc("/sharding", s.handleGetSharding).Methods("GET")
+	api.HandleFunc("/sharding/owners/{id}", s.handleGetShardOwners).Methods("GET")
 }
 
 // corsMiddleware es un middleware para manejar CORS
@@ -92,7 +146,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 
 		// Configurar otras cabeceras CORS
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 
 		// Manejar solicitudes OPTIONS (preflight)
@@ -175,7 +230,9 @@ func (s *APIServer) authMiddleware(next http.Handler) http.Handler {
 			} else {
 				resource = "*"
 			}
-		} else if strings.HasPrefix(path, "/api/users") || strings.HasPrefix(path, "/api/roles") || strings.HasPrefix(path, "/api/backups") {
+		} else if strings.HasPrefix(path, "/api/users") || strings.HasPrefix(path, "/api/roles") || strings.HasPrefix(path, "/api/backups") ||
+			strings.HasPrefix(path, "/api/bootstrap") || strings.HasPrefix(path, "/api/consensus") ||
+			strings.HasPrefix(path, "/api/sharding") {
 			resource = "admin"
 		} else {
 			resource = "*"
@@ -195,6 +252,11 @@ func (s *APIServer) authMiddleware(next http.Handler) http.Handler {
 			action = "*"
 		}
 
+		// Una agregación solo lee, aunque el pipeline se envíe por POST
+		if method == "POST" && strings.HasPrefix(path, "/api/collections/") && strings.HasSuffix(path, "/aggregate") {
+			action = "read"
+		}
+
 		// Verificar permiso
 		if !s.authManager.CheckUserPermission(user.ID, resource, action) {
 			http.Error(w, "Acceso prohibido", http.StatusForbidden)
@@ -342,7 +404,9 @@ func (s *APIServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 			"database": "running",
 			"p2p":      "running",
 		},
-		"cors": "enabled",
+		"cors":         "enabled",
+		"outbox_depth": s.db.OutboxDepth(),
+		"read_only":    s.db.IsReadOnly(),
 	})
 }
 
@@ -610,11 +674,33 @@ func (s *APIServer) handleListCollections(w http.ResponseWriter, r *http.Request
 	respondError(w, http.StatusNotImplemented, "Funcionalidad no implementada")
 }
 
-// handleGetCollection maneja la obtención de todos los documentos de una colección
+// handleGetCollection maneja la obtención de todos los documentos de una colección.
+// Con el parámetro search realiza una búsqueda de texto ordenada por relevancia.
 func (s *APIServer) handleGetCollection(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	collection := vars["collection"]
 
+	if r.URL.Query().Get("scope") == "cluster" {
+		s.handleClusterQuery(w, r, collection)
+		return
+	}
+
+	if search := r.URL.Query().Get("search"); search != "" {
+		query := db.NewQuery(collection).Where("", db.OperatorTEXT, search)
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+			query.Limit(limit)
+		}
+
+		docs, err := query.Execute(s.db)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, docs)
+		return
+	}
+
 	docs, err := s.db.GetAllDocuments(collection)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, err.Error())
@@ -624,6 +710,70 @@ func (s *APIServer) handleGetCollection(w http.ResponseWriter, r *http.Request)
 	respondJSON(w, http.StatusOK, docs)
 }
 
+// handleClusterQuery maneja la consulta de una colección sobre los documentos de
+// todos los nodos. Admite los parámetros filter (condición en JSON con el formato
+// de las consultas), search, sort (campo, o -campo para orden descendente), skip,
+// limit y timeout (milisegundos de espera a cada nodo).
+func (s *APIServer) handleClusterQuery(w http.ResponseWriter, r *http.Request, collection string) {
+	if s.queries == nil {
+		respondError(w, http.StatusServiceUnavailable, "Las consultas distribuidas no están habilitadas")
+		return
+	}
+
+	params := r.URL.Query()
+	query := db.NewQuery(collection)
+
+	var conditions []interface{}
+	if filter := params.Get("filter"); filter != "" {
+		var condition interface{}
+		if err := json.Unmarshal([]byte(filter), &condition); err != nil {
+			respondError(w, http.StatusBadRequest, "Filtro no válido")
+			return
+		}
+		conditions = append(conditions, condition)
+	}
+	if search := params.Get("search"); search != "" {
+		conditions = append(conditions, db.QueryCondition{Operator: db.OperatorTEXT, Value: search})
+	}
+	switch len(conditions) {
+	case 1:
+		query.Condition = conditions[0]
+	case 2:
+		query.And(conditions...)
+	}
+
+	for _, field := range params["sort"] {
+		if strings.HasPrefix(field, "-") {
+			query.Sort(strings.TrimPrefix(field, "-"), db.SortDescending)
+		} else {
+			query.Sort(field, db.SortAscending)
+		}
+	}
+	if skip, err := strconv.Atoi(params.Get("skip")); err == nil {
+		query.Skip(skip)
+	}
+	if limit, err := strconv.Atoi(params.Get("limit")); err == nil {
+		query.Limit(limit)
+	}
+
+	var timeout time.Duration
+	if ms, err := strconv.Atoi(params.Get("timeout")); err == nil {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	result, err := s.queries.Execute(query, timeout)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, db.ErrConsensusUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, result)
+}
+
 // handleCreateDocument maneja la creación de un documento
 func (s *APIServer) handleCreateDocument(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -637,13 +787,158 @@ func (s *APIServer) handleCreateDocument(w http.ResponseWriter, r *http.Request)
 
 	doc, err := s.db.CreateDocument(collection, data)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		if respondValidationError(w, err) {
+			return
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrReadOnly) || errors.Is(err, db.ErrConsensusUnavailable) || errors.Is(err, db.ErrShardUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		respondError(w, status, err.Error())
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, doc)
 }
 
+// handleAggregate maneja la ejecución de un pipeline de agregación sobre una colección
+func (s *APIServer) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	collection := vars["collection"]
+
+	var req struct {
+		Pipeline []db.AggregationStage `json:"pipeline"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Error al decodificar JSON")
+		return
+	}
+
+	// El pipeline lee también las colecciones que une con $lookup
+	user := s.getUserFromContext(r)
+	for _, from := range db.LookupCollections(req.Pipeline) {
+		if user == nil || !s.authManager.CheckUserPermission(user.ID, from, "read") {
+			respondError(w, http.StatusForbidden, fmt.Sprintf("Acceso prohibido a la colección %s", from))
+			return
+		}
+	}
+
+	results, err := s.db.Aggregate(collection, req.Pipeline)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, results)
+}
+
+// respondValidationError responde 400 con los campos que no cumplen el esquema si
+// el error es de validación, y devuelve si ha respondido
+func respondValidationError(w http.ResponseWriter, err error) bool {
+	var validationErr *db.SchemaValidationError
+	if !errors.As(err, &validationErr) {
+		return false
+	}
+
+	respondJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":  db.ErrSchemaValidation.Error(),
+		"errors": validationErr.Errors,
+	})
+	return true
+}
+
+// handleGetSchema maneja la obtención del esquema de una colección
+func (s *APIServer) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+
+	schema, exists := s.db.GetSchema(collection)
+	if !exists {
+		respondError(w, http.StatusNotFound, "La colección no tiene esquema")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, schema)
+}
+
+// handleSetSchema maneja la asignación del esquema de una colección
+func (s *APIServer) handleSetSchema(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+
+	var schema db.Schema
+	if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+		respondError(w, http.StatusBadRequest, "Error al decodificar JSON")
+		return
+	}
+
+	if err := s.db.SetSchema(collection, &schema); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, &schema)
+}
+
+// handleDeleteSchema maneja la eliminación del esquema de una colección
+func (s *APIServer) handleDeleteSchema(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+
+	if err := s.db.DeleteSchema(collection); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Esquema eliminado"})
+}
+
+// handleGetCRDTSpec maneja la obtención de los campos contador y conjunto de una colección
+func (s *APIServer) handleGetCRDTSpec(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+
+	respondJSON(w, http.StatusOK, s.db.GetCRDTSpec(collection))
+}
+
+// handleSetCRDTSpec maneja la declaración de los campos contador y conjunto de una colección
+func (s *APIServer) handleSetCRDTSpec(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+
+	var spec db.CRDTSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		respondError(w, http.StatusBadRequest, "Error al decodificar JSON")
+		return
+	}
+
+	if err := s.db.SetCRDTSpec(collection, spec); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, spec)
+}
+
+// handleValidateCollection valida los documentos existentes de una colección y
+// devuelve un informe sin modificarlos. Con POST se valida con el esquema del
+// cuerpo, por ejemplo antes de asignarlo; con GET, con el esquema de la colección.
+func (s *APIServer) handleValidateCollection(w http.ResponseWriter, r *http.Request) {
+	collection := mux.Vars(r)["collection"]
+
+	var schema *db.Schema
+	if r.Method == http.MethodPost {
+		schema = &db.Schema{}
+		if err := json.NewDecoder(r.Body).Decode(schema); err != nil {
+			respondError(w, http.StatusBadRequest, "Error al decodificar JSON")
+			return
+		}
+	}
+
+	report, err := s.db.ValidateCollection(collection, schema)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
 // handleGetDocument maneja la obtención de un documento
 func (s *APIServer) handleGetDocument(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -651,7 +946,18 @@ func (s *APIServer) handleGetDocument(w http.ResponseWriter, r *http.Request) {
 
 	doc, err := s.db.GetDocument(id)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err.Error())
+		status := http.StatusNotFound
+		if errors.Is(err, db.ErrConsensusUnavailable) || errors.Is(err, db.ErrShardUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		respondError(w, status, err.Error())
+		return
+	}
+
+	// Responder sin contenido si el cliente ya tiene la revisión actual
+	w.Header().Set("ETag", documentETag(doc))
+	if matchesETag(r.Header.Get("If-None-Match"), doc) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
@@ -669,12 +975,29 @@ func (s *APIServer) handleUpdateDocument(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	doc, err := s.db.UpdateDocument(id, data)
+	options, ok := s.ifMatchOptions(w, r, id)
+	if !ok {
+		return
+	}
+
+	doc, err := s.db.UpdateDocument(id, data, options...)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+		if respondValidationError(w, err) {
+			return
+		}
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrInvalidUpdate) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, db.ErrRevisionConflict) {
+			status = http.StatusPreconditionFailed
+		} else if errors.Is(err, db.ErrReadOnly) || errors.Is(err, db.ErrConsensusUnavailable) || errors.Is(err, db.ErrShardUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		respondError(w, status, err.Error())
 		return
 	}
 
+	w.Header().Set("ETag", documentETag(doc))
 	respondJSON(w, http.StatusOK, doc)
 }
 
@@ -683,14 +1006,71 @@ func (s *APIServer) handleDeleteDocument(w http.ResponseWriter, r *http.Request)
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	if err := s.db.DeleteDocument(id); err != nil {
-		respondError(w, http.StatusInternalServerError, err.Error())
+	options, ok := s.ifMatchOptions(w, r, id)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteDocument(id, options...); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrRevisionConflict) {
+			status = http.StatusPreconditionFailed
+		} else if errors.Is(err, db.ErrReadOnly) || errors.Is(err, db.ErrConsensusUnavailable) || errors.Is(err, db.ErrShardUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
+		respondError(w, status, err.Error())
 		return
 	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"message": "Documento eliminado"})
 }
 
+// documentETag devuelve la ETag de un documento, basada en su revisión
+func documentETag(doc *db.Document) string {
+	return fmt.Sprintf("\"%d\"", doc.Revision)
+}
+
+// matchesETag indica si una cabecera If-Match o If-None-Match incluye la
+// revisión del documento (o es "*")
+func matchesETag(header string, doc *db.Document) bool {
+	if header == "" {
+		return false
+	}
+
+	etag := documentETag(doc)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchOptions convierte la cabecera If-Match en una escritura condicional a la
+// revisión actual del documento. Si la cabecera no coincide responde 412 y devuelve false.
+func (s *APIServer) ifMatchOptions(w http.ResponseWriter, r *http.Request, id string) ([]db.WriteOption, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil, true
+	}
+
+	doc, err := s.db.GetDocument(id)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+
+	if !matchesETag(header, doc) {
+		w.Header().Set("ETag", documentETag(doc))
+		respondError(w, http.StatusPreconditionFailed, "La revisión del documento no coincide con If-Match")
+		return nil, false
+	}
+
+	// La escritura falla si el documento cambia entre la comprobación y la escritura
+	return []db.WriteOption{db.IfRevision(doc.Revision)}, true
+}
+
 // Manejadores de backup y restauración
 
 // handleListBackups maneja la obtención de todas las copias de seguridad
@@ -741,6 +1121,164 @@ func (s *APIServer) handleDeleteBackup(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"message": "Copia de seguridad eliminada"})
 }
 
+// Manejadores de incorporación del nodo
+
+// handleGetBootstrap maneja la consulta del progreso de la incorporación
+func (s *APIServer) handleGetBootstrap(w http.ResponseWriter, r *http.Request) {
+	if s.bootstrapper == nil {
+		respondError(w, http.StatusServiceUnavailable, "La incorporación del nodo no está disponible")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.bootstrapper.Progress())
+}
+
+// handleStartBootstrap maneja el inicio de la incorporación del nodo a partir
+// de la instantánea del peer indicado, o del más cercano si no se indica
+func (s *APIServer) handleStartBootstrap(w http.ResponseWriter, r *http.Request) {
+	if s.bootstrapper == nil {
+		respondError(w, http.StatusServiceUnavailable, "La incorporación del nodo no está disponible")
+		return
+	}
+
+	var req struct {
+		Peer string `json:"peer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, "Error al decodificar JSON")
+		return
+	}
+
+	var pid peer.ID
+	if req.Peer != "" {
+		var err error
+		if pid, err = peer.Decode(req.Peer); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("ID de peer no válido: %v", err))
+			return
+		}
+	}
+
+	if err := s.bootstrapper.StartJoin(pid); err != nil {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusAccepted, s.bootstrapper.Progress())
+}
+
+// handleOverrideBootstrap maneja la habilitación de las escrituras tras una
+// incorporación fallida
+func (s *APIServer) handleOverrideBootstrap(w http.ResponseWriter, r *http.Request) {
+	if s.bootstrapper == nil {
+		respondError(w, http.StatusServiceUnavailable, "La incorporación del nodo no está disponible")
+		return
+	}
+
+	if err := s.bootstrapper.Override(); err != nil {
+		respondError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.bootstrapper.Progress())
+}
+
+// Manejadores del consenso
+
+// handleGetConsensus maneja la consulta del estado del grupo de consenso
+func (s *APIServer) handleGetConsensus(w http.ResponseWriter, r *http.Request) {
+	if s.consensus == nil {
+		respondError(w, http.StatusServiceUnavailable, "El consenso no está habilitado")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.consensus.Status())
+}
+
+// handleAddConsensusMember maneja la incorporación de un nodo al grupo de
+// consenso, con voto salvo que se indique lo contrario
+func (s *APIServer) handleAddConsensusMember(w http.ResponseWriter, r *http.Request) {
+	if s.consensus == nil {
+		respondError(w, http.StatusServiceUnavailable, "El consenso no está habilitado")
+		return
+	}
+
+	var req struct {
+		ID    string `json:"id"`
+		Voter *bool  `json:"voter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Error al decodificar JSON")
+		return
+	}
+	if req.ID == "" {
+		respondError(w, http.StatusBadRequest, "Falta el ID del nodo")
+		return
+	}
+
+	voter := req.Voter == nil || *req.Voter
+	if err := s.consensus.AddMember(req.ID, voter); err != nil {
+		respondError(w, consensusErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.consensus.Status())
+}
+
+// handleRemoveConsensusMember maneja la salida de un nodo del grupo de consenso
+func (s *APIServer) handleRemoveConsensusMember(w http.ResponseWriter, r *http.Request) {
+	if s.consensus == nil {
+		respondError(w, http.StatusServiceUnavailable, "El consenso no está habilitado")
+		return
+	}
+
+	if err := s.consensus.RemoveMember(mux.Vars(r)["id"]); err != nil {
+		respondError(w, consensusErrorStatus(err), err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.consensus.Status())
+}
+
+// consensusErrorStatus devuelve el código HTTP de un error de cambio de miembros
+func consensusErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, raft.ErrConfigChangePending):
+		return http.StatusConflict
+	case errors.Is(err, raft.ErrLeaderOnly):
+		return http.StatusMisdirectedRequest
+	case errors.Is(err, raft.ErrNoLeader), errors.Is(err, raft.ErrStopped), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Manejadores de la fragmentación
+
+// handleGetSharding maneja la consulta del estado de la fragmentación
+func (s *APIServer) handleGetSharding(w http.ResponseWriter, r *http.Request) {
+	if s.sharding == nil {
+		respondError(w, http.StatusServiceUnavailable, "La fragmentación no está habilitada")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, s.sharding.Status())
+}
+
+// handleGetShardOwners maneja la consulta de los nodos que guardan un documento
+func (s *APIServer) handleGetShardOwners(w http.ResponseWriter, r *http.Request) {
+	if s.sharding == nil {
+		respondError(w, http.StatusServiceUnavailable, "La fragmentación no está habilitada")
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	respondJSON(w, http.StatusOK, map[string]any{
+		"id":     id,
+		"owners": s.sharding.Owners(id),
+	})
+}
+
 // Manejadores de recuperación de contraseñas
 
 // handleForgotPassword maneja la solicitud de recuperación de contraseña
@@ -3,10 +3,12 @@ package binary
 import (
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,13 +24,25 @@ type FileMetadata struct {
 	Metadata   map[string]string `json:"metadata,omitempty"`
 	CreatedAt  time.Time         `json:"created_at"`
 	UpdatedAt  time.Time         `json:"updated_at"`
+	Manifest   *Manifest         `json:"manifest,omitempty"` // Fragmentos del contenido; nulo en los archivos anteriores
 }
 
-// BinaryManager gestiona el almacenamiento de archivos binarios
+// FetchFunc obtiene de otros nodos un archivo que falta en el nodo
+type FetchFunc func(id string) error
+
+// BinaryManager gestiona el almacenamiento de archivos binarios. El contenido
+// se guarda en fragmentos direccionados por su SHA-256, compartidos entre los
+// archivos iguales, y los metadatos incluyen el manifiesto con sus fragmentos.
 type BinaryManager struct {
-	storageDir  string
-	metadataDir string
-	compression bool
+	storageDir     string
+	metadataDir    string
+	chunkDir       string
+	chunkSize      int
+	compression    bool
+	fetcher        FetchFunc
+	storeCallbacks []func(*FileMetadata)
+	callbackMutex  sync.RWMutex
+	mutex          sync.RWMutex // Excluye la eliminación de fragmentos mientras se escriben
 }
 
 // StoreOption representa una opción para almacenar un archivo
@@ -60,6 +74,15 @@ func WithCompression(enabled bool) BinaryManagerOption {
 	}
 }
 
+// WithChunkSize establece el tamaño de los fragmentos de los archivos nuevos
+func WithChunkSize(size int) BinaryManagerOption {
+	return func(m *BinaryManager) {
+		if size > 0 && size <= maxChunkSize {
+			m.chunkSize = size
+		}
+	}
+}
+
 // BinaryManagerOption representa una opción para el gestor de binarios
 type BinaryManagerOption func(*BinaryManager)
 
@@ -75,9 +98,16 @@ func NewBinaryManager(storageDir string, opts ...BinaryManagerOption) (*BinaryMa
 		return nil, fmt.Errorf("error al crear directorio de metadatos: %v", err)
 	}
 
+	chunkDir := filepath.Join(storageDir, "chunks")
+	if err := os.MkdirAll(chunkDir, 0755); err != nil {
+		return nil, fmt.Errorf("error al crear directorio de fragmentos: %v", err)
+	}
+
 	manager := &BinaryManager{
 		storageDir:  storageDir,
 		metadataDir: metadataDir,
+		chunkDir:    chunkDir,
+		chunkSize:   DefaultChunkSize,
 		compression: false,
 	}
 
@@ -103,42 +133,12 @@ func (m *BinaryManager) StoreFile(reader io.Reader, filename, mimeType string, o
 	// Generar ID único
 	id := uuid.New().String()
 
-	// Crear directorio de colección si no existe
-	collectionDir := filepath.Join(m.storageDir, options.collection)
-	if err := os.MkdirAll(collectionDir, 0755); err != nil {
-		return nil, fmt.Errorf("error al crear directorio de colección: %v", err)
-	}
-
-	// Ruta del archivo
-	filePath := filepath.Join(collectionDir, id)
-
-	// Crear archivo
-	file, err := os.Create(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("error al crear archivo: %v", err)
-	}
-	defer file.Close()
-
-	// Preparar escritor (con compresión si está habilitada)
-	var writer io.Writer = file
-	var gzipWriter *gzip.Writer
-	if m.compression {
-		gzipWriter = gzip.NewWriter(file)
-		writer = gzipWriter
-		defer gzipWriter.Close()
-	}
-
-	// Copiar contenido
-	size, err := io.Copy(writer, reader)
+	// Guardar el contenido en fragmentos
+	m.mutex.RLock()
+	manifest, size, err := m.storeChunks(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error al escribir archivo: %v", err)
-	}
-
-	// Cerrar escritor gzip si se está usando
-	if gzipWriter != nil {
-		if err := gzipWriter.Close(); err != nil {
-			return nil, fmt.Errorf("error al cerrar escritor gzip: %v", err)
-		}
+		m.mutex.RUnlock()
+		return nil, err
 	}
 
 	// Crear metadatos
@@ -152,24 +152,48 @@ func (m *BinaryManager) StoreFile(reader io.Reader, filename, mimeType string, o
 		Metadata:   options.metadata,
 		CreatedAt:  now,
 		UpdatedAt:  now,
+		Manifest:   manifest,
 	}
 
 	// Guardar metadatos
-	if err := m.saveMetadata(metadata); err != nil {
+	err = m.saveMetadata(metadata)
+	m.mutex.RUnlock()
+	if err != nil {
 		return nil, fmt.Errorf("error al guardar metadatos: %v", err)
 	}
 
+	// Notificar el nuevo archivo
+	m.callbackMutex.RLock()
+	callbacks := m.storeCallbacks
+	m.callbackMutex.RUnlock()
+	for _, callback := range callbacks {
+		callback(metadata)
+	}
+
 	return metadata, nil
 }
 
-// GetFile recupera un archivo por su ID
+// GetFile recupera un archivo por su ID. Si el nodo no lo tiene completo y hay
+// un FetchFunc, lo obtiene antes de otros nodos.
 func (m *BinaryManager) GetFile(id string) (io.ReadCloser, *FileMetadata, error) {
 	// Obtener metadatos
-	metadata, err := m.getMetadata(id)
+	metadata, err := m.localFile(id)
+	if fetcher := m.getFetcher(); fetcher != nil && (errors.Is(err, ErrFileNotFound) || errors.Is(err, ErrIncompleteFile)) {
+		if err := fetcher(id); err != nil {
+			return nil, nil, fmt.Errorf("error al obtener archivo de otros nodos: %v", err)
+		}
+		metadata, err = m.localFile(id)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
+	// Leer los fragmentos
+	if metadata.Manifest != nil {
+		chunks := append([]ChunkRef(nil), metadata.Manifest.Chunks...)
+		return &chunkReader{manager: m, chunks: chunks}, metadata, nil
+	}
+
 	// Ruta del archivo
 	filePath := filepath.Join(m.storageDir, metadata.Collection, id)
 
@@ -216,12 +240,15 @@ func (m *BinaryManager) DeleteFile(id string) error {
 		return err
 	}
 
-	// Ruta del archivo
-	filePath := filepath.Join(m.storageDir, metadata.Collection, id)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	// Eliminar archivo
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("error al eliminar archivo: %v", err)
+	if metadata.Manifest == nil {
+		filePath := filepath.Join(m.storageDir, metadata.Collection, id)
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("error al eliminar archivo: %v", err)
+		}
 	}
 
 	// Eliminar metadatos
@@ -230,6 +257,11 @@ func (m *BinaryManager) DeleteFile(id string) error {
 		return fmt.Errorf("error al eliminar metadatos: %v", err)
 	}
 
+	// Eliminar los fragmentos que ya no usa ningún archivo
+	if metadata.Manifest != nil {
+		return m.deleteChunks(metadata.Manifest)
+	}
+
 	return nil
 }
 
@@ -284,6 +316,9 @@ func (m *BinaryManager) getMetadata(id string) (*FileMetadata, error) {
 
 	// Leer archivo
 	data, err := os.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error al leer metadatos: %v", err)
 	}
@@ -321,3 +356,74 @@ func (m *BinaryManager) UpdateMetadata(id string, updates map[string]string) (*F
 
 	return metadata, nil
 }
+
+// GetMetadata devuelve los metadatos de un archivo, aunque al nodo le falten
+// fragmentos
+func (m *BinaryManager) GetMetadata(id string) (*FileMetadata, error) {
+	return m.getMetadata(id)
+}
+
+// localFile devuelve los metadatos de un archivo si el nodo lo tiene completo
+func (m *BinaryManager) localFile(id string) (*FileMetadata, error) {
+	metadata, err := m.getMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.MissingChunks(metadata)) > 0 {
+		return metadata, ErrIncompleteFile
+	}
+	return metadata, nil
+}
+
+// HasFile indica si el nodo tiene completo un archivo
+func (m *BinaryManager) HasFile(id string) bool {
+	_, err := m.localFile(id)
+	return err == nil
+}
+
+// ImportMetadata guarda los metadatos de un archivo de otro nodo, cuyos
+// fragmentos se obtienen después. No sustituye un archivo que ya existe.
+func (m *BinaryManager) ImportMetadata(metadata *FileMetadata) error {
+	if metadata.Manifest == nil {
+		return fmt.Errorf("archivo sin manifiesto: %s", metadata.ID)
+	}
+	if err := uuid.Validate(metadata.ID); err != nil {
+		return fmt.Errorf("ID de archivo no válido: %s", metadata.ID)
+	}
+	if metadata.Collection == "" || metadata.Collection != filepath.Base(metadata.Collection) {
+		return fmt.Errorf("colección no válida: %s", metadata.Collection)
+	}
+	if err := metadata.Manifest.Validate(metadata.Size); err != nil {
+		return fmt.Errorf("manifiesto no válido: %v", err)
+	}
+
+	if existing, err := m.getMetadata(metadata.ID); err == nil {
+		if existing.Manifest == nil || existing.Manifest.Root != metadata.Manifest.Root {
+			return fmt.Errorf("el archivo %s ya existe con otro contenido", metadata.ID)
+		}
+		return nil
+	}
+	return m.saveMetadata(metadata)
+}
+
+// SetFetcher establece cómo se obtienen los archivos que faltan en el nodo
+func (m *BinaryManager) SetFetcher(fetcher FetchFunc) {
+	m.callbackMutex.Lock()
+	defer m.callbackMutex.Unlock()
+	m.fetcher = fetcher
+}
+
+// getFetcher devuelve la función que obtiene los archivos que faltan
+func (m *BinaryManager) getFetcher() FetchFunc {
+	m.callbackMutex.RLock()
+	defer m.callbackMutex.RUnlock()
+	return m.fetcher
+}
+
+// RegisterStoreCallback registra una función a la que se llama con cada archivo
+// que se almacena en el nodo
+func (m *BinaryManager) RegisterStoreCallback(callback func(*FileMetadata)) {
+	m.callbackMutex.Lock()
+	defer m.callbackMutex.Unlock()
+	m.storeCallbacks = append(m.storeCallbacks, callback)
+}
@@ -0,0 +1,352 @@
+package binary
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultChunkSize tamaño predeterminado de los fragmentos de un archivo
+const DefaultChunkSize = 256 << 10
+
+// maxChunkSize tamaño máximo de un fragmento, también para los manifiestos
+// recibidos de otros nodos
+const maxChunkSize = 16 << 20
+
+var (
+	// ErrFileNotFound indica que el nodo no tiene los metadatos de un archivo
+	ErrFileNotFound = errors.New("archivo no encontrado")
+	// ErrIncompleteFile indica que faltan fragmentos de un archivo en el nodo
+	ErrIncompleteFile = errors.New("faltan fragmentos del archivo")
+)
+
+// ChunkRef referencia a un fragmento de un archivo por su contenido
+type ChunkRef struct {
+	Hash string `json:"hash"` // SHA-256 del contenido en hexadecimal
+	Size int    `json:"size"`
+}
+
+// Manifest lista los fragmentos de un archivo en orden. La raíz es el SHA-256
+// de los hashes de los fragmentos concatenados, e identifica el contenido del
+// archivo completo.
+type Manifest struct {
+	Root      string     `json:"root"`
+	ChunkSize int        `json:"chunk_size"`
+	Chunks    []ChunkRef `json:"chunks"`
+}
+
+// manifestRoot calcula la raíz de una lista de fragmentos
+func manifestRoot(chunks []ChunkRef) (string, error) {
+	h := sha256.New()
+	for _, chunk := range chunks {
+		sum, err := hex.DecodeString(chunk.Hash)
+		if err != nil || len(sum) != sha256.Size {
+			return "", fmt.Errorf("hash de fragmento no válido: %s", chunk.Hash)
+		}
+		h.Write(sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Validate comprueba que el manifiesto es coherente con el tamaño del archivo y
+// que la raíz corresponde a sus fragmentos
+func (m *Manifest) Validate(size int64) error {
+	if m.ChunkSize <= 0 || m.ChunkSize > maxChunkSize {
+		return fmt.Errorf("tamaño de fragmento no válido: %d", m.ChunkSize)
+	}
+
+	var total int64
+	for i, chunk := range m.Chunks {
+		if chunk.Size <= 0 || chunk.Size > m.ChunkSize {
+			return fmt.Errorf("tamaño no válido del fragmento %d: %d", i, chunk.Size)
+		}
+		if chunk.Size < m.ChunkSize && i < len(m.Chunks)-1 {
+			return fmt.Errorf("fragmento %d incompleto en medio del archivo", i)
+		}
+		total += int64(chunk.Size)
+	}
+	if total != size {
+		return fmt.Errorf("los fragmentos suman %d bytes y el archivo tiene %d", total, size)
+	}
+
+	root, err := manifestRoot(m.Chunks)
+	if err != nil {
+		return err
+	}
+	if root != m.Root {
+		return fmt.Errorf("la raíz del manifiesto no corresponde a sus fragmentos")
+	}
+	return nil
+}
+
+// chunkHash devuelve el hash con el que se direcciona un fragmento
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validChunkHash comprueba que un hash tiene el formato de los fragmentos, para
+// no usar como ruta lo que envía otro nodo
+func validChunkHash(hash string) bool {
+	sum, err := hex.DecodeString(hash)
+	return err == nil && len(sum) == sha256.Size && hash == hex.EncodeToString(sum)
+}
+
+// chunkPath devuelve la ruta de un fragmento; los comprimidos llevan la
+// extensión .gz
+func (m *BinaryManager) chunkPath(hash string, compressed bool) string {
+	path := filepath.Join(m.chunkDir, hash[:2], hash)
+	if compressed {
+		path += ".gz"
+	}
+	return path
+}
+
+// HasChunk indica si el nodo tiene un fragmento
+func (m *BinaryManager) HasChunk(hash string) bool {
+	if !validChunkHash(hash) {
+		return false
+	}
+	for _, compressed := range []bool{false, true} {
+		if _, err := os.Stat(m.chunkPath(hash, compressed)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadChunk lee un fragmento y comprueba su contenido. Un fragmento dañado se
+// elimina para que se vuelva a obtener de otro nodo.
+func (m *BinaryManager) ReadChunk(hash string) ([]byte, error) {
+	if !validChunkHash(hash) {
+		return nil, fmt.Errorf("hash de fragmento no válido: %s", hash)
+	}
+
+	data, err := os.ReadFile(m.chunkPath(hash, false))
+	corrupt := false
+	if os.IsNotExist(err) {
+		data, corrupt, err = readGzipFile(m.chunkPath(hash, true))
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("fragmento no encontrado: %s", hash)
+	}
+	if err != nil && !corrupt {
+		return nil, fmt.Errorf("error al leer fragmento %s: %v", hash, err)
+	}
+
+	if corrupt || chunkHash(data) != hash {
+		os.Remove(m.chunkPath(hash, false))
+		os.Remove(m.chunkPath(hash, true))
+		return nil, fmt.Errorf("fragmento dañado: %s", hash)
+	}
+	return data, nil
+}
+
+// readGzipFile lee y descomprime un archivo. Indica si el error se debe a que
+// el contenido no se puede descomprimir.
+func readGzipFile(path string) ([]byte, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, true, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, maxChunkSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+	return data, false, nil
+}
+
+// PutChunk guarda un fragmento recibido de otro nodo tras comprobar que su
+// contenido corresponde al hash
+func (m *BinaryManager) PutChunk(hash string, data []byte) error {
+	if !validChunkHash(hash) {
+		return fmt.Errorf("hash de fragmento no válido: %s", hash)
+	}
+	if len(data) > maxChunkSize {
+		return fmt.Errorf("fragmento demasiado grande: %d bytes", len(data))
+	}
+	if chunkHash(data) != hash {
+		return fmt.Errorf("el contenido del fragmento no corresponde a su hash %s", hash)
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.writeChunk(hash, data)
+}
+
+// writeChunk guarda un fragmento si no existe. Se escribe en un archivo temporal
+// y se renombra, de modo que un fragmento a medias nunca pasa por completo.
+// Debe llamarse con el mutex del gestor bloqueado para lectura.
+func (m *BinaryManager) writeChunk(hash string, data []byte) error {
+	if m.HasChunk(hash) {
+		return nil
+	}
+
+	path := m.chunkPath(hash, m.compression)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de fragmentos: %v", err)
+	}
+
+	content := data
+	if m.compression {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return fmt.Errorf("error al comprimir fragmento: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("error al comprimir fragmento: %v", err)
+		}
+		content = buf.Bytes()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error al crear fragmento: %v", err)
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error al escribir fragmento: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error al escribir fragmento: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error al guardar fragmento: %v", err)
+	}
+	return nil
+}
+
+// storeChunks divide el contenido en fragmentos, los guarda y devuelve el
+// manifiesto y el tamaño total
+func (m *BinaryManager) storeChunks(reader io.Reader) (*Manifest, int64, error) {
+	manifest := &Manifest{ChunkSize: m.chunkSize, Chunks: []ChunkRef{}}
+	buf := make([]byte, m.chunkSize)
+
+	var size int64
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			hash := chunkHash(buf[:n])
+			if err := m.writeChunk(hash, buf[:n]); err != nil {
+				return nil, 0, err
+			}
+			manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: hash, Size: n})
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("error al leer archivo: %v", err)
+		}
+	}
+
+	root, err := manifestRoot(manifest.Chunks)
+	if err != nil {
+		return nil, 0, err
+	}
+	manifest.Root = root
+	return manifest, size, nil
+}
+
+// MissingChunks devuelve los fragmentos de un archivo que no tiene el nodo
+func (m *BinaryManager) MissingChunks(metadata *FileMetadata) []ChunkRef {
+	if metadata.Manifest == nil {
+		return nil
+	}
+
+	var missing []ChunkRef
+	seen := make(map[string]bool)
+	for _, chunk := range metadata.Manifest.Chunks {
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+		if !m.HasChunk(chunk.Hash) {
+			missing = append(missing, chunk)
+		}
+	}
+	return missing
+}
+
+// deleteChunks elimina los fragmentos de un archivo que no usa ningún otro.
+// Debe llamarse con el mutex del gestor bloqueado.
+func (m *BinaryManager) deleteChunks(manifest *Manifest) error {
+	files, err := m.ListFiles("")
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, file := range files {
+		if file.Manifest == nil {
+			continue
+		}
+		for _, chunk := range file.Manifest.Chunks {
+			used[chunk.Hash] = true
+		}
+	}
+
+	for _, chunk := range manifest.Chunks {
+		if used[chunk.Hash] {
+			continue
+		}
+		for _, compressed := range []bool{false, true} {
+			if err := os.Remove(m.chunkPath(chunk.Hash, compressed)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error al eliminar fragmento: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// chunkReader lee el contenido de un archivo fragmento a fragmento,
+// comprobando cada uno al leerlo
+type chunkReader struct {
+	manager *BinaryManager
+	chunks  []ChunkRef
+	current []byte
+}
+
+// Read implementa io.Reader
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := r.manager.ReadChunk(r.chunks[0].Hash)
+		if err != nil {
+			return 0, err
+		}
+		r.current = data
+		r.chunks = r.chunks[1:]
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close implementa io.Closer
+func (r *chunkReader) Close() error {
+	r.chunks = nil
+	r.current = nil
+	return nil
+}
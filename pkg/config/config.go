@@ -1,9 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"slices"
 	"sync"
 
 	"gopkg.in/yaml.v3"
@@ -31,6 +33,9 @@ type Config struct {
 	} `yaml:"websocket"`
 
 	Database struct {
+		StorageEngine        string `yaml:"storage_engine"`         // "file" o "segment"; vacío usa el del directorio de datos
+		TombstoneGracePeriod int    `yaml:"tombstone_grace_period"` // Segundos mínimos que se conservan las eliminaciones
+
 		Backup struct {
 			AutoBackup bool `yaml:"auto_backup"`
 			Interval   int  `yaml:"interval"`
@@ -39,6 +44,13 @@ type Config struct {
 	} `yaml:"database"`
 
 	Network struct {
+		ClusterID string `yaml:"cluster_id"` // Separa el servicio mDNS, los temas y el DHT de cada clúster
+
+		PrivateNetwork struct {
+			Enabled bool   `yaml:"enabled"`
+			PSKFile string `yaml:"psk_file"` // Clave precompartida de 256 bits; vacío usa swarm.key en el directorio de datos
+		} `yaml:"private_network"`
+
 		LibP2P struct {
 			ListenAddresses []string `yaml:"listen_addresses"`
 			BootstrapPeers  []string `yaml:"bootstrap_peers"`
@@ -57,6 +69,84 @@ type Config struct {
 		} `yaml:"dht"`
 	} `yaml:"network"`
 
+	Sync struct {
+		FullSyncInterval        int      `yaml:"full_sync_interval"`        // Segundos entre comparaciones de árboles Merkle
+		IncrementalSyncInterval int      `yaml:"incremental_sync_interval"` // Segundos entre sincronizaciones incrementales
+		BatchSize               int      `yaml:"batch_size"`
+		ResponseTimeout         int      `yaml:"response_timeout"` // Segundos de espera por cada respuesta
+		MaxRetries              int      `yaml:"max_retries"`
+		UseCompression          bool     `yaml:"use_compression"`
+		CompressionLevel        int      `yaml:"compression_level"`
+		CollectionPriorities    []string `yaml:"collection_priorities"`
+		ExcludedCollections     []string `yaml:"excluded_collections"`
+
+		Replication struct {
+			Publish   []string               `yaml:"publish"`   // Colecciones que el nodo envía; vacío para todas
+			Subscribe []string               `yaml:"subscribe"` // Colecciones que el nodo recibe; vacío para todas
+			Filters   map[string]interface{} `yaml:"filters"`   // Condición de los documentos replicados de cada colección
+		} `yaml:"replication"`
+
+		ACL struct {
+			Enabled     bool   `yaml:"enabled"`
+			DefaultRole string `yaml:"default_role"` // "writer", "reader" o vacío para rechazar los nodos no listados
+
+			Peers map[string]struct {
+				Role        string   `yaml:"role"`
+				Collections []string `yaml:"collections"` // Colecciones en las que puede escribir; vacío para todas
+				Operations  []string `yaml:"operations"`  // Sustituyen a las operaciones del rol
+			} `yaml:"peers"` // Permisos de cada nodo por su ID
+		} `yaml:"acl"`
+
+		Encryption struct {
+			Enabled          bool     `yaml:"enabled"`
+			Collections      []string `yaml:"collections"`       // Colecciones cifradas; vacío para todas
+			RotationInterval int      `yaml:"rotation_interval"` // Segundos tras los que se rota la clave de datos; 0 para no rotarla
+			KeyRetention     int      `yaml:"key_retention"`     // Segundos que se puede descifrar con una clave tras rotarla; 0 para siempre
+		} `yaml:"encryption"`
+
+		Binaries struct {
+			Enabled     bool              `yaml:"enabled"`
+			Mode        string            `yaml:"mode"`        // "lazy" (al leerlos) o "eager" (al anunciarse)
+			Collections map[string]string `yaml:"collections"` // Modo de cada colección; las demás usan mode
+			ChunkSize   int               `yaml:"chunk_size"`  // Bytes de cada fragmento de los archivos nuevos
+		} `yaml:"binaries"`
+
+		// Incorporación de los nodos nuevos a partir de una instantánea de un peer
+		Bootstrap struct {
+			Enabled     bool `yaml:"enabled"`      // Incorporarse al arrancar con la base de datos vacía
+			Indexes     bool `yaml:"indexes"`      // Copiar también las definiciones de los índices
+			Binaries    bool `yaml:"binaries"`     // Obtener también los archivos binarios
+			PeerTimeout int  `yaml:"peer_timeout"` // Segundos de espera a un peer; sin ninguno, el nodo es el primero
+			MaxAttempts int  `yaml:"max_attempts"`
+			BatchSize   int  `yaml:"batch_size"` // Documentos por trama de la instantánea
+		} `yaml:"bootstrap"`
+
+		// Colecciones de consistencia fuerte, cuyas escrituras confirma un grupo Raft
+		Consensus struct {
+			Enabled           bool     `yaml:"enabled"`
+			Collections       []string `yaml:"collections"`        // Colecciones cuyas escrituras pasan por el consenso
+			Members           []string `yaml:"members"`            // IDs de los nodos que forman el grupo al crearlo
+			LeaderReads       bool     `yaml:"leader_reads"`       // Lecturas linealizables, confirmadas con el líder
+			ElectionTimeout   int      `yaml:"election_timeout"`   // Milisegundos sin noticias del líder antes de convocar elecciones
+			HeartbeatInterval int      `yaml:"heartbeat_interval"` // Milisegundos entre latidos del líder
+			SnapshotThreshold int      `yaml:"snapshot_threshold"` // Entradas tras las que se compacta el log
+			ProposeTimeout    int      `yaml:"propose_timeout"`    // Segundos de espera a que se confirme una escritura
+		} `yaml:"consensus"`
+
+		// Colecciones repartidas entre los nodos con un anillo de hash consistente
+		Sharding struct {
+			Enabled           bool     `yaml:"enabled"`
+			Collections       []string `yaml:"collections"`        // Colecciones fragmentadas por el ID de sus documentos
+			ReplicationFactor int      `yaml:"replication_factor"` // Nodos que guardan cada documento
+			VirtualNodes      int      `yaml:"virtual_nodes"`      // Puntos de cada nodo en el anillo
+			RebalanceInterval int      `yaml:"rebalance_interval"` // Segundos entre revisiones de los miembros del anillo
+		} `yaml:"sharding"`
+		Query struct {
+			Enabled     bool `yaml:"enabled"`
+			PeerTimeout int  `yaml:"peer_timeout"` // Milisegundos de espera a la respuesta de cada nodo
+		} `yaml:"query"`
+	} `yaml:"sync"`
+
 	Auth struct {
 		JWT struct {
 			Secret     string `yaml:"secret"`
@@ -106,6 +196,20 @@ func LoadConfig(filePath string) (*Config, error) {
 	return &cfg, nil
 }
 
+// Validate comprueba que las opciones de la configuración sean compatibles entre sí
+func (c *Config) Validate() error {
+	// Las escrituras de una colección fuerte solo pasan por el consenso, y las de
+	// una fragmentada se envían a los propietarios del documento
+	if c.Sync.Consensus.Enabled && c.Sync.Sharding.Enabled {
+		for _, collection := range c.Sync.Consensus.Collections {
+			if slices.Contains(c.Sync.Sharding.Collections, collection) {
+				return fmt.Errorf("la colección %s no puede estar a la vez en sync.consensus.collections y en sync.sharding.collections", collection)
+			}
+		}
+	}
+	return nil
+}
+
 // GetConfig devuelve la configuración actual o crea una predeterminada
 func GetConfig() *Config {
 	configLock.RLock()
@@ -138,6 +242,8 @@ func GetConfig() *Config {
 	config.WebSocket.Port = 8081
 
 	// Database
+	config.Database.StorageEngine = "file"
+	config.Database.TombstoneGracePeriod = 604800
 	config.Database.Backup.AutoBackup = true
 	config.Database.Backup.Interval = 3600
 	config.Database.Backup.MaxBackups = 5
@@ -157,6 +263,46 @@ func GetConfig() *Config {
 	config.Network.DHT.Mode = "client"
 	config.Network.DHT.BootstrapInterval = 300
 
+	// Sync
+	config.Sync.FullSyncInterval = 600
+	config.Sync.IncrementalSyncInterval = 300
+	config.Sync.BatchSize = 100
+	config.Sync.ResponseTimeout = 30
+	config.Sync.MaxRetries = 3
+	config.Sync.UseCompression = true
+	config.Sync.CompressionLevel = 6
+	config.Sync.CollectionPriorities = []string{}
+	config.Sync.ExcludedCollections = []string{"_system"}
+	config.Sync.ACL.DefaultRole = "writer"
+	config.Sync.Encryption.RotationInterval = 604800
+	config.Sync.Encryption.KeyRetention = 86400
+	config.Sync.Binaries.Enabled = true
+	config.Sync.Binaries.Mode = "lazy"
+	config.Sync.Binaries.ChunkSize = 262144
+
+	config.Sync.Bootstrap.Enabled = true
+	config.Sync.Bootstrap.Indexes = true
+	config.Sync.Bootstrap.Binaries = false
+	config.Sync.Bootstrap.PeerTimeout = 15
+	config.Sync.Bootstrap.MaxAttempts = 3
+	config.Sync.Bootstrap.BatchSize = 500
+
+	config.Sync.Consensus.Enabled = false
+	config.Sync.Consensus.Collections = []string{}
+	config.Sync.Consensus.Members = []string{}
+	config.Sync.Consensus.ElectionTimeout = 1000
+	config.Sync.Consensus.HeartbeatInterval = 100
+	config.Sync.Consensus.SnapshotThreshold = 1024
+	config.Sync.Consensus.ProposeTimeout = 10
+
+	config.Sync.Sharding.Enabled = false
+	config.Sync.Sharding.Collections = []string{}
+	config.Sync.Sharding.ReplicationFactor = 3
+	config.Sync.Sharding.VirtualNodes = 64
+	config.Sync.Sharding.RebalanceInterval = 30
+	config.Sync.Query.Enabled = true
+	config.Sync.Query.PeerTimeout = 5000
+
 	// Auth
 	config.Auth.JWT.Secret = "dbp2p_secret_key"
 	config.Auth.JWT.Expiration = 86400
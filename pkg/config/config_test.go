@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+// TestValidateStrongShardedCollection comprueba que una colección no pueda ser a
+// la vez de consistencia fuerte y fragmentada
+func TestValidateStrongShardedCollection(t *testing.T) {
+	var cfg Config
+	cfg.Sync.Consensus.Enabled = true
+	cfg.Sync.Consensus.Collections = []string{"cuentas"}
+	cfg.Sync.Sharding.Enabled = true
+	cfg.Sync.Sharding.Collections = []string{"pedidos", "cuentas"}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("se aceptó una colección fuerte y fragmentada")
+	}
+
+	cfg.Sync.Sharding.Collections = []string{"pedidos"}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("error con colecciones distintas: %v", err)
+	}
+
+	// Las listas de una función deshabilitada no se tienen en cuenta
+	cfg.Sync.Sharding.Collections = []string{"cuentas"}
+	cfg.Sync.Sharding.Enabled = false
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("error con la fragmentación deshabilitada: %v", err)
+	}
+}
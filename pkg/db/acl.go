@@ -0,0 +1,203 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ACLRole rol de un nodo en la replicación
+type ACLRole string
+
+const (
+	// ACLRoleWriter puede crear, actualizar y eliminar documentos
+	ACLRoleWriter ACLRole = "writer"
+	// ACLRoleReader es una réplica de solo lectura: recibe pero no escribe
+	ACLRoleReader ACLRole = "reader"
+)
+
+// ACLRule permisos de un nodo en la replicación
+type ACLRule struct {
+	Role        ACLRole     `json:"role,omitempty"`
+	Collections []string    `json:"collections,omitempty"` // Colecciones en las que puede escribir; vacío para todas
+	Operations  []Operation `json:"operations,omitempty"`  // Sustituyen a las operaciones del rol
+}
+
+// ReplicationACL decide qué nodos pueden escribir en cada colección a través de
+// la replicación. Sin habilitar se aceptan las escrituras de cualquier nodo.
+type ReplicationACL struct {
+	Enabled     bool               `json:"enabled"`
+	DefaultRole ACLRole            `json:"default_role,omitempty"` // Rol de los nodos no listados; vacío los rechaza
+	Peers       map[string]ACLRule `json:"peers,omitempty"`        // Permisos de cada nodo por su ID
+}
+
+// Validate comprueba los roles, operaciones e IDs de nodo de la ACL
+func (a ReplicationACL) Validate() error {
+	if err := validateRole(a.DefaultRole); err != nil {
+		return err
+	}
+	for id, rule := range a.Peers {
+		if _, err := peer.Decode(id); err != nil {
+			return fmt.Errorf("ID de nodo no válido en la ACL %s: %v", id, err)
+		}
+		if err := validateRole(rule.Role); err != nil {
+			return fmt.Errorf("%v para el nodo %s", err, id)
+		}
+		for _, operation := range rule.Operations {
+			switch operation {
+			case OperationCreate, OperationUpdate, OperationDelete:
+			default:
+				return fmt.Errorf("operación no admitida en la ACL para el nodo %s: %s", id, operation)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRole comprueba que un rol sea conocido
+func validateRole(role ACLRole) error {
+	switch role {
+	case "", ACLRoleWriter, ACLRoleReader:
+		return nil
+	}
+	return fmt.Errorf("rol de replicación no válido: %s", role)
+}
+
+// rule devuelve los permisos de un nodo y si la ACL lo conoce
+func (a ReplicationACL) rule(peerID string) (ACLRule, bool) {
+	if rule, exists := a.Peers[peerID]; exists {
+		return rule, true
+	}
+	if a.DefaultRole != "" {
+		return ACLRule{Role: a.DefaultRole}, true
+	}
+	return ACLRule{}, false
+}
+
+// Knows indica si se aceptan mensajes de un nodo, aunque sea de solo lectura.
+// Solo los nodos conocidos pueden confirmar eliminaciones o anunciar colecciones.
+func (a ReplicationACL) Knows(peerID string) bool {
+	if !a.Enabled {
+		return true
+	}
+	_, known := a.rule(peerID)
+	return known
+}
+
+// Lists indica si el nodo aparece en la lista de la ACL. A diferencia de Knows,
+// no incluye a los nodos que solo se aceptan por el rol por defecto.
+func (a ReplicationACL) Lists(peerID string) bool {
+	if !a.Enabled {
+		return false
+	}
+	_, listed := a.Peers[peerID]
+	return listed
+}
+
+// Allows indica si un nodo puede realizar una operación en una colección
+func (a ReplicationACL) Allows(peerID string, operation Operation, collection string) bool {
+	if !a.Enabled {
+		return true
+	}
+	rule, known := a.rule(peerID)
+	if !known {
+		return false
+	}
+	if len(rule.Collections) > 0 && !slices.Contains(rule.Collections, collection) {
+		return false
+	}
+	if len(rule.Operations) > 0 {
+		return slices.Contains(rule.Operations, operation)
+	}
+	return rule.Role == ACLRoleWriter
+}
+
+// clone devuelve una copia de la ACL
+func (a ReplicationACL) clone() ReplicationACL {
+	peers := maps.Clone(a.Peers)
+	for id, rule := range peers {
+		rule.Collections = slices.Clone(rule.Collections)
+		rule.Operations = slices.Clone(rule.Operations)
+		peers[id] = rule
+	}
+	return ReplicationACL{Enabled: a.Enabled, DefaultRole: a.DefaultRole, Peers: peers}
+}
+
+// SetReplicationACL establece qué nodos pueden escribir a través de la replicación
+func (db *Database) SetReplicationACL(acl ReplicationACL) error {
+	if err := acl.Validate(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.acl = acl.clone()
+	return nil
+}
+
+// ReplicationACL devuelve la ACL de replicación del nodo
+func (db *Database) ReplicationACL() ReplicationACL {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.acl.clone()
+}
+
+// AllowsReplication indica si se acepta de un nodo una operación sobre una colección
+func (db *Database) AllowsReplication(peerID string, operation Operation, collection string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.acl.Allows(peerID, operation, collection)
+}
+
+// AllowsDocument indica si se acepta de un nodo un documento replicado: crearlo
+// si no existe en el nodo o actualizarlo si existe
+func (db *Database) AllowsDocument(peerID string, doc *Document) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	operation := OperationCreate
+	if _, exists := db.documents[doc.ID]; exists {
+		operation = OperationUpdate
+	}
+	return db.acl.Allows(peerID, operation, doc.Collection)
+}
+
+// KnowsPeer indica si la ACL acepta mensajes de un nodo
+func (db *Database) KnowsPeer(peerID string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.acl.Knows(peerID)
+}
+
+// ListsPeer indica si el nodo aparece en la lista de la ACL habilitada
+func (db *Database) ListsPeer(peerID string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.acl.Lists(peerID)
+}
+
+// RejectReplication registra un mensaje de replicación rechazado
+func (db *Database) RejectReplication(peerID string, reason string) {
+	db.mutex.Lock()
+	db.rejected++
+	db.mutex.Unlock()
+
+	log.Printf("Mensaje de replicación de %s rechazado: %s", peerID, reason)
+}
+
+// RejectedCount devuelve cuántos mensajes de replicación se han rechazado por
+// firma no válida o falta de permisos
+func (db *Database) RejectedCount() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.rejected
+}
@@ -0,0 +1,497 @@
+package db
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// AccumulatorOperator define los operadores de acumulación de la etapa group
+type AccumulatorOperator string
+
+const (
+	// AccumulatorSum suma de los valores numéricos
+	AccumulatorSum AccumulatorOperator = "sum"
+	// AccumulatorAvg media de los valores numéricos
+	AccumulatorAvg AccumulatorOperator = "avg"
+	// AccumulatorMin valor mínimo
+	AccumulatorMin AccumulatorOperator = "min"
+	// AccumulatorMax valor máximo
+	AccumulatorMax AccumulatorOperator = "max"
+	// AccumulatorCount número de documentos
+	AccumulatorCount AccumulatorOperator = "count"
+	// AccumulatorPush lista de valores
+	AccumulatorPush AccumulatorOperator = "push"
+)
+
+// Accumulator calcula un campo de la etapa group a partir de los documentos del grupo
+type Accumulator struct {
+	Operator AccumulatorOperator `json:"operator"`
+	Field    string              `json:"field,omitempty"` // Campo de entrada; en count y push es opcional
+}
+
+// GroupStage agrupa los documentos por uno o varios campos
+type GroupStage struct {
+	By     []string               `json:"by"`     // Campos de agrupación; vacío agrupa todos los documentos
+	Fields map[string]Accumulator `json:"fields"` // Campos calculados de cada grupo
+}
+
+// LookupStage une cada documento con los documentos de otra colección
+type LookupStage struct {
+	From         string `json:"from"`          // Colección a unir
+	LocalField   string `json:"local_field"`   // Campo del documento
+	ForeignField string `json:"foreign_field"` // Campo de la otra colección ("_id" para su ID)
+	As           string `json:"as"`            // Campo donde se guardan los documentos unidos
+}
+
+// AggregationStage es una etapa del pipeline de agregación. Debe tener
+// exactamente una de sus operaciones definida.
+type AggregationStage struct {
+	Match   interface{}            `json:"match,omitempty"`   // QueryCondition o LogicalCondition
+	Group   *GroupStage            `json:"group,omitempty"`   // Agrupación con acumuladores
+	Project map[string]interface{} `json:"project,omitempty"` // 1/0 incluye o excluye, "$campo" referencia, otro valor literal
+	Unwind  string                 `json:"unwind,omitempty"`  // Campo lista a desplegar
+	Sort    []SortOption           `json:"sort,omitempty"`    // Ordenación
+	Limit   *int                   `json:"limit,omitempty"`   // Número máximo de resultados
+	Lookup  *LookupStage           `json:"lookup,omitempty"`  // Unión con otra colección
+}
+
+// LookupCollections devuelve las colecciones que un pipeline une con $lookup,
+// que quien lo ejecuta también debe poder leer
+func LookupCollections(pipeline []AggregationStage) []string {
+	var collections []string
+	for _, stage := range pipeline {
+		if stage.Lookup != nil && !slices.Contains(collections, stage.Lookup.From) {
+			collections = append(collections, stage.Lookup.From)
+		}
+	}
+	return collections
+}
+
+// Aggregate ejecuta un pipeline de agregación sobre una colección. Los documentos
+// entran al pipeline como sus datos con el campo "_id" añadido.
+func (db *Database) Aggregate(collection string, pipeline []AggregationStage) ([]map[string]interface{}, error) {
+	for i, stage := range pipeline {
+		if err := stage.validate(); err != nil {
+			return nil, fmt.Errorf("etapa %d: %v", i, err)
+		}
+	}
+
+	// Si la primera etapa es un filtro, ejecutarlo como consulta para aprovechar los índices
+	query := &Query{Collection: collection}
+	if len(pipeline) > 0 && pipeline[0].Match != nil {
+		query.Condition = pipeline[0].Match
+		pipeline = pipeline[1:]
+	}
+
+	docs, err := query.Execute(db)
+	if err != nil {
+		return nil, fmt.Errorf("error al filtrar documentos: %v", err)
+	}
+
+	rows := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		rows[i] = documentRow(doc)
+	}
+
+	for i, stage := range pipeline {
+		rows, err = db.applyStage(stage, rows)
+		if err != nil {
+			return nil, fmt.Errorf("etapa %d: %v", i, err)
+		}
+	}
+
+	return rows, nil
+}
+
+// documentRow convierte un documento en una fila del pipeline
+func documentRow(doc *Document) map[string]interface{} {
+	row := make(map[string]interface{}, len(doc.Data)+1)
+	for key, value := range doc.Data {
+		row[key] = value
+	}
+	row["_id"] = doc.ID
+	return row
+}
+
+// validate verifica que la etapa tenga exactamente una operación
+func (s AggregationStage) validate() error {
+	count := 0
+	if s.Match != nil {
+		count++
+	}
+	if s.Group != nil {
+		count++
+	}
+	if s.Project != nil {
+		count++
+	}
+	if s.Unwind != "" {
+		count++
+	}
+	if s.Sort != nil {
+		count++
+	}
+	if s.Limit != nil {
+		count++
+	}
+	if s.Lookup != nil {
+		count++
+		if s.Lookup.From == "" || s.Lookup.LocalField == "" || s.Lookup.ForeignField == "" || s.Lookup.As == "" {
+			return fmt.Errorf("lookup requiere from, local_field, foreign_field y as")
+		}
+	}
+
+	if count != 1 {
+		return fmt.Errorf("cada etapa debe tener exactamente una operación (tiene %d)", count)
+	}
+	return nil
+}
+
+// applyStage aplica una etapa a las filas
+func (db *Database) applyStage(stage AggregationStage, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	switch {
+	case stage.Match != nil:
+		query := &Query{Condition: stage.Match}
+		var results []map[string]interface{}
+		for _, row := range rows {
+			if query.matchesCondition(row, stage.Match) {
+				results = append(results, row)
+			}
+		}
+		return results, nil
+
+	case stage.Group != nil:
+		return groupRows(stage.Group, rows)
+
+	case stage.Project != nil:
+		results := make([]map[string]interface{}, len(rows))
+		for i, row := range rows {
+			results[i] = projectRow(stage.Project, row)
+		}
+		return results, nil
+
+	case stage.Unwind != "":
+		return unwindRows(stage.Unwind, rows), nil
+
+	case stage.Sort != nil:
+		sort.SliceStable(rows, func(i, j int) bool {
+			return lessBySortOptions(stage.Sort, func(k int, field string) (interface{}, error) {
+				return getNestedFieldValue(rows[k], field)
+			}, i, j)
+		})
+		return rows, nil
+
+	case stage.Limit != nil:
+		if *stage.Limit >= 0 && *stage.Limit < len(rows) {
+			rows = rows[:*stage.Limit]
+		}
+		return rows, nil
+
+	case stage.Lookup != nil:
+		return db.lookupRows(stage.Lookup, rows)
+	}
+
+	return rows, nil
+}
+
+// groupState acumula los valores de un grupo
+type groupState struct {
+	key    interface{}
+	sums   map[string]float64
+	counts map[string]int
+	values map[string]interface{}
+	lists  map[string][]interface{}
+}
+
+// groupRows agrupa las filas y calcula los acumuladores de cada grupo.
+// Los grupos se devuelven en el orden en que aparece su primera fila.
+func groupRows(stage *GroupStage, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	for name, acc := range stage.Fields {
+		switch acc.Operator {
+		case AccumulatorSum, AccumulatorAvg, AccumulatorMin, AccumulatorMax:
+			if acc.Field == "" {
+				return nil, fmt.Errorf("el acumulador %s de %s requiere un campo", acc.Operator, name)
+			}
+		case AccumulatorCount, AccumulatorPush:
+		default:
+			return nil, fmt.Errorf("acumulador no soportado: %s", acc.Operator)
+		}
+	}
+
+	groups := make(map[string]*groupState)
+	var order []string
+
+	for _, row := range rows {
+		key, keyString := groupKey(stage.By, row)
+		state, exists := groups[keyString]
+		if !exists {
+			state = &groupState{
+				key:    key,
+				sums:   make(map[string]float64),
+				counts: make(map[string]int),
+				values: make(map[string]interface{}),
+				lists:  make(map[string][]interface{}),
+			}
+			groups[keyString] = state
+			order = append(order, keyString)
+		}
+
+		for name, acc := range stage.Fields {
+			var value interface{} = row
+			var err error
+			if acc.Field != "" {
+				value, err = getNestedFieldValue(row, acc.Field)
+			}
+
+			switch acc.Operator {
+			case AccumulatorSum, AccumulatorAvg:
+				if err != nil {
+					continue
+				}
+				if n := newOrderedValue(value); n.kind == orderedKindNumber {
+					state.sums[name] += n.num
+					state.counts[name]++
+				}
+			case AccumulatorMin, AccumulatorMax:
+				if err != nil {
+					continue
+				}
+				current, exists := state.values[name]
+				cmp := compareValues(value, current)
+				if !exists || (acc.Operator == AccumulatorMin && cmp < 0) || (acc.Operator == AccumulatorMax && cmp > 0) {
+					state.values[name] = value
+				}
+			case AccumulatorCount:
+				if err == nil {
+					state.counts[name]++
+				}
+			case AccumulatorPush:
+				if err == nil {
+					state.lists[name] = append(state.lists[name], value)
+				}
+			}
+		}
+	}
+
+	results := make([]map[string]interface{}, 0, len(order))
+	for _, keyString := range order {
+		state := groups[keyString]
+		result := map[string]interface{}{"_id": state.key}
+		for name, acc := range stage.Fields {
+			switch acc.Operator {
+			case AccumulatorSum:
+				result[name] = state.sums[name]
+			case AccumulatorAvg:
+				if state.counts[name] > 0 {
+					result[name] = state.sums[name] / float64(state.counts[name])
+				} else {
+					result[name] = nil
+				}
+			case AccumulatorMin, AccumulatorMax:
+				result[name] = state.values[name]
+			case AccumulatorCount:
+				result[name] = state.counts[name]
+			case AccumulatorPush:
+				list := state.lists[name]
+				if list == nil {
+					list = []interface{}{}
+				}
+				result[name] = list
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// groupKey calcula la clave de grupo de una fila: el valor del campo si se agrupa
+// por uno solo, o un mapa campo -> valor si se agrupa por varios
+func groupKey(by []string, row map[string]interface{}) (interface{}, string) {
+	if len(by) == 0 {
+		return nil, ""
+	}
+
+	if len(by) == 1 {
+		value, _ := getNestedFieldValue(row, by[0])
+		return value, groupKeyString(value)
+	}
+
+	key := make(map[string]interface{}, len(by))
+	parts := make([]string, len(by))
+	for i, field := range by {
+		value, _ := getNestedFieldValue(row, field)
+		key[field] = value
+		parts[i] = groupKeyString(value)
+	}
+	return key, strings.Join(parts, "|")
+}
+
+// groupKeyString convierte un valor en una clave de agrupación. Los números se
+// agrupan por su valor aunque sean de tipos distintos.
+func groupKeyString(value interface{}) string {
+	v := newOrderedValue(value)
+	return fmt.Sprintf("%d:%v", v.kind, indexKey(value))
+}
+
+// projectRow construye una fila con los campos indicados en la proyección
+func projectRow(projection map[string]interface{}, row map[string]interface{}) map[string]interface{} {
+	// Determinar si la proyección incluye campos o solo los excluye
+	inclusive := false
+	for field, spec := range projection {
+		if field == "_id" {
+			continue
+		}
+		if include, ok := projectionFlag(spec); !ok || include {
+			inclusive = true
+			break
+		}
+	}
+
+	result := make(map[string]interface{})
+	if inclusive {
+		if id, exists := row["_id"]; exists {
+			result["_id"] = id
+		}
+	} else {
+		for key, value := range row {
+			result[key] = value
+		}
+	}
+
+	for field, spec := range projection {
+		include, isFlag := projectionFlag(spec)
+		switch {
+		case isFlag && !include:
+			delete(result, field)
+		case isFlag && include:
+			if value, err := getNestedFieldValue(row, field); err == nil {
+				result[field] = value
+			}
+		default:
+			// Referencia a otro campo o valor literal
+			if ref, ok := spec.(string); ok && strings.HasPrefix(ref, "$") {
+				if value, err := getNestedFieldValue(row, ref[1:]); err == nil {
+					result[field] = value
+				}
+			} else {
+				result[field] = spec
+			}
+		}
+	}
+
+	return result
+}
+
+// projectionFlag interpreta una especificación de proyección como inclusión (1/true)
+// o exclusión (0/false)
+func projectionFlag(spec interface{}) (bool, bool) {
+	switch v := spec.(type) {
+	case bool:
+		return v, true
+	case int, int64, float64:
+		n := newOrderedValue(v)
+		if n.num == 0 || n.num == 1 {
+			return n.num == 1, true
+		}
+	}
+	return false, false
+}
+
+// unwindRows genera una fila por cada elemento del campo lista. Las filas sin el
+// campo o con la lista vacía se descartan; los valores que no son listas se mantienen.
+func unwindRows(field string, rows []map[string]interface{}) []map[string]interface{} {
+	var results []map[string]interface{}
+	for _, row := range rows {
+		value, err := getNestedFieldValue(row, field)
+		if err != nil {
+			continue
+		}
+
+		items, ok := value.([]interface{})
+		if !ok {
+			results = append(results, row)
+			continue
+		}
+
+		for _, item := range items {
+			results = append(results, setPathValue(row, field, item))
+		}
+	}
+	return results
+}
+
+// setPathValue devuelve una copia de la fila con el valor asignado al campo,
+// copiando los objetos intermedios para no modificar la fila original
+func setPathValue(row map[string]interface{}, field string, value interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(row))
+	for key, v := range row {
+		result[key] = v
+	}
+
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) == 1 {
+		result[field] = value
+		return result
+	}
+
+	child, _ := result[parts[0]].(map[string]interface{})
+	if child == nil {
+		child = map[string]interface{}{}
+	}
+	result[parts[0]] = setPathValue(child, parts[1], value)
+	return result
+}
+
+// lookupRows añade a cada fila los documentos de otra colección cuyo campo
+// coincide con el campo local. Si el campo local es una lista, basta con que
+// coincida uno de sus elementos.
+func (db *Database) lookupRows(stage *LookupStage, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	foreignDocs, err := db.GetAllDocuments(stage.From)
+	if err != nil {
+		return nil, err
+	}
+
+	// Agrupar los documentos de la otra colección por el valor del campo de unión
+	buckets := make(map[string][]map[string]interface{})
+	for _, doc := range foreignDocs {
+		foreign := documentRow(doc)
+		value, err := getNestedFieldValue(foreign, stage.ForeignField)
+		if err != nil {
+			continue
+		}
+		key := indexKey(value)
+		buckets[key] = append(buckets[key], foreign)
+	}
+
+	results := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		matches := []interface{}{}
+		if local, err := getNestedFieldValue(row, stage.LocalField); err == nil {
+			values, isList := local.([]interface{})
+			if !isList {
+				values = []interface{}{local}
+			}
+
+			seen := make(map[string]bool)
+			for _, value := range values {
+				for _, foreign := range buckets[indexKey(value)] {
+					id, _ := foreign["_id"].(string)
+					if seen[id] {
+						continue
+					}
+					foreignValue, _ := getNestedFieldValue(foreign, stage.ForeignField)
+					if compareValues(value, foreignValue) == 0 {
+						seen[id] = true
+						matches = append(matches, foreign)
+					}
+				}
+			}
+		}
+		results[i] = setPathValue(row, stage.As, matches)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// MerklePeer da acceso al resumen Merkle y a los documentos de otro nodo. Cada
+// llamada es un intercambio con ese nodo.
+type MerklePeer interface {
+	// ID devuelve el identificador del nodo
+	ID() string
+	// Roots devuelve la raíz del árbol de cada colección no vacía
+	Roots(ctx context.Context) (map[string]uint64, error)
+	// Nodes devuelve los hashes de los nodos indicados de un nivel del árbol de una colección
+	Nodes(ctx context.Context, collection string, level int, indexes []uint32) ([]uint64, error)
+	// Entries devuelve el hash de cada documento y lápida de las hojas indicadas
+	Entries(ctx context.Context, collection string, leaves []uint32) (map[string]uint64, error)
+	// Fetch devuelve los documentos y lápidas de una colección con los IDs indicados
+	Fetch(ctx context.Context, collection string, ids []string) ([]*Document, []*Tombstone, error)
+}
+
+// AntiEntropyStats resume una sincronización por árbol Merkle
+type AntiEntropyStats struct {
+	Rounds      int // Intercambios con el otro nodo
+	Collections int // Colecciones con diferencias
+	Documents   int // Documentos recibidos
+	Tombstones  int // Eliminaciones recibidas
+	Rejected    int // Documentos y eliminaciones que la ACL no permite al otro nodo
+}
+
+// AntiEntropy trae de otro nodo los documentos y eliminaciones que difieren de
+// los locales. Compara los árboles Merkle de las colecciones de arriba abajo,
+// bajando solo por los nodos con hashes distintos, y pide únicamente las
+// entradas de las hojas que no coinciden. Solo se sincronizan las colecciones
+// para las que include devuelve true (todas si es nil), y los documentos se
+// piden en lotes de batchSize. Lo que la ACL de replicación no permite escribir
+// al otro nodo se descarta. El otro nodo obtiene lo que le falta cuando
+// sincroniza en sentido contrario.
+func (db *Database) AntiEntropy(ctx context.Context, peer MerklePeer, include func(collection string) bool, batchSize int) (AntiEntropyStats, error) {
+	var stats AntiEntropyStats
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	remoteRoots, err := peer.Roots(ctx)
+	if err != nil {
+		return stats, fmt.Errorf("error al obtener raíces de %s: %v", peer.ID(), err)
+	}
+	stats.Rounds++
+
+	localRoots := db.MerkleRoots()
+	for _, collection := range slices.Sorted(maps.Keys(remoteRoots)) {
+		if remoteRoots[collection] == localRoots[collection] {
+			continue
+		}
+		if include != nil && !include(collection) {
+			continue
+		}
+		stats.Collections++
+
+		ids, rounds, err := db.merkleDiff(ctx, peer, collection)
+		stats.Rounds += rounds
+		if err != nil {
+			return stats, err
+		}
+
+		for start := 0; start < len(ids); start += batchSize {
+			end := min(start+batchSize, len(ids))
+			documents, tombstones, err := peer.Fetch(ctx, collection, ids[start:end])
+			if err != nil {
+				return stats, fmt.Errorf("error al obtener documentos de %s: %v", peer.ID(), err)
+			}
+			stats.Rounds++
+
+			for _, doc := range documents {
+				if !db.AllowsDocument(peer.ID(), doc) {
+					db.RejectReplication(peer.ID(), fmt.Sprintf("sin permiso para escribir en %s", doc.Collection))
+					stats.Rejected++
+					continue
+				}
+				if _, err := db.ApplyRemoteDocument(doc); err != nil {
+					return stats, err
+				}
+				stats.Documents++
+			}
+			for _, tombstone := range tombstones {
+				if !db.AllowsReplication(peer.ID(), OperationDelete, tombstone.Collection) {
+					db.RejectReplication(peer.ID(), fmt.Sprintf("sin permiso para eliminar en %s", tombstone.Collection))
+					stats.Rejected++
+					continue
+				}
+				if _, err := db.ApplyRemoteDelete(tombstone, peer.ID()); err != nil {
+					return stats, err
+				}
+				stats.Tombstones++
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// merkleDiff baja por el árbol de una colección hasta las hojas que difieren y
+// devuelve los IDs cuyas entradas remotas no coinciden con las locales, junto
+// con el número de intercambios realizados
+func (db *Database) merkleDiff(ctx context.Context, peer MerklePeer, collection string) ([]string, int, error) {
+	rounds := 0
+	differing := []uint32{0}
+	for level := 1; level <= merkleDepth && len(differing) > 0; level++ {
+		children := make([]uint32, 0, len(differing)*merkleFanout)
+		for _, index := range differing {
+			for child := range uint32(merkleFanout) {
+				children = append(children, index*merkleFanout+child)
+			}
+		}
+
+		remote, err := peer.Nodes(ctx, collection, level, children)
+		if err != nil {
+			return nil, rounds, fmt.Errorf("error al comparar el árbol de %s con %s: %v", collection, peer.ID(), err)
+		}
+		rounds++
+		if len(remote) != len(children) {
+			return nil, rounds, fmt.Errorf("respuesta no válida de %s: %d hashes para %d nodos", peer.ID(), len(remote), len(children))
+		}
+
+		local := db.MerkleNodes(collection, level, children)
+		differing = differing[:0]
+		for i, index := range children {
+			if remote[i] != local[i] {
+				differing = append(differing, index)
+			}
+		}
+	}
+	if len(differing) == 0 {
+		return nil, rounds, nil
+	}
+
+	remote, err := peer.Entries(ctx, collection, differing)
+	if err != nil {
+		return nil, rounds, fmt.Errorf("error al obtener entradas de %s: %v", peer.ID(), err)
+	}
+	rounds++
+
+	local := db.MerkleEntries(collection, differing)
+	ids := make(map[string]bool)
+	for key, hash := range remote {
+		if local[key] != hash {
+			ids[merkleKeyID(key)] = true
+		}
+	}
+	delete(ids, "")
+
+	return slices.Sorted(maps.Keys(ids)), rounds, nil
+}
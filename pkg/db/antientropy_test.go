@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// localMerklePeer da acceso al árbol de otra base de datos del mismo proceso y
+// anota lo que se le pide
+type localMerklePeer struct {
+	t        *testing.T
+	id       string
+	database *Database
+	nodes    int             // Nodos del árbol pedidos
+	leaves   map[uint32]bool // Hojas cuyas entradas se pidieron
+	fetched  map[string]bool // IDs de los documentos y lápidas pedidos
+}
+
+func newLocalMerklePeer(t *testing.T, id string, database *Database) *localMerklePeer {
+	return &localMerklePeer{t: t, id: id, database: database, leaves: map[uint32]bool{}, fetched: map[string]bool{}}
+}
+
+func (p *localMerklePeer) ID() string { return p.id }
+
+func (p *localMerklePeer) Roots(context.Context) (map[string]uint64, error) {
+	return p.database.MerkleRoots(), nil
+}
+
+func (p *localMerklePeer) Nodes(_ context.Context, collection string, level int, indexes []uint32) ([]uint64, error) {
+	p.nodes += len(indexes)
+	return p.database.MerkleNodes(collection, level, indexes), nil
+}
+
+func (p *localMerklePeer) Entries(_ context.Context, collection string, leaves []uint32) (map[string]uint64, error) {
+	for _, leaf := range leaves {
+		p.leaves[leaf] = true
+	}
+	return p.database.MerkleEntries(collection, leaves), nil
+}
+
+func (p *localMerklePeer) Fetch(_ context.Context, collection string, ids []string) ([]*Document, []*Tombstone, error) {
+	for _, id := range ids {
+		p.fetched[id] = true
+	}
+	documents, tombstones := p.database.GetReplicas(collection, ids)
+	for i, doc := range documents {
+		documents[i] = wireCopy(p.t, doc)
+	}
+	return documents, tombstones, nil
+}
+
+// leavesOf devuelve las hojas del árbol que corresponden a los IDs indicados
+func leavesOf(ids ...string) map[uint32]bool {
+	leaves := make(map[uint32]bool)
+	for _, id := range ids {
+		leaves[merkleLeaf(id)] = true
+	}
+	return leaves
+}
+
+func TestAntiEntropyExchangesOnlyDifferingRanges(t *testing.T) {
+	local := newCRDTTestNode(t, "local")
+	remote := newCRDTTestNode(t, "remote")
+
+	// Estado común de partida
+	var shared []string
+	for i := range 400 {
+		doc, err := remote.CreateDocument("notas", map[string]any{"n": i})
+		if err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+		if _, err := local.ApplyRemoteDocument(wireCopy(t, doc)); err != nil {
+			t.Fatalf("error al replicar documento: %v", err)
+		}
+		shared = append(shared, doc.ID)
+	}
+	if local.MerkleRoots()["notas"] != remote.MerkleRoots()["notas"] {
+		t.Fatalf("los árboles difieren con el mismo contenido")
+	}
+
+	// Se actualiza un documento que comparte hoja con otro, que no debe pedirse
+	var updated, neighbour string
+	byLeaf := make(map[uint32]string)
+	for _, id := range shared {
+		if other, exists := byLeaf[merkleLeaf(id)]; exists {
+			updated, neighbour = id, other
+			break
+		}
+		byLeaf[merkleLeaf(id)] = id
+	}
+	if updated == "" {
+		t.Fatalf("ningún par de documentos comparte hoja")
+	}
+	deleted := shared[0]
+	if deleted == neighbour {
+		deleted = shared[1]
+	}
+
+	// Los nodos divergen: cada uno crea un documento, el remoto actualiza uno y
+	// elimina otro
+	created, err := remote.CreateDocument("notas", map[string]any{"n": "remoto"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	ownCreated, err := local.CreateDocument("notas", map[string]any{"n": "local"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	if _, err := remote.UpdateDocument(updated, map[string]any{"n": "cambiado"}); err != nil {
+		t.Fatalf("error al actualizar documento: %v", err)
+	}
+	if err := remote.DeleteDocument(deleted); err != nil {
+		t.Fatalf("error al eliminar documento: %v", err)
+	}
+
+	peer := newLocalMerklePeer(t, "remote", remote)
+	stats, err := local.AntiEntropy(context.Background(), peer, nil, 0)
+	if err != nil {
+		t.Fatalf("error en la anti-entropía: %v", err)
+	}
+
+	differing := []string{created.ID, updated, deleted}
+	if want := leavesOf(append(differing, ownCreated.ID)...); !maps.Equal(peer.leaves, want) {
+		t.Errorf("se pidieron %d hojas, se esperaban las %d de las entradas distintas", len(peer.leaves), len(want))
+	}
+	if got := slices.Sorted(maps.Keys(peer.fetched)); !slices.Equal(got, slices.Sorted(slices.Values(differing))) {
+		t.Errorf("documentos pedidos = %v, se esperaban %v", got, differing)
+	}
+	// Por cada nivel solo se piden los hijos de los nodos que difieren
+	if maxNodes := merkleFanout * (1 + 2*len(peer.leaves)); peer.nodes > maxNodes {
+		t.Errorf("nodos pedidos = %d, se esperaban como mucho %d", peer.nodes, maxNodes)
+	}
+	if stats.Collections != 1 || stats.Documents != 2 || stats.Tombstones != 1 {
+		t.Errorf("estadísticas = %+v, se esperaba una colección, 2 documentos y una eliminación", stats)
+	}
+	// Raíces, tres niveles, entradas y un lote de documentos
+	if want := 1 + merkleDepth + 1 + 1; stats.Rounds != want {
+		t.Errorf("intercambios = %d, se esperaban %d", stats.Rounds, want)
+	}
+
+	// En sentido contrario el remoto obtiene el documento creado en local
+	if _, err := remote.AntiEntropy(context.Background(), newLocalMerklePeer(t, "local", local), nil, 0); err != nil {
+		t.Fatalf("error en la anti-entropía: %v", err)
+	}
+	if local.MerkleRoots()["notas"] != remote.MerkleRoots()["notas"] {
+		t.Errorf("los árboles no convergen tras sincronizar en ambos sentidos")
+	}
+	for _, database := range []*Database{local, remote} {
+		if _, err := database.GetDocument(deleted); err == nil {
+			t.Errorf("el documento eliminado sigue existiendo")
+		}
+		doc, err := database.GetDocument(updated)
+		if err != nil || fmt.Sprint(doc.Data["n"]) != "cambiado" {
+			t.Errorf("documento actualizado = %v, %v", doc, err)
+		}
+	}
+
+	// Con los árboles iguales basta con comparar las raíces
+	stats, err = local.AntiEntropy(context.Background(), newLocalMerklePeer(t, "remote", remote), nil, 0)
+	if err != nil || stats.Rounds != 1 || stats.Collections != 0 {
+		t.Errorf("estadísticas sin diferencias = %+v, %v", stats, err)
+	}
+}
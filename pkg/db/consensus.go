@@ -0,0 +1,335 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrConsensusUnavailable indica que el grupo de consenso no pudo confirmar
+	// una operación, por ejemplo porque no tiene líder o no hay mayoría
+	ErrConsensusUnavailable = errors.New("el grupo de consenso no está disponible")
+	// ErrStrongTransaction indica que una transacción escribe en una colección
+	// de consistencia fuerte, cuyas escrituras solo pasan por el consenso
+	ErrStrongTransaction = errors.New("las transacciones no admiten colecciones de consistencia fuerte")
+)
+
+// Consensus es el grupo de consenso por el que pasan las escrituras de las
+// colecciones de consistencia fuerte. Sus métodos no deben tomar el mutex de la
+// base de datos.
+type Consensus interface {
+	// Strong indica si las escrituras de una colección pasan por el consenso
+	Strong(collection string) bool
+	// Member indica si el nodo aplica el log del consenso. Un nodo que no es
+	// miembro recibe las colecciones fuertes por la replicación habitual.
+	Member() bool
+	// Propose propone un comando y devuelve su resultado una vez aplicado
+	Propose(command *Command) (*Document, error)
+	// Barrier espera, si están activadas las lecturas del líder, a que el nodo
+	// tenga aplicadas todas las escrituras confirmadas de la colección
+	Barrier(collection string) error
+	// CatchUp espera a que un miembro tenga aplicadas todas las escrituras
+	// confirmadas, aunque no estén activadas las lecturas del líder
+	CatchUp() error
+}
+
+// Command es una escritura de una colección de consistencia fuerte. Lleva todo
+// lo que necesita para aplicarse igual en todos los miembros.
+type Command struct {
+	Operation  Operation      `json:"operation"`
+	Collection string         `json:"collection"`
+	ID         string         `json:"id"`
+	Data       map[string]any `json:"data,omitempty"`     // Datos del documento, o de la actualización
+	Revision   *uint64        `json:"revision,omitempty"` // Revisión esperada (IfRevision)
+	Stamp      Timestamp      `json:"stamp"`
+	Time       time.Time      `json:"time"`
+}
+
+// commandResult es el resultado de un comando, que viaja por la red hasta el
+// nodo que lo propuso. Los errores conocidos conservan su tipo.
+type commandResult struct {
+	Document   *Document              `json:"document,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Code       string                 `json:"code,omitempty"`
+	Conflict   *RevisionConflictError `json:"conflict,omitempty"`
+	Validation *SchemaValidationError `json:"validation,omitempty"`
+}
+
+// commandErrorCodes son los errores que se reconocen al otro lado de la red
+var commandErrorCodes = map[string]error{
+	"invalid_update": ErrInvalidUpdate,
+	"read_only":      ErrReadOnly,
+}
+
+// commandError es un error devuelto por un comando aplicado en otro nodo
+type commandError struct {
+	text   string
+	target error
+}
+
+// Error implementa la interfaz error
+func (e *commandError) Error() string {
+	return e.text
+}
+
+// Is permite comparar el error con el error conocido de su tipo
+func (e *commandError) Is(target error) bool {
+	return e.target != nil && target == e.target
+}
+
+// EncodeCommandResult serializa el resultado de aplicar un comando
+func EncodeCommandResult(doc *Document, err error) []byte {
+	result := commandResult{Document: doc}
+	if err != nil {
+		result.Document = nil
+		result.Error = err.Error()
+		errors.As(err, &result.Conflict)
+		errors.As(err, &result.Validation)
+		for code, target := range commandErrorCodes {
+			if errors.Is(err, target) {
+				result.Code = code
+			}
+		}
+	}
+
+	data, marshalErr := json.Marshal(result)
+	if marshalErr != nil {
+		data, _ = json.Marshal(commandResult{Error: fmt.Sprintf("error al serializar resultado: %v", marshalErr)})
+	}
+	return data
+}
+
+// DecodeCommandResult deserializa el resultado de un comando
+func DecodeCommandResult(data []byte) (*Document, error) {
+	var result commandResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("error al deserializar resultado: %v", err)
+	}
+
+	switch {
+	case result.Conflict != nil:
+		return nil, result.Conflict
+	case result.Validation != nil:
+		return nil, result.Validation
+	case result.Error != "":
+		return nil, &commandError{text: result.Error, target: commandErrorCodes[result.Code]}
+	}
+	return result.Document, nil
+}
+
+// SetConsensus establece el grupo de consenso de las colecciones de consistencia
+// fuerte, o lo quita con nil
+func (db *Database) SetConsensus(consensus Consensus) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.consensus = consensus
+}
+
+// consensusFor devuelve el consenso por el que pasan las escrituras de una
+// colección, o nil si se escriben localmente
+func (db *Database) consensusFor(collection string) Consensus {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.consensus == nil || !db.consensus.Strong(collection) {
+		return nil
+	}
+	return db.consensus
+}
+
+// consensusForDocument devuelve el consenso por el que pasan las escrituras de
+// un documento y su colección, o nil si se escribe localmente
+func (db *Database) consensusForDocument(id string) (Consensus, string) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	doc, exists := db.documents[id]
+	if !exists || db.consensus == nil || !db.consensus.Strong(doc.Collection) {
+		return nil, ""
+	}
+	return db.consensus, doc.Collection
+}
+
+// consensusForWrite devuelve el consenso por el que pasa una escritura de un
+// documento y su colección. Si un miembro no tiene el documento, puede ser que
+// aún no haya aplicado su creación, así que se pone al día antes de decidir.
+func (db *Database) consensusForWrite(id string) (Consensus, string, error) {
+	if consensus, collection := db.consensusForDocument(id); consensus != nil {
+		return consensus, collection, nil
+	}
+
+	db.mutex.RLock()
+	consensus := db.consensus
+	_, exists := db.documents[id]
+	db.mutex.RUnlock()
+	if consensus == nil || exists || !consensus.Member() {
+		return nil, "", nil
+	}
+
+	if err := consensus.CatchUp(); err != nil {
+		return nil, "", err
+	}
+	consensus, collection := db.consensusForDocument(id)
+	return consensus, collection, nil
+}
+
+// managedLocked indica si los cambios de una colección solo llegan por el log
+// del consenso, de modo que la replicación habitual no la modifica. Debe
+// llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) managedLocked(collection string) bool {
+	return db.consensus != nil && db.consensus.Strong(collection) && db.consensus.Member()
+}
+
+// readBarrier espera a que las lecturas de una colección de consistencia fuerte
+// vean todas las escrituras confirmadas, si el consenso lo pide
+func (db *Database) readBarrier(collection string) error {
+	consensus := db.consensusFor(collection)
+	if consensus == nil {
+		return nil
+	}
+	return consensus.Barrier(collection)
+}
+
+// newCommand crea el comando de una escritura local, marcado con el reloj del nodo
+func (db *Database) newCommand(operation Operation, collection, id string, data map[string]any, opts writeOptions) *Command {
+	return &Command{
+		Operation:  operation,
+		Collection: collection,
+		ID:         id,
+		Data:       data,
+		Revision:   opts.expectedRevision,
+		Stamp:      db.clock.Now(),
+		Time:       time.Now(),
+	}
+}
+
+// ApplyCommand aplica un comando confirmado por el consenso en la entrada index
+// del log. El resultado solo depende del comando y del estado de la colección,
+// así que es el mismo en todos los miembros. Un comando ya aplicado, al
+// reproducir el log tras un reinicio, no se repite. Con publish la escritura se
+// replica además a los nodos que no son miembros.
+func (db *Database) ApplyCommand(index uint64, command *Command, publish bool) (*Document, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.clock.Update(command.Stamp)
+	stamp := writeStamp{clock: command.Stamp, time: command.Time, index: index, publish: publish}
+	opts := writeOptions{expectedRevision: command.Revision}
+
+	existing, exists := db.documents[command.ID]
+	if exists && existing.LogIndex >= index {
+		return existing, nil
+	}
+
+	switch command.Operation {
+	case OperationCreate:
+		if exists {
+			return nil, fmt.Errorf("el documento %s ya existe", command.ID)
+		}
+		if _, deleted := db.tombstones[command.ID]; deleted {
+			return nil, fmt.Errorf("el documento %s se eliminó", command.ID)
+		}
+		doc := &Document{ID: command.ID, Collection: command.Collection, Data: command.Data}
+		return db.createDocumentLocked(doc, stamp)
+
+	case OperationUpdate:
+		if !exists || existing.Collection != command.Collection {
+			return nil, errors.New("documento no encontrado")
+		}
+		apply, err := updateFunc(command.Data)
+		if err != nil {
+			return nil, err
+		}
+		stamp.clock = stampAfter(documentClock(existing), command.Stamp)
+		return db.updateDocumentLocked(existing, apply, opts, stamp)
+
+	case OperationDelete:
+		if !exists || existing.Collection != command.Collection {
+			return nil, errors.New("documento no encontrado")
+		}
+		stamp.clock = stampAfter(documentClock(existing), command.Stamp)
+		return nil, db.deleteDocumentLocked(existing, opts, stamp)
+
+	default:
+		return nil, fmt.Errorf("operación no soportada en el consenso: %s", command.Operation)
+	}
+}
+
+// stampAfter devuelve ts si es posterior a previous, o la marca siguiente a
+// previous con el nodo de ts. Así la versión del consenso siempre gana al
+// fusionarse con la anterior en los nodos que no son miembros.
+func stampAfter(previous, ts Timestamp) Timestamp {
+	if ts.Compare(previous) > 0 {
+		return ts
+	}
+	return Timestamp{Wall: previous.Wall, Logical: previous.Logical + 1, Node: ts.Node}
+}
+
+// RestoreCollections reemplaza los documentos y lápidas de las colecciones que
+// cumplen include por los de una instantánea. Los documentos que no están en
+// ella se eliminan sin lápida, porque la instantánea ya es el estado completo.
+func (db *Database) RestoreCollections(snapshot *Snapshot, include func(collection string) bool) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	keep := make(map[string]bool, len(snapshot.Documents))
+	for _, doc := range snapshot.Documents {
+		if include(doc.Collection) {
+			keep[doc.ID] = true
+		}
+	}
+
+	for id, doc := range db.documents {
+		if !include(doc.Collection) || keep[id] {
+			continue
+		}
+		db.removeDocumentLocked(id)
+		if db.persistenceEnabled {
+			if err := db.persistence.DeleteDocument(doc.Collection, id); err != nil {
+				return fmt.Errorf("error al persistir eliminación: %v", err)
+			}
+		}
+	}
+
+	for _, doc := range snapshot.Documents {
+		if !include(doc.Collection) {
+			continue
+		}
+		if current, exists := db.documents[doc.ID]; exists && current.LogIndex == doc.LogIndex && sameDocumentState(current, doc) {
+			continue
+		}
+		restored := *doc
+		db.putDocumentLocked(&restored)
+		if db.persistenceEnabled {
+			if err := db.persistence.SaveDocument(&restored); err != nil {
+				return fmt.Errorf("error al persistir documento: %v", err)
+			}
+		}
+	}
+
+	tombstones := make(map[string]*Tombstone, len(snapshot.Tombstones))
+	for _, tombstone := range snapshot.Tombstones {
+		if include(tombstone.Collection) {
+			tombstones[tombstone.ID] = tombstone
+		}
+	}
+	for id, tombstone := range db.tombstones {
+		if include(tombstone.Collection) && tombstones[id] == nil {
+			db.dropTombstoneLocked(id)
+			db.tombstonesDirty = true
+		}
+	}
+	for id, tombstone := range tombstones {
+		if current, exists := db.tombstones[id]; exists && current.Deleted == tombstone.Deleted {
+			continue
+		}
+		restored := tombstone.clone()
+		restored.ack(db.clock.Node())
+		db.setTombstoneLocked(restored)
+		db.tombstonesDirty = true
+	}
+	return db.saveTombstonesLocked()
+}
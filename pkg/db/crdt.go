@@ -0,0 +1,645 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Resolución de conflictos en la replicación
+//
+// Cada escritura local se marca con el reloj lógico híbrido del nodo. Al recibir
+// un documento de otro nodo se fusiona con la versión local campo a campo (los
+// campos de primer nivel de Data):
+//
+//   - Por defecto cada campo es un registro en el que gana la escritura con la
+//     marca posterior (last-writer-wins), incluidas las eliminaciones de campos.
+//   - Los campos declarados como contadores suman los incrementos y decrementos
+//     de todos los nodos.
+//   - Los campos declarados como conjuntos conservan un elemento mientras quede
+//     alguna inserción que no se haya visto eliminar (add-wins).
+//
+// La fusión es conmutativa, asociativa e idempotente, así que todos los nodos
+// convergen al mismo documento sea cual sea el orden en que reciben los mensajes.
+
+// CRDTSpec declara los campos de una colección que se fusionan como contadores o
+// como conjuntos en lugar de como registros last-writer-wins
+type CRDTSpec struct {
+	Counters []string `json:"counters,omitempty"`
+	Sets     []string `json:"sets,omitempty"`
+}
+
+// crdtFieldKind tipo de fusión de un campo
+type crdtFieldKind int
+
+const (
+	crdtRegister crdtFieldKind = iota
+	crdtCounter
+	crdtSet
+)
+
+// kind devuelve cómo se fusiona un campo
+func (s CRDTSpec) kind(field string) crdtFieldKind {
+	if slices.Contains(s.Counters, field) {
+		return crdtCounter
+	}
+	if slices.Contains(s.Sets, field) {
+		return crdtSet
+	}
+	return crdtRegister
+}
+
+// IsEmpty indica si la especificación no declara ningún campo
+func (s CRDTSpec) IsEmpty() bool {
+	return len(s.Counters) == 0 && len(s.Sets) == 0
+}
+
+// validate comprueba que los campos son de primer nivel y no se repiten
+func (s CRDTSpec) validate() error {
+	seen := make(map[string]bool)
+	for _, field := range slices.Concat(s.Counters, s.Sets) {
+		if field == "" || strings.Contains(field, ".") {
+			return fmt.Errorf("campo no válido: %q (solo se admiten campos de primer nivel)", field)
+		}
+		if seen[field] {
+			return fmt.Errorf("campo declarado dos veces: %s", field)
+		}
+		seen[field] = true
+	}
+	return nil
+}
+
+// DocumentCRDT son los metadatos de replicación de un documento
+type DocumentCRDT struct {
+	Clock    Timestamp             `json:"clock"`              // Marca de la última escritura
+	Fields   map[string]Timestamp  `json:"fields,omitempty"`   // Marca de la última escritura de cada campo
+	Counters map[string]*PNCounter `json:"counters,omitempty"` // Estado de los campos contador
+	Sets     map[string]*ORSet     `json:"sets,omitempty"`     // Estado de los campos conjunto
+}
+
+// PNCounter es un contador que admite incrementos y decrementos concurrentes. Su
+// valor es la base más los incrementos menos los decrementos de cada nodo.
+type PNCounter struct {
+	Base float64            `json:"base,omitempty"`
+	Inc  map[string]float64 `json:"inc,omitempty"`
+	Dec  map[string]float64 `json:"dec,omitempty"`
+}
+
+// Value devuelve el valor del contador. Los nodos se suman siempre en el mismo
+// orden para que el resultado en coma flotante sea idéntico en todos los nodos.
+func (c *PNCounter) Value() float64 {
+	value := c.Base
+	for _, node := range slices.Sorted(maps.Keys(c.Inc)) {
+		value += c.Inc[node]
+	}
+	for _, node := range slices.Sorted(maps.Keys(c.Dec)) {
+		value -= c.Dec[node]
+	}
+	return value
+}
+
+// add suma un cambio a la contribución de un nodo
+func (c *PNCounter) add(node string, delta float64) {
+	switch {
+	case delta > 0:
+		if c.Inc == nil {
+			c.Inc = make(map[string]float64)
+		}
+		c.Inc[node] += delta
+	case delta < 0:
+		if c.Dec == nil {
+			c.Dec = make(map[string]float64)
+		}
+		c.Dec[node] -= delta
+	}
+}
+
+// clone devuelve una copia del contador
+func (c *PNCounter) clone() *PNCounter {
+	return &PNCounter{Base: c.Base, Inc: maps.Clone(c.Inc), Dec: maps.Clone(c.Dec)}
+}
+
+// mergePNCounters fusiona dos contadores quedándose con la mayor contribución de
+// cada nodo, que solo crece. La base es la del registro ganador del campo.
+func mergePNCounters(base float64, a, b *PNCounter) *PNCounter {
+	merged := &PNCounter{Base: base}
+	for _, counter := range []*PNCounter{a, b} {
+		for node, value := range counter.Inc {
+			if merged.Inc == nil {
+				merged.Inc = make(map[string]float64)
+			}
+			merged.Inc[node] = max(merged.Inc[node], value)
+		}
+		for node, value := range counter.Dec {
+			if merged.Dec == nil {
+				merged.Dec = make(map[string]float64)
+			}
+			merged.Dec[node] = max(merged.Dec[node], value)
+		}
+	}
+	return merged
+}
+
+// ORSet es un conjunto en el que una inserción concurrente con una eliminación
+// gana. Cada inserción lleva una etiqueta única y eliminar un elemento elimina
+// las etiquetas vistas hasta ese momento.
+type ORSet struct {
+	Elements map[string]*ORSetElement `json:"elements,omitempty"` // Por valor serializado
+}
+
+// ORSetElement es un elemento de un ORSet
+type ORSetElement struct {
+	Value   any      `json:"value"`
+	Adds    []string `json:"adds"`
+	Removes []string `json:"removes,omitempty"`
+}
+
+// present indica si queda alguna inserción no eliminada
+func (e *ORSetElement) present() bool {
+	for _, tag := range e.Adds {
+		if !slices.Contains(e.Removes, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values devuelve los elementos presentes ordenados por su valor serializado
+func (s *ORSet) Values() []any {
+	values := []any{}
+	for _, key := range slices.Sorted(maps.Keys(s.Elements)) {
+		if element := s.Elements[key]; element.present() {
+			values = append(values, element.Value)
+		}
+	}
+	return values
+}
+
+// add inserta un valor con una etiqueta nueva si no está presente
+func (s *ORSet) add(value any, tag string) {
+	key := setElementKey(value)
+	element, exists := s.Elements[key]
+	if !exists {
+		element = &ORSetElement{Value: value}
+		s.Elements[key] = element
+	} else if element.present() {
+		return
+	}
+	element.Adds = mergeTags(element.Adds, []string{tag})
+}
+
+// remove elimina un valor marcando como eliminadas las etiquetas vistas
+func (s *ORSet) remove(key string) {
+	if element, exists := s.Elements[key]; exists {
+		element.Removes = mergeTags(element.Removes, element.Adds)
+	}
+}
+
+// clone devuelve una copia del conjunto
+func (s *ORSet) clone() *ORSet {
+	cloned := &ORSet{Elements: make(map[string]*ORSetElement, len(s.Elements))}
+	for key, element := range s.Elements {
+		cloned.Elements[key] = &ORSetElement{
+			Value:   element.Value,
+			Adds:    slices.Clone(element.Adds),
+			Removes: slices.Clone(element.Removes),
+		}
+	}
+	return cloned
+}
+
+// mergeORSets fusiona dos conjuntos uniendo las etiquetas de cada elemento
+func mergeORSets(a, b *ORSet) *ORSet {
+	merged := a.clone()
+	for key, element := range b.Elements {
+		current, exists := merged.Elements[key]
+		if !exists {
+			merged.Elements[key] = &ORSetElement{
+				Value:   element.Value,
+				Adds:    slices.Clone(element.Adds),
+				Removes: slices.Clone(element.Removes),
+			}
+			continue
+		}
+		current.Adds = mergeTags(current.Adds, element.Adds)
+		current.Removes = mergeTags(current.Removes, element.Removes)
+	}
+	return merged
+}
+
+// mergeTags une dos listas de etiquetas ordenadas y sin repeticiones
+func mergeTags(a, b []string) []string {
+	return slices.Compact(slices.Sorted(slices.Values(slices.Concat(a, b))))
+}
+
+// setElementKey serializa un valor para identificarlo dentro de un conjunto
+func setElementKey(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// documentClock devuelve la marca de la última escritura de un documento. Los
+// documentos sin metadatos usan su fecha de actualización.
+func documentClock(doc *Document) Timestamp {
+	if doc.CRDT != nil {
+		return doc.CRDT.Clock
+	}
+	return Timestamp{Wall: doc.UpdatedAt.UnixNano()}
+}
+
+// fieldClock devuelve la marca de la última escritura de un campo y si el
+// documento tiene constancia de él (con valor o eliminado)
+func fieldClock(doc *Document, field string) (Timestamp, bool) {
+	if doc.CRDT != nil {
+		if ts, exists := doc.CRDT.Fields[field]; exists {
+			return ts, true
+		}
+	}
+	if _, exists := doc.Data[field]; exists {
+		return documentClock(doc), true
+	}
+	return Timestamp{}, false
+}
+
+// counterState devuelve una copia del estado de un campo contador. Si el
+// documento no lo tiene, el valor actual del campo es la base.
+func counterState(doc *Document, field string) *PNCounter {
+	if doc.CRDT != nil {
+		if counter, exists := doc.CRDT.Counters[field]; exists {
+			return counter.clone()
+		}
+	}
+
+	counter := &PNCounter{}
+	if value := newOrderedValue(doc.Data[field]); value.kind == orderedKindNumber {
+		counter.Base = value.num
+	}
+	return counter
+}
+
+// setState devuelve una copia del estado de un campo conjunto. Si el documento no
+// lo tiene, los elementos actuales se insertan con una etiqueta derivada de la
+// marca del campo, igual en todos los nodos que tengan esa misma versión.
+func setState(doc *Document, field string) *ORSet {
+	if doc.CRDT != nil {
+		if set, exists := doc.CRDT.Sets[field]; exists {
+			return set.clone()
+		}
+	}
+
+	set := &ORSet{Elements: make(map[string]*ORSetElement)}
+	if values, ok := doc.Data[field].([]any); ok {
+		ts, _ := fieldClock(doc, field)
+		for _, value := range values {
+			set.add(value, ts.String())
+		}
+	}
+	return set
+}
+
+// compareRegisters compara la escritura de un campo en dos documentos. Las marcas
+// iguales solo se dan en documentos sin metadatos; entonces decide el valor.
+func compareRegisters(a, b *Document, field string) int {
+	at, aKnown := fieldClock(a, field)
+	bt, bKnown := fieldClock(b, field)
+	switch {
+	case !aKnown && !bKnown:
+		return 0
+	case !bKnown:
+		return 1
+	case !aKnown:
+		return -1
+	}
+	if c := at.Compare(bt); c != 0 {
+		return c
+	}
+
+	aValue, aExists := a.Data[field]
+	bValue, bExists := b.Data[field]
+	switch {
+	case aExists != bExists:
+		if aExists {
+			return 1
+		}
+		return -1
+	case !aExists:
+		return 0
+	}
+	return strings.Compare(setElementKey(aValue), setElementKey(bValue))
+}
+
+// MergeDocuments fusiona dos versiones de un mismo documento según la
+// especificación de su colección. El resultado no depende del orden de los
+// argumentos. Devuelve también si hubo conflicto, es decir, si cada versión
+// tenía escrituras que la otra no conocía.
+func MergeDocuments(local, remote *Document, spec CRDTSpec) (*Document, bool) {
+	merged := *local
+	merged.Data = make(map[string]any)
+	merged.Score = 0
+	meta := &DocumentCRDT{
+		Clock:  maxTimestamp(documentClock(local), documentClock(remote)),
+		Fields: make(map[string]Timestamp),
+	}
+
+	fields := make(map[string]bool)
+	for _, doc := range []*Document{local, remote} {
+		for field := range doc.Data {
+			fields[field] = true
+		}
+		if doc.CRDT != nil {
+			for field := range doc.CRDT.Fields {
+				fields[field] = true
+			}
+		}
+	}
+
+	localAhead, remoteAhead := false, false
+	for _, field := range slices.Sorted(maps.Keys(fields)) {
+		// El registro del campo decide su valor, o su base si es contador
+		winner := local
+		c := compareRegisters(local, remote, field)
+		if c < 0 {
+			winner = remote
+		}
+		if ts, known := fieldClock(winner, field); known {
+			meta.Fields[field] = ts
+		}
+
+		_, present := winner.Data[field]
+		switch spec.kind(field) {
+		case crdtCounter:
+			if !present {
+				break
+			}
+			counter := mergePNCounters(counterState(winner, field).Base, counterState(local, field), counterState(remote, field))
+			if meta.Counters == nil {
+				meta.Counters = make(map[string]*PNCounter)
+			}
+			meta.Counters[field] = counter
+			merged.Data[field] = counter.Value()
+		case crdtSet:
+			if !present {
+				break
+			}
+			set := mergeORSets(setState(local, field), setState(remote, field))
+			if meta.Sets == nil {
+				meta.Sets = make(map[string]*ORSet)
+			}
+			meta.Sets[field] = set
+			merged.Data[field] = set.Values()
+		default:
+			if present {
+				merged.Data[field] = winner.Data[field]
+			}
+			if c > 0 {
+				localAhead = true
+			} else if c < 0 {
+				remoteAhead = true
+			}
+		}
+	}
+
+	merged.CRDT = meta
+	if remote.CreatedAt.Before(local.CreatedAt) {
+		merged.CreatedAt = remote.CreatedAt
+	}
+	if remote.UpdatedAt.After(local.UpdatedAt) {
+		merged.UpdatedAt = remote.UpdatedAt
+	}
+	merged.Revision = max(local.Revision, remote.Revision)
+
+	return &merged, localAhead && remoteAhead
+}
+
+// sameDocumentState indica si dos versiones tienen los mismos datos y metadatos
+func sameDocumentState(a, b *Document) bool {
+	return reflect.DeepEqual(a.Data, b.Data) && reflect.DeepEqual(a.CRDT, b.CRDT)
+}
+
+// stampLocked marca con ts los campos que cambia una escritura y actualiza el
+// estado de los contadores y conjuntos con la diferencia respecto a la versión
+// anterior (nil al crear), atribuida al nodo de ts. Los contadores y conjuntos
+// no se pueden eliminar: quitar el campo equivale a ponerlo a cero o vaciarlo.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) stampLocked(previous, doc *Document, ts Timestamp) {
+	spec := db.crdtSpecs[doc.Collection]
+
+	meta := &DocumentCRDT{Clock: ts, Fields: make(map[string]Timestamp)}
+	if previous != nil && previous.CRDT != nil {
+		meta.Fields = maps.Clone(previous.CRDT.Fields)
+		meta.Counters = maps.Clone(previous.CRDT.Counters)
+		meta.Sets = maps.Clone(previous.CRDT.Sets)
+	}
+
+	var before map[string]any
+	if previous != nil {
+		before = previous.Data
+	}
+	fields := make(map[string]bool)
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range doc.Data {
+		fields[field] = true
+	}
+
+	cloned := false
+	setData := func(field string, value any) {
+		if !cloned {
+			doc.Data = maps.Clone(doc.Data)
+			cloned = true
+		}
+		doc.Data[field] = value
+	}
+
+	for field := range fields {
+		oldValue, hadOld := before[field]
+		newValue, hasNew := doc.Data[field]
+
+		switch spec.kind(field) {
+		case crdtCounter:
+			var counter *PNCounter
+			target := newOrderedValue(newValue)
+			if !hadOld {
+				counter = &PNCounter{}
+				if target.kind == orderedKindNumber {
+					counter.Base = target.num
+				}
+				meta.Fields[field] = ts
+			} else {
+				counter = counterState(previous, field)
+				next := 0.0
+				if target.kind == orderedKindNumber {
+					next = target.num
+				}
+				counter.add(ts.Node, next-counter.Value())
+			}
+			if meta.Counters == nil {
+				meta.Counters = make(map[string]*PNCounter)
+			}
+			meta.Counters[field] = counter
+			if value := counter.Value(); !hasNew || value != newValue {
+				setData(field, value)
+			}
+
+		case crdtSet:
+			set := &ORSet{Elements: make(map[string]*ORSetElement)}
+			if hadOld {
+				set = setState(previous, field)
+			} else {
+				meta.Fields[field] = ts
+			}
+			values, _ := newValue.([]any)
+			wanted := make(map[string]bool, len(values))
+			for _, value := range values {
+				wanted[setElementKey(value)] = true
+				set.add(value, ts.String())
+			}
+			for key, element := range set.Elements {
+				if element.present() && !wanted[key] {
+					set.remove(key)
+				}
+			}
+			if meta.Sets == nil {
+				meta.Sets = make(map[string]*ORSet)
+			}
+			meta.Sets[field] = set
+			setData(field, set.Values())
+
+		default:
+			if hadOld != hasNew || !reflect.DeepEqual(oldValue, newValue) {
+				meta.Fields[field] = ts
+			}
+		}
+	}
+
+	doc.CRDT = meta
+}
+
+// applyRemoteLocked fusiona un documento recibido de otro nodo con la versión
+// local y guarda el resultado. Devuelve el documento guardado y si la versión
+// local cambió; si una eliminación posterior lo anula devuelve nil. Las
+// colecciones que gestiona el consenso no se modifican, y los documentos
+// fragmentados de los que el nodo no es propietario no se guardan. Debe
+// llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) applyRemoteLocked(remote *Document) (*Document, bool) {
+	db.clock.Update(documentClock(remote))
+	if db.managedLocked(remote.Collection) || !db.hostsLocked(remote.Collection, remote.ID) {
+		return db.documents[remote.ID], false
+	}
+	if db.suppressedLocked(remote) {
+		return nil, false
+	}
+
+	local, exists := db.documents[remote.ID]
+	if !exists {
+		doc := *remote
+		db.putDocumentLocked(&doc)
+		return &doc, true
+	}
+
+	merged, conflict := MergeDocuments(local, remote, db.crdtSpecs[local.Collection])
+	if conflict {
+		db.conflicts++
+	}
+	if sameDocumentState(local, merged) {
+		return local, false
+	}
+
+	merged.Revision = max(merged.Revision, local.Revision+1)
+	db.putDocumentLocked(merged)
+	return merged, true
+}
+
+// ApplyRemoteDocument fusiona un documento recibido de otro nodo con la versión
+// local, lo persiste si cambió y devuelve el documento resultante. Devuelve nil
+// si el documento se eliminó después de la versión recibida.
+func (db *Database) ApplyRemoteDocument(remote *Document) (*Document, error) {
+	db.mutex.Lock()
+	doc, changed := db.applyRemoteLocked(remote)
+	err := db.saveTombstonesLocked()
+	db.mutex.Unlock()
+	if err != nil {
+		return doc, err
+	}
+
+	if changed && db.persistenceEnabled {
+		if err := db.persistence.SaveDocument(doc); err != nil {
+			return doc, fmt.Errorf("error al persistir documento sincronizado: %v", err)
+		}
+	}
+
+	return doc, nil
+}
+
+// ConflictCount devuelve cuántas fusiones de documentos replicados resolvieron
+// escrituras concurrentes en distintos nodos
+func (db *Database) ConflictCount() uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.conflicts
+}
+
+// SetNodeID establece el identificador del nodo en el reloj de replicación
+func (db *Database) SetNodeID(nodeID string) {
+	db.clock.SetNode(nodeID)
+}
+
+// SetCRDTSpec declara los campos contador y conjunto de una colección. Debe
+// declararse igual en todos los nodos y antes de escribir esos campos de forma
+// concurrente. Una especificación vacía elimina la declaración.
+func (db *Database) SetCRDTSpec(collection string, spec CRDTSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	specs := maps.Clone(db.crdtSpecs)
+	if specs == nil {
+		specs = make(map[string]CRDTSpec)
+	}
+	if spec.IsEmpty() {
+		delete(specs, collection)
+	} else {
+		specs[collection] = spec
+	}
+
+	if db.persistenceEnabled {
+		if err := db.persistence.SaveCRDTSpecs(specs); err != nil {
+			return fmt.Errorf("error al persistir especificación CRDT: %v", err)
+		}
+	}
+
+	db.crdtSpecs = specs
+	return nil
+}
+
+// GetCRDTSpec obtiene los campos contador y conjunto declarados en una colección
+func (db *Database) GetCRDTSpec(collection string) CRDTSpec {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.crdtSpecs[collection]
+}
+
+// loadCRDTSpecs carga las especificaciones CRDT persistidas
+func (db *Database) loadCRDTSpecs() error {
+	specs, err := db.persistence.LoadCRDTSpecs()
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	db.crdtSpecs = specs
+	db.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// crdtTestSpec son los campos contador y conjunto de la colección de las pruebas
+var crdtTestSpec = CRDTSpec{Counters: []string{"likes"}, Sets: []string{"tags"}}
+
+// newCRDTTestNode crea un nodo de prueba con la especificación CRDT declarada
+func newCRDTTestNode(t *testing.T, node string) *Database {
+	t.Helper()
+	database := NewDatabase()
+	database.SetNodeID(node)
+	if err := database.SetCRDTSpec("posts", crdtTestSpec); err != nil {
+		t.Fatalf("error al declarar la especificación CRDT: %v", err)
+	}
+	return database
+}
+
+// wireCopy copia un documento como lo recibiría otro nodo por la red
+func wireCopy(t *testing.T, doc *Document) *Document {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("error al serializar documento: %v", err)
+	}
+	var copied Document
+	if err := json.Unmarshal(data, &copied); err != nil {
+		t.Fatalf("error al deserializar documento: %v", err)
+	}
+	return &copied
+}
+
+// documentState devuelve los datos y metadatos de replicación de un documento
+// serializados, para comparar el estado de varios nodos
+func documentState(t *testing.T, doc *Document) string {
+	t.Helper()
+	data, err := json.Marshal(struct {
+		Data map[string]any `json:"data"`
+		CRDT *DocumentCRDT  `json:"crdt"`
+	}{doc.Data, doc.CRDT})
+	if err != nil {
+		t.Fatalf("error al serializar estado: %v", err)
+	}
+	return string(data)
+}
+
+// permutations devuelve todas las ordenaciones de los índices 0..n-1
+func permutations(n int) [][]int {
+	if n == 0 {
+		return [][]int{{}}
+	}
+	var result [][]int
+	for _, perm := range permutations(n - 1) {
+		for i := 0; i <= len(perm); i++ {
+			next := make([]int, 0, n)
+			next = append(next, perm[:i]...)
+			next = append(next, n-1)
+			next = append(next, perm[i:]...)
+			result = append(result, next)
+		}
+	}
+	return result
+}
+
+// concurrentUpdates crea un documento, lo replica en tres nodos y aplica en cada
+// uno escrituras concurrentes. Devuelve la versión original y los mensajes que
+// enviaría cada escritura.
+func concurrentUpdates(t *testing.T) (*Document, []*Document) {
+	t.Helper()
+	origin := newCRDTTestNode(t, "origin")
+	created, err := origin.CreateDocument("posts", map[string]any{
+		"title": "base",
+		"likes": 5,
+		"tags":  []any{"t0", "t1"},
+	})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	base := wireCopy(t, created)
+
+	update := func(database *Database, data map[string]any) *Document {
+		doc, err := database.UpdateDocument(base.ID, data)
+		if err != nil {
+			t.Fatalf("error al actualizar documento: %v", err)
+		}
+		return wireCopy(t, doc)
+	}
+
+	var messages []*Document
+	nodes := map[string]*Database{}
+	for _, name := range []string{"a", "b", "c"} {
+		nodes[name] = newCRDTTestNode(t, name)
+		if _, err := nodes[name].ApplyRemoteDocument(wireCopy(t, base)); err != nil {
+			t.Fatalf("error al replicar documento: %v", err)
+		}
+	}
+
+	// a: cambia el título, suma 1 y añade "x"
+	messages = append(messages, update(nodes["a"], map[string]any{"title": "a", "likes": 6, "tags": []any{"t0", "t1", "x"}}))
+	// b: resta 2 y elimina "t0" y "t1"
+	messages = append(messages, update(nodes["b"], map[string]any{"likes": 3, "tags": []any{}}))
+	// c: cambia el título, suma 3, elimina "t1" y lo vuelve a añadir
+	messages = append(messages, update(nodes["c"], map[string]any{"title": "c", "likes": 8, "tags": []any{"t0"}}))
+	messages = append(messages, update(nodes["c"], map[string]any{"tags": []any{"t0", "t1"}}))
+
+	return base, messages
+}
+
+// TestCRDTConvergesInAnyOrder comprueba que todos los órdenes de entrega de
+// escrituras concurrentes produzcan el mismo documento y que reentregarlas no
+// lo cambie
+func TestCRDTConvergesInAnyOrder(t *testing.T) {
+	base, messages := concurrentUpdates(t)
+
+	// El título lo decide la escritura con la marca posterior
+	wantTitle := "a"
+	if messages[2].CRDT.Fields["title"].Compare(messages[0].CRDT.Fields["title"]) > 0 {
+		wantTitle = "c"
+	}
+
+	var converged string
+	for _, order := range permutations(len(messages)) {
+		replica := newCRDTTestNode(t, "replica")
+		if _, err := replica.ApplyRemoteDocument(wireCopy(t, base)); err != nil {
+			t.Fatalf("error al replicar documento: %v", err)
+		}
+		for _, i := range order {
+			if _, err := replica.ApplyRemoteDocument(wireCopy(t, messages[i])); err != nil {
+				t.Fatalf("error al aplicar mensaje %d: %v", i, err)
+			}
+		}
+
+		doc, err := replica.GetDocument(base.ID)
+		if err != nil {
+			t.Fatalf("error al obtener documento: %v", err)
+		}
+		state := documentState(t, doc)
+		if converged == "" {
+			converged = state
+
+			if doc.Data["title"] != wantTitle {
+				t.Errorf("title = %v, se esperaba %q", doc.Data["title"], wantTitle)
+			}
+			if compareValues(doc.Data["likes"], 7) != 0 {
+				t.Errorf("likes = %v, se esperaba 7", doc.Data["likes"])
+			}
+			if !reflect.DeepEqual(doc.Data["tags"], []any{"t1", "x"}) {
+				t.Errorf("tags = %v, se esperaba [t1 x]", doc.Data["tags"])
+			}
+		} else if state != converged {
+			t.Fatalf("el orden %v produce\n%s\nen lugar de\n%s", order, state, converged)
+		}
+
+		// Reentregar los mensajes, en cualquier orden, no cambia el documento
+		for i := len(order) - 1; i >= 0; i-- {
+			replica.ApplyRemoteDocument(wireCopy(t, messages[order[i]]))
+		}
+		replica.ApplyRemoteDocument(wireCopy(t, base))
+		doc, _ = replica.GetDocument(base.ID)
+		if state := documentState(t, doc); state != converged {
+			t.Fatalf("la reentrega tras el orden %v cambia el documento:\n%s", order, state)
+		}
+	}
+}
+
+// TestMergeDocumentsCommutative comprueba que la fusión de dos versiones no
+// dependa del orden de los argumentos y que fusionar una versión consigo misma
+// no la cambie
+func TestMergeDocumentsCommutative(t *testing.T) {
+	_, messages := concurrentUpdates(t)
+
+	for i, a := range messages {
+		merged, _ := MergeDocuments(a, a, crdtTestSpec)
+		if documentState(t, merged) != documentState(t, a) {
+			t.Errorf("fusionar el mensaje %d consigo mismo lo cambia", i)
+		}
+
+		for j, b := range messages {
+			ab, _ := MergeDocuments(a, b, crdtTestSpec)
+			ba, _ := MergeDocuments(b, a, crdtTestSpec)
+			if documentState(t, ab) != documentState(t, ba) {
+				t.Errorf("la fusión de los mensajes %d y %d depende del orden:\n%s\n%s", i, j, documentState(t, ab), documentState(t, ba))
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"errors"
+	"slices"
+)
+
+// ErrUnknownKey indica que un mensaje está cifrado con una clave de datos que el
+// nodo no conoce o que ya ha caducado
+var ErrUnknownKey = errors.New("clave de datos desconocida")
+
+// PayloadCipher cifra los mensajes de replicación con la clave de datos del clúster
+type PayloadCipher interface {
+	// Seal cifra con la clave actual y devuelve su ID junto con el texto cifrado
+	Seal(plaintext, aad []byte) (keyID string, ciphertext []byte, err error)
+	// Open descifra con la clave indicada; si no la conoce falla con ErrUnknownKey
+	Open(keyID string, ciphertext, aad []byte) ([]byte, error)
+}
+
+// EncryptionPolicy indica qué colecciones se replican cifradas de extremo a
+// extremo. Sus documentos no son legibles por los nodos que solo reenvían los
+// mensajes, y solo se envían por los protocolos punto a punto a los nodos que
+// lista la ACL de replicación.
+type EncryptionPolicy struct {
+	Enabled     bool     `json:"enabled"`
+	Collections []string `json:"collections,omitempty"` // Colecciones cifradas; vacío para todas
+}
+
+// Encrypts indica si una colección se replica cifrada
+func (p EncryptionPolicy) Encrypts(collection string) bool {
+	return p.Enabled && (len(p.Collections) == 0 || slices.Contains(p.Collections, collection))
+}
+
+// encryptsMessage indica si un mensaje afecta a alguna colección cifrada
+func (p EncryptionPolicy) encryptsMessage(msg DBMessage) bool {
+	if msg.Operation == OperationBatch {
+		return slices.ContainsFunc(msg.Batch, p.encryptsMessage)
+	}
+	if collection := messageCollection(msg); collection != "" {
+		return p.Encrypts(collection)
+	}
+	return false
+}
+
+// SetEncryptionPolicy establece qué colecciones se replican cifradas
+func (db *Database) SetEncryptionPolicy(policy EncryptionPolicy) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.encryption = EncryptionPolicy{Enabled: policy.Enabled, Collections: slices.Clone(policy.Collections)}
+}
+
+// EncryptionPolicy devuelve qué colecciones se replican cifradas
+func (db *Database) EncryptionPolicy() EncryptionPolicy {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return EncryptionPolicy{Enabled: db.encryption.Enabled, Collections: slices.Clone(db.encryption.Collections)}
+}
+
+// CanRead indica si se pueden enviar a un nodo los documentos de una colección.
+// Las colecciones cifradas solo se envían a los nodos que lista la ACL.
+func (db *Database) CanRead(peerID string, collection string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return !db.encryption.Encrypts(collection) || db.acl.Lists(peerID)
+}
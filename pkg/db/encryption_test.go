@@ -0,0 +1,167 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testCipher cifra con AES-GCM y una clave por ID, como el servicio de cifrado
+// del nodo
+type testCipher struct {
+	current string
+	keys    map[string][]byte
+}
+
+// newTestCipher crea un cifrador con una clave aleatoria
+func newTestCipher(t *testing.T, keyID string) *testCipher {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("error al generar clave: %v", err)
+	}
+	return &testCipher{current: keyID, keys: map[string][]byte{keyID: key}}
+}
+
+func (c *testCipher) gcm(keyID string) (cipher.AEAD, error) {
+	key, exists := c.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *testCipher) Seal(plaintext, aad []byte) (string, []byte, error) {
+	gcm, err := c.gcm(c.current)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return c.current, gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func (c *testCipher) Open(keyID string, ciphertext, aad []byte) ([]byte, error) {
+	gcm, err := c.gcm(keyID)
+	if err != nil {
+		return nil, err
+	}
+	size := gcm.NonceSize()
+	return gcm.Open(nil, ciphertext[:size], ciphertext[size:], aad)
+}
+
+func TestSealAndOpenEncryptedMessage(t *testing.T) {
+	author := newSigningTestPeer(t)
+	cluster := newTestCipher(t, "k1")
+
+	data, err := sealMessage(author.key, author.id, createMessage("a"), cluster)
+	if err != nil {
+		t.Fatalf("error al cifrar mensaje: %v", err)
+	}
+	if bytes.Contains(data, []byte("hola")) {
+		t.Fatalf("el mensaje cifrado contiene el documento en claro")
+	}
+
+	msg, from, err := openMessage(data, cluster)
+	if err != nil {
+		t.Fatalf("error al abrir mensaje: %v", err)
+	}
+	if from != author.id || msg.Document == nil || msg.Document.Data["texto"] != "hola" {
+		t.Errorf("mensaje abierto = %+v de %s", msg, from)
+	}
+
+	// El cifrado está ligado al nodo de origen
+	other := newSigningTestPeer(t)
+	forged, err := sealMessage(other.key, other.id, DBMessage{}, nil)
+	if err != nil {
+		t.Fatalf("error al firmar mensaje: %v", err)
+	}
+	var envelope, stolen SignedMessage
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		t.Fatalf("error al deserializar mensaje: %v", err)
+	}
+	if err := json.Unmarshal(forged, &stolen); err != nil {
+		t.Fatalf("error al deserializar mensaje: %v", err)
+	}
+	stolen.Payload, stolen.KeyID, stolen.Ciphertext = nil, envelope.KeyID, envelope.Ciphertext
+	if stolen.Signature, err = other.key.Sign(signedBytes(&stolen)); err != nil {
+		t.Fatalf("error al firmar mensaje: %v", err)
+	}
+	restamped, err := json.Marshal(stolen)
+	if err != nil {
+		t.Fatalf("error al serializar mensaje: %v", err)
+	}
+	if _, _, err := openMessage(restamped, cluster); err == nil {
+		t.Errorf("se abrió un texto cifrado reenviado como propio por otro nodo")
+	}
+}
+
+func TestEncryptedCollectionUnreadableWithoutKey(t *testing.T) {
+	author := newSigningTestPeer(t)
+	data, err := sealMessage(author.key, author.id, createMessage("a"), newTestCipher(t, "k1"))
+	if err != nil {
+		t.Fatalf("error al cifrar mensaje: %v", err)
+	}
+
+	// Un nodo sin cifrado o con otras claves no puede leerlo
+	for name, cipher := range map[string]PayloadCipher{"sin cifrado": nil, "otra clave": newTestCipher(t, "k2")} {
+		if _, _, err := openMessage(data, cipher); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("%s: error = %v, se esperaba %v", name, err, ErrUnknownKey)
+		}
+	}
+
+	// Un nodo conocido sin la clave la pide y no cuenta el mensaje como rechazado
+	database := NewDatabase()
+	database.SetEncryptionPolicy(EncryptionPolicy{Enabled: true, Collections: []string{"notas"}})
+	s := newSigningTestSync(t, database)
+	var requested []string
+	s.onMissingKey = func(keyID string, peers ...string) { requested = append(requested, keyID) }
+	if _, err := s.verify(pubsubMessage(t, data, author.id)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("error = %v, se esperaba %v", err, ErrUnknownKey)
+	}
+	if len(requested) != 1 || requested[0] != "k1" {
+		t.Errorf("claves pedidas = %v, se esperaba [k1]", requested)
+	}
+	if database.RejectedCount() != 0 {
+		t.Errorf("rechazados = %d, se esperaban 0", database.RejectedCount())
+	}
+
+	// Un mensaje en claro para una colección cifrada se rechaza
+	plain := author.seal(t, createMessage("b"))
+	if _, err := s.verify(pubsubMessage(t, plain, author.id)); err == nil {
+		t.Errorf("se aceptó un mensaje sin cifrar para una colección cifrada")
+	}
+}
+
+func TestCanReadEncryptedCollection(t *testing.T) {
+	database := NewDatabase()
+	listed := newSigningTestPeer(t)
+	byDefault := newSigningTestPeer(t)
+	database.SetEncryptionPolicy(EncryptionPolicy{Enabled: true, Collections: []string{"secretos"}})
+	if err := database.SetReplicationACL(ReplicationACL{
+		Enabled:     true,
+		DefaultRole: ACLRoleReader,
+		Peers:       map[string]ACLRule{listed.id: {Role: ACLRoleWriter}},
+	}); err != nil {
+		t.Fatalf("error al establecer la ACL: %v", err)
+	}
+
+	if !database.CanRead(listed.id, "secretos") {
+		t.Errorf("un nodo de la ACL no puede leer la colección cifrada")
+	}
+	if database.CanRead(byDefault.id, "secretos") {
+		t.Errorf("un nodo aceptado solo por el rol por defecto puede leer la colección cifrada")
+	}
+	if !database.CanRead(byDefault.id, "notas") {
+		t.Errorf("un nodo no puede leer una colección sin cifrar")
+	}
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore es el motor que guarda cada documento en un archivo JSON dentro del
+// directorio de su colección. Es sencillo de inspeccionar, pero necesita un inodo
+// por documento y la carga inicial lee un archivo por documento.
+type FileStore struct {
+	dir   string
+	dirty map[string]bool // Archivos y directorios escritos desde el último Sync
+	mutex sync.Mutex
+}
+
+// OpenFileStore abre el motor de archivos por documento sobre un directorio
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error al crear directorio de colecciones: %v", err)
+	}
+
+	return &FileStore{
+		dir:   dir,
+		dirty: make(map[string]bool),
+	}, nil
+}
+
+// Name devuelve el nombre del motor
+func (fs *FileStore) Name() string {
+	return StorageEngineFile
+}
+
+// Put escribe un documento en el archivo de su colección
+func (fs *FileStore) Put(doc *Document) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	collectionDir := filepath.Join(fs.dir, doc.Collection)
+	if err := os.MkdirAll(collectionDir, 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de colección: %v", err)
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar documento: %v", err)
+	}
+
+	filePath := filepath.Join(collectionDir, doc.ID+".json")
+	if err := os.WriteFile(filePath, data, 0644); err != nil {
+		return fmt.Errorf("error al guardar documento: %v", err)
+	}
+
+	// El archivo y su directorio se fuerzan a disco en el siguiente Sync
+	fs.dirty[filePath] = true
+	fs.dirty[collectionDir] = true
+	return nil
+}
+
+// Delete elimina el archivo de un documento si existe
+func (fs *FileStore) Delete(collection, id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	collectionDir := filepath.Join(fs.dir, collection)
+	filePath := filepath.Join(collectionDir, id+".json")
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error al eliminar documento: %v", err)
+	}
+
+	delete(fs.dirty, filePath)
+	fs.dirty[collectionDir] = true
+	return nil
+}
+
+// Has indica si existe el archivo de un documento
+func (fs *FileStore) Has(collection, id string) (bool, error) {
+	_, err := os.Stat(filepath.Join(fs.dir, collection, id+".json"))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// ForEach recorre los documentos de todas las colecciones
+func (fs *FileStore) ForEach(fn func(doc *Document) error) error {
+	return fs.walkDocuments(func(filePath string) error {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("error al leer documento %s: %v", filepath.Base(filePath), err)
+		}
+
+		var doc Document
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error al deserializar documento %s: %v", filepath.Base(filePath), err)
+		}
+
+		return fn(&doc)
+	})
+}
+
+// Drop elimina los archivos de todos los documentos. Los esquemas de las
+// colecciones, que comparten el directorio, se conservan.
+func (fs *FileStore) Drop() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	err := fs.walkDocuments(func(filePath string) error {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error al eliminar documento: %v", err)
+		}
+		delete(fs.dirty, filePath)
+		fs.dirty[filepath.Dir(filePath)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fs.dirty[fs.dir] = true
+	return nil
+}
+
+// walkDocuments llama a fn con la ruta de cada archivo de documento
+func (fs *FileStore) walkDocuments(fn func(filePath string) error) error {
+	collections, err := os.ReadDir(fs.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error al leer directorio de colecciones: %v", err)
+	}
+
+	for _, collectionInfo := range collections {
+		if !collectionInfo.IsDir() {
+			continue
+		}
+
+		collectionName := collectionInfo.Name()
+		collectionDir := filepath.Join(fs.dir, collectionName)
+
+		files, err := os.ReadDir(collectionDir)
+		if err != nil {
+			return fmt.Errorf("error al leer directorio de colección %s: %v", collectionName, err)
+		}
+
+		for _, fileInfo := range files {
+			if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".json" || fileInfo.Name() == schemaFileName {
+				continue
+			}
+			if err := fn(filepath.Join(collectionDir, fileInfo.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sync fuerza a disco los archivos y directorios escritos desde el último Sync
+func (fs *FileStore) Sync() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for path := range fs.dirty {
+		if err := syncPath(path); err != nil {
+			return fmt.Errorf("error al sincronizar %s: %v", path, err)
+		}
+	}
+	fs.dirty = make(map[string]bool)
+	return nil
+}
+
+// Close fuerza a disco las escrituras pendientes
+func (fs *FileStore) Close() error {
+	return fs.Sync()
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxClockDrift adelanto máximo que se acepta en el reloj de otro nodo. Un reloj
+// remoto más adelantado no arrastra al local, para que un nodo con la hora mal
+// configurada no adelante los relojes de toda la red.
+const maxClockDrift = time.Minute
+
+// Timestamp es una marca de un reloj lógico híbrido (HLC): el tiempo físico en
+// nanosegundos, un contador lógico para eventos en el mismo instante y el nodo
+// que la generó, que deshace los empates. Las marcas forman un orden total.
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical,omitempty"`
+	Node    string `json:"node,omitempty"`
+}
+
+// Compare compara dos marcas: -1 si t es anterior a other, 1 si es posterior y 0 si son iguales
+func (t Timestamp) Compare(other Timestamp) int {
+	if c := cmp.Compare(t.Wall, other.Wall); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(t.Logical, other.Logical); c != 0 {
+		return c
+	}
+	return cmp.Compare(t.Node, other.Node)
+}
+
+// IsZero indica si la marca está vacía
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0 && t.Node == ""
+}
+
+// String devuelve la marca como "wall.logical@nodo"
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d@%s", t.Wall, t.Logical, t.Node)
+}
+
+// maxTimestamp devuelve la posterior de dos marcas
+func maxTimestamp(a, b Timestamp) Timestamp {
+	if a.Compare(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// HLC es un reloj lógico híbrido. Sus marcas siguen al reloj físico pero nunca
+// retroceden y siempre son posteriores a las marcas recibidas de otros nodos.
+type HLC struct {
+	node  string
+	last  Timestamp
+	now   func() int64
+	mutex sync.Mutex
+}
+
+// NewHLC crea un reloj para un nodo
+func NewHLC(node string) *HLC {
+	return &HLC{
+		node: node,
+		now:  func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// Node devuelve el nodo del reloj
+func (c *HLC) Node() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.node
+}
+
+// SetNode cambia el nodo con el que se marcan los eventos
+func (c *HLC) SetNode(node string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.node = node
+	c.last.Node = node
+}
+
+// Now genera una marca para un evento local
+func (c *HLC) Now() Timestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	wall := c.now()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall, Node: c.node}
+	} else {
+		// Tras incorporar una marca remota la última no lleva el nodo
+		c.last.Logical++
+		c.last.Node = c.node
+	}
+	return c.last
+}
+
+// Update incorpora la marca de un evento recibido de otro nodo, de modo que los
+// eventos locales posteriores queden ordenados después de él
+func (c *HLC) Update(remote Timestamp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	wall := c.now()
+	if remote.Wall-wall > int64(maxClockDrift) {
+		log.Printf("Reloj del nodo %s adelantado %v; no se sincroniza", remote.Node, time.Duration(remote.Wall-wall))
+		return
+	}
+
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	}
+	c.last.Node = c.node
+}
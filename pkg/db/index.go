@@ -3,6 +3,7 @@ package db
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,25 +19,53 @@ const (
 	IndexTypeNonUnique IndexType = "non-unique"
 	// IndexTypeText índice de texto
 	IndexTypeText IndexType = "text"
+	// IndexTypeOrdered índice ordenado, para consultas por rango y ordenación
+	IndexTypeOrdered IndexType = "ordered"
 )
 
 // Index representa un índice en la base de datos
 type Index struct {
-	Name       string            // Nombre del índice
-	Collection string            // Colección a la que pertenece
-	Fields     []string          // Campos indexados
-	Type       IndexType         // Tipo de índice
-	Unique     bool              // Si el índice es único
-	CreatedAt  time.Time         // Fecha de creación
-	UpdatedAt  time.Time         // Fecha de actualización
-	Data       map[string][]string // Datos del índice: valor -> IDs de documentos
-	mutex      sync.RWMutex      // Mutex para concurrencia
+	Name         string                // Nombre del índice
+	Collection   string                // Colección a la que pertenece
+	Fields       []string              // Campos indexados
+	Type         IndexType             // Tipo de índice
+	Unique       bool                  // Si el índice es único
+	CreatedAt    time.Time             // Fecha de creación
+	UpdatedAt    time.Time             // Fecha de actualización
+	Data         map[string][]string   // Datos del índice: valor -> IDs de documentos
+	docValues    map[string]string     // Valor indexado de cada documento: ID -> valor
+	ordered      *skipList             // Entradas ordenadas (solo índices ordenados)
+	docKeys      map[string]orderedKey // Clave ordenada de cada documento: ID -> clave
+	Language     string                // Idioma del analizador (solo índices de texto)
+	text         *textIndex            // Índice invertido (solo índices de texto)
+	textAnalyzer *Analyzer             // Analizador de texto (solo índices de texto)
+	mutex        sync.RWMutex          // Mutex para concurrencia
+}
+
+// IndexDefinition describe un índice para poder persistirlo y reconstruirlo
+type IndexDefinition struct {
+	Name       string    `json:"name"`
+	Collection string    `json:"collection"`
+	Fields     []string  `json:"fields"`
+	Type       IndexType `json:"type"`
+	Language   string    `json:"language,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IndexOption configura un índice al crearlo
+type IndexOption func(*Index)
+
+// WithLanguage establece el idioma del analizador de un índice de texto
+func WithLanguage(language string) IndexOption {
+	return func(idx *Index) {
+		idx.Language = language
+	}
 }
 
 // NewIndex crea un nuevo índice
-func NewIndex(name string, collection string, fields []string, indexType IndexType) *Index {
+func NewIndex(name string, collection string, fields []string, indexType IndexType, options ...IndexOption) *Index {
 	now := time.Now()
-	return &Index{
+	idx := &Index{
 		Name:       name,
 		Collection: collection,
 		Fields:     fields,
@@ -44,7 +73,40 @@ func NewIndex(name string, collection string, fields []string, indexType IndexTy
 		Unique:     indexType == IndexTypeUnique,
 		CreatedAt:  now,
 		UpdatedAt:  now,
-		Data:       make(map[string][]string),
+	}
+	for _, option := range options {
+		option(idx)
+	}
+	if indexType == IndexTypeText {
+		idx.textAnalyzer = NewAnalyzer(idx.Language)
+		idx.Language = idx.textAnalyzer.Language
+	}
+	idx.reset()
+	return idx
+}
+
+// reset vacía el índice. Debe llamarse con el mutex bloqueado.
+func (idx *Index) reset() {
+	idx.Data = make(map[string][]string)
+	idx.docValues = make(map[string]string)
+	if idx.Type == IndexTypeOrdered {
+		idx.ordered = newSkipList()
+		idx.docKeys = make(map[string]orderedKey)
+	}
+	if idx.Type == IndexTypeText {
+		idx.text = newTextIndex(idx.textAnalyzer)
+	}
+}
+
+// Definition devuelve la definición persistible del índice
+func (idx *Index) Definition() IndexDefinition {
+	return IndexDefinition{
+		Name:       idx.Name,
+		Collection: idx.Collection,
+		Fields:     idx.Fields,
+		Type:       idx.Type,
+		Language:   idx.Language,
+		CreatedAt:  idx.CreatedAt,
 	}
 }
 
@@ -53,88 +115,183 @@ func (idx *Index) AddDocument(doc *Document) error {
 	idx.mutex.Lock()
 	defer idx.mutex.Unlock()
 
-	// Obtener valor del campo indexado
-	value, err := idx.getIndexValue(doc)
-	if err != nil {
-		return err
+	return idx.addDocument(doc, idx.Unique)
+}
+
+// addDocument añade un documento al índice, verificando opcionalmente la unicidad.
+// Debe llamarse con el mutex del índice bloqueado.
+func (idx *Index) addDocument(doc *Document, enforceUnique bool) error {
+	// Los índices de texto indexan los términos de sus campos
+	if idx.text != nil {
+		if texts := idx.getTexts(doc.Data); len(texts) > 0 {
+			idx.text.add(doc.ID, texts)
+		} else {
+			idx.text.remove(doc.ID)
+		}
+		idx.UpdatedAt = time.Now()
+		return nil
 	}
 
-	// Verificar unicidad si es necesario
-	if idx.Unique && len(idx.Data[value]) > 0 {
-		return fmt.Errorf("violación de índice único: %s", value)
+	// Obtener valores de los campos indexados. Los documentos sin los campos no se indexan.
+	values, err := idx.getFieldValues(doc)
+	if err != nil {
+		idx.removeDocument(doc.ID)
+		return nil
 	}
+	value := joinIndexKeys(values)
 
-	// Añadir documento al índice
-	if _, exists := idx.Data[value]; !exists {
-		idx.Data[value] = []string{}
+	var key orderedKey
+	if idx.ordered != nil {
+		key = make(orderedKey, len(values))
+		for i, v := range values {
+			key[i] = newOrderedValue(v)
+		}
 	}
 
-	// Verificar si el documento ya está en el índice
-	for _, id := range idx.Data[value] {
-		if id == doc.ID {
-			return nil // Ya está indexado
+	// Si el documento ya está indexado con el mismo valor no hay nada que hacer
+	if current, exists := idx.docValues[doc.ID]; exists && current == value {
+		if idx.ordered == nil || compareOrderedKeys(idx.docKeys[doc.ID], key) == 0 {
+			return nil
 		}
 	}
 
+	// Verificar unicidad si es necesario
+	if enforceUnique && len(idx.Data[value]) > 0 {
+		return fmt.Errorf("violación de índice único %s: %s", idx.Name, value)
+	}
+
+	// Eliminar el valor anterior del documento, si lo había
+	idx.removeDocument(doc.ID)
+
 	// Añadir ID del documento
 	idx.Data[value] = append(idx.Data[value], doc.ID)
+	idx.docValues[doc.ID] = value
+	if idx.ordered != nil {
+		idx.ordered.Insert(key, doc.ID)
+		idx.docKeys[doc.ID] = key
+	}
 	idx.UpdatedAt = time.Now()
 
 	return nil
 }
 
+// checkUnique verifica que el documento no viole la restricción de unicidad del índice
+func (idx *Index) checkUnique(doc *Document) error {
+	_, _, err := idx.checkUniqueExcept(doc, nil)
+	return err
+}
+
+// checkUniqueExcept verifica la unicidad ignorando los documentos de ignore y
+// devuelve el valor único del documento, si lo tiene
+func (idx *Index) checkUniqueExcept(doc *Document, ignore map[string]bool) (string, bool, error) {
+	if !idx.Unique {
+		return "", false, nil
+	}
+
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	value, err := idx.getIndexValue(doc)
+	if err != nil {
+		return "", false, nil
+	}
+
+	for _, id := range idx.Data[value] {
+		if id != doc.ID && !ignore[id] {
+			return "", false, fmt.Errorf("violación de índice único %s: %s", idx.Name, value)
+		}
+	}
+
+	return value, true, nil
+}
+
 // RemoveDocument elimina un documento del índice
 func (idx *Index) RemoveDocument(docID string) {
 	idx.mutex.Lock()
 	defer idx.mutex.Unlock()
 
-	// Buscar y eliminar el documento de todos los valores
-	for value, ids := range idx.Data {
-		newIDs := []string{}
-		for _, id := range ids {
-			if id != docID {
-				newIDs = append(newIDs, id)
-			}
-		}
+	idx.removeDocument(docID)
+}
 
-		if len(newIDs) == 0 {
-			delete(idx.Data, value)
-		} else {
-			idx.Data[value] = newIDs
+// removeDocument elimina un documento del índice. Debe llamarse con el mutex bloqueado.
+func (idx *Index) removeDocument(docID string) {
+	if idx.text != nil {
+		idx.text.remove(docID)
+		return
+	}
+
+	value, exists := idx.docValues[docID]
+	if !exists {
+		return
+	}
+
+	ids := idx.Data[value]
+	for i, id := range ids {
+		if id == docID {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
 		}
 	}
 
+	if len(ids) == 0 {
+		delete(idx.Data, value)
+	} else {
+		idx.Data[value] = ids
+	}
+
+	delete(idx.docValues, docID)
+	if idx.ordered != nil {
+		idx.ordered.Delete(idx.docKeys[docID], docID)
+		delete(idx.docKeys, docID)
+	}
 	idx.UpdatedAt = time.Now()
 }
 
 // UpdateDocument actualiza un documento en el índice
 func (idx *Index) UpdateDocument(doc *Document) error {
-	// Primero eliminar el documento
-	idx.RemoveDocument(doc.ID)
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
 
-	// Luego añadirlo de nuevo
-	return idx.AddDocument(doc)
+	return idx.addDocument(doc, idx.Unique)
 }
 
-// Search busca documentos por valor indexado
-func (idx *Index) Search(value string) []string {
+// Lookup devuelve los IDs de los documentos cuyo valor indexado coincide exactamente
+func (idx *Index) Lookup(value string) []string {
 	idx.mutex.RLock()
 	defer idx.mutex.RUnlock()
 
-	// Búsqueda exacta
-	if ids, exists := idx.Data[value]; exists {
-		return ids
+	ids := idx.Data[value]
+	result := make([]string, len(ids))
+	copy(result, ids)
+	return result
+}
+
+// Size devuelve el número de documentos indexados
+func (idx *Index) Size() int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if idx.text != nil {
+		return len(idx.text.docLengths)
 	}
+	return len(idx.docValues)
+}
 
-	// Si es un índice de texto, realizar búsqueda parcial
+// Search busca documentos por valor indexado. En los índices de texto realiza una
+// búsqueda de texto y devuelve los documentos ordenados por relevancia.
+func (idx *Index) Search(value string) []string {
 	if idx.Type == IndexTypeText {
-		var results []string
-		for indexValue, ids := range idx.Data {
-			if strings.Contains(indexValue, value) {
-				results = append(results, ids...)
-			}
-		}
-		return results
+		return rankByScore(idx.TextSearch(value))
+	}
+
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	// Búsqueda exacta
+	if ids, exists := idx.Data[value]; exists {
+		result := make([]string, len(ids))
+		copy(result, ids)
+		return result
 	}
 
 	return []string{}
@@ -142,45 +299,58 @@ func (idx *Index) Search(value string) []string {
 
 // getIndexValue obtiene el valor indexado de un documento
 func (idx *Index) getIndexValue(doc *Document) (string, error) {
-	if len(idx.Fields) == 0 {
-		return "", fmt.Errorf("no hay campos definidos para el índice")
+	values, err := idx.getFieldValues(doc)
+	if err != nil {
+		return "", err
 	}
 
-	// Para índices de un solo campo
-	if len(idx.Fields) == 1 {
-		field := idx.Fields[0]
-		
-		// Si el campo es "_id", usar el ID del documento
-		if field == "_id" {
-			return doc.ID, nil
-		}
-
-		// Obtener el valor del campo
-		value, err := getFieldValue(doc.Data, field)
-		if err != nil {
-			return "", err
-		}
+	return joinIndexKeys(values), nil
+}
 
-		return fmt.Sprintf("%v", value), nil
+// getFieldValues obtiene los valores de los campos indexados de un documento
+func (idx *Index) getFieldValues(doc *Document) ([]interface{}, error) {
+	if len(idx.Fields) == 0 {
+		return nil, fmt.Errorf("no hay campos definidos para el índice")
 	}
 
-	// Para índices compuestos
-	var values []string
+	values := make([]interface{}, 0, len(idx.Fields))
 	for _, field := range idx.Fields {
+		// Si el campo es "_id", usar el ID del documento
 		if field == "_id" {
 			values = append(values, doc.ID)
 			continue
 		}
 
+		// Obtener el valor del campo
 		value, err := getFieldValue(doc.Data, field)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
-		values = append(values, fmt.Sprintf("%v", value))
+		values = append(values, value)
 	}
 
-	return strings.Join(values, "|"), nil
+	return values, nil
+}
+
+// joinIndexKeys construye la clave de igualdad de un índice. En los índices
+// compuestos los valores de cada campo se separan con "|".
+func joinIndexKeys(values []interface{}) string {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = indexKey(value)
+	}
+	return strings.Join(keys, "|")
+}
+
+// indexKey convierte un valor en la clave usada por los índices. Los números se
+// normalizan para que los valores iguales de distinto tipo (1, 1.0, 1e0) tengan
+// la misma clave, igual que al compararlos.
+func indexKey(value interface{}) string {
+	if v := newOrderedValue(value); v.kind == orderedKindNumber {
+		return strconv.FormatFloat(v.num, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
 }
 
 // getFieldValue obtiene el valor de un campo en un documento
@@ -242,7 +412,7 @@ func NewIndexManager() *IndexManager {
 }
 
 // CreateIndex crea un nuevo índice
-func (im *IndexManager) CreateIndex(name string, collection string, fields []string, indexType IndexType) (*Index, error) {
+func (im *IndexManager) CreateIndex(name string, collection string, fields []string, indexType IndexType, options ...IndexOption) (*Index, error) {
 	im.mutex.Lock()
 	defer im.mutex.Unlock()
 
@@ -251,8 +421,13 @@ func (im *IndexManager) CreateIndex(name string, collection string, fields []str
 		return nil, fmt.Errorf("ya existe un índice con el nombre %s", name)
 	}
 
+	// Verificar que se hayan indicado campos
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("el índice %s debe tener al menos un campo", name)
+	}
+
 	// Crear índice
-	index := NewIndex(name, collection, fields, indexType)
+	index := NewIndex(name, collection, fields, indexType, options...)
 	im.Indexes[name] = index
 
 	return index, nil
@@ -295,17 +470,75 @@ func (im *IndexManager) DropIndex(name string) error {
 	return nil
 }
 
-// AddDocument añade un documento a todos los índices de su colección
-func (im *IndexManager) AddDocument(doc *Document) error {
-	indexes := im.GetIndexesForCollection(doc.Collection)
-	for _, index := range indexes {
-		if err := index.AddDocument(doc); err != nil {
+// Definitions devuelve las definiciones de todos los índices
+func (im *IndexManager) Definitions() []IndexDefinition {
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	definitions := make([]IndexDefinition, 0, len(im.Indexes))
+	for _, index := range im.Indexes {
+		definitions = append(definitions, index.Definition())
+	}
+
+	return definitions
+}
+
+// CheckDocument verifica que un documento pueda indexarse sin violar restricciones de unicidad
+func (im *IndexManager) CheckDocument(doc *Document) error {
+	for _, index := range im.GetIndexesForCollection(doc.Collection) {
+		if err := index.checkUnique(doc); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// CheckDocuments verifica que un conjunto de documentos escritos a la vez no viole
+// la unicidad, ni con los documentos existentes ni entre sí. Los documentos de
+// replaced, que el mismo conjunto modifica o elimina, no cuentan como existentes.
+func (im *IndexManager) CheckDocuments(docs []*Document, replaced map[string]bool) error {
+	seen := make(map[string]string)
+	for _, doc := range docs {
+		for _, index := range im.GetIndexesForCollection(doc.Collection) {
+			value, unique, err := index.checkUniqueExcept(doc, replaced)
+			if err != nil {
+				return err
+			}
+			if !unique {
+				continue
+			}
+
+			key := index.Name + "\x00" + value
+			if id, exists := seen[key]; exists && id != doc.ID {
+				return fmt.Errorf("violación de índice único %s: %s", index.Name, value)
+			}
+			seen[key] = doc.ID
+		}
+	}
+	return nil
+}
+
+// AddDocument añade un documento a todos los índices de su colección
+func (im *IndexManager) AddDocument(doc *Document) error {
+	// Verificar todas las restricciones antes de modificar ningún índice
+	if err := im.CheckDocument(doc); err != nil {
+		return err
+	}
+
+	im.ReindexDocument(doc)
+	return nil
+}
+
+// ReindexDocument indexa un documento sin verificar unicidad. Se usa para aplicar
+// escrituras ya confirmadas (replicación y reproducción del log de transacciones).
+func (im *IndexManager) ReindexDocument(doc *Document) {
+	for _, index := range im.GetIndexesForCollection(doc.Collection) {
+		index.mutex.Lock()
+		index.addDocument(doc, false)
+		index.mutex.Unlock()
+	}
+}
+
 // RemoveDocument elimina un documento de todos los índices de su colección
 func (im *IndexManager) RemoveDocument(doc *Document) {
 	indexes := im.GetIndexesForCollection(doc.Collection)
@@ -316,13 +549,7 @@ func (im *IndexManager) RemoveDocument(doc *Document) {
 
 // UpdateDocument actualiza un documento en todos los índices de su colección
 func (im *IndexManager) UpdateDocument(doc *Document) error {
-	indexes := im.GetIndexesForCollection(doc.Collection)
-	for _, index := range indexes {
-		if err := index.UpdateDocument(doc); err != nil {
-			return err
-		}
-	}
-	return nil
+	return im.AddDocument(doc)
 }
 
 // FindDocumentsByIndex busca documentos usando un índice específico
@@ -360,15 +587,21 @@ func (im *IndexManager) RebuildIndex(indexName string, documents []*Document) er
 		return fmt.Errorf("índice %s no encontrado", indexName)
 	}
 
+	return index.rebuild(documents, index.Unique)
+}
+
+// rebuild vacía el índice y vuelve a añadir los documentos de su colección
+func (idx *Index) rebuild(documents []*Document, enforceUnique bool) error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
 	// Limpiar índice
-	index.mutex.Lock()
-	index.Data = make(map[string][]string)
-	index.mutex.Unlock()
+	idx.reset()
 
 	// Añadir documentos
 	for _, doc := range documents {
-		if doc.Collection == index.Collection {
-			if err := index.AddDocument(doc); err != nil {
+		if doc.Collection == idx.Collection {
+			if err := idx.addDocument(doc, enforceUnique); err != nil {
 				return err
 			}
 		}
@@ -380,9 +613,13 @@ func (im *IndexManager) RebuildIndex(indexName string, documents []*Document) er
 // RebuildAllIndexes reconstruye todos los índices
 func (im *IndexManager) RebuildAllIndexes(documents []*Document) error {
 	im.mutex.RLock()
-	defer im.mutex.RUnlock()
-
+	names := make([]string, 0, len(im.Indexes))
 	for name := range im.Indexes {
+		names = append(names, name)
+	}
+	im.mutex.RUnlock()
+
+	for _, name := range names {
 		if err := im.RebuildIndex(name, documents); err != nil {
 			return err
 		}
@@ -390,3 +627,204 @@ func (im *IndexManager) RebuildAllIndexes(documents []*Document) error {
 
 	return nil
 }
+
+// findIndex busca un índice de igualdad de la colección que cubra exactamente los campos dados
+func (im *IndexManager) findIndex(collection string, fields []string) *Index {
+	for _, index := range im.GetIndexesForCollection(collection) {
+		if index.Type == IndexTypeText || len(index.Fields) != len(fields) {
+			continue
+		}
+
+		matches := true
+		for i, field := range fields {
+			if index.Fields[i] != field {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return index
+		}
+	}
+
+	return nil
+}
+
+// lookupCondition obtiene los IDs candidatos para una condición de igualdad,
+// pertenencia o rango usando un índice. Devuelve false si ningún índice es aplicable.
+func (im *IndexManager) lookupCondition(collection string, condition QueryCondition) ([]string, bool) {
+	switch condition.Operator {
+	case OperatorGT, OperatorGTE, OperatorLT, OperatorLTE, OperatorSTARTSWITH:
+		return im.lookupRange(collection, []QueryCondition{condition})
+	case OperatorEQ, OperatorIN:
+	default:
+		return nil, false
+	}
+
+	index := im.findIndex(collection, []string{condition.Field})
+	if index == nil {
+		return nil, false
+	}
+
+	if condition.Operator == OperatorEQ {
+		return index.Lookup(indexKey(condition.Value)), true
+	}
+
+	values, ok := condition.Value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	// Unir los resultados de cada valor sin duplicados
+	seen := make(map[string]bool)
+	var ids []string
+	for _, value := range values {
+		for _, id := range index.Lookup(indexKey(value)) {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, true
+}
+
+// lookupCompound obtiene los IDs candidatos usando un índice compuesto cuyos
+// campos estén todos fijados por condiciones de igualdad
+func (im *IndexManager) lookupCompound(collection string, equalities map[string]interface{}) ([]string, bool) {
+	if len(equalities) < 2 {
+		return nil, false
+	}
+
+	for _, index := range im.GetIndexesForCollection(collection) {
+		if index.Type == IndexTypeText || len(index.Fields) < 2 {
+			continue
+		}
+
+		values := make([]string, 0, len(index.Fields))
+		for _, field := range index.Fields {
+			value, exists := equalities[field]
+			if !exists {
+				break
+			}
+			values = append(values, indexKey(value))
+		}
+
+		if len(values) == len(index.Fields) {
+			return index.Lookup(strings.Join(values, "|")), true
+		}
+	}
+
+	return nil, false
+}
+
+// findOrderedIndex busca el índice ordenado de la colección que acote más campos
+// con las condiciones dadas. A igualdad de campos se prefiere el índice más corto.
+func (im *IndexManager) findOrderedIndex(collection string, conditions []QueryCondition) (*Index, keyRange) {
+	var best *Index
+	var bestRange keyRange
+	bestBounded := 0
+
+	for _, index := range im.GetIndexesForCollection(collection) {
+		if index.Type != IndexTypeOrdered {
+			continue
+		}
+
+		r, bounded := index.rangeFor(conditions)
+		if bounded == 0 {
+			continue
+		}
+		if best == nil || bounded > bestBounded || (bounded == bestBounded && len(index.Fields) < len(best.Fields)) {
+			best, bestRange, bestBounded = index, r, bounded
+		}
+	}
+
+	return best, bestRange
+}
+
+// lookupRange obtiene los IDs candidatos para un conjunto de condiciones usando un
+// índice ordenado: igualdades sobre los primeros campos y un rango sobre el siguiente
+func (im *IndexManager) lookupRange(collection string, conditions []QueryCondition) ([]string, bool) {
+	index, r := im.findOrderedIndex(collection, conditions)
+	if index == nil {
+		return nil, false
+	}
+
+	return index.LookupRange(r), true
+}
+
+// findSortIndex busca un índice ordenado que devuelva los documentos en el orden
+// pedido. Los primeros campos del índice pueden estar fijados por igualdades; los
+// siguientes deben ser exactamente los campos de ordenación, todos en la misma
+// dirección. Un índice con más campos no sirve: no contiene los documentos a los
+// que les falta alguno de los campos finales.
+func (im *IndexManager) findSortIndex(collection string, sortOptions []SortOption, conditions []QueryCondition) (*Index, bool) {
+	if len(sortOptions) == 0 {
+		return nil, false
+	}
+
+	descending := sortOptions[0].Direction == SortDescending
+	for _, option := range sortOptions {
+		if (option.Direction == SortDescending) != descending {
+			return nil, false
+		}
+	}
+
+	for _, index := range im.GetIndexesForCollection(collection) {
+		if index.Type != IndexTypeOrdered {
+			continue
+		}
+
+		// Saltar los campos fijados por igualdades que preceden a la ordenación
+		offset := 0
+		for offset < len(index.Fields) && index.Fields[offset] != sortOptions[0].Field {
+			if _, ok := findEquality(conditions, index.Fields[offset]); !ok {
+				break
+			}
+			offset++
+		}
+
+		if len(index.Fields)-offset != len(sortOptions) {
+			continue
+		}
+
+		matches := true
+		for i, option := range sortOptions {
+			if index.Fields[offset+i] != option.Field {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return index, descending
+		}
+	}
+
+	return nil, false
+}
+
+// findTextIndex busca el índice de texto de la colección que cubre el campo.
+// Si el campo está vacío se usa el primer índice de texto de la colección.
+func (im *IndexManager) findTextIndex(collection string, field string) *Index {
+	var found *Index
+	for _, index := range im.GetIndexesForCollection(collection) {
+		if index.Type != IndexTypeText {
+			continue
+		}
+		if field == "" {
+			if found == nil || index.Name < found.Name {
+				found = index
+			}
+			continue
+		}
+		for _, indexField := range index.Fields {
+			if indexField == field {
+				return index
+			}
+		}
+	}
+	return found
+}
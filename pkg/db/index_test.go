@@ -0,0 +1,96 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestIndexKeyNumericParity comprueba que los números iguales de distinto tipo
+// tengan la misma clave de índice
+func TestIndexKeyNumericParity(t *testing.T) {
+	groups := [][]interface{}{
+		{int(100000000), int64(100000000), uint32(100000000), float64(1e8), json.Number("100000000")},
+		{int(2500000), float64(2.5e6), float32(2.5e6)},
+		{int(-3), int8(-3), float64(-3)},
+		{float64(0.1), json.Number("0.1")},
+	}
+
+	for _, group := range groups {
+		want := indexKey(group[0])
+		for _, value := range group[1:] {
+			if got := indexKey(value); got != want {
+				t.Errorf("indexKey(%T %v) = %q, se esperaba %q", value, value, got, want)
+			}
+		}
+	}
+
+	if indexKey(1) == indexKey(1.5) {
+		t.Errorf("valores distintos con la misma clave: %q", indexKey(1))
+	}
+}
+
+// TestIndexedQueryNumericParity comprueba que una consulta con índice devuelva los
+// mismos documentos que sin él cuando los números son de distinto tipo
+func TestIndexedQueryNumericParity(t *testing.T) {
+	database := NewDatabase()
+	for _, value := range []interface{}{int(100000000), float64(1e8), int64(100000000), 7} {
+		if _, err := database.CreateDocument("items", map[string]interface{}{"n": value, "kind": "a"}); err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+	}
+
+	count := func(value interface{}) int {
+		docs, err := NewQuery("items").Where("n", OperatorEQ, value).Execute(database)
+		if err != nil {
+			t.Fatalf("error al ejecutar consulta: %v", err)
+		}
+		return len(docs)
+	}
+	countCompound := func(value interface{}) int {
+		docs, err := NewQuery("items").And(
+			QueryCondition{Field: "kind", Operator: OperatorEQ, Value: "a"},
+			QueryCondition{Field: "n", Operator: OperatorEQ, Value: value},
+		).Execute(database)
+		if err != nil {
+			t.Fatalf("error al ejecutar consulta: %v", err)
+		}
+		return len(docs)
+	}
+
+	scanned := count(1e8)
+	if scanned != 3 {
+		t.Fatalf("consulta sin índice: %d documentos, se esperaban 3", scanned)
+	}
+
+	if _, err := database.CreateIndex("items_n", "items", []string{"n"}, IndexTypeNonUnique); err != nil {
+		t.Fatalf("error al crear índice: %v", err)
+	}
+	if _, err := database.CreateIndex("items_kind_n", "items", []string{"kind", "n"}, IndexTypeNonUnique); err != nil {
+		t.Fatalf("error al crear índice compuesto: %v", err)
+	}
+
+	for _, value := range []interface{}{int(100000000), float64(1e8), json.Number("100000000")} {
+		if got := count(value); got != scanned {
+			t.Errorf("consulta con índice por %T %v: %d documentos, se esperaban %d", value, value, got, scanned)
+		}
+		if got := countCompound(value); got != scanned {
+			t.Errorf("consulta con índice compuesto por %T %v: %d documentos, se esperaban %d", value, value, got, scanned)
+		}
+	}
+}
+
+// TestUniqueIndexNumericParity comprueba que un índice único rechace números
+// iguales de distinto tipo
+func TestUniqueIndexNumericParity(t *testing.T) {
+	database := NewDatabase()
+	if _, err := database.CreateIndex("codes_code", "codes", []string{"code"}, IndexTypeUnique); err != nil {
+		t.Fatalf("error al crear índice: %v", err)
+	}
+
+	if _, err := database.CreateDocument("codes", map[string]interface{}{"code": int(2500000)}); err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	if _, err := database.CreateDocument("codes", map[string]interface{}{"code": float64(2.5e6)}); err == nil {
+		t.Errorf("el índice único admitió un valor duplicado de otro tipo")
+	}
+}
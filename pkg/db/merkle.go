@@ -0,0 +1,261 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"maps"
+	"slices"
+)
+
+// Forma de los árboles Merkle: 16 hijos por nodo y 3 niveles bajo la raíz, es
+// decir, 4096 hojas por colección
+const (
+	merkleFanout = 16
+	merkleDepth  = 3
+	merkleLeaves = merkleFanout * merkleFanout * merkleFanout
+)
+
+// Tipos de entrada de los árboles Merkle
+const (
+	merkleDocument  = 'd'
+	merkleTombstone = 't'
+)
+
+// MerkleTree resume el contenido de una colección para compararlo con el de otro
+// nodo sin transferir los documentos. Cada documento y cada lápida aportan un
+// hash de su ID y de su versión a la hoja que corresponde a su ID, y cada nodo
+// del árbol es el XOR de los hashes de su subárbol, así que una escritura solo
+// cambia un nodo por nivel.
+type MerkleTree struct {
+	levels [][]uint64          // levels[0] es la raíz y levels[merkleDepth] las hojas
+	leaves []map[string]uint64 // Hash de las entradas de cada hoja por clave
+}
+
+// newMerkleTree crea un árbol vacío
+func newMerkleTree() *MerkleTree {
+	tree := &MerkleTree{
+		levels: make([][]uint64, merkleDepth+1),
+		leaves: make([]map[string]uint64, merkleLeaves),
+	}
+	width := 1
+	for level := range tree.levels {
+		tree.levels[level] = make([]uint64, width)
+		width *= merkleFanout
+	}
+	return tree
+}
+
+// Root devuelve el hash de la raíz; cero si el árbol está vacío
+func (t *MerkleTree) Root() uint64 {
+	return t.levels[0][0]
+}
+
+// set cambia el hash de una entrada; un hash cero la elimina
+func (t *MerkleTree) set(key, id string, hash uint64) {
+	leaf := merkleLeaf(id)
+	old := t.leaves[leaf][key]
+	if old == hash {
+		return
+	}
+
+	if hash == 0 {
+		delete(t.leaves[leaf], key)
+	} else {
+		if t.leaves[leaf] == nil {
+			t.leaves[leaf] = make(map[string]uint64)
+		}
+		t.leaves[leaf][key] = hash
+	}
+
+	delta := old ^ hash
+	index := leaf
+	for level := merkleDepth; level >= 0; level-- {
+		t.levels[level][index] ^= delta
+		index /= merkleFanout
+	}
+}
+
+// nodes devuelve los hashes de los nodos indicados de un nivel
+func (t *MerkleTree) nodes(level int, indexes []uint32) []uint64 {
+	hashes := make([]uint64, len(indexes))
+	if level < 0 || level > merkleDepth {
+		return hashes
+	}
+	for i, index := range indexes {
+		if int(index) < len(t.levels[level]) {
+			hashes[i] = t.levels[level][index]
+		}
+	}
+	return hashes
+}
+
+// entries devuelve las entradas de las hojas indicadas
+func (t *MerkleTree) entries(leaves []uint32) map[string]uint64 {
+	entries := make(map[string]uint64)
+	for _, leaf := range leaves {
+		if int(leaf) < len(t.leaves) {
+			maps.Copy(entries, t.leaves[leaf])
+		}
+	}
+	return entries
+}
+
+// merkleLeaf devuelve la hoja que corresponde a un ID
+func merkleLeaf(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32() % merkleLeaves
+}
+
+// merkleKey devuelve la clave de una entrada: un documento y su lápida son
+// entradas distintas con el mismo ID
+func merkleKey(kind byte, id string) string {
+	return string(kind) + ":" + id
+}
+
+// merkleKeyID devuelve el ID de una clave de entrada
+func merkleKeyID(key string) string {
+	if len(key) < 2 {
+		return ""
+	}
+	return key[2:]
+}
+
+// merkleHash calcula el hash de una entrada. La versión es la marca HLC de la
+// última escritura (o de la eliminación), que coincide en todos los nodos que
+// tienen el mismo estado; Revision, en cambio, es local a cada nodo.
+func merkleHash(kind byte, collection, id string, version Timestamp) uint64 {
+	h := sha256.New()
+	h.Write([]byte{kind})
+	h.Write([]byte(collection))
+	h.Write([]byte{0})
+	h.Write([]byte(id))
+	h.Write([]byte{0})
+	h.Write([]byte(version.String()))
+	sum := binary.BigEndian.Uint64(h.Sum(nil))
+	if sum == 0 {
+		sum = 1
+	}
+	return sum
+}
+
+// merkleTreeLocked devuelve el árbol de una colección, creándolo si no existe.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) merkleTreeLocked(collection string) *MerkleTree {
+	tree, exists := db.merkle[collection]
+	if !exists {
+		if db.merkle == nil {
+			db.merkle = make(map[string]*MerkleTree)
+		}
+		tree = newMerkleTree()
+		db.merkle[collection] = tree
+	}
+	return tree
+}
+
+// trackDocumentLocked anota la versión de un documento en el árbol de su colección.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) trackDocumentLocked(doc *Document) {
+	hash := merkleHash(merkleDocument, doc.Collection, doc.ID, documentClock(doc))
+	db.merkleTreeLocked(doc.Collection).set(merkleKey(merkleDocument, doc.ID), doc.ID, hash)
+}
+
+// untrackDocumentLocked quita un documento del árbol de su colección.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) untrackDocumentLocked(doc *Document) {
+	db.merkleTreeLocked(doc.Collection).set(merkleKey(merkleDocument, doc.ID), doc.ID, 0)
+}
+
+// setTombstoneLocked guarda una lápida y la anota en el árbol de su colección.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) setTombstoneLocked(tombstone *Tombstone) {
+	if db.tombstones == nil {
+		db.tombstones = make(map[string]*Tombstone)
+	}
+	db.tombstones[tombstone.ID] = tombstone
+	db.recordChangeLocked(tombstone.ID)
+
+	hash := merkleHash(merkleTombstone, tombstone.Collection, tombstone.ID, tombstone.Deleted)
+	db.merkleTreeLocked(tombstone.Collection).set(merkleKey(merkleTombstone, tombstone.ID), tombstone.ID, hash)
+}
+
+// dropTombstoneLocked elimina una lápida y la quita del árbol de su colección.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) dropTombstoneLocked(id string) {
+	tombstone, exists := db.tombstones[id]
+	if !exists {
+		return
+	}
+	delete(db.tombstones, id)
+	db.merkleTreeLocked(tombstone.Collection).set(merkleKey(merkleTombstone, id), id, 0)
+}
+
+// rebuildMerkleLocked reconstruye los árboles con los documentos y lápidas
+// actuales. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) rebuildMerkleLocked() {
+	db.merkle = make(map[string]*MerkleTree)
+	for _, doc := range db.documents {
+		db.trackDocumentLocked(doc)
+	}
+	for _, tombstone := range db.tombstones {
+		db.setTombstoneLocked(tombstone)
+	}
+}
+
+// MerkleRoots devuelve la raíz del árbol Merkle de cada colección no vacía
+func (db *Database) MerkleRoots() map[string]uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	roots := make(map[string]uint64, len(db.merkle))
+	for collection, tree := range db.merkle {
+		if root := tree.Root(); root != 0 {
+			roots[collection] = root
+		}
+	}
+	return roots
+}
+
+// MerkleNodes devuelve los hashes de los nodos indicados de un nivel del árbol
+// de una colección (0 es la raíz y 3 las hojas)
+func (db *Database) MerkleNodes(collection string, level int, indexes []uint32) []uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	tree, exists := db.merkle[collection]
+	if !exists {
+		return make([]uint64, len(indexes))
+	}
+	return tree.nodes(level, indexes)
+}
+
+// MerkleEntries devuelve el hash de cada documento y lápida de las hojas indicadas
+func (db *Database) MerkleEntries(collection string, leaves []uint32) map[string]uint64 {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	tree, exists := db.merkle[collection]
+	if !exists {
+		return map[string]uint64{}
+	}
+	return tree.entries(leaves)
+}
+
+// GetReplicas devuelve los documentos y lápidas de una colección con los IDs indicados
+func (db *Database) GetReplicas(collection string, ids []string) ([]*Document, []*Tombstone) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var documents []*Document
+	var tombstones []*Tombstone
+	for _, id := range slices.Compact(slices.Sorted(slices.Values(ids))) {
+		if doc, exists := db.documents[id]; exists && doc.Collection == collection {
+			documents = append(documents, doc)
+		}
+		if tombstone, exists := db.tombstones[id]; exists && tombstone.Collection == collection {
+			tombstones = append(tombstones, tombstone.clone())
+		}
+	}
+	return documents, tombstones
+}
@@ -19,6 +19,10 @@ type Document struct {
 	Data       map[string]any `json:"data"`
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
+	Revision   uint64         `json:"revision"`            // Aumenta con cada escritura del documento
+	CRDT       *DocumentCRDT  `json:"crdt,omitempty"`      // Metadatos para fusionar versiones de distintos nodos
+	Score      float64        `json:"score,omitempty"`     // Relevancia en las búsquedas de texto
+	LogIndex   uint64         `json:"log_index,omitempty"` // Entrada del log de consenso que escribió la versión
 }
 
 // EventCallback es una función que se llama cuando ocurre un evento en la base de datos
@@ -31,9 +35,39 @@ type Database struct {
 	persistence        *PersistenceManager
 	dataDir            string
 	persistenceEnabled bool
-	eventCallbacks     []EventCallback // Callbacks para eventos
-	sync               *DBSync         // Gestor de sincronización P2P
-	syncEnabled        bool            // Indica si la sincronización está habilitada
+	eventCallbacks     []EventCallback    // Callbacks para eventos
+	sync               *DBSync            // Gestor de sincronización P2P
+	syncEnabled        bool               // Indica si la sincronización está habilitada
+	indexes            *IndexManager      // Índices secundarios de las colecciones
+	schemas            map[string]*Schema // Esquemas de validación por colección
+
+	// Replicación
+	clock       *HLC                   // Reloj con el que se marcan las escrituras locales
+	crdtSpecs   map[string]CRDTSpec    // Campos contador y conjunto por colección
+	conflicts   uint64                 // Fusiones con escrituras concurrentes
+	merkle      map[string]*MerkleTree // Resumen de cada colección para la anti-entropía
+	replication ReplicationPolicy      // Colecciones y documentos que replica el nodo
+	acl         ReplicationACL         // Nodos que pueden escribir a través de la replicación
+	rejected    uint64                 // Mensajes de replicación rechazados
+	encryption  EncryptionPolicy       // Colecciones que se replican cifradas
+
+	// Eliminaciones replicadas
+	tombstones      map[string]*Tombstone // Lápidas de los documentos eliminados
+	peers           map[string]bool       // Nodos que deben confirmar las eliminaciones
+	tombstoneGrace  time.Duration         // Tiempo mínimo que se conservan las lápidas
+	tombstonesDirty bool                  // Lápidas o nodos pendientes de persistir
+
+	// Control de versiones para detectar conflictos entre transacciones
+	commitSeq   uint64                 // Secuencia de escrituras confirmadas
+	docVersions map[string]uint64      // Secuencia de la última escritura de cada documento
+	txHistory   map[string][]txVersion // Versiones anteriores de los documentos escritos con transacciones abiertas
+	txSnapshots map[uint64]int         // Transacciones abiertas por secuencia de su instantánea
+
+	changes  *changeLog // Orden de los cambios, para ponerse al día tras una instantánea
+	readOnly bool       // Rechaza las escrituras locales mientras el nodo se incorpora
+
+	consensus Consensus   // Grupo de consenso de las colecciones de consistencia fuerte
+	shards    ShardRouter // Reparto de las colecciones fragmentadas entre los nodos
 }
 
 // NewDatabase crea una nueva instancia de la base de datos
@@ -42,13 +76,17 @@ func NewDatabase() *Database {
 		documents:          make(map[string]*Document),
 		persistenceEnabled: false,
 		eventCallbacks:     []EventCallback{},
+		indexes:            NewIndexManager(),
+		clock:              NewHLC(uuid.New().String()),
+		tombstoneGrace:     defaultTombstoneGracePeriod,
+		changes:            newChangeLog(defaultChangeLogSize),
 	}
 }
 
 // NewDatabaseWithPersistence crea una nueva instancia de la base de datos con persistencia
-func NewDatabaseWithPersistence(dataDir string) (*Database, error) {
-	// Crear el gestor de persistencia
-	persistence, err := NewPersistenceManager(dataDir)
+func NewDatabaseWithPersistence(dataDir string, options ...PersistenceOption) (*Database, error) {
+	// Crear el gestor de persistencia, que completa las escrituras pendientes del WAL
+	persistence, err := NewPersistenceManager(dataDir, options...)
 	if err != nil {
 		return nil, fmt.Errorf("error al crear gestor de persistencia: %v", err)
 	}
@@ -56,6 +94,7 @@ func NewDatabaseWithPersistence(dataDir string) (*Database, error) {
 	// Cargar documentos existentes
 	documents, err := persistence.LoadAllDocuments()
 	if err != nil {
+		persistence.Close()
 		return nil, fmt.Errorf("error al cargar documentos: %v", err)
 	}
 
@@ -66,22 +105,62 @@ func NewDatabaseWithPersistence(dataDir string) (*Database, error) {
 		dataDir:            dataDir,
 		persistenceEnabled: true,
 		eventCallbacks:     []EventCallback{},
+		indexes:            NewIndexManager(),
+		clock:              NewHLC(uuid.New().String()),
+		tombstoneGrace:     defaultTombstoneGracePeriod,
+		changes:            newChangeLog(defaultChangeLogSize),
 	}
 
-	// Reproducir transacciones pendientes
-	transactions, err := persistence.transactionLog.ReadTransactions()
-	if err != nil {
-		return nil, fmt.Errorf("error al leer transacciones: %v", err)
+	// Restaurar los índices definidos y reconstruirlos con los documentos cargados
+	if err := db.loadIndexes(); err != nil {
+		persistence.Close()
+		return nil, fmt.Errorf("error al cargar índices: %v", err)
+	}
+
+	// Cargar los esquemas de las colecciones
+	if err := db.loadSchemas(); err != nil {
+		persistence.Close()
+		return nil, fmt.Errorf("error al cargar esquemas: %v", err)
 	}
 
-	// Aplicar transacciones
-	if err := ReplayTransactions(db, transactions); err != nil {
-		return nil, fmt.Errorf("error al reproducir transacciones: %v", err)
+	// Cargar los campos contador y conjunto declarados
+	if err := db.loadCRDTSpecs(); err != nil {
+		persistence.Close()
+		return nil, fmt.Errorf("error al cargar especificaciones CRDT: %v", err)
 	}
 
+	// Cargar las lápidas de los documentos eliminados
+	if err := db.loadTombstones(); err != nil {
+		persistence.Close()
+		return nil, fmt.Errorf("error al cargar lápidas: %v", err)
+	}
+
+	// Resumir los documentos y lápidas para la anti-entropía
+	db.mutex.Lock()
+	db.rebuildMerkleLocked()
+	db.mutex.Unlock()
+
 	return db, nil
 }
 
+// Close cierra la base de datos, creando un último punto de control si la
+// persistencia está habilitada
+func (db *Database) Close() error {
+	if !db.persistenceEnabled {
+		return nil
+	}
+
+	// Guardar las confirmaciones de eliminaciones pendientes
+	db.mutex.Lock()
+	err := db.saveTombstonesLocked()
+	db.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error al guardar lápidas: %v", err)
+	}
+
+	return db.persistence.Close()
+}
+
 // RegisterEventCallback registra un callback para eventos de la base de datos
 func (db *Database) RegisterEventCallback(callback EventCallback) {
 	db.mutex.Lock()
@@ -97,26 +176,79 @@ func (db *Database) triggerEvent(eventType string, collection string, documentID
 	}
 }
 
-// CreateDocument crea un nuevo documento en la colección especificada
+// writeStamp es la marca con la que se guarda una escritura. Las escrituras
+// locales usan el reloj del nodo; las del consenso, la marca del comando, que
+// es la misma en todos los miembros.
+type writeStamp struct {
+	clock   Timestamp // Marca del reloj lógico híbrido
+	time    time.Time // Fecha de creación o actualización del documento
+	index   uint64    // Entrada del log de consenso, 0 fuera del consenso
+	publish bool      // Replicar la escritura a los demás nodos
+}
+
+// localStamp devuelve la marca de una escritura local
+func (db *Database) localStamp() writeStamp {
+	return writeStamp{clock: db.clock.Now(), time: time.Now(), publish: true}
+}
+
+// CreateDocument crea un nuevo documento en la colección especificada. En una
+// colección de consistencia fuerte el documento se crea a través del consenso, y
+// en una fragmentada, en los nodos propietarios de su ID.
 func (db *Database) CreateDocument(collection string, data map[string]any) (*Document, error) {
+	// Generar un ID único para el documento
+	id := uuid.New().String()
+
+	if consensus := db.consensusFor(collection); consensus != nil {
+		if db.IsReadOnly() {
+			return nil, ErrReadOnly
+		}
+		return consensus.Propose(db.newCommand(OperationCreate, collection, id, data, writeOptions{}))
+	}
+	if router := db.shardRouterFor(collection, id); router != nil {
+		if db.IsReadOnly() {
+			return nil, ErrReadOnly
+		}
+		return router.Forward(db.newCommand(OperationCreate, collection, id, data, writeOptions{}))
+	}
+
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
-	// Generar un ID único para el documento
-	id := uuid.New().String()
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
 
-	// Crear el documento
-	now := time.Now()
 	doc := &Document{
 		ID:         id,
 		Collection: collection,
 		Data:       data,
-		CreatedAt:  now,
-		UpdatedAt:  now,
+	}
+	return db.createDocumentLocked(doc, db.localStamp())
+}
+
+// createDocumentLocked valida, indexa y guarda un documento nuevo con la marca
+// indicada. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) createDocumentLocked(doc *Document, stamp writeStamp) (*Document, error) {
+	doc.CreatedAt = stamp.time
+	doc.UpdatedAt = stamp.time
+	doc.Revision = 1
+	doc.LogIndex = stamp.index
+	db.stampLocked(nil, doc, stamp.clock)
+
+	// Validar el documento con el esquema de la colección
+	if err := db.validateDocumentLocked(doc); err != nil {
+		return nil, err
+	}
+
+	// Indexar el documento, verificando las restricciones de unicidad
+	if err := db.indexes.AddDocument(doc); err != nil {
+		return nil, fmt.Errorf("error al indexar documento: %v", err)
 	}
 
 	// Almacenar el documento
-	db.documents[id] = doc
+	db.documents[doc.ID] = doc
+	db.trackDocumentLocked(doc)
+	db.recordWriteLocked(doc.ID, nil)
 
 	// Persistir el documento si está habilitada la persistencia
 	if db.persistenceEnabled {
@@ -126,7 +258,7 @@ func (db *Database) CreateDocument(collection string, data map[string]any) (*Doc
 	}
 
 	// Sincronizar documento si está habilitada la sincronización
-	if db.syncEnabled && db.sync != nil {
+	if stamp.publish && db.syncEnabled && db.sync != nil {
 		if err := db.sync.PublishCreate(doc); err != nil {
 			log.Printf("Error al sincronizar documento: %v", err)
 			// No devolvemos error para no bloquear la operación
@@ -134,19 +266,27 @@ func (db *Database) CreateDocument(collection string, data map[string]any) (*Doc
 	}
 
 	// Disparar evento de creación
-	db.triggerEvent("create", collection, id, doc)
+	db.triggerEvent("create", doc.Collection, doc.ID, doc)
 
 	return doc, nil
 }
 
-// GetDocument obtiene un documento por su ID
+// GetDocument obtiene un documento por su ID. En una colección de consistencia
+// fuerte con lecturas del líder, la lectura ve todas las escrituras confirmadas.
+// Un documento fragmentado que el nodo no guarda se obtiene de sus propietarios.
 func (db *Database) GetDocument(id string) (*Document, error) {
-	db.mutex.RLock()
-	defer db.mutex.RUnlock()
+	if consensus, collection := db.consensusForDocument(id); consensus != nil {
+		if err := consensus.Barrier(collection); err != nil {
+			return nil, err
+		}
+	}
 
+	db.mutex.RLock()
 	doc, exists := db.documents[id]
+	db.mutex.RUnlock()
+
 	if !exists {
-		return nil, errors.New("documento no encontrado")
+		return db.fetchDocument(id)
 	}
 
 	return doc, nil
@@ -154,13 +294,28 @@ func (db *Database) GetDocument(id string) (*Document, error) {
 
 // QueryDocuments busca documentos en una colección que coincidan con los criterios
 func (db *Database) QueryDocuments(collection string, query map[string]any) ([]*Document, error) {
+	if err := db.readBarrier(collection); err != nil {
+		return nil, err
+	}
+
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
 	var results []*Document
 
+	// Usar un índice para reducir los candidatos si alguno cubre los criterios
+	candidates := db.documents
+	if ids, ok := db.lookupEqualities(collection, query); ok {
+		candidates = make(map[string]*Document, len(ids))
+		for _, id := range ids {
+			if doc, exists := db.documents[id]; exists {
+				candidates[id] = doc
+			}
+		}
+	}
+
 	// Buscar documentos que coincidan con la colección y los criterios
-	for _, doc := range db.documents {
+	for _, doc := range candidates {
 		if doc.Collection != collection {
 			continue
 		}
@@ -182,19 +337,149 @@ func (db *Database) QueryDocuments(collection string, query map[string]any) ([]*
 	return results, nil
 }
 
-// UpdateDocument actualiza un documento existente
-func (db *Database) UpdateDocument(id string, data map[string]any) (*Document, error) {
+// lookupEqualities busca los IDs candidatos para un conjunto de criterios de igualdad
+// usando el índice más selectivo disponible
+func (db *Database) lookupEqualities(collection string, query map[string]any) ([]string, bool) {
+	if ids, ok := db.indexes.lookupCompound(collection, query); ok {
+		return ids, true
+	}
+
+	var best []string
+	found := false
+	for field, value := range query {
+		ids, ok := db.indexes.lookupCondition(collection, QueryCondition{Field: field, Operator: OperatorEQ, Value: value})
+		if ok && (!found || len(ids) < len(best)) {
+			best = ids
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+// UpdateDocument actualiza un documento existente. Si todas las claves de data son
+// operadores ($set, $unset, $inc, $push, $pull) se aplican como una Update; en caso
+// contrario los campos se combinan con los del documento. Con IfRevision la
+// actualización solo se aplica si el documento está en la revisión indicada.
+func (db *Database) UpdateDocument(id string, data map[string]any, options ...WriteOption) (*Document, error) {
+	apply, err := updateFunc(data)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := newWriteOptions(options)
+	consensus, collection, err := db.consensusForWrite(id)
+	if err != nil {
+		return nil, err
+	}
+	if consensus != nil {
+		if db.IsReadOnly() {
+			return nil, ErrReadOnly
+		}
+		return consensus.Propose(db.newCommand(OperationUpdate, collection, id, data, opts))
+	}
+	if router := db.shardRouterForDocument(id); router != nil {
+		if db.IsReadOnly() {
+			return nil, ErrReadOnly
+		}
+		return router.Forward(db.newCommand(OperationUpdate, "", id, data, opts))
+	}
+
+	return db.updateDocument(id, apply, opts)
+}
+
+// updateFunc devuelve la función que calcula los nuevos datos de un documento a
+// partir de unos datos de actualización, con operadores o campos a combinar
+func updateFunc(data map[string]any) (func(current map[string]any) (map[string]any, error), error) {
+	if IsUpdateOperators(data) {
+		update, err := ParseUpdate(data)
+		if err != nil {
+			return nil, err
+		}
+		return update.Apply, nil
+	}
+
+	return func(current map[string]any) (map[string]any, error) {
+		updated := maps.Clone(current)
+		if updated == nil {
+			updated = make(map[string]any)
+		}
+		maps.Copy(updated, data)
+		return updated, nil
+	}, nil
+}
+
+// ApplyUpdate aplica una actualización con operadores a un documento de forma
+// atómica: los operadores se evalúan sobre el estado actual bajo el bloqueo
+// de la base de datos y se replica el documento resultante
+func (db *Database) ApplyUpdate(id string, update Update, options ...WriteOption) (*Document, error) {
+	opts := newWriteOptions(options)
+	consensus, collection, err := db.consensusForWrite(id)
+	if err != nil {
+		return nil, err
+	}
+	if consensus != nil {
+		if db.IsReadOnly() {
+			return nil, ErrReadOnly
+		}
+		return consensus.Propose(db.newCommand(OperationUpdate, collection, id, update.data(), opts))
+	}
+	if router := db.shardRouterForDocument(id); router != nil {
+		if db.IsReadOnly() {
+			return nil, ErrReadOnly
+		}
+		return router.Forward(db.newCommand(OperationUpdate, "", id, update.data(), opts))
+	}
+
+	return db.updateDocument(id, update.Apply, opts)
+}
+
+// updateDocument calcula los nuevos datos de un documento con apply y los guarda
+func (db *Database) updateDocument(id string, apply func(current map[string]any) (map[string]any, error), opts writeOptions) (*Document, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
 	doc, exists := db.documents[id]
 	if !exists {
 		return nil, errors.New("documento no encontrado")
 	}
+	return db.updateDocumentLocked(doc, apply, opts, db.localStamp())
+}
+
+// updateDocumentLocked calcula los nuevos datos de un documento con apply y
+// guarda la nueva versión con la marca indicada. Debe llamarse con el mutex de
+// la base de datos bloqueado.
+func (db *Database) updateDocumentLocked(doc *Document, apply func(current map[string]any) (map[string]any, error), opts writeOptions, stamp writeStamp) (*Document, error) {
+	if err := opts.checkRevision(doc); err != nil {
+		return nil, err
+	}
+
+	// Calcular los nuevos datos y verificar los índices antes de aplicarlos
+	updated, err := apply(doc.Data)
+	if err != nil {
+		return nil, err
+	}
+	candidate := *doc
+	candidate.Data = updated
+	db.stampLocked(doc, &candidate, stamp.clock)
+	if err := db.validateDocumentLocked(&candidate); err != nil {
+		return nil, err
+	}
+	if err := db.indexes.CheckDocument(&candidate); err != nil {
+		return nil, fmt.Errorf("error al indexar documento: %v", err)
+	}
 
-	// Actualizar los datos
-	maps.Copy(doc.Data, data)
-	doc.UpdatedAt = time.Now()
+	// Guardar una nueva versión del documento, de modo que quien tenga la anterior
+	// no vea cambios a medias
+	candidate.UpdatedAt = stamp.time
+	candidate.Revision = doc.Revision + 1
+	candidate.LogIndex = stamp.index
+	doc = &candidate
+	db.putDocumentLocked(doc)
 
 	// Persistir el documento si está habilitada la persistencia
 	if db.persistenceEnabled {
@@ -204,7 +489,7 @@ func (db *Database) UpdateDocument(id string, data map[string]any) (*Document, e
 	}
 
 	// Sincronizar documento si está habilitada la sincronización
-	if db.syncEnabled && db.sync != nil {
+	if stamp.publish && db.syncEnabled && db.sync != nil {
 		if err := db.sync.PublishUpdate(doc); err != nil {
 			log.Printf("Error al sincronizar actualización: %v", err)
 			// No devolvemos error para no bloquear la operación
@@ -212,27 +497,76 @@ func (db *Database) UpdateDocument(id string, data map[string]any) (*Document, e
 	}
 
 	// Disparar evento de actualización
-	db.triggerEvent("update", doc.Collection, id, doc)
+	db.triggerEvent("update", doc.Collection, doc.ID, doc)
 
 	return doc, nil
 }
 
-// DeleteDocument elimina un documento por su ID
-func (db *Database) DeleteDocument(id string) error {
+// DeleteDocument elimina un documento por su ID. Con IfRevision solo se elimina
+// si el documento está en la revisión indicada.
+func (db *Database) DeleteDocument(id string, options ...WriteOption) error {
+	opts := newWriteOptions(options)
+	consensus, collection, err := db.consensusForWrite(id)
+	if err != nil {
+		return err
+	}
+	if consensus != nil {
+		if db.IsReadOnly() {
+			return ErrReadOnly
+		}
+		_, err = consensus.Propose(db.newCommand(OperationDelete, collection, id, nil, opts))
+		return err
+	}
+	if router := db.shardRouterForDocument(id); router != nil {
+		if db.IsReadOnly() {
+			return ErrReadOnly
+		}
+		_, err = router.Forward(db.newCommand(OperationDelete, "", id, nil, opts))
+		return err
+	}
+
+	return db.deleteDocument(id, opts)
+}
+
+// deleteDocument elimina localmente un documento por su ID
+func (db *Database) deleteDocument(id string, opts writeOptions) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
 	doc, exists := db.documents[id]
 	if !exists {
 		return errors.New("documento no encontrado")
 	}
+	return db.deleteDocumentLocked(doc, opts, db.localStamp())
+}
+
+// deleteDocumentLocked elimina un documento registrando su lápida con la marca
+// indicada. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) deleteDocumentLocked(doc *Document, opts writeOptions, stamp writeStamp) error {
+	if err := opts.checkRevision(doc); err != nil {
+		return err
+	}
 
 	// Guardar una copia del documento para el evento
 	docCopy := *doc
+	id := doc.ID
 	collection := doc.Collection
 
+	// Registrar la lápida antes de eliminar el documento, para que un fallo
+	// entre ambos pasos no deje el documento eliminado sin lápida
+	tombstone := db.recordTombstoneLocked(doc, stamp)
+	db.tombstonesDirty = true
+	if err := db.saveTombstonesLocked(); err != nil {
+		db.dropTombstoneLocked(id)
+		return err
+	}
+
 	// Eliminar el documento
-	delete(db.documents, id)
+	db.removeDocumentLocked(id)
 
 	// Persistir la eliminación si está habilitada la persistencia
 	if db.persistenceEnabled {
@@ -242,8 +576,8 @@ func (db *Database) DeleteDocument(id string) error {
 	}
 
 	// Sincronizar eliminación si está habilitada la sincronización
-	if db.syncEnabled && db.sync != nil {
-		if err := db.sync.PublishDelete(id); err != nil {
+	if stamp.publish && db.syncEnabled && db.sync != nil {
+		if err := db.sync.PublishDelete(tombstone.clone()); err != nil {
 			log.Printf("Error al sincronizar eliminación: %v", err)
 			// No devolvemos error para no bloquear la operación
 		}
@@ -257,6 +591,10 @@ func (db *Database) DeleteDocument(id string) error {
 
 // GetAllDocuments devuelve todos los documentos de una colección
 func (db *Database) GetAllDocuments(collection string) ([]*Document, error) {
+	if err := db.readBarrier(collection); err != nil {
+		return nil, err
+	}
+
 	db.mutex.RLock()
 	defer db.mutex.RUnlock()
 
@@ -270,6 +608,85 @@ func (db *Database) GetAllDocuments(collection string) ([]*Document, error) {
 	return results, nil
 }
 
+// getDocumentsByIDs obtiene los documentos de una colección a partir de sus IDs
+func (db *Database) getDocumentsByIDs(collection string, ids []string) []*Document {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	results := make([]*Document, 0, len(ids))
+	for _, id := range ids {
+		if doc, exists := db.documents[id]; exists && doc.Collection == collection {
+			results = append(results, doc)
+		}
+	}
+
+	return results
+}
+
+// scanIndex recorre en orden los documentos de un índice ordenado dentro del rango
+// hasta que fn devuelva false. El mutex de la base de datos se toma antes que el
+// del índice para respetar el orden de bloqueo.
+func (db *Database) scanIndex(index *Index, r keyRange, descending bool, fn func(doc *Document) bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	index.Scan(r, descending, func(id string) bool {
+		doc, exists := db.documents[id]
+		if !exists || doc.Collection != index.Collection {
+			return true
+		}
+		return fn(doc)
+	})
+}
+
+// putDocumentLocked almacena un documento ya confirmado (replicado o reproducido)
+// y actualiza los índices. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) putDocumentLocked(doc *Document) {
+	previous, exists := db.documents[doc.ID]
+	if exists {
+		if previous.Collection != doc.Collection {
+			db.indexes.RemoveDocument(previous)
+		}
+		db.untrackDocumentLocked(previous)
+	}
+	db.documents[doc.ID] = doc
+	db.indexes.ReindexDocument(doc)
+	db.trackDocumentLocked(doc)
+	db.recordWriteLocked(doc.ID, previous)
+}
+
+// removeDocumentLocked elimina un documento y lo quita de los índices.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) removeDocumentLocked(id string) *Document {
+	doc, exists := db.documents[id]
+	if !exists {
+		return nil
+	}
+	delete(db.documents, id)
+	db.indexes.RemoveDocument(doc)
+	db.untrackDocumentLocked(doc)
+	db.recordWriteLocked(id, doc)
+	return doc
+}
+
+// recordWriteLocked anota la escritura de un documento, cuya versión anterior era
+// previous (nil si no existía), para que las transacciones abiertas detecten
+// conflictos y sigan leyendo su instantánea. Solo se guardan versiones mientras
+// haya transacciones. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) recordWriteLocked(id string, previous *Document) {
+	db.commitSeq++
+	db.recordChangeLocked(id)
+	if len(db.txSnapshots) == 0 {
+		return
+	}
+	if db.docVersions == nil {
+		db.docVersions = make(map[string]uint64)
+		db.txHistory = make(map[string][]txVersion)
+	}
+	db.docVersions[id] = db.commitSeq
+	db.txHistory[id] = append(db.txHistory[id], txVersion{seq: db.commitSeq, previous: previous})
+}
+
 // SerializeDocument convierte un documento a JSON
 func SerializeDocument(doc *Document) ([]byte, error) {
 	return json.Marshal(doc)
@@ -317,9 +734,24 @@ func (db *Database) RestoreFromBackup(backupName string) error {
 		return fmt.Errorf("error al recargar documentos: %v", err)
 	}
 
-	// Actualizar los documentos en memoria
+	// Recargar los esquemas restaurados con las colecciones
+	if err := db.loadSchemas(); err != nil {
+		return fmt.Errorf("error al recargar esquemas: %v", err)
+	}
+
+	// Actualizar los documentos en memoria y reconstruir los índices
 	db.mutex.Lock()
+	for id, doc := range db.documents {
+		db.recordWriteLocked(id, doc)
+	}
+	for id := range documents {
+		if _, exists := db.documents[id]; !exists {
+			db.recordWriteLocked(id, nil)
+		}
+	}
 	db.documents = documents
+	db.rebuildIndexesLocked()
+	db.rebuildMerkleLocked()
 	db.mutex.Unlock()
 
 	return nil
@@ -343,6 +775,110 @@ func (db *Database) DeleteBackup(backupName string) error {
 	return db.persistence.DeleteBackup(backupName)
 }
 
+// CreateIndex crea un índice sobre una colección y lo construye con los documentos existentes
+func (db *Database) CreateIndex(name string, collection string, fields []string, indexType IndexType, options ...IndexOption) (*Index, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	index, err := db.indexes.CreateIndex(name, collection, fields, indexType, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Construir el índice con los documentos actuales de la colección
+	if err := index.rebuild(db.collectionDocumentsLocked(collection), index.Unique); err != nil {
+		db.indexes.DropIndex(name)
+		return nil, fmt.Errorf("error al construir índice: %v", err)
+	}
+
+	// Persistir las definiciones de índices
+	if err := db.saveIndexDefinitions(); err != nil {
+		db.indexes.DropIndex(name)
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// DropIndex elimina un índice
+func (db *Database) DropIndex(name string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if err := db.indexes.DropIndex(name); err != nil {
+		return err
+	}
+
+	return db.saveIndexDefinitions()
+}
+
+// GetIndexes obtiene los índices de una colección
+func (db *Database) GetIndexes(collection string) []*Index {
+	return db.indexes.GetIndexesForCollection(collection)
+}
+
+// saveIndexDefinitions persiste las definiciones de índices si la persistencia está habilitada
+func (db *Database) saveIndexDefinitions() error {
+	if !db.persistenceEnabled {
+		return nil
+	}
+
+	if err := db.persistence.SaveIndexDefinitions(db.indexes.Definitions()); err != nil {
+		return fmt.Errorf("error al persistir índices: %v", err)
+	}
+
+	return nil
+}
+
+// loadIndexes crea los índices persistidos y los construye con los documentos cargados
+func (db *Database) loadIndexes() error {
+	definitions, err := db.persistence.LoadIndexDefinitions()
+	if err != nil {
+		return err
+	}
+
+	for _, definition := range definitions {
+		index, err := db.indexes.CreateIndex(definition.Name, definition.Collection, definition.Fields, definition.Type, WithLanguage(definition.Language))
+		if err != nil {
+			return err
+		}
+		index.CreatedAt = definition.CreatedAt
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.rebuildIndexesLocked()
+	return nil
+}
+
+// rebuildIndexesLocked reconstruye todos los índices con los documentos en memoria.
+// Los datos ya confirmados se indexan aunque violen la unicidad, para no perder documentos.
+func (db *Database) rebuildIndexesLocked() {
+	db.indexes.mutex.RLock()
+	indexes := make([]*Index, 0, len(db.indexes.Indexes))
+	for _, index := range db.indexes.Indexes {
+		indexes = append(indexes, index)
+	}
+	db.indexes.mutex.RUnlock()
+
+	for _, index := range indexes {
+		index.rebuild(db.collectionDocumentsLocked(index.Collection), false)
+	}
+}
+
+// collectionDocumentsLocked devuelve los documentos de una colección.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) collectionDocumentsLocked(collection string) []*Document {
+	var results []*Document
+	for _, doc := range db.documents {
+		if doc.Collection == collection {
+			results = append(results, doc)
+		}
+	}
+	return results
+}
+
 // SetSync establece el gestor de sincronización
 func (db *Database) SetSync(sync *DBSync) {
 	db.sync = sync
@@ -373,6 +909,14 @@ func (db *Database) SyncAllDocuments() error {
 	return db.sync.SyncAllDocuments()
 }
 
+// OutboxDepth devuelve cuántas escrituras locales están pendientes de replicar
+func (db *Database) OutboxDepth() int {
+	if db.sync == nil {
+		return 0
+	}
+	return db.sync.OutboxDepth()
+}
+
 // GetCollections obtiene todas las colecciones
 func (db *Database) GetCollections() ([]string, error) {
 	db.mutex.RLock()
@@ -0,0 +1,463 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// orderedKind define la clase de un valor dentro de un índice ordenado.
+// Los valores de clases distintas se ordenan por clase: null < número < texto < booleano < fecha < otros.
+type orderedKind int
+
+const (
+	orderedKindNull orderedKind = iota
+	orderedKindNumber
+	orderedKindString
+	orderedKindBool
+	orderedKindTime
+	orderedKindOther
+)
+
+// orderedValue es un valor tipado comparable de un índice ordenado
+type orderedValue struct {
+	kind orderedKind
+	num  float64
+	str  string
+	b    bool
+	t    time.Time
+}
+
+// orderedKey es la clave de un documento en un índice ordenado (un valor por campo)
+type orderedKey []orderedValue
+
+// newOrderedValue convierte un valor de un documento en un valor tipado
+func newOrderedValue(value interface{}) orderedValue {
+	switch v := value.(type) {
+	case nil:
+		return orderedValue{kind: orderedKindNull}
+	case int:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case int8:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case int16:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case int32:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case int64:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case uint:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case uint8:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case uint16:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case uint32:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case uint64:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case float32:
+		return orderedValue{kind: orderedKindNumber, num: float64(v)}
+	case float64:
+		return orderedValue{kind: orderedKindNumber, num: v}
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return orderedValue{kind: orderedKindNumber, num: f}
+		}
+		return orderedValue{kind: orderedKindString, str: v.String()}
+	case string:
+		return orderedValue{kind: orderedKindString, str: v}
+	case bool:
+		return orderedValue{kind: orderedKindBool, b: v}
+	case time.Time:
+		return orderedValue{kind: orderedKindTime, t: v}
+	default:
+		return orderedValue{kind: orderedKindOther, str: fmt.Sprintf("%v", v)}
+	}
+}
+
+// compareOrderedValues compara dos valores tipados
+func compareOrderedValues(a, b orderedValue) int {
+	if a.kind != b.kind {
+		if a.kind < b.kind {
+			return -1
+		}
+		return 1
+	}
+
+	switch a.kind {
+	case orderedKindNumber:
+		if a.num < b.num {
+			return -1
+		} else if a.num > b.num {
+			return 1
+		}
+		return 0
+	case orderedKindBool:
+		if !a.b && b.b {
+			return -1
+		} else if a.b && !b.b {
+			return 1
+		}
+		return 0
+	case orderedKindTime:
+		return a.t.Compare(b.t)
+	case orderedKindString, orderedKindOther:
+		return strings.Compare(a.str, b.str)
+	}
+
+	return 0
+}
+
+// comparePrefix compara una clave con un límite que puede cubrir solo sus primeros campos
+func comparePrefix(key orderedKey, bound orderedKey) int {
+	for i := 0; i < len(bound) && i < len(key); i++ {
+		if cmp := compareOrderedValues(key[i], bound[i]); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// compareOrderedKeys compara dos claves completas campo a campo
+func compareOrderedKeys(a, b orderedKey) int {
+	if cmp := comparePrefix(a, b); cmp != 0 {
+		return cmp
+	}
+	return len(a) - len(b)
+}
+
+// keyRange delimita un recorrido sobre un índice ordenado. Un límite nil no acota.
+// Los límites pueden cubrir solo los primeros campos de un índice compuesto.
+type keyRange struct {
+	lower          orderedKey
+	lowerInclusive bool
+	upper          orderedKey
+	upperInclusive bool
+}
+
+// aboveLower indica si una clave cumple el límite inferior del rango
+func (r keyRange) aboveLower(key orderedKey) bool {
+	if r.lower == nil {
+		return true
+	}
+	cmp := comparePrefix(key, r.lower)
+	return cmp > 0 || (cmp == 0 && r.lowerInclusive)
+}
+
+// belowUpper indica si una clave cumple el límite superior del rango
+func (r keyRange) belowUpper(key orderedKey) bool {
+	if r.upper == nil {
+		return true
+	}
+	cmp := comparePrefix(key, r.upper)
+	return cmp < 0 || (cmp == 0 && r.upperInclusive)
+}
+
+// prefixUpperBound devuelve el límite superior exclusivo de los textos que empiezan por prefix
+func prefixUpperBound(prefix string) orderedValue {
+	// Incrementar el último byte que no sea 0xff
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return orderedValue{kind: orderedKindString, str: string(b[:i+1])}
+		}
+	}
+
+	// Todos los textos empiezan por el prefijo: acotar con el menor valor de la clase siguiente
+	return orderedValue{kind: orderedKindString + 1}
+}
+
+const (
+	// skipListMaxLevel número máximo de niveles de la skiplist
+	skipListMaxLevel = 24
+	// skipListP probabilidad de promocionar un nodo al nivel siguiente
+	skipListP = 0.25
+)
+
+// skipListNode es un nodo de la skiplist
+type skipListNode struct {
+	key  orderedKey
+	id   string
+	next []*skipListNode
+	prev *skipListNode
+}
+
+// skipList mantiene las entradas (clave, ID de documento) de un índice ordenado.
+// Las entradas con la misma clave se ordenan por ID para que cada una sea única.
+type skipList struct {
+	head   *skipListNode
+	tail   *skipListNode
+	level  int
+	length int
+}
+
+// newSkipList crea una skiplist vacía
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+// compareEntry compara un nodo con una entrada (clave, ID)
+func compareEntry(node *skipListNode, key orderedKey, id string) int {
+	if cmp := compareOrderedKeys(node.key, key); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(node.id, id)
+}
+
+// randomLevel elige el nivel de un nuevo nodo
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// Insert añade una entrada a la skiplist
+func (sl *skipList) Insert(key orderedKey, id string) {
+	var update [skipListMaxLevel]*skipListNode
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && compareEntry(x.next[i], key, id) < 0 {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	// No duplicar entradas existentes
+	if x.next[0] != nil && compareEntry(x.next[0], key, id) == 0 {
+		return
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+
+	node := &skipListNode{key: key, id: id, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+
+	// Enlace hacia atrás para los recorridos descendentes
+	if update[0] != sl.head {
+		node.prev = update[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		sl.tail = node
+	}
+
+	sl.length++
+}
+
+// Delete elimina una entrada de la skiplist
+func (sl *skipList) Delete(key orderedKey, id string) {
+	var update [skipListMaxLevel]*skipListNode
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && compareEntry(x.next[i], key, id) < 0 {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+
+	node := x.next[0]
+	if node == nil || compareEntry(node, key, id) != 0 {
+		return
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].next[i] != node {
+			break
+		}
+		update[i].next[i] = node.next[i]
+	}
+
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		sl.tail = node.prev
+	}
+
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+
+	sl.length--
+}
+
+// Scan recorre en orden las entradas dentro del rango hasta que fn devuelva false
+func (sl *skipList) Scan(r keyRange, descending bool, fn func(key orderedKey, id string) bool) {
+	if descending {
+		// Buscar la última entrada que cumpla el límite superior
+		node := sl.tail
+		if r.upper != nil {
+			x := sl.head
+			for i := sl.level - 1; i >= 0; i-- {
+				for x.next[i] != nil && r.belowUpper(x.next[i].key) {
+					x = x.next[i]
+				}
+			}
+			node = nil
+			if x != sl.head {
+				node = x
+			}
+		}
+
+		for ; node != nil && r.aboveLower(node.key); node = node.prev {
+			if !fn(node.key, node.id) {
+				return
+			}
+		}
+		return
+	}
+
+	// Buscar la primera entrada que cumpla el límite inferior
+	x := sl.head
+	if r.lower != nil {
+		for i := sl.level - 1; i >= 0; i-- {
+			for x.next[i] != nil && !r.aboveLower(x.next[i].key) {
+				x = x.next[i]
+			}
+		}
+	}
+
+	for node := x.next[0]; node != nil && r.belowUpper(node.key); node = node.next[0] {
+		if !fn(node.key, node.id) {
+			return
+		}
+	}
+}
+
+// Len devuelve el número de entradas de la skiplist
+func (sl *skipList) Len() int {
+	return sl.length
+}
+
+// Scan recorre en orden los IDs de los documentos de un índice ordenado dentro del rango
+// hasta que fn devuelva false
+func (idx *Index) Scan(r keyRange, descending bool, fn func(id string) bool) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if idx.ordered == nil {
+		return
+	}
+
+	idx.ordered.Scan(r, descending, func(_ orderedKey, id string) bool {
+		return fn(id)
+	})
+}
+
+// LookupRange devuelve los IDs de los documentos dentro del rango, en orden ascendente
+func (idx *Index) LookupRange(r keyRange) []string {
+	var ids []string
+	idx.Scan(r, false, func(id string) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// rangeFor calcula el rango del índice que cubren las condiciones: igualdades sobre
+// los primeros campos seguidas, opcionalmente, de un rango sobre el siguiente campo.
+// Devuelve el número de campos del índice acotados (0 si el índice no es aplicable).
+func (idx *Index) rangeFor(conditions []QueryCondition) (keyRange, int) {
+	prefix := orderedKey{}
+
+	for i, field := range idx.Fields {
+		// Igualdad sobre el campo: se añade al prefijo y se continúa con el siguiente
+		if value, ok := findEquality(conditions, field); ok {
+			prefix = append(prefix, newOrderedValue(value))
+			continue
+		}
+
+		r := keyRange{lower: prefix, lowerInclusive: true, upper: prefix, upperInclusive: true}
+		bounded := false
+		for _, condition := range conditions {
+			if condition.Field != field {
+				continue
+			}
+
+			value := newOrderedValue(condition.Value)
+			switch condition.Operator {
+			case OperatorGT, OperatorGTE:
+				r.lower, r.lowerInclusive = tightenLower(r.lower, r.lowerInclusive, prefix, value, condition.Operator == OperatorGTE)
+				bounded = true
+			case OperatorLT, OperatorLTE:
+				r.upper, r.upperInclusive = tightenUpper(r.upper, r.upperInclusive, prefix, value, condition.Operator == OperatorLTE)
+				bounded = true
+			case OperatorSTARTSWITH:
+				prefixValue, ok := condition.Value.(string)
+				if !ok {
+					continue
+				}
+				r.lower, r.lowerInclusive = tightenLower(r.lower, r.lowerInclusive, prefix, newOrderedValue(prefixValue), true)
+				r.upper, r.upperInclusive = tightenUpper(r.upper, r.upperInclusive, prefix, prefixUpperBound(prefixValue), false)
+				bounded = true
+			}
+		}
+
+		if bounded {
+			return r, i + 1
+		}
+		if i == 0 {
+			return keyRange{}, 0
+		}
+		return r, i
+	}
+
+	return keyRange{lower: prefix, lowerInclusive: true, upper: prefix, upperInclusive: true}, len(idx.Fields)
+}
+
+// findEquality busca una condición de igualdad sobre un campo
+func findEquality(conditions []QueryCondition, field string) (interface{}, bool) {
+	for _, condition := range conditions {
+		if condition.Field == field && condition.Operator == OperatorEQ {
+			return condition.Value, true
+		}
+	}
+	return nil, false
+}
+
+// tightenLower sustituye el límite inferior si el nuevo valor es más restrictivo
+func tightenLower(current orderedKey, inclusive bool, prefix orderedKey, value orderedValue, valueInclusive bool) (orderedKey, bool) {
+	if len(current) > len(prefix) {
+		cmp := compareOrderedValues(value, current[len(prefix)])
+		if cmp < 0 || (cmp == 0 && (valueInclusive || !inclusive)) {
+			return current, inclusive
+		}
+	}
+	return appendKey(prefix, value), valueInclusive
+}
+
+// tightenUpper sustituye el límite superior si el nuevo valor es más restrictivo
+func tightenUpper(current orderedKey, inclusive bool, prefix orderedKey, value orderedValue, valueInclusive bool) (orderedKey, bool) {
+	if len(current) > len(prefix) {
+		cmp := compareOrderedValues(value, current[len(prefix)])
+		if cmp > 0 || (cmp == 0 && (valueInclusive || !inclusive)) {
+			return current, inclusive
+		}
+	}
+	return appendKey(prefix, value), valueInclusive
+}
+
+// appendKey devuelve una copia de la clave con un valor más
+func appendKey(key orderedKey, value orderedValue) orderedKey {
+	result := make(orderedKey, len(key), len(key)+1)
+	copy(result, key)
+	return append(result, value)
+}
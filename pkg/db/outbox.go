@@ -0,0 +1,559 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// outboxFileName archivo del directorio de datos con las escrituras pendientes de replicar
+	outboxFileName = "outbox.log"
+	// outboxRetryBase espera tras el primer envío sin confirmar; se duplica en cada intento
+	outboxRetryBase = 5 * time.Second
+	// outboxRetryMax espera máxima entre reintentos de una misma entrada
+	outboxRetryMax = 5 * time.Minute
+	// outboxCompactThreshold entradas eliminadas tras las que se reescribe el archivo
+	outboxCompactThreshold = 1024
+	// outboxCheckInterval intervalo entre búsquedas de entradas que reenviar
+	outboxCheckInterval = time.Second
+	// outboxSendLimit entradas que se envían como máximo en cada búsqueda
+	outboxSendLimit = 100
+	// receivedWindowSize secuencias recibidas de cada nodo que se recuerdan para descartar repeticiones
+	receivedWindowSize = 4096
+	// confirmInterval intervalo entre envíos de las confirmaciones de escrituras recibidas
+	confirmInterval = time.Second
+)
+
+// OutboxEntry es una escritura local pendiente de replicar. Se identifica en la
+// red por el nodo de origen, la época del outbox y su número de secuencia.
+type OutboxEntry struct {
+	Origin  string    `json:"origin"`
+	Seq     uint64    `json:"seq"`
+	Message DBMessage `json:"message"`
+	Created time.Time `json:"created"`
+
+	attempts    int       // Envíos sin confirmar
+	nextAttempt time.Time // Momento a partir del cual se vuelve a enviar
+	pending     int       // Documentos de la entrada que no ha sustituido otra posterior
+}
+
+// outboxRecord es una línea del archivo del outbox: una entrada nueva, las
+// entradas que ya no están pendientes o, al principio del archivo, la época y
+// la última secuencia asignada
+type outboxRecord struct {
+	Epoch  string       `json:"epoch,omitempty"`
+	Seq    uint64       `json:"seq,omitempty"`
+	Add    *OutboxEntry `json:"add,omitempty"`
+	Remove []uint64     `json:"remove,omitempty"`
+}
+
+// Outbox guarda las escrituras locales hasta que otro nodo confirma haberlas
+// recibido o una escritura posterior de los mismos documentos las sustituye.
+// Las entradas se añaden a un archivo forzado a disco, de modo que sobreviven a
+// un reinicio; sin archivo el outbox solo está en memoria.
+//
+// Las secuencias se numeran dentro de una época: un identificador aleatorio que
+// se guarda con ellas en el archivo. Un outbox en memoria vuelve a numerar desde
+// 1 en cada arranque con una época nueva, de modo que los receptores no
+// confunden sus escrituras con repeticiones de las del arranque anterior.
+type Outbox struct {
+	path    string
+	file    *os.File
+	epoch   string
+	entries map[uint64]*OutboxEntry
+	docs    map[string]uint64 // Última entrada pendiente de cada documento
+	lastSeq uint64
+	removed int           // Entradas eliminadas desde la última reescritura del archivo
+	notify  chan struct{} // Avisa de que hay entradas nuevas que enviar
+	mutex   sync.Mutex
+}
+
+// OpenOutbox abre el outbox de un directorio de datos, o uno en memoria si
+// dataDir está vacío. Una línea incompleta al final del archivo, por un cierre
+// inesperado, se descarta.
+func OpenOutbox(dataDir string) (*Outbox, error) {
+	o := &Outbox{
+		entries: make(map[uint64]*OutboxEntry),
+		docs:    make(map[string]uint64),
+		notify:  make(chan struct{}, 1),
+	}
+	if dataDir == "" {
+		o.epoch = uuid.New().String()
+		return o, nil
+	}
+	o.path = filepath.Join(dataDir, outboxFileName)
+
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	if o.epoch == "" {
+		// Archivo nuevo o de una versión sin épocas
+		o.epoch = uuid.New().String()
+	}
+	if err := o.rewrite(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// load lee las entradas pendientes del archivo del outbox
+func (o *Outbox) load() error {
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error al leer el outbox: %v", err)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Una línea sin terminar es una escritura interrumpida
+			break
+		}
+
+		var record outboxRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if reader.Buffered() == 0 {
+				break
+			}
+			return fmt.Errorf("outbox dañado: %v", err)
+		}
+
+		if record.Epoch != "" {
+			o.epoch = record.Epoch
+		}
+		o.lastSeq = max(o.lastSeq, record.Seq)
+		if record.Add != nil {
+			o.entries[record.Add.Seq] = record.Add
+			o.lastSeq = max(o.lastSeq, record.Add.Seq)
+		}
+		for _, seq := range record.Remove {
+			delete(o.entries, seq)
+		}
+	}
+
+	// Recalcular qué documentos de cada entrada siguen pendientes
+	for _, seq := range slices.Sorted(maps.Keys(o.entries)) {
+		for _, superseded := range o.trackLocked(o.entries[seq]) {
+			delete(o.entries, superseded)
+		}
+	}
+	return nil
+}
+
+// rewrite reescribe el archivo solo con las entradas pendientes y lo deja
+// abierto para añadir las siguientes
+func (o *Outbox) rewrite() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.Encode(outboxRecord{Epoch: o.epoch, Seq: o.lastSeq})
+	for _, seq := range slices.Sorted(maps.Keys(o.entries)) {
+		if err := encoder.Encode(outboxRecord{Add: o.entries[seq]}); err != nil {
+			return fmt.Errorf("error al serializar el outbox: %v", err)
+		}
+	}
+
+	tmpPath := o.path + ".tmp"
+	if err := writeFileSync(tmpPath, buf.Bytes()); err != nil {
+		return fmt.Errorf("error al guardar el outbox: %v", err)
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return fmt.Errorf("error al guardar el outbox: %v", err)
+	}
+	if err := syncDir(filepath.Dir(o.path)); err != nil {
+		return err
+	}
+
+	if o.file != nil {
+		o.file.Close()
+	}
+	file, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error al abrir el outbox: %v", err)
+	}
+	o.file = file
+	o.removed = 0
+	return nil
+}
+
+// appendLocked añade un registro al archivo, forzándolo a disco si se indica.
+// Debe llamarse con el mutex bloqueado.
+func (o *Outbox) appendLocked(record outboxRecord, sync bool) error {
+	if o.file == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error al serializar el outbox: %v", err)
+	}
+	if _, err := o.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error al escribir en el outbox: %v", err)
+	}
+	if sync {
+		if err := o.file.Sync(); err != nil {
+			return fmt.Errorf("error al sincronizar el outbox: %v", err)
+		}
+	}
+	return nil
+}
+
+// Epoch devuelve la época en la que se numeran las secuencias del outbox
+func (o *Outbox) Epoch() string {
+	return o.epoch
+}
+
+// Add registra una escritura local y devuelve su número de secuencia. Las
+// entradas anteriores cuyos documentos sustituye la nueva dejan de estar pendientes.
+func (o *Outbox) Add(origin string, msg DBMessage) (uint64, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry := &OutboxEntry{
+		Origin:  origin,
+		Seq:     o.lastSeq + 1,
+		Message: msg,
+		Created: time.Now(),
+	}
+	if err := o.appendLocked(outboxRecord{Add: entry}, true); err != nil {
+		return 0, err
+	}
+	o.lastSeq = entry.Seq
+	o.entries[entry.Seq] = entry
+
+	if superseded := o.trackLocked(entry); len(superseded) > 0 {
+		o.removeLocked(superseded)
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return entry.Seq, nil
+}
+
+// trackLocked anota la entrada como la última de sus documentos y devuelve las
+// entradas anteriores que ya no tienen documentos pendientes.
+// Debe llamarse con el mutex bloqueado.
+func (o *Outbox) trackLocked(entry *OutboxEntry) []uint64 {
+	var superseded []uint64
+	for _, id := range messageDocumentIDs(entry.Message) {
+		if previous, exists := o.docs[id]; exists && previous != entry.Seq {
+			if old := o.entries[previous]; old != nil {
+				old.pending--
+				if old.pending <= 0 {
+					superseded = append(superseded, previous)
+				}
+			}
+		}
+		o.docs[id] = entry.Seq
+		entry.pending++
+	}
+	return superseded
+}
+
+// messageDocumentIDs devuelve los IDs de los documentos a los que afecta un mensaje
+func messageDocumentIDs(msg DBMessage) []string {
+	if msg.Operation == OperationBatch {
+		var ids []string
+		for _, operation := range msg.Batch {
+			ids = append(ids, messageDocumentIDs(operation)...)
+		}
+		return ids
+	}
+	if id := getDocumentID(msg); id != "" {
+		return []string{id}
+	}
+	if msg.Tombstone != nil {
+		return []string{msg.Tombstone.ID}
+	}
+	return nil
+}
+
+// Remove elimina entradas que ya no hay que enviar, porque otro nodo confirmó
+// haberlas recibido o porque la política de replicación no las publica
+func (o *Outbox) Remove(seqs []uint64) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.removeLocked(seqs)
+}
+
+// removeLocked elimina entradas y reescribe el archivo si acumula muchas
+// eliminadas. Debe llamarse con el mutex bloqueado.
+func (o *Outbox) removeLocked(seqs []uint64) error {
+	var removed []uint64
+	for _, seq := range seqs {
+		entry, exists := o.entries[seq]
+		if !exists {
+			continue
+		}
+		for _, id := range messageDocumentIDs(entry.Message) {
+			if o.docs[id] == seq {
+				delete(o.docs, id)
+			}
+		}
+		delete(o.entries, seq)
+		removed = append(removed, seq)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	// Perder un registro de eliminación solo provoca un reenvío, así que no se
+	// fuerza a disco
+	if err := o.appendLocked(outboxRecord{Remove: removed}, false); err != nil {
+		return err
+	}
+	o.removed += len(removed)
+	if o.file != nil && o.removed >= outboxCompactThreshold && o.removed > len(o.entries) {
+		return o.rewrite()
+	}
+	return nil
+}
+
+// Due devuelve hasta limit entradas cuyo envío toca, en orden de secuencia
+func (o *Outbox) Due(now time.Time, limit int) []OutboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var due []OutboxEntry
+	for _, seq := range slices.Sorted(maps.Keys(o.entries)) {
+		entry := o.entries[seq]
+		if entry.nextAttempt.After(now) {
+			continue
+		}
+		due = append(due, *entry)
+		if len(due) == limit {
+			break
+		}
+	}
+	return due
+}
+
+// Attempted anota un envío sin confirmar y aplaza el siguiente, cada vez más
+func (o *Outbox) Attempted(seq uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	entry, exists := o.entries[seq]
+	if !exists {
+		return
+	}
+	entry.attempts++
+	delay := outboxRetryMax
+	if entry.attempts <= 10 {
+		delay = min(outboxRetryBase<<(entry.attempts-1), outboxRetryMax)
+	}
+	entry.nextAttempt = time.Now().Add(delay)
+}
+
+// RetryNow adelanta el envío de todas las entradas pendientes
+func (o *Outbox) RetryNow() {
+	o.mutex.Lock()
+	for _, entry := range o.entries {
+		entry.nextAttempt = time.Time{}
+	}
+	o.mutex.Unlock()
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending indica si un documento tiene una escritura pendiente de replicar
+func (o *Outbox) Pending(id string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	_, exists := o.docs[id]
+	return exists
+}
+
+// Len devuelve cuántas entradas están pendientes
+func (o *Outbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.entries)
+}
+
+// Close cierra el archivo del outbox
+func (o *Outbox) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
+
+// outboxStream identifica las escrituras de un nodo en una época de su outbox.
+// Los mensajes de versiones sin épocas se identifican solo por el nodo.
+func outboxStream(origin, epoch string) string {
+	if epoch == "" {
+		return origin
+	}
+	return origin + "/" + epoch
+}
+
+// seqWindow recuerda los últimos números de secuencia recibidos de un nodo. Una
+// secuencia que ya no está en la ventana se vuelve a aplicar, lo que no cambia
+// el resultado.
+type seqWindow struct {
+	seen  map[uint64]bool
+	order []uint64
+}
+
+// enqueue registra una escritura local en el outbox, desde donde se envía a la
+// red hasta que otro nodo confirma haberla recibido
+func (s *DBSync) enqueue(msg DBMessage) error {
+	if _, err := s.outbox.Add(s.nodeID, msg); err != nil {
+		return fmt.Errorf("error al registrar la escritura en el outbox: %v", err)
+	}
+	return nil
+}
+
+// outboxLoop envía las entradas del outbox cuando se añaden y las reenvía
+// periódicamente mientras nadie confirma haberlas recibido
+func (s *DBSync) outboxLoop(ctx context.Context) {
+	ticker := time.NewTicker(outboxCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.outbox.notify:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for _, entry := range s.outbox.Due(time.Now(), outboxSendLimit) {
+			s.deliver(entry)
+		}
+	}
+}
+
+// deliver publica una entrada del outbox en los temas de sus colecciones. Si
+// ningún tema tiene nodos suscritos se reintenta en la siguiente comprobación
+// sin contar el intento; si la política no publica nada de la entrada se
+// descarta.
+func (s *DBSync) deliver(entry OutboxEntry) {
+	msg, collections := s.route(entry.Message)
+	if len(collections) == 0 {
+		s.outbox.Remove([]uint64{entry.Seq})
+		return
+	}
+	msg.Origin, msg.Epoch, msg.Seq = entry.Origin, s.outbox.Epoch(), entry.Seq
+
+	sent := false
+	for _, collection := range collections {
+		topic, err := s.topicFor(collection)
+		if err != nil {
+			log.Printf("Error al enviar la escritura %d del outbox: %v", entry.Seq, err)
+			continue
+		}
+		if len(topic.ListPeers()) == 0 {
+			continue
+		}
+		if err := s.publishTo(topic, msg); err != nil {
+			log.Printf("Error al enviar la escritura %d del outbox: %v", entry.Seq, err)
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		s.outbox.Attempted(entry.Seq)
+	}
+}
+
+// received indica si ya se aplicó la escritura seq del flujo stream, el de un
+// nodo de origen en una época de su outbox
+func (s *DBSync) received(stream string, seq uint64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	window := s.delivered[stream]
+	return window != nil && window.seen[seq]
+}
+
+// confirm anota que se aplicó la escritura seq del flujo stream y la añade a
+// las confirmaciones pendientes de enviar
+func (s *DBSync) confirm(stream string, seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	window := s.delivered[stream]
+	if window == nil {
+		window = &seqWindow{seen: make(map[uint64]bool)}
+		s.delivered[stream] = window
+	}
+	if !window.seen[seq] {
+		window.seen[seq] = true
+		window.order = append(window.order, seq)
+		if len(window.order) > receivedWindowSize {
+			delete(window.seen, window.order[0])
+			window.order = window.order[1:]
+		}
+	}
+	s.pendingDelivered[stream] = append(s.pendingDelivered[stream], seq)
+}
+
+// confirmed devuelve las escrituras del outbox local que confirma un mensaje.
+// Las confirmaciones de otra época corresponden a un arranque anterior y sus
+// secuencias no son las de las entradas actuales.
+func (s *DBSync) confirmed(delivered map[string][]uint64) []uint64 {
+	return delivered[outboxStream(s.nodeID, s.outbox.Epoch())]
+}
+
+// confirmLoop envía periódicamente las confirmaciones de las escrituras recibidas
+func (s *DBSync) confirmLoop(ctx context.Context) {
+	ticker := time.NewTicker(confirmInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mutex.Lock()
+			delivered := s.pendingDelivered
+			s.pendingDelivered = make(map[string][]uint64)
+			s.mutex.Unlock()
+			if len(delivered) == 0 {
+				continue
+			}
+
+			msg := DBMessage{Operation: OperationAck, Delivered: delivered}
+			if err := s.publishTo(s.topic, msg); err != nil {
+				log.Printf("Error al confirmar escrituras recibidas: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// OutboxDepth devuelve cuántas escrituras locales están pendientes de replicar
+func (s *DBSync) OutboxDepth() int {
+	return s.outbox.Len()
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// newOutboxTestSync crea un DBSync sin red con el outbox indicado
+func newOutboxTestSync(nodeID string, outbox *Outbox) *DBSync {
+	return &DBSync{
+		nodeID:           nodeID,
+		outbox:           outbox,
+		delivered:        make(map[string]*seqWindow),
+		pendingDelivered: make(map[string][]uint64),
+	}
+}
+
+// receive simula la recepción de una escritura del outbox y devuelve si se aplica
+func receive(s *DBSync, sender string, msg DBMessage) bool {
+	stream := outboxStream(sender, msg.Epoch)
+	if s.received(stream, msg.Seq) {
+		s.confirm(stream, msg.Seq)
+		return false
+	}
+	s.confirm(stream, msg.Seq)
+	return true
+}
+
+// outboxMessage devuelve el mensaje con el que se envía la entrada seq del outbox
+func outboxMessage(t *testing.T, outbox *Outbox, seq uint64) DBMessage {
+	t.Helper()
+	for _, entry := range outbox.Due(time.Now(), 0) {
+		if entry.Seq == seq {
+			msg := entry.Message
+			msg.Origin, msg.Epoch, msg.Seq = entry.Origin, outbox.Epoch(), entry.Seq
+			return msg
+		}
+	}
+	t.Fatalf("la entrada %d no está en el outbox", seq)
+	return DBMessage{}
+}
+
+func TestOutboxInMemoryRestartIsNotReplay(t *testing.T) {
+	receiver := newOutboxTestSync("receptor", nil)
+
+	first, err := OpenOutbox("")
+	if err != nil {
+		t.Fatalf("error al abrir el outbox: %v", err)
+	}
+	seq, err := first.Add("origen", DBMessage{Operation: OperationCreate, Document: &Document{ID: "a"}})
+	if err != nil {
+		t.Fatalf("error al añadir al outbox: %v", err)
+	}
+	msg := outboxMessage(t, first, seq)
+	if !receive(receiver, "origen", msg) {
+		t.Fatalf("la primera escritura no se aplicó")
+	}
+	if receive(receiver, "origen", msg) {
+		t.Errorf("el reenvío de una escritura aplicada se volvió a aplicar")
+	}
+
+	// Reinicio: el outbox en memoria vuelve a numerar desde 1
+	restarted, err := OpenOutbox("")
+	if err != nil {
+		t.Fatalf("error al abrir el outbox: %v", err)
+	}
+	if restarted.Epoch() == first.Epoch() {
+		t.Fatalf("el outbox reiniciado conserva la época %s", first.Epoch())
+	}
+	seq, err = restarted.Add("origen", DBMessage{Operation: OperationCreate, Document: &Document{ID: "b"}})
+	if err != nil {
+		t.Fatalf("error al añadir al outbox: %v", err)
+	}
+	if seq != msg.Seq {
+		t.Fatalf("secuencia tras el reinicio = %d, se esperaba %d", seq, msg.Seq)
+	}
+	if !receive(receiver, "origen", outboxMessage(t, restarted, seq)) {
+		t.Errorf("la escritura tras el reinicio se descartó como repetición")
+	}
+
+	// Solo la confirmación de la época actual saca la entrada del outbox
+	origin := newOutboxTestSync("origen", restarted)
+	stale := map[string][]uint64{outboxStream("origen", first.Epoch()): {seq}}
+	if seqs := origin.confirmed(stale); len(seqs) > 0 {
+		t.Errorf("una confirmación del arranque anterior confirma %v", seqs)
+	}
+	if seqs := origin.confirmed(receiver.pendingDelivered); len(seqs) != 1 || seqs[0] != seq {
+		t.Errorf("confirmadas = %v, se esperaba [%d]", seqs, seq)
+	}
+}
+
+func TestOutboxKeepsEpochAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	outbox, err := OpenOutbox(dir)
+	if err != nil {
+		t.Fatalf("error al abrir el outbox: %v", err)
+	}
+	if _, err := outbox.Add("origen", DBMessage{Operation: OperationCreate, Document: &Document{ID: "a"}}); err != nil {
+		t.Fatalf("error al añadir al outbox: %v", err)
+	}
+	epoch := outbox.Epoch()
+	outbox.Close()
+
+	reopened, err := OpenOutbox(dir)
+	if err != nil {
+		t.Fatalf("error al reabrir el outbox: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Epoch() != epoch {
+		t.Errorf("época tras reabrir = %s, se esperaba %s", reopened.Epoch(), epoch)
+	}
+	seq, err := reopened.Add("origen", DBMessage{Operation: OperationCreate, Document: &Document{ID: "b"}})
+	if err != nil {
+		t.Fatalf("error al añadir al outbox: %v", err)
+	}
+	if seq != 2 {
+		t.Errorf("secuencia tras reabrir = %d, se esperaba 2", seq)
+	}
+}
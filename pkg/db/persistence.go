@@ -2,189 +2,667 @@ package db
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 )
 
-// PersistenceManager maneja la persistencia de la base de datos
+// schemaFileName nombre del archivo con el esquema de una colección, dentro de su directorio
+const schemaFileName = "_schema.json"
+
+// legacyTransactionLog log de transacciones usado antes del WAL
+const legacyTransactionLog = "transactions.log"
+
+// defaultCheckpointInterval intervalo por defecto entre puntos de control
+const defaultCheckpointInterval = time.Minute
+
+// PersistenceManager maneja la persistencia de la base de datos. Cada escritura se
+// registra en el WAL antes de aplicarse al motor de almacenamiento, y los puntos
+// de control periódicos fuerzan el motor a disco y liberan el WAL.
 type PersistenceManager struct {
-	dataDir        string
-	transactionLog *TransactionLogger
-	mutex          sync.Mutex
+	dataDir            string
+	wal                *WAL
+	engine             StorageEngine
+	engineName         string // Motor configurado; vacío usa el registrado en el directorio
+	checkpointInterval time.Duration
+	segmentSize        int64
+	stop               chan struct{}
+	done               chan struct{}
+	mutex              sync.Mutex
 }
 
-// NewPersistenceManager crea una nueva instancia del gestor de persistencia
-func NewPersistenceManager(dataDir string) (*PersistenceManager, error) {
+// PersistenceOption configura el gestor de persistencia
+type PersistenceOption func(*PersistenceManager)
+
+// WithCheckpointInterval establece el intervalo entre puntos de control automáticos
+// (0 los desactiva; Checkpoint y Close siguen creando puntos de control)
+func WithCheckpointInterval(interval time.Duration) PersistenceOption {
+	return func(pm *PersistenceManager) {
+		pm.checkpointInterval = interval
+	}
+}
+
+// WithSegmentSize establece el tamaño a partir del cual se rota el segmento del WAL
+func WithSegmentSize(size int64) PersistenceOption {
+	return func(pm *PersistenceManager) {
+		pm.segmentSize = size
+	}
+}
+
+// WithStorageEngine establece el motor de almacenamiento de los documentos
+// (StorageEngineFile o StorageEngineSegment). Si el directorio de datos ya usa
+// otro motor, hay que convertirlo antes con MigrateStorage.
+func WithStorageEngine(name string) PersistenceOption {
+	return func(pm *PersistenceManager) {
+		pm.engineName = name
+	}
+}
+
+// NewPersistenceManager crea una nueva instancia del gestor de persistencia. Al
+// abrirse aplica al motor de almacenamiento las escrituras del WAL posteriores al
+// último punto de control, de modo que los documentos quedan al día.
+func NewPersistenceManager(dataDir string, options ...PersistenceOption) (*PersistenceManager, error) {
 	// Crear directorio de datos si no existe
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("error al crear directorio de datos: %v", err)
 	}
 
-	// Crear directorio para colecciones
+	pm := &PersistenceManager{
+		dataDir:            dataDir,
+		checkpointInterval: defaultCheckpointInterval,
+		segmentSize:        defaultSegmentSize,
+		stop:               make(chan struct{}),
+		done:               make(chan struct{}),
+	}
+	for _, option := range options {
+		option(pm)
+	}
+
+	// Abrir el motor registrado en el directorio de datos
+	engine, err := pm.openEngine()
+	if err != nil {
+		return nil, err
+	}
+	pm.engine = engine
+
+	// Crear directorio para colecciones, donde se guardan los esquemas
 	collectionsDir := filepath.Join(dataDir, "collections")
 	if err := os.MkdirAll(collectionsDir, 0755); err != nil {
+		engine.Close()
 		return nil, fmt.Errorf("error al crear directorio de colecciones: %v", err)
 	}
 
-	// Inicializar el logger de transacciones
-	transactionLog, err := NewTransactionLogger(filepath.Join(dataDir, "transactions.log"))
+	// Abrir el WAL
+	wal, err := OpenWAL(filepath.Join(dataDir, "wal"), pm.segmentSize)
 	if err != nil {
-		return nil, fmt.Errorf("error al inicializar el logger de transacciones: %v", err)
+		engine.Close()
+		return nil, fmt.Errorf("error al abrir el WAL: %v", err)
+	}
+	pm.wal = wal
+
+	// Completar las escrituras pendientes
+	if err := pm.recover(); err != nil {
+		wal.Close()
+		engine.Close()
+		return nil, err
 	}
 
-	return &PersistenceManager{
-		dataDir:        dataDir,
-		transactionLog: transactionLog,
-	}, nil
+	go pm.checkpointLoop()
+
+	return pm, nil
 }
 
-// SaveDocument guarda un documento en el sistema de archivos
-func (pm *PersistenceManager) SaveDocument(doc *Document) error {
+// openEngine abre el motor de almacenamiento del directorio de datos, comprobando
+// que coincide con el configurado, y lo registra si el directorio es nuevo
+func (pm *PersistenceManager) openEngine() (StorageEngine, error) {
+	recorded, err := readStorageEngine(pm.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	name := pm.engineName
+	switch {
+	case recorded == "" && name == "":
+		name = StorageEngineFile
+	case name == "":
+		name = recorded
+	case recorded != "" && recorded != name:
+		return nil, fmt.Errorf("el directorio de datos usa el motor %q y no %q; conviértelo primero con la migración de almacenamiento", recorded, name)
+	}
+
+	engine, err := OpenStorageEngine(name, pm.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir motor de almacenamiento: %v", err)
+	}
+
+	if recorded == "" {
+		if err := writeStorageEngine(pm.dataDir, name); err != nil {
+			engine.Close()
+			return nil, err
+		}
+	}
+	return engine, nil
+}
+
+// StorageEngine devuelve el nombre del motor de almacenamiento en uso
+func (pm *PersistenceManager) StorageEngine() string {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
-	// Crear directorio para la colección si no existe
-	collectionDir := filepath.Join(pm.dataDir, "collections", doc.Collection)
-	if err := os.MkdirAll(collectionDir, 0755); err != nil {
-		return fmt.Errorf("error al crear directorio de colección: %v", err)
+	return pm.engine.Name()
+}
+
+// recover migra el log de transacciones anterior, si existe, y aplica al motor
+// las transacciones del WAL posteriores al punto de control
+func (pm *PersistenceManager) recover() error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	legacyPath := filepath.Join(pm.dataDir, legacyTransactionLog)
+	transactions, err := readLegacyTransactions(legacyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error al leer log de transacciones anterior: %v", err)
+	}
+	for _, transaction := range transactions {
+		if err := pm.applyTransaction(transaction); err != nil {
+			return err
+		}
 	}
 
-	// Serializar el documento a JSON
-	data, err := json.MarshalIndent(doc, "", "  ")
+	err = pm.wal.ReadFrom(pm.wal.CheckpointLSN(), pm.applyTransaction)
 	if err != nil {
-		return fmt.Errorf("error al serializar documento: %v", err)
+		return fmt.Errorf("error al reproducir el WAL: %v", err)
 	}
 
-	// Guardar el documento en un archivo
-	filePath := filepath.Join(collectionDir, doc.ID+".json")
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return fmt.Errorf("error al guardar documento: %v", err)
+	if err := pm.checkpointLocked(); err != nil {
+		return err
 	}
 
-	// Registrar la transacción
-	pm.transactionLog.LogOperation(OperationCreate, doc.ID, doc)
+	// El log anterior ya está aplicado y protegido por el punto de control
+	if err := os.Remove(legacyPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error al eliminar log de transacciones anterior: %v", err)
+	}
 
 	return nil
 }
 
-// UpdateDocument actualiza un documento en el sistema de archivos
+// applyTransaction aplica una transacción del log al motor de almacenamiento.
+// Debe llamarse con el mutex bloqueado.
+func (pm *PersistenceManager) applyTransaction(transaction Transaction) error {
+	switch transaction.Type {
+	case TransactionCreate, TransactionUpdate:
+		if transaction.Document != nil {
+			return pm.engine.Put(transaction.Document)
+		}
+	case TransactionDelete:
+		// Los registros anteriores al WAL no guardaban la colección de las eliminaciones
+		if transaction.Collection != "" {
+			return pm.engine.Delete(transaction.Collection, transaction.DocID)
+		}
+	case TransactionCommit:
+		for _, operation := range transaction.Operations {
+			if err := pm.applyTransaction(operation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logTransaction registra una transacción en el WAL. Debe llamarse con el mutex bloqueado.
+func (pm *PersistenceManager) logTransaction(op Operation, docID string, doc *Document, collection string) error {
+	transaction, err := newTransaction(op, docID, doc)
+	if err != nil {
+		return err
+	}
+	transaction.Collection = collection
+
+	if _, err := pm.wal.Append(transaction); err != nil {
+		return fmt.Errorf("error al registrar transacción: %v", err)
+	}
+	return nil
+}
+
+// SaveDocument guarda un documento en el motor de almacenamiento
+func (pm *PersistenceManager) SaveDocument(doc *Document) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	// Registrar la transacción antes de modificar el motor
+	if err := pm.logTransaction(OperationCreate, doc.ID, doc, doc.Collection); err != nil {
+		return err
+	}
+
+	return pm.engine.Put(doc)
+}
+
+// UpdateDocument actualiza un documento en el motor de almacenamiento
 func (pm *PersistenceManager) UpdateDocument(doc *Document) error {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
 	// Verificar si el documento existe
-	filePath := filepath.Join(pm.dataDir, "collections", doc.Collection, doc.ID+".json")
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("documento no encontrado: %s", doc.ID)
+	if err := pm.checkExists(doc.Collection, doc.ID); err != nil {
+		return err
 	}
 
-	// Serializar el documento a JSON
-	data, err := json.MarshalIndent(doc, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error al serializar documento: %v", err)
+	// Registrar la transacción antes de modificar el motor
+	if err := pm.logTransaction(OperationUpdate, doc.ID, doc, doc.Collection); err != nil {
+		return err
+	}
+
+	return pm.engine.Put(doc)
+}
+
+// DeleteDocument elimina un documento del motor de almacenamiento
+func (pm *PersistenceManager) DeleteDocument(collection, id string) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	// Verificar si el documento existe
+	if err := pm.checkExists(collection, id); err != nil {
+		return err
 	}
 
-	// Guardar el documento en un archivo
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		return fmt.Errorf("error al guardar documento: %v", err)
+	// Registrar la transacción antes de modificar el motor
+	if err := pm.logTransaction(OperationDelete, id, nil, collection); err != nil {
+		return err
 	}
 
-	// Registrar la transacción
-	pm.transactionLog.LogOperation(OperationUpdate, doc.ID, doc)
+	return pm.engine.Delete(collection, id)
+}
 
+// checkExists comprueba que un documento está guardado. Debe llamarse con el mutex bloqueado.
+func (pm *PersistenceManager) checkExists(collection, id string) error {
+	exists, err := pm.engine.Has(collection, id)
+	if err != nil {
+		return fmt.Errorf("error al comprobar documento: %v", err)
+	}
+	if !exists {
+		return fmt.Errorf("documento no encontrado: %s", id)
+	}
 	return nil
 }
 
-// DeleteDocument elimina un documento del sistema de archivos
-func (pm *PersistenceManager) DeleteDocument(collection, id string) error {
+// CommitTransaction persiste las operaciones de una transacción. Primero se
+// registran en el WAL como un único commit y después se aplican al motor, de
+// modo que tras un fallo la recuperación completa la transacción.
+func (pm *PersistenceManager) CommitTransaction(operations []Transaction) error {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
-	// Verificar si el documento existe
-	filePath := filepath.Join(pm.dataDir, "collections", collection, id+".json")
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("documento no encontrado: %s", id)
+	commit := Transaction{
+		ID:         generateUUID(),
+		Type:       TransactionCommit,
+		Timestamp:  time.Now(),
+		Operations: operations,
+	}
+	if _, err := pm.wal.Append(commit); err != nil {
+		return fmt.Errorf("error al registrar transacción: %v", err)
+	}
+
+	return pm.applyTransaction(commit)
+}
+
+// Checkpoint fuerza a disco el motor de almacenamiento y registra en el WAL que
+// sus transacciones ya están aplicadas, liberando los segmentos que ya no se necesitan
+func (pm *PersistenceManager) Checkpoint() error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.checkpointLocked()
+}
+
+// checkpointLocked crea un punto de control. Debe llamarse con el mutex bloqueado.
+func (pm *PersistenceManager) checkpointLocked() error {
+	// Todas las transacciones del WAL están aplicadas al motor bajo el mutex;
+	// basta con forzarlo a disco antes de registrar el punto de control
+	if err := pm.engine.Sync(); err != nil {
+		return err
+	}
+
+	lsn := pm.wal.LastLSN()
+	if lsn == pm.wal.CheckpointLSN() {
+		return nil
+	}
+	if err := pm.wal.Checkpoint(lsn); err != nil {
+		return fmt.Errorf("error al crear punto de control: %v", err)
+	}
+	return nil
+}
+
+// checkpointLoop crea puntos de control periódicos hasta que se cierra el gestor
+func (pm *PersistenceManager) checkpointLoop() {
+	defer close(pm.done)
+
+	if pm.checkpointInterval <= 0 {
+		<-pm.stop
+		return
+	}
+
+	ticker := time.NewTicker(pm.checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pm.stop:
+			return
+		case <-ticker.C:
+			if err := pm.Checkpoint(); err != nil {
+				log.Printf("Error al crear punto de control: %v", err)
+			}
+		}
+	}
+}
+
+// WALStats devuelve el último LSN escrito, el del último punto de control y el
+// tamaño del WAL en disco
+func (pm *PersistenceManager) WALStats() (lastLSN, checkpointLSN uint64, size int64) {
+	return pm.wal.LastLSN(), pm.wal.CheckpointLSN(), pm.wal.Size()
+}
+
+// Close crea un último punto de control y cierra el WAL y el motor de almacenamiento
+func (pm *PersistenceManager) Close() error {
+	select {
+	case <-pm.stop:
+		return nil
+	default:
 	}
+	close(pm.stop)
+	<-pm.done
 
-	// Eliminar el archivo
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("error al eliminar documento: %v", err)
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	err := pm.checkpointLocked()
+	if walErr := pm.wal.Close(); err == nil {
+		err = walErr
 	}
+	if engineErr := pm.engine.Close(); err == nil {
+		err = engineErr
+	}
+	return err
+}
 
-	// Registrar la transacción
-	pm.transactionLog.LogOperation(OperationDelete, id, nil)
+// syncPath fuerza a disco un archivo o directorio si todavía existe
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
 
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
 	return nil
 }
 
-// LoadAllDocuments carga todos los documentos del sistema de archivos
+// LoadAllDocuments carga todos los documentos del motor de almacenamiento
 func (pm *PersistenceManager) LoadAllDocuments() (map[string]*Document, error) {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
 	documents := make(map[string]*Document)
+	err := pm.engine.ForEach(func(doc *Document) error {
+		documents[doc.ID] = doc
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error al cargar documentos: %v", err)
+	}
+
+	return documents, nil
+}
+
+// SaveIndexDefinitions guarda las definiciones de los índices en el directorio de datos
+func (pm *PersistenceManager) SaveIndexDefinitions(definitions []IndexDefinition) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
 
-	// Obtener todas las colecciones
-	collectionsDir := filepath.Join(pm.dataDir, "collections")
+	// Serializar las definiciones a JSON
+	data, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar definiciones de índices: %v", err)
+	}
+
+	// Escribir en un archivo temporal y renombrarlo para evitar archivos a medias
+	filePath := filepath.Join(pm.dataDir, "indexes.json")
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("error al guardar definiciones de índices: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar definiciones de índices: %v", err)
+	}
+
+	return nil
+}
+
+// LoadIndexDefinitions carga las definiciones de los índices del directorio de datos
+func (pm *PersistenceManager) LoadIndexDefinitions() ([]IndexDefinition, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(pm.dataDir, "indexes.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Si el archivo no existe, no hay índices definidos
+			return []IndexDefinition{}, nil
+		}
+		return nil, fmt.Errorf("error al leer definiciones de índices: %v", err)
+	}
+
+	var definitions []IndexDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return nil, fmt.Errorf("error al deserializar definiciones de índices: %v", err)
+	}
+
+	return definitions, nil
+}
+
+// SaveCRDTSpecs guarda los campos contador y conjunto declarados en cada colección
+func (pm *PersistenceManager) SaveCRDTSpecs(specs map[string]CRDTSpec) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	data, err := json.MarshalIndent(specs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar especificaciones CRDT: %v", err)
+	}
+
+	// Escribir en un archivo temporal y renombrarlo para evitar archivos a medias
+	filePath := filepath.Join(pm.dataDir, "crdt.json")
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("error al guardar especificaciones CRDT: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar especificaciones CRDT: %v", err)
+	}
+
+	return nil
+}
+
+// LoadCRDTSpecs carga los campos contador y conjunto declarados en cada colección
+func (pm *PersistenceManager) LoadCRDTSpecs() (map[string]CRDTSpec, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	specs := make(map[string]CRDTSpec)
+	data, err := os.ReadFile(filepath.Join(pm.dataDir, "crdt.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return specs, nil
+		}
+		return nil, fmt.Errorf("error al leer especificaciones CRDT: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("error al deserializar especificaciones CRDT: %v", err)
+	}
+
+	return specs, nil
+}
+
+// SaveTombstones guarda las lápidas de los documentos eliminados y los nodos
+// que deben confirmarlas
+func (pm *PersistenceManager) SaveTombstones(state tombstoneState) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error al serializar lápidas: %v", err)
+	}
+
+	// Forzar el archivo a disco: perder una lápida puede resucitar el documento
+	filePath := filepath.Join(pm.dataDir, "tombstones.json")
+	tmpPath := filePath + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return fmt.Errorf("error al guardar lápidas: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar lápidas: %v", err)
+	}
+
+	return syncDir(pm.dataDir)
+}
+
+// LoadTombstones carga las lápidas de los documentos eliminados
+func (pm *PersistenceManager) LoadTombstones() (tombstoneState, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	var state tombstoneState
+	data, err := os.ReadFile(filepath.Join(pm.dataDir, "tombstones.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, fmt.Errorf("error al leer lápidas: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error al deserializar lápidas: %v", err)
+	}
+
+	return state, nil
+}
+
+// SaveSchema guarda el esquema de una colección en su directorio
+func (pm *PersistenceManager) SaveSchema(collection string, schema *Schema) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return writeSchemaFile(pm.dataDir, collection, schema)
+}
+
+// DeleteSchema elimina el esquema de una colección
+func (pm *PersistenceManager) DeleteSchema(collection string) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return removeSchemaFile(pm.dataDir, collection)
+}
+
+// LoadSchemas carga los esquemas de todas las colecciones
+func (pm *PersistenceManager) LoadSchemas() (map[string]*Schema, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return readSchemaFiles(pm.dataDir)
+}
+
+// writeSchemaFile guarda el esquema de una colección de un directorio de datos
+func writeSchemaFile(dataDir, collection string, schema *Schema) error {
+	collectionDir := filepath.Join(dataDir, "collections", collection)
+	if err := os.MkdirAll(collectionDir, 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de colección: %v", err)
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar esquema: %v", err)
+	}
+
+	// Escribir en un archivo temporal y renombrarlo para evitar archivos a medias
+	filePath := filepath.Join(collectionDir, schemaFileName)
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("error al guardar esquema: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar esquema: %v", err)
+	}
+
+	return nil
+}
+
+// removeSchemaFile elimina el esquema de una colección de un directorio de datos
+func removeSchemaFile(dataDir, collection string) error {
+	filePath := filepath.Join(dataDir, "collections", collection, schemaFileName)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error al eliminar esquema: %v", err)
+	}
+
+	return nil
+}
+
+// readSchemaFiles carga los esquemas de las colecciones de un directorio de datos
+func readSchemaFiles(dataDir string) (map[string]*Schema, error) {
+	schemas := make(map[string]*Schema)
+
+	collectionsDir := filepath.Join(dataDir, "collections")
 	collections, err := os.ReadDir(collectionsDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// Si el directorio no existe, devolver un mapa vacío
-			return documents, nil
+			return schemas, nil
 		}
 		return nil, fmt.Errorf("error al leer directorio de colecciones: %v", err)
 	}
 
-	// Iterar sobre cada colección
 	for _, collectionInfo := range collections {
 		if !collectionInfo.IsDir() {
 			continue
 		}
 
-		collectionName := collectionInfo.Name()
-		collectionDir := filepath.Join(collectionsDir, collectionName)
-
-		// Leer todos los archivos de la colección
-		files, err := os.ReadDir(collectionDir)
+		data, err := os.ReadFile(filepath.Join(collectionsDir, collectionInfo.Name(), schemaFileName))
 		if err != nil {
-			return nil, fmt.Errorf("error al leer directorio de colección %s: %v", collectionName, err)
-		}
-
-		// Iterar sobre cada archivo (documento)
-		for _, fileInfo := range files {
-			if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".json" {
+			if os.IsNotExist(err) {
 				continue
 			}
+			return nil, fmt.Errorf("error al leer esquema de %s: %v", collectionInfo.Name(), err)
+		}
 
-			// Leer el archivo
-			filePath := filepath.Join(collectionDir, fileInfo.Name())
-			data, err := os.ReadFile(filePath)
-			if err != nil {
-				return nil, fmt.Errorf("error al leer documento %s: %v", fileInfo.Name(), err)
-			}
-
-			// Deserializar el documento
-			var doc Document
-			if err := json.Unmarshal(data, &doc); err != nil {
-				return nil, fmt.Errorf("error al deserializar documento %s: %v", fileInfo.Name(), err)
-			}
-
-			// Añadir el documento al mapa
-			documents[doc.ID] = &doc
+		var schema Schema
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return nil, fmt.Errorf("error al deserializar esquema de %s: %v", collectionInfo.Name(), err)
 		}
+		schemas[collectionInfo.Name()] = &schema
 	}
 
-	return documents, nil
+	return schemas, nil
 }
 
-// CreateBackup crea una copia de seguridad de la base de datos
+// CreateBackup crea una copia de seguridad de la base de datos. El backup es un
+// directorio de datos con el mismo motor de almacenamiento y los esquemas.
 func (pm *PersistenceManager) CreateBackup() (string, error) {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
 
+	// Forzar a disco las escrituras pendientes para copiar un estado completo
+	if err := pm.checkpointLocked(); err != nil {
+		return "", err
+	}
+
 	// Crear directorio de backups si no existe
 	backupsDir := filepath.Join(pm.dataDir, "backups")
 	if err := os.MkdirAll(backupsDir, 0755); err != nil {
@@ -201,24 +679,38 @@ func (pm *PersistenceManager) CreateBackup() (string, error) {
 		return "", fmt.Errorf("error al crear directorio de backup: %v", err)
 	}
 
-	// Copiar directorio de colecciones
-	collectionsDir := filepath.Join(pm.dataDir, "collections")
-	backupCollectionsDir := filepath.Join(backupDir, "collections")
-	if err := copyDir(collectionsDir, backupCollectionsDir); err != nil {
-		return "", fmt.Errorf("error al copiar colecciones: %v", err)
+	// Copiar los documentos a un motor del mismo tipo dentro del backup
+	backup, err := OpenStorageEngine(pm.engine.Name(), backupDir)
+	if err != nil {
+		return "", fmt.Errorf("error al crear almacenamiento del backup: %v", err)
+	}
+	_, err = copyDocuments(pm.engine, backup)
+	if closeErr := backup.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("error al copiar documentos: %v", err)
+	}
+	if err := writeStorageEngine(backupDir, pm.engine.Name()); err != nil {
+		return "", err
 	}
 
-	// Copiar archivo de transacciones
-	transactionLogPath := filepath.Join(pm.dataDir, "transactions.log")
-	backupTransactionLogPath := filepath.Join(backupDir, "transactions.log")
-	if err := copyFile(transactionLogPath, backupTransactionLogPath); err != nil {
-		return "", fmt.Errorf("error al copiar log de transacciones: %v", err)
+	// Copiar los esquemas de las colecciones
+	schemas, err := readSchemaFiles(pm.dataDir)
+	if err != nil {
+		return "", err
+	}
+	for collection, schema := range schemas {
+		if err := writeSchemaFile(backupDir, collection, schema); err != nil {
+			return "", fmt.Errorf("error al copiar esquemas: %v", err)
+		}
 	}
 
 	return backupName, nil
 }
 
-// RestoreFromBackup restaura la base de datos desde una copia de seguridad
+// RestoreFromBackup restaura la base de datos desde una copia de seguridad. El
+// backup puede usar un motor de almacenamiento distinto del actual.
 func (pm *PersistenceManager) RestoreFromBackup(backupName string) error {
 	pm.mutex.Lock()
 	defer pm.mutex.Unlock()
@@ -229,41 +721,100 @@ func (pm *PersistenceManager) RestoreFromBackup(backupName string) error {
 		return fmt.Errorf("backup no encontrado: %s", backupName)
 	}
 
-	// Eliminar directorio de colecciones actual
-	collectionsDir := filepath.Join(pm.dataDir, "collections")
-	if err := os.RemoveAll(collectionsDir); err != nil {
-		return fmt.Errorf("error al eliminar directorio de colecciones: %v", err)
+	name, err := readStorageEngine(backupDir)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = StorageEngineFile
+	}
+	backup, err := OpenStorageEngine(name, backupDir)
+	if err != nil {
+		return fmt.Errorf("error al abrir almacenamiento del backup: %v", err)
+	}
+	defer backup.Close()
+
+	// Reemplazar los documentos actuales por los del backup
+	if err := pm.engine.Drop(); err != nil {
+		return fmt.Errorf("error al eliminar documentos actuales: %v", err)
+	}
+	if _, err := copyDocuments(backup, pm.engine); err != nil {
+		return fmt.Errorf("error al restaurar documentos: %v", err)
 	}
 
-	// Copiar directorio de colecciones desde el backup
-	backupCollectionsDir := filepath.Join(backupDir, "collections")
-	if err := copyDir(backupCollectionsDir, collectionsDir); err != nil {
-		return fmt.Errorf("error al restaurar colecciones: %v", err)
+	// Reemplazar los esquemas
+	current, err := readSchemaFiles(pm.dataDir)
+	if err != nil {
+		return err
+	}
+	for collection := range current {
+		if err := removeSchemaFile(pm.dataDir, collection); err != nil {
+			return err
+		}
+	}
+	restored, err := readSchemaFiles(backupDir)
+	if err != nil {
+		return err
+	}
+	for collection, schema := range restored {
+		if err := writeSchemaFile(pm.dataDir, collection, schema); err != nil {
+			return fmt.Errorf("error al restaurar esquemas: %v", err)
+		}
 	}
 
-	// Cerrar el logger de transacciones actual
-	pm.transactionLog.Close()
+	// Los documentos restaurados sustituyen a las escrituras del WAL: crear un
+	// punto de control para que no se vuelvan a aplicar
+	return pm.checkpointLocked()
+}
+
+// migrate copia los documentos a un motor de almacenamiento nuevo y lo deja en
+// uso. El registro del motor en el directorio de datos confirma la migración.
+func (pm *PersistenceManager) migrate(target string) (int, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
 
-	// Eliminar archivo de transacciones actual
-	transactionLogPath := filepath.Join(pm.dataDir, "transactions.log")
-	if err := os.Remove(transactionLogPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("error al eliminar log de transacciones: %v", err)
+	source := pm.engine
+	if source.Name() == target {
+		return 0, fmt.Errorf("el directorio de datos ya usa el motor %q", target)
 	}
 
-	// Copiar archivo de transacciones desde el backup
-	backupTransactionLogPath := filepath.Join(backupDir, "transactions.log")
-	if err := copyFile(backupTransactionLogPath, transactionLogPath); err != nil {
-		return fmt.Errorf("error al restaurar log de transacciones: %v", err)
+	// Aplicar y forzar a disco todas las escrituras del WAL
+	if err := pm.checkpointLocked(); err != nil {
+		return 0, err
 	}
 
-	// Reiniciar el logger de transacciones
-	var err error
-	pm.transactionLog, err = NewTransactionLogger(transactionLogPath)
+	engine, err := OpenStorageEngine(target, pm.dataDir)
 	if err != nil {
-		return fmt.Errorf("error al reiniciar el logger de transacciones: %v", err)
+		return 0, fmt.Errorf("error al abrir motor de almacenamiento: %v", err)
 	}
 
-	return nil
+	// Descartar los restos de una migración interrumpida antes de copiar
+	if err := engine.Drop(); err != nil {
+		engine.Close()
+		return 0, fmt.Errorf("error al vaciar motor de destino: %v", err)
+	}
+	count, err := copyDocuments(source, engine)
+	if err != nil {
+		engine.Close()
+		return count, fmt.Errorf("error al copiar documentos: %v", err)
+	}
+	if err := writeStorageEngine(pm.dataDir, target); err != nil {
+		engine.Close()
+		return count, err
+	}
+	pm.engine = engine
+	pm.engineName = target
+
+	// Liberar el espacio del motor anterior
+	err = source.Drop()
+	if closeErr := source.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return count, fmt.Errorf("error al eliminar datos del motor anterior: %v", err)
+	}
+
+	return count, nil
 }
 
 // ListBackups lista todas las copias de seguridad disponibles
@@ -306,52 +857,3 @@ func (pm *PersistenceManager) DeleteBackup(backupName string) error {
 
 	return nil
 }
-
-// Funciones auxiliares para copiar archivos y directorios
-
-func copyFile(src, dst string) error {
-	// Leer el archivo fuente
-	data, err := os.ReadFile(src)
-	if err != nil {
-		return err
-	}
-
-	// Escribir en el archivo destino
-	return os.WriteFile(dst, data, 0644)
-}
-
-func copyDir(src, dst string) error {
-	// Crear el directorio destino
-	if err := os.MkdirAll(dst, 0755); err != nil {
-		return err
-	}
-
-	// Leer el directorio fuente
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-
-	// Copiar cada entrada
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			// Si es un directorio, copiarlo recursivamente
-			if err := copyDir(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			// Si es un archivo, copiarlo
-			if err := copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -40,6 +41,8 @@ const (
 	OperatorSTARTSWITH QueryOperator = "startswith"
 	// OperatorENDSWITH termina con
 	OperatorENDSWITH QueryOperator = "endswith"
+	// OperatorTEXT búsqueda de texto sobre un índice de texto
+	OperatorTEXT QueryOperator = "text"
 )
 
 // LogicalOperator define los operadores lógicos
@@ -64,6 +67,9 @@ const (
 	SortDescending SortDirection = "desc"
 )
 
+// DocumentIDField campo por el que se puede ordenar el ID de los documentos
+const DocumentIDField = "_id"
+
 // QueryCondition representa una condición de consulta
 type QueryCondition struct {
 	Field    string        `json:"field"`
@@ -95,6 +101,26 @@ type Query struct {
 	Collection string       `json:"collection"`
 	Condition  interface{}  `json:"condition"` // Puede ser QueryCondition o LogicalCondition
 	Options    QueryOptions `json:"options"`
+	text       *textSearch  // Búsquedas de texto resueltas al ejecutar la consulta
+}
+
+// textSearch contiene las búsquedas de texto de una consulta resueltas contra sus índices
+type textSearch struct {
+	searches map[textSearchKey]*resolvedTextSearch
+	scores   map[string]float64 // Relevancia total de cada documento
+}
+
+// textSearchKey identifica una condición de texto de la consulta
+type textSearchKey struct {
+	field string
+	query string
+}
+
+// resolvedTextSearch es una condición de texto con su índice y sus resultados
+type resolvedTextSearch struct {
+	index  *Index
+	query  *textQuery
+	scores map[string]float64
 }
 
 // NewQuery crea una nueva consulta
@@ -167,8 +193,25 @@ func (q *Query) Sort(field string, direction SortDirection) *Query {
 
 // Execute ejecuta la consulta
 func (q *Query) Execute(db *Database) ([]*Document, error) {
-	// Obtener todos los documentos de la colección
-	docs, err := db.GetAllDocuments(q.Collection)
+	// En una colección de consistencia fuerte, ver las escrituras confirmadas
+	if err := db.readBarrier(q.Collection); err != nil {
+		return nil, err
+	}
+
+	// Resolver las búsquedas de texto contra sus índices
+	if err := q.prepareText(db.indexes); err != nil {
+		return nil, err
+	}
+
+	// Si un índice ordenado cubre la ordenación, recorrerlo solo hasta completar la página
+	if q.text == nil {
+		if results, ok := q.executeSorted(db); ok {
+			return results, nil
+		}
+	}
+
+	// Obtener los documentos candidatos, usando un índice si alguno es aplicable
+	docs, err := q.candidateDocuments(db)
 	if err != nil {
 		return nil, err
 	}
@@ -181,9 +224,13 @@ func (q *Query) Execute(db *Database) ([]*Document, error) {
 		}
 	}
 
-	// Aplicar ordenación
+	// Aplicar ordenación. Las búsquedas de texto sin ordenación explícita se ordenan por relevancia.
 	if len(q.Options.Sort) > 0 {
 		results = q.sortDocuments(results)
+	} else if q.text != nil {
+		sort.SliceStable(results, func(i, j int) bool {
+			return q.text.scores[results[i].ID] > q.text.scores[results[j].ID]
+		})
 	}
 
 	// Aplicar paginación
@@ -194,43 +241,281 @@ func (q *Query) Execute(db *Database) ([]*Document, error) {
 		results = results[:q.Options.Limit]
 	}
 
+	// Añadir la relevancia a los resultados de las búsquedas de texto
+	if q.text != nil {
+		for i, doc := range results {
+			scored := *doc
+			scored.Score = q.text.scores[doc.ID]
+			results[i] = &scored
+		}
+	}
+
 	return results, nil
 }
 
-// matchesCondition verifica si un documento coincide con una condición
-func (q *Query) matchesCondition(data map[string]interface{}, condition interface{}) bool {
-	// Verificar tipo de condición
-	switch cond := condition.(type) {
+// prepareText resuelve las condiciones de texto de la consulta: busca el índice de
+// texto de cada una y calcula la relevancia de los documentos candidatos
+func (q *Query) prepareText(im *IndexManager) error {
+	q.text = nil
+
+	var conditions []QueryCondition
+	collectTextConditions(q.Condition, &conditions)
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	text := &textSearch{
+		searches: make(map[textSearchKey]*resolvedTextSearch),
+		scores:   make(map[string]float64),
+	}
+	for _, condition := range conditions {
+		value, ok := condition.Value.(string)
+		if !ok {
+			return fmt.Errorf("el operador text requiere una cadena de búsqueda")
+		}
+
+		key := textSearchKey{field: condition.Field, query: value}
+		if _, exists := text.searches[key]; exists {
+			continue
+		}
+
+		index := im.findTextIndex(q.Collection, condition.Field)
+		if index == nil {
+			return fmt.Errorf("no hay índice de texto para el campo %q en la colección %s", condition.Field, q.Collection)
+		}
+
+		search := &resolvedTextSearch{
+			index:  index,
+			query:  parseTextQuery(index.textAnalyzer, value),
+			scores: index.TextSearch(value),
+		}
+		text.searches[key] = search
+		for id, score := range search.scores {
+			text.scores[id] += score
+		}
+	}
+
+	q.text = text
+	return nil
+}
+
+// collectTextConditions reúne las condiciones de texto de un árbol de condiciones
+func collectTextConditions(condition interface{}, conditions *[]QueryCondition) {
+	switch cond := normalizeCondition(condition).(type) {
 	case QueryCondition:
-		return q.matchesQueryCondition(data, cond)
+		if cond.Operator == OperatorTEXT {
+			*conditions = append(*conditions, cond)
+		}
 	case LogicalCondition:
-		return q.matchesLogicalCondition(data, cond)
-	case map[string]interface{}:
-		// Convertir mapa a QueryCondition
-		if field, ok := cond["field"].(string); ok {
-			if operator, ok := cond["operator"].(string); ok {
-				return q.matchesQueryCondition(data, QueryCondition{
-					Field:    field,
-					Operator: QueryOperator(operator),
-					Value:    cond["value"],
-				})
+		for _, child := range cond.Conditions {
+			collectTextConditions(child, conditions)
+		}
+	}
+}
+
+// textSearchFor devuelve la búsqueda de texto resuelta para una condición
+func (q *Query) textSearchFor(condition QueryCondition) *resolvedTextSearch {
+	if q.text == nil {
+		return nil
+	}
+	value, _ := condition.Value.(string)
+	return q.text.searches[textSearchKey{field: condition.Field, query: value}]
+}
+
+// executeSorted ejecuta una consulta con ordenación y límite recorriendo un índice
+// ordenado, de modo que solo se leen los documentos necesarios para la página.
+// Devuelve false si ningún índice es aplicable o si el índice no contiene
+// suficientes resultados (los documentos sin el campo se ordenan al final).
+func (q *Query) executeSorted(db *Database) ([]*Document, bool) {
+	if len(q.Options.Sort) == 0 || q.Options.Limit <= 0 {
+		return nil, false
+	}
+
+	conditions := conjunctiveConditions(q.Condition)
+	index, descending := db.indexes.findSortIndex(q.Collection, q.Options.Sort, conditions)
+	if index == nil {
+		return nil, false
+	}
+	r, _ := index.rangeFor(conditions)
+
+	skip := q.Options.Skip
+	if skip < 0 {
+		skip = 0
+	}
+	wanted := skip + q.Options.Limit
+
+	var results []*Document
+	db.scanIndex(index, r, descending, func(doc *Document) bool {
+		if q.matchesCondition(doc.Data, q.Condition) {
+			results = append(results, doc)
+		}
+		return len(results) < wanted
+	})
+
+	if len(results) < wanted {
+		return nil, false
+	}
+
+	return results[skip:], true
+}
+
+// conjunctiveConditions devuelve las condiciones simples que deben cumplirse siempre:
+// la condición misma o los hijos directos de un AND
+func conjunctiveConditions(condition interface{}) []QueryCondition {
+	switch cond := normalizeCondition(condition).(type) {
+	case QueryCondition:
+		return []QueryCondition{cond}
+	case LogicalCondition:
+		if cond.Operator != LogicalAND {
+			return nil
+		}
+		var conditions []QueryCondition
+		for _, child := range cond.Conditions {
+			if qc, ok := normalizeCondition(child).(QueryCondition); ok {
+				conditions = append(conditions, qc)
 			}
 		}
-		// Verificar si es una condición lógica
+		return conditions
+	}
+	return nil
+}
+
+// candidateDocuments obtiene los documentos que pueden cumplir la condición.
+// Si un índice cubre la condición solo se leen los documentos indexados;
+// en caso contrario se recorre la colección completa.
+func (q *Query) candidateDocuments(db *Database) ([]*Document, error) {
+	if ids, ok := q.planIndexLookup(db.indexes, q.Condition); ok {
+		return db.getDocumentsByIDs(q.Collection, ids), nil
+	}
+
+	return db.GetAllDocuments(q.Collection)
+}
+
+// planIndexLookup obtiene los IDs candidatos para una condición usando los índices.
+// Los candidatos son un superconjunto de los resultados: el filtro se aplica igualmente.
+func (q *Query) planIndexLookup(im *IndexManager, condition interface{}) ([]string, bool) {
+	switch cond := normalizeCondition(condition).(type) {
+	case QueryCondition:
+		// Los candidatos de una búsqueda de texto son los documentos con relevancia
+		if cond.Operator == OperatorTEXT {
+			search := q.textSearchFor(cond)
+			if search == nil {
+				return nil, false
+			}
+			ids := make([]string, 0, len(search.scores))
+			for id := range search.scores {
+				ids = append(ids, id)
+			}
+			return ids, true
+		}
+		return im.lookupCondition(q.Collection, cond)
+
+	case LogicalCondition:
+		switch cond.Operator {
+		case LogicalAND:
+			// Intentar primero con un índice compuesto sobre las igualdades
+			equalities := make(map[string]interface{})
+			for _, child := range cond.Conditions {
+				if qc, ok := normalizeCondition(child).(QueryCondition); ok && qc.Operator == OperatorEQ {
+					equalities[qc.Field] = qc.Value
+				}
+			}
+			if ids, ok := im.lookupCompound(q.Collection, equalities); ok {
+				return ids, true
+			}
+
+			// Usar la condición indexada más selectiva, incluyendo los rangos
+			// sobre índices ordenados (igualdades en los primeros campos y un rango)
+			best, found := im.lookupRange(q.Collection, conjunctiveConditions(cond))
+			for _, child := range cond.Conditions {
+				if ids, ok := q.planIndexLookup(im, child); ok && (!found || len(ids) < len(best)) {
+					best = ids
+					found = true
+				}
+			}
+			return best, found
+
+		case LogicalOR:
+			// Solo se puede usar un índice si todas las alternativas están indexadas
+			if len(cond.Conditions) == 0 {
+				return nil, false
+			}
+			seen := make(map[string]bool)
+			var ids []string
+			for _, child := range cond.Conditions {
+				childIDs, ok := q.planIndexLookup(im, child)
+				if !ok {
+					return nil, false
+				}
+				for _, id := range childIDs {
+					if !seen[id] {
+						seen[id] = true
+						ids = append(ids, id)
+					}
+				}
+			}
+			return ids, true
+		}
+	}
+
+	return nil, false
+}
+
+// normalizeCondition convierte una condición expresada como mapa (por ejemplo,
+// recibida en JSON) en una QueryCondition o LogicalCondition
+func normalizeCondition(condition interface{}) interface{} {
+	cond, ok := condition.(map[string]interface{})
+	if !ok {
+		return condition
+	}
+
+	// Convertir mapa a QueryCondition
+	if field, ok := cond["field"].(string); ok {
 		if operator, ok := cond["operator"].(string); ok {
-			if conditions, ok := cond["conditions"].([]interface{}); ok {
-				return q.matchesLogicalCondition(data, LogicalCondition{
-					Operator:   LogicalOperator(operator),
-					Conditions: conditions,
-				})
+			return QueryCondition{
+				Field:    field,
+				Operator: QueryOperator(operator),
+				Value:    cond["value"],
+			}
+		}
+	}
+
+	// Verificar si es una condición lógica
+	if operator, ok := cond["operator"].(string); ok {
+		if conditions, ok := cond["conditions"].([]interface{}); ok {
+			return LogicalCondition{
+				Operator:   LogicalOperator(operator),
+				Conditions: conditions,
 			}
 		}
 	}
+
+	return condition
+}
+
+// matchesCondition verifica si un documento coincide con una condición
+func (q *Query) matchesCondition(data map[string]interface{}, condition interface{}) bool {
+	// Verificar tipo de condición
+	switch cond := normalizeCondition(condition).(type) {
+	case nil:
+		// Una consulta sin condición devuelve todos los documentos
+		return true
+	case QueryCondition:
+		return q.matchesQueryCondition(data, cond)
+	case LogicalCondition:
+		return q.matchesLogicalCondition(data, cond)
+	}
 	return false
 }
 
 // matchesQueryCondition verifica si un documento coincide con una condición de consulta
 func (q *Query) matchesQueryCondition(data map[string]interface{}, condition QueryCondition) bool {
+	// Las búsquedas de texto se verifican con el analizador de su índice
+	if condition.Operator == OperatorTEXT {
+		search := q.textSearchFor(condition)
+		return search != nil && search.index.matchesText(data, search.query)
+	}
+
 	// Obtener valor del campo
 	fieldValue, err := getNestedFieldValue(data, condition.Field)
 	if err != nil {
@@ -352,44 +637,174 @@ func (q *Query) matchesLogicalCondition(data map[string]interface{}, condition L
 	return false
 }
 
-// sortDocuments ordena los documentos según las opciones de ordenación
+// sortDocuments ordena los documentos según las opciones de ordenación.
+// Los documentos sin el campo de ordenación se colocan al final.
 func (q *Query) sortDocuments(docs []*Document) []*Document {
-	// Implementar ordenación
-	// Por simplicidad, solo se implementa la ordenación por un campo
-	if len(q.Options.Sort) > 0 {
-		sortOption := q.Options.Sort[0]
-		field := sortOption.Field
-		direction := sortOption.Direction
-
-		// Ordenar documentos
-		for i := 0; i < len(docs)-1; i++ {
-			for j := i + 1; j < len(docs); j++ {
-				// Obtener valores de los campos
-				valueI, errI := getNestedFieldValue(docs[i].Data, field)
-				valueJ, errJ := getNestedFieldValue(docs[j].Data, field)
-
-				// Si algún campo no existe, moverlo al final
-				if errI != nil && errJ == nil {
-					docs[i], docs[j] = docs[j], docs[i]
-					continue
-				}
-				if errI == nil && errJ != nil {
-					continue
-				}
-				if errI != nil && errJ != nil {
-					continue
-				}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return lessBySortOptions(q.Options.Sort, func(k int, field string) (interface{}, error) {
+			return q.sortValue(docs[k], field)
+		}, i, j)
+	})
 
-				// Comparar valores
-				cmp := compareValues(valueI, valueJ)
-				if (direction == SortAscending && cmp > 0) || (direction == SortDescending && cmp < 0) {
-					docs[i], docs[j] = docs[j], docs[i]
-				}
+	return docs
+}
+
+// lessBySortOptions compara los elementos i y j según las opciones de ordenación,
+// obteniendo sus valores con value. Los elementos sin el campo se colocan al final.
+func lessBySortOptions(options []SortOption, value func(k int, field string) (interface{}, error), i, j int) bool {
+	for _, option := range options {
+		valueI, errI := value(i, option.Field)
+		valueJ, errJ := value(j, option.Field)
+
+		// Si algún campo no existe, moverlo al final
+		if errI != nil || errJ != nil {
+			if errI != nil && errJ != nil {
+				continue
 			}
+			return errJ != nil
 		}
+
+		cmp := compareValues(valueI, valueJ)
+		if cmp == 0 {
+			continue
+		}
+		if option.Direction == SortDescending {
+			return cmp > 0
+		}
+		return cmp < 0
 	}
+	return false
+}
 
-	return docs
+// sortValue obtiene el valor de ordenación de un documento. En las búsquedas de
+// texto el campo TextScoreField corresponde a la relevancia del documento, y el
+// campo DocumentIDField corresponde siempre a su ID.
+func (q *Query) sortValue(doc *Document, field string) (interface{}, error) {
+	if field == TextScoreField && q.text != nil {
+		return q.text.scores[doc.ID], nil
+	}
+	if field == DocumentIDField {
+		return doc.ID, nil
+	}
+	return getNestedFieldValue(doc.Data, field)
+}
+
+// Partial devuelve la consulta que ejecuta cada nodo en una consulta distribuida:
+// la misma condición, sin omitir documentos y limitada a Skip+Limit. Todos los
+// nodos ordenan igual, desempatando por ID, para que la fusión de los resultados
+// parciales pueda aplicar la paginación.
+func (q *Query) Partial() *Query {
+	partial := &Query{
+		Collection: q.Collection,
+		Condition:  q.Condition,
+		Options: QueryOptions{
+			Sort: q.mergeSort(),
+		},
+	}
+	if q.Options.Limit > 0 {
+		partial.Options.Limit = max(q.Options.Skip, 0) + q.Options.Limit
+	}
+	return partial
+}
+
+// mergeSort devuelve la ordenación con la que se fusionan los resultados de una
+// consulta distribuida: la de la consulta, o por relevancia en las búsquedas de
+// texto sin ordenación explícita, y después por ID
+func (q *Query) mergeSort() []SortOption {
+	options := append([]SortOption(nil), q.Options.Sort...)
+	if len(options) == 0 {
+		var textConditions []QueryCondition
+		collectTextConditions(q.Condition, &textConditions)
+		if len(textConditions) > 0 {
+			options = append(options, SortOption{Field: TextScoreField, Direction: SortDescending})
+		}
+	}
+	return append(options, SortOption{Field: DocumentIDField, Direction: SortAscending})
+}
+
+// MergeResults fusiona los resultados parciales de la consulta en varios nodos,
+// incluido el de database, el nodo que la ejecuta. De cada documento repetido se
+// conserva la versión más reciente, y se descartan los que database ha eliminado
+// o tiene en una versión posterior: esa versión no cumple la consulta o queda
+// fuera de la página. El resultado se ordena como en Partial y después se
+// aplican Skip y Limit.
+func (q *Query) MergeResults(database *Database, partials ...[]*Document) []*Document {
+	merged := make(map[string]*Document)
+	for _, docs := range partials {
+		for _, doc := range docs {
+			if current, exists := merged[doc.ID]; !exists || newerVersion(doc, current) {
+				merged[doc.ID] = doc
+			}
+		}
+	}
+
+	// Un nodo que va por detrás puede devolver una versión que ya no es la vigente
+	if database != nil {
+		database.mutex.RLock()
+		for id, doc := range merged {
+			if database.supersedesLocked(doc) {
+				delete(merged, id)
+			}
+		}
+		database.mutex.RUnlock()
+	}
+
+	results := make([]*Document, 0, len(merged))
+	for _, doc := range merged {
+		results = append(results, doc)
+	}
+
+	// La relevancia de cada documento la calculó el nodo que lo devolvió
+	var textConditions []QueryCondition
+	collectTextConditions(q.Condition, &textConditions)
+	text := len(textConditions) > 0
+
+	options := q.mergeSort()
+	sort.Slice(results, func(i, j int) bool {
+		return lessBySortOptions(options, func(k int, field string) (interface{}, error) {
+			switch {
+			case field == TextScoreField && text:
+				return results[k].Score, nil
+			case field == DocumentIDField:
+				return results[k].ID, nil
+			}
+			return getNestedFieldValue(results[k].Data, field)
+		}, i, j)
+	})
+
+	// Aplicar paginación
+	if q.Options.Skip > 0 {
+		results = results[min(q.Options.Skip, len(results)):]
+	}
+	if q.Options.Limit > 0 && q.Options.Limit < len(results) {
+		results = results[:q.Options.Limit]
+	}
+
+	return results
+}
+
+// newerVersion indica si a es una versión de un documento más reciente que b.
+// Se compara la marca de la última escritura, porque cada nodo numera sus
+// propias revisiones.
+func newerVersion(a, b *Document) bool {
+	if c := documentClock(a).Compare(documentClock(b)); c != 0 {
+		return c > 0
+	}
+	if a.Revision != b.Revision {
+		return a.Revision > b.Revision
+	}
+	return a.UpdatedAt.After(b.UpdatedAt)
+}
+
+// supersedesLocked indica si el nodo tiene una versión posterior de un documento
+// recibido de otro nodo o una eliminación posterior a él. Debe llamarse con el
+// mutex de la base de datos bloqueado.
+func (db *Database) supersedesLocked(doc *Document) bool {
+	if tombstone, exists := db.tombstones[doc.ID]; exists && documentClock(doc).Compare(tombstone.Deleted) <= 0 {
+		return true
+	}
+	local, exists := db.documents[doc.ID]
+	return exists && documentClock(local).Compare(documentClock(doc)) > 0
 }
 
 // getNestedFieldValue obtiene el valor de un campo, soportando notación de punto para campos anidados
@@ -435,60 +850,11 @@ func getNestedFieldValue(data map[string]interface{}, field string) (interface{}
 	return nil, fmt.Errorf("campo no encontrado: %s", field)
 }
 
-// compareValues compara dos valores
+// compareValues compara dos valores. Los números se comparan por su valor
+// aunque sean de tipos distintos; valores de clases distintas se ordenan por clase
+// igual que en los índices ordenados.
 func compareValues(a, b interface{}) int {
-	// Si los tipos son diferentes, convertir a string
-	if reflect.TypeOf(a) != reflect.TypeOf(b) {
-		aStr := fmt.Sprintf("%v", a)
-		bStr := fmt.Sprintf("%v", b)
-		return strings.Compare(aStr, bStr)
-	}
-
-	// Comparar según el tipo
-	switch a := a.(type) {
-	case string:
-		return strings.Compare(a, b.(string))
-	case int:
-		if a < b.(int) {
-			return -1
-		} else if a > b.(int) {
-			return 1
-		}
-		return 0
-	case int64:
-		if a < b.(int64) {
-			return -1
-		} else if a > b.(int64) {
-			return 1
-		}
-		return 0
-	case float64:
-		if a < b.(float64) {
-			return -1
-		} else if a > b.(float64) {
-			return 1
-		}
-		return 0
-	case bool:
-		if !a && b.(bool) {
-			return -1
-		} else if a && !b.(bool) {
-			return 1
-		}
-		return 0
-	case time.Time:
-		if a.Before(b.(time.Time)) {
-			return -1
-		} else if a.After(b.(time.Time)) {
-			return 1
-		}
-		return 0
-	}
-
-	// Para otros tipos, convertir a string
-	aStr := fmt.Sprintf("%v", a)
-	bStr := fmt.Sprintf("%v", b)
-	return strings.Compare(aStr, bStr)
+	return compareOrderedValues(newOrderedValue(a), newOrderedValue(b))
 }
 
 // getTypeName obtiene el nombre del tipo de un valor
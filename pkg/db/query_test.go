@@ -0,0 +1,131 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSortedQueryWithWiderIndex comprueba que una consulta ordenada no pierda los
+// documentos que faltan en un índice compuesto con más campos que la ordenación
+func TestSortedQueryWithWiderIndex(t *testing.T) {
+	database := NewDatabase()
+	for i := 1; i <= 10; i++ {
+		data := map[string]interface{}{"a": i}
+		if i%2 == 0 {
+			data["b"] = i * 10
+		}
+		if _, err := database.CreateDocument("items", data); err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+	}
+	if _, err := database.CreateIndex("items_a_b", "items", []string{"a", "b"}, IndexTypeOrdered); err != nil {
+		t.Fatalf("error al crear índice: %v", err)
+	}
+
+	docs, err := NewQuery("items").Sort("a", SortAscending).Limit(5).Execute(database)
+	if err != nil {
+		t.Fatalf("error al ejecutar consulta: %v", err)
+	}
+
+	if len(docs) != 5 {
+		t.Fatalf("%d documentos, se esperaban 5", len(docs))
+	}
+	for i, doc := range docs {
+		if got := compareValues(doc.Data["a"], i+1); got != 0 {
+			t.Errorf("posición %d: a = %v, se esperaba %d", i, doc.Data["a"], i+1)
+		}
+	}
+}
+
+// TestSortedQueryWithMatchingIndex comprueba que una consulta ordenada con un
+// índice de los mismos campos devuelva la misma página que sin índice
+func TestSortedQueryWithMatchingIndex(t *testing.T) {
+	database := NewDatabase()
+	for i := 1; i <= 20; i++ {
+		data := map[string]interface{}{"group": i % 2, "n": (i * 7) % 20}
+		if _, err := database.CreateDocument("items", data); err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+	}
+
+	query := func() *Query {
+		return NewQuery("items").Where("group", OperatorEQ, 1).Sort("n", SortDescending).Skip(2).Limit(4)
+	}
+	scanned, err := query().Execute(database)
+	if err != nil {
+		t.Fatalf("error al ejecutar consulta: %v", err)
+	}
+
+	if _, err := database.CreateIndex("items_group_n", "items", []string{"group", "n"}, IndexTypeOrdered); err != nil {
+		t.Fatalf("error al crear índice: %v", err)
+	}
+	indexed, err := query().Execute(database)
+	if err != nil {
+		t.Fatalf("error al ejecutar consulta: %v", err)
+	}
+
+	if len(indexed) != len(scanned) {
+		t.Fatalf("%d documentos con índice, %d sin él", len(indexed), len(scanned))
+	}
+	for i := range scanned {
+		if indexed[i].ID != scanned[i].ID {
+			t.Errorf("posición %d: %s con índice, %s sin él", i, indexed[i].ID, scanned[i].ID)
+		}
+	}
+}
+
+// TestMergeResultsDiscardsStale comprueba que una consulta distribuida no
+// devuelva la versión de un nodo atrasado de un documento que el nodo local ha
+// eliminado o cambiado para que ya no cumpla la consulta
+func TestMergeResultsDiscardsStale(t *testing.T) {
+	local := NewDatabase()
+	local.SetNodeID("local")
+	remote := NewDatabase()
+	remote.SetNodeID("remote")
+
+	// El nodo atrasado conserva las versiones anteriores
+	var lagging []*Document
+	for _, id := range []string{"updated", "deleted", "kept"} {
+		doc, err := local.CreateDocument("items", map[string]interface{}{"name": id, "status": "open"})
+		if err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+		lagging = append(lagging, wireCopy(t, doc))
+	}
+	updated, deleted := lagging[0].ID, lagging[1].ID
+	if _, err := local.UpdateDocument(updated, map[string]interface{}{"status": "closed"}); err != nil {
+		t.Fatalf("error al actualizar: %v", err)
+	}
+	if err := local.DeleteDocument(deleted); err != nil {
+		t.Fatalf("error al eliminar: %v", err)
+	}
+
+	// Un documento que solo tiene el otro nodo y otro que tiene en una versión
+	// posterior a la local
+	only, _ := remote.CreateDocument("items", map[string]interface{}{"name": "remote", "status": "open"})
+	newer := wireCopy(t, lagging[2])
+	if _, err := remote.ApplyRemoteDocument(newer); err != nil {
+		t.Fatalf("error al replicar: %v", err)
+	}
+	newer, err := remote.UpdateDocument(newer.ID, map[string]interface{}{"name": "kept-remote"})
+	if err != nil {
+		t.Fatalf("error al actualizar: %v", err)
+	}
+
+	query := NewQuery("items").Where("status", OperatorEQ, "open").Sort("name", SortAscending)
+	partial := query.Partial()
+	localDocs, err := partial.Execute(local)
+	if err != nil {
+		t.Fatalf("error al ejecutar consulta: %v", err)
+	}
+	remoteDocs := append(lagging, wireCopy(t, only), wireCopy(t, newer))
+
+	var names []interface{}
+	for _, doc := range query.MergeResults(local, localDocs, remoteDocs) {
+		names = append(names, doc.Data["name"])
+	}
+	want := []interface{}{"kept-remote", "remote"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("resultado %v, se esperaba %v", names, want)
+	}
+}
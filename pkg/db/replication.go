@@ -0,0 +1,174 @@
+package db
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// collectionTopicPrefix prefijo de los temas de sincronización de cada colección
+const collectionTopicPrefix = "db-sync/"
+
+// CollectionTopic devuelve el tema de sincronización de una colección
+func CollectionTopic(collection string) string {
+	return collectionTopicPrefix + collection
+}
+
+// ReplicationPolicy decide qué colecciones y documentos replica el nodo. Es local
+// a cada nodo: un nodo de borde puede recibir solo las colecciones que usa.
+type ReplicationPolicy struct {
+	Publish    []string               `json:"publish,omitempty"`    // Colecciones que el nodo envía; vacío para todas
+	Subscribe  []string               `json:"subscribe,omitempty"`  // Colecciones que el nodo recibe; vacío para todas
+	Excluded   []string               `json:"excluded,omitempty"`   // Colecciones que nunca salen del nodo ni se reciben
+	Priorities []string               `json:"priorities,omitempty"` // Colecciones que se sincronizan primero
+	Filters    map[string]interface{} `json:"filters,omitempty"`    // Condición, en el formato de Query, de los documentos replicados de cada colección
+}
+
+// Validate comprueba que los filtros sean condiciones de consulta válidas
+func (p ReplicationPolicy) Validate() error {
+	for collection, filter := range p.Filters {
+		if err := validateFilter(filter); err != nil {
+			return fmt.Errorf("filtro de replicación no válido para %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// validateFilter comprueba una condición de filtro. Las búsquedas de texto no se
+// admiten porque dependen de los índices de cada nodo.
+func validateFilter(condition interface{}) error {
+	switch cond := normalizeCondition(condition).(type) {
+	case QueryCondition:
+		if cond.Field == "" {
+			return fmt.Errorf("condición sin campo")
+		}
+		switch cond.Operator {
+		case OperatorEQ, OperatorNE, OperatorGT, OperatorGTE, OperatorLT, OperatorLTE,
+			OperatorTYPE, OperatorCONTAINS, OperatorSTARTSWITH, OperatorENDSWITH:
+		case OperatorIN, OperatorNIN:
+			if _, ok := cond.Value.([]interface{}); !ok {
+				return fmt.Errorf("el operador %s requiere una lista", cond.Operator)
+			}
+		case OperatorEXISTS:
+			if _, ok := cond.Value.(bool); !ok {
+				return fmt.Errorf("el operador %s requiere un booleano", cond.Operator)
+			}
+		case OperatorREGEX:
+			pattern, ok := cond.Value.(string)
+			if !ok {
+				return fmt.Errorf("el operador %s requiere una cadena", cond.Operator)
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("expresión regular no válida: %v", err)
+			}
+		default:
+			return fmt.Errorf("operador no admitido: %s", cond.Operator)
+		}
+	case LogicalCondition:
+		switch cond.Operator {
+		case LogicalAND, LogicalOR, LogicalNOT:
+		default:
+			return fmt.Errorf("operador lógico no admitido: %s", cond.Operator)
+		}
+		if len(cond.Conditions) == 0 {
+			return fmt.Errorf("condición %s sin condiciones", cond.Operator)
+		}
+		for _, sub := range cond.Conditions {
+			if err := validateFilter(sub); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("condición no reconocida")
+	}
+	return nil
+}
+
+// Excludes indica si una colección está excluida de la replicación
+func (p ReplicationPolicy) Excludes(collection string) bool {
+	return slices.Contains(p.Excluded, collection)
+}
+
+// Publishes indica si el nodo envía los documentos de una colección
+func (p ReplicationPolicy) Publishes(collection string) bool {
+	return !p.Excludes(collection) && (len(p.Publish) == 0 || slices.Contains(p.Publish, collection))
+}
+
+// Subscribes indica si el nodo recibe los documentos de una colección
+func (p ReplicationPolicy) Subscribes(collection string) bool {
+	return !p.Excludes(collection) && (len(p.Subscribe) == 0 || slices.Contains(p.Subscribe, collection))
+}
+
+// Filtered indica si solo se replica parte de una colección
+func (p ReplicationPolicy) Filtered(collection string) bool {
+	return p.Filters[collection] != nil
+}
+
+// Matches indica si un documento cumple el filtro de su colección
+func (p ReplicationPolicy) Matches(doc *Document) bool {
+	filter := p.Filters[doc.Collection]
+	if filter == nil {
+		return true
+	}
+	q := &Query{Collection: doc.Collection, Condition: filter}
+	return q.matchesCondition(doc.Data, filter)
+}
+
+// ShouldPublish indica si el nodo envía un documento a la red
+func (p ReplicationPolicy) ShouldPublish(doc *Document) bool {
+	return p.Publishes(doc.Collection) && p.Matches(doc)
+}
+
+// Accepts indica si el nodo aplica un documento recibido de la red
+func (p ReplicationPolicy) Accepts(doc *Document) bool {
+	return p.Subscribes(doc.Collection) && p.Matches(doc)
+}
+
+// CompareCollections ordena las colecciones por prioridad y después por nombre
+func (p ReplicationPolicy) CompareCollections(a, b string) int {
+	rank := func(collection string) int {
+		if i := slices.Index(p.Priorities, collection); i >= 0 {
+			return i
+		}
+		return len(p.Priorities)
+	}
+	if c := rank(a) - rank(b); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// clone devuelve una copia de la política
+func (p ReplicationPolicy) clone() ReplicationPolicy {
+	return ReplicationPolicy{
+		Publish:    slices.Clone(p.Publish),
+		Subscribe:  slices.Clone(p.Subscribe),
+		Excluded:   slices.Clone(p.Excluded),
+		Priorities: slices.Clone(p.Priorities),
+		Filters:    maps.Clone(p.Filters),
+	}
+}
+
+// SetReplicationPolicy establece qué colecciones y documentos replica el nodo.
+// Los temas de sincronización se eligen al iniciarla, así que debe establecerse antes.
+func (db *Database) SetReplicationPolicy(policy ReplicationPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.replication = policy.clone()
+	return nil
+}
+
+// ReplicationPolicy devuelve la política de replicación del nodo
+func (db *Database) ReplicationPolicy() ReplicationPolicy {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.replication.clone()
+}
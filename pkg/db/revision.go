@@ -0,0 +1,59 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRevisionConflict indica que la revisión de un documento no es la esperada
+var ErrRevisionConflict = errors.New("conflicto de revisión")
+
+// RevisionConflictError describe un conflicto de revisión en una escritura condicional
+type RevisionConflictError struct {
+	ID       string // ID del documento
+	Expected uint64 // Revisión esperada por quien escribe
+	Current  uint64 // Revisión actual del documento
+}
+
+// Error implementa la interfaz error
+func (e *RevisionConflictError) Error() string {
+	return fmt.Sprintf("%v: documento %s en revisión %d, se esperaba %d", ErrRevisionConflict, e.ID, e.Current, e.Expected)
+}
+
+// Is permite comparar el error con ErrRevisionConflict mediante errors.Is
+func (e *RevisionConflictError) Is(target error) bool {
+	return target == ErrRevisionConflict
+}
+
+// WriteOption configura una escritura sobre un documento existente
+type WriteOption func(*writeOptions)
+
+// writeOptions opciones de una escritura
+type writeOptions struct {
+	expectedRevision *uint64
+}
+
+// IfRevision hace que la escritura solo se aplique si el documento está en la
+// revisión indicada; en caso contrario falla con un RevisionConflictError
+func IfRevision(revision uint64) WriteOption {
+	return func(o *writeOptions) {
+		o.expectedRevision = &revision
+	}
+}
+
+// newWriteOptions aplica las opciones de una escritura
+func newWriteOptions(options []WriteOption) writeOptions {
+	var opts writeOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	return opts
+}
+
+// checkRevision verifica la revisión esperada del documento, si se indicó alguna
+func (o writeOptions) checkRevision(doc *Document) error {
+	if o.expectedRevision != nil && *o.expectedRevision != doc.Revision {
+		return &RevisionConflictError{ID: doc.ID, Expected: *o.expectedRevision, Current: doc.Revision}
+	}
+	return nil
+}
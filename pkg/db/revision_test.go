@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// checkConflict comprueba que una escritura falló por la revisión indicada
+func checkConflict(t *testing.T, err error, expected, current uint64) {
+	t.Helper()
+	var conflict *RevisionConflictError
+	if !errors.Is(err, ErrRevisionConflict) || !errors.As(err, &conflict) {
+		t.Fatalf("error = %v, se esperaba %v", err, ErrRevisionConflict)
+	}
+	if conflict.Expected != expected || conflict.Current != current {
+		t.Errorf("conflicto = %+v, se esperaba la revisión %d en lugar de %d", conflict, current, expected)
+	}
+}
+
+func TestIfRevisionMismatch(t *testing.T) {
+	database := NewDatabase()
+	doc, err := database.CreateDocument("notas", map[string]any{"texto": "hola", "n": 1})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	if doc.Revision != 1 {
+		t.Fatalf("revisión inicial = %d, se esperaba 1", doc.Revision)
+	}
+
+	updated, err := database.UpdateDocument(doc.ID, map[string]any{"texto": "adiós"}, IfRevision(1))
+	if err != nil {
+		t.Fatalf("error al actualizar en la revisión esperada: %v", err)
+	}
+	if updated.Revision != 2 {
+		t.Errorf("revisión = %d, se esperaba 2", updated.Revision)
+	}
+
+	// Quien sigue con la revisión 1 no sobrescribe el cambio
+	_, err = database.UpdateDocument(doc.ID, map[string]any{"texto": "otro"}, IfRevision(1))
+	checkConflict(t, err, 1, 2)
+	_, err = database.ApplyUpdate(doc.ID, Update{}.Inc("n", 1), IfRevision(1))
+	checkConflict(t, err, 1, 2)
+	err = database.DeleteDocument(doc.ID, IfRevision(1))
+	checkConflict(t, err, 1, 2)
+
+	current, err := database.GetDocument(doc.ID)
+	if err != nil {
+		t.Fatalf("un borrado con revisión antigua eliminó el documento: %v", err)
+	}
+	if current.Revision != 2 || current.Data["texto"] != "adiós" || current.Data["n"] != 1 {
+		t.Errorf("las escrituras con revisión antigua cambiaron el documento: %+v", current)
+	}
+
+	if err := database.DeleteDocument(doc.ID, IfRevision(2)); err != nil {
+		t.Fatalf("error al eliminar en la revisión esperada: %v", err)
+	}
+	if _, err := database.GetDocument(doc.ID); err == nil {
+		t.Errorf("el documento sigue existiendo")
+	}
+}
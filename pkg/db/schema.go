@@ -0,0 +1,461 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tipos de JSON Schema soportados
+const (
+	SchemaTypeObject  = "object"
+	SchemaTypeArray   = "array"
+	SchemaTypeString  = "string"
+	SchemaTypeNumber  = "number"
+	SchemaTypeInteger = "integer"
+	SchemaTypeBoolean = "boolean"
+	SchemaTypeNull    = "null"
+)
+
+// ErrSchemaValidation indica que un documento no cumple el esquema de su colección
+var ErrSchemaValidation = errors.New("el documento no cumple el esquema de la colección")
+
+// Schema representa un JSON Schema (subconjunto del draft 2020-12): tipos,
+// required, enum, límites numéricos y de longitud, pattern, y objetos y listas anidados
+type Schema struct {
+	SchemaURI            string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 SchemaTypes        `json:"type,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     *float64           `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp // Expresión compilada de Pattern
+}
+
+// SchemaTypes representa el campo "type", que admite un tipo o una lista de tipos
+type SchemaTypes []string
+
+// UnmarshalJSON admite tanto "string" como ["string", "null"]
+func (t *SchemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = SchemaTypes{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type debe ser una cadena o una lista de cadenas")
+	}
+	*t = list
+	return nil
+}
+
+// MarshalJSON escribe un único tipo como cadena
+func (t SchemaTypes) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+// ValidationError describe un fallo de validación en un campo del documento
+type ValidationError struct {
+	Path    string `json:"path"` // Ruta del campo con notación de punto, p. ej. direccion.ciudad o etiquetas[0]
+	Message string `json:"message"`
+}
+
+// SchemaValidationError agrupa los fallos de validación de un documento
+type SchemaValidationError struct {
+	Collection string            `json:"collection"`
+	Errors     []ValidationError `json:"errors"`
+}
+
+// Error implementa la interfaz error
+func (e *SchemaValidationError) Error() string {
+	parts := make([]string, len(e.Errors))
+	for i, failure := range e.Errors {
+		parts[i] = fmt.Sprintf("%s: %s", displayPath(failure.Path), failure.Message)
+	}
+	return fmt.Sprintf("%v %s: %s", ErrSchemaValidation, e.Collection, strings.Join(parts, "; "))
+}
+
+// Is permite comparar el error con ErrSchemaValidation mediante errors.Is
+func (e *SchemaValidationError) Is(target error) bool {
+	return target == ErrSchemaValidation
+}
+
+// ValidationReport es el resultado de validar los documentos existentes de una colección
+type ValidationReport struct {
+	Collection string               `json:"collection"`
+	Checked    int                  `json:"checked"`
+	Valid      int                  `json:"valid"`
+	Invalid    []DocumentValidation `json:"invalid"`
+}
+
+// DocumentValidation describe los fallos de validación de un documento existente
+type DocumentValidation struct {
+	ID     string            `json:"id"`
+	Errors []ValidationError `json:"errors"`
+}
+
+// Compile verifica el esquema y prepara sus expresiones regulares
+func (s *Schema) Compile() error {
+	return s.compile("")
+}
+
+// compile verifica recursivamente un esquema
+func (s *Schema) compile(path string) error {
+	for _, t := range s.Type {
+		switch t {
+		case SchemaTypeObject, SchemaTypeArray, SchemaTypeString, SchemaTypeNumber,
+			SchemaTypeInteger, SchemaTypeBoolean, SchemaTypeNull:
+		default:
+			return fmt.Errorf("tipo no soportado en %s: %s", displayPath(path), t)
+		}
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern no válido en %s: %v", displayPath(path), err)
+		}
+		s.pattern = pattern
+	}
+
+	for name, property := range s.Properties {
+		if property == nil {
+			return fmt.Errorf("esquema vacío en %s", displayPath(joinSchemaPath(path, name)))
+		}
+		if err := property.compile(joinSchemaPath(path, name)); err != nil {
+			return err
+		}
+	}
+
+	if s.Items != nil {
+		if err := s.Items.compile(path + "[]"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate valida unos datos y devuelve los fallos ordenados por ruta
+func (s *Schema) Validate(data map[string]any) []ValidationError {
+	var failures []ValidationError
+	s.validate("", data, &failures)
+
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].Path < failures[j].Path
+	})
+	return failures
+}
+
+// validate valida recursivamente un valor
+func (s *Schema) validate(path string, value any, failures *[]ValidationError) {
+	fail := func(format string, args ...any) {
+		*failures = append(*failures, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.Type) > 0 && !s.matchesType(value) {
+		fail("se esperaba %s y se obtuvo %s", strings.Join(s.Type, " o "), jsonTypeOf(value))
+		return
+	}
+
+	if len(s.Enum) > 0 && !containsValue(s.Enum, value) {
+		fail("el valor no está entre los permitidos")
+	}
+
+	if number, ok := schemaNumber(value); ok {
+		if s.Minimum != nil && number < *s.Minimum {
+			fail("debe ser mayor o igual que %v", *s.Minimum)
+		}
+		if s.Maximum != nil && number > *s.Maximum {
+			fail("debe ser menor o igual que %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && number <= *s.ExclusiveMinimum {
+			fail("debe ser mayor que %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && number >= *s.ExclusiveMaximum {
+			fail("debe ser menor que %v", *s.ExclusiveMaximum)
+		}
+	}
+
+	if str, ok := value.(string); ok {
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("debe tener al menos %d caracteres", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("debe tener como máximo %d caracteres", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			fail("no cumple el patrón %s", s.Pattern)
+		}
+	}
+
+	if object, ok := value.(map[string]any); ok {
+		for _, name := range s.Required {
+			if _, exists := object[name]; !exists {
+				*failures = append(*failures, ValidationError{Path: joinSchemaPath(path, name), Message: "campo obligatorio"})
+			}
+		}
+		for name, field := range object {
+			if property, exists := s.Properties[name]; exists {
+				property.validate(joinSchemaPath(path, name), field, failures)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*failures = append(*failures, ValidationError{Path: joinSchemaPath(path, name), Message: "campo no permitido"})
+			}
+		}
+	}
+
+	if list, ok := schemaList(value); ok {
+		if s.MinItems != nil && len(list) < *s.MinItems {
+			fail("debe tener al menos %d elementos", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(list) > *s.MaxItems {
+			fail("debe tener como máximo %d elementos", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range list {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, failures)
+			}
+		}
+	}
+}
+
+// matchesType indica si un valor es de alguno de los tipos del esquema
+func (s *Schema) matchesType(value any) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range s.Type {
+		if t == actual {
+			return true
+		}
+		if t == SchemaTypeNumber && actual == SchemaTypeInteger {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeOf devuelve el tipo JSON de un valor
+func jsonTypeOf(value any) string {
+	if value == nil {
+		return SchemaTypeNull
+	}
+	if number, ok := schemaNumber(value); ok {
+		if number == math.Trunc(number) && !math.IsInf(number, 0) {
+			return SchemaTypeInteger
+		}
+		return SchemaTypeNumber
+	}
+
+	switch value.(type) {
+	case string:
+		return SchemaTypeString
+	case bool:
+		return SchemaTypeBoolean
+	case map[string]any:
+		return SchemaTypeObject
+	}
+	if _, ok := schemaList(value); ok {
+		return SchemaTypeArray
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// schemaNumber obtiene el valor de un número de cualquier tipo numérico
+func schemaNumber(value any) (float64, bool) {
+	ordered := newOrderedValue(value)
+	return ordered.num, ordered.kind == orderedKindNumber
+}
+
+// schemaList obtiene los elementos de una lista de cualquier tipo de slice
+func schemaList(value any) ([]any, bool) {
+	if list, ok := value.([]any); ok {
+		return list, true
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	list := make([]any, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+	return list, true
+}
+
+// containsValue indica si un valor está en una lista, comparando los números por su valor
+func containsValue(values []any, value any) bool {
+	number, isNumber := schemaNumber(value)
+	for _, candidate := range values {
+		if isNumber {
+			if other, ok := schemaNumber(candidate); ok && other == number {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinSchemaPath añade un campo a una ruta
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// displayPath devuelve la ruta para los mensajes, indicando la raíz del documento
+func displayPath(path string) string {
+	if path == "" {
+		return "(raíz)"
+	}
+	return path
+}
+
+// SetSchema asigna el esquema de una colección. Los documentos que se creen o
+// actualicen a partir de ahora deben cumplirlo; los existentes no se validan
+// (ver ValidateCollection). Los documentos replicados desde otros nodos no se
+// validan, porque ya se confirmaron en su origen.
+func (db *Database) SetSchema(collection string, schema *Schema) error {
+	if schema == nil {
+		return db.DeleteSchema(collection)
+	}
+	if err := schema.Compile(); err != nil {
+		return fmt.Errorf("esquema no válido: %v", err)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.persistenceEnabled {
+		if err := db.persistence.SaveSchema(collection, schema); err != nil {
+			return fmt.Errorf("error al persistir esquema: %v", err)
+		}
+	}
+
+	if db.schemas == nil {
+		db.schemas = make(map[string]*Schema)
+	}
+	db.schemas[collection] = schema
+	return nil
+}
+
+// GetSchema obtiene el esquema de una colección
+func (db *Database) GetSchema(collection string) (*Schema, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	schema, exists := db.schemas[collection]
+	return schema, exists
+}
+
+// DeleteSchema elimina el esquema de una colección
+func (db *Database) DeleteSchema(collection string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.persistenceEnabled {
+		if err := db.persistence.DeleteSchema(collection); err != nil {
+			return fmt.Errorf("error al eliminar esquema: %v", err)
+		}
+	}
+
+	delete(db.schemas, collection)
+	return nil
+}
+
+// ValidateCollection valida los documentos existentes de una colección con un
+// esquema sin modificarlos. Si schema es nil se usa el esquema de la colección.
+func (db *Database) ValidateCollection(collection string, schema *Schema) (*ValidationReport, error) {
+	if schema != nil {
+		if err := schema.Compile(); err != nil {
+			return nil, fmt.Errorf("esquema no válido: %v", err)
+		}
+	}
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if schema == nil {
+		var exists bool
+		if schema, exists = db.schemas[collection]; !exists {
+			return nil, fmt.Errorf("la colección %s no tiene esquema", collection)
+		}
+	}
+
+	report := &ValidationReport{Collection: collection, Invalid: []DocumentValidation{}}
+	for _, doc := range db.collectionDocumentsLocked(collection) {
+		report.Checked++
+		if failures := schema.Validate(doc.Data); len(failures) > 0 {
+			report.Invalid = append(report.Invalid, DocumentValidation{ID: doc.ID, Errors: failures})
+		} else {
+			report.Valid++
+		}
+	}
+
+	sort.Slice(report.Invalid, func(i, j int) bool {
+		return report.Invalid[i].ID < report.Invalid[j].ID
+	})
+	return report, nil
+}
+
+// validateDocumentLocked valida un documento con el esquema de su colección.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) validateDocumentLocked(doc *Document) error {
+	schema, exists := db.schemas[doc.Collection]
+	if !exists {
+		return nil
+	}
+
+	if failures := schema.Validate(doc.Data); len(failures) > 0 {
+		return &SchemaValidationError{Collection: doc.Collection, Errors: failures}
+	}
+	return nil
+}
+
+// loadSchemas carga los esquemas persistidos de las colecciones
+func (db *Database) loadSchemas() error {
+	schemas, err := db.persistence.LoadSchemas()
+	if err != nil {
+		return err
+	}
+
+	for collection, schema := range schemas {
+		if err := schema.Compile(); err != nil {
+			return fmt.Errorf("esquema no válido en la colección %s: %v", collection, err)
+		}
+	}
+
+	db.mutex.Lock()
+	db.schemas = schemas
+	db.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+// clientesSchema es el esquema de la colección de las pruebas
+const clientesSchema = `{
+	"type": "object",
+	"required": ["nombre", "direccion"],
+	"additionalProperties": false,
+	"properties": {
+		"nombre": {"type": "string", "minLength": 2},
+		"edad": {"type": "integer", "minimum": 18},
+		"estado": {"enum": ["activo", "baja"]},
+		"direccion": {
+			"type": "object",
+			"required": ["ciudad"],
+			"properties": {
+				"ciudad": {"type": "string"},
+				"cp": {"type": "string", "pattern": "^[0-9]{5}$"}
+			}
+		},
+		"etiquetas": {"type": "array", "maxItems": 3, "items": {"type": "string"}}
+	}
+}`
+
+// newSchema deserializa un esquema como lo recibiría la API
+func newSchema(t *testing.T, text string) *Schema {
+	t.Helper()
+	var schema Schema
+	if err := json.Unmarshal([]byte(text), &schema); err != nil {
+		t.Fatalf("error al deserializar esquema: %v", err)
+	}
+	return &schema
+}
+
+// validationPaths devuelve las rutas de los fallos de validación
+func validationPaths(failures []ValidationError) []string {
+	paths := make([]string, len(failures))
+	for i, failure := range failures {
+		paths[i] = failure.Path
+	}
+	return paths
+}
+
+// invalidCliente tiene un fallo en cada nivel del esquema
+func invalidCliente() map[string]any {
+	return map[string]any{
+		"nombre":    "ana",
+		"edad":      16,
+		"estado":    "pendiente",
+		"direccion": map[string]any{"cp": "28A01"},
+		"etiquetas": []any{"vip", 7},
+		"extra":     true,
+	}
+}
+
+// invalidClientePaths son las rutas de los fallos de invalidCliente
+var invalidClientePaths = []string{"direccion.ciudad", "direccion.cp", "edad", "estado", "etiquetas[1]", "extra"}
+
+func TestSchemaRejectsWritesWithNestedPaths(t *testing.T) {
+	database := NewDatabase()
+	if err := database.SetSchema("clientes", newSchema(t, clientesSchema)); err != nil {
+		t.Fatalf("error al asignar esquema: %v", err)
+	}
+
+	_, err := database.CreateDocument("clientes", invalidCliente())
+	var validation *SchemaValidationError
+	if !errors.Is(err, ErrSchemaValidation) || !errors.As(err, &validation) {
+		t.Fatalf("error = %v, se esperaba %v", err, ErrSchemaValidation)
+	}
+	if paths := validationPaths(validation.Errors); !slices.Equal(paths, invalidClientePaths) {
+		t.Errorf("rutas = %v, se esperaban %v", paths, invalidClientePaths)
+	}
+	if docs, _ := database.GetAllDocuments("clientes"); len(docs) != 0 {
+		t.Errorf("se guardó un documento que no cumple el esquema")
+	}
+
+	doc, err := database.CreateDocument("clientes", map[string]any{
+		"nombre":    "ana",
+		"direccion": map[string]any{"ciudad": "Madrid", "cp": "28001"},
+	})
+	if err != nil {
+		t.Fatalf("error al crear un documento válido: %v", err)
+	}
+
+	// Las actualizaciones se validan sobre el documento resultante
+	_, err = database.ApplyUpdate(doc.ID, Update{}.Unset("direccion.ciudad").Push("etiquetas", 1))
+	if !errors.As(err, &validation) {
+		t.Fatalf("error = %v, se esperaba %v", err, ErrSchemaValidation)
+	}
+	if paths := validationPaths(validation.Errors); !slices.Equal(paths, []string{"direccion.ciudad", "etiquetas[0]"}) {
+		t.Errorf("rutas = %v, se esperaban [direccion.ciudad etiquetas[0]]", paths)
+	}
+	current, err := database.GetDocument(doc.ID)
+	if err != nil || current.Revision != doc.Revision {
+		t.Errorf("una actualización rechazada cambió el documento: %v, %v", current, err)
+	}
+}
+
+func TestValidateCollectionReport(t *testing.T) {
+	database := NewDatabase()
+	if _, err := database.CreateDocument("clientes", map[string]any{
+		"nombre":    "luis",
+		"direccion": map[string]any{"ciudad": "Sevilla"},
+	}); err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	var invalid []string
+	for range 2 {
+		doc, err := database.CreateDocument("clientes", invalidCliente())
+		if err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+		invalid = append(invalid, doc.ID)
+	}
+	slices.Sort(invalid)
+
+	if _, err := database.ValidateCollection("clientes", nil); err == nil {
+		t.Errorf("se validó una colección sin esquema")
+	}
+
+	// El informe con un esquema propuesto no lo asigna ni modifica los documentos
+	report, err := database.ValidateCollection("clientes", newSchema(t, clientesSchema))
+	if err != nil {
+		t.Fatalf("error al validar la colección: %v", err)
+	}
+	if report.Collection != "clientes" || report.Checked != 3 || report.Valid != 1 || len(report.Invalid) != 2 {
+		t.Fatalf("informe = %+v, se esperaban 3 documentos, 1 válido y 2 no válidos", report)
+	}
+	for i, result := range report.Invalid {
+		if result.ID != invalid[i] {
+			t.Errorf("documento no válido %d = %s, se esperaba %s", i, result.ID, invalid[i])
+		}
+		if paths := validationPaths(result.Errors); !slices.Equal(paths, invalidClientePaths) {
+			t.Errorf("%s: rutas = %v, se esperaban %v", result.ID, paths, invalidClientePaths)
+		}
+	}
+	if _, exists := database.GetSchema("clientes"); exists {
+		t.Errorf("el informe asignó el esquema a la colección")
+	}
+	if docs, _ := database.GetAllDocuments("clientes"); len(docs) != 3 {
+		t.Errorf("documentos = %d, el informe no debe eliminar ninguno", len(docs))
+	}
+
+	// Sin esquema propuesto se usa el de la colección
+	if err := database.SetSchema("clientes", newSchema(t, clientesSchema)); err != nil {
+		t.Fatalf("error al asignar esquema: %v", err)
+	}
+	report, err = database.ValidateCollection("clientes", nil)
+	if err != nil || report.Valid != 1 || len(report.Invalid) != 2 {
+		t.Errorf("informe con el esquema de la colección = %+v, %v", report, err)
+	}
+}
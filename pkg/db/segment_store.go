@@ -0,0 +1,730 @@
+package db
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formato de un registro de un segmento:
+//
+//	crc32 (uint32) | secuencia (uint64) | tipo (uint8) | longitud de la clave (uint16) | longitud del valor (uint32) | clave | valor
+//
+// La clave es "<colección>\x00<id>" y el valor el documento en JSON, vacío en las
+// eliminaciones. El CRC (Castagnoli) cubre todo lo que le sigue. La secuencia
+// crece con cada escritura y decide qué registro de una clave es el vigente, así
+// que al recuperar no importa el orden de los segmentos. El manifiesto enumera
+// los segmentos en uso; cualquier otro archivo de segmento es un resto de una
+// rotación o compactación interrumpida y se elimina al abrir.
+const (
+	storeHeaderSize        = 19
+	storeSegmentPrefix     = "seg-"
+	storeSegmentSuffix     = ".data"
+	storeManifestFile      = "MANIFEST"
+	storeRecordPut         = 0
+	storeRecordDelete      = 1
+	storeMaxSegmentSize    = 64 << 20
+	storeCompactInterval   = 30 * time.Second
+	storeCompactMinGarbage = 8 << 20
+)
+
+// ErrSegmentCorrupted indica un registro dañado en un segmento que no se puede
+// atribuir a una escritura interrumpida
+var ErrSegmentCorrupted = errors.New("segmento dañado")
+
+// SegmentStore es el motor de segmentos de solo anexado. Cada escritura añade un
+// registro al segmento activo y un directorio de claves en memoria apunta al
+// registro vigente de cada documento. Una compactación en segundo plano reescribe
+// los registros vigentes cuando la mitad del espacio está ocupada por registros
+// obsoletos.
+type SegmentStore struct {
+	dir        string
+	segments   map[uint32]*storeSegment
+	order      []uint32              // Segmentos del manifiesto; el último es el activo
+	keydir     map[string]storeEntry // Registro vigente de cada documento
+	nextID     uint32
+	seq        uint64
+	totalBytes int64 // Tamaño de todos los segmentos
+	liveBytes  int64 // Tamaño de los registros vigentes
+	closed     bool
+	stop       chan struct{}
+	done       chan struct{}
+	mutex      sync.RWMutex
+}
+
+// storeSegment es un archivo de segmento abierto
+type storeSegment struct {
+	id   uint32
+	file *os.File
+	size int64
+}
+
+// storeEntry localiza el registro vigente de un documento
+type storeEntry struct {
+	segment uint32
+	offset  int64
+	size    int64
+	seq     uint64
+}
+
+// storeRecord es un registro leído de un segmento
+type storeRecord struct {
+	seq   uint64
+	kind  byte
+	key   string
+	value []byte
+	size  int64
+}
+
+// storeManifest es el contenido del manifiesto
+type storeManifest struct {
+	Segments []uint32 `json:"segments"`
+	NextID   uint32   `json:"next_id"`
+}
+
+// OpenSegmentStore abre el motor de segmentos sobre un directorio. Si el último
+// segmento termina en un registro incompleto o dañado (escritura interrumpida)
+// se trunca en el último registro válido.
+func OpenSegmentStore(dir string) (*SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error al crear directorio de segmentos: %v", err)
+	}
+
+	s := &SegmentStore{
+		dir:      dir,
+		segments: make(map[uint32]*storeSegment),
+		keydir:   make(map[string]storeEntry),
+		nextID:   1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	go s.compactLoop()
+
+	return s, nil
+}
+
+// load lee el manifiesto y reconstruye el directorio de claves recorriendo los segmentos
+func (s *SegmentStore) load() error {
+	manifest, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	if manifest.NextID > s.nextID {
+		s.nextID = manifest.NextID
+	}
+
+	// Eliminar los segmentos que no llegaron a registrarse en el manifiesto
+	live := make(map[uint32]bool, len(manifest.Segments))
+	for _, id := range manifest.Segments {
+		live[id] = true
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("error al leer directorio de segmentos: %v", err)
+	}
+	for _, entry := range entries {
+		id, ok := parseSegmentName(entry.Name())
+		if (ok && !live[id]) || entry.Name() == storeManifestFile+".tmp" {
+			if err := os.Remove(filepath.Join(s.dir, entry.Name())); err != nil {
+				return fmt.Errorf("error al eliminar segmento sobrante: %v", err)
+			}
+		}
+	}
+
+	// Los registros de una clave pueden estar en cualquier segmento; las
+	// eliminaciones se recuerdan para descartar registros más antiguos leídos después
+	deleted := make(map[string]uint64)
+	for i, id := range manifest.Segments {
+		file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0644)
+		if err != nil {
+			return fmt.Errorf("error al abrir segmento %d: %v", id, err)
+		}
+		segment := &storeSegment{id: id, file: file}
+		s.segments[id] = segment
+		s.order = append(s.order, id)
+
+		if err := s.scanSegment(segment, i == len(manifest.Segments)-1, deleted); err != nil {
+			return err
+		}
+	}
+
+	if len(s.order) == 0 {
+		if _, err := s.newSegmentLocked(nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSegment añade al directorio de claves los registros de un segmento
+func (s *SegmentStore) scanSegment(segment *storeSegment, last bool, deleted map[string]uint64) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return fmt.Errorf("error al leer segmento %d: %v", segment.id, err)
+	}
+
+	var offset int64
+	for offset < info.Size() {
+		record, reason, err := readStoreRecord(segment.file, offset, info.Size())
+		if err != nil {
+			return fmt.Errorf("error al leer segmento %d: %v", segment.id, err)
+		}
+		if reason != "" {
+			if !last {
+				return fmt.Errorf("%w: %s en la posición %d del segmento %d", ErrSegmentCorrupted, reason, offset, segment.id)
+			}
+
+			log.Printf("Segmento %d: %s en la posición %d, se descarta el final", segment.id, reason, offset)
+			if err := segment.file.Truncate(offset); err != nil {
+				return fmt.Errorf("error al truncar segmento %d: %v", segment.id, err)
+			}
+			if err := segment.file.Sync(); err != nil {
+				return fmt.Errorf("error al sincronizar segmento %d: %v", segment.id, err)
+			}
+			break
+		}
+
+		s.indexRecord(segment.id, offset, record, deleted)
+		offset += record.size
+	}
+
+	segment.size = offset
+	s.totalBytes += offset
+	return nil
+}
+
+// indexRecord aplica un registro recuperado al directorio de claves
+func (s *SegmentStore) indexRecord(segmentID uint32, offset int64, record storeRecord, deleted map[string]uint64) {
+	if record.seq > s.seq {
+		s.seq = record.seq
+	}
+
+	current, exists := s.keydir[record.key]
+	if exists && current.seq > record.seq {
+		return
+	}
+	if seq, wasDeleted := deleted[record.key]; wasDeleted && seq > record.seq {
+		return
+	}
+	if exists {
+		s.liveBytes -= current.size
+	}
+
+	if record.kind == storeRecordDelete {
+		delete(s.keydir, record.key)
+		deleted[record.key] = record.seq
+		return
+	}
+
+	delete(deleted, record.key)
+	s.keydir[record.key] = storeEntry{segment: segmentID, offset: offset, size: record.size, seq: record.seq}
+	s.liveBytes += record.size
+}
+
+// readStoreRecord lee el registro que empieza en offset sin pasar de limit. Un
+// registro incompleto o dañado se indica con un motivo, no con un error.
+func readStoreRecord(file *os.File, offset, limit int64) (storeRecord, string, error) {
+	if limit-offset < storeHeaderSize {
+		return storeRecord{}, "registro incompleto", nil
+	}
+
+	header := make([]byte, storeHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return storeRecord{}, "", err
+	}
+
+	keyLength := int64(binary.LittleEndian.Uint16(header[13:15]))
+	valueLength := int64(binary.LittleEndian.Uint32(header[15:19]))
+	if valueLength > walMaxRecordSize {
+		return storeRecord{}, "longitud no válida", nil
+	}
+	size := storeHeaderSize + keyLength + valueLength
+	if limit-offset < size {
+		return storeRecord{}, "registro incompleto", nil
+	}
+
+	body := make([]byte, keyLength+valueLength)
+	if _, err := file.ReadAt(body, offset+storeHeaderSize); err != nil {
+		return storeRecord{}, "", err
+	}
+	checksum := crc32.Update(crc32.Checksum(header[4:], walCRCTable), walCRCTable, body)
+	if checksum != binary.LittleEndian.Uint32(header[0:4]) {
+		return storeRecord{}, "CRC no válido", nil
+	}
+	if header[12] != storeRecordPut && header[12] != storeRecordDelete {
+		return storeRecord{}, "tipo de registro no válido", nil
+	}
+
+	return storeRecord{
+		seq:   binary.LittleEndian.Uint64(header[4:12]),
+		kind:  header[12],
+		key:   string(body[:keyLength]),
+		value: body[keyLength:],
+		size:  size,
+	}, "", nil
+}
+
+// encodeStoreRecord serializa un registro
+func encodeStoreRecord(seq uint64, kind byte, key string, value []byte) []byte {
+	record := make([]byte, storeHeaderSize+len(key)+len(value))
+	binary.LittleEndian.PutUint64(record[4:12], seq)
+	record[12] = kind
+	binary.LittleEndian.PutUint16(record[13:15], uint16(len(key)))
+	binary.LittleEndian.PutUint32(record[15:19], uint32(len(value)))
+	copy(record[storeHeaderSize:], key)
+	copy(record[storeHeaderSize+len(key):], value)
+	binary.LittleEndian.PutUint32(record[0:4], crc32.Checksum(record[4:], walCRCTable))
+	return record
+}
+
+// storeKey devuelve la clave de un documento
+func storeKey(collection, id string) string {
+	return collection + "\x00" + id
+}
+
+// Name devuelve el nombre del motor
+func (s *SegmentStore) Name() string {
+	return StorageEngineSegment
+}
+
+// Put añade un registro con el documento al segmento activo
+func (s *SegmentStore) Put(doc *Document) error {
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("error al serializar documento: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.appendLocked(storeKey(doc.Collection, doc.ID), storeRecordPut, value)
+}
+
+// Delete añade un registro de eliminación si el documento existe
+func (s *SegmentStore) Delete(collection, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := storeKey(collection, id)
+	if _, exists := s.keydir[key]; !exists {
+		return nil
+	}
+	return s.appendLocked(key, storeRecordDelete, nil)
+}
+
+// appendLocked añade un registro al segmento activo, rotándolo si se llena.
+// Debe llamarse con el mutex bloqueado.
+func (s *SegmentStore) appendLocked(key string, kind byte, value []byte) error {
+	if s.closed {
+		return errors.New("motor de segmentos cerrado")
+	}
+	if len(key) > math.MaxUint16 {
+		return fmt.Errorf("clave demasiado larga: %d bytes", len(key))
+	}
+	if len(value) > walMaxRecordSize {
+		return fmt.Errorf("documento demasiado grande: %d bytes", len(value))
+	}
+
+	size := int64(storeHeaderSize + len(key) + len(value))
+	segment := s.activeSegment()
+	if segment.size > 0 && segment.size+size > storeMaxSegmentSize {
+		var err error
+		if segment, err = s.newSegmentLocked(s.order); err != nil {
+			return err
+		}
+	}
+
+	record := encodeStoreRecord(s.seq+1, kind, key, value)
+	if _, err := segment.file.WriteAt(record, segment.size); err != nil {
+		// Descartar el registro a medias para no dejar basura en medio del segmento
+		segment.file.Truncate(segment.size)
+		return fmt.Errorf("error al escribir en el segmento: %v", err)
+	}
+	s.seq++
+
+	if current, exists := s.keydir[key]; exists {
+		s.liveBytes -= current.size
+	}
+	if kind == storeRecordDelete {
+		delete(s.keydir, key)
+	} else {
+		s.keydir[key] = storeEntry{segment: segment.id, offset: segment.size, size: size, seq: s.seq}
+		s.liveBytes += size
+	}
+	segment.size += size
+	s.totalBytes += size
+	return nil
+}
+
+// Has indica si un documento existe
+func (s *SegmentStore) Has(collection, id string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, exists := s.keydir[storeKey(collection, id)]
+	return exists, nil
+}
+
+// ForEach recorre los documentos vigentes en el orden en que están en disco
+func (s *SegmentStore) ForEach(fn func(doc *Document) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries := make([]storeEntry, 0, len(s.keydir))
+	for _, entry := range s.keydir {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b storeEntry) int {
+		if a.segment != b.segment {
+			return cmp.Compare(a.segment, b.segment)
+		}
+		return cmp.Compare(a.offset, b.offset)
+	})
+
+	for _, entry := range entries {
+		record, reason, err := readStoreRecord(s.segments[entry.segment].file, entry.offset, entry.offset+entry.size)
+		if err != nil {
+			return fmt.Errorf("error al leer segmento %d: %v", entry.segment, err)
+		}
+		if reason != "" {
+			return fmt.Errorf("%w: %s en la posición %d del segmento %d", ErrSegmentCorrupted, reason, entry.offset, entry.segment)
+		}
+
+		var doc Document
+		if err := json.Unmarshal(record.value, &doc); err != nil {
+			return fmt.Errorf("error al deserializar documento del segmento %d: %v", entry.segment, err)
+		}
+		if err := fn(&doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Drop elimina todos los documentos empezando un segmento vacío
+func (s *SegmentStore) Drop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.New("motor de segmentos cerrado")
+	}
+
+	previous := s.order
+	if _, err := s.newSegmentLocked(nil); err != nil {
+		return err
+	}
+	if err := s.removeSegmentsLocked(previous); err != nil {
+		return err
+	}
+
+	s.keydir = make(map[string]storeEntry)
+	s.liveBytes = 0
+	return nil
+}
+
+// Compact reescribe los registros vigentes de todos los segmentos en segmentos
+// nuevos y elimina los anteriores. Las escrituras esperan a que termine.
+func (s *SegmentStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.New("motor de segmentos cerrado")
+	}
+
+	// Empezar un segmento activo vacío para compactar todo lo escrito hasta ahora;
+	// así ningún registro antiguo de una clave eliminada sobrevive a la compactación
+	if s.activeSegment().size > 0 {
+		if _, err := s.newSegmentLocked(s.order); err != nil {
+			return err
+		}
+	}
+	previous := slices.Clone(s.order[:len(s.order)-1])
+	if len(previous) == 0 {
+		return nil
+	}
+	active := s.order[len(s.order)-1]
+
+	type move struct {
+		key   string
+		entry storeEntry
+	}
+	moves := make([]move, 0, len(s.keydir))
+	for key, entry := range s.keydir {
+		moves = append(moves, move{key: key, entry: entry})
+	}
+	slices.SortFunc(moves, func(a, b move) int {
+		if a.entry.segment != b.entry.segment {
+			return cmp.Compare(a.entry.segment, b.entry.segment)
+		}
+		return cmp.Compare(a.entry.offset, b.entry.offset)
+	})
+
+	// Copiar los registros vigentes tal cual, con su secuencia, a segmentos nuevos
+	var outputs []*storeSegment
+	discard := func() {
+		for _, output := range outputs {
+			output.file.Close()
+			os.Remove(s.segmentPath(output.id))
+		}
+	}
+	updated := make(map[string]storeEntry, len(moves))
+	var output *storeSegment
+	for _, m := range moves {
+		if output == nil || (output.size > 0 && output.size+m.entry.size > storeMaxSegmentSize) {
+			id := s.nextID
+			s.nextID++
+			file, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				discard()
+				return fmt.Errorf("error al crear segmento compactado: %v", err)
+			}
+			output = &storeSegment{id: id, file: file}
+			outputs = append(outputs, output)
+		}
+
+		record := make([]byte, m.entry.size)
+		if _, err := s.segments[m.entry.segment].file.ReadAt(record, m.entry.offset); err != nil {
+			discard()
+			return fmt.Errorf("error al leer segmento %d: %v", m.entry.segment, err)
+		}
+		if _, err := output.file.WriteAt(record, output.size); err != nil {
+			discard()
+			return fmt.Errorf("error al escribir segmento compactado: %v", err)
+		}
+
+		updated[m.key] = storeEntry{segment: output.id, offset: output.size, size: m.entry.size, seq: m.entry.seq}
+		output.size += m.entry.size
+	}
+
+	order := make([]uint32, 0, len(outputs)+1)
+	for _, output := range outputs {
+		if err := output.file.Sync(); err != nil {
+			discard()
+			return fmt.Errorf("error al sincronizar segmento compactado: %v", err)
+		}
+		order = append(order, output.id)
+	}
+	order = append(order, active)
+
+	// El manifiesto nuevo confirma la compactación
+	if err := s.writeManifest(order); err != nil {
+		discard()
+		return err
+	}
+	s.order = order
+	for _, output := range outputs {
+		s.segments[output.id] = output
+		s.totalBytes += output.size
+	}
+	for key, entry := range updated {
+		s.keydir[key] = entry
+	}
+
+	return s.removeSegmentsLocked(previous)
+}
+
+// shouldCompact indica si los registros obsoletos ocupan suficiente espacio
+// para que merezca la pena compactar
+func (s *SegmentStore) shouldCompact() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	garbage := s.totalBytes - s.liveBytes
+	return !s.closed && garbage >= storeCompactMinGarbage && garbage*2 >= s.totalBytes
+}
+
+// compactLoop compacta periódicamente los segmentos hasta que se cierra el motor
+func (s *SegmentStore) compactLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(storeCompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if !s.shouldCompact() {
+				continue
+			}
+			if err := s.Compact(); err != nil {
+				log.Printf("Error al compactar segmentos: %v", err)
+			}
+		}
+	}
+}
+
+// Sync fuerza a disco el segmento activo; los anteriores se sincronizaron al rotar
+func (s *SegmentStore) Sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if err := s.activeSegment().file.Sync(); err != nil {
+		return fmt.Errorf("error al sincronizar segmento: %v", err)
+	}
+	return nil
+}
+
+// Close detiene la compactación, fuerza a disco el segmento activo y cierra los archivos
+func (s *SegmentStore) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	close(s.stop)
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.activeSegment().file.Sync()
+	s.closeFiles()
+	if err != nil {
+		return fmt.Errorf("error al sincronizar segmento: %v", err)
+	}
+	return nil
+}
+
+// closeFiles cierra los archivos de los segmentos
+func (s *SegmentStore) closeFiles() {
+	for _, segment := range s.segments {
+		segment.file.Close()
+	}
+}
+
+// activeSegment devuelve el segmento en el que se anexan las escrituras
+func (s *SegmentStore) activeSegment() *storeSegment {
+	return s.segments[s.order[len(s.order)-1]]
+}
+
+// newSegmentLocked crea un segmento vacío, lo registra en el manifiesto detrás de
+// order y lo convierte en el activo. Debe llamarse con el mutex bloqueado.
+func (s *SegmentStore) newSegmentLocked(order []uint32) (*storeSegment, error) {
+	id := s.nextID
+	s.nextID++
+
+	path := s.segmentPath(id)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error al crear segmento: %v", err)
+	}
+
+	// El segmento activo anterior deja de recibir escrituras: forzarlo a disco
+	if len(s.order) > 0 {
+		if err := s.activeSegment().file.Sync(); err != nil {
+			file.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("error al sincronizar segmento: %v", err)
+		}
+	}
+
+	newOrder := append(slices.Clone(order), id)
+	if err := s.writeManifest(newOrder); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	segment := &storeSegment{id: id, file: file}
+	s.segments[id] = segment
+	s.order = newOrder
+	return segment, nil
+}
+
+// removeSegmentsLocked cierra y elimina segmentos que ya no están en el
+// manifiesto. Debe llamarse con el mutex bloqueado.
+func (s *SegmentStore) removeSegmentsLocked(ids []uint32) error {
+	for _, id := range ids {
+		segment := s.segments[id]
+		segment.file.Close()
+		delete(s.segments, id)
+		s.totalBytes -= segment.size
+
+		if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error al eliminar segmento %d: %v", id, err)
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// readManifest lee el manifiesto; un directorio nuevo no tiene segmentos
+func (s *SegmentStore) readManifest() (storeManifest, error) {
+	var manifest storeManifest
+
+	data, err := os.ReadFile(filepath.Join(s.dir, storeManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return manifest, nil
+		}
+		return manifest, fmt.Errorf("error al leer manifiesto de segmentos: %v", err)
+	}
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("error al deserializar manifiesto de segmentos: %v", err)
+	}
+	return manifest, nil
+}
+
+// writeManifest guarda de forma atómica la lista de segmentos en uso
+func (s *SegmentStore) writeManifest(order []uint32) error {
+	data, err := json.Marshal(storeManifest{Segments: order, NextID: s.nextID})
+	if err != nil {
+		return fmt.Errorf("error al serializar manifiesto de segmentos: %v", err)
+	}
+
+	filePath := filepath.Join(s.dir, storeManifestFile)
+	tmpPath := filePath + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return fmt.Errorf("error al guardar manifiesto de segmentos: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar manifiesto de segmentos: %v", err)
+	}
+	return syncDir(s.dir)
+}
+
+// segmentPath devuelve la ruta del archivo de un segmento
+func (s *SegmentStore) segmentPath(id uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%010d%s", storeSegmentPrefix, id, storeSegmentSuffix))
+}
+
+// parseSegmentName obtiene el identificador de un archivo de segmento
+func parseSegmentName(name string) (uint32, bool) {
+	if !strings.HasPrefix(name, storeSegmentPrefix) || !strings.HasSuffix(name, storeSegmentSuffix) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, storeSegmentPrefix), storeSegmentSuffix), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
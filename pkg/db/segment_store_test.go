@@ -0,0 +1,219 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+// storeDoc crea un documento de prueba
+func storeDoc(collection, id string, value any) *Document {
+	return &Document{ID: id, Collection: collection, Data: map[string]any{"valor": value}}
+}
+
+// openTestStore abre el motor de segmentos de un directorio
+func openTestStore(t *testing.T, dir string) *SegmentStore {
+	t.Helper()
+	s, err := OpenSegmentStore(dir)
+	if err != nil {
+		t.Fatalf("error al abrir el motor de segmentos: %v", err)
+	}
+	return s
+}
+
+// storeIDs devuelve los IDs de los documentos guardados en el motor
+func storeIDs(t *testing.T, s StorageEngine) map[string]*Document {
+	t.Helper()
+	docs := make(map[string]*Document)
+	if err := s.ForEach(func(doc *Document) error {
+		docs[doc.ID] = doc
+		return nil
+	}); err != nil {
+		t.Fatalf("error al recorrer el motor: %v", err)
+	}
+	return docs
+}
+
+// rotateForTest empieza un segmento activo nuevo
+func (s *SegmentStore) rotateForTest(t *testing.T) {
+	t.Helper()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.newSegmentLocked(s.order); err != nil {
+		t.Fatalf("error al crear segmento: %v", err)
+	}
+}
+
+func TestSegmentStoreRecoversTornLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	for _, id := range []string{"a", "b"} {
+		if err := s.Put(storeDoc("c", id, id)); err != nil {
+			t.Fatalf("error al guardar: %v", err)
+		}
+	}
+	active := s.segmentPath(s.activeSegment().id)
+	s.Close()
+
+	// Un registro escrito a medias al final del segmento activo
+	record := encodeStoreRecord(3, storeRecordPut, storeKey("c", "x"), []byte(`{"id":"x"}`))
+	file, err := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("error al abrir el segmento: %v", err)
+	}
+	file.Write(record[:len(record)-4])
+	file.Close()
+
+	s = openTestStore(t, dir)
+	docs := storeIDs(t, s)
+	if len(docs) != 2 || docs["a"] == nil || docs["b"] == nil {
+		t.Fatalf("documentos recuperados = %v, se esperaban a y b", docs)
+	}
+
+	// Las escrituras siguientes no quedan detrás de los restos del registro
+	if err := s.Put(storeDoc("c", "d", "d")); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	s.Close()
+
+	s = openTestStore(t, dir)
+	defer s.Close()
+	if docs := storeIDs(t, s); len(docs) != 3 || docs["d"] == nil {
+		t.Errorf("documentos tras reabrir = %v, se esperaban a, b y d", docs)
+	}
+}
+
+func TestSegmentStoreDeleteInLaterSegmentSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	if err := s.Put(storeDoc("c", "a", 1)); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	if err := s.Put(storeDoc("c", "b", 1)); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	s.rotateForTest(t)
+	if err := s.Delete("c", "a"); err != nil {
+		t.Fatalf("error al eliminar: %v", err)
+	}
+	s.Close()
+
+	s = openTestStore(t, dir)
+	defer s.Close()
+	if exists, _ := s.Has("c", "a"); exists {
+		t.Errorf("el documento eliminado en un segmento posterior reaparece al reabrir")
+	}
+	if exists, _ := s.Has("c", "b"); !exists {
+		t.Errorf("falta el documento no eliminado")
+	}
+}
+
+func TestSegmentStoreCompactDoesNotResurrectDeletes(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	if err := s.Put(storeDoc("c", "a", 1)); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	s.rotateForTest(t)
+	if err := s.Put(storeDoc("c", "b", 1)); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	if err := s.Put(storeDoc("c", "b", 2)); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	if err := s.Delete("c", "a"); err != nil {
+		t.Fatalf("error al eliminar: %v", err)
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatalf("error al compactar: %v", err)
+	}
+	if exists, _ := s.Has("c", "a"); exists {
+		t.Errorf("el documento eliminado reaparece tras compactar")
+	}
+	s.Close()
+
+	s = openTestStore(t, dir)
+	defer s.Close()
+	docs := storeIDs(t, s)
+	if docs["a"] != nil {
+		t.Errorf("el documento eliminado reaparece al reabrir tras compactar")
+	}
+	if docs["b"] == nil || docs["b"].Data["valor"] != float64(2) {
+		t.Errorf("documento b = %v, se esperaba su última versión", docs["b"])
+	}
+}
+
+func TestSegmentStoreRemovesOrphanSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	if err := s.Put(storeDoc("c", "a", 1)); err != nil {
+		t.Fatalf("error al guardar: %v", err)
+	}
+	orphan := s.segmentPath(s.nextID + 10)
+	s.Close()
+
+	// Resto de una rotación interrumpida: un segmento que no está en el manifiesto
+	data := encodeStoreRecord(99, storeRecordPut, storeKey("c", "huerfano"), []byte(`{"id":"huerfano","collection":"c"}`))
+	if err := os.WriteFile(orphan, data, 0644); err != nil {
+		t.Fatalf("error al escribir el segmento huérfano: %v", err)
+	}
+
+	s = openTestStore(t, dir)
+	defer s.Close()
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("el segmento huérfano sigue en disco: %v", err)
+	}
+	if exists, _ := s.Has("c", "huerfano"); exists {
+		t.Errorf("se cargó un documento del segmento huérfano")
+	}
+	if exists, _ := s.Has("c", "a"); !exists {
+		t.Errorf("falta el documento del segmento del manifiesto")
+	}
+}
+
+func TestMigrateStorageRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	pm, err := NewPersistenceManager(dir, WithCheckpointInterval(0), WithStorageEngine(StorageEngineFile))
+	if err != nil {
+		t.Fatalf("error al abrir la persistencia: %v", err)
+	}
+	for _, doc := range []*Document{storeDoc("c", "a", 1), storeDoc("c", "b", 2), storeDoc("d", "x", "y")} {
+		if err := pm.SaveDocument(doc); err != nil {
+			t.Fatalf("error al guardar: %v", err)
+		}
+	}
+	if err := pm.DeleteDocument("c", "b"); err != nil {
+		t.Fatalf("error al eliminar: %v", err)
+	}
+	if err := pm.Close(); err != nil {
+		t.Fatalf("error al cerrar la persistencia: %v", err)
+	}
+
+	for _, target := range []string{StorageEngineSegment, StorageEngineFile} {
+		count, err := MigrateStorage(dir, target)
+		if err != nil {
+			t.Fatalf("error al migrar a %s: %v", target, err)
+		}
+		if count != 2 {
+			t.Errorf("documentos migrados a %s = %d, se esperaban 2", target, count)
+		}
+
+		pm, err := NewPersistenceManager(dir, WithCheckpointInterval(0), WithStorageEngine(target))
+		if err != nil {
+			t.Fatalf("error al abrir la persistencia con %s: %v", target, err)
+		}
+		if pm.StorageEngine() != target {
+			t.Errorf("motor en uso = %s, se esperaba %s", pm.StorageEngine(), target)
+		}
+		docs, err := pm.LoadAllDocuments()
+		if err != nil {
+			t.Fatalf("error al cargar documentos: %v", err)
+		}
+		if len(docs) != 2 || docs["a"] == nil || docs["x"] == nil {
+			t.Errorf("documentos con %s = %v, se esperaban a y x", target, docs)
+		} else if docs["x"].Collection != "d" || docs["x"].Data["valor"] != "y" {
+			t.Errorf("documento x con %s = %+v", target, docs["x"])
+		}
+		pm.Close()
+	}
+}
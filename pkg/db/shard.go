@@ -0,0 +1,192 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrShardUnavailable indica que no respondió ningún nodo propietario de un
+	// documento de una colección fragmentada
+	ErrShardUnavailable = errors.New("ningún nodo propietario del documento está disponible")
+	// ErrShardedTransaction indica que una transacción escribe un documento
+	// fragmentado del que el nodo no es propietario
+	ErrShardedTransaction = errors.New("las transacciones solo admiten documentos fragmentados propios del nodo")
+	// ErrStrongShardWrite indica que otro nodo envió una escritura directa de una
+	// colección de consistencia fuerte, cuyas escrituras solo pasan por el consenso
+	ErrStrongShardWrite = errors.New("las colecciones de consistencia fuerte no admiten escrituras de otros nodos")
+)
+
+// ShardRouter reparte los documentos de las colecciones fragmentadas entre los
+// nodos del clúster según su ID. Sus métodos no deben tomar el mutex de la base
+// de datos.
+type ShardRouter interface {
+	// Sharded indica si una colección está fragmentada
+	Sharded(collection string) bool
+	// Owns indica si el nodo es uno de los propietarios de un documento
+	Owns(id string) bool
+	// Forward envía una escritura a un propietario del documento y devuelve su resultado
+	Forward(command *Command) (*Document, error)
+	// Fetch obtiene un documento de los demás propietarios
+	Fetch(id string) (*Document, error)
+}
+
+// SetShardRouter establece el reparto de las colecciones fragmentadas, o lo
+// quita con nil
+func (db *Database) SetShardRouter(router ShardRouter) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.shards = router
+}
+
+// shardRouterFor devuelve el reparto por el que pasa la creación de un documento
+// de una colección, o nil si el nodo lo crea localmente
+func (db *Database) shardRouterFor(collection, id string) ShardRouter {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.shards == nil || !db.shards.Sharded(collection) || db.shards.Owns(id) {
+		return nil
+	}
+	return db.shards
+}
+
+// shardRouterForDocument devuelve el reparto por el que pasa una escritura de un
+// documento, o nil si el nodo la aplica localmente. Un documento que el nodo no
+// tiene ni le pertenece se busca en sus propietarios.
+func (db *Database) shardRouterForDocument(id string) ShardRouter {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.shards == nil || db.shards.Owns(id) {
+		return nil
+	}
+	if doc, exists := db.documents[id]; exists && !db.shards.Sharded(doc.Collection) {
+		return nil
+	}
+	return db.shards
+}
+
+// hostsLocked indica si el nodo guarda un documento de una colección. Los
+// documentos fragmentados solo los guardan sus propietarios. Debe llamarse con
+// el mutex de la base de datos bloqueado.
+func (db *Database) hostsLocked(collection, id string) bool {
+	return db.shards == nil || !db.shards.Sharded(collection) || db.shards.Owns(id)
+}
+
+// fetchDocument busca en los propietarios un documento que el nodo no tiene
+func (db *Database) fetchDocument(id string) (*Document, error) {
+	db.mutex.RLock()
+	router := db.shards
+	db.mutex.RUnlock()
+
+	if router == nil {
+		return nil, errors.New("documento no encontrado")
+	}
+	return router.Fetch(id)
+}
+
+// ExecuteCommand aplica en el nodo una escritura que le ha enviado otro nodo por
+// ser uno de los propietarios del documento. La escritura se replica a los
+// demás propietarios como cualquier escritura local. Las colecciones de
+// consistencia fuerte se rechazan con ErrStrongShardWrite.
+func (db *Database) ExecuteCommand(command *Command) (*Document, error) {
+	opts := writeOptions{expectedRevision: command.Revision}
+
+	db.mutex.RLock()
+	collection := command.Collection
+	if doc, exists := db.documents[command.ID]; exists {
+		collection = doc.Collection
+	}
+	strong := db.consensus != nil && db.consensus.Strong(collection)
+	db.mutex.RUnlock()
+	if strong {
+		return nil, ErrStrongShardWrite
+	}
+
+	switch command.Operation {
+	case OperationCreate:
+		db.mutex.Lock()
+		defer db.mutex.Unlock()
+
+		if db.readOnly {
+			return nil, ErrReadOnly
+		}
+		if _, exists := db.documents[command.ID]; exists {
+			return nil, fmt.Errorf("el documento %s ya existe", command.ID)
+		}
+		doc := &Document{ID: command.ID, Collection: command.Collection, Data: command.Data}
+		return db.createDocumentLocked(doc, db.localStamp())
+
+	case OperationUpdate:
+		apply, err := updateFunc(command.Data)
+		if err != nil {
+			return nil, err
+		}
+		return db.updateDocument(command.ID, apply, opts)
+
+	case OperationDelete:
+		return nil, db.deleteDocument(command.ID, opts)
+
+	default:
+		return nil, fmt.Errorf("operación no soportada: %s", command.Operation)
+	}
+}
+
+// ReleaseDocuments quita del nodo documentos y lápidas que han pasado a otros
+// propietarios, sin registrar su eliminación ni replicarla
+func (db *Database) ReleaseDocuments(ids []string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, id := range ids {
+		if _, exists := db.tombstones[id]; exists {
+			db.dropTombstoneLocked(id)
+			db.tombstonesDirty = true
+		}
+
+		doc := db.removeDocumentLocked(id)
+		if doc != nil && db.persistenceEnabled {
+			if err := db.persistence.DeleteDocument(doc.Collection, id); err != nil {
+				return fmt.Errorf("error al persistir eliminación: %v", err)
+			}
+		}
+	}
+	return db.saveTombstonesLocked()
+}
+
+// GetLocalDocument obtiene un documento solo si el nodo lo guarda, sin buscarlo
+// en otros nodos
+func (db *Database) GetLocalDocument(id string) (*Document, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	doc, exists := db.documents[id]
+	return doc, exists
+}
+
+// Holds indica si el nodo guarda un documento o la lápida de su eliminación
+func (db *Database) Holds(id string) bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	_, exists := db.documents[id]
+	_, deleted := db.tombstones[id]
+	return exists || deleted
+}
+
+// CountLocalDocuments devuelve cuántos documentos guarda el nodo de las
+// colecciones para las que include devuelve true
+func (db *Database) CountLocalDocuments(include func(collection string) bool) int {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	count := 0
+	for _, doc := range db.documents {
+		if include(doc.Collection) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// strongCollections es un consenso de prueba que solo indica qué colecciones
+// son de consistencia fuerte
+type strongCollections []string
+
+func (c strongCollections) Strong(collection string) bool { return slices.Contains(c, collection) }
+func (c strongCollections) Member() bool                  { return true }
+func (c strongCollections) Propose(command *Command) (*Document, error) {
+	return nil, ErrConsensusUnavailable
+}
+func (c strongCollections) Barrier(collection string) error { return nil }
+func (c strongCollections) CatchUp() error                  { return nil }
+
+// TestExecuteCommandRejectsStrongCollections comprueba que las escrituras que
+// envía otro nodo no entren en una colección de consistencia fuerte sin pasar
+// por el consenso
+func TestExecuteCommandRejectsStrongCollections(t *testing.T) {
+	database := NewDatabase()
+	existing, err := database.CreateDocument("cuentas", map[string]interface{}{"saldo": 10})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	database.SetConsensus(strongCollections{"cuentas"})
+
+	commands := []*Command{
+		{Operation: OperationCreate, Collection: "cuentas", ID: "nueva", Data: map[string]any{"saldo": 100}},
+		{Operation: OperationUpdate, Collection: "otra", ID: existing.ID, Data: map[string]any{"saldo": 100}},
+		{Operation: OperationDelete, Collection: "otra", ID: existing.ID},
+	}
+	for _, command := range commands {
+		if _, err := database.ExecuteCommand(command); !errors.Is(err, ErrStrongShardWrite) {
+			t.Errorf("%s en %s: %v, se esperaba ErrStrongShardWrite", command.Operation, command.ID, err)
+		}
+	}
+
+	doc, exists := database.GetLocalDocument(existing.ID)
+	if !exists || compareValues(doc.Data["saldo"], 10) != 0 {
+		t.Errorf("el documento de la colección fuerte cambió: %v", doc)
+	}
+	if _, exists := database.GetLocalDocument("nueva"); exists {
+		t.Errorf("se creó un documento en la colección fuerte")
+	}
+
+	// Las demás colecciones siguen admitiendo escrituras de otros nodos
+	created, err := database.ExecuteCommand(&Command{Operation: OperationCreate, Collection: "pedidos", ID: "p1", Data: map[string]any{"total": 5}})
+	if err != nil || created == nil {
+		t.Errorf("escritura en una colección sin consenso: %v, %v", created, err)
+	}
+}
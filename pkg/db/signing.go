@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// syncSignaturePrefix separa las firmas de los mensajes de sincronización de
+// otros usos de la clave del nodo
+const syncSignaturePrefix = "dbp2p-sync:"
+
+// SignedMessage envuelve un mensaje de sincronización con la firma del nodo que
+// lo creó, de modo que se puede verificar aunque llegue reenviado por otro nodo.
+// Los mensajes de las colecciones cifradas llevan el DBMessage cifrado con la
+// clave de datos del clúster en lugar de en claro.
+type SignedMessage struct {
+	From       string          `json:"from"`                 // ID del nodo de origen
+	Key        []byte          `json:"key,omitempty"`        // Clave pública, si no se deduce del ID
+	Payload    json.RawMessage `json:"payload,omitempty"`    // DBMessage serializado, si no va cifrado
+	KeyID      string          `json:"key_id,omitempty"`     // Clave de datos con la que se cifró
+	Ciphertext []byte          `json:"ciphertext,omitempty"` // DBMessage cifrado
+	Signature  []byte          `json:"signature"`
+}
+
+// sealMessage serializa un mensaje, lo cifra si se indica un cifrador y lo firma
+// con la clave privada del nodo. El cifrado se liga al nodo de origen.
+func sealMessage(key crypto.PrivKey, from string, msg DBMessage, cipher PayloadCipher) ([]byte, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := SignedMessage{From: from, Payload: payload}
+	if cipher != nil {
+		signed.Payload = nil
+		if signed.KeyID, signed.Ciphertext, err = cipher.Seal(payload, []byte(from)); err != nil {
+			return nil, fmt.Errorf("error al cifrar mensaje de sincronización: %v", err)
+		}
+	}
+
+	if signed.Signature, err = key.Sign(signedBytes(&signed)); err != nil {
+		return nil, fmt.Errorf("error al firmar mensaje de sincronización: %v", err)
+	}
+
+	// Los IDs de las claves RSA no incluyen la clave pública
+	if _, err := peer.ID(from).ExtractPublicKey(); err != nil {
+		if signed.Key, err = crypto.MarshalPublicKey(key.GetPublic()); err != nil {
+			return nil, fmt.Errorf("error al serializar clave pública: %v", err)
+		}
+	}
+
+	return json.Marshal(signed)
+}
+
+// openMessage verifica la firma de un mensaje de sincronización, lo descifra si
+// va cifrado y devuelve el mensaje junto con el ID del nodo que lo firmó
+func openMessage(data []byte, cipher PayloadCipher) (*DBMessage, string, error) {
+	signed, err := verifyEnvelope(data)
+	if err != nil {
+		return nil, signed.From, err
+	}
+	msg, err := decodeMessage(signed, cipher)
+	return msg, signed.From, err
+}
+
+// verifyEnvelope deserializa un mensaje firmado y comprueba su firma. Devuelve
+// el sobre aunque la firma no sea válida, para identificar al remitente.
+func verifyEnvelope(data []byte) (*SignedMessage, error) {
+	var signed SignedMessage
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return &signed, fmt.Errorf("mensaje mal formado: %v", err)
+	}
+	if len(signed.Signature) == 0 {
+		return &signed, fmt.Errorf("mensaje sin firmar")
+	}
+
+	from, err := peer.Decode(signed.From)
+	if err != nil {
+		return &signed, fmt.Errorf("ID de origen no válido: %v", err)
+	}
+	key, err := publicKeyOf(from, signed.Key)
+	if err != nil {
+		return &signed, err
+	}
+
+	valid, err := key.Verify(signedBytes(&signed), signed.Signature)
+	if err != nil || !valid {
+		return &signed, fmt.Errorf("firma no válida")
+	}
+	return &signed, nil
+}
+
+// decodeMessage obtiene el DBMessage de un sobre verificado, descifrándolo si
+// va cifrado. Sin la clave de datos falla con ErrUnknownKey.
+func decodeMessage(signed *SignedMessage, cipher PayloadCipher) (*DBMessage, error) {
+	payload := []byte(signed.Payload)
+	if signed.KeyID != "" {
+		if cipher == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownKey, signed.KeyID)
+		}
+		var err error
+		if payload, err = cipher.Open(signed.KeyID, signed.Ciphertext, []byte(signed.From)); err != nil {
+			return nil, err
+		}
+	}
+
+	var msg DBMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, fmt.Errorf("mensaje mal formado: %v", err)
+	}
+	return &msg, nil
+}
+
+// publicKeyOf obtiene la clave pública de un nodo a partir de su ID o, si no la
+// incluye, de la enviada con el mensaje, que debe corresponder al ID
+func publicKeyOf(id peer.ID, data []byte) (crypto.PubKey, error) {
+	key, err := id.ExtractPublicKey()
+	if err == nil && key != nil {
+		return key, nil
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no se puede obtener la clave pública de %s", id)
+	}
+
+	key, err = crypto.UnmarshalPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("clave pública no válida: %v", err)
+	}
+	owner, err := peer.IDFromPublicKey(key)
+	if err != nil || owner != id {
+		return nil, fmt.Errorf("la clave pública no corresponde a %s", id)
+	}
+	return key, nil
+}
+
+// signedBytes devuelve los bytes que se firman de un mensaje: el DBMessage en
+// claro o, si va cifrado, el ID de la clave de datos y el texto cifrado
+func signedBytes(signed *SignedMessage) []byte {
+	data := []byte(syncSignaturePrefix)
+	if signed.KeyID == "" {
+		return append(data, signed.Payload...)
+	}
+	data = append(data, signed.KeyID...)
+	data = append(data, 0)
+	return append(data, signed.Ciphertext...)
+}
+
+// validateMessage es el validador de los temas de sincronización: descarta, sin
+// aplicarlos ni reenviarlos, los mensajes sin firma válida y los que la ACL no
+// permite a su nodo de origen. Guarda el mensaje verificado en ValidatorData.
+// Los mensajes cifrados con una clave que el nodo no tiene se reenvían sin
+// leerlos si su origen es un nodo conocido.
+func (s *DBSync) validateMessage(ctx context.Context, pid peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	dbMsg, err := s.verify(msg)
+	if errors.Is(err, ErrUnknownKey) {
+		return pubsub.ValidationAccept
+	}
+	if err != nil {
+		return pubsub.ValidationReject
+	}
+	msg.ValidatorData = dbMsg
+	return pubsub.ValidationAccept
+}
+
+// verify comprueba la firma y los permisos de un mensaje recibido y lo descifra.
+// Los mensajes rechazados se cuentan y registran en la base de datos. Si falta
+// la clave de datos se pide a los nodos de los que llega y se devuelve un error
+// ErrUnknownKey, que no cuenta como rechazo.
+func (s *DBSync) verify(msg *pubsub.Message) (*DBMessage, error) {
+	signed, err := verifyEnvelope(msg.Data)
+	from := signed.From
+	if err == nil && msg.GetFrom() != "" && from != msg.GetFrom().String() {
+		err = fmt.Errorf("firmado por %s pero publicado por %s", from, msg.GetFrom())
+	}
+
+	var dbMsg *DBMessage
+	if err == nil {
+		dbMsg, err = decodeMessage(signed, s.cipher)
+		if errors.Is(err, ErrUnknownKey) {
+			if s.db.KnowsPeer(from) {
+				if s.onMissingKey != nil {
+					s.onMissingKey(signed.KeyID, from, msg.ReceivedFrom.String())
+				}
+				return nil, err
+			}
+			err = fmt.Errorf("nodo no autorizado")
+		}
+	}
+	if err == nil && dbMsg.Origin != "" && dbMsg.Origin != from {
+		err = fmt.Errorf("escritura de %s firmada por %s", dbMsg.Origin, from)
+	}
+	if err == nil && signed.KeyID == "" && s.db.EncryptionPolicy().encryptsMessage(*dbMsg) {
+		err = fmt.Errorf("mensaje sin cifrar para una colección cifrada")
+	}
+	if err == nil {
+		err = s.authorize(from, *dbMsg)
+	}
+	if err != nil {
+		if from == "" {
+			from = msg.ReceivedFrom.String()
+		}
+		s.db.RejectReplication(from, err.Error())
+		return nil, err
+	}
+	return dbMsg, nil
+}
+
+// authorize comprueba que la ACL permita a un nodo las operaciones de un mensaje.
+// Un lote se rechaza completo si alguna de sus operaciones no está permitida.
+func (s *DBSync) authorize(from string, msg DBMessage) error {
+	if from == s.nodeID {
+		return nil
+	}
+
+	switch msg.Operation {
+	case OperationAck, OperationAnnounce:
+		if !s.db.KnowsPeer(from) {
+			return fmt.Errorf("nodo no autorizado")
+		}
+	case OperationCreate, OperationUpdate:
+		if msg.Document == nil {
+			return fmt.Errorf("operación %s sin documento", msg.Operation)
+		}
+		if !s.db.AllowsDocument(from, msg.Document) {
+			return fmt.Errorf("sin permiso para escribir en %s", msg.Document.Collection)
+		}
+	case OperationDelete:
+		collection := messageCollection(msg)
+		if collection == "" {
+			if doc, err := s.db.GetDocument(msg.DocumentID); err == nil {
+				collection = doc.Collection
+			}
+		}
+		if !s.db.AllowsReplication(from, OperationDelete, collection) {
+			return fmt.Errorf("sin permiso para eliminar en %s", collection)
+		}
+	case OperationBatch:
+		for _, operation := range msg.Batch {
+			if operation.Operation == OperationBatch {
+				return fmt.Errorf("lote anidado")
+			}
+			if err := s.authorize(from, operation); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("operación desconocida %s", msg.Operation)
+	}
+	return nil
+}
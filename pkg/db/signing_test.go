@@ -0,0 +1,162 @@
+package db
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// signingTestPeer es un nodo de prueba con su clave y su ID
+type signingTestPeer struct {
+	key crypto.PrivKey
+	id  string
+}
+
+// newSigningTestPeer genera la identidad de un nodo de prueba
+func newSigningTestPeer(t *testing.T) signingTestPeer {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("error al generar clave: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error al obtener ID: %v", err)
+	}
+	return signingTestPeer{key: key, id: id.String()}
+}
+
+// pubsubMessage simula la recepción de un mensaje publicado por from
+func pubsubMessage(t *testing.T, data []byte, from string) *pubsub.Message {
+	t.Helper()
+	pid, err := peer.Decode(from)
+	if err != nil {
+		t.Fatalf("ID no válido: %v", err)
+	}
+	return &pubsub.Message{Message: &pb.Message{Data: data, From: []byte(pid)}, ReceivedFrom: pid}
+}
+
+// seal firma un mensaje como el nodo p
+func (p signingTestPeer) seal(t *testing.T, msg DBMessage) []byte {
+	t.Helper()
+	data, err := sealMessage(p.key, p.id, msg, nil)
+	if err != nil {
+		t.Fatalf("error al firmar mensaje: %v", err)
+	}
+	return data
+}
+
+// newSigningTestSync crea un DBSync sin red para verificar mensajes
+func newSigningTestSync(t *testing.T, database *Database) *DBSync {
+	return &DBSync{db: database, nodeID: newSigningTestPeer(t).id}
+}
+
+func createMessage(id string) DBMessage {
+	return DBMessage{
+		Operation: OperationCreate,
+		Document:  &Document{ID: id, Collection: "notas", Data: map[string]any{"texto": "hola"}},
+	}
+}
+
+func TestVerifyRejectsForgedMessages(t *testing.T) {
+	database := NewDatabase()
+	s := newSigningTestSync(t, database)
+	author := newSigningTestPeer(t)
+	impostor := newSigningTestPeer(t)
+
+	// Un mensaje firmado correctamente se acepta
+	if _, err := s.verify(pubsubMessage(t, author.seal(t, createMessage("a")), author.id)); err != nil {
+		t.Fatalf("mensaje válido rechazado: %v", err)
+	}
+
+	// Contenido modificado después de firmar
+	tampered := strings.Replace(string(author.seal(t, createMessage("b"))), "hola", "adios", 1)
+	// Firmado por el impostor pero atribuido al autor
+	forgedFrom := strings.Replace(string(impostor.seal(t, createMessage("c"))), impostor.id, author.id, 1)
+	// Firmado por el autor pero publicado por el impostor
+	relayedAs := author.seal(t, DBMessage{Operation: OperationCreate, Document: createMessage("d").Document, Origin: impostor.id, Seq: 1})
+
+	cases := []struct {
+		name      string
+		data      []byte
+		publisher string
+	}{
+		{"contenido modificado", []byte(tampered), author.id},
+		{"origen suplantado", []byte(forgedFrom), author.id},
+		{"publicado por otro nodo", author.seal(t, createMessage("e")), impostor.id},
+		{"escritura de otro origen", relayedAs, author.id},
+		{"sin firma", []byte(`{"from":"` + author.id + `","payload":{}}`), author.id},
+	}
+	for i, c := range cases {
+		if _, err := s.verify(pubsubMessage(t, c.data, c.publisher)); err == nil {
+			t.Errorf("%s: mensaje aceptado", c.name)
+		}
+		if rejected := database.RejectedCount(); rejected != uint64(i+1) {
+			t.Errorf("%s: rechazados = %d, se esperaban %d", c.name, rejected, i+1)
+		}
+	}
+}
+
+func TestVerifyAppliesReplicationACL(t *testing.T) {
+	database := NewDatabase()
+	s := newSigningTestSync(t, database)
+	writer := newSigningTestPeer(t)
+	reader := newSigningTestPeer(t)
+	stranger := newSigningTestPeer(t)
+
+	err := database.SetReplicationACL(ReplicationACL{
+		Enabled: true,
+		Peers: map[string]ACLRule{
+			writer.id: {Role: ACLRoleWriter, Collections: []string{"notas"}},
+			reader.id: {Role: ACLRoleReader},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error al establecer la ACL: %v", err)
+	}
+
+	accepted := []struct {
+		name string
+		from signingTestPeer
+		msg  DBMessage
+	}{
+		{"escritura del escritor", writer, createMessage("a")},
+		{"confirmación de la réplica", reader, DBMessage{Operation: OperationAck}},
+	}
+	for _, c := range accepted {
+		if _, err := s.verify(pubsubMessage(t, c.from.seal(t, c.msg), c.from.id)); err != nil {
+			t.Errorf("%s rechazada: %v", c.name, err)
+		}
+	}
+	if database.RejectedCount() != 0 {
+		t.Fatalf("rechazados = %d, se esperaban 0", database.RejectedCount())
+	}
+
+	other := createMessage("b")
+	other.Document.Collection = "usuarios"
+	rejected := []struct {
+		name string
+		from signingTestPeer
+		msg  DBMessage
+	}{
+		{"escritura de un nodo fuera de la ACL", stranger, createMessage("c")},
+		{"confirmación de un nodo fuera de la ACL", stranger, DBMessage{Operation: OperationAck}},
+		{"escritura de la réplica de solo lectura", reader, createMessage("d")},
+		{"eliminación de la réplica de solo lectura", reader, DBMessage{Operation: OperationDelete, DocumentID: "a", Tombstone: &Tombstone{ID: "a", Collection: "notas"}}},
+		{"lote con una escritura de la réplica", reader, DBMessage{Operation: OperationBatch, Batch: []DBMessage{createMessage("e")}}},
+		{"escritura en una colección no permitida", writer, other},
+	}
+	for i, c := range rejected {
+		if _, err := s.verify(pubsubMessage(t, c.from.seal(t, c.msg), c.from.id)); err == nil {
+			t.Errorf("%s aceptada", c.name)
+		}
+		if count := database.RejectedCount(); count != uint64(i+1) {
+			t.Errorf("%s: rechazados = %d, se esperaban %d", c.name, count, i+1)
+		}
+	}
+}
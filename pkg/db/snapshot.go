@@ -0,0 +1,253 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// defaultChangeLogSize número de cambios que se conservan para que un nodo que
+// copia una instantánea se ponga al día
+const defaultChangeLogSize = 100000
+
+var (
+	// ErrChangesUnavailable indica que los cambios posteriores a un punto ya no
+	// están en el registro, porque se han descartado o el nodo se ha reiniciado
+	ErrChangesUnavailable = errors.New("los cambios pedidos ya no están en el registro")
+	// ErrReadOnly indica que la base de datos no admite escrituras locales
+	ErrReadOnly = errors.New("la base de datos es de solo lectura")
+)
+
+// changeEntry es un cambio del registro: el documento o lápida con ese ID cambió
+// en esa secuencia
+type changeEntry struct {
+	seq uint64
+	id  string
+}
+
+// changeLog registra en orden los documentos y lápidas que cambian, con una
+// secuencia que crece con cada cambio. Solo vive en memoria; la época lo
+// identifica, de modo que una secuencia de otra ejecución no se confunde.
+type changeLog struct {
+	epoch   string
+	seq     uint64
+	entries []changeEntry
+	limit   int
+}
+
+// newChangeLog crea un registro de cambios que conserva los limit últimos
+func newChangeLog(limit int) *changeLog {
+	return &changeLog{
+		epoch: uuid.New().String(),
+		limit: limit,
+	}
+}
+
+// record anota un cambio y descarta los más antiguos si se supera el límite
+func (l *changeLog) record(id string) {
+	l.seq++
+	l.entries = append(l.entries, changeEntry{seq: l.seq, id: id})
+	if len(l.entries) > 2*l.limit {
+		l.entries = append([]changeEntry(nil), l.entries[len(l.entries)-l.limit:]...)
+	}
+}
+
+// since devuelve los IDs distintos que cambiaron después de seq, hasta limit, y
+// la secuencia del último cambio incluido
+func (l *changeLog) since(epoch string, seq uint64, limit int) ([]string, uint64, bool, error) {
+	if epoch != l.epoch || seq > l.seq {
+		return nil, 0, false, ErrChangesUnavailable
+	}
+	if seq == l.seq {
+		return nil, seq, false, nil
+	}
+	if limit <= 0 {
+		limit = len(l.entries)
+	}
+	if len(l.entries) == 0 || l.entries[0].seq > seq+1 {
+		return nil, 0, false, ErrChangesUnavailable
+	}
+
+	// Las secuencias son consecutivas, así que la posición se calcula
+	start := int(seq + 1 - l.entries[0].seq)
+	seen := make(map[string]bool)
+	var ids []string
+	last := seq
+	for _, entry := range l.entries[start:] {
+		if !seen[entry.id] {
+			if len(ids) == limit {
+				return ids, last, true, nil
+			}
+			seen[entry.id] = true
+			ids = append(ids, entry.id)
+		}
+		last = entry.seq
+	}
+	return ids, last, false, nil
+}
+
+// recordChangeLocked anota en el registro de cambios un documento o lápida.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) recordChangeLocked(id string) {
+	db.changes.record(id)
+}
+
+// Snapshot es una copia coherente de los datos replicados de la base de datos
+// en un punto del registro de cambios
+type Snapshot struct {
+	Epoch      string              `json:"epoch"`
+	Seq        uint64              `json:"seq"`
+	Documents  []*Document         `json:"documents"`
+	Tombstones []*Tombstone        `json:"tombstones"`
+	Indexes    []IndexDefinition   `json:"indexes,omitempty"`
+	Schemas    map[string]*Schema  `json:"schemas,omitempty"`
+	CRDTSpecs  map[string]CRDTSpec `json:"crdt_specs,omitempty"`
+}
+
+// ChangeSet son los documentos y lápidas que cambiaron entre dos puntos del
+// registro, en su versión actual
+type ChangeSet struct {
+	Epoch      string       `json:"epoch"`
+	From       uint64       `json:"from"`
+	To         uint64       `json:"to"`
+	HasMore    bool         `json:"has_more"`
+	Documents  []*Document  `json:"documents,omitempty"`
+	Tombstones []*Tombstone `json:"tombstones,omitempty"`
+}
+
+// Snapshot devuelve una instantánea de las colecciones que cumplen include, con
+// las definiciones de índices, esquemas y campos CRDT. Los documentos no se
+// modifican una vez guardados, así que basta con copiar las referencias.
+func (db *Database) Snapshot(include func(collection string) bool) *Snapshot {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	snapshot := &Snapshot{
+		Epoch:      db.changes.epoch,
+		Seq:        db.changes.seq,
+		Documents:  make([]*Document, 0, len(db.documents)),
+		Tombstones: make([]*Tombstone, 0, len(db.tombstones)),
+		Schemas:    make(map[string]*Schema),
+		CRDTSpecs:  make(map[string]CRDTSpec),
+	}
+	for _, doc := range db.documents {
+		if include(doc.Collection) {
+			snapshot.Documents = append(snapshot.Documents, doc)
+		}
+	}
+	for _, tombstone := range db.tombstones {
+		if include(tombstone.Collection) {
+			snapshot.Tombstones = append(snapshot.Tombstones, tombstone.clone())
+		}
+	}
+	for _, definition := range db.indexes.Definitions() {
+		if include(definition.Collection) {
+			snapshot.Indexes = append(snapshot.Indexes, definition)
+		}
+	}
+	for collection, schema := range db.schemas {
+		if include(collection) {
+			snapshot.Schemas[collection] = schema
+		}
+	}
+	for collection, spec := range db.crdtSpecs {
+		if include(collection) {
+			snapshot.CRDTSpecs[collection] = spec
+		}
+	}
+	return snapshot
+}
+
+// ChangesSince devuelve, de las colecciones que cumplen include, la versión
+// actual de hasta limit documentos y lápidas que cambiaron después de seq.
+// Devuelve ErrChangesUnavailable si el registro ya no llega a ese punto.
+func (db *Database) ChangesSince(epoch string, seq uint64, limit int, include func(collection string) bool) (*ChangeSet, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	ids, last, more, err := db.changes.since(epoch, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &ChangeSet{Epoch: epoch, From: seq, To: last, HasMore: more}
+	for _, id := range ids {
+		if doc, exists := db.documents[id]; exists && include(doc.Collection) {
+			changes.Documents = append(changes.Documents, doc)
+		}
+		if tombstone, exists := db.tombstones[id]; exists && include(tombstone.Collection) {
+			changes.Tombstones = append(changes.Tombstones, tombstone.clone())
+		}
+	}
+	return changes, nil
+}
+
+// ChangeSeq devuelve la época y la secuencia actuales del registro de cambios
+func (db *Database) ChangeSeq() (string, uint64) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.changes.epoch, db.changes.seq
+}
+
+// ImportDefinitions crea los índices, esquemas y campos CRDT de una instantánea
+// que no existen en la base de datos; los ya definidos se conservan
+func (db *Database) ImportDefinitions(snapshot *Snapshot) error {
+	existing := make(map[string]bool)
+	for _, definition := range db.indexes.Definitions() {
+		existing[definition.Name] = true
+	}
+	for _, definition := range snapshot.Indexes {
+		if existing[definition.Name] {
+			continue
+		}
+		if _, err := db.CreateIndex(definition.Name, definition.Collection, definition.Fields, definition.Type, WithLanguage(definition.Language)); err != nil {
+			return fmt.Errorf("error al crear índice %s: %v", definition.Name, err)
+		}
+	}
+
+	for collection, schema := range snapshot.Schemas {
+		if _, exists := db.GetSchema(collection); exists || schema == nil {
+			continue
+		}
+		if err := db.SetSchema(collection, schema); err != nil {
+			return fmt.Errorf("error al establecer el esquema de %s: %v", collection, err)
+		}
+	}
+
+	for collection, spec := range snapshot.CRDTSpecs {
+		if !db.GetCRDTSpec(collection).IsEmpty() {
+			continue
+		}
+		if err := db.SetCRDTSpec(collection, spec); err != nil {
+			return fmt.Errorf("error al establecer los campos CRDT de %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// IsEmpty indica si la base de datos no tiene documentos ni lápidas
+func (db *Database) IsEmpty() bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return len(db.documents) == 0 && len(db.tombstones) == 0
+}
+
+// SetReadOnly establece si la base de datos rechaza las escrituras locales con
+// ErrReadOnly. Las escrituras recibidas de otros nodos se siguen aplicando.
+func (db *Database) SetReadOnly(readOnly bool) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.readOnly = readOnly
+}
+
+// IsReadOnly indica si la base de datos rechaza las escrituras locales
+func (db *Database) IsReadOnly() bool {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.readOnly
+}
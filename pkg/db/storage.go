@@ -0,0 +1,133 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Motores de almacenamiento disponibles
+const (
+	// StorageEngineFile guarda cada documento en un archivo JSON bajo collections/<colección>
+	StorageEngineFile = "file"
+	// StorageEngineSegment guarda los documentos en segmentos de solo anexado bajo segments/
+	StorageEngineSegment = "segment"
+)
+
+// storageFileName archivo del directorio de datos que registra el motor en uso
+const storageFileName = "storage.json"
+
+// StorageEngine almacena los documentos de la base de datos. Las escrituras no
+// tienen por qué ser duraderas hasta que se llama a Sync: el WAL del gestor de
+// persistencia las protege mientras tanto y las vuelve a aplicar tras un fallo,
+// por lo que Put y Delete deben ser idempotentes.
+type StorageEngine interface {
+	// Name devuelve el nombre del motor
+	Name() string
+	// Put guarda o reemplaza un documento
+	Put(doc *Document) error
+	// Delete elimina un documento; no es un error que no exista
+	Delete(collection, id string) error
+	// Has indica si un documento existe
+	Has(collection, id string) (bool, error)
+	// ForEach recorre todos los documentos guardados
+	ForEach(fn func(doc *Document) error) error
+	// Drop elimina todos los documentos
+	Drop() error
+	// Sync fuerza a disco las escrituras anteriores
+	Sync() error
+	// Close cierra el motor
+	Close() error
+}
+
+// storageInfo es el contenido del archivo que registra el motor en uso
+type storageInfo struct {
+	Engine string `json:"engine"`
+}
+
+// OpenStorageEngine abre el motor de almacenamiento indicado sobre un directorio de datos
+func OpenStorageEngine(name, dataDir string) (StorageEngine, error) {
+	switch name {
+	case StorageEngineFile:
+		return OpenFileStore(filepath.Join(dataDir, "collections"))
+	case StorageEngineSegment:
+		return OpenSegmentStore(filepath.Join(dataDir, "segments"))
+	default:
+		return nil, fmt.Errorf("motor de almacenamiento desconocido: %s", name)
+	}
+}
+
+// readStorageEngine devuelve el motor registrado en un directorio de datos. Los
+// directorios anteriores al registro usan archivos por documento; un directorio
+// nuevo devuelve una cadena vacía.
+func readStorageEngine(dataDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, storageFileName))
+	if err == nil {
+		var info storageInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return "", fmt.Errorf("error al leer %s: %v", storageFileName, err)
+		}
+		return info.Engine, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("error al leer %s: %v", storageFileName, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dataDir, "collections")); err == nil {
+		return StorageEngineFile, nil
+	}
+	return "", nil
+}
+
+// writeStorageEngine registra el motor en uso en un directorio de datos
+func writeStorageEngine(dataDir, name string) error {
+	data, err := json.MarshalIndent(storageInfo{Engine: name}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar %s: %v", storageFileName, err)
+	}
+
+	filePath := filepath.Join(dataDir, storageFileName)
+	tmpPath := filePath + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return fmt.Errorf("error al guardar %s: %v", storageFileName, err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar %s: %v", storageFileName, err)
+	}
+	return syncDir(dataDir)
+}
+
+// copyDocuments copia todos los documentos de un motor a otro y devuelve cuántos copió
+func copyDocuments(src, dst StorageEngine) (int, error) {
+	count := 0
+	err := src.ForEach(func(doc *Document) error {
+		if err := dst.Put(doc); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, dst.Sync()
+}
+
+// MigrateStorage convierte sin conexión el directorio de datos al motor indicado.
+// Primero aplica el WAL pendiente, copia los documentos al nuevo motor y solo
+// entonces registra el cambio y elimina los datos del motor anterior; si se
+// interrumpe, el directorio sigue usando el motor anterior y la migración puede
+// repetirse. Devuelve el número de documentos migrados.
+func MigrateStorage(dataDir, target string) (int, error) {
+	pm, err := NewPersistenceManager(dataDir, WithCheckpointInterval(0))
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := pm.migrate(target)
+	if closeErr := pm.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
@@ -2,12 +2,14 @@ package db
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
+	"sync"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
 )
 
 // Operación representa el tipo de operación de base de datos
@@ -18,101 +20,314 @@ const (
 	OperationCreate Operation = "create"
 	OperationUpdate Operation = "update"
 	OperationDelete Operation = "delete"
+	// OperationBatch agrupa las operaciones de una transacción
+	OperationBatch Operation = "batch"
+	// OperationAck confirma la recepción de eliminaciones
+	OperationAck Operation = "ack"
+	// OperationAnnounce anuncia las colecciones que publica un nodo
+	OperationAnnounce Operation = "announce"
+)
+
+const (
+	// controlTopic tema de las confirmaciones y anuncios de colecciones
+	controlTopic = "db-sync"
+	// tombstoneGCInterval intervalo entre limpiezas de lápidas
+	tombstoneGCInterval = time.Hour
+	// collectionScanInterval intervalo entre búsquedas de colecciones nuevas a las que suscribirse
+	collectionScanInterval = time.Minute
 )
 
 // DBMessage representa un mensaje de sincronización de base de datos
 type DBMessage struct {
-	Operation  Operation `json:"operation"`
-	Document   *Document `json:"document,omitempty"`
-	DocumentID string    `json:"document_id,omitempty"`
+	Operation   Operation      `json:"operation"`
+	Document    *Document      `json:"document,omitempty"`
+	DocumentID  string         `json:"document_id,omitempty"`
+	Tombstone   *Tombstone     `json:"tombstone,omitempty"`   // Lápida de una eliminación
+	Acks        []TombstoneAck `json:"acks,omitempty"`        // Eliminaciones confirmadas
+	Batch       []DBMessage    `json:"batch,omitempty"`       // Operaciones de una transacción
+	Collections []string       `json:"collections,omitempty"` // Colecciones anunciadas
+
+	// Nodo de origen, época de su outbox y número de secuencia de una escritura
+	// del outbox, con los que los receptores descartan las repeticiones
+	Origin string `json:"origin,omitempty"`
+	Epoch  string `json:"epoch,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+
+	// Escrituras del outbox recibidas, por nodo de origen y época
+	Delivered map[string][]uint64 `json:"delivered,omitempty"`
 }
 
-// DBSync maneja la sincronización de la base de datos entre nodos
+// DBSync maneja la sincronización de la base de datos entre nodos. Las escrituras
+// se publican en un tema por colección, de modo que cada nodo solo recibe las
+// colecciones a las que está suscrito según su política de replicación. Cada
+// mensaje va firmado con la clave del nodo y solo se aplican, y reenvían, los
+// que la ACL de replicación permite a su nodo de origen.
 type DBSync struct {
 	db      *Database
-	topic   *pubsub.Topic
+	topic   *pubsub.Topic // Tema de control
 	pubsub  *pubsub.PubSub
 	nodeID  string
+	key     crypto.PrivKey // Clave privada con la que se firman los mensajes
+	cluster string         // Clúster en cuyos temas se sincroniza; vacío para los temas comunes
+	cipher  PayloadCipher  // Cifrado de los mensajes de las colecciones cifradas
+
+	onMissingKey func(keyID string, peers ...string) // Pide a otros nodos una clave de datos desconocida
+
 	enabled bool
 	sub     *pubsub.Subscription
 	ctx     context.Context
 	cancel  context.CancelFunc
+
+	topics    map[string]*pubsub.Topic        // Temas de las colecciones
+	subs      map[string]*pubsub.Subscription // Suscripciones a los temas de las colecciones
+	announced map[string]bool                 // Colecciones anunciadas por este nodo
+
+	outbox           *Outbox               // Escrituras locales pendientes de replicar
+	delivered        map[string]*seqWindow // Escrituras recibidas de cada nodo y época
+	pendingDelivered map[string][]uint64   // Escrituras recibidas pendientes de confirmar
+
+	mutex sync.Mutex
+}
+
+// DBSyncOption es una función que configura la sincronización
+type DBSyncOption func(*DBSync)
+
+// WithClusterID antepone el identificador del clúster a los temas de
+// sincronización, de modo que no se mezclan los datos de distintos clústeres
+func WithClusterID(clusterID string) DBSyncOption {
+	return func(s *DBSync) {
+		s.cluster = clusterID
+	}
+}
+
+// WithPayloadCipher establece el cifrado de los mensajes de las colecciones
+// que la política de cifrado de la base de datos indica
+func WithPayloadCipher(cipher PayloadCipher) DBSyncOption {
+	return func(s *DBSync) {
+		s.cipher = cipher
+	}
 }
 
-// NewDBSync crea una nueva instancia de sincronización de base de datos
-func NewDBSync(ctx context.Context, db *Database, ps *pubsub.PubSub, nodeID string) (*DBSync, error) {
+// WithMissingKeyHandler establece la función con la que se pide una clave de
+// datos desconocida a los nodos de los que llega un mensaje cifrado con ella
+func WithMissingKeyHandler(handler func(keyID string, peers ...string)) DBSyncOption {
+	return func(s *DBSync) {
+		s.onMissingKey = handler
+	}
+}
+
+// NewDBSync crea una nueva instancia de sincronización de base de datos. Los
+// mensajes se firman con key, la clave privada del nodo nodeID.
+func NewDBSync(ctx context.Context, db *Database, ps *pubsub.PubSub, nodeID string, key crypto.PrivKey, options ...DBSyncOption) (*DBSync, error) {
 	log.Printf("Creando nueva instancia de sincronización de base de datos...")
 
+	if key == nil {
+		return nil, fmt.Errorf("se necesita la clave privada del nodo para firmar los mensajes")
+	}
+
 	// Crear contexto cancelable
 	syncCtx, cancel := context.WithCancel(ctx)
 
-	// Crear o unirse al tema de sincronización de base de datos
-	topic, err := ps.Join("db-sync")
+	sync := &DBSync{
+		db:        db,
+		pubsub:    ps,
+		nodeID:    nodeID,
+		key:       key,
+		enabled:   true,
+		ctx:       syncCtx,
+		cancel:    cancel,
+		topics:    make(map[string]*pubsub.Topic),
+		subs:      make(map[string]*pubsub.Subscription),
+		announced: make(map[string]bool),
+
+		delivered:        make(map[string]*seqWindow),
+		pendingDelivered: make(map[string][]uint64),
+	}
+
+	// Aplicar opciones
+	for _, option := range options {
+		option(sync)
+	}
+	if db.EncryptionPolicy().Enabled && sync.cipher == nil {
+		cancel()
+		return nil, fmt.Errorf("el cifrado de la replicación está habilitado pero no hay clave de datos")
+	}
+
+	// Abrir el outbox con las escrituras que quedaron sin replicar
+	outboxDir := ""
+	if db.persistenceEnabled {
+		outboxDir = db.dataDir
+	}
+	outbox, err := OpenOutbox(outboxDir)
 	if err != nil {
+		cancel()
+		return nil, err
+	}
+	sync.outbox = outbox
+
+	// Verificar los mensajes antes de aplicarlos o reenviarlos
+	if err := ps.RegisterTopicValidator(sync.topicName(controlTopic), pubsub.ValidatorEx(sync.validateMessage)); err != nil {
+		outbox.Close()
+		cancel()
+		return nil, fmt.Errorf("error al registrar el validador de sincronización: %v", err)
+	}
+
+	// Crear o unirse al tema de control
+	topic, err := ps.Join(sync.topicName(controlTopic))
+	if err != nil {
+		outbox.Close()
 		cancel()
 		return nil, fmt.Errorf("error al unirse al tema de sincronización: %v", err)
 	}
 
-	log.Printf("Unido al tema de sincronización 'db-sync'")
+	log.Printf("Unido al tema de sincronización '%s'", sync.topicName(controlTopic))
 
 	// Suscribirse al tema
 	sub, err := topic.Subscribe()
 	if err != nil {
+		outbox.Close()
 		cancel()
 		return nil, fmt.Errorf("error al suscribirse al tema: %v", err)
 	}
 
 	log.Printf("Suscrito al tema de sincronización")
 
-	// Crear la instancia de sincronización
-	sync := &DBSync{
-		db:      db,
-		topic:   topic,
-		pubsub:  ps,
-		nodeID:  nodeID,
-		enabled: true,
-		sub:     sub,
-		ctx:     syncCtx,
-		cancel:  cancel,
-	}
+	// Marcar las escrituras locales con el identificador del nodo
+	db.SetNodeID(nodeID)
+
+	sync.topic = topic
+	sync.sub = sub
+
+	// Suscribirse a las colecciones que recibe el nodo y anunciar las que publica
+	sync.subscribeCollections()
+	sync.announceCollections()
 
-	// Iniciar la escucha de mensajes
+	// Iniciar la escucha de mensajes, el envío del outbox, la limpieza de lápidas
+	// y la búsqueda de colecciones nuevas
 	go sync.listenForUpdates(syncCtx, sub)
+	go sync.outboxLoop(syncCtx)
+	go sync.confirmLoop(syncCtx)
+	go sync.collectTombstonesLoop(syncCtx)
+	go sync.watchCollectionsLoop(syncCtx)
 
 	log.Printf("Sincronización de base de datos iniciada correctamente")
 	return sync, nil
 }
 
-// PublishCreate publica un mensaje de creación de documento
+// PublishCreate registra en el outbox la creación de un documento para publicarla
 func (s *DBSync) PublishCreate(doc *Document) error {
 	msg := DBMessage{
 		Operation: OperationCreate,
 		Document:  doc,
 	}
-	return s.publishMessage(msg)
+	return s.enqueue(msg)
 }
 
-// PublishUpdate publica un mensaje de actualización de documento
+// PublishUpdate registra en el outbox la actualización de un documento para publicarla
 func (s *DBSync) PublishUpdate(doc *Document) error {
 	msg := DBMessage{
 		Operation: OperationUpdate,
 		Document:  doc,
 	}
-	return s.publishMessage(msg)
+	return s.enqueue(msg)
 }
 
-// PublishDelete publica un mensaje de eliminación de documento
-func (s *DBSync) PublishDelete(docID string) error {
+// PublishDelete registra en el outbox la eliminación de un documento, con su
+// lápida, para publicarla
+func (s *DBSync) PublishDelete(tombstone *Tombstone) error {
 	msg := DBMessage{
 		Operation:  OperationDelete,
-		DocumentID: docID,
+		DocumentID: tombstone.ID,
+		Tombstone:  tombstone,
+	}
+	return s.enqueue(msg)
+}
+
+// PublishAcks publica la confirmación de las eliminaciones recibidas
+func (s *DBSync) PublishAcks(acks []TombstoneAck) error {
+	msg := DBMessage{
+		Operation: OperationAck,
+		Acks:      acks,
 	}
 	return s.publishMessage(msg)
 }
 
-// publishMessage serializa y publica un mensaje en el tema
+// PublishBatch registra en el outbox las operaciones de una transacción para
+// publicarlas en un único mensaje
+func (s *DBSync) PublishBatch(batch []DBMessage) error {
+	msg := DBMessage{
+		Operation: OperationBatch,
+		Batch:     batch,
+	}
+	return s.enqueue(msg)
+}
+
+// publishMessage publica un mensaje en el tema de la colección a la que afecta.
+// Lo que la política de replicación no permite enviar se descarta; un lote se
+// publica en el tema de cada una de sus colecciones. Las confirmaciones y
+// anuncios van por el tema de control.
 func (s *DBSync) publishMessage(msg DBMessage) error {
-	data, err := json.Marshal(msg)
+	if msg.Operation == OperationAck || msg.Operation == OperationAnnounce {
+		return s.publishTo(s.topic, msg)
+	}
+
+	msg, collections := s.route(msg)
+	for _, collection := range collections {
+		topic, err := s.topicFor(collection)
+		if err != nil {
+			return err
+		}
+		if err := s.publishTo(topic, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// route devuelve el mensaje sin las operaciones que la política de replicación
+// no permite enviar y las colecciones en cuyos temas se publica, ninguna si no
+// queda nada que enviar
+func (s *DBSync) route(msg DBMessage) (DBMessage, []string) {
+	policy := s.db.ReplicationPolicy()
+	var collections []string
+	if msg.Operation == OperationBatch {
+		batch := make([]DBMessage, 0, len(msg.Batch))
+		for _, operation := range msg.Batch {
+			collection := messageCollection(operation)
+			if !publishable(policy, operation) {
+				continue
+			}
+			batch = append(batch, operation)
+			if !slices.Contains(collections, collection) {
+				collections = append(collections, collection)
+			}
+		}
+		if len(batch) == 0 {
+			return msg, nil
+		}
+		msg.Batch = batch
+		slices.SortFunc(collections, policy.CompareCollections)
+	} else {
+		if !publishable(policy, msg) {
+			return msg, nil
+		}
+		collections = []string{messageCollection(msg)}
+	}
+	return msg, collections
+}
+
+// publishTo firma y publica un mensaje en un tema, cifrado si afecta a alguna
+// colección cifrada
+func (s *DBSync) publishTo(topic *pubsub.Topic, msg DBMessage) error {
+	var cipher PayloadCipher
+	if s.db.EncryptionPolicy().encryptsMessage(msg) {
+		if s.cipher == nil {
+			return fmt.Errorf("no hay clave de datos para cifrar el mensaje")
+		}
+		cipher = s.cipher
+	}
+
+	data, err := sealMessage(s.key, s.nodeID, msg, cipher)
 	if err != nil {
 		return err
 	}
@@ -121,7 +336,7 @@ func (s *DBSync) publishMessage(msg DBMessage) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err = s.topic.Publish(ctx, data)
+	err = topic.Publish(ctx, data)
 	if err != nil {
 		log.Printf("Error al publicar mensaje de sincronización: %v", err)
 		return err
@@ -131,6 +346,160 @@ func (s *DBSync) publishMessage(msg DBMessage) error {
 	return nil
 }
 
+// messageCollection obtiene la colección del documento de un mensaje
+func messageCollection(msg DBMessage) string {
+	if msg.Document != nil {
+		return msg.Document.Collection
+	}
+	if msg.Tombstone != nil {
+		return msg.Tombstone.Collection
+	}
+	return ""
+}
+
+// publishable indica si la política permite enviar una operación. Las
+// eliminaciones no tienen datos que filtrar y se envían si se publica su colección.
+func publishable(policy ReplicationPolicy, msg DBMessage) bool {
+	collection := messageCollection(msg)
+	if collection == "" || !policy.Publishes(collection) {
+		return false
+	}
+	return msg.Document == nil || policy.Matches(msg.Document)
+}
+
+// topicFor devuelve el tema de una colección y la anuncia la primera vez que
+// el nodo publica en ella
+func (s *DBSync) topicFor(collection string) (*pubsub.Topic, error) {
+	s.mutex.Lock()
+	topic, err := s.joinLocked(collection)
+	announce := err == nil && !s.announced[collection]
+	s.announced[collection] = true
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if announce {
+		s.announce([]string{collection})
+	}
+	return topic, nil
+}
+
+// topicName devuelve el nombre de un tema de sincronización en el clúster del nodo
+func (s *DBSync) topicName(name string) string {
+	if s.cluster == "" {
+		return name
+	}
+	return s.cluster + "/" + name
+}
+
+// joinLocked se une al tema de una colección si no lo había hecho.
+// Debe llamarse con el mutex de la sincronización bloqueado.
+func (s *DBSync) joinLocked(collection string) (*pubsub.Topic, error) {
+	if topic, exists := s.topics[collection]; exists {
+		return topic, nil
+	}
+	if err := s.pubsub.RegisterTopicValidator(s.topicName(CollectionTopic(collection)), pubsub.ValidatorEx(s.validateMessage)); err != nil {
+		return nil, fmt.Errorf("error al registrar el validador de la colección %s: %v", collection, err)
+	}
+	topic, err := s.pubsub.Join(s.topicName(CollectionTopic(collection)))
+	if err != nil {
+		return nil, fmt.Errorf("error al unirse al tema de la colección %s: %v", collection, err)
+	}
+	s.topics[collection] = topic
+	return topic, nil
+}
+
+// subscribe se suscribe al tema de una colección si la política lo permite
+func (s *DBSync) subscribe(collection string) error {
+	if !s.db.ReplicationPolicy().Subscribes(collection) {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.subs[collection]; exists || !s.enabled {
+		return nil
+	}
+	topic, err := s.joinLocked(collection)
+	if err != nil {
+		return err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("error al suscribirse a la colección %s: %v", collection, err)
+	}
+	s.subs[collection] = sub
+
+	go s.listenForUpdates(s.ctx, sub)
+	log.Printf("Suscrito a la colección '%s'", collection)
+	return nil
+}
+
+// subscribeCollections se suscribe a las colecciones que recibe el nodo: las
+// indicadas en la política o, si recibe todas, las que conoce
+func (s *DBSync) subscribeCollections() {
+	collections := s.db.ReplicationPolicy().Subscribe
+	if len(collections) == 0 {
+		collections, _ = s.db.GetCollections()
+	}
+	for _, collection := range collections {
+		if err := s.subscribe(collection); err != nil {
+			log.Printf("Error al suscribirse a la colección %s: %v", collection, err)
+		}
+	}
+}
+
+// announceCollections anuncia las colecciones locales que publica el nodo, para
+// que los nodos que reciben todas se suscriban a ellas
+func (s *DBSync) announceCollections() {
+	policy := s.db.ReplicationPolicy()
+	collections, _ := s.db.GetCollections()
+	collections = slices.DeleteFunc(collections, func(collection string) bool {
+		return !policy.Publishes(collection)
+	})
+	if len(collections) == 0 {
+		return
+	}
+	slices.SortFunc(collections, policy.CompareCollections)
+
+	s.mutex.Lock()
+	for _, collection := range collections {
+		s.announced[collection] = true
+	}
+	s.mutex.Unlock()
+
+	s.announce(collections)
+}
+
+// announce publica un anuncio de colecciones en el tema de control
+func (s *DBSync) announce(collections []string) {
+	msg := DBMessage{
+		Operation:   OperationAnnounce,
+		Collections: collections,
+	}
+	if err := s.publishMessage(msg); err != nil {
+		log.Printf("Error al anunciar colecciones: %v", err)
+	}
+}
+
+// watchCollectionsLoop se suscribe periódicamente a las colecciones que el nodo
+// ha conocido por otras vías, como la sincronización punto a punto
+func (s *DBSync) watchCollectionsLoop(ctx context.Context) {
+	ticker := time.NewTicker(collectionScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.subscribeCollections()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 // getDocumentID obtiene el ID del documento de un mensaje
 func getDocumentID(msg DBMessage) string {
 	if msg.Document != nil {
@@ -166,75 +535,213 @@ func (s *DBSync) listenForUpdates(ctx context.Context, sub *pubsub.Subscription)
 
 		log.Printf("Mensaje de sincronización recibido de: %s", msg.ReceivedFrom.String())
 
-		// Deserializar el mensaje
-		var dbMsg DBMessage
-		if err := json.Unmarshal(msg.Data, &dbMsg); err != nil {
-			log.Printf("Error deserializando mensaje: %v", err)
+		// El validador del tema ya ha verificado la firma y los permisos
+		dbMsg, ok := msg.ValidatorData.(*DBMessage)
+		if !ok {
+			var err error
+			if dbMsg, err = s.verify(msg); err != nil {
+				continue
+			}
+		}
+
+		// El nodo de origen deberá confirmar las eliminaciones antes de limpiarlas
+		sender := msg.GetFrom().String()
+		s.db.AddPeer(sender)
+
+		// Una escritura ya aplicada, reenviada desde el outbox de su origen, solo
+		// se vuelve a confirmar
+		stream := outboxStream(sender, dbMsg.Epoch)
+		if dbMsg.Seq > 0 && s.received(stream, dbMsg.Seq) {
+			s.confirm(stream, dbMsg.Seq)
 			continue
 		}
 
-		// Procesar el mensaje según la operación
+		// Procesar el mensaje según la operación, descartando lo que la política
+		// de replicación no permite recibir
+		policy := s.db.ReplicationPolicy()
 		switch dbMsg.Operation {
-		case OperationCreate:
-			if dbMsg.Document != nil {
-				// Añadir directamente el documento al almacén local
-				s.db.mutex.Lock()
-				s.db.documents[dbMsg.Document.ID] = dbMsg.Document
-				s.db.mutex.Unlock()
-
-				// Persistir el documento si está habilitada la persistencia
-				if s.db.persistenceEnabled {
-					if err := s.db.persistence.SaveDocument(dbMsg.Document); err != nil {
-						log.Printf("Error al persistir documento sincronizado: %v", err)
-					}
+		case OperationCreate, OperationUpdate:
+			if dbMsg.Document != nil && policy.Accepts(dbMsg.Document) {
+				// Fusionar el documento con la versión local y persistir el resultado
+				if _, err := s.db.ApplyRemoteDocument(dbMsg.Document); err != nil {
+					log.Printf("Error al aplicar documento sincronizado: %v", err)
+					continue
 				}
 
-				fmt.Printf("Documento sincronizado (creado): %s\n", dbMsg.Document.ID)
+				fmt.Printf("Documento sincronizado (%s): %s\n", dbMsg.Operation, dbMsg.Document.ID)
 			}
 
-		case OperationUpdate:
-			if dbMsg.Document != nil {
-				// Actualizar el documento en el almacén local
-				s.db.mutex.Lock()
-				s.db.documents[dbMsg.Document.ID] = dbMsg.Document
-				s.db.mutex.Unlock()
-
-				// Persistir el documento si está habilitada la persistencia
-				if s.db.persistenceEnabled {
-					if err := s.db.persistence.UpdateDocument(dbMsg.Document); err != nil {
-						log.Printf("Error al persistir actualización sincronizada: %v", err)
-					}
+		case OperationDelete:
+			if tombstone := s.tombstoneFor(*dbMsg); tombstone != nil && policy.Subscribes(tombstone.Collection) {
+				// Registrar la lápida y eliminar el documento si es anterior a ella
+				if _, err := s.db.ApplyRemoteDelete(tombstone, sender); err != nil {
+					log.Printf("Error al aplicar eliminación sincronizada: %v", err)
+					continue
 				}
+				s.acknowledge([]TombstoneAck{tombstone.Ack()})
 
-				fmt.Printf("Documento sincronizado (actualizado): %s\n", dbMsg.Document.ID)
+				fmt.Printf("Documento sincronizado (eliminado): %s\n", tombstone.ID)
 			}
 
-		case OperationDelete:
-			if dbMsg.DocumentID != "" {
-				// Obtener la colección del documento antes de eliminarlo
-				var collection string
-				s.db.mutex.RLock()
-				if doc, exists := s.db.documents[dbMsg.DocumentID]; exists {
-					collection = doc.Collection
+		case OperationAck:
+			s.db.AcknowledgeTombstones(sender, dbMsg.Acks)
+			if seqs := s.confirmed(dbMsg.Delivered); len(seqs) > 0 {
+				if err := s.outbox.Remove(seqs); err != nil {
+					log.Printf("Error al actualizar el outbox: %v", err)
 				}
-				s.db.mutex.RUnlock()
-
-				// Eliminar el documento del almacén local
-				s.db.mutex.Lock()
-				delete(s.db.documents, dbMsg.DocumentID)
-				s.db.mutex.Unlock()
-
-				// Persistir la eliminación si está habilitada la persistencia y se conoce la colección
-				if s.db.persistenceEnabled && collection != "" {
-					if err := s.db.persistence.DeleteDocument(collection, dbMsg.DocumentID); err != nil {
-						log.Printf("Error al persistir eliminación sincronizada: %v", err)
-					}
+			}
+
+		case OperationAnnounce:
+			for _, collection := range dbMsg.Collections {
+				if err := s.subscribe(collection); err != nil {
+					log.Printf("Error al suscribirse a la colección %s: %v", collection, err)
 				}
+			}
 
-				fmt.Printf("Documento sincronizado (eliminado): %s\n", dbMsg.DocumentID)
+		case OperationBatch:
+			if err := s.applyBatch(dbMsg.Batch, sender); err != nil {
+				log.Printf("Error al aplicar transacción sincronizada: %v", err)
+				continue
 			}
 		}
+
+		// Confirmar la escritura al nodo de origen para que la saque de su outbox.
+		// Las que no se pudieron aplicar no se confirman y el origen las reenvía.
+		if dbMsg.Seq > 0 {
+			s.confirm(stream, dbMsg.Seq)
+		}
+	}
+}
+
+// tombstoneFor devuelve la lápida de un mensaje de eliminación. Los mensajes de
+// versiones anteriores solo traen el ID, así que la eliminación se marca con el
+// reloj local; si el documento no existe no hay nada que registrar.
+func (s *DBSync) tombstoneFor(msg DBMessage) *Tombstone {
+	if msg.Tombstone != nil {
+		return msg.Tombstone
+	}
+	if msg.DocumentID == "" {
+		return nil
+	}
+
+	s.db.mutex.RLock()
+	doc, exists := s.db.documents[msg.DocumentID]
+	s.db.mutex.RUnlock()
+	if !exists {
+		return nil
 	}
+	return &Tombstone{ID: doc.ID, Collection: doc.Collection, Deleted: s.db.clock.Now()}
+}
+
+// acknowledge confirma a los demás nodos las eliminaciones recibidas
+func (s *DBSync) acknowledge(acks []TombstoneAck) {
+	if len(acks) == 0 {
+		return
+	}
+	if err := s.PublishAcks(acks); err != nil {
+		log.Printf("Error al confirmar eliminaciones: %v", err)
+	}
+}
+
+// collectTombstonesLoop limpia periódicamente las lápidas confirmadas por todos los nodos
+func (s *DBSync) collectTombstonesLoop(ctx context.Context) {
+	ticker := time.NewTicker(tombstoneGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			collected, err := s.db.CollectTombstones()
+			if err != nil {
+				log.Printf("Error al limpiar lápidas: %v", err)
+			} else if collected > 0 {
+				log.Printf("Lápidas eliminadas: %d", collected)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyBatch aplica las operaciones de una transacción remota bajo un único
+// bloqueo, de modo que las lecturas locales ven todas o ninguna. Devuelve un
+// error si el lote no es válido o no se pudo persistir.
+func (s *DBSync) applyBatch(batch []DBMessage, sender string) error {
+	// Rechazar el lote completo si alguna operación no es válida
+	for _, msg := range batch {
+		switch msg.Operation {
+		case OperationCreate, OperationUpdate:
+			if msg.Document == nil {
+				return fmt.Errorf("lote descartado: operación %s sin documento", msg.Operation)
+			}
+		case OperationDelete:
+			if msg.DocumentID == "" && msg.Tombstone == nil {
+				return fmt.Errorf("lote descartado: eliminación sin ID")
+			}
+		default:
+			return fmt.Errorf("lote descartado: operación desconocida %s", msg.Operation)
+		}
+	}
+
+	operations := make([]Transaction, 0, len(batch))
+	var acks []TombstoneAck
+
+	// Un lote se publica en el tema de cada colección que incluye: solo se
+	// aplican las operaciones de las colecciones que recibe el nodo
+	policy := s.db.ReplicationPolicy()
+
+	s.db.mutex.Lock()
+	for _, msg := range batch {
+		if msg.Operation == OperationDelete {
+			tombstone := msg.Tombstone
+			if tombstone == nil {
+				local, exists := s.db.documents[msg.DocumentID]
+				if !exists {
+					continue
+				}
+				tombstone = &Tombstone{ID: local.ID, Collection: local.Collection, Deleted: s.db.clock.Now()}
+			}
+			if !policy.Subscribes(tombstone.Collection) {
+				continue
+			}
+			acks = append(acks, tombstone.Ack())
+
+			doc := s.db.applyRemoteDeleteLocked(tombstone, sender)
+			if doc == nil {
+				continue
+			}
+			operation, _ := newTransaction(OperationDelete, doc.ID, nil)
+			operation.Collection = doc.Collection
+			operations = append(operations, operation)
+			continue
+		}
+
+		if !policy.Accepts(msg.Document) {
+			continue
+		}
+		doc, changed := s.db.applyRemoteLocked(msg.Document)
+		if !changed {
+			continue
+		}
+		operation, _ := newTransaction(msg.Operation, doc.ID, doc)
+		operations = append(operations, operation)
+	}
+	if err := s.db.saveTombstonesLocked(); err != nil {
+		s.db.mutex.Unlock()
+		return fmt.Errorf("error al persistir lápidas sincronizadas: %v", err)
+	}
+	s.db.mutex.Unlock()
+	s.acknowledge(acks)
+
+	// Persistir la transacción si está habilitada la persistencia
+	if s.db.persistenceEnabled && len(operations) > 0 {
+		if err := s.db.persistence.CommitTransaction(operations); err != nil {
+			return fmt.Errorf("error al persistir transacción sincronizada: %v", err)
+		}
+	}
+
+	fmt.Printf("Transacción sincronizada: %d operaciones\n", len(operations))
+	return nil
 }
 
 // Close cierra la sincronización de base de datos
@@ -247,7 +754,21 @@ func (s *DBSync) Close() error {
 		s.sub.Cancel()
 	}
 
+	s.mutex.Lock()
+	for _, sub := range s.subs {
+		sub.Cancel()
+	}
+	s.pubsub.UnregisterTopicValidator(s.topicName(controlTopic))
+	for collection := range s.topics {
+		s.pubsub.UnregisterTopicValidator(s.topicName(CollectionTopic(collection)))
+	}
 	s.enabled = false
+	s.mutex.Unlock()
+
+	if err := s.outbox.Close(); err != nil {
+		log.Printf("Error al cerrar el outbox: %v", err)
+	}
+
 	log.Printf("Sincronización de base de datos cerrada")
 	return nil
 }
@@ -257,25 +778,35 @@ func (s *DBSync) IsEnabled() bool {
 	return s.enabled
 }
 
-// SyncAllDocuments sincroniza todos los documentos con la red
+// SyncAllDocuments sincroniza todos los documentos con la red. Las escrituras
+// pendientes del outbox se reenvían con su número de secuencia, de modo que los
+// nodos que ya las aplicaron las descartan, y el resto de documentos se publica
+// una vez; aplicarlos de nuevo no cambia nada en los nodos que ya los tienen.
 func (s *DBSync) SyncAllDocuments() error {
 	if !s.enabled {
 		return fmt.Errorf("sincronización no habilitada")
 	}
 
 	log.Printf("Iniciando sincronización completa de documentos...")
+	s.outbox.RetryNow()
 
-	// Obtener todos los documentos
+	// Obtener los documentos que publica el nodo, primero los de las colecciones prioritarias
+	policy := s.db.ReplicationPolicy()
 	s.db.mutex.RLock()
 	documents := make([]*Document, 0, len(s.db.documents))
 	for _, doc := range s.db.documents {
-		documents = append(documents, doc)
+		if policy.ShouldPublish(doc) && !s.outbox.Pending(doc.ID) {
+			documents = append(documents, doc)
+		}
 	}
 	s.db.mutex.RUnlock()
+	slices.SortStableFunc(documents, func(a, b *Document) int {
+		return policy.CompareCollections(a.Collection, b.Collection)
+	})
 
 	// Publicar cada documento
 	for _, doc := range documents {
-		err := s.PublishCreate(doc)
+		err := s.publishMessage(DBMessage{Operation: OperationCreate, Document: doc})
 		if err != nil {
 			log.Printf("Error al sincronizar documento %s: %v", doc.ID, err)
 		}
@@ -284,6 +815,20 @@ func (s *DBSync) SyncAllDocuments() error {
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	log.Printf("Sincronización completa finalizada: %d documentos sincronizados", len(documents))
+	// Publicar las eliminaciones para que no se resuciten documentos en los nodos
+	// que no las recibieron
+	tombstones := slices.DeleteFunc(s.db.GetTombstones(time.Time{}), func(tombstone *Tombstone) bool {
+		return !policy.Publishes(tombstone.Collection) || s.outbox.Pending(tombstone.ID)
+	})
+	for _, tombstone := range tombstones {
+		msg := DBMessage{Operation: OperationDelete, DocumentID: tombstone.ID, Tombstone: tombstone}
+		if err := s.publishMessage(msg); err != nil {
+			log.Printf("Error al sincronizar eliminación %s: %v", tombstone.ID, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	log.Printf("Sincronización completa finalizada: %d documentos y %d eliminaciones sincronizados", len(documents), len(tombstones))
 	return nil
 }
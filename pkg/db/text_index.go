@@ -0,0 +1,486 @@
+package db
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// TextLanguageSpanish analizador para texto en español
+	TextLanguageSpanish = "es"
+	// TextLanguageEnglish analizador para texto en inglés
+	TextLanguageEnglish = "en"
+	// TextLanguageNone analizador sin palabras vacías ni stemming
+	TextLanguageNone = "none"
+
+	// TextScoreField campo por el que se puede ordenar la relevancia de una búsqueda de texto
+	TextScoreField = "score"
+
+	// Parámetros de BM25
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// textFieldGap separación de posiciones entre campos para que las frases no crucen campos
+	textFieldGap = 100
+)
+
+// accentFolding convierte las letras acentuadas en su forma sin acento
+var accentFolding = map[rune]rune{
+	'á': 'a', 'à': 'a', 'â': 'a', 'ä': 'a',
+	'é': 'e', 'è': 'e', 'ê': 'e', 'ë': 'e',
+	'í': 'i', 'ì': 'i', 'î': 'i', 'ï': 'i',
+	'ó': 'o', 'ò': 'o', 'ô': 'o', 'ö': 'o',
+	'ú': 'u', 'ù': 'u', 'û': 'u', 'ü': 'u',
+	'ñ': 'n', 'ç': 'c',
+}
+
+// spanishStopwords palabras vacías en español (sin acentos)
+var spanishStopwords = stopwordSet(`a al algo algunas algunos ante antes como con contra cual cuando de del desde
+donde durante e el ella ellas ellos en entre era erais eran eras eres es esa esas ese eso esos esta estaba estado
+estais estamos estan estar estas este esto estos estoy fue fueron fui ha habia han has hasta hay la las le les lo
+los mas me mi mis mucho muy nada ni no nos nosotros o os otra otras otro otros para pero poco por porque que quien
+se sea ser si sin sobre son su sus tambien tanto te tiene tienen todo todos tu tus un una uno unos y ya yo`)
+
+// englishStopwords palabras vacías en inglés
+var englishStopwords = stopwordSet(`a an and are as at be but by for from has have he her his i if in into is it its
+of on or our she so such that the their then there these they this to was we were what when where which who will
+with you your`)
+
+// stopwordSet construye un conjunto de palabras vacías
+func stopwordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// Analyzer convierte texto en términos indexables: pasa a minúsculas, elimina
+// acentos, descarta palabras vacías y reduce cada palabra a su raíz
+type Analyzer struct {
+	Language  string
+	stopwords map[string]bool
+	stem      func(string) string
+}
+
+// NewAnalyzer crea un analizador para un idioma. Un idioma vacío equivale a español.
+func NewAnalyzer(language string) *Analyzer {
+	switch language {
+	case TextLanguageEnglish:
+		return &Analyzer{Language: language, stopwords: englishStopwords, stem: stemEnglish}
+	case TextLanguageNone:
+		return &Analyzer{Language: language, stopwords: map[string]bool{}, stem: func(s string) string { return s }}
+	default:
+		return &Analyzer{Language: TextLanguageSpanish, stopwords: spanishStopwords, stem: stemSpanish}
+	}
+}
+
+// textToken es un término con su posición en el texto
+type textToken struct {
+	term     string
+	position int
+}
+
+// normalize pasa una palabra a minúsculas y elimina los acentos
+func (a *Analyzer) normalize(word string) string {
+	return strings.Map(func(r rune) rune {
+		r = unicode.ToLower(r)
+		if folded, ok := accentFolding[r]; ok {
+			return folded
+		}
+		return r
+	}, word)
+}
+
+// Analyze divide el texto en términos. Las palabras vacías se descartan pero
+// conservan su posición, de modo que las frases se comparan con sus huecos.
+func (a *Analyzer) Analyze(text string) []textToken {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := make([]textToken, 0, len(words))
+	for position, word := range words {
+		word = a.normalize(word)
+		if a.stopwords[word] {
+			continue
+		}
+		tokens = append(tokens, textToken{term: a.stem(word), position: position})
+	}
+
+	return tokens
+}
+
+// analyzeFields analiza varios textos como un único documento, separando las
+// posiciones de cada campo
+func (a *Analyzer) analyzeFields(texts []string) map[string][]int {
+	positions := make(map[string][]int)
+	offset := 0
+	for _, text := range texts {
+		last := 0
+		for _, token := range a.Analyze(text) {
+			positions[token.term] = append(positions[token.term], offset+token.position)
+			last = token.position
+		}
+		offset += last + textFieldGap
+	}
+	return positions
+}
+
+// stemSpanish reduce una palabra en español a su raíz (stemmer ligero: plurales
+// y género). El plural se quita antes que el género, de modo que el singular y
+// el plural de una palabra llegan a la misma raíz con la misma longitud mínima.
+func stemSpanish(word string) string {
+	s := []rune(word)
+
+	// Plurales: -ces de las palabras en z, -es tras consonante y -s tras vocal
+	if n := len(s); n > 3 && s[n-1] == 's' {
+		switch {
+		case n > 4 && s[n-2] == 'e' && s[n-3] == 'c':
+			s = append(s[:n-3], 'z')
+		case n > 4 && s[n-2] == 'e' && !isSpanishVowel(s[n-3]):
+			s = s[:n-2]
+		case isSpanishVowel(s[n-2]):
+			s = s[:n-1]
+		}
+	}
+
+	// Género: vocal final tras una raíz de al menos tres letras
+	if n := len(s); n > 3 && (s[n-1] == 'o' || s[n-1] == 'a' || s[n-1] == 'e') {
+		s = s[:n-1]
+	}
+
+	return string(s)
+}
+
+// isSpanishVowel indica si una letra sin acento es vocal
+func isSpanishVowel(r rune) bool {
+	return r == 'a' || r == 'e' || r == 'i' || r == 'o' || r == 'u'
+}
+
+// stemEnglish reduce una palabra en inglés a su forma singular (stemmer mínimo)
+func stemEnglish(word string) string {
+	s := []rune(word)
+	n := len(s)
+	if n < 3 || s[n-1] != 's' {
+		return word
+	}
+
+	switch s[n-2] {
+	case 'u', 's':
+		return word
+	case 'e':
+		if n > 3 && s[n-3] == 'i' && s[n-4] != 'a' && s[n-4] != 'e' {
+			s[n-3] = 'y'
+			return string(s[:n-2])
+		}
+		// -es tras x, ch, sh y ss: boxes, watches, dishes, classes
+		if n > 4 && (s[n-3] == 'x' || (s[n-3] == 'h' && (s[n-4] == 'c' || s[n-4] == 's')) || (s[n-3] == 's' && s[n-4] == 's')) {
+			return string(s[:n-2])
+		}
+		if s[n-3] == 'i' || s[n-3] == 'a' || s[n-3] == 'o' || s[n-3] == 'e' {
+			return word
+		}
+	}
+
+	return string(s[:n-1])
+}
+
+// textQuery es una búsqueda de texto analizada. Las palabras sueltas y los
+// prefijos (palabra*) son alternativos; las frases entre comillas son obligatorias.
+type textQuery struct {
+	terms    []string
+	prefixes []string
+	phrases  [][]textToken
+}
+
+// parseTextQuery analiza una búsqueda de texto
+func parseTextQuery(analyzer *Analyzer, query string) *textQuery {
+	q := &textQuery{}
+
+	// Separar las frases entre comillas del resto
+	parts := strings.Split(query, `"`)
+	for i, part := range parts {
+		if i%2 == 1 {
+			if tokens := analyzer.Analyze(part); len(tokens) > 0 {
+				q.phrases = append(q.phrases, tokens)
+			}
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			if strings.HasSuffix(word, "*") {
+				prefix := analyzer.normalize(strings.TrimRight(word, "*"))
+				if prefix = strings.TrimFunc(prefix, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }); prefix != "" {
+					q.prefixes = append(q.prefixes, analyzer.stem(prefix))
+				}
+				continue
+			}
+			for _, token := range analyzer.Analyze(word) {
+				q.terms = append(q.terms, token.term)
+			}
+		}
+	}
+
+	return q
+}
+
+// isEmpty indica si la búsqueda no contiene ningún término
+func (q *textQuery) isEmpty() bool {
+	return len(q.terms) == 0 && len(q.prefixes) == 0 && len(q.phrases) == 0
+}
+
+// matches verifica si un documento, dado por las posiciones de sus términos, cumple la búsqueda
+func (q *textQuery) matches(positions map[string][]int) bool {
+	if q.isEmpty() {
+		return false
+	}
+
+	// Todas las frases deben aparecer
+	for _, phrase := range q.phrases {
+		if !phraseMatches(phrase, func(term string) []int { return positions[term] }) {
+			return false
+		}
+	}
+
+	// Si solo hay frases, basta con que aparezcan
+	if len(q.terms) == 0 && len(q.prefixes) == 0 {
+		return true
+	}
+
+	// Al menos una palabra o prefijo debe aparecer
+	for _, term := range q.terms {
+		if len(positions[term]) > 0 {
+			return true
+		}
+	}
+	for _, prefix := range q.prefixes {
+		for term := range positions {
+			if strings.HasPrefix(term, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// phraseMatches verifica si los términos de una frase aparecen consecutivos
+func phraseMatches(phrase []textToken, positions func(term string) []int) bool {
+	first := phrase[0]
+	for _, start := range positions(first.term) {
+		found := true
+		for _, token := range phrase[1:] {
+			expected := start + token.position - first.position
+			if !containsInt(positions(token.term), expected) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt verifica si una lista ordenada de posiciones contiene un valor
+func containsInt(values []int, value int) bool {
+	i := sort.SearchInts(values, value)
+	return i < len(values) && values[i] == value
+}
+
+// textIndex es un índice invertido con las posiciones de cada término por documento
+type textIndex struct {
+	analyzer    *Analyzer
+	postings    map[string]map[string][]int // término -> ID de documento -> posiciones
+	terms       *skipList                   // Términos ordenados, para las búsquedas por prefijo
+	docTerms    map[string][]string         // ID de documento -> términos
+	docLengths  map[string]int              // ID de documento -> número de términos
+	totalLength int
+}
+
+// newTextIndex crea un índice invertido vacío
+func newTextIndex(analyzer *Analyzer) *textIndex {
+	return &textIndex{
+		analyzer:   analyzer,
+		postings:   make(map[string]map[string][]int),
+		terms:      newSkipList(),
+		docTerms:   make(map[string][]string),
+		docLengths: make(map[string]int),
+	}
+}
+
+// add indexa los textos de un documento, sustituyendo los anteriores
+func (ti *textIndex) add(docID string, texts []string) {
+	ti.remove(docID)
+
+	positions := ti.analyzer.analyzeFields(texts)
+	length := 0
+	terms := make([]string, 0, len(positions))
+	for term, termPositions := range positions {
+		docs, exists := ti.postings[term]
+		if !exists {
+			docs = make(map[string][]int)
+			ti.postings[term] = docs
+			ti.terms.Insert(orderedKey{newOrderedValue(term)}, "")
+		}
+		docs[docID] = termPositions
+		terms = append(terms, term)
+		length += len(termPositions)
+	}
+
+	ti.docTerms[docID] = terms
+	ti.docLengths[docID] = length
+	ti.totalLength += length
+}
+
+// remove elimina un documento del índice
+func (ti *textIndex) remove(docID string) {
+	terms, exists := ti.docTerms[docID]
+	if !exists {
+		return
+	}
+
+	for _, term := range terms {
+		docs := ti.postings[term]
+		delete(docs, docID)
+		if len(docs) == 0 {
+			delete(ti.postings, term)
+			ti.terms.Delete(orderedKey{newOrderedValue(term)}, "")
+		}
+	}
+
+	ti.totalLength -= ti.docLengths[docID]
+	delete(ti.docTerms, docID)
+	delete(ti.docLengths, docID)
+}
+
+// expandPrefix devuelve los términos del índice que empiezan por el prefijo
+func (ti *textIndex) expandPrefix(prefix string) []string {
+	r := keyRange{
+		lower:          orderedKey{newOrderedValue(prefix)},
+		lowerInclusive: true,
+		upper:          orderedKey{prefixUpperBound(prefix)},
+	}
+
+	var terms []string
+	ti.terms.Scan(r, false, func(key orderedKey, _ string) bool {
+		terms = append(terms, key[0].str)
+		return true
+	})
+	return terms
+}
+
+// search devuelve los documentos candidatos para la búsqueda con su puntuación BM25.
+// Los candidatos contienen al menos uno de los términos buscados; la verificación
+// exacta (frases obligatorias) se hace al filtrar.
+func (ti *textIndex) search(q *textQuery) map[string]float64 {
+	// Reunir los términos que puntúan
+	terms := append([]string{}, q.terms...)
+	for _, prefix := range q.prefixes {
+		terms = append(terms, ti.expandPrefix(prefix)...)
+	}
+	for _, phrase := range q.phrases {
+		for _, token := range phrase {
+			terms = append(terms, token.term)
+		}
+	}
+
+	scores := make(map[string]float64)
+	docCount := float64(len(ti.docLengths))
+	if docCount == 0 {
+		return scores
+	}
+	avgLength := float64(ti.totalLength) / docCount
+
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+
+		docs := ti.postings[term]
+		if len(docs) == 0 {
+			continue
+		}
+
+		df := float64(len(docs))
+		idf := math.Log(1 + (docCount-df+0.5)/(df+0.5))
+		for docID, positions := range docs {
+			tf := float64(len(positions))
+			norm := 1 - bm25B + bm25B*float64(ti.docLengths[docID])/avgLength
+			scores[docID] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	return scores
+}
+
+// textValues extrae los textos de un valor: cadenas o listas de cadenas
+func textValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				texts = append(texts, s)
+			}
+		}
+		return texts
+	}
+	return nil
+}
+
+// getTexts obtiene los textos de los campos indexados de un documento
+func (idx *Index) getTexts(data map[string]interface{}) []string {
+	var texts []string
+	for _, field := range idx.Fields {
+		value, err := getFieldValue(data, field)
+		if err != nil {
+			continue
+		}
+		texts = append(texts, textValues(value)...)
+	}
+	return texts
+}
+
+// TextSearch busca documentos en un índice de texto y devuelve su puntuación de relevancia
+func (idx *Index) TextSearch(query string) map[string]float64 {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if idx.text == nil {
+		return map[string]float64{}
+	}
+
+	return idx.text.search(parseTextQuery(idx.text.analyzer, query))
+}
+
+// matchesText verifica si los datos de un documento cumplen una búsqueda de texto
+// sobre los campos del índice
+func (idx *Index) matchesText(data map[string]interface{}, q *textQuery) bool {
+	return q.matches(idx.textAnalyzer.analyzeFields(idx.getTexts(data)))
+}
+
+// rankByScore ordena los IDs por puntuación descendente
+func rankByScore(scores map[string]float64) []string {
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
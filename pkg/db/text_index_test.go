@@ -0,0 +1,78 @@
+package db
+
+import "testing"
+
+// TestStemSingularPlural comprueba que el singular y el plural de una palabra
+// se reduzcan a la misma raíz
+func TestStemSingularPlural(t *testing.T) {
+	cases := []struct {
+		language string
+		pairs    [][2]string
+	}{
+		{TextLanguageSpanish, [][2]string{
+			{"casa", "casas"},
+			{"gato", "gatos"},
+			{"coche", "coches"},
+			{"flor", "flores"},
+			{"mes", "meses"},
+			{"luz", "luces"},
+			{"canción", "canciones"},
+		}},
+		{TextLanguageEnglish, [][2]string{
+			{"cat", "cats"},
+			{"box", "boxes"},
+			{"watch", "watches"},
+			{"dish", "dishes"},
+			{"class", "classes"},
+			{"city", "cities"},
+		}},
+	}
+
+	for _, c := range cases {
+		analyzer := NewAnalyzer(c.language)
+		for _, pair := range c.pairs {
+			singular := analyzer.stem(analyzer.normalize(pair[0]))
+			plural := analyzer.stem(analyzer.normalize(pair[1]))
+			if singular != plural {
+				t.Errorf("%s: %q -> %q y %q -> %q, se esperaba la misma raíz", c.language, pair[0], singular, pair[1], plural)
+			}
+		}
+	}
+}
+
+// TestTextSearchMatchesPlurals comprueba que una búsqueda en singular encuentre
+// los documentos en plural y que BM25 puntúe más los que repiten el término en
+// un texto más corto
+func TestTextSearchMatchesPlurals(t *testing.T) {
+	idx := NewIndex("texto", "anuncios", []string{"titulo"}, IndexTypeText, WithLanguage(TextLanguageSpanish))
+	docs := map[string]string{
+		"a": "casas baratas en la costa",
+		"b": "casa con jardín y piscina junto a otras viviendas de la urbanización",
+		"c": "casas y más casas",
+		"d": "pisos en el centro",
+	}
+	for id, title := range docs {
+		if err := idx.AddDocument(&Document{ID: id, Data: map[string]interface{}{"titulo": title}}); err != nil {
+			t.Fatalf("error al indexar %s: %v", id, err)
+		}
+	}
+
+	ranked := idx.Search("casa")
+	if len(ranked) != 3 {
+		t.Fatalf("resultados = %v, se esperaban a, b y c", ranked)
+	}
+	if ranked[0] != "c" {
+		t.Errorf("primer resultado = %s, se esperaba c (término repetido en un texto corto)", ranked[0])
+	}
+	if ranked[2] != "b" {
+		t.Errorf("último resultado = %s, se esperaba b (texto más largo)", ranked[2])
+	}
+
+	scores := idx.TextSearch("casas")
+	if scores["d"] != 0 {
+		t.Errorf("el documento sin el término puntúa %v", scores["d"])
+	}
+	if scores["a"] <= scores["b"] {
+		t.Errorf("puntuación de a (%v) no supera la de b (%v)", scores["a"], scores["b"])
+	}
+}
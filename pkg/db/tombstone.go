@@ -0,0 +1,313 @@
+package db
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// defaultTombstoneGracePeriod tiempo mínimo que se conserva una lápida
+const defaultTombstoneGracePeriod = 7 * 24 * time.Hour
+
+// Tombstone registra la eliminación de un documento para que se propague a los
+// nodos que no estaban conectados y no se resucite con versiones anteriores
+type Tombstone struct {
+	ID         string          `json:"id"`
+	Collection string          `json:"collection"`
+	Deleted    Timestamp       `json:"deleted"`        // Marca del reloj del nodo que eliminó el documento
+	RecordedAt time.Time       `json:"recorded_at"`    // Momento en que este nodo registró la eliminación
+	Acks       map[string]bool `json:"acks,omitempty"` // Nodos que han confirmado la eliminación
+}
+
+// TombstoneAck confirma que un nodo ha recibido una eliminación
+type TombstoneAck struct {
+	ID      string    `json:"id"`
+	Deleted Timestamp `json:"deleted"`
+}
+
+// tombstoneState es el contenido del archivo de lápidas
+type tombstoneState struct {
+	Peers      []string     `json:"peers"`
+	Tombstones []*Tombstone `json:"tombstones"`
+}
+
+// Ack devuelve la confirmación de la lápida
+func (t *Tombstone) Ack() TombstoneAck {
+	return TombstoneAck{ID: t.ID, Deleted: t.Deleted}
+}
+
+// clone devuelve una copia de la lápida
+func (t *Tombstone) clone() *Tombstone {
+	c := *t
+	c.Acks = maps.Clone(t.Acks)
+	return &c
+}
+
+// ack anota que un nodo conoce la eliminación
+func (t *Tombstone) ack(node string) bool {
+	if node == "" || t.Acks[node] {
+		return false
+	}
+	if t.Acks == nil {
+		t.Acks = make(map[string]bool)
+	}
+	t.Acks[node] = true
+	return true
+}
+
+// recordTombstoneLocked registra la eliminación de un documento con la marca de
+// la escritura. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) recordTombstoneLocked(doc *Document, stamp writeStamp) *Tombstone {
+	tombstone := &Tombstone{
+		ID:         doc.ID,
+		Collection: doc.Collection,
+		Deleted:    stamp.clock,
+		RecordedAt: stamp.time,
+	}
+	tombstone.ack(db.clock.Node())
+
+	db.setTombstoneLocked(tombstone)
+	return tombstone
+}
+
+// suppressedLocked indica si una lápida posterior anula un documento recibido.
+// Si el documento es posterior, la eliminación queda superada y la lápida se
+// descarta. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) suppressedLocked(remote *Document) bool {
+	tombstone, exists := db.tombstones[remote.ID]
+	if !exists {
+		return false
+	}
+	if documentClock(remote).Compare(tombstone.Deleted) <= 0 {
+		return true
+	}
+
+	db.dropTombstoneLocked(remote.ID)
+	db.tombstonesDirty = true
+	return false
+}
+
+// applyRemoteDeleteLocked aplica una eliminación recibida de otro nodo. Si la
+// versión local es posterior a la eliminación se conserva. Devuelve el documento
+// eliminado, si había uno. Las colecciones que gestiona el consenso no se
+// modifican, y las lápidas de documentos fragmentados de los que el nodo no es
+// propietario no se guardan. Debe llamarse con el mutex de la base de datos
+// bloqueado.
+func (db *Database) applyRemoteDeleteLocked(remote *Tombstone, from string) *Document {
+	db.clock.Update(remote.Deleted)
+	if db.managedLocked(remote.Collection) || !db.hostsLocked(remote.Collection, remote.ID) {
+		return nil
+	}
+
+	if local, exists := db.documents[remote.ID]; exists && documentClock(local).Compare(remote.Deleted) > 0 {
+		return nil
+	}
+
+	// Una eliminación repetida no cambia nada ni se vuelve a persistir
+	tombstone, exists := db.tombstones[remote.ID]
+	changed := true
+	switch {
+	case !exists:
+		tombstone = remote.clone()
+		tombstone.RecordedAt = time.Now()
+		db.setTombstoneLocked(tombstone)
+	case remote.Deleted.Compare(tombstone.Deleted) > 0:
+		tombstone.Deleted = remote.Deleted
+		db.setTombstoneLocked(tombstone)
+	default:
+		changed = false
+	}
+	for node := range remote.Acks {
+		changed = tombstone.ack(node) || changed
+	}
+	changed = tombstone.ack(from) || changed
+	changed = tombstone.ack(db.clock.Node()) || changed
+
+	doc := db.removeDocumentLocked(remote.ID)
+	if changed || doc != nil {
+		db.tombstonesDirty = true
+	}
+	return doc
+}
+
+// ApplyRemoteDelete aplica una eliminación recibida del nodo from y la persiste.
+// Devuelve si se eliminó un documento local.
+func (db *Database) ApplyRemoteDelete(remote *Tombstone, from string) (bool, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	doc := db.applyRemoteDeleteLocked(remote, from)
+	if err := db.saveTombstonesLocked(); err != nil {
+		return false, err
+	}
+	if doc == nil {
+		return false, nil
+	}
+
+	if db.persistenceEnabled {
+		if err := db.persistence.DeleteDocument(doc.Collection, doc.ID); err != nil {
+			return true, fmt.Errorf("error al persistir eliminación sincronizada: %v", err)
+		}
+	}
+
+	docCopy := *doc
+	db.triggerEvent("delete", doc.Collection, doc.ID, &docCopy)
+	return true, nil
+}
+
+// GetTombstones devuelve las lápidas registradas después de since (todas si es cero)
+func (db *Database) GetTombstones(since time.Time) []*Tombstone {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	var results []*Tombstone
+	for _, tombstone := range db.tombstones {
+		if tombstone.RecordedAt.After(since) {
+			results = append(results, tombstone.clone())
+		}
+	}
+
+	return results
+}
+
+// AddPeer registra un nodo de la red. Las lápidas solo se eliminan cuando todos
+// los nodos registrados han confirmado la eliminación.
+func (db *Database) AddPeer(node string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if node == "" || node == db.clock.Node() || db.peers[node] {
+		return
+	}
+	if db.peers == nil {
+		db.peers = make(map[string]bool)
+	}
+	db.peers[node] = true
+	db.tombstonesDirty = true
+}
+
+// RemovePeer olvida un nodo que ha abandonado la red, para que sus
+// confirmaciones pendientes no impidan eliminar las lápidas
+func (db *Database) RemovePeer(node string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.peers[node] {
+		delete(db.peers, node)
+		db.tombstonesDirty = true
+	}
+}
+
+// KnownPeers devuelve los nodos registrados
+func (db *Database) KnownPeers() []string {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return slices.Sorted(maps.Keys(db.peers))
+}
+
+// AcknowledgeTombstones anota que un nodo ha recibido las eliminaciones indicadas.
+// Una confirmación solo cuenta si es de la misma eliminación o de una posterior.
+func (db *Database) AcknowledgeTombstones(node string, acks []TombstoneAck) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, ack := range acks {
+		tombstone, exists := db.tombstones[ack.ID]
+		if exists && ack.Deleted.Compare(tombstone.Deleted) >= 0 && tombstone.ack(node) {
+			db.tombstonesDirty = true
+		}
+	}
+}
+
+// SetTombstoneGracePeriod establece el tiempo mínimo que se conservan las lápidas
+func (db *Database) SetTombstoneGracePeriod(period time.Duration) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.tombstoneGrace = period
+}
+
+// CollectTombstones elimina las lápidas que superan el periodo de gracia y que
+// todos los nodos conocidos han confirmado. Devuelve cuántas eliminó.
+func (db *Database) CollectTombstones() (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	deadline := time.Now().Add(-db.tombstoneGrace)
+
+	collected := 0
+	for id, tombstone := range db.tombstones {
+		if tombstone.RecordedAt.After(deadline) {
+			continue
+		}
+		acknowledged := true
+		for node := range db.peers {
+			if !tombstone.Acks[node] {
+				acknowledged = false
+				break
+			}
+		}
+		if acknowledged {
+			db.dropTombstoneLocked(id)
+			collected++
+		}
+	}
+	if collected > 0 {
+		db.tombstonesDirty = true
+	}
+
+	return collected, db.saveTombstonesLocked()
+}
+
+// saveTombstonesLocked persiste las lápidas y los nodos conocidos si cambiaron.
+// Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) saveTombstonesLocked() error {
+	if !db.tombstonesDirty {
+		return nil
+	}
+	if db.persistenceEnabled {
+		state := tombstoneState{
+			Peers:      slices.Sorted(maps.Keys(db.peers)),
+			Tombstones: make([]*Tombstone, 0, len(db.tombstones)),
+		}
+		for _, id := range slices.Sorted(maps.Keys(db.tombstones)) {
+			state.Tombstones = append(state.Tombstones, db.tombstones[id])
+		}
+		if err := db.persistence.SaveTombstones(state); err != nil {
+			return fmt.Errorf("error al persistir lápidas: %v", err)
+		}
+	}
+
+	db.tombstonesDirty = false
+	return nil
+}
+
+// loadTombstones carga las lápidas y los nodos conocidos. Una lápida de un
+// documento que sigue guardado corresponde a una eliminación que no llegó a
+// persistirse y se descarta.
+func (db *Database) loadTombstones() error {
+	state, err := db.persistence.LoadTombstones()
+	if err != nil {
+		return err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.tombstones = make(map[string]*Tombstone, len(state.Tombstones))
+	for _, tombstone := range state.Tombstones {
+		if _, exists := db.documents[tombstone.ID]; exists {
+			db.tombstonesDirty = true
+			continue
+		}
+		db.tombstones[tombstone.ID] = tombstone
+	}
+	db.peers = make(map[string]bool, len(state.Peers))
+	for _, node := range state.Peers {
+		db.peers[node] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// replicatedDocument crea un documento en origin y lo replica en target.
+// Devuelve la copia que recibió target.
+func replicatedDocument(t *testing.T, origin, target *Database) *Document {
+	t.Helper()
+	created, err := origin.CreateDocument("notas", map[string]any{"texto": "hola"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	remote := wireCopy(t, created)
+	if _, err := target.ApplyRemoteDocument(wireCopy(t, remote)); err != nil {
+		t.Fatalf("error al replicar documento: %v", err)
+	}
+	return remote
+}
+
+// tombstoneIDs devuelve los IDs de las lápidas de la base de datos
+func tombstoneIDs(database *Database) map[string]bool {
+	ids := make(map[string]bool)
+	for _, tombstone := range database.GetTombstones(time.Time{}) {
+		ids[tombstone.ID] = true
+	}
+	return ids
+}
+
+func TestTombstoneSuppressesOlderCreate(t *testing.T) {
+	origin := newCRDTTestNode(t, "origin")
+	target := newCRDTTestNode(t, "target")
+	created := replicatedDocument(t, origin, target)
+
+	if err := target.DeleteDocument(created.ID); err != nil {
+		t.Fatalf("error al eliminar documento: %v", err)
+	}
+
+	// La creación llega de nuevo, por ejemplo reenviada por otro nodo
+	doc, err := target.ApplyRemoteDocument(wireCopy(t, created))
+	if err != nil {
+		t.Fatalf("error al aplicar la creación: %v", err)
+	}
+	if doc != nil {
+		t.Errorf("la creación anterior a la eliminación se aplicó")
+	}
+	if _, err := target.GetDocument(created.ID); err == nil {
+		t.Errorf("la creación anterior resucitó el documento eliminado")
+	}
+	if !tombstoneIDs(target)[created.ID] {
+		t.Errorf("se descartó la lápida")
+	}
+}
+
+func TestNewerUpdateDropsTombstone(t *testing.T) {
+	origin := newCRDTTestNode(t, "origin")
+	target := newCRDTTestNode(t, "target")
+	created := replicatedDocument(t, origin, target)
+
+	if err := target.DeleteDocument(created.ID); err != nil {
+		t.Fatalf("error al eliminar documento: %v", err)
+	}
+	tombstone := target.GetTombstones(time.Time{})[0]
+
+	// El origen actualiza el documento después de conocer la eliminación
+	origin.clock.Update(tombstone.Deleted)
+	updated, err := origin.UpdateDocument(created.ID, map[string]any{"texto": "adiós"})
+	if err != nil {
+		t.Fatalf("error al actualizar documento: %v", err)
+	}
+
+	doc, err := target.ApplyRemoteDocument(wireCopy(t, updated))
+	if err != nil {
+		t.Fatalf("error al aplicar la actualización: %v", err)
+	}
+	if doc == nil || doc.Data["texto"] != "adiós" {
+		t.Fatalf("documento = %v, se esperaba la actualización posterior", doc)
+	}
+	if tombstoneIDs(target)[created.ID] {
+		t.Errorf("la actualización posterior no descartó la lápida")
+	}
+}
+
+func TestCollectTombstonesWaitsForAcksAndGracePeriod(t *testing.T) {
+	database := newCRDTTestNode(t, "local")
+	database.AddPeer("b")
+	database.AddPeer("c")
+
+	doc, err := database.CreateDocument("notas", map[string]any{"texto": "hola"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	if err := database.DeleteDocument(doc.ID); err != nil {
+		t.Fatalf("error al eliminar documento: %v", err)
+	}
+	ack := database.GetTombstones(time.Time{})[0].Ack()
+
+	collect := func(step string, want int) {
+		t.Helper()
+		collected, err := database.CollectTombstones()
+		if err != nil {
+			t.Fatalf("%s: error al recoger lápidas: %v", step, err)
+		}
+		if collected != want {
+			t.Errorf("%s: lápidas recogidas = %d, se esperaba %d", step, collected, want)
+		}
+	}
+
+	database.SetTombstoneGracePeriod(0)
+	collect("sin confirmaciones", 0)
+
+	database.AcknowledgeTombstones("b", []TombstoneAck{ack})
+	database.AcknowledgeTombstones("c", []TombstoneAck{{ID: ack.ID}})
+	collect("con una confirmación de una eliminación anterior", 0)
+
+	database.SetTombstoneGracePeriod(time.Hour)
+	database.AcknowledgeTombstones("c", []TombstoneAck{ack})
+	collect("dentro del periodo de gracia", 0)
+
+	database.SetTombstoneGracePeriod(0)
+	collect("confirmada y fuera del periodo de gracia", 1)
+	if len(database.GetTombstones(time.Time{})) != 0 {
+		t.Errorf("la lápida recogida sigue registrada")
+	}
+}
+
+func TestLoadTombstonesDropsExistingDocuments(t *testing.T) {
+	dir := t.TempDir()
+	database, err := NewDatabaseWithPersistence(dir)
+	if err != nil {
+		t.Fatalf("error al abrir la base de datos: %v", err)
+	}
+	deleted, err := database.CreateDocument("notas", map[string]any{"texto": "eliminado"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	kept, err := database.CreateDocument("notas", map[string]any{"texto": "conservado"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	if err := database.DeleteDocument(deleted.ID); err != nil {
+		t.Fatalf("error al eliminar documento: %v", err)
+	}
+
+	// Una eliminación que guardó la lápida pero no llegó a borrar el documento
+	database.mutex.Lock()
+	database.recordTombstoneLocked(kept, database.localStamp())
+	database.tombstonesDirty = true
+	err = database.saveTombstonesLocked()
+	database.mutex.Unlock()
+	if err != nil {
+		t.Fatalf("error al guardar lápidas: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatalf("error al cerrar la base de datos: %v", err)
+	}
+
+	reopened, err := NewDatabaseWithPersistence(dir)
+	if err != nil {
+		t.Fatalf("error al reabrir la base de datos: %v", err)
+	}
+	defer reopened.Close()
+
+	tombstones := tombstoneIDs(reopened)
+	if !tombstones[deleted.ID] {
+		t.Errorf("se perdió la lápida del documento eliminado")
+	}
+	if tombstones[kept.ID] {
+		t.Errorf("se cargó la lápida de un documento que sigue guardado")
+	}
+	if _, err := reopened.GetDocument(kept.ID); err != nil {
+		t.Errorf("el documento conservado no se cargó: %v", err)
+	}
+}
@@ -2,9 +2,10 @@ package db
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"sync"
 	"time"
 )
 
@@ -16,54 +17,33 @@ const (
 	TransactionCreate TransactionType = "create"
 	TransactionUpdate TransactionType = "update"
 	TransactionDelete TransactionType = "delete"
+	// TransactionCommit agrupa las operaciones de una transacción confirmada
+	TransactionCommit TransactionType = "commit"
 )
 
 // Transaction representa una transacción en el log
 type Transaction struct {
-	ID        string          `json:"id"`
-	Type      TransactionType `json:"type"`
-	Timestamp time.Time       `json:"timestamp"`
-	DocID     string          `json:"doc_id"`
-	Document  *Document       `json:"document,omitempty"`
+	LSN        uint64          `json:"lsn,omitempty"` // Número de secuencia en el WAL
+	ID         string          `json:"id"`
+	Type       TransactionType `json:"type"`
+	Timestamp  time.Time       `json:"timestamp"`
+	DocID      string          `json:"doc_id"`
+	Collection string          `json:"collection,omitempty"`
+	Document   *Document       `json:"document,omitempty"`
+	Operations []Transaction   `json:"operations,omitempty"` // Operaciones de un commit
 }
 
-// TransactionLogger maneja el registro de transacciones
-type TransactionLogger struct {
-	file   *os.File
-	mutex  sync.Mutex
-	closed bool
-}
-
-// NewTransactionLogger crea una nueva instancia del logger de transacciones
-func NewTransactionLogger(filePath string) (*TransactionLogger, error) {
-	// Abrir el archivo en modo append (o crearlo si no existe)
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("error al abrir archivo de transacciones: %v", err)
-	}
-
-	return &TransactionLogger{
-		file:   file,
-		closed: false,
-	}, nil
-}
-
-// LogOperation registra una operación en el log de transacciones
-func (tl *TransactionLogger) LogOperation(op Operation, docID string, doc *Document) error {
-	if tl.closed {
-		return fmt.Errorf("logger de transacciones cerrado")
-	}
-
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-
-	// Crear la transacción
+// newTransaction crea el registro de una operación sobre un documento
+func newTransaction(op Operation, docID string, doc *Document) (Transaction, error) {
 	transaction := Transaction{
 		ID:        generateUUID(),
 		Timestamp: time.Now(),
 		DocID:     docID,
 		Document:  doc,
 	}
+	if doc != nil {
+		transaction.Collection = doc.Collection
+	}
 
 	// Mapear la operación al tipo de transacción
 	switch op {
@@ -74,110 +54,75 @@ func (tl *TransactionLogger) LogOperation(op Operation, docID string, doc *Docum
 	case OperationDelete:
 		transaction.Type = TransactionDelete
 	default:
-		return fmt.Errorf("tipo de operación desconocido: %s", op)
+		return Transaction{}, fmt.Errorf("tipo de operación desconocido: %s", op)
 	}
 
-	// Serializar la transacción a JSON
-	data, err := json.Marshal(transaction)
-	if err != nil {
-		return fmt.Errorf("error al serializar transacción: %v", err)
-	}
-
-	// Añadir un salto de línea al final
-	data = append(data, '\n')
-
-	// Escribir en el archivo
-	if _, err := tl.file.Write(data); err != nil {
-		return fmt.Errorf("error al escribir transacción: %v", err)
-	}
-
-	// Forzar la escritura en disco
-	if err := tl.file.Sync(); err != nil {
-		return fmt.Errorf("error al sincronizar archivo: %v", err)
-	}
-
-	return nil
+	return transaction, nil
 }
 
-// ReadTransactions lee todas las transacciones del log
-func (tl *TransactionLogger) ReadTransactions() ([]Transaction, error) {
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-
-	// Cerrar el archivo actual
-	currentFile := tl.file
-	currentFile.Close()
-
-	// Reabrir el archivo para lectura
-	file, err := os.Open(currentFile.Name())
+// readLegacyTransactions lee el log de transacciones en JSON por líneas que se
+// usaba antes del WAL. Una línea final incompleta se ignora.
+func readLegacyTransactions(path string) ([]Transaction, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		// Reabrir el archivo original en modo append
-		tl.file, _ = os.OpenFile(currentFile.Name(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		return nil, fmt.Errorf("error al abrir archivo para lectura: %v", err)
+		return nil, err
 	}
 	defer file.Close()
 
-	// Leer el archivo línea por línea
 	var transactions []Transaction
 	decoder := json.NewDecoder(file)
 	for decoder.More() {
 		var transaction Transaction
 		if err := decoder.Decode(&transaction); err != nil {
-			// Reabrir el archivo original en modo append
-			tl.file, _ = os.OpenFile(currentFile.Name(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
 			return nil, fmt.Errorf("error al decodificar transacción: %v", err)
 		}
 		transactions = append(transactions, transaction)
 	}
 
-	// Reabrir el archivo original en modo append
-	tl.file, _ = os.OpenFile(currentFile.Name(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-
 	return transactions, nil
 }
 
-// Close cierra el logger de transacciones
-func (tl *TransactionLogger) Close() error {
-	if tl.closed {
-		return nil
-	}
-
-	tl.mutex.Lock()
-	defer tl.mutex.Unlock()
-
-	tl.closed = true
-	return tl.file.Close()
-}
-
 // ReplayTransactions reproduce las transacciones en la base de datos
 func ReplayTransactions(db *Database, transactions []Transaction) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	for _, transaction := range transactions {
-		switch transaction.Type {
-		case TransactionCreate:
-			if transaction.Document != nil {
-				// Añadir directamente el documento al almacén local
-				db.mutex.Lock()
-				db.documents[transaction.Document.ID] = transaction.Document
-				db.mutex.Unlock()
-			}
+		if err := replayTransactionLocked(db, transaction); err != nil {
+			return err
+		}
+	}
 
-		case TransactionUpdate:
-			if transaction.Document != nil {
-				// Actualizar el documento en el almacén local
-				db.mutex.Lock()
-				db.documents[transaction.Document.ID] = transaction.Document
-				db.mutex.Unlock()
-			}
+	return nil
+}
 
-		case TransactionDelete:
-			// Eliminar el documento del almacén local
-			db.mutex.Lock()
-			delete(db.documents, transaction.DocID)
-			db.mutex.Unlock()
+// replayTransactionLocked aplica una transacción del log. Debe llamarse con el
+// mutex de la base de datos bloqueado.
+func replayTransactionLocked(db *Database, transaction Transaction) error {
+	switch transaction.Type {
+	case TransactionCreate, TransactionUpdate:
+		if transaction.Document != nil {
+			// Añadir o actualizar directamente el documento en el almacén local
+			db.putDocumentLocked(transaction.Document)
+		}
+
+	case TransactionDelete:
+		// Eliminar el documento del almacén local
+		db.removeDocumentLocked(transaction.DocID)
 
-		default:
-			return fmt.Errorf("tipo de transacción desconocido: %s", transaction.Type)
+	case TransactionCommit:
+		// Aplicar todas las operaciones de la transacción confirmada
+		for _, operation := range transaction.Operations {
+			if err := replayTransactionLocked(db, operation); err != nil {
+				return err
+			}
 		}
+
+	default:
+		return fmt.Errorf("tipo de transacción desconocido: %s", transaction.Type)
 	}
 
 	return nil
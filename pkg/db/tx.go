@@ -0,0 +1,421 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrTransactionConflict indica que otra escritura modificó un documento de la
+	// transacción después de que esta empezara
+	ErrTransactionConflict = errors.New("conflicto de escritura en la transacción")
+	// ErrTransactionClosed indica que la transacción ya se confirmó o se deshizo
+	ErrTransactionClosed = errors.New("transacción finalizada")
+)
+
+// Tx representa una transacción sobre varios documentos. Las lecturas ven una
+// instantánea de la base de datos tomada en Begin más las escrituras propias, y
+// las escrituras se aplican todas juntas en Commit.
+type Tx struct {
+	db          *Database
+	snapshotSeq uint64              // Secuencia de escrituras al empezar la transacción
+	writes      map[string]*txWrite // Escrituras pendientes por ID de documento
+	order       []string            // Orden de las escrituras pendientes
+	done        bool
+	mutex       sync.Mutex
+}
+
+// txWrite representa una escritura pendiente de una transacción
+type txWrite struct {
+	operation  Operation
+	collection string
+	document   *Document // nil en las eliminaciones
+	previous   *Document // Documento en la instantánea, si existía
+}
+
+// txVersion es la versión de un documento anterior a una escritura confirmada
+// mientras había transacciones abiertas
+type txVersion struct {
+	seq      uint64    // Secuencia de la escritura
+	previous *Document // Documento antes de la escritura; nil si no existía
+}
+
+// Begin inicia una transacción. La transacción debe terminar con Commit o
+// Rollback: mientras está abierta, la base de datos conserva la versión anterior
+// de cada documento que se escribe. Una transacción abandonada se deshace cuando
+// el recolector de memoria la libera.
+func (db *Database) Begin() *Tx {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// Los documentos no se modifican una vez almacenados, así que la instantánea
+	// son los documentos actuales más las versiones anteriores a las escrituras
+	// que se confirmen después
+	if db.txSnapshots == nil {
+		db.txSnapshots = make(map[uint64]int)
+	}
+	db.txSnapshots[db.commitSeq]++
+
+	tx := &Tx{
+		db:          db,
+		snapshotSeq: db.commitSeq,
+		writes:      make(map[string]*txWrite),
+	}
+	runtime.SetFinalizer(tx, (*Tx).Rollback)
+	return tx
+}
+
+// Get obtiene un documento tal como lo ve la transacción
+func (tx *Tx) Get(id string) (*Document, error) {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return nil, ErrTransactionClosed
+	}
+
+	doc, exists := tx.get(id)
+	if !exists {
+		return nil, errors.New("documento no encontrado")
+	}
+
+	return doc, nil
+}
+
+// get obtiene un documento de las escrituras pendientes o de la instantánea
+func (tx *Tx) get(id string) (*Document, bool) {
+	if write, exists := tx.writes[id]; exists {
+		return write.document, write.document != nil
+	}
+
+	doc := tx.db.versionAt(id, tx.snapshotSeq)
+	return doc, doc != nil
+}
+
+// versionAt devuelve la versión de un documento en la instantánea de una
+// transacción abierta, o nil si no existía
+func (db *Database) versionAt(id string, seq uint64) *Document {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	// La primera escritura posterior a la instantánea guardó la versión que veía
+	for _, version := range db.txHistory[id] {
+		if version.seq > seq {
+			return version.previous
+		}
+	}
+	return db.documents[id]
+}
+
+// Create crea un documento dentro de la transacción
+func (tx *Tx) Create(collection string, data map[string]any) (*Document, error) {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return nil, ErrTransactionClosed
+	}
+
+	now := time.Now()
+	doc := &Document{
+		ID:         uuid.New().String(),
+		Collection: collection,
+		Data:       data,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Revision:   1,
+	}
+
+	tx.write(doc.ID, &txWrite{operation: OperationCreate, collection: collection, document: doc})
+	return doc, nil
+}
+
+// Update actualiza un documento dentro de la transacción, con operadores o
+// combinando campos igual que Database.UpdateDocument
+func (tx *Tx) Update(id string, data map[string]any, options ...WriteOption) (*Document, error) {
+	apply, err := updateFunc(data)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return nil, ErrTransactionClosed
+	}
+
+	current, exists := tx.get(id)
+	if !exists {
+		return nil, errors.New("documento no encontrado")
+	}
+	if err := newWriteOptions(options).checkRevision(current); err != nil {
+		return nil, err
+	}
+
+	updated, err := apply(current.Data)
+	if err != nil {
+		return nil, err
+	}
+	doc := *current
+	doc.Data = updated
+	doc.UpdatedAt = time.Now()
+
+	// Un documento ya escrito en la transacción conserva su revisión, y si se
+	// creó en ella sigue siendo una creación
+	operation := OperationUpdate
+	if write, exists := tx.writes[id]; exists {
+		if write.operation == OperationCreate {
+			operation = OperationCreate
+		}
+	} else {
+		doc.Revision = current.Revision + 1
+	}
+
+	tx.write(id, &txWrite{operation: operation, collection: doc.Collection, document: &doc})
+	return &doc, nil
+}
+
+// Delete elimina un documento dentro de la transacción
+func (tx *Tx) Delete(id string, options ...WriteOption) error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return ErrTransactionClosed
+	}
+
+	current, exists := tx.get(id)
+	if !exists {
+		return errors.New("documento no encontrado")
+	}
+	if err := newWriteOptions(options).checkRevision(current); err != nil {
+		return err
+	}
+
+	// Un documento creado en la misma transacción simplemente se descarta
+	if write, exists := tx.writes[id]; exists && write.operation == OperationCreate {
+		delete(tx.writes, id)
+		for i, writeID := range tx.order {
+			if writeID == id {
+				tx.order = append(tx.order[:i], tx.order[i+1:]...)
+				break
+			}
+		}
+		return nil
+	}
+
+	tx.write(id, &txWrite{operation: OperationDelete, collection: current.Collection})
+	return nil
+}
+
+// write registra una escritura pendiente
+func (tx *Tx) write(id string, write *txWrite) {
+	if previous, exists := tx.writes[id]; exists {
+		write.previous = previous.previous
+	} else {
+		write.previous = tx.db.versionAt(id, tx.snapshotSeq)
+		tx.order = append(tx.order, id)
+	}
+	tx.writes[id] = write
+}
+
+// Commit confirma la transacción. Falla con ErrTransactionConflict si otra
+// escritura modificó alguno de sus documentos desde Begin; en ese caso no se
+// aplica ninguna escritura.
+func (tx *Tx) Commit() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return ErrTransactionClosed
+	}
+	tx.done = true
+	runtime.SetFinalizer(tx, nil)
+
+	db := tx.db
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	defer db.endTransactionLocked(tx.snapshotSeq)
+
+	if len(tx.order) == 0 {
+		return nil
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// Las escrituras de las colecciones de consistencia fuerte solo pasan por el consenso
+	if db.consensus != nil {
+		for _, id := range tx.order {
+			if db.consensus.Strong(tx.writes[id].collection) {
+				return fmt.Errorf("%w: %s", ErrStrongTransaction, tx.writes[id].collection)
+			}
+		}
+	}
+
+	// Los documentos fragmentados solo los escriben sus propietarios
+	for _, id := range tx.order {
+		if !db.hostsLocked(tx.writes[id].collection, id) {
+			return fmt.Errorf("%w: %s", ErrShardedTransaction, id)
+		}
+	}
+
+	// Detectar conflictos con escrituras confirmadas después de Begin
+	for _, id := range tx.order {
+		if db.docVersions[id] > tx.snapshotSeq {
+			return fmt.Errorf("%w: documento %s", ErrTransactionConflict, id)
+		}
+	}
+
+	// Validar los documentos escritos y la unicidad del conjunto de escrituras
+	docs := make([]*Document, 0, len(tx.order))
+	replaced := make(map[string]bool, len(tx.order))
+	for _, id := range tx.order {
+		replaced[id] = true
+		if doc := tx.writes[id].document; doc != nil {
+			db.stampLocked(db.documents[id], doc, db.clock.Now())
+			if err := db.validateDocumentLocked(doc); err != nil {
+				return err
+			}
+			docs = append(docs, doc)
+		}
+	}
+	if err := db.indexes.CheckDocuments(docs, replaced); err != nil {
+		return fmt.Errorf("error al indexar documento: %v", err)
+	}
+
+	// Preparar las operaciones del log y del mensaje de sincronización
+	operations := make([]Transaction, 0, len(tx.order))
+	batch := make([]DBMessage, 0, len(tx.order))
+	var deleted []string
+	for _, id := range tx.order {
+		write := tx.writes[id]
+		operation, err := newTransaction(write.operation, id, write.document)
+		if err != nil {
+			return err
+		}
+		operation.Collection = write.collection
+		operations = append(operations, operation)
+
+		if write.document != nil {
+			batch = append(batch, DBMessage{Operation: write.operation, Document: write.document})
+		} else {
+			tombstone := db.recordTombstoneLocked(db.documents[id], db.localStamp())
+			deleted = append(deleted, id)
+			batch = append(batch, DBMessage{Operation: OperationDelete, DocumentID: id, Tombstone: tombstone.clone()})
+		}
+	}
+
+	// Registrar las lápidas de las eliminaciones antes que la transacción
+	if len(deleted) > 0 {
+		db.tombstonesDirty = true
+		if err := db.saveTombstonesLocked(); err != nil {
+			for _, id := range deleted {
+				db.dropTombstoneLocked(id)
+			}
+			return err
+		}
+	}
+
+	// Persistir la transacción antes de aplicarla en memoria
+	if db.persistenceEnabled {
+		if err := db.persistence.CommitTransaction(operations); err != nil {
+			return fmt.Errorf("error al persistir transacción: %v", err)
+		}
+	}
+
+	for _, id := range tx.order {
+		if doc := tx.writes[id].document; doc != nil {
+			db.putDocumentLocked(doc)
+		} else {
+			db.removeDocumentLocked(id)
+		}
+	}
+
+	// Sincronizar la transacción como un único mensaje
+	if db.syncEnabled && db.sync != nil {
+		if err := db.sync.PublishBatch(batch); err != nil {
+			log.Printf("Error al sincronizar transacción: %v", err)
+			// No devolvemos error para no bloquear la operación
+		}
+	}
+
+	// Disparar los eventos de cada escritura
+	for _, id := range tx.order {
+		write := tx.writes[id]
+		if write.document != nil {
+			db.triggerEvent(string(write.operation), write.collection, id, write.document)
+		} else if write.previous != nil {
+			docCopy := *write.previous
+			db.triggerEvent("delete", write.collection, id, &docCopy)
+		}
+	}
+
+	return nil
+}
+
+// Rollback descarta la transacción. Llamarlo tras Commit no tiene efecto, así
+// que puede usarse con defer.
+func (tx *Tx) Rollback() error {
+	tx.mutex.Lock()
+	defer tx.mutex.Unlock()
+
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	runtime.SetFinalizer(tx, nil)
+
+	tx.db.mutex.Lock()
+	defer tx.db.mutex.Unlock()
+
+	tx.db.endTransactionLocked(tx.snapshotSeq)
+	return nil
+}
+
+// endTransactionLocked cierra una transacción con la instantánea snapshotSeq y
+// descarta las versiones de los documentos que ya no ve ninguna transacción
+// abierta. Debe llamarse con el mutex de la base de datos bloqueado.
+func (db *Database) endTransactionLocked(snapshotSeq uint64) {
+	db.txSnapshots[snapshotSeq]--
+	if db.txSnapshots[snapshotSeq] <= 0 {
+		delete(db.txSnapshots, snapshotSeq)
+	}
+	if len(db.txSnapshots) == 0 {
+		db.docVersions = nil
+		db.txHistory = nil
+		return
+	}
+
+	oldest := uint64(math.MaxUint64)
+	for seq := range db.txSnapshots {
+		oldest = min(oldest, seq)
+	}
+
+	// Las escrituras anteriores a la instantánea más antigua ya no son conflictos
+	// ni guardan versiones que alguna transacción pueda leer
+	for id, seq := range db.docVersions {
+		if seq <= oldest {
+			delete(db.docVersions, id)
+		}
+	}
+	for id, versions := range db.txHistory {
+		i := 0
+		for i < len(versions) && versions[i].seq <= oldest {
+			i++
+		}
+		if i == len(versions) {
+			delete(db.txHistory, id)
+		} else {
+			db.txHistory[id] = versions[i:]
+		}
+	}
+}
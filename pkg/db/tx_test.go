@@ -0,0 +1,112 @@
+package db
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestTxSnapshotIsolation comprueba que una transacción lea la instantánea de
+// Begin aunque otras escrituras cambien, eliminen o creen documentos después
+func TestTxSnapshotIsolation(t *testing.T) {
+	database := NewDatabase()
+	updated, _ := database.CreateDocument("items", map[string]interface{}{"n": 1})
+	deleted, _ := database.CreateDocument("items", map[string]interface{}{"n": 2})
+
+	tx := database.Begin()
+	defer tx.Rollback()
+
+	if _, err := database.UpdateDocument(updated.ID, map[string]interface{}{"n": 10}); err != nil {
+		t.Fatalf("error al actualizar: %v", err)
+	}
+	if _, err := database.UpdateDocument(updated.ID, map[string]interface{}{"n": 20}); err != nil {
+		t.Fatalf("error al actualizar: %v", err)
+	}
+	if err := database.DeleteDocument(deleted.ID); err != nil {
+		t.Fatalf("error al eliminar: %v", err)
+	}
+	created, _ := database.CreateDocument("items", map[string]interface{}{"n": 3})
+
+	doc, err := tx.Get(updated.ID)
+	if err != nil || compareValues(doc.Data["n"], 1) != 0 {
+		t.Errorf("documento actualizado: %v, %v; se esperaba n = 1", doc, err)
+	}
+	if doc, err := tx.Get(deleted.ID); err != nil || compareValues(doc.Data["n"], 2) != 0 {
+		t.Errorf("documento eliminado: %v, %v; se esperaba n = 2", doc, err)
+	}
+	if _, err := tx.Get(created.ID); err == nil {
+		t.Errorf("la transacción ve un documento creado después de Begin")
+	}
+
+	// Escribir un documento modificado después de Begin es un conflicto
+	if _, err := tx.Update(updated.ID, map[string]interface{}{"n": 5}); err != nil {
+		t.Fatalf("error al actualizar en la transacción: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTransactionConflict) {
+		t.Errorf("Commit = %v, se esperaba ErrTransactionConflict", err)
+	}
+}
+
+// TestTxVersionsReleased comprueba que las versiones guardadas para las
+// transacciones se descarten al cerrarse
+func TestTxVersionsReleased(t *testing.T) {
+	database := NewDatabase()
+	doc, _ := database.CreateDocument("items", map[string]interface{}{"n": 1})
+
+	first := database.Begin()
+	database.UpdateDocument(doc.ID, map[string]interface{}{"n": 2})
+	second := database.Begin()
+	database.UpdateDocument(doc.ID, map[string]interface{}{"n": 3})
+
+	if got, _ := second.Get(doc.ID); compareValues(got.Data["n"], 2) != 0 {
+		t.Errorf("segunda transacción: n = %v, se esperaba 2", got.Data["n"])
+	}
+
+	// Al cerrar la primera solo queda la versión que ve la segunda
+	first.Rollback()
+	database.mutex.RLock()
+	versions := len(database.txHistory[doc.ID])
+	database.mutex.RUnlock()
+	if versions != 1 {
+		t.Errorf("%d versiones guardadas, se esperaba 1", versions)
+	}
+	if got, _ := second.Get(doc.ID); compareValues(got.Data["n"], 2) != 0 {
+		t.Errorf("segunda transacción tras cerrar la primera: n = %v, se esperaba 2", got.Data["n"])
+	}
+
+	if err := second.Commit(); err != nil {
+		t.Fatalf("error al confirmar: %v", err)
+	}
+	database.mutex.RLock()
+	defer database.mutex.RUnlock()
+	if database.txHistory != nil || database.docVersions != nil || len(database.txSnapshots) != 0 {
+		t.Errorf("quedan versiones sin transacciones abiertas")
+	}
+}
+
+// TestTxAbandonedReleased comprueba que una transacción abandonada se deshaga al
+// liberarse
+func TestTxAbandonedReleased(t *testing.T) {
+	database := NewDatabase()
+	doc, _ := database.CreateDocument("items", map[string]interface{}{"n": 1})
+
+	func() {
+		tx := database.Begin()
+		tx.Get(doc.ID)
+	}()
+	database.UpdateDocument(doc.ID, map[string]interface{}{"n": 2})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runtime.GC()
+		database.mutex.RLock()
+		open := len(database.txSnapshots)
+		database.mutex.RUnlock()
+		if open == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("la transacción abandonada sigue abierta")
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+)
+
+// UpdateOperator define los operadores de actualización
+type UpdateOperator string
+
+const (
+	// UpdateSet asigna el valor de un campo
+	UpdateSet UpdateOperator = "$set"
+	// UpdateUnset elimina un campo
+	UpdateUnset UpdateOperator = "$unset"
+	// UpdateInc incrementa un campo numérico
+	UpdateInc UpdateOperator = "$inc"
+	// UpdatePush añade un valor (o varios con $each) a un campo lista
+	UpdatePush UpdateOperator = "$push"
+	// UpdatePull elimina de un campo lista los valores iguales al indicado
+	UpdatePull UpdateOperator = "$pull"
+)
+
+// updateOperatorOrder orden en que se aplican los operadores de una actualización
+var updateOperatorOrder = []UpdateOperator{UpdateSet, UpdateInc, UpdatePush, UpdatePull, UpdateUnset}
+
+// ErrInvalidUpdate indica que una actualización no se puede aplicar al documento
+var ErrInvalidUpdate = errors.New("actualización no válida")
+
+// Update representa una actualización con operadores: operador -> campo -> valor.
+// Los campos admiten notación de punto para acceder a objetos anidados.
+type Update map[UpdateOperator]map[string]any
+
+// Set añade una asignación a la actualización
+func (u Update) Set(field string, value any) Update {
+	return u.add(UpdateSet, field, value)
+}
+
+// Unset añade la eliminación de un campo a la actualización
+func (u Update) Unset(field string) Update {
+	return u.add(UpdateUnset, field, true)
+}
+
+// Inc añade un incremento a la actualización
+func (u Update) Inc(field string, amount any) Update {
+	return u.add(UpdateInc, field, amount)
+}
+
+// Push añade la inserción de un valor en una lista a la actualización
+func (u Update) Push(field string, value any) Update {
+	return u.add(UpdatePush, field, value)
+}
+
+// Pull añade la eliminación de un valor de una lista a la actualización
+func (u Update) Pull(field string, value any) Update {
+	return u.add(UpdatePull, field, value)
+}
+
+// add añade una operación sobre un campo
+func (u Update) add(operator UpdateOperator, field string, value any) Update {
+	if u[operator] == nil {
+		u[operator] = make(map[string]any)
+	}
+	u[operator][field] = value
+	return u
+}
+
+// IsUpdateOperators indica si unos datos de actualización usan operadores
+// (todas sus claves empiezan por "$") en lugar de ser campos a combinar
+func IsUpdateOperators(data map[string]any) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for key := range data {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseUpdate convierte unos datos de actualización con operadores, por ejemplo
+// recibidos en JSON, en una Update
+func ParseUpdate(data map[string]any) (Update, error) {
+	update := make(Update)
+	for key, value := range data {
+		operator := UpdateOperator(key)
+		switch operator {
+		case UpdateSet, UpdateUnset, UpdateInc, UpdatePush, UpdatePull:
+		default:
+			return nil, fmt.Errorf("%w: operador no soportado %s", ErrInvalidUpdate, key)
+		}
+
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s requiere un objeto campo -> valor", ErrInvalidUpdate, key)
+		}
+		update[operator] = fields
+	}
+	return update, nil
+}
+
+// data devuelve la actualización como datos con operadores, la inversa de ParseUpdate
+func (u Update) data() map[string]any {
+	data := make(map[string]any, len(u))
+	for operator, fields := range u {
+		data[string(operator)] = fields
+	}
+	return data
+}
+
+// Apply calcula los nuevos datos de un documento aplicando la actualización.
+// Los datos originales no se modifican: se copian los objetos del camino de cada campo.
+func (u Update) Apply(data map[string]any) (map[string]any, error) {
+	result := maps.Clone(data)
+	if result == nil {
+		result = make(map[string]any)
+	}
+
+	for _, operator := range updateOperatorOrder {
+		fields := u[operator]
+
+		// Aplicar los campos en orden para que el resultado sea determinista
+		paths := make([]string, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			if path == "" {
+				return nil, fmt.Errorf("%w: campo vacío en %s", ErrInvalidUpdate, operator)
+			}
+			if err := applyUpdateOperator(result, operator, path, fields[path]); err != nil {
+				return nil, fmt.Errorf("%w: %s %s: %v", ErrInvalidUpdate, operator, path, err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// applyUpdateOperator aplica un operador sobre un campo de los datos
+func applyUpdateOperator(data map[string]any, operator UpdateOperator, path string, value any) error {
+	parts := strings.Split(path, ".")
+
+	if operator == UpdateUnset {
+		unsetPath(data, parts)
+		return nil
+	}
+
+	current, exists := lookupPath(data, parts)
+
+	switch operator {
+	case UpdateSet:
+		return setPath(data, parts, value)
+
+	case UpdateInc:
+		if !exists {
+			current = 0
+		}
+		sum, err := addNumbers(current, value)
+		if err != nil {
+			return err
+		}
+		return setPath(data, parts, sum)
+
+	case UpdatePush:
+		var list []any
+		if exists {
+			var ok bool
+			if list, ok = current.([]any); !ok {
+				return fmt.Errorf("el campo no es una lista")
+			}
+		}
+
+		// {"$each": [...]} añade varios valores
+		values := []any{value}
+		if each, ok := value.(map[string]any); ok && len(each) == 1 {
+			if items, ok := each["$each"].([]any); ok {
+				values = items
+			}
+		}
+
+		pushed := make([]any, 0, len(list)+len(values))
+		pushed = append(pushed, list...)
+		pushed = append(pushed, values...)
+		return setPath(data, parts, pushed)
+
+	case UpdatePull:
+		if !exists {
+			return nil
+		}
+		list, ok := current.([]any)
+		if !ok {
+			return fmt.Errorf("el campo no es una lista")
+		}
+
+		pulled := make([]any, 0, len(list))
+		for _, item := range list {
+			if compareValues(item, value) != 0 {
+				pulled = append(pulled, item)
+			}
+		}
+		return setPath(data, parts, pulled)
+	}
+
+	return nil
+}
+
+// lookupPath obtiene el valor de un campo anidado
+func lookupPath(data map[string]any, parts []string) (any, bool) {
+	current := data
+	for i, part := range parts {
+		value, exists := current[part]
+		if !exists {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return value, true
+		}
+		if current, exists = value.(map[string]any); !exists {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// setPath asigna un campo anidado creando los objetos intermedios que falten.
+// Los objetos intermedios existentes se copian antes de modificarlos.
+func setPath(data map[string]any, parts []string, value any) error {
+	if len(parts) == 1 {
+		data[parts[0]] = value
+		return nil
+	}
+
+	var child map[string]any
+	switch existing := data[parts[0]].(type) {
+	case nil:
+		child = make(map[string]any)
+	case map[string]any:
+		child = maps.Clone(existing)
+	default:
+		return fmt.Errorf("%s no es un objeto", parts[0])
+	}
+
+	if err := setPath(child, parts[1:], value); err != nil {
+		return err
+	}
+	data[parts[0]] = child
+	return nil
+}
+
+// unsetPath elimina un campo anidado. Los objetos intermedios se copian antes de modificarlos.
+func unsetPath(data map[string]any, parts []string) {
+	if len(parts) == 1 {
+		delete(data, parts[0])
+		return
+	}
+
+	existing, ok := data[parts[0]].(map[string]any)
+	if !ok {
+		return
+	}
+	if _, exists := lookupPath(existing, parts[1:]); !exists {
+		return
+	}
+
+	child := maps.Clone(existing)
+	unsetPath(child, parts[1:])
+	data[parts[0]] = child
+}
+
+// addNumbers suma dos valores numéricos. El resultado es entero si ambos lo son.
+func addNumbers(a, b any) (any, error) {
+	x, y := newOrderedValue(a), newOrderedValue(b)
+	if x.kind != orderedKindNumber {
+		return nil, fmt.Errorf("el campo no es numérico")
+	}
+	if y.kind != orderedKindNumber {
+		return nil, fmt.Errorf("el incremento no es numérico")
+	}
+
+	ai, aInt := a.(int)
+	bi, bInt := b.(int)
+	if aInt && bInt {
+		return ai + bi, nil
+	}
+	return x.num + y.num, nil
+}
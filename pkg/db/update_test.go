@@ -0,0 +1,120 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateIncMissingAndNonNumericFields(t *testing.T) {
+	database := NewDatabase()
+	doc, err := database.CreateDocument("posts", map[string]any{"nombre": "hola", "likes": 2})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+
+	// Un campo que no existe empieza en cero, también dentro de un objeto nuevo
+	updated, err := database.ApplyUpdate(doc.ID, Update{}.Inc("likes", 3).Inc("visitas", 1).Inc("stats.total", 2.5))
+	if err != nil {
+		t.Fatalf("error al incrementar: %v", err)
+	}
+	want := map[string]any{"nombre": "hola", "likes": 5, "visitas": 1, "stats": map[string]any{"total": 2.5}}
+	if !reflect.DeepEqual(updated.Data, want) {
+		t.Errorf("datos = %v, se esperaba %v", updated.Data, want)
+	}
+
+	failures := []Update{
+		Update{}.Inc("nombre", 1),                 // El campo no es numérico
+		Update{}.Inc("likes", "uno"),              // El incremento no es numérico
+		Update{}.Inc("nombre.total", 1),           // El camino atraviesa un valor que no es un objeto
+		Update{}.Inc("likes", 1).Inc("nombre", 1), // Un operador válido no se aplica si falla otro
+	}
+	for _, update := range failures {
+		if _, err := database.ApplyUpdate(doc.ID, update); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%v: error = %v, se esperaba %v", update, err, ErrInvalidUpdate)
+		}
+	}
+
+	current, err := database.GetDocument(doc.ID)
+	if err != nil {
+		t.Fatalf("error al obtener documento: %v", err)
+	}
+	if !reflect.DeepEqual(current.Data, want) || current.Revision != updated.Revision {
+		t.Errorf("una actualización fallida cambió el documento: %v", current.Data)
+	}
+}
+
+func TestUpdatePushPullDotPaths(t *testing.T) {
+	data := map[string]any{
+		"perfil": map[string]any{"nombre": "ana", "tags": []any{"a", "b", "a"}},
+	}
+
+	update := Update{}.
+		Push("perfil.tags", "c").
+		Pull("perfil.tags", "a").
+		Push("perfil.extra.items", map[string]any{"$each": []any{1, 2}}).
+		Pull("perfil.ausente", "x")
+	result, err := update.Apply(data)
+	if err != nil {
+		t.Fatalf("error al aplicar: %v", err)
+	}
+
+	// $push se aplica antes que $pull
+	want := map[string]any{
+		"perfil": map[string]any{
+			"nombre": "ana",
+			"tags":   []any{"b", "c"},
+			"extra":  map[string]any{"items": []any{1, 2}},
+		},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("datos = %v, se esperaba %v", result, want)
+	}
+
+	// Los objetos del camino se copian: los datos originales no cambian
+	original := map[string]any{"nombre": "ana", "tags": []any{"a", "b", "a"}}
+	if !reflect.DeepEqual(data["perfil"], original) {
+		t.Errorf("se modificaron los datos originales: %v", data["perfil"])
+	}
+
+	for _, update := range []Update{
+		Update{}.Push("perfil.nombre", "x"),
+		Update{}.Pull("perfil.nombre", "x"),
+	} {
+		if _, err := update.Apply(data); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%v sobre un campo que no es una lista: error = %v", update, err)
+		}
+	}
+}
+
+func TestUpdateDocumentParsesOperators(t *testing.T) {
+	database := NewDatabase()
+	doc, err := database.CreateDocument("posts", map[string]any{
+		"titulo": "hola",
+		"meta":   map[string]any{"borrador": true, "autor": "ana"},
+	})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+
+	updated, err := database.UpdateDocument(doc.ID, map[string]any{
+		"$set":   map[string]any{"meta.autor": "luis"},
+		"$unset": map[string]any{"meta.borrador": ""},
+	})
+	if err != nil {
+		t.Fatalf("error al actualizar: %v", err)
+	}
+	want := map[string]any{"titulo": "hola", "meta": map[string]any{"autor": "luis"}}
+	if !reflect.DeepEqual(updated.Data, want) {
+		t.Errorf("datos = %v, se esperaba %v", updated.Data, want)
+	}
+
+	for _, data := range []map[string]any{
+		{"$rename": map[string]any{"titulo": "nombre"}},
+		{"$set": "titulo"},
+	} {
+		if _, err := database.UpdateDocument(doc.ID, data); !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%v: error = %v, se esperaba %v", data, err, ErrInvalidUpdate)
+		}
+	}
+}
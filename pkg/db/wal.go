@@ -0,0 +1,497 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formato de un registro del WAL:
+//
+//	longitud (uint32) | crc32 (uint32) | lsn (uint64) | transacción en JSON
+//
+// El CRC (Castagnoli) cubre el LSN y el contenido. Los segmentos se nombran con
+// el LSN de su primer registro y el punto de control guarda el último LSN cuyos
+// cambios ya están en los archivos de las colecciones.
+const (
+	walHeaderSize      = 16
+	walSegmentPrefix   = "wal-"
+	walSegmentSuffix   = ".log"
+	walCheckpointFile  = "checkpoint.json"
+	walMaxRecordSize   = 64 << 20
+	defaultSegmentSize = 16 << 20
+)
+
+// ErrWALCorrupted indica un registro dañado en medio del WAL, que no se puede
+// atribuir a una escritura interrumpida
+var ErrWALCorrupted = errors.New("WAL dañado")
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL es un registro de escritura anticipada dividido en segmentos
+type WAL struct {
+	dir           string
+	segmentSize   int64
+	segments      []walSegment // Segmentos ordenados por su primer LSN; el último es el activo
+	file          *os.File     // Segmento activo
+	fileSize      int64
+	lastLSN       uint64
+	checkpointLSN uint64
+	mutex         sync.Mutex
+	closed        bool
+	failed        error // Error que dejó el segmento activo en un estado desconocido
+}
+
+// walSegment describe un archivo de segmento
+type walSegment struct {
+	firstLSN uint64
+	path     string
+}
+
+// walCheckpoint es el contenido del archivo de punto de control
+type walCheckpoint struct {
+	LSN       uint64    `json:"lsn"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// OpenWAL abre el WAL de un directorio. Si el último segmento termina en un
+// registro incompleto o dañado (escritura interrumpida) se trunca en el último
+// registro válido.
+func OpenWAL(dir string, segmentSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error al crear directorio del WAL: %v", err)
+	}
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	w := &WAL{dir: dir, segmentSize: segmentSize}
+
+	checkpoint, err := w.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	w.checkpointLSN = checkpoint.LSN
+	w.lastLSN = checkpoint.LSN
+
+	if w.segments, err = w.listSegments(); err != nil {
+		return nil, err
+	}
+
+	// Recorrer los registros para conocer el último LSN y reparar la cola
+	if err := w.scan(0, func(Transaction) error { return nil }); err != nil {
+		return nil, err
+	}
+
+	if len(w.segments) == 0 {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	active := w.segments[len(w.segments)-1]
+	file, err := os.OpenFile(active.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir segmento del WAL: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error al abrir segmento del WAL: %v", err)
+	}
+	w.file = file
+	w.fileSize = info.Size()
+
+	return w, nil
+}
+
+// Append añade una transacción al WAL, la fuerza a disco y devuelve su LSN
+func (w *WAL) Append(transaction Transaction) (uint64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("WAL cerrado")
+	}
+	if w.failed != nil {
+		return 0, fmt.Errorf("WAL inutilizable: %v", w.failed)
+	}
+
+	if w.fileSize >= w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	lsn := w.lastLSN + 1
+	transaction.LSN = lsn
+	payload, err := json.Marshal(transaction)
+	if err != nil {
+		return 0, fmt.Errorf("error al serializar transacción: %v", err)
+	}
+	if len(payload) > walMaxRecordSize {
+		return 0, fmt.Errorf("transacción demasiado grande para el WAL: %d bytes", len(payload))
+	}
+
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(record[8:16], lsn)
+	copy(record[walHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(record[8:], walCRCTable))
+
+	if _, err := w.file.Write(record); err != nil {
+		w.discardLocked()
+		return 0, fmt.Errorf("error al escribir en el WAL: %v", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		w.discardLocked()
+		return 0, fmt.Errorf("error al sincronizar el WAL: %v", err)
+	}
+
+	w.fileSize += int64(len(record))
+	w.lastLSN = lsn
+	return lsn, nil
+}
+
+// discardLocked descarta un registro que no se escribió o no se forzó a disco,
+// para que el siguiente no quede detrás de él con un LSN repetido. Si no se
+// puede truncar el segmento, el WAL deja de aceptar escrituras.
+// Debe llamarse con el mutex bloqueado.
+func (w *WAL) discardLocked() {
+	if err := w.file.Truncate(w.fileSize); err != nil {
+		w.failed = err
+		return
+	}
+	if err := w.file.Sync(); err != nil {
+		w.failed = err
+	}
+}
+
+// ReadFrom llama a fn con cada transacción cuyo LSN es mayor que after, en orden
+func (w *WAL) ReadFrom(after uint64, fn func(Transaction) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.scan(after, fn)
+}
+
+// Checkpoint registra que los cambios hasta lsn ya están aplicados fuera del WAL
+// y elimina los segmentos que solo contienen registros anteriores
+func (w *WAL) Checkpoint(lsn uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("WAL cerrado")
+	}
+	if lsn > w.lastLSN {
+		return fmt.Errorf("punto de control %d posterior al último LSN %d", lsn, w.lastLSN)
+	}
+
+	if err := w.writeCheckpoint(walCheckpoint{LSN: lsn, Timestamp: time.Now()}); err != nil {
+		return err
+	}
+	w.checkpointLSN = lsn
+
+	// Empezar un segmento nuevo para poder eliminar el activo si ya está cubierto
+	if lsn == w.lastLSN && w.fileSize > 0 {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// Un segmento se puede eliminar si el siguiente empieza después del punto de control
+	keep := w.segments[:0]
+	for i, segment := range w.segments {
+		if i < len(w.segments)-1 && w.segments[i+1].firstLSN <= lsn+1 {
+			if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error al eliminar segmento del WAL: %v", err)
+			}
+			continue
+		}
+		keep = append(keep, segment)
+	}
+	w.segments = keep
+
+	return nil
+}
+
+// LastLSN devuelve el LSN del último registro escrito
+func (w *WAL) LastLSN() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.lastLSN
+}
+
+// CheckpointLSN devuelve el LSN del último punto de control
+func (w *WAL) CheckpointLSN() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.checkpointLSN
+}
+
+// Size devuelve el tamaño total de los segmentos en disco
+func (w *WAL) Size() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var size int64
+	for _, segment := range w.segments {
+		if info, err := os.Stat(segment.path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Close cierra el WAL
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.file.Close()
+}
+
+// rotate cierra el segmento activo y crea uno nuevo a partir del siguiente LSN.
+// Debe llamarse con el mutex bloqueado.
+func (w *WAL) rotate() error {
+	segment := walSegment{
+		firstLSN: w.lastLSN + 1,
+		path:     filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walSegmentPrefix, w.lastLSN+1, walSegmentSuffix)),
+	}
+
+	file, err := os.OpenFile(segment.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error al crear segmento del WAL: %v", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = file
+	w.fileSize = 0
+
+	// Un segmento vacío con el mismo primer LSN se reemplaza
+	if n := len(w.segments); n > 0 && w.segments[n-1].firstLSN == segment.firstLSN {
+		w.segments[n-1] = segment
+	} else {
+		w.segments = append(w.segments, segment)
+	}
+	return nil
+}
+
+// scan recorre los registros de los segmentos. Un registro incompleto o dañado al
+// final del último segmento se trunca; en cualquier otro punto es un error.
+// Debe llamarse con el mutex bloqueado.
+func (w *WAL) scan(after uint64, fn func(Transaction) error) error {
+	for i, segment := range w.segments {
+		// Saltar los segmentos cuyos registros son todos anteriores a after
+		if i < len(w.segments)-1 && w.segments[i+1].firstLSN <= after+1 {
+			continue
+		}
+
+		lastLSN, err := w.scanSegment(segment, i == len(w.segments)-1, after, fn)
+		if err != nil {
+			return err
+		}
+		if lastLSN > w.lastLSN {
+			w.lastLSN = lastLSN
+		}
+	}
+	return nil
+}
+
+// scanSegment recorre los registros de un segmento y devuelve el LSN del último
+func (w *WAL) scanSegment(segment walSegment, last bool, after uint64, fn func(Transaction) error) (uint64, error) {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return 0, fmt.Errorf("error al abrir segmento del WAL: %v", err)
+	}
+	defer file.Close()
+
+	var offset int64
+	var lastLSN uint64
+	expected := segment.firstLSN
+	header := make([]byte, walHeaderSize)
+	for {
+		transaction, size, damaged, err := readWALRecord(file, header, expected)
+		if err == io.EOF {
+			return lastLSN, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if damaged != "" {
+			if !last {
+				return 0, fmt.Errorf("%w: %s en %s", ErrWALCorrupted, damaged, filepath.Base(segment.path))
+			}
+			// Escritura interrumpida: descartar la cola del último segmento
+			if err := os.Truncate(segment.path, offset); err != nil {
+				return 0, fmt.Errorf("error al truncar el WAL: %v", err)
+			}
+			return lastLSN, nil
+		}
+
+		offset += size
+		lastLSN = transaction.LSN
+		expected = lastLSN + 1
+
+		if transaction.LSN > after {
+			if err := fn(transaction); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// readWALRecord lee el siguiente registro. Devuelve io.EOF al final del archivo
+// y una descripción del daño si el registro está incompleto o no es válido.
+func readWALRecord(file *os.File, header []byte, expected uint64) (Transaction, int64, string, error) {
+	var transaction Transaction
+
+	n, err := io.ReadFull(file, header)
+	if err == io.EOF {
+		return transaction, 0, "", io.EOF
+	}
+	if err != nil {
+		return transaction, 0, fmt.Sprintf("cabecera incompleta (%d bytes)", n), nil
+	}
+
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	lsn := binary.LittleEndian.Uint64(header[8:16])
+	if length > walMaxRecordSize {
+		return transaction, 0, fmt.Sprintf("longitud no válida %d", length), nil
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(file, payload); err != nil {
+		return transaction, 0, "registro incompleto", nil
+	}
+
+	if crc32.Update(crc32.Checksum(header[8:16], walCRCTable), walCRCTable, payload) != checksum {
+		return transaction, 0, fmt.Sprintf("CRC no válido en LSN %d", lsn), nil
+	}
+	if lsn != expected {
+		return transaction, 0, fmt.Sprintf("LSN %d fuera de secuencia, se esperaba %d", lsn, expected), nil
+	}
+	if err := json.Unmarshal(payload, &transaction); err != nil {
+		return transaction, 0, fmt.Sprintf("registro ilegible en LSN %d", lsn), nil
+	}
+
+	transaction.LSN = lsn
+	return transaction, int64(walHeaderSize) + int64(length), "", nil
+}
+
+// listSegments obtiene los segmentos del directorio ordenados por su primer LSN
+func (w *WAL) listSegments() ([]walSegment, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error al leer directorio del WAL: %v", err)
+	}
+
+	var segments []walSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		var firstLSN uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix), "%d", &firstLSN); err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{firstLSN: firstLSN, path: filepath.Join(w.dir, name)})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstLSN < segments[j].firstLSN
+	})
+	return segments, nil
+}
+
+// readCheckpoint lee el punto de control, si existe
+func (w *WAL) readCheckpoint() (walCheckpoint, error) {
+	var checkpoint walCheckpoint
+
+	data, err := os.ReadFile(filepath.Join(w.dir, walCheckpointFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checkpoint, nil
+		}
+		return checkpoint, fmt.Errorf("error al leer punto de control: %v", err)
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("error al deserializar punto de control: %v", err)
+	}
+	return checkpoint, nil
+}
+
+// writeCheckpoint escribe el punto de control de forma atómica
+func (w *WAL) writeCheckpoint(checkpoint walCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("error al serializar punto de control: %v", err)
+	}
+
+	filePath := filepath.Join(w.dir, walCheckpointFile)
+	tmpPath := filePath + ".tmp"
+	if err := writeFileSync(tmpPath, data); err != nil {
+		return fmt.Errorf("error al guardar punto de control: %v", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error al guardar punto de control: %v", err)
+	}
+	return syncDir(w.dir)
+}
+
+// writeFileSync escribe un archivo y lo fuerza a disco
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir fuerza a disco las entradas de un directorio (creaciones, renombrados y borrados)
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error al abrir directorio %s: %v", dir, err)
+	}
+	defer file.Close()
+
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return fmt.Errorf("error al sincronizar directorio %s: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+// appendWAL añade n transacciones al WAL
+func appendWAL(t *testing.T, w *WAL, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := w.Append(Transaction{ID: generateUUID(), Type: TransactionCreate, DocID: "doc"}); err != nil {
+			t.Fatalf("error al añadir al WAL: %v", err)
+		}
+	}
+}
+
+// readWAL devuelve los LSN de las transacciones posteriores a after
+func readWAL(t *testing.T, w *WAL, after uint64) []uint64 {
+	t.Helper()
+	var lsns []uint64
+	if err := w.ReadFrom(after, func(transaction Transaction) error {
+		lsns = append(lsns, transaction.LSN)
+		return nil
+	}); err != nil {
+		t.Fatalf("error al leer el WAL: %v", err)
+	}
+	return lsns
+}
+
+// flipByte invierte el último byte de un registro de un segmento
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error al leer el segmento: %v", err)
+	}
+	if offset < 0 {
+		offset += int64(len(data))
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("error al escribir el segmento: %v", err)
+	}
+}
+
+func TestWALTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	appendWAL(t, w, 3)
+	path := w.segments[len(w.segments)-1].path
+	w.Close()
+
+	// Escritura interrumpida: la mitad de la cabecera de un cuarto registro
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("error al abrir el segmento: %v", err)
+	}
+	file.Write(make([]byte, walHeaderSize/2))
+	file.Close()
+
+	w, err = OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al reabrir el WAL: %v", err)
+	}
+	defer w.Close()
+	if w.LastLSN() != 3 {
+		t.Errorf("último LSN = %d, se esperaba 3", w.LastLSN())
+	}
+	appendWAL(t, w, 1)
+	if lsns := readWAL(t, w, 0); !slices.Equal(lsns, []uint64{1, 2, 3, 4}) {
+		t.Errorf("LSN leídos = %v, se esperaba [1 2 3 4]", lsns)
+	}
+}
+
+func TestWALTruncatesCorruptedLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	appendWAL(t, w, 3)
+	path := w.segments[len(w.segments)-1].path
+	w.Close()
+
+	// Un byte dañado en el último registro del último segmento
+	flipByte(t, path, -2)
+
+	w, err = OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al reabrir el WAL: %v", err)
+	}
+	defer w.Close()
+	if lsns := readWAL(t, w, 0); !slices.Equal(lsns, []uint64{1, 2}) {
+		t.Errorf("LSN leídos = %v, se esperaba [1 2]", lsns)
+	}
+}
+
+func TestWALRejectsCorruptedEarlierSegment(t *testing.T) {
+	dir := t.TempDir()
+	// Con segmentos de un byte cada registro va en su propio segmento
+	w, err := OpenWAL(dir, 1)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	appendWAL(t, w, 3)
+	if len(w.segments) != 3 {
+		t.Fatalf("segmentos = %d, se esperaban 3", len(w.segments))
+	}
+	path := w.segments[0].path
+	w.Close()
+
+	flipByte(t, path, -2)
+
+	if _, err := OpenWAL(dir, 1); !errors.Is(err, ErrWALCorrupted) {
+		t.Errorf("error al abrir = %v, se esperaba %v", err, ErrWALCorrupted)
+	}
+}
+
+func TestWALReplaysAfterCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 1)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	appendWAL(t, w, 4)
+	if err := w.Checkpoint(2); err != nil {
+		t.Fatalf("error al crear el punto de control: %v", err)
+	}
+	w.Close()
+
+	w, err = OpenWAL(dir, 1)
+	if err != nil {
+		t.Fatalf("error al reabrir el WAL: %v", err)
+	}
+	defer w.Close()
+	if w.CheckpointLSN() != 2 {
+		t.Fatalf("punto de control = %d, se esperaba 2", w.CheckpointLSN())
+	}
+	if lsns := readWAL(t, w, w.CheckpointLSN()); !slices.Equal(lsns, []uint64{3, 4}) {
+		t.Errorf("LSN reproducidos = %v, se esperaba [3 4]", lsns)
+	}
+}
+
+func TestWALCheckpointRemovesCoveredSegments(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 1)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	defer w.Close()
+	appendWAL(t, w, 4)
+	segments := append([]walSegment(nil), w.segments...)
+
+	if err := w.Checkpoint(3); err != nil {
+		t.Fatalf("error al crear el punto de control: %v", err)
+	}
+
+	for _, segment := range segments {
+		_, err := os.Stat(segment.path)
+		covered := segment.firstLSN <= 3
+		if covered && !os.IsNotExist(err) {
+			t.Errorf("el segmento %d, cubierto por el punto de control, sigue en disco", segment.firstLSN)
+		}
+		if !covered && err != nil {
+			t.Errorf("el segmento %d no cubierto se eliminó: %v", segment.firstLSN, err)
+		}
+	}
+	if lsns := readWAL(t, w, 0); !slices.Equal(lsns, []uint64{4}) {
+		t.Errorf("LSN tras el punto de control = %v, se esperaba [4]", lsns)
+	}
+}
+
+func TestWALDiscardsPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	appendWAL(t, w, 2)
+
+	// Una escritura fallida que deja parte del registro en el segmento
+	if _, err := w.file.Write(make([]byte, walHeaderSize+3)); err != nil {
+		t.Fatalf("error al escribir en el segmento: %v", err)
+	}
+	w.discardLocked()
+	if w.failed != nil {
+		t.Fatalf("el WAL quedó inutilizable: %v", w.failed)
+	}
+
+	// La siguiente escritura no queda detrás de los restos del registro
+	appendWAL(t, w, 1)
+	w.Close()
+
+	w, err = OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al reabrir el WAL: %v", err)
+	}
+	defer w.Close()
+	if lsns := readWAL(t, w, 0); !slices.Equal(lsns, []uint64{1, 2, 3}) {
+		t.Errorf("LSN leídos = %v, se esperaba [1 2 3]", lsns)
+	}
+}
+
+func TestWALRefusesAppendsAfterFailedDiscard(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWAL(dir, 0)
+	if err != nil {
+		t.Fatalf("error al abrir el WAL: %v", err)
+	}
+	defer w.Close()
+	appendWAL(t, w, 2)
+	path := w.segments[len(w.segments)-1].path
+
+	// Con un descriptor de solo lectura fallan tanto la escritura como el truncado
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error al abrir el segmento: %v", err)
+	}
+	w.file.Close()
+	w.file = readOnly
+	if _, err := w.Append(Transaction{ID: generateUUID(), DocID: "doc"}); err == nil {
+		t.Fatalf("se esperaba un error al escribir")
+	}
+
+	// Aunque el segmento vuelva a admitir escrituras, su estado es desconocido
+	writable, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("error al abrir el segmento: %v", err)
+	}
+	readOnly.Close()
+	w.file = writable
+	if _, err := w.Append(Transaction{ID: generateUUID(), DocID: "doc"}); err == nil {
+		t.Errorf("el WAL acepta escrituras tras no poder descartar un registro")
+	}
+}
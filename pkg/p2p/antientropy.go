@@ -0,0 +1,247 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// AntiEntropyProtocol protocolo con el que los nodos comparan sus árboles Merkle
+// y se piden los documentos que difieren. Cada stream lleva una petición y su respuesta.
+const AntiEntropyProtocol = protocol.ID("/dbp2p/antientropy/1.0.0")
+
+// Tipos de petición de anti-entropía
+const (
+	merkleRoots   = "roots"
+	merkleNodes   = "nodes"
+	merkleEntries = "entries"
+	merkleFetch   = "fetch"
+)
+
+// merkleRequest es una petición de anti-entropía
+type merkleRequest struct {
+	Type       string   `json:"type"`
+	Collection string   `json:"collection,omitempty"`
+	Level      int      `json:"level,omitempty"`
+	Indexes    []uint32 `json:"indexes,omitempty"` // Nodos del nivel o, en entries, hojas
+	IDs        []string `json:"ids,omitempty"`
+}
+
+// merkleResponse es la respuesta a una petición de anti-entropía
+type merkleResponse struct {
+	Error      string            `json:"error,omitempty"`
+	Roots      map[string]uint64 `json:"roots,omitempty"`
+	Hashes     []uint64          `json:"hashes,omitempty"`
+	Entries    map[string]uint64 `json:"entries,omitempty"`
+	Documents  []*db.Document    `json:"documents,omitempty"`
+	Tombstones []*db.Tombstone   `json:"tombstones,omitempty"`
+}
+
+// countingReader cuenta los bytes leídos
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingWriter cuenta los bytes escritos
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// merklePeer implementa db.MerklePeer sobre streams del protocolo de anti-entropía
+type merklePeer struct {
+	host     host.Host
+	id       peer.ID
+	timeout  time.Duration
+	sent     int64 // Bytes enviados
+	received int64 // Bytes recibidos
+}
+
+// ID devuelve el identificador del nodo
+func (p *merklePeer) ID() string {
+	return p.id.String()
+}
+
+// call envía una petición en un stream nuevo y devuelve la respuesta
+func (p *merklePeer) call(ctx context.Context, request merkleRequest) (merkleResponse, error) {
+	var response merkleResponse
+
+	stream, err := p.host.NewStream(ctx, p.id, AntiEntropyProtocol)
+	if err != nil {
+		return response, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	if p.timeout > 0 {
+		stream.SetDeadline(time.Now().Add(p.timeout))
+	}
+
+	if err := json.NewEncoder(countingWriter{stream, &p.sent}).Encode(request); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al enviar petición: %v", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al enviar petición: %v", err)
+	}
+
+	if err := json.NewDecoder(countingReader{stream, &p.received}).Decode(&response); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al leer respuesta: %v", err)
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// Roots devuelve la raíz del árbol de cada colección del otro nodo
+func (p *merklePeer) Roots(ctx context.Context) (map[string]uint64, error) {
+	response, err := p.call(ctx, merkleRequest{Type: merkleRoots})
+	return response.Roots, err
+}
+
+// Nodes devuelve los hashes de los nodos indicados de un nivel
+func (p *merklePeer) Nodes(ctx context.Context, collection string, level int, indexes []uint32) ([]uint64, error) {
+	response, err := p.call(ctx, merkleRequest{Type: merkleNodes, Collection: collection, Level: level, Indexes: indexes})
+	return response.Hashes, err
+}
+
+// Entries devuelve las entradas de las hojas indicadas
+func (p *merklePeer) Entries(ctx context.Context, collection string, leaves []uint32) (map[string]uint64, error) {
+	response, err := p.call(ctx, merkleRequest{Type: merkleEntries, Collection: collection, Indexes: leaves})
+	return response.Entries, err
+}
+
+// Fetch devuelve los documentos y lápidas con los IDs indicados
+func (p *merklePeer) Fetch(ctx context.Context, collection string, ids []string) ([]*db.Document, []*db.Tombstone, error) {
+	response, err := p.call(ctx, merkleRequest{Type: merkleFetch, Collection: collection, IDs: ids})
+	return response.Documents, response.Tombstones, err
+}
+
+// handleAntiEntropyStream responde a una petición de anti-entropía de otro nodo
+func (sm *SyncManager) handleAntiEntropyStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(sm.config.ResponseTimeout))
+
+	var received, sent int64
+	var request merkleRequest
+	if err := json.NewDecoder(countingReader{stream, &received}).Decode(&request); err != nil {
+		stream.Reset()
+		fmt.Printf("Error al leer petición de anti-entropía: %v\n", err)
+		return
+	}
+
+	remote := stream.Conn().RemotePeer().String()
+	sm.database.AddPeer(remote)
+	response := sm.answerMerkleRequest(remote, request)
+
+	if err := json.NewEncoder(countingWriter{stream, &sent}).Encode(response); err != nil {
+		stream.Reset()
+		fmt.Printf("Error al enviar respuesta de anti-entropía: %v\n", err)
+		return
+	}
+
+	// Actualizar estadísticas
+	sm.mutex.Lock()
+	sm.syncStats.DocumentsSent += len(response.Documents)
+	sm.syncStats.BytesSent += sent
+	sm.syncStats.BytesReceived += received
+	sm.syncStats.AntiEntropyBytes += sent + received
+	sm.mutex.Unlock()
+}
+
+// answerMerkleRequest calcula la respuesta a una petición de anti-entropía. Las
+// colecciones que el nodo no publica no se anuncian ni se sirven, y tampoco las
+// filtradas, cuyo árbol incluye documentos que no se replican, ni las cifradas
+// que el otro nodo no puede leer.
+func (sm *SyncManager) answerMerkleRequest(remote string, request merkleRequest) merkleResponse {
+	policy := sm.policy()
+	served := func(collection string) bool {
+		return policy.Publishes(collection) && !policy.Filtered(collection) &&
+			sm.database.CanRead(remote, collection)
+	}
+	if request.Type != merkleRoots && !served(request.Collection) {
+		return merkleResponse{Error: fmt.Sprintf("colección no replicada: %s", request.Collection)}
+	}
+
+	switch request.Type {
+	case merkleRoots:
+		roots := sm.database.MerkleRoots()
+		for collection := range roots {
+			if !served(collection) {
+				delete(roots, collection)
+			}
+		}
+		return merkleResponse{Roots: roots}
+	case merkleNodes:
+		return merkleResponse{Hashes: sm.database.MerkleNodes(request.Collection, request.Level, request.Indexes)}
+	case merkleEntries:
+		return merkleResponse{Entries: sm.database.MerkleEntries(request.Collection, request.Indexes)}
+	case merkleFetch:
+		documents, tombstones := sm.database.GetReplicas(request.Collection, request.IDs)
+		return merkleResponse{Documents: documents, Tombstones: tombstones}
+	default:
+		return merkleResponse{Error: fmt.Sprintf("tipo de petición desconocido: %s", request.Type)}
+	}
+}
+
+// antiEntropy sincroniza con un peer comparando los árboles Merkle
+func (sm *SyncManager) antiEntropy(ctx context.Context, pid peer.ID) error {
+	remote := &merklePeer{
+		host:    sm.node.Host,
+		id:      pid,
+		timeout: sm.config.ResponseTimeout,
+	}
+
+	// Las colecciones filtradas se sincronizan solo de forma incremental, y no se
+	// comparan las colecciones en las que la ACL no permite escribir al peer
+	policy := sm.policy()
+	from := pid.String()
+	include := func(collection string) bool {
+		if !policy.Subscribes(collection) || policy.Filtered(collection) {
+			return false
+		}
+		return sm.database.AllowsReplication(from, db.OperationCreate, collection) ||
+			sm.database.AllowsReplication(from, db.OperationUpdate, collection) ||
+			sm.database.AllowsReplication(from, db.OperationDelete, collection)
+	}
+	stats, err := sm.database.AntiEntropy(ctx, remote, include, sm.config.BatchSize)
+
+	// Actualizar estadísticas, también si la sincronización se interrumpió
+	sent := atomic.LoadInt64(&remote.sent)
+	received := atomic.LoadInt64(&remote.received)
+	sm.mutex.Lock()
+	sm.syncStats.AntiEntropyRounds += stats.Rounds
+	sm.syncStats.AntiEntropyBytes += sent + received
+	sm.syncStats.BytesSent += sent
+	sm.syncStats.BytesReceived += received
+	sm.syncStats.DocumentsReceived += stats.Documents
+	sm.mutex.Unlock()
+
+	return err
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// requestStream es el stream del nodo que pide: al cerrar la escritura, el otro
+// nodo atiende la petición con serve y su respuesta queda disponible para leerla
+type requestStream struct {
+	*testStream
+	self  peer.ID
+	serve func(stream network.Stream)
+}
+
+// newRequestStream abre un stream de self con remote, que lo atiende con serve
+func newRequestStream(self, remote peer.ID, serve func(stream network.Stream)) *requestStream {
+	return &requestStream{testStream: &testStream{remote: remote, in: bytes.NewReader(nil)}, self: self, serve: serve}
+}
+
+func (s *requestStream) CloseWrite() error {
+	served := &testStream{remote: s.self, in: &s.out}
+	s.serve(served)
+	s.in = &served.out
+	return nil
+}
+
+// antiEntropyHost abre streams de anti-entropía con los gestores de otros nodos
+type antiEntropyHost struct {
+	host.Host
+	self  peer.ID
+	peers map[peer.ID]*SyncManager
+}
+
+func (h antiEntropyHost) NewStream(_ context.Context, pid peer.ID, _ ...protocol.ID) (network.Stream, error) {
+	server, exists := h.peers[pid]
+	if !exists {
+		return nil, errors.New("peer inalcanzable")
+	}
+	return newRequestStream(h.self, pid, server.handleAntiEntropyStream), nil
+}
+
+// newAntiEntropyNode crea el gestor de sincronización de un nodo de la red de prueba
+func newAntiEntropyNode(id peer.ID, peers map[peer.ID]*SyncManager) *SyncManager {
+	database := db.NewDatabase()
+	database.SetNodeID(id.String())
+	sm := NewSyncManager(&Node{Host: antiEntropyHost{self: id, peers: peers}}, database)
+	peers[id] = sm
+	return sm
+}
+
+func TestAntiEntropyConvergesAndUpdatesStats(t *testing.T) {
+	peers := make(map[peer.ID]*SyncManager)
+	local := newAntiEntropyNode(peer.ID("local"), peers)
+	remote := newAntiEntropyNode(peer.ID("remote"), peers)
+
+	for i := range 50 {
+		doc, err := remote.database.CreateDocument("notas", map[string]any{"n": i})
+		if err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+		if i%10 == 0 {
+			continue // Documentos que el nodo local no recibió
+		}
+		if _, err := local.database.ApplyRemoteDocument(doc); err != nil {
+			t.Fatalf("error al replicar documento: %v", err)
+		}
+	}
+	if _, err := local.database.CreateDocument("notas", map[string]any{"n": "local"}); err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+
+	if err := local.antiEntropy(context.Background(), peer.ID("remote")); err != nil {
+		t.Fatalf("error en la anti-entropía: %v", err)
+	}
+	if err := remote.antiEntropy(context.Background(), peer.ID("local")); err != nil {
+		t.Fatalf("error en la anti-entropía: %v", err)
+	}
+
+	localRoots, remoteRoots := local.database.MerkleRoots(), remote.database.MerkleRoots()
+	if localRoots["notas"] == 0 || localRoots["notas"] != remoteRoots["notas"] {
+		t.Fatalf("los árboles no convergen: %x y %x", localRoots["notas"], remoteRoots["notas"])
+	}
+
+	// Raíces, tres niveles, entradas y un lote de documentos en cada sentido
+	localStats, remoteStats := local.GetSyncStats(), remote.GetSyncStats()
+	if localStats.AntiEntropyRounds != 6 || remoteStats.AntiEntropyRounds != 6 {
+		t.Errorf("intercambios = %d y %d, se esperaban 6", localStats.AntiEntropyRounds, remoteStats.AntiEntropyRounds)
+	}
+	if localStats.DocumentsReceived != 5 || remoteStats.DocumentsReceived != 1 {
+		t.Errorf("documentos recibidos = %d y %d, se esperaban 5 y 1", localStats.DocumentsReceived, remoteStats.DocumentsReceived)
+	}
+	if localStats.DocumentsSent != 1 || remoteStats.DocumentsSent != 5 {
+		t.Errorf("documentos enviados = %d y %d, se esperaban 1 y 5", localStats.DocumentsSent, remoteStats.DocumentsSent)
+	}
+
+	// Cada nodo cuenta lo que envía y recibe al pedir y al responder
+	for _, stats := range []SyncStats{localStats, remoteStats} {
+		if stats.BytesSent == 0 || stats.BytesReceived == 0 {
+			t.Errorf("bytes = %d enviados y %d recibidos, se esperaban ambos", stats.BytesSent, stats.BytesReceived)
+		}
+		if stats.AntiEntropyBytes != stats.BytesSent+stats.BytesReceived {
+			t.Errorf("bytes de anti-entropía = %d, se esperaban %d", stats.AntiEntropyBytes, stats.BytesSent+stats.BytesReceived)
+		}
+	}
+}
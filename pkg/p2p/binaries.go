@@ -0,0 +1,629 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/binary"
+	"github.com/aratan/dbp2p/pkg/db"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// BinaryProtocol protocolo con el que los nodos se piden los manifiestos y los
+// fragmentos de los archivos binarios. En un mismo stream se pueden hacer varias
+// peticiones, cada una con su respuesta.
+const BinaryProtocol = protocol.ID("/dbp2p/binary/1.0.0")
+
+// binaryTopic tema en el que se anuncian los archivos nuevos
+const binaryTopic = "db-binaries"
+
+const (
+	// binaryRequestTimeout tiempo máximo de cada petición de un manifiesto o fragmento
+	binaryRequestTimeout = 30 * time.Second
+	// binaryReadTimeout tiempo máximo para obtener un archivo al leerlo
+	binaryReadTimeout = 5 * time.Minute
+	// binaryProviderCount número de proveedores de un archivo que se buscan en el DHT
+	binaryProviderCount = 5
+	// binaryReprovideInterval intervalo entre anuncios de los archivos en el DHT
+	binaryReprovideInterval = 12 * time.Hour
+)
+
+// BinaryMode indica cuándo obtiene un nodo los archivos de otros nodos
+type BinaryMode string
+
+const (
+	// BinaryLazy obtiene cada archivo la primera vez que se lee
+	BinaryLazy BinaryMode = "lazy"
+	// BinaryEager obtiene cada archivo en cuanto se anuncia
+	BinaryEager BinaryMode = "eager"
+)
+
+// BinaryPolicy establece el modo de replicación de los archivos de cada colección
+type BinaryPolicy struct {
+	Mode        BinaryMode            // Modo de las colecciones no listadas
+	Collections map[string]BinaryMode // Modo de cada colección
+}
+
+// Validate comprueba que los modos de la política son conocidos
+func (p BinaryPolicy) Validate() error {
+	if err := validateBinaryMode(p.Mode); err != nil {
+		return err
+	}
+	for collection, mode := range p.Collections {
+		if err := validateBinaryMode(mode); err != nil {
+			return fmt.Errorf("colección %s: %v", collection, err)
+		}
+	}
+	return nil
+}
+
+// validateBinaryMode comprueba que un modo de replicación es conocido
+func validateBinaryMode(mode BinaryMode) error {
+	switch mode {
+	case BinaryLazy, BinaryEager:
+		return nil
+	default:
+		return fmt.Errorf("modo de replicación de archivos desconocido: %s", mode)
+	}
+}
+
+// ModeFor devuelve el modo de replicación de los archivos de una colección
+func (p BinaryPolicy) ModeFor(collection string) BinaryMode {
+	if mode, exists := p.Collections[collection]; exists {
+		return mode
+	}
+	return p.Mode
+}
+
+// eagerCollections devuelve las colecciones que se replican al anunciarse; nil
+// si son todas salvo las listadas en modo lazy
+func (p BinaryPolicy) eagerCollections() ([]string, bool) {
+	if p.Mode == BinaryEager {
+		return nil, true
+	}
+	var collections []string
+	for collection, mode := range p.Collections {
+		if mode == BinaryEager {
+			collections = append(collections, collection)
+		}
+	}
+	return collections, len(collections) > 0
+}
+
+// binaryRequest petición del protocolo de archivos
+type binaryRequest struct {
+	Type        string   `json:"type"` // "manifest", "chunk" o "list"
+	FileID      string   `json:"file_id,omitempty"`
+	Hash        string   `json:"hash,omitempty"`
+	Collections []string `json:"collections,omitempty"` // Colecciones de la lista; vacío para todas
+}
+
+// binaryResponse respuesta a una petición del protocolo de archivos
+type binaryResponse struct {
+	File  *binary.FileMetadata  `json:"file,omitempty"`
+	Files []binary.FileMetadata `json:"files,omitempty"`
+	Data  []byte                `json:"data,omitempty"`
+	Error string                `json:"error,omitempty"`
+}
+
+// binaryFetch obtención de un archivo en curso, que comparten las peticiones
+// simultáneas del mismo archivo
+type binaryFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// BinaryReplicator replica los archivos de un BinaryManager entre los nodos.
+// Los archivos completos se anuncian como disponibles en el DHT, y los nuevos
+// también en un tema del clúster. Los fragmentos que faltan se piden a los
+// nodos que los tienen por BinaryProtocol, comprobando cada uno con su hash;
+// los ya recibidos se conservan, de modo que una transferencia interrumpida
+// continúa donde se quedó.
+type BinaryReplicator struct {
+	node     *Node
+	manager  *binary.BinaryManager
+	database *db.Database
+	policy   BinaryPolicy
+	topic    string
+	fetches  map[string]*binaryFetch
+	notifiee *network.NotifyBundle
+	mutex    sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewBinaryReplicator crea el servicio de replicación de archivos del nodo
+func NewBinaryReplicator(n *Node, manager *binary.BinaryManager, policy BinaryPolicy, clusterID string) (*BinaryReplicator, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	topic := binaryTopic
+	if clusterID != "" {
+		topic = clusterID + "/" + binaryTopic
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	return &BinaryReplicator{
+		node:     n,
+		manager:  manager,
+		database: n.Database,
+		policy:   policy,
+		topic:    topic,
+		fetches:  make(map[string]*binaryFetch),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Start empieza a servir los archivos, a anunciarlos y a obtener los que faltan
+func (r *BinaryReplicator) Start() error {
+	host := r.node.Host
+	host.SetStreamHandler(BinaryProtocol, r.handleBinaryStream)
+
+	if r.node.PubSub != nil {
+		if err := r.node.PubSub.Subscribe(r.topic, r.handleAnnouncement); err != nil {
+			host.RemoveStreamHandler(BinaryProtocol)
+			return fmt.Errorf("error al suscribirse a los anuncios de archivos: %v", err)
+		}
+	}
+
+	r.manager.SetFetcher(r.fetchForRead)
+	r.manager.RegisterStoreCallback(r.announce)
+
+	// Los nodos con colecciones en modo eager traen de cada peer que se conecta
+	// los archivos que se anunciaron mientras no estaban
+	if _, eager := r.policy.eagerCollections(); eager {
+		r.notifiee = &network.NotifyBundle{
+			ConnectedF: func(_ network.Network, conn network.Conn) {
+				go r.catchUp(conn.RemotePeer())
+			},
+		}
+		host.Network().Notify(r.notifiee)
+
+		for _, pid := range host.Network().Peers() {
+			go r.catchUp(pid)
+		}
+	}
+
+	go r.provideLoop()
+	return nil
+}
+
+// Stop deja de servir y obtener archivos
+func (r *BinaryReplicator) Stop() {
+	r.node.Host.RemoveStreamHandler(BinaryProtocol)
+	if r.notifiee != nil {
+		r.node.Host.Network().StopNotify(r.notifiee)
+	}
+	if r.node.PubSub != nil {
+		r.node.PubSub.Unsubscribe(r.topic)
+	}
+	r.manager.SetFetcher(nil)
+	r.cancel()
+}
+
+// fileKey devuelve la clave con la que se anuncia un archivo en el DHT
+func fileKey(id string) string {
+	return "/dbp2p/binary/" + id
+}
+
+// provide anuncia en el DHT que el nodo tiene un archivo completo
+func (r *BinaryReplicator) provide(id string) {
+	if r.node.DHTService == nil {
+		return
+	}
+	if err := r.node.DHTService.Provide(fileKey(id)); err != nil {
+		log.Printf("Error al anunciar el archivo %s en el DHT: %v", id, err)
+	}
+}
+
+// provideLoop anuncia periódicamente en el DHT los archivos completos del nodo,
+// ya que los anuncios caducan
+func (r *BinaryReplicator) provideLoop() {
+	ticker := time.NewTicker(binaryReprovideInterval)
+	defer ticker.Stop()
+
+	for {
+		if r.node.DHTService != nil {
+			files, err := r.manager.ListFiles("")
+			if err != nil {
+				log.Printf("Error al listar archivos para anunciarlos: %v", err)
+			}
+			for _, file := range files {
+				if r.ctx.Err() != nil {
+					return
+				}
+				if file.Manifest != nil && r.manager.HasFile(file.ID) {
+					r.provide(file.ID)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// announce anuncia un archivo recién almacenado en el DHT y a los nodos del
+// clúster
+func (r *BinaryReplicator) announce(metadata *binary.FileMetadata) {
+	go func() {
+		r.provide(metadata.ID)
+
+		if r.node.PubSub == nil {
+			return
+		}
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			log.Printf("Error al serializar el anuncio del archivo %s: %v", metadata.ID, err)
+			return
+		}
+		if err := r.node.PubSub.Publish(r.topic, data); err != nil {
+			log.Printf("Error al anunciar el archivo %s: %v", metadata.ID, err)
+		}
+	}()
+}
+
+// handleAnnouncement obtiene los archivos anunciados de las colecciones en modo
+// eager, si el nodo que los anuncia puede escribir en ellas
+func (r *BinaryReplicator) handleAnnouncement(msg *pubsub.Message) error {
+	var metadata binary.FileMetadata
+	if err := json.Unmarshal(msg.Data, &metadata); err != nil {
+		return fmt.Errorf("error al deserializar anuncio de archivo: %v", err)
+	}
+
+	from := msg.GetFrom()
+	if from == r.node.Host.ID() || !r.wants(metadata.Collection) || r.manager.HasFile(metadata.ID) {
+		return nil
+	}
+	if !r.database.AllowsReplication(from.String(), db.OperationCreate, metadata.Collection) {
+		r.database.RejectReplication(from.String(), fmt.Sprintf("sin permiso para escribir archivos en %s", metadata.Collection))
+		return nil
+	}
+	if err := r.manager.ImportMetadata(&metadata); err != nil {
+		return err
+	}
+
+	go func() {
+		if err := r.Fetch(r.ctx, metadata.ID, from); err != nil {
+			log.Printf("Error al replicar el archivo %s: %v", metadata.ID, err)
+		}
+	}()
+	return nil
+}
+
+// wants indica si el nodo obtiene los archivos de una colección al anunciarse
+func (r *BinaryReplicator) wants(collection string) bool {
+	return r.policy.ModeFor(collection) == BinaryEager && r.database.ReplicationPolicy().Subscribes(collection)
+}
+
+// catchUp obtiene de un peer los archivos de las colecciones en modo eager que
+// le faltan al nodo
+func (r *BinaryReplicator) catchUp(pid peer.ID) {
+	if pid == r.node.Host.ID() {
+		return
+	}
+
+	collections, _ := r.policy.eagerCollections()
+	fetched, err := r.fetchFiles(r.ctx, pid, collections, r.wants)
+	if err != nil {
+		// Los nodos sin replicación de archivos no responden al protocolo
+		return
+	}
+	if fetched > 0 {
+		log.Printf("Obtenidos %d archivos de %s", fetched, pid.String())
+	}
+}
+
+// fetchFiles obtiene de un peer los archivos de las colecciones indicadas, o de
+// todas si no se indica ninguna, que cumplen want y le faltan al nodo. Devuelve
+// cuántos se obtuvieron; los que fallan solo se registran.
+func (r *BinaryReplicator) fetchFiles(ctx context.Context, pid peer.ID, collections []string, want func(collection string) bool) (int, error) {
+	files, err := r.ListRemoteFiles(ctx, pid, collections)
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return fetched, ctx.Err()
+		}
+		if !want(file.Collection) || r.manager.HasFile(file.ID) {
+			continue
+		}
+		if err := r.Fetch(ctx, file.ID, pid); err != nil {
+			log.Printf("Error al replicar el archivo %s: %v", file.ID, err)
+			continue
+		}
+		fetched++
+	}
+	return fetched, nil
+}
+
+// fetchForRead obtiene un archivo que se está leyendo y el nodo no tiene. Se
+// usa como binary.FetchFunc del gestor de binarios.
+func (r *BinaryReplicator) fetchForRead(id string) error {
+	ctx, cancel := context.WithTimeout(r.ctx, binaryReadTimeout)
+	defer cancel()
+	return r.Fetch(ctx, id)
+}
+
+// Fetch obtiene los fragmentos que faltan de un archivo, probando primero con
+// los peers indicados y después con los proveedores del DHT y los peers
+// conectados. Al completarlo, el nodo lo anuncia como proveedor.
+func (r *BinaryReplicator) Fetch(ctx context.Context, id string, hints ...peer.ID) error {
+	// Compartir la obtención si ya está en curso
+	r.mutex.Lock()
+	if fetch, exists := r.fetches[id]; exists {
+		r.mutex.Unlock()
+		select {
+		case <-fetch.done:
+			return fetch.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	fetch := &binaryFetch{done: make(chan struct{})}
+	r.fetches[id] = fetch
+	r.mutex.Unlock()
+
+	fetch.err = r.fetch(ctx, id, hints)
+
+	r.mutex.Lock()
+	delete(r.fetches, id)
+	r.mutex.Unlock()
+	close(fetch.done)
+
+	return fetch.err
+}
+
+// fetch obtiene un archivo de los candidatos hasta completarlo
+func (r *BinaryReplicator) fetch(ctx context.Context, id string, hints []peer.ID) error {
+	if r.manager.HasFile(id) {
+		return nil
+	}
+
+	var lastErr error
+	for _, pid := range r.candidates(id, hints) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := r.fetchFrom(ctx, pid, id); err != nil {
+			lastErr = err
+			log.Printf("No se pudo obtener el archivo %s de %s: %v", id, pid.String(), err)
+			continue
+		}
+		if r.manager.HasFile(id) {
+			r.provide(id)
+			return nil
+		}
+	}
+
+	if lastErr == nil {
+		return fmt.Errorf("ningún nodo tiene el archivo %s", id)
+	}
+	return fmt.Errorf("no se pudo obtener el archivo %s: %v", id, lastErr)
+}
+
+// candidates devuelve los peers a los que pedir un archivo, sin repetir
+func (r *BinaryReplicator) candidates(id string, hints []peer.ID) []peer.ID {
+	self := r.node.Host.ID()
+	var candidates []peer.ID
+	add := func(pid peer.ID) {
+		if pid != self && pid != "" && !slices.Contains(candidates, pid) {
+			candidates = append(candidates, pid)
+		}
+	}
+
+	for _, pid := range hints {
+		add(pid)
+	}
+	if r.node.DHTService != nil {
+		providers, err := r.node.DHTService.FindProviders(fileKey(id), binaryProviderCount)
+		if err != nil {
+			log.Printf("Error al buscar proveedores del archivo %s: %v", id, err)
+		}
+		for _, provider := range providers {
+			r.node.Host.Peerstore().AddAddrs(provider.ID, provider.Addrs, peerstore.TempAddrTTL)
+			add(provider.ID)
+		}
+	}
+	for _, pid := range r.node.Host.Network().Peers() {
+		add(pid)
+	}
+	return candidates
+}
+
+// fetchFrom pide a un peer el manifiesto de un archivo, si falta, y los
+// fragmentos que no tiene el nodo
+func (r *BinaryReplicator) fetchFrom(ctx context.Context, pid peer.ID, id string) error {
+	stream, err := r.node.Host.NewStream(ctx, pid, BinaryProtocol)
+	if err != nil {
+		return fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	metadata, err := r.manager.GetMetadata(id)
+	if errors.Is(err, binary.ErrFileNotFound) {
+		response, err := r.request(stream, binaryRequest{Type: "manifest", FileID: id})
+		if err != nil {
+			return err
+		}
+		metadata = response.File
+		if metadata == nil || metadata.ID != id {
+			stream.Reset()
+			return fmt.Errorf("respuesta sin el manifiesto del archivo")
+		}
+		if !r.database.AllowsReplication(pid.String(), db.OperationCreate, metadata.Collection) {
+			stream.Reset()
+			r.database.RejectReplication(pid.String(), fmt.Sprintf("sin permiso para escribir archivos en %s", metadata.Collection))
+			return fmt.Errorf("nodo no autorizado para la colección %s", metadata.Collection)
+		}
+		if err := r.manager.ImportMetadata(metadata); err != nil {
+			stream.Reset()
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for _, chunk := range r.manager.MissingChunks(metadata) {
+		if ctx.Err() != nil {
+			stream.Reset()
+			return ctx.Err()
+		}
+		response, err := r.request(stream, binaryRequest{Type: "chunk", FileID: id, Hash: chunk.Hash})
+		if err != nil {
+			return err
+		}
+		if err := r.manager.PutChunk(chunk.Hash, response.Data); err != nil {
+			stream.Reset()
+			return err
+		}
+	}
+	return nil
+}
+
+// ListRemoteFiles pide a un peer la lista de sus archivos completos de las
+// colecciones indicadas; vacío para todas. Los archivos se devuelven sin su
+// manifiesto.
+func (r *BinaryReplicator) ListRemoteFiles(ctx context.Context, pid peer.ID, collections []string) ([]binary.FileMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, binaryRequestTimeout)
+	defer cancel()
+
+	stream, err := r.node.Host.NewStream(ctx, pid, BinaryProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	response, err := r.request(stream, binaryRequest{Type: "list", Collections: collections})
+	if err != nil {
+		return nil, err
+	}
+	return response.Files, nil
+}
+
+// request envía una petición por un stream y lee su respuesta
+func (r *BinaryReplicator) request(stream network.Stream, request binaryRequest) (binaryResponse, error) {
+	stream.SetDeadline(time.Now().Add(binaryRequestTimeout))
+
+	var response binaryResponse
+	if _, err := writeFrame(stream, request, false, 0); err != nil {
+		stream.Reset()
+		return response, err
+	}
+	if _, err := readFrame(stream, &response); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al leer respuesta: %v", err)
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// handleBinaryStream responde a las peticiones de archivos que llegan por un
+// stream hasta que el otro nodo lo cierra
+func (r *BinaryReplicator) handleBinaryStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	for {
+		stream.SetDeadline(time.Now().Add(binaryRequestTimeout))
+
+		var request binaryRequest
+		if _, err := readFrame(stream, &request); err != nil {
+			if !errors.Is(err, io.EOF) {
+				stream.Reset()
+				log.Printf("Error al leer petición de archivos de %s: %v", remote, err)
+			}
+			return
+		}
+
+		response := r.answer(remote, request)
+		if _, err := writeFrame(stream, response, false, 0); err != nil {
+			stream.Reset()
+			log.Printf("Error al enviar respuesta de archivos a %s: %v", remote, err)
+			return
+		}
+	}
+}
+
+// answer responde a una petición de archivos. Solo se sirven los archivos
+// completos de las colecciones que el nodo publica y el otro puede leer.
+func (r *BinaryReplicator) answer(remote string, request binaryRequest) binaryResponse {
+	switch request.Type {
+	case "list":
+		files, err := r.manager.ListFiles("")
+		if err != nil {
+			return binaryResponse{Error: err.Error()}
+		}
+		response := binaryResponse{Files: []binary.FileMetadata{}}
+		for _, file := range files {
+			if len(request.Collections) > 0 && !slices.Contains(request.Collections, file.Collection) {
+				continue
+			}
+			if file.Manifest == nil || !r.serves(remote, file) || !r.manager.HasFile(file.ID) {
+				continue
+			}
+			listed := *file
+			listed.Manifest = nil
+			response.Files = append(response.Files, listed)
+		}
+		return response
+
+	case "manifest", "chunk":
+		metadata, err := r.manager.GetMetadata(request.FileID)
+		if err != nil || metadata.Manifest == nil {
+			return binaryResponse{Error: "archivo no encontrado"}
+		}
+		if !r.serves(remote, metadata) {
+			r.database.RejectReplication(remote, fmt.Sprintf("petición de archivos de %s sin permiso", metadata.Collection))
+			return binaryResponse{Error: "nodo no autorizado"}
+		}
+
+		if request.Type == "manifest" {
+			if !r.manager.HasFile(metadata.ID) {
+				return binaryResponse{Error: "archivo incompleto"}
+			}
+			return binaryResponse{File: metadata}
+		}
+
+		if !slices.ContainsFunc(metadata.Manifest.Chunks, func(chunk binary.ChunkRef) bool {
+			return chunk.Hash == request.Hash
+		}) {
+			return binaryResponse{Error: "el fragmento no pertenece al archivo"}
+		}
+		data, err := r.manager.ReadChunk(request.Hash)
+		if err != nil {
+			return binaryResponse{Error: err.Error()}
+		}
+		return binaryResponse{Data: data}
+
+	default:
+		return binaryResponse{Error: fmt.Sprintf("tipo de petición desconocido: %s", request.Type)}
+	}
+}
+
+// serves indica si el nodo entrega a otro los archivos de una colección
+func (r *BinaryReplicator) serves(remote string, metadata *binary.FileMetadata) bool {
+	return r.database.ReplicationPolicy().Publishes(metadata.Collection) && r.database.CanRead(remote, metadata.Collection)
+}
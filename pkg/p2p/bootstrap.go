@@ -0,0 +1,760 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// BootstrapProtocol protocolo con el que un nodo nuevo copia los datos de un
+// peer: una instantánea coherente en un punto del registro de cambios y,
+// después, los cambios posteriores a ese punto. En un mismo stream se pueden
+// hacer varias peticiones.
+const BootstrapProtocol = protocol.ID("/dbp2p/bootstrap/1.0.0")
+
+// bootstrapStatusTimeout tiempo máximo de la consulta del estado de un peer
+const bootstrapStatusTimeout = 5 * time.Second
+
+var (
+	// ErrBootstrapRunning indica que el nodo ya se está incorporando
+	ErrBootstrapRunning = errors.New("el nodo ya se está incorporando")
+	// errNoBootstrapPeer indica que ningún peer puede servir una instantánea
+	errNoBootstrapPeer = errors.New("ningún peer puede servir una instantánea")
+	// errChangesExpired indica que el peer ya no tiene los cambios posteriores a
+	// la instantánea y hay que copiar otra
+	errChangesExpired = errors.New("el peer ya no tiene los cambios posteriores a la instantánea")
+)
+
+// BootstrapConfig configuración de la incorporación de un nodo nuevo
+type BootstrapConfig struct {
+	// Copiar también las definiciones de los índices
+	Indexes bool
+
+	// Obtener también los archivos binarios de las colecciones replicadas
+	Binaries bool
+
+	// Tiempo máximo de espera a un peer que sirva la instantánea; si no aparece
+	// ninguno, el nodo se considera el primero del clúster
+	PeerTimeout time.Duration
+
+	// Número máximo de intentos, cada uno con una instantánea nueva
+	MaxAttempts int
+
+	// Documentos por trama de la instantánea y por lote de cambios
+	BatchSize int
+
+	// Tiempo máximo para recibir cada trama
+	ResponseTimeout time.Duration
+
+	// Nivel de compresión de la instantánea (1-9)
+	CompressionLevel int
+}
+
+// DefaultBootstrapConfig es la configuración por defecto de la incorporación
+var DefaultBootstrapConfig = BootstrapConfig{
+	Indexes:          true,
+	PeerTimeout:      15 * time.Second,
+	MaxAttempts:      3,
+	BatchSize:        500,
+	ResponseTimeout:  30 * time.Second,
+	CompressionLevel: 6,
+}
+
+// BootstrapPhase fase de la incorporación de un nodo
+type BootstrapPhase string
+
+const (
+	BootstrapIdle      BootstrapPhase = "idle"      // No se ha pedido
+	BootstrapSelecting BootstrapPhase = "selecting" // Eligiendo el peer
+	BootstrapSnapshot  BootstrapPhase = "snapshot"  // Copiando la instantánea
+	BootstrapCatchUp   BootstrapPhase = "catchup"   // Aplicando los cambios posteriores
+	BootstrapFiles     BootstrapPhase = "files"     // Obteniendo los archivos binarios
+	BootstrapDone      BootstrapPhase = "done"      // Terminada
+	BootstrapFailed    BootstrapPhase = "failed"    // Fallida tras todos los intentos
+)
+
+// BootstrapProgress estado de la incorporación del nodo
+type BootstrapProgress struct {
+	Phase              BootstrapPhase `json:"phase"`
+	Peer               string         `json:"peer,omitempty"`
+	Attempt            int            `json:"attempt"`
+	Seq                uint64         `json:"seq"` // Punto del registro de cambios del peer alcanzado
+	DocumentsTotal     int            `json:"documents_total"`
+	DocumentsReceived  int            `json:"documents_received"`
+	TombstonesReceived int            `json:"tombstones_received"`
+	ChangesApplied     int            `json:"changes_applied"`
+	FilesFetched       int            `json:"files_fetched"`
+	StartedAt          time.Time      `json:"started_at,omitempty"`
+	FinishedAt         time.Time      `json:"finished_at,omitempty"`
+	Error              string         `json:"error,omitempty"`
+	ReadOnly           bool           `json:"read_only"` // La base de datos sigue sin admitir escrituras locales
+}
+
+// Running indica si la incorporación está en curso
+func (p BootstrapProgress) Running() bool {
+	switch p.Phase {
+	case BootstrapSelecting, BootstrapSnapshot, BootstrapCatchUp, BootstrapFiles:
+		return true
+	default:
+		return false
+	}
+}
+
+// bootstrapRequest petición del protocolo de incorporación
+type bootstrapRequest struct {
+	Type             string         `json:"type"`                  // "status", "snapshot" o "changes"
+	Collections      []string       `json:"collections,omitempty"` // Colecciones que recibe el nodo; vacío para todas
+	Filters          map[string]any `json:"filters,omitempty"`
+	Indexes          bool           `json:"indexes,omitempty"`
+	BatchSize        int            `json:"batch_size,omitempty"`
+	CompressionLevel int            `json:"compression_level,omitempty"`
+	Epoch            string         `json:"epoch,omitempty"` // Punto a partir del que se piden los cambios
+	Seq              uint64         `json:"seq,omitempty"`
+}
+
+// bootstrapStatus estado de un nodo como origen de una instantánea
+type bootstrapStatus struct {
+	NodeID   string `json:"node_id"`
+	ReadOnly bool   `json:"read_only"` // Se está incorporando, así que no sirve instantáneas
+	Epoch    string `json:"epoch"`
+	Seq      uint64 `json:"seq"`
+}
+
+// snapshotHeader primera trama de una instantánea, con el punto del registro en
+// el que se tomó y las definiciones de las colecciones
+type snapshotHeader struct {
+	Epoch      string                 `json:"epoch"`
+	Seq        uint64                 `json:"seq"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Documents  int                    `json:"documents"`
+	Tombstones int                    `json:"tombstones"`
+	Indexes    []db.IndexDefinition   `json:"indexes,omitempty"`
+	Schemas    map[string]*db.Schema  `json:"schemas,omitempty"`
+	CRDTSpecs  map[string]db.CRDTSpec `json:"crdt_specs,omitempty"`
+}
+
+// bootstrapFrame trama de respuesta del protocolo de incorporación. Una
+// instantánea es una cabecera, varias tramas de documentos y lápidas y una
+// trama final; el resto de peticiones se responden con una sola trama.
+type bootstrapFrame struct {
+	Status     *bootstrapStatus `json:"status,omitempty"`
+	Header     *snapshotHeader  `json:"header,omitempty"`
+	Documents  []db.Document    `json:"documents,omitempty"`
+	Tombstones []db.Tombstone   `json:"tombstones,omitempty"`
+	To         uint64           `json:"to,omitempty"` // Último cambio incluido en un lote de cambios
+	HasMore    bool             `json:"has_more,omitempty"`
+	Done       bool             `json:"done,omitempty"`
+	Expired    bool             `json:"expired,omitempty"` // Los cambios pedidos ya no están en el registro
+	Error      string           `json:"error,omitempty"`
+}
+
+// Bootstrapper incorpora un nodo nuevo al clúster copiando los datos de un
+// peer. Mientras dura, la base de datos no admite escrituras locales, aunque
+// sigue aplicando las que llegan de otros nodos. Si falla, sigue sin
+// admitirlas hasta que un administrador la reintenta con éxito o las habilita
+// con Override. También sirve las instantáneas a los nodos que se incorporan.
+type Bootstrapper struct {
+	node     *Node
+	database *db.Database
+	config   BootstrapConfig
+	progress BootstrapProgress
+	mutex    sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewBootstrapper crea el servicio de incorporación del nodo
+func NewBootstrapper(n *Node, database *db.Database, config ...BootstrapConfig) *Bootstrapper {
+	cfg := DefaultBootstrapConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	return &Bootstrapper{
+		node:     n,
+		database: database,
+		config:   cfg,
+		progress: BootstrapProgress{Phase: BootstrapIdle},
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start empieza a servir instantáneas a otros nodos
+func (b *Bootstrapper) Start() {
+	b.node.Host.SetStreamHandler(BootstrapProtocol, b.handleBootstrapStream)
+}
+
+// Stop deja de servir instantáneas y cancela la incorporación en curso
+func (b *Bootstrapper) Stop() {
+	b.node.Host.RemoveStreamHandler(BootstrapProtocol)
+	b.cancel()
+}
+
+// Progress devuelve el estado de la incorporación
+func (b *Bootstrapper) Progress() BootstrapProgress {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.progress
+}
+
+// update modifica el estado de la incorporación
+func (b *Bootstrapper) update(apply func(progress *BootstrapProgress)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	apply(&b.progress)
+}
+
+// begin marca el inicio de una incorporación; false si ya hay una en curso
+func (b *Bootstrapper) begin() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.progress.Running() {
+		return false
+	}
+	b.progress = BootstrapProgress{Phase: BootstrapSelecting, StartedAt: time.Now(), ReadOnly: true}
+	b.database.SetReadOnly(true)
+	return true
+}
+
+// Override habilita las escrituras locales tras una incorporación fallida,
+// aunque el nodo no tenga todos los datos. Los que falten llegarán con la
+// sincronización periódica.
+func (b *Bootstrapper) Override() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.progress.Running() {
+		return ErrBootstrapRunning
+	}
+	if b.progress.ReadOnly {
+		log.Printf("Escrituras habilitadas sin completar la incorporación del nodo")
+	}
+	b.progress.ReadOnly = false
+	b.database.SetReadOnly(false)
+	return nil
+}
+
+// StartJoin inicia en segundo plano la incorporación del nodo a partir del
+// peer indicado, o del más cercano de los conectados si pid está vacío. La
+// base de datos pasa a ser de solo lectura antes de volver.
+func (b *Bootstrapper) StartJoin(pid peer.ID) error {
+	if !b.begin() {
+		return ErrBootstrapRunning
+	}
+	go b.run(b.ctx, pid)
+	return nil
+}
+
+// Join incorpora el nodo a partir del peer indicado, o del más cercano de los
+// conectados si pid está vacío, y espera a que termine
+func (b *Bootstrapper) Join(ctx context.Context, pid peer.ID) error {
+	if !b.begin() {
+		return ErrBootstrapRunning
+	}
+	return b.run(ctx, pid)
+}
+
+// run copia la instantánea y los cambios posteriores, reintentando con una
+// instantánea nueva hasta MaxAttempts veces. La base de datos vuelve a admitir
+// escrituras si termina bien o no hay ningún peer del que copiar; si fallan
+// todos los intentos se queda en solo lectura, porque le faltan datos.
+func (b *Bootstrapper) run(ctx context.Context, pid peer.ID) error {
+	attempts := max(b.config.MaxAttempts, 1)
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("Reintentando la incorporación (%d/%d): %v", attempt, attempts, err)
+			select {
+			case <-time.After(time.Duration(attempt-1) * time.Second):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+		b.update(func(p *BootstrapProgress) {
+			p.Phase = BootstrapSelecting
+			p.Attempt = attempt
+		})
+
+		source := pid
+		if source == "" {
+			source, err = b.selectPeer(ctx)
+			if errors.Is(err, errNoBootstrapPeer) {
+				// Sin peers de los que copiar, el nodo es el primero del clúster
+				log.Printf("Ningún peer puede servir una instantánea; el nodo empieza con la base de datos vacía")
+				b.finish(nil)
+				return nil
+			}
+			if err != nil {
+				continue
+			}
+		}
+
+		if err = b.joinFrom(ctx, source); err == nil {
+			b.finish(nil)
+			return nil
+		}
+	}
+
+	b.finish(err)
+	log.Printf("Error en la incorporación del nodo, que sigue en solo lectura: %v", err)
+	return err
+}
+
+// finish marca el final de la incorporación y, si terminó bien, vuelve a
+// admitir escrituras
+func (b *Bootstrapper) finish(err error) {
+	b.update(func(p *BootstrapProgress) {
+		p.FinishedAt = time.Now()
+		if err != nil {
+			p.Phase = BootstrapFailed
+			p.Error = err.Error()
+			return
+		}
+		p.Phase = BootstrapDone
+		p.Error = ""
+		p.ReadOnly = false
+		b.database.SetReadOnly(false)
+	})
+}
+
+// selectPeer espera hasta PeerTimeout a un peer conectado que pueda servir una
+// instantánea y, si hay varios, elige el que responde antes. Los peers que se
+// están incorporando no sirven.
+func (b *Bootstrapper) selectPeer(ctx context.Context) (peer.ID, error) {
+	deadline := time.Now().Add(b.config.PeerTimeout)
+	for {
+		var selected peer.ID
+		var best time.Duration
+		for _, pid := range b.node.Host.Network().Peers() {
+			started := time.Now()
+			status, err := b.status(ctx, pid)
+			if err != nil || status.ReadOnly {
+				continue
+			}
+			if rtt := time.Since(started); selected == "" || rtt < best {
+				selected, best = pid, rtt
+			}
+		}
+		if selected != "" {
+			return selected, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", errNoBootstrapPeer
+		}
+		select {
+		case <-time.After(min(remaining, time.Second)):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// status consulta a un peer si puede servir una instantánea
+func (b *Bootstrapper) status(ctx context.Context, pid peer.ID) (*bootstrapStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, bootstrapStatusTimeout)
+	defer cancel()
+
+	stream, err := b.node.Host.NewStream(ctx, pid, BootstrapProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(bootstrapStatusTimeout))
+	frame, err := b.request(stream, bootstrapRequest{Type: "status"})
+	if err != nil {
+		return nil, err
+	}
+	if frame.Status == nil {
+		return nil, fmt.Errorf("respuesta sin el estado del peer")
+	}
+	return frame.Status, nil
+}
+
+// joinFrom copia la instantánea de un peer, aplica los cambios posteriores y,
+// si se indica, obtiene los archivos binarios
+func (b *Bootstrapper) joinFrom(ctx context.Context, pid peer.ID) error {
+	b.update(func(p *BootstrapProgress) {
+		p.Phase = BootstrapSnapshot
+		p.Peer = pid.String()
+		p.DocumentsTotal = 0
+		p.DocumentsReceived = 0
+		p.TombstonesReceived = 0
+		p.ChangesApplied = 0
+	})
+	log.Printf("Incorporando el nodo a partir de %s", pid.String())
+
+	stream, err := b.node.Host.NewStream(ctx, pid, BootstrapProtocol)
+	if err != nil {
+		return fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	header, err := b.copySnapshot(stream, pid)
+	if err != nil {
+		return err
+	}
+
+	b.update(func(p *BootstrapProgress) {
+		p.Phase = BootstrapCatchUp
+	})
+	if err := b.catchUp(ctx, stream, pid, header); err != nil {
+		return err
+	}
+
+	// La siguiente sincronización con el peer parte del momento de la instantánea
+	if b.node.SyncManager != nil {
+		b.node.SyncManager.mutex.Lock()
+		b.node.SyncManager.lastSyncByPeer[pid] = header.Timestamp
+		b.node.SyncManager.mutex.Unlock()
+	}
+
+	if b.config.Binaries && b.node.Binaries != nil {
+		b.update(func(p *BootstrapProgress) {
+			p.Phase = BootstrapFiles
+		})
+		policy := b.database.ReplicationPolicy()
+		fetched, err := b.node.Binaries.fetchFiles(ctx, pid, nil, policy.Subscribes)
+		if err != nil {
+			// Los archivos que falten se obtendrán al leerlos
+			log.Printf("Error al obtener los archivos de %s: %v", pid.String(), err)
+		}
+		b.update(func(p *BootstrapProgress) {
+			p.FilesFetched = fetched
+		})
+	}
+
+	log.Printf("Nodo incorporado a partir de %s en el punto %d", pid.String(), b.Progress().Seq)
+	return nil
+}
+
+// copySnapshot pide la instantánea de un peer y aplica sus definiciones,
+// documentos y lápidas. Devuelve su cabecera.
+func (b *Bootstrapper) copySnapshot(stream network.Stream, pid peer.ID) (*snapshotHeader, error) {
+	policy := b.database.ReplicationPolicy()
+	request := bootstrapRequest{
+		Type:             "snapshot",
+		Collections:      policy.Subscribe,
+		Filters:          policy.Filters,
+		Indexes:          b.config.Indexes,
+		BatchSize:        b.config.BatchSize,
+		CompressionLevel: b.config.CompressionLevel,
+	}
+	frame, err := b.request(stream, request)
+	if err != nil {
+		return nil, err
+	}
+	header := frame.Header
+	if header == nil {
+		stream.Reset()
+		return nil, fmt.Errorf("instantánea sin cabecera")
+	}
+
+	// Las definiciones van antes que los documentos, que se validan e indexan
+	// con ellas al aplicarse
+	definitions := &db.Snapshot{
+		Indexes:   header.Indexes,
+		Schemas:   make(map[string]*db.Schema),
+		CRDTSpecs: make(map[string]db.CRDTSpec),
+	}
+	for collection, schema := range header.Schemas {
+		if policy.Subscribes(collection) {
+			definitions.Schemas[collection] = schema
+		}
+	}
+	for collection, spec := range header.CRDTSpecs {
+		if policy.Subscribes(collection) {
+			definitions.CRDTSpecs[collection] = spec
+		}
+	}
+	if err := b.database.ImportDefinitions(definitions); err != nil {
+		stream.Reset()
+		return nil, err
+	}
+	b.update(func(p *BootstrapProgress) {
+		p.Seq = header.Seq
+		p.DocumentsTotal = header.Documents
+	})
+
+	for {
+		var frame bootstrapFrame
+		stream.SetDeadline(time.Now().Add(b.config.ResponseTimeout))
+		if _, err := readFrame(stream, &frame); err != nil {
+			stream.Reset()
+			return nil, fmt.Errorf("error al leer la instantánea: %v", err)
+		}
+		if frame.Error != "" {
+			return nil, errors.New(frame.Error)
+		}
+
+		b.apply(pid, frame.Documents, frame.Tombstones)
+		b.update(func(p *BootstrapProgress) {
+			p.DocumentsReceived += len(frame.Documents)
+			p.TombstonesReceived += len(frame.Tombstones)
+		})
+		if frame.Done {
+			return header, nil
+		}
+	}
+}
+
+// catchUp pide los cambios posteriores a la instantánea hasta alcanzar el
+// punto actual del peer
+func (b *Bootstrapper) catchUp(ctx context.Context, stream network.Stream, pid peer.ID, header *snapshotHeader) error {
+	policy := b.database.ReplicationPolicy()
+	seq := header.Seq
+	for {
+		if ctx.Err() != nil {
+			stream.Reset()
+			return ctx.Err()
+		}
+
+		frame, err := b.request(stream, bootstrapRequest{
+			Type:        "changes",
+			Collections: policy.Subscribe,
+			Filters:     policy.Filters,
+			Epoch:       header.Epoch,
+			Seq:         seq,
+			BatchSize:   b.config.BatchSize,
+		})
+		if err != nil {
+			return err
+		}
+		if frame.Expired {
+			return errChangesExpired
+		}
+
+		b.apply(pid, frame.Documents, frame.Tombstones)
+		seq = frame.To
+		b.update(func(p *BootstrapProgress) {
+			p.Seq = seq
+			p.ChangesApplied += len(frame.Documents) + len(frame.Tombstones)
+		})
+		if !frame.HasMore {
+			return nil
+		}
+	}
+}
+
+// apply aplica los documentos y lápidas recibidos como un lote de
+// sincronización, con las mismas comprobaciones de política y ACL
+func (b *Bootstrapper) apply(pid peer.ID, documents []db.Document, tombstones []db.Tombstone) {
+	if len(documents) == 0 && len(tombstones) == 0 {
+		return
+	}
+	b.node.SyncManager.applySyncResponse(pid, SyncResponse{
+		Documents:  documents,
+		Tombstones: tombstones,
+	})
+}
+
+// request envía una petición por un stream y lee la primera trama de la respuesta
+func (b *Bootstrapper) request(stream network.Stream, request bootstrapRequest) (bootstrapFrame, error) {
+	stream.SetDeadline(time.Now().Add(b.config.ResponseTimeout))
+
+	var frame bootstrapFrame
+	if _, err := writeFrame(stream, request, false, 0); err != nil {
+		stream.Reset()
+		return frame, err
+	}
+	if _, err := readFrame(stream, &frame); err != nil {
+		stream.Reset()
+		return frame, fmt.Errorf("error al leer respuesta: %v", err)
+	}
+	if frame.Error != "" {
+		return frame, errors.New(frame.Error)
+	}
+	return frame, nil
+}
+
+// handleBootstrapStream responde a las peticiones de incorporación que llegan
+// por un stream hasta que el otro nodo lo cierra
+func (b *Bootstrapper) handleBootstrapStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	for {
+		stream.SetDeadline(time.Now().Add(b.config.ResponseTimeout))
+
+		var request bootstrapRequest
+		if _, err := readFrame(stream, &request); err != nil {
+			if !errors.Is(err, io.EOF) {
+				stream.Reset()
+				log.Printf("Error al leer petición de incorporación de %s: %v", remote, err)
+			}
+			return
+		}
+
+		var err error
+		switch request.Type {
+		case "status":
+			epoch, seq := b.database.ChangeSeq()
+			_, err = writeFrame(stream, bootstrapFrame{Status: &bootstrapStatus{
+				NodeID:   b.node.Host.ID().String(),
+				ReadOnly: b.database.IsReadOnly(),
+				Epoch:    epoch,
+				Seq:      seq,
+			}}, false, 0)
+		case "snapshot":
+			err = b.sendSnapshot(stream, remote, request)
+		case "changes":
+			err = b.sendChanges(stream, remote, request)
+		default:
+			_, err = writeFrame(stream, bootstrapFrame{Error: fmt.Sprintf("tipo de petición desconocido: %s", request.Type)}, false, 0)
+		}
+		if err != nil {
+			stream.Reset()
+			log.Printf("Error al responder petición de incorporación de %s: %v", remote, err)
+			return
+		}
+	}
+}
+
+// bootstrapFilter devuelve las funciones que eligen las colecciones y los
+// documentos que se envían a un nodo: los que este nodo publica y el otro
+// recibe y puede leer, como en la sincronización
+func (b *Bootstrapper) bootstrapFilter(remote string, request bootstrapRequest) (func(string) bool, func(*db.Document) bool, error) {
+	policy := b.database.ReplicationPolicy()
+	remotePolicy := db.ReplicationPolicy{Subscribe: request.Collections, Filters: request.Filters}
+	if err := remotePolicy.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	include := func(collection string) bool {
+		return policy.Publishes(collection) && remotePolicy.Subscribes(collection) &&
+			b.database.CanRead(remote, collection)
+	}
+	matches := func(doc *db.Document) bool {
+		return policy.Matches(doc) && remotePolicy.Matches(doc)
+	}
+	return include, matches, nil
+}
+
+// sendSnapshot envía una instantánea comprimida: la cabecera, los documentos y
+// las lápidas en tramas de BatchSize y una trama final
+func (b *Bootstrapper) sendSnapshot(stream network.Stream, remote string, request bootstrapRequest) error {
+	// Un nodo que se está incorporando no tiene todavía todos los datos
+	if b.database.IsReadOnly() {
+		_, err := writeFrame(stream, bootstrapFrame{Error: "el nodo se está incorporando"}, false, 0)
+		return err
+	}
+
+	include, matches, err := b.bootstrapFilter(remote, request)
+	if err != nil {
+		_, err = writeFrame(stream, bootstrapFrame{Error: err.Error()}, false, 0)
+		return err
+	}
+
+	snapshot := b.database.Snapshot(include)
+	documents := make([]db.Document, 0, len(snapshot.Documents))
+	for _, doc := range snapshot.Documents {
+		if matches(doc) {
+			documents = append(documents, *doc)
+		}
+	}
+
+	header := &snapshotHeader{
+		Epoch:      snapshot.Epoch,
+		Seq:        snapshot.Seq,
+		Timestamp:  time.Now(),
+		Documents:  len(documents),
+		Tombstones: len(snapshot.Tombstones),
+		Schemas:    snapshot.Schemas,
+		CRDTSpecs:  snapshot.CRDTSpecs,
+	}
+	if request.Indexes {
+		header.Indexes = snapshot.Indexes
+	}
+
+	batchSize := request.BatchSize
+	if batchSize <= 0 || batchSize > b.config.BatchSize {
+		batchSize = b.config.BatchSize
+	}
+	level := request.CompressionLevel
+	if level == 0 {
+		level = b.config.CompressionLevel
+	}
+	send := func(frame bootstrapFrame) error {
+		stream.SetDeadline(time.Now().Add(b.config.ResponseTimeout))
+		_, err := writeFrame(stream, frame, true, level)
+		return err
+	}
+
+	if err := send(bootstrapFrame{Header: header}); err != nil {
+		return err
+	}
+	for start := 0; start < len(documents); start += batchSize {
+		end := min(start+batchSize, len(documents))
+		if err := send(bootstrapFrame{Documents: documents[start:end]}); err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(snapshot.Tombstones); start += batchSize {
+		end := min(start+batchSize, len(snapshot.Tombstones))
+		tombstones := make([]db.Tombstone, 0, end-start)
+		for _, tombstone := range snapshot.Tombstones[start:end] {
+			tombstones = append(tombstones, *tombstone)
+		}
+		if err := send(bootstrapFrame{Tombstones: tombstones}); err != nil {
+			return err
+		}
+	}
+	return send(bootstrapFrame{Done: true})
+}
+
+// sendChanges envía la versión actual de los documentos y lápidas que
+// cambiaron después del punto pedido
+func (b *Bootstrapper) sendChanges(stream network.Stream, remote string, request bootstrapRequest) error {
+	include, matches, err := b.bootstrapFilter(remote, request)
+	if err != nil {
+		_, err = writeFrame(stream, bootstrapFrame{Error: err.Error()}, false, 0)
+		return err
+	}
+
+	batchSize := request.BatchSize
+	if batchSize <= 0 || batchSize > b.config.BatchSize {
+		batchSize = b.config.BatchSize
+	}
+
+	changes, err := b.database.ChangesSince(request.Epoch, request.Seq, batchSize, include)
+	if errors.Is(err, db.ErrChangesUnavailable) {
+		_, err = writeFrame(stream, bootstrapFrame{Expired: true}, false, 0)
+		return err
+	}
+	if err != nil {
+		_, err = writeFrame(stream, bootstrapFrame{Error: err.Error()}, false, 0)
+		return err
+	}
+
+	frame := bootstrapFrame{To: changes.To, HasMore: changes.HasMore}
+	for _, doc := range changes.Documents {
+		if matches(doc) {
+			frame.Documents = append(frame.Documents, *doc)
+		}
+	}
+	for _, tombstone := range changes.Tombstones {
+		frame.Tombstones = append(frame.Tombstones, *tombstone)
+	}
+	_, err = writeFrame(stream, frame, true, b.config.CompressionLevel)
+	return err
+}
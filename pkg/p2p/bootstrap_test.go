@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// unreachableHost es un host con el que no se puede abrir ningún stream
+type unreachableHost struct {
+	host.Host
+}
+
+func (unreachableHost) NewStream(context.Context, peer.ID, ...protocol.ID) (network.Stream, error) {
+	return nil, errors.New("peer inalcanzable")
+}
+
+func (unreachableHost) Network() network.Network {
+	return noPeersNetwork{}
+}
+
+// noPeersNetwork es una red sin peers conectados
+type noPeersNetwork struct {
+	network.Network
+}
+
+func (noPeersNetwork) Peers() []peer.ID {
+	return nil
+}
+
+// newTestBootstrapper crea un servicio de incorporación cuyos peers no responden
+func newTestBootstrapper(database *db.Database) *Bootstrapper {
+	config := DefaultBootstrapConfig
+	config.MaxAttempts = 1
+	config.PeerTimeout = 0
+	node := &Node{Host: unreachableHost{}, ctx: context.Background()}
+	return NewBootstrapper(node, database, config)
+}
+
+// TestBootstrapFailureKeepsReadOnly comprueba que una incorporación fallida deje
+// la base de datos en solo lectura hasta que un administrador la habilita
+func TestBootstrapFailureKeepsReadOnly(t *testing.T) {
+	database := db.NewDatabase()
+	bootstrapper := newTestBootstrapper(database)
+
+	if err := bootstrapper.Join(context.Background(), peer.ID("origen")); err == nil {
+		t.Fatalf("se esperaba un error al incorporarse desde un peer inalcanzable")
+	}
+	progress := bootstrapper.Progress()
+	if progress.Phase != BootstrapFailed || progress.Error == "" {
+		t.Errorf("progreso = %+v, se esperaba la fase %s con el error", progress, BootstrapFailed)
+	}
+	if !progress.ReadOnly || !database.IsReadOnly() {
+		t.Fatalf("la incorporación fallida habilitó las escrituras")
+	}
+	if _, err := database.CreateDocument("notas", map[string]interface{}{"texto": "hola"}); !errors.Is(err, db.ErrReadOnly) {
+		t.Errorf("escritura tras la incorporación fallida: %v, se esperaba %v", err, db.ErrReadOnly)
+	}
+
+	// Un reintento que vuelve a fallar tampoco las habilita
+	if err := bootstrapper.Join(context.Background(), peer.ID("origen")); err == nil {
+		t.Fatalf("se esperaba un error en el reintento")
+	}
+	if !database.IsReadOnly() {
+		t.Fatalf("el reintento fallido habilitó las escrituras")
+	}
+
+	if err := bootstrapper.Override(); err != nil {
+		t.Fatalf("error al habilitar las escrituras: %v", err)
+	}
+	if database.IsReadOnly() || bootstrapper.Progress().ReadOnly {
+		t.Errorf("las escrituras siguen deshabilitadas tras Override")
+	}
+	if _, err := database.CreateDocument("notas", map[string]interface{}{"texto": "hola"}); err != nil {
+		t.Errorf("error al escribir tras Override: %v", err)
+	}
+}
+
+// TestBootstrapWithoutPeersAllowsWrites comprueba que un nodo sin peers de los
+// que copiar se considere el primero del clúster y admita escrituras
+func TestBootstrapWithoutPeersAllowsWrites(t *testing.T) {
+	database := db.NewDatabase()
+	bootstrapper := newTestBootstrapper(database)
+
+	if err := bootstrapper.Join(context.Background(), ""); err != nil {
+		t.Fatalf("error en la incorporación sin peers: %v", err)
+	}
+	if progress := bootstrapper.Progress(); progress.Phase != BootstrapDone || progress.ReadOnly {
+		t.Errorf("progreso = %+v, se esperaba la fase %s sin solo lectura", progress, BootstrapDone)
+	}
+	if database.IsReadOnly() {
+		t.Errorf("la base de datos sigue en solo lectura")
+	}
+}
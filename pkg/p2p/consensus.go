@@ -0,0 +1,384 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+	"github.com/aratan/dbp2p/pkg/raft"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ConsensusProtocol protocolo por el que se comunican los miembros del grupo de
+// consenso de las colecciones de consistencia fuerte. Cada stream lleva un
+// mensaje de Raft y su respuesta.
+const ConsensusProtocol = protocol.ID("/dbp2p/raft/1.0.0")
+
+// ConsensusConfig configuración del grupo de consenso
+type ConsensusConfig struct {
+	// Colecciones cuyas escrituras pasan por el consenso
+	Collections []string
+
+	// IDs de los nodos que forman el grupo al crearlo. Los demás se añaden
+	// después desde la API de administración.
+	Members []string
+
+	// Esperar en las lecturas a que el nodo tenga aplicadas todas las escrituras
+	// confirmadas, confirmando con el líder que lo sigue siendo
+	LeaderReads bool
+
+	// Tiempo sin noticias del líder antes de convocar elecciones
+	ElectionTimeout time.Duration
+
+	// Intervalo de los latidos del líder
+	HeartbeatInterval time.Duration
+
+	// Entradas aplicadas tras las que se compacta el log
+	SnapshotThreshold uint64
+
+	// Tiempo máximo de espera a que se confirme una escritura o un cambio de miembros
+	ProposeTimeout time.Duration
+}
+
+// DefaultConsensusConfig es la configuración por defecto del consenso
+var DefaultConsensusConfig = ConsensusConfig{
+	ElectionTimeout:   raft.DefaultConfig.ElectionTimeout,
+	HeartbeatInterval: raft.DefaultConfig.HeartbeatInterval,
+	SnapshotThreshold: raft.DefaultConfig.SnapshotThreshold,
+	ProposeTimeout:    10 * time.Second,
+}
+
+// ConsensusStatus estado del grupo de consenso visto desde el nodo
+type ConsensusStatus struct {
+	raft.Status
+	Member      bool     `json:"member"`
+	Collections []string `json:"collections"`
+	LeaderReads bool     `json:"leader_reads"`
+}
+
+// Consensus mantiene las colecciones de consistencia fuerte con un grupo Raft
+// cuyos miembros son nodos del clúster. Las escrituras de esas colecciones se
+// confirman por mayoría de los votantes antes de aplicarse, en el mismo orden
+// en todos los miembros. Los nodos que no son miembros reenvían sus escrituras
+// al líder y reciben el resultado por la replicación habitual.
+type Consensus struct {
+	node      *Node
+	database  *db.Database
+	config    ConsensusConfig
+	raft      *raft.Node
+	storage   *raft.FileStorage
+	transport *streamTransport
+}
+
+// NewConsensus crea el servidor de consenso del nodo, con su log en dir. Si el
+// nodo está entre los miembros iniciales y no tiene estado, inicializa el grupo.
+func NewConsensus(n *Node, database *db.Database, dir string, config ...ConsensusConfig) (*Consensus, error) {
+	cfg := DefaultConsensusConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	storage, err := raft.NewFileStorage(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir el log de consenso: %v", err)
+	}
+
+	c := &Consensus{
+		node:      n,
+		database:  database,
+		config:    cfg,
+		storage:   storage,
+		transport: &streamTransport{host: n.Host, timeout: cfg.ProposeTimeout},
+	}
+
+	id := n.Host.ID().String()
+	c.raft, err = raft.NewNode(id, &consensusFSM{consensus: c}, storage, c.transport, raft.Config{
+		ElectionTimeout:   cfg.ElectionTimeout,
+		HeartbeatInterval: cfg.HeartbeatInterval,
+		SnapshotThreshold: cfg.SnapshotThreshold,
+		AuthorizeForward:  c.authorizeForward,
+	})
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("error al crear el servidor de consenso: %v", err)
+	}
+
+	if slices.Contains(cfg.Members, id) {
+		servers := make([]raft.Server, len(cfg.Members))
+		for i, member := range cfg.Members {
+			servers[i] = raft.Server{ID: member, Suffrage: raft.Voter}
+		}
+		if err := c.raft.Bootstrap(servers); err != nil && !errors.Is(err, raft.ErrAlreadyBootstrapped) {
+			storage.Close()
+			return nil, fmt.Errorf("error al inicializar el grupo de consenso: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+// Start empieza a atender a los demás miembros del grupo
+func (c *Consensus) Start() {
+	c.raft.Start()
+	log.Printf("Consenso iniciado para las colecciones %v", c.config.Collections)
+}
+
+// Stop detiene el servidor de consenso y cierra su log
+func (c *Consensus) Stop() {
+	c.raft.Stop()
+	c.node.Host.RemoveStreamHandler(ConsensusProtocol)
+	if err := c.storage.Close(); err != nil {
+		log.Printf("Error al cerrar el log de consenso: %v", err)
+	}
+}
+
+// Strong indica si las escrituras de una colección pasan por el consenso
+func (c *Consensus) Strong(collection string) bool {
+	return slices.Contains(c.config.Collections, collection)
+}
+
+// Member indica si el nodo pertenece al grupo de consenso
+func (c *Consensus) Member() bool {
+	return c.raft.IsMember()
+}
+
+// Propose propone una escritura al grupo y espera a que se aplique. Si el grupo
+// no la confirma a tiempo, falla con db.ErrConsensusUnavailable.
+func (c *Consensus) Propose(command *db.Command) (*db.Document, error) {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("error al serializar comando: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(c.node.ctx, c.config.ProposeTimeout)
+	defer cancel()
+
+	result, err := c.raft.Apply(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", db.ErrConsensusUnavailable, err)
+	}
+	return db.DecodeCommandResult(result)
+}
+
+// Barrier espera, si están activadas las lecturas del líder, a que el nodo tenga
+// aplicadas todas las escrituras confirmadas
+func (c *Consensus) Barrier(collection string) error {
+	if !c.config.LeaderReads || !c.Strong(collection) {
+		return nil
+	}
+	return c.CatchUp()
+}
+
+// CatchUp espera a que el nodo tenga aplicadas todas las escrituras confirmadas,
+// confirmando con el líder que lo sigue siendo. Un nodo que no es miembro lee su
+// copia replicada, sin esperar.
+func (c *Consensus) CatchUp() error {
+	ctx, cancel := context.WithTimeout(c.node.ctx, c.config.ProposeTimeout)
+	defer cancel()
+
+	err := c.raft.Barrier(ctx)
+	if errors.Is(err, raft.ErrNotMember) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", db.ErrConsensusUnavailable, err)
+	}
+	return nil
+}
+
+// Status devuelve el estado del grupo visto desde el nodo
+func (c *Consensus) Status() ConsensusStatus {
+	return ConsensusStatus{
+		Status:      c.raft.Status(),
+		Member:      c.raft.IsMember(),
+		Collections: c.config.Collections,
+		LeaderReads: c.config.LeaderReads,
+	}
+}
+
+// AddMember añade un nodo al grupo, con voto o sin él. Un nodo sin voto recibe
+// el log sin contar para la mayoría, lo que permite ponerlo al día antes de
+// darle voto.
+func (c *Consensus) AddMember(id string, voter bool) error {
+	if _, err := peer.Decode(id); err != nil {
+		return fmt.Errorf("ID de nodo no válido: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(c.node.ctx, c.config.ProposeTimeout)
+	defer cancel()
+
+	if voter {
+		return c.raft.AddVoter(ctx, id)
+	}
+	return c.raft.AddLearner(ctx, id)
+}
+
+// RemoveMember quita un nodo del grupo
+func (c *Consensus) RemoveMember(id string) error {
+	ctx, cancel := context.WithTimeout(c.node.ctx, c.config.ProposeTimeout)
+	defer cancel()
+
+	return c.raft.RemoveServer(ctx, id)
+}
+
+// authorizeForward comprueba que un nodo pueda realizar la escritura que reenvía
+// al líder, con la ACL de replicación de la colección
+func (c *Consensus) authorizeForward(from string, data []byte) error {
+	var command db.Command
+	if err := json.Unmarshal(data, &command); err != nil {
+		return fmt.Errorf("error al deserializar comando: %v", err)
+	}
+	if !c.Strong(command.Collection) {
+		return fmt.Errorf("la colección %s no pasa por el consenso", command.Collection)
+	}
+	if !c.database.AllowsReplication(from, command.Operation, command.Collection) {
+		c.database.RejectReplication(from, fmt.Sprintf("escritura reenviada sin permiso en %s", command.Collection))
+		return fmt.Errorf("sin permiso para escribir en %s", command.Collection)
+	}
+	return nil
+}
+
+// consensusFSM aplica el log del grupo a las colecciones de consistencia fuerte
+type consensusFSM struct {
+	consensus *Consensus
+}
+
+// Apply aplica una escritura confirmada. El líder la publica además para los
+// nodos que no son miembros.
+func (f *consensusFSM) Apply(index uint64, data []byte) []byte {
+	var command db.Command
+	if err := json.Unmarshal(data, &command); err != nil {
+		return db.EncodeCommandResult(nil, fmt.Errorf("error al deserializar comando: %v", err))
+	}
+
+	c := f.consensus
+	doc, err := c.database.ApplyCommand(index, &command, c.raft != nil && c.raft.IsLeader())
+	return db.EncodeCommandResult(doc, err)
+}
+
+// Snapshot devuelve los documentos y lápidas de las colecciones fuertes
+func (f *consensusFSM) Snapshot() ([]byte, error) {
+	snapshot := f.consensus.database.Snapshot(f.consensus.Strong)
+	return json.Marshal(&db.Snapshot{Documents: snapshot.Documents, Tombstones: snapshot.Tombstones})
+}
+
+// Restore reemplaza las colecciones fuertes por las de una instantánea
+func (f *consensusFSM) Restore(data []byte) error {
+	var snapshot db.Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("error al deserializar instantánea: %v", err)
+	}
+	return f.consensus.database.RestoreCollections(&snapshot, f.consensus.Strong)
+}
+
+// streamTransport implementa raft.Transport sobre streams de libp2p
+type streamTransport struct {
+	host    host.Host
+	timeout time.Duration
+	handler raft.Handler
+	mutex   sync.RWMutex
+}
+
+// Call envía un mensaje a otro miembro en un stream nuevo y espera la respuesta
+func (t *streamTransport) Call(ctx context.Context, target string, msg *raft.Message) (*raft.Message, error) {
+	pid, err := peer.Decode(target)
+	if err != nil {
+		return nil, fmt.Errorf("ID de nodo no válido: %v", err)
+	}
+
+	stream, err := t.host.NewStream(ctx, pid, ConsensusProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	} else {
+		stream.SetDeadline(time.Now().Add(t.timeout))
+	}
+
+	if err := json.NewEncoder(stream).Encode(msg); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("error al enviar mensaje: %v", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("error al enviar mensaje: %v", err)
+	}
+
+	var response raft.Message
+	if err := json.NewDecoder(stream).Decode(&response); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("error al leer respuesta: %v", err)
+	}
+	return &response, nil
+}
+
+// SetHandler establece la función que atiende los mensajes y empieza a recibirlos
+func (t *streamTransport) SetHandler(handler raft.Handler) {
+	t.mutex.Lock()
+	t.handler = handler
+	t.mutex.Unlock()
+
+	t.host.SetStreamHandler(ConsensusProtocol, t.handleStream)
+}
+
+// Peers devuelve los nodos conectados
+func (t *streamTransport) Peers() []string {
+	peers := t.host.Network().Peers()
+	ids := make([]string, len(peers))
+	for i, pid := range peers {
+		ids[i] = pid.String()
+	}
+	return ids
+}
+
+// handleStream atiende un mensaje de otro miembro del grupo
+func (t *streamTransport) handleStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(t.timeout))
+
+	t.mutex.RLock()
+	handler := t.handler
+	t.mutex.RUnlock()
+	if handler == nil {
+		stream.Reset()
+		return
+	}
+
+	var msg raft.Message
+	if err := json.NewDecoder(stream).Decode(&msg); err != nil {
+		stream.Reset()
+		log.Printf("Error al leer mensaje de consenso: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	response := handler(ctx, stream.Conn().RemotePeer().String(), &msg)
+	if response == nil {
+		response = &raft.Message{Type: msg.Type, Error: "mensaje no atendido"}
+	}
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		stream.Reset()
+		log.Printf("Error al enviar respuesta de consenso: %v", err)
+	}
+}
+
+// consensusDir devuelve el directorio del log de consenso
+func consensusDir(dataDir string) string {
+	return filepath.Join(dataDir, "consensus")
+}
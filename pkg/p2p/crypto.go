@@ -5,14 +5,46 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
 )
 
-// CryptoService representa el servicio de cifrado
+// dataKeysFileName archivo del directorio de datos con las claves de datos del clúster
+const dataKeysFileName = "datakeys.json"
+
+// DataKeysPath devuelve la ruta del archivo con las claves de datos del clúster
+func DataKeysPath(dataDir string) string {
+	return filepath.Join(dataDir, dataKeysFileName)
+}
+
+// DataKey representa una clave de datos del clúster
+type DataKey struct {
+	ID      string    `json:"id"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// CryptoService representa el servicio de cifrado. Gestiona las claves de datos
+// del clúster: cifra con la más reciente y descifra con cualquiera de ellas
+// hasta que pasa el periodo de retención desde que se sustituyó.
 type CryptoService struct {
-	encryptionKey []byte
+	encryptionKey []byte             // Clave actual
+	keyID         string             // ID de la clave actual
+	keys          map[string]DataKey // Claves con las que se puede descifrar
+	retention     time.Duration      // Tiempo que sigue valiendo una clave tras ser sustituida
+	path          string             // Archivo en el que se guardan las claves; vacío para no guardarlas
 	mutex         sync.RWMutex
 }
 
@@ -33,24 +65,273 @@ func NewCryptoService(key []byte) *CryptoService {
 		key = newKey
 	}
 
-	return &CryptoService{
-		encryptionKey: key,
+	s := &CryptoService{keys: make(map[string]DataKey)}
+	s.addKeyLocked(DataKey{ID: newKeyID(), Key: key, Created: time.Now()})
+	return s
+}
+
+// LoadCryptoService carga las claves de datos del clúster de un archivo. Si no
+// existe, el servicio empieza sin claves: se obtienen de otros nodos o se genera
+// una al cifrar el primer mensaje. Las claves sustituidas se conservan durante
+// retention para descifrar los mensajes cifrados con ellas.
+func LoadCryptoService(path string, retention time.Duration) (*CryptoService, error) {
+	s := &CryptoService{
+		keys:      make(map[string]DataKey),
+		retention: retention,
+		path:      path,
 	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al leer las claves de datos: %v", err)
+	}
+
+	var keys []DataKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("error al deserializar las claves de datos: %v", err)
+	}
+	for _, key := range keys {
+		if len(key.Key) == 32 && key.ID != "" {
+			s.keys[key.ID] = key
+		}
+	}
+	s.refreshLocked()
+	return s, nil
 }
 
-// Encrypt cifra un mensaje usando AES-GCM
-func (s *CryptoService) Encrypt(plaintext string) (string, error) {
+// newKeyID genera un identificador aleatorio de clave
+func newKeyID() string {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic(fmt.Errorf("error al generar ID de clave: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// addKeyLocked añade una clave y recalcula la actual.
+// Debe llamarse con el mutex bloqueado.
+func (s *CryptoService) addKeyLocked(key DataKey) {
+	s.keys[key.ID] = key
+	s.refreshLocked()
+}
+
+// refreshLocked elige como clave actual la más reciente y descarta las que han
+// superado el periodo de retención desde que se creó la siguiente. Todos los
+// nodos llegan a la misma clave actual al intercambiar sus claves.
+// Debe llamarse con el mutex bloqueado.
+func (s *CryptoService) refreshLocked() {
+	keys := s.sortedKeysLocked()
+	if len(keys) == 0 {
+		s.encryptionKey, s.keyID = nil, ""
+		return
+	}
+
+	if s.retention > 0 {
+		for i := 0; i < len(keys)-1; i++ {
+			if time.Since(keys[i+1].Created) > s.retention {
+				delete(s.keys, keys[i].ID)
+			}
+		}
+	}
+
+	current := keys[len(keys)-1]
+	s.encryptionKey, s.keyID = current.Key, current.ID
+}
+
+// sortedKeysLocked devuelve las claves de la más antigua a la más reciente.
+// Debe llamarse con el mutex bloqueado.
+func (s *CryptoService) sortedKeysLocked() []DataKey {
+	keys := slices.Collect(maps.Values(s.keys))
+	slices.SortFunc(keys, func(a, b DataKey) int {
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return keys
+}
+
+// saveLocked guarda las claves en el archivo del servicio, legible solo por su
+// propietario. Debe llamarse con el mutex bloqueado.
+func (s *CryptoService) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.sortedKeysLocked(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar las claves de datos: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de datos: %v", err)
+	}
+	tmpPath := s.path + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("error al guardar las claves de datos: %v", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error al guardar las claves de datos: %v", err)
+	}
+	return nil
+}
+
+// KeyID devuelve el ID de la clave actual, vacío si aún no hay ninguna
+func (s *CryptoService) KeyID() string {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	block, err := aes.NewCipher(s.encryptionKey)
+	return s.keyID
+}
+
+// HasKey indica si se conoce una clave de datos
+func (s *CryptoService) HasKey(keyID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, exists := s.keys[keyID]
+	return exists
+}
+
+// CurrentKeyCreated devuelve cuándo se creó la clave actual
+func (s *CryptoService) CurrentKeyCreated() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.keys[s.keyID].Created
+}
+
+// RotateKey genera una nueva clave actual. Las anteriores siguen sirviendo para
+// descifrar durante el periodo de retención. Devuelve el ID de la nueva clave.
+func (s *CryptoService) RotateKey() (string, error) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.addKeyLocked(DataKey{ID: newKeyID(), Key: key, Created: time.Now()})
+	return s.keyID, s.saveLocked()
+}
+
+// Keys devuelve las claves vigentes, de la más antigua a la más reciente
+func (s *CryptoService) Keys() []DataKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refreshLocked()
+	return s.sortedKeysLocked()
+}
+
+// MergeKeys añade las claves recibidas de otro nodo que no se conocían y
+// devuelve cuántas se han añadido
+func (s *CryptoService) MergeKeys(keys []DataKey) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	added := 0
+	for _, key := range keys {
+		if _, exists := s.keys[key.ID]; exists || key.ID == "" || len(key.Key) != 32 {
+			continue
+		}
+		s.keys[key.ID] = key
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	s.refreshLocked()
+	return added, s.saveLocked()
+}
+
+// Seal cifra con AES-GCM y la clave actual, generando una si no hay ninguna, y
+// devuelve el ID de la clave. El texto cifrado solo se descifra con el mismo aad.
+func (s *CryptoService) Seal(plaintext, aad []byte) (string, []byte, error) {
+	s.mutex.Lock()
+	if s.keyID == "" {
+		key, err := GenerateRandomKey()
+		if err != nil {
+			s.mutex.Unlock()
+			return "", nil, err
+		}
+		s.addKeyLocked(DataKey{ID: newKeyID(), Key: key, Created: time.Now()})
+		if err := s.saveLocked(); err != nil {
+			s.mutex.Unlock()
+			return "", nil, err
+		}
+	}
+	keyID, key := s.keyID, s.encryptionKey
+	s.mutex.Unlock()
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, fmt.Errorf("error al generar nonce: %v", err)
+	}
+	return keyID, gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open descifra un texto cifrado con Seal y la clave indicada. Falla con
+// db.ErrUnknownKey si la clave no se conoce o ha caducado.
+func (s *CryptoService) Open(keyID string, ciphertext, aad []byte) ([]byte, error) {
+	s.mutex.RLock()
+	key, exists := s.keys[keyID]
+	s.mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", db.ErrUnknownKey, keyID)
+	}
+
+	gcm, err := newGCM(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("ciphertext demasiado corto")
+	}
+	plaintext, err := gcm.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("error al descifrar: %v", err)
+	}
+	return plaintext, nil
+}
+
+// newGCM crea un cifrador AES-GCM con una clave
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", fmt.Errorf("error al crear cifrador: %v", err)
+		return nil, fmt.Errorf("error al crear cifrador: %v", err)
 	}
 
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", fmt.Errorf("error al crear GCM: %v", err)
+		return nil, fmt.Errorf("error al crear GCM: %v", err)
+	}
+	return gcm, nil
+}
+
+// Encrypt cifra un mensaje usando AES-GCM
+func (s *CryptoService) Encrypt(plaintext string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.encryptionKey == nil {
+		return "", fmt.Errorf("no hay clave de cifrado")
+	}
+	gcm, err := newGCM(s.encryptionKey)
+	if err != nil {
+		return "", err
 	}
 
 	nonce := make([]byte, gcm.NonceSize())
@@ -67,14 +348,12 @@ func (s *CryptoService) Decrypt(ciphertext string) (string, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	block, err := aes.NewCipher(s.encryptionKey)
-	if err != nil {
-		return "", fmt.Errorf("error al crear cifrador: %v", err)
+	if s.encryptionKey == nil {
+		return "", fmt.Errorf("no hay clave de cifrado")
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(s.encryptionKey)
 	if err != nil {
-		return "", fmt.Errorf("error al crear GCM: %v", err)
+		return "", err
 	}
 
 	data, err := base64.URLEncoding.DecodeString(ciphertext)
@@ -114,7 +393,7 @@ func (s *CryptoService) DecryptMessage(message []byte) ([]byte, error) {
 	return []byte(decrypted), nil
 }
 
-// SetEncryptionKey establece una nueva clave de cifrado
+// SetEncryptionKey establece una nueva clave de cifrado, que pasa a ser la actual
 func (s *CryptoService) SetEncryptionKey(key []byte) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -123,8 +402,8 @@ func (s *CryptoService) SetEncryptionKey(key []byte) error {
 		return fmt.Errorf("la clave debe tener 32 bytes (256 bits)")
 	}
 
-	s.encryptionKey = key
-	return nil
+	s.addKeyLocked(DataKey{ID: newKeyID(), Key: key, Created: time.Now()})
+	return s.saveLocked()
 }
 
 // GenerateRandomKey genera una clave aleatoria de 256 bits
@@ -11,6 +11,7 @@ import (
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/multiformats/go-multihash"
 )
@@ -32,6 +33,7 @@ type DHTService struct {
 	mode              DHTMode
 	bootstrapPeers    []peer.AddrInfo
 	bootstrapInterval time.Duration
+	protocolPrefix    protocol.ID // Prefijo de los protocolos del DHT; vacío usa el de IPFS
 	ctx               context.Context
 	cancel            context.CancelFunc
 	mutex             sync.RWMutex
@@ -71,6 +73,14 @@ func WithBootstrapPeers(peers []string) DHTOption {
 	}
 }
 
+// WithProtocolPrefix establece el prefijo de los protocolos del DHT, de modo que
+// solo intercambian rutas los nodos con el mismo prefijo
+func WithProtocolPrefix(prefix string) DHTOption {
+	return func(s *DHTService) {
+		s.protocolPrefix = protocol.ID(prefix)
+	}
+}
+
 // WithBootstrapInterval establece el intervalo de bootstrap para el DHT
 func WithBootstrapInterval(interval int) DHTOption {
 	return func(s *DHTService) {
@@ -120,7 +130,11 @@ func (s *DHTService) Start() error {
 	}
 
 	// Crear DHT
-	kadDHT, err := dht.New(s.ctx, s.host, dht.Mode(mode))
+	opts := []dht.Option{dht.Mode(mode)}
+	if s.protocolPrefix != "" {
+		opts = append(opts, dht.ProtocolPrefix(s.protocolPrefix))
+	}
+	kadDHT, err := dht.New(s.ctx, s.host, opts...)
 	if err != nil {
 		return fmt.Errorf("error al crear DHT: %v", err)
 	}
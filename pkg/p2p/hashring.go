@@ -0,0 +1,86 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// HashRing es un anillo de hash consistente. Cada miembro ocupa varios puntos
+// del anillo (nodos virtuales) y una clave pertenece a los primeros miembros
+// distintos que se encuentran desde su hash en el sentido de las agujas del
+// reloj. Al entrar o salir un miembro solo cambian de dueño las claves de los
+// tramos vecinos a sus puntos. Un anillo no se modifica una vez creado.
+type HashRing struct {
+	members []string
+	points  []ringPoint
+}
+
+// ringPoint es un punto del anillo
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// NewHashRing crea un anillo con los miembros indicados y vnodes puntos por miembro
+func NewHashRing(members []string, vnodes int) *HashRing {
+	vnodes = max(vnodes, 1)
+	ring := &HashRing{
+		members: slices.Compact(slices.Sorted(slices.Values(members))),
+	}
+
+	ring.points = make([]ringPoint, 0, len(ring.members)*vnodes)
+	for _, member := range ring.members {
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{hash: ringHash(member + "#" + strconv.Itoa(i)), member: member})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash != ring.points[j].hash {
+			return ring.points[i].hash < ring.points[j].hash
+		}
+		return ring.points[i].member < ring.points[j].member
+	})
+	return ring
+}
+
+// ringHash devuelve la posición de una clave en el anillo
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Members devuelve los miembros del anillo, ordenados
+func (r *HashRing) Members() []string {
+	return slices.Clone(r.members)
+}
+
+// Owners devuelve los n miembros a los que pertenece una clave, empezando por el
+// primero; menos si el anillo tiene menos miembros
+func (r *HashRing) Owners(key string, n int) []string {
+	n = min(n, len(r.members))
+	if n <= 0 {
+		return nil
+	}
+
+	hash := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	owners := make([]string, 0, n)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		member := r.points[(start+i)%len(r.points)].member
+		if !slices.Contains(owners, member) {
+			owners = append(owners, member)
+		}
+	}
+	return owners
+}
+
+// Equal indica si dos anillos tienen los mismos miembros
+func (r *HashRing) Equal(other *HashRing) bool {
+	return other != nil && slices.Equal(r.members, other.members)
+}
@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// ringKeys devuelve las claves con las que se prueba el reparto
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("doc-%d", i)
+	}
+	return keys
+}
+
+func TestHashRingOwners(t *testing.T) {
+	ring := NewHashRing([]string{"c", "a", "b", "a"}, 16)
+	if members := ring.Members(); !slices.Equal(members, []string{"a", "b", "c"}) {
+		t.Fatalf("miembros = %v, se esperaban [a b c]", members)
+	}
+
+	// El orden en que se indican los miembros no cambia el reparto
+	same := NewHashRing([]string{"b", "c", "a"}, 16)
+	counts := make(map[string]int)
+	for _, key := range ringKeys(3000) {
+		owners := ring.Owners(key, 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			t.Fatalf("propietarios de %s = %v, se esperaban dos distintos", key, owners)
+		}
+		if other := same.Owners(key, 2); !slices.Equal(owners, other) {
+			t.Fatalf("propietarios de %s = %v y %v según el orden de los miembros", key, owners, other)
+		}
+		if !slices.Equal(ring.Owners(key, 1), owners[:1]) {
+			t.Fatalf("el primer propietario de %s depende del número pedido", key)
+		}
+		counts[owners[0]]++
+	}
+
+	// Con nodos virtuales cada miembro recibe una parte parecida de las claves
+	for member, count := range counts {
+		if count < 500 || count > 1500 {
+			t.Errorf("%s es el primer propietario de %d claves de 3000", member, count)
+		}
+	}
+
+	if owners := ring.Owners("doc", 5); len(owners) != 3 {
+		t.Errorf("propietarios = %v, se esperaban los 3 miembros", owners)
+	}
+	if owners := NewHashRing(nil, 16).Owners("doc", 3); owners != nil {
+		t.Errorf("propietarios en un anillo vacío = %v", owners)
+	}
+}
+
+func TestHashRingMovesFewKeys(t *testing.T) {
+	members := []string{"a", "b", "c", "d", "e"}
+	before := NewHashRing(members, 64)
+	after := NewHashRing(append(members, "f"), 64)
+	keys := ringKeys(6000)
+
+	// Al entrar un miembro, las claves que cambian de dueño pasan al nuevo y los
+	// demás propietarios de cada clave ya lo eran
+	moved := 0
+	for _, key := range keys {
+		old, owners := before.Owners(key, 3), after.Owners(key, 3)
+		if old[0] != owners[0] {
+			moved++
+			if owners[0] != "f" {
+				t.Fatalf("%s pasó de %s a %s al entrar f", key, old[0], owners[0])
+			}
+		}
+		for _, owner := range owners {
+			if owner != "f" && !slices.Contains(old, owner) {
+				t.Fatalf("%s pasó a %s al entrar f: %v -> %v", key, owner, old, owners)
+			}
+		}
+	}
+	if moved == 0 || moved > len(keys)/3 {
+		t.Errorf("al entrar un miembro de 6 cambiaron de dueño %d claves de %d", moved, len(keys))
+	}
+
+	// Al salir un miembro solo cambian de dueño sus claves
+	left := NewHashRing([]string{"a", "b", "d", "e"}, 64)
+	for _, key := range keys {
+		old, owners := before.Owners(key, 1)[0], left.Owners(key, 1)[0]
+		if old != "c" && old != owners {
+			t.Fatalf("%s pasó de %s a %s al salir c", key, old, owners)
+		}
+	}
+}
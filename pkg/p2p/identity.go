@@ -0,0 +1,149 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// identityFileName archivo del directorio de datos con la clave privada del nodo
+const identityFileName = "node.key"
+
+// identityPath devuelve la ruta del archivo de identidad del nodo
+func identityPath(dataDir string) string {
+	return filepath.Join(dataDir, identityFileName)
+}
+
+// LoadIdentity carga la clave privada del nodo del directorio de datos. La
+// primera vez la genera y la guarda, de modo que el ID del nodo se mantiene
+// entre reinicios.
+func LoadIdentity(dataDir string) (crypto.PrivKey, error) {
+	path := identityPath(dataDir)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error al generar la clave del nodo: %v", err)
+		}
+		if err := saveIdentity(dataDir, key); err != nil {
+			return nil, err
+		}
+		log.Printf("Generada nueva identidad del nodo en %s", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al leer la clave del nodo: %v", err)
+	}
+
+	// Corregir los permisos si otros usuarios pueden leer la clave
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("La clave del nodo %s tiene permisos %v; se restringen a 0600", path, info.Mode().Perm())
+		if err := os.Chmod(path, 0600); err != nil {
+			log.Printf("Error al restringir los permisos de la clave del nodo: %v", err)
+		}
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("clave del nodo no válida en %s: %v", path, err)
+	}
+	return key, nil
+}
+
+// IdentityID devuelve el ID del nodo, generando su clave si no existe
+func IdentityID(dataDir string) (peer.ID, error) {
+	key, err := LoadIdentity(dataDir)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPrivateKey(key)
+}
+
+// ImportIdentity sustituye la clave del nodo por la de un archivo, en formato
+// binario de libp2p o codificada en base64 como en la configuración de IPFS.
+// La clave anterior se conserva como copia. Devuelve el nuevo ID del nodo.
+func ImportIdentity(dataDir, keyFile string) (peer.ID, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("error al leer la clave: %v", err)
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		decoded, decodeErr := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if decodeErr != nil {
+			return "", fmt.Errorf("clave no válida: %v", err)
+		}
+		if key, err = crypto.UnmarshalPrivateKey(decoded); err != nil {
+			return "", fmt.Errorf("clave no válida: %v", err)
+		}
+	}
+
+	return replaceIdentity(dataDir, key)
+}
+
+// RotateIdentity genera una nueva clave para el nodo y conserva la anterior como
+// copia. Devuelve el nuevo ID del nodo.
+func RotateIdentity(dataDir string) (peer.ID, error) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("error al generar la clave del nodo: %v", err)
+	}
+	return replaceIdentity(dataDir, key)
+}
+
+// replaceIdentity guarda una nueva clave del nodo tras copiar la actual
+func replaceIdentity(dataDir string, key crypto.PrivKey) (peer.ID, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("error al obtener el ID de la clave: %v", err)
+	}
+
+	path := identityPath(dataDir)
+	if _, err := os.Stat(path); err == nil {
+		backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102-150405"))
+		if err := os.Rename(path, backup); err != nil {
+			return "", fmt.Errorf("error al copiar la clave anterior: %v", err)
+		}
+		log.Printf("Clave anterior del nodo guardada en %s", backup)
+	}
+
+	if err := saveIdentity(dataDir, key); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// saveIdentity escribe la clave del nodo, legible solo por su propietario
+func saveIdentity(dataDir string, key crypto.PrivKey) error {
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error al serializar la clave del nodo: %v", err)
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de datos: %v", err)
+	}
+
+	// Escribir en un archivo temporal y renombrarlo para no dejar la clave a medias
+	path := identityPath(dataDir)
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("error al guardar la clave del nodo: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error al guardar la clave del nodo: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// KeyProtocol protocolo con el que los nodos se piden las claves de datos del
+// clúster. El stream va autenticado y cifrado por libp2p, y solo se responde a
+// los nodos que lista la ACL de replicación.
+const KeyProtocol = protocol.ID("/dbp2p/keys/1.0.0")
+
+const (
+	// keyRequestTimeout tiempo máximo de cada petición de claves
+	keyRequestTimeout = 10 * time.Second
+	// missingKeyRetryInterval tiempo mínimo entre peticiones de una misma clave
+	missingKeyRetryInterval = 10 * time.Second
+	// keyRotationCheckInterval intervalo entre comprobaciones de la antigüedad de la clave actual
+	keyRotationCheckInterval = time.Minute
+)
+
+// keyResponse respuesta a una petición de claves
+type keyResponse struct {
+	Keys  []DataKey `json:"keys,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// KeyExchange reparte las claves de datos del clúster entre los nodos: las pide
+// a los peers conocidos al conectarse y cuando llega un mensaje cifrado con una
+// clave que no tiene, y rota la clave actual cuando supera su antigüedad máxima
+type KeyExchange struct {
+	host     host.Host
+	crypto   *CryptoService
+	database *db.Database
+	rotation time.Duration // Antigüedad tras la que se rota la clave; 0 para no rotarla
+	requests map[string]time.Time
+	notifiee *network.NotifyBundle
+	mutex    sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewKeyExchange crea el servicio de intercambio de claves de datos
+func NewKeyExchange(ctx context.Context, h host.Host, crypto *CryptoService, database *db.Database, rotation time.Duration) *KeyExchange {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &KeyExchange{
+		host:     h,
+		crypto:   crypto,
+		database: database,
+		rotation: rotation,
+		requests: make(map[string]time.Time),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start empieza a servir las claves y a pedirlas a los peers que se conectan
+func (k *KeyExchange) Start() {
+	k.host.SetStreamHandler(KeyProtocol, k.handleKeyStream)
+
+	k.notifiee = &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			go k.fetchFrom(conn.RemotePeer())
+		},
+	}
+	k.host.Network().Notify(k.notifiee)
+
+	for _, pid := range k.host.Network().Peers() {
+		go k.fetchFrom(pid)
+	}
+
+	if k.rotation > 0 {
+		go k.rotateLoop()
+	}
+}
+
+// Stop deja de servir y pedir claves
+func (k *KeyExchange) Stop() {
+	k.host.RemoveStreamHandler(KeyProtocol)
+	if k.notifiee != nil {
+		k.host.Network().StopNotify(k.notifiee)
+	}
+	k.cancel()
+}
+
+// handleKeyStream envía las claves vigentes a un nodo que lista la ACL
+func (k *KeyExchange) handleKeyStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(keyRequestTimeout))
+
+	remote := stream.Conn().RemotePeer().String()
+	var response keyResponse
+	if k.database.ListsPeer(remote) {
+		response.Keys = k.crypto.Keys()
+	} else {
+		k.database.RejectReplication(remote, "petición de claves de un nodo no autorizado")
+		response.Error = "nodo no autorizado"
+	}
+
+	if _, err := writeFrame(stream, response, false, 0); err != nil {
+		stream.Reset()
+		log.Printf("Error al enviar claves de datos a %s: %v", remote, err)
+	}
+}
+
+// FetchKeys pide sus claves a un peer y añade las que no se conocían. Solo se
+// aceptan claves de los nodos que lista la ACL.
+func (k *KeyExchange) FetchKeys(ctx context.Context, pid peer.ID) (int, error) {
+	if !k.database.ListsPeer(pid.String()) {
+		return 0, fmt.Errorf("nodo no autorizado: %s", pid.String())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keyRequestTimeout)
+	defer cancel()
+
+	stream, err := k.host.NewStream(ctx, pid, KeyProtocol)
+	if err != nil {
+		return 0, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(keyRequestTimeout))
+	stream.CloseWrite()
+
+	var response keyResponse
+	if _, err := readFrame(stream, &response); err != nil {
+		stream.Reset()
+		return 0, fmt.Errorf("error al leer claves de datos: %v", err)
+	}
+	if response.Error != "" {
+		return 0, fmt.Errorf("el nodo rechazó la petición: %s", response.Error)
+	}
+
+	return k.crypto.MergeKeys(response.Keys)
+}
+
+// fetchFrom pide las claves a un peer recién conectado, si la ACL lo lista
+func (k *KeyExchange) fetchFrom(pid peer.ID) {
+	if pid == k.host.ID() || !k.database.ListsPeer(pid.String()) {
+		return
+	}
+	added, err := k.FetchKeys(k.ctx, pid)
+	if err != nil {
+		// Los nodos sin cifrado habilitado no sirven claves
+		return
+	}
+	if added > 0 {
+		log.Printf("Obtenidas %d claves de datos de %s", added, pid.String())
+	}
+}
+
+// MissingKey pide una clave de datos desconocida a los nodos indicados, que son
+// el que firmó el mensaje y el que lo reenvió. Se usa como manejador de
+// db.WithMissingKeyHandler, y no repite la petición de una misma clave hasta
+// pasado un tiempo.
+func (k *KeyExchange) MissingKey(keyID string, peers ...string) {
+	k.mutex.Lock()
+	if last, exists := k.requests[keyID]; exists && time.Since(last) < missingKeyRetryInterval {
+		k.mutex.Unlock()
+		return
+	}
+	k.requests[keyID] = time.Now()
+	for id, last := range k.requests {
+		if time.Since(last) > missingKeyRetryInterval {
+			delete(k.requests, id)
+		}
+	}
+	k.mutex.Unlock()
+
+	go func() {
+		for _, id := range peers {
+			pid, err := peer.Decode(id)
+			if err != nil || pid == k.host.ID() {
+				continue
+			}
+			if _, err := k.FetchKeys(k.ctx, pid); err != nil {
+				log.Printf("No se pudo obtener la clave de datos %s de %s: %v", keyID, id, err)
+				continue
+			}
+			if k.crypto.HasKey(keyID) {
+				log.Printf("Obtenida la clave de datos %s de %s", keyID, id)
+				return
+			}
+		}
+	}()
+}
+
+// rotateLoop rota la clave actual cuando supera la antigüedad máxima. Se añade
+// un retraso aleatorio para que no roten a la vez todos los nodos del clúster;
+// el primero que rota reparte la nueva clave a los demás al usarla.
+func (k *KeyExchange) rotateLoop() {
+	ticker := time.NewTicker(keyRotationCheckInterval)
+	defer ticker.Stop()
+
+	jitter := time.Duration(rand.Int63n(int64(k.rotation)/10 + 1))
+	for {
+		select {
+		case <-ticker.C:
+			created := k.crypto.CurrentKeyCreated()
+			if created.IsZero() || time.Since(created) < k.rotation+jitter {
+				continue
+			}
+			keyID, err := k.crypto.RotateKey()
+			if err != nil {
+				log.Printf("Error al rotar la clave de datos: %v", err)
+				continue
+			}
+			log.Printf("Clave de datos rotada, nueva clave %s", keyID)
+		case <-k.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// testStream es un stream en memoria: lee de in y guarda lo escrito en out
+type testStream struct {
+	network.Stream
+	remote peer.ID
+	in     io.Reader
+	out    bytes.Buffer
+}
+
+func (s *testStream) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *testStream) Write(p []byte) (int, error) { return s.out.Write(p) }
+func (s *testStream) Close() error                { return nil }
+func (s *testStream) CloseWrite() error           { return nil }
+func (s *testStream) Reset() error                { return nil }
+func (s *testStream) SetDeadline(time.Time) error { return nil }
+func (s *testStream) Conn() network.Conn          { return testConn{remote: s.remote} }
+
+// testConn es una conexión con un peer remoto
+type testConn struct {
+	network.Conn
+	remote peer.ID
+}
+
+func (c testConn) RemotePeer() peer.ID { return c.remote }
+
+// keyNode es un nodo de prueba con su servicio de claves
+type keyNode struct {
+	id       peer.ID
+	database *db.Database
+	crypto   *CryptoService
+	keys     *KeyExchange
+}
+
+// keyNetwork conecta los nodos de prueba: abrir un stream hacia un nodo ejecuta
+// su manejador de claves y devuelve la respuesta
+type keyNetwork struct {
+	host.Host
+	self  peer.ID
+	nodes map[peer.ID]*keyNode
+}
+
+func (n keyNetwork) ID() peer.ID { return n.self }
+
+func (n keyNetwork) NewStream(_ context.Context, pid peer.ID, _ ...protocol.ID) (network.Stream, error) {
+	remote, exists := n.nodes[pid]
+	if !exists {
+		return nil, errors.New("peer inalcanzable")
+	}
+	served := &testStream{remote: n.self, in: bytes.NewReader(nil)}
+	remote.keys.handleKeyStream(served)
+	return &testStream{remote: pid, in: &served.out}, nil
+}
+
+// newTestPeerID genera el ID de un nodo de prueba
+func newTestPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatalf("error al generar clave: %v", err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error al obtener ID: %v", err)
+	}
+	return id
+}
+
+// newKeyNode crea un nodo de la red de prueba con su propio almacén de claves
+func newKeyNode(t *testing.T, nodes map[peer.ID]*keyNode) *keyNode {
+	t.Helper()
+	id := newTestPeerID(t)
+	service, err := LoadCryptoService(filepath.Join(t.TempDir(), dataKeysFileName), time.Hour)
+	if err != nil {
+		t.Fatalf("error al cargar las claves: %v", err)
+	}
+
+	node := &keyNode{id: id, database: db.NewDatabase(), crypto: service}
+	node.keys = NewKeyExchange(context.Background(), keyNetwork{self: id, nodes: nodes}, service, node.database, 0)
+	nodes[id] = node
+	return node
+}
+
+// allow lista en la ACL del nodo a los peers indicados
+func (n *keyNode) allow(t *testing.T, peers ...*keyNode) {
+	t.Helper()
+	acl := db.ReplicationACL{Enabled: true, Peers: map[string]db.ACLRule{}}
+	for _, p := range peers {
+		acl.Peers[p.id.String()] = db.ACLRule{Role: db.ACLRoleWriter}
+	}
+	if err := n.database.SetReplicationACL(acl); err != nil {
+		t.Fatalf("error al establecer la ACL: %v", err)
+	}
+}
+
+func TestKeyExchangeOnlyServesListedPeers(t *testing.T) {
+	nodes := make(map[peer.ID]*keyNode)
+	owner := newKeyNode(t, nodes)
+	member := newKeyNode(t, nodes)
+	outsider := newKeyNode(t, nodes)
+	owner.allow(t, member)
+	member.allow(t, owner)
+	outsider.allow(t, owner)
+
+	keyID, ciphertext, err := owner.crypto.Seal([]byte("secreto"), []byte(owner.id))
+	if err != nil {
+		t.Fatalf("error al cifrar: %v", err)
+	}
+
+	// Sin la clave de datos, ningún otro nodo puede leer el mensaje
+	for _, node := range []*keyNode{member, outsider} {
+		if _, err := node.crypto.Open(keyID, ciphertext, []byte(owner.id)); !errors.Is(err, db.ErrUnknownKey) {
+			t.Errorf("error al abrir sin la clave = %v, se esperaba %v", err, db.ErrUnknownKey)
+		}
+	}
+
+	// El nodo que lista la ACL obtiene la clave y puede leerlo
+	added, err := member.keys.FetchKeys(context.Background(), owner.id)
+	if err != nil || added != 1 {
+		t.Fatalf("FetchKeys = %d, %v; se esperaba 1 clave", added, err)
+	}
+	plaintext, err := member.crypto.Open(keyID, ciphertext, []byte(owner.id))
+	if err != nil || string(plaintext) != "secreto" {
+		t.Errorf("mensaje abierto = %q, %v", plaintext, err)
+	}
+
+	// El que no lista no recibe claves y se cuenta como rechazado
+	if _, err := outsider.keys.FetchKeys(context.Background(), owner.id); err == nil {
+		t.Errorf("un nodo fuera de la ACL obtuvo las claves")
+	}
+	if owner.database.RejectedCount() != 1 {
+		t.Errorf("rechazados = %d, se esperaba 1", owner.database.RejectedCount())
+	}
+	if outsider.crypto.HasKey(keyID) {
+		t.Errorf("un nodo fuera de la ACL tiene la clave de datos")
+	}
+
+	// Tampoco se piden claves a un nodo que la ACL propia no lista
+	if _, err := owner.keys.FetchKeys(context.Background(), outsider.id); err == nil {
+		t.Errorf("se aceptaron claves de un nodo fuera de la ACL")
+	}
+}
+
+func TestRetiredKeyRetention(t *testing.T) {
+	// Mensajes cifrados con una clave antigua
+	retired := NewCryptoService(nil)
+	retiredID, ciphertext, err := retired.Seal([]byte("antiguo"), nil)
+	if err != nil {
+		t.Fatalf("error al cifrar: %v", err)
+	}
+	retiredKey := retired.Keys()[0]
+
+	cases := []struct {
+		name     string
+		replaced time.Duration // Antigüedad de la clave que sustituyó a la retirada
+		readable bool
+	}{
+		{"dentro del periodo de retención", 30 * time.Minute, true},
+		{"fuera del periodo de retención", 2 * time.Hour, false},
+	}
+	for _, c := range cases {
+		service, err := LoadCryptoService(filepath.Join(t.TempDir(), dataKeysFileName), time.Hour)
+		if err != nil {
+			t.Fatalf("error al cargar las claves: %v", err)
+		}
+		old := retiredKey
+		old.Created = time.Now().Add(-3 * time.Hour)
+		successor, err := GenerateRandomKey()
+		if err != nil {
+			t.Fatalf("error al generar clave: %v", err)
+		}
+		if _, err := service.MergeKeys([]DataKey{old, {ID: "actual", Key: successor, Created: time.Now().Add(-c.replaced)}}); err != nil {
+			t.Fatalf("error al añadir las claves: %v", err)
+		}
+		if service.KeyID() != "actual" {
+			t.Errorf("%s: clave actual = %s, se esperaba la más reciente", c.name, service.KeyID())
+		}
+
+		plaintext, err := service.Open(retiredID, ciphertext, nil)
+		if c.readable && (err != nil || string(plaintext) != "antiguo") {
+			t.Errorf("%s: mensaje abierto = %q, %v", c.name, plaintext, err)
+		}
+		if !c.readable && !errors.Is(err, db.ErrUnknownKey) {
+			t.Errorf("%s: error = %v, se esperaba %v", c.name, err, db.ErrUnknownKey)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/aratan/dbp2p/pkg/binary"
 	"github.com/aratan/dbp2p/pkg/config"
 	"github.com/aratan/dbp2p/pkg/db"
 
@@ -26,6 +27,14 @@ type Node struct {
 	cancel      context.CancelFunc
 	Database    *db.Database
 	Sync        *db.DBSync
+	SyncManager *SyncManager
+	PeerBook    *PeerBook         // Peers conocidos de ejecuciones anteriores
+	Keys        *KeyExchange      // Reparto de las claves de datos, si el cifrado está habilitado
+	Binaries    *BinaryReplicator // Replicación de los archivos binarios, si está habilitada
+	Bootstrap   *Bootstrapper     // Incorporación del nodo a partir de la instantánea de un peer
+	Consensus   *Consensus        // Consenso de las colecciones de consistencia fuerte, si está habilitado
+	Sharding    *Sharding         // Reparto de las colecciones fragmentadas, si está habilitado
+	Queries     *DistributedQuery // Consultas sobre los documentos de todo el clúster, si están habilitadas
 }
 
 // NewNode crea un nuevo nodo P2P con mDNS y DHT
@@ -36,13 +45,37 @@ func NewNode(ctx context.Context) (*Node, error) {
 	// Cargar configuración
 	cfg := config.GetConfig()
 
+	if err := ValidateClusterID(cfg.Network.ClusterID); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Usar la misma identidad en cada ejecución
+	key, err := LoadIdentity(cfg.General.DataDir)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error al cargar la identidad del nodo: %v", err)
+	}
+
 	// Crear opciones de libp2p
 	opts := []libp2p.Option{
+		libp2p.Identity(key),
 		libp2p.Security(noise.ID, noise.New),
 		libp2p.NATPortMap(),
 		libp2p.EnableRelay(),
 	}
 
+	// En una red privada solo se aceptan conexiones de los nodos con la misma clave
+	if cfg.Network.PrivateNetwork.Enabled {
+		psk, err := LoadPSK(PSKPath(cfg))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		opts = append(opts, libp2p.PrivateNetwork(psk))
+		log.Printf("Red privada habilitada con la clave %s", PSKPath(cfg))
+	}
+
 	// Añadir direcciones de escucha
 	for _, addr := range cfg.Network.LibP2P.ListenAddresses {
 		ma, err := multiaddr.NewMultiaddr(addr)
@@ -67,12 +100,21 @@ func NewNode(ctx context.Context) (*Node, error) {
 		cancel: cancel,
 	}
 
+	// Cargar los peers conocidos para reconectar con ellos
+	peerBook, err := NewPeerBook(ctx, host, cfg.General.DataDir)
+	if err != nil {
+		node.Close()
+		return nil, fmt.Errorf("error al cargar peers conocidos: %v", err)
+	}
+	peerBook.Start()
+	node.PeerBook = peerBook
+
 	// Inicializar mDNS si está habilitado
 	if cfg.Network.MDNS.Enabled {
 		mdnsService, err := NewMDNSService(
 			ctx,
 			host,
-			WithServiceName(cfg.Network.MDNS.ServiceName),
+			WithServiceName(clusterServiceName(cfg.Network.MDNS.ServiceName, cfg.Network.ClusterID)),
 			WithInterval(cfg.Network.MDNS.Interval),
 		)
 		if err != nil {
@@ -90,13 +132,15 @@ func NewNode(ctx context.Context) (*Node, error) {
 
 	// Inicializar DHT si está habilitado
 	if cfg.Network.DHT.Enabled {
-		dhtService, err := NewDHTService(
-			ctx,
-			host,
+		dhtOptions := []DHTOption{
 			WithDHTMode(cfg.Network.DHT.Mode),
 			WithBootstrapPeers(cfg.Network.LibP2P.BootstrapPeers),
 			WithBootstrapInterval(cfg.Network.DHT.BootstrapInterval),
-		)
+		}
+		if cfg.Network.ClusterID != "" {
+			dhtOptions = append(dhtOptions, WithProtocolPrefix("/dbp2p-"+cfg.Network.ClusterID))
+		}
+		dhtService, err := NewDHTService(ctx, host, dhtOptions...)
 		if err != nil {
 			node.Close()
 			return nil, fmt.Errorf("error al crear servicio DHT: %v", err)
@@ -126,6 +170,38 @@ func NewNode(ctx context.Context) (*Node, error) {
 // Close cierra el nodo P2P y todos sus servicios
 func (n *Node) Close() error {
 	// Detener servicios en orden inverso
+	if n.Bootstrap != nil {
+		n.Bootstrap.Stop()
+	}
+
+	if n.Queries != nil {
+		n.Queries.Stop()
+	}
+
+	if n.Consensus != nil {
+		n.Consensus.Stop()
+	}
+
+	if n.SyncManager != nil {
+		n.SyncManager.Stop()
+	}
+
+	if n.Binaries != nil {
+		n.Binaries.Stop()
+	}
+
+	if n.Sync != nil {
+		n.Sync.Close()
+	}
+
+	if n.Sharding != nil {
+		n.Sharding.Stop()
+	}
+
+	if n.Keys != nil {
+		n.Keys.Stop()
+	}
+
 	if n.PubSub != nil {
 		n.PubSub.Stop()
 	}
@@ -138,6 +214,10 @@ func (n *Node) Close() error {
 		n.MDNSService.Stop()
 	}
 
+	if n.PeerBook != nil {
+		n.PeerBook.Stop()
+	}
+
 	// Cerrar host
 	if err := n.Host.Close(); err != nil {
 		return fmt.Errorf("error al cerrar host: %v", err)
@@ -168,8 +248,55 @@ func (n *Node) GetPeers() []string {
 func (n *Node) SetDatabase(database *db.Database) error {
 	n.Database = database
 
-	// Inicializar sincronización
-	sync, err := db.NewDBSync(n.ctx, database, n.PubSub.GetPubSub(), n.Host.ID().String())
+	// Establecer qué colecciones y documentos replica el nodo
+	cfg := config.GetConfig()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := database.SetReplicationPolicy(replicationPolicyFrom(cfg)); err != nil {
+		return fmt.Errorf("error al configurar la replicación: %v", err)
+	}
+	if err := database.SetReplicationACL(replicationACLFrom(cfg)); err != nil {
+		return fmt.Errorf("error al configurar la ACL de replicación: %v", err)
+	}
+
+	syncOptions := []db.DBSyncOption{db.WithClusterID(cfg.Network.ClusterID)}
+
+	// Cifrar las colecciones indicadas con la clave de datos del clúster
+	if cfg.Sync.Encryption.Enabled {
+		// Sin ACL cualquier nodo de la red podría obtener la clave de datos
+		if !cfg.Sync.ACL.Enabled {
+			return fmt.Errorf("el cifrado requiere la ACL de replicación habilitada")
+		}
+		database.SetEncryptionPolicy(db.EncryptionPolicy{
+			Enabled:     true,
+			Collections: cfg.Sync.Encryption.Collections,
+		})
+
+		retention := time.Duration(cfg.Sync.Encryption.KeyRetention) * time.Second
+		crypto, err := LoadCryptoService(DataKeysPath(cfg.General.DataDir), retention)
+		if err != nil {
+			return fmt.Errorf("error al cargar las claves de datos: %v", err)
+		}
+		rotation := time.Duration(cfg.Sync.Encryption.RotationInterval) * time.Second
+		n.Keys = NewKeyExchange(n.ctx, n.Host, crypto, database, rotation)
+		n.Keys.Start()
+
+		syncOptions = append(syncOptions, db.WithPayloadCipher(crypto), db.WithMissingKeyHandler(n.Keys.MissingKey))
+	}
+
+	// Repartir las colecciones fragmentadas entre los nodos antes de recibir
+	// documentos, para que cada nodo guarde solo los suyos
+	if cfg.Sync.Sharding.Enabled {
+		n.Sharding = NewSharding(n, database, shardingConfigFrom(cfg))
+		database.SetShardRouter(n.Sharding)
+		n.Sharding.Start()
+	}
+
+	// Inicializar sincronización en los temas del clúster, firmando los mensajes
+	// con la clave del nodo
+	key := n.Host.Peerstore().PrivKey(n.Host.ID())
+	sync, err := db.NewDBSync(n.ctx, database, n.PubSub.GetPubSub(), n.Host.ID().String(), key, syncOptions...)
 	if err != nil {
 		return fmt.Errorf("error al inicializar sincronización: %v", err)
 	}
@@ -179,20 +306,237 @@ func (n *Node) SetDatabase(database *db.Database) error {
 	// Configurar la base de datos para usar la sincronización
 	database.SetSync(sync)
 
-	// Sincronizar todos los documentos
+	// Iniciar la sincronización punto a punto con los peers
+	n.SyncManager = NewSyncManager(n, database, syncConfigFrom(cfg))
+	n.SyncManager.Start()
+
+	// Confirmar por consenso las escrituras de las colecciones de consistencia fuerte
+	if cfg.Sync.Consensus.Enabled {
+		consensus, err := NewConsensus(n, database, consensusDir(cfg.General.DataDir), consensusConfigFrom(cfg))
+		if err != nil {
+			return fmt.Errorf("error al configurar el consenso: %v", err)
+		}
+		database.SetConsensus(consensus)
+		consensus.Start()
+		n.Consensus = consensus
+	}
+
+	// Atender las consultas distribuidas de los demás nodos
+	if cfg.Sync.Query.Enabled {
+		n.Queries = NewDistributedQuery(n, database, queryConfigFrom(cfg))
+		n.Queries.Start()
+	}
+
+	// Servir instantáneas a los nodos nuevos y, si este lo es, incorporarlo a
+	// partir de la de un peer antes de admitir escrituras
+	n.Bootstrap = NewBootstrapper(n, database, bootstrapConfigFrom(cfg))
+	n.Bootstrap.Start()
+	if cfg.Sync.Bootstrap.Enabled && database.IsEmpty() {
+		return n.Bootstrap.StartJoin("")
+	}
+
+	// Traer los documentos de los peers conectados
 	go func() {
 		// Esperar un poco para que otros nodos se conecten
-		time.Sleep(5 * time.Second)
-
-		// Sincronizar todos los documentos
-		if err := database.SyncAllDocuments(); err != nil {
-			log.Printf("Error al sincronizar todos los documentos: %v", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-n.ctx.Done():
+			return
 		}
+
+		n.SyncManager.SyncNow()
 	}()
 
 	return nil
 }
 
+// SetBinaryManager establece el gestor de binarios del nodo y, si está
+// habilitado, replica sus archivos con los demás nodos. Debe llamarse después
+// de SetDatabase, cuya ACL y política de replicación también se aplican a los
+// archivos de cada colección.
+func (n *Node) SetBinaryManager(manager *binary.BinaryManager) error {
+	cfg := config.GetConfig()
+	if !cfg.Sync.Binaries.Enabled {
+		return nil
+	}
+	if n.Database == nil {
+		return fmt.Errorf("la base de datos del nodo no está establecida")
+	}
+
+	policy := BinaryPolicy{
+		Mode:        BinaryMode(cfg.Sync.Binaries.Mode),
+		Collections: make(map[string]BinaryMode, len(cfg.Sync.Binaries.Collections)),
+	}
+	for collection, mode := range cfg.Sync.Binaries.Collections {
+		policy.Collections[collection] = BinaryMode(mode)
+	}
+
+	replicator, err := NewBinaryReplicator(n, manager, policy, cfg.Network.ClusterID)
+	if err != nil {
+		return fmt.Errorf("error al configurar la replicación de archivos: %v", err)
+	}
+	if err := replicator.Start(); err != nil {
+		return fmt.Errorf("error al iniciar la replicación de archivos: %v", err)
+	}
+	n.Binaries = replicator
+
+	return nil
+}
+
+// replicationPolicyFrom obtiene la política de replicación a partir de la
+// configuración de la aplicación
+func replicationPolicyFrom(cfg *config.Config) db.ReplicationPolicy {
+	return db.ReplicationPolicy{
+		Publish:    cfg.Sync.Replication.Publish,
+		Subscribe:  cfg.Sync.Replication.Subscribe,
+		Excluded:   cfg.Sync.ExcludedCollections,
+		Priorities: cfg.Sync.CollectionPriorities,
+		Filters:    cfg.Sync.Replication.Filters,
+	}
+}
+
+// replicationACLFrom obtiene la ACL de replicación a partir de la configuración
+// de la aplicación
+func replicationACLFrom(cfg *config.Config) db.ReplicationACL {
+	acl := db.ReplicationACL{
+		Enabled:     cfg.Sync.ACL.Enabled,
+		DefaultRole: db.ACLRole(cfg.Sync.ACL.DefaultRole),
+		Peers:       make(map[string]db.ACLRule, len(cfg.Sync.ACL.Peers)),
+	}
+	for id, peerRule := range cfg.Sync.ACL.Peers {
+		rule := db.ACLRule{
+			Role:        db.ACLRole(peerRule.Role),
+			Collections: peerRule.Collections,
+		}
+		for _, operation := range peerRule.Operations {
+			rule.Operations = append(rule.Operations, db.Operation(operation))
+		}
+		acl.Peers[id] = rule
+	}
+	return acl
+}
+
+// syncConfigFrom obtiene la configuración de sincronización a partir de la de la
+// aplicación; los valores no indicados toman el valor por defecto
+func syncConfigFrom(cfg *config.Config) SyncConfig {
+	syncConfig := DefaultSyncConfig
+	syncConfig.UseCompression = cfg.Sync.UseCompression
+
+	if cfg.Sync.FullSyncInterval > 0 {
+		syncConfig.FullSyncInterval = time.Duration(cfg.Sync.FullSyncInterval) * time.Second
+	}
+	if cfg.Sync.IncrementalSyncInterval > 0 {
+		syncConfig.IncrementalSyncInterval = time.Duration(cfg.Sync.IncrementalSyncInterval) * time.Second
+	}
+	if cfg.Sync.BatchSize > 0 {
+		syncConfig.BatchSize = cfg.Sync.BatchSize
+	}
+	if cfg.Sync.ResponseTimeout > 0 {
+		syncConfig.ResponseTimeout = time.Duration(cfg.Sync.ResponseTimeout) * time.Second
+	}
+	if cfg.Sync.MaxRetries > 0 {
+		syncConfig.MaxRetries = cfg.Sync.MaxRetries
+	}
+	if cfg.Sync.CompressionLevel > 0 {
+		syncConfig.CompressionLevel = cfg.Sync.CompressionLevel
+	}
+	if cfg.Sync.CollectionPriorities != nil {
+		syncConfig.CollectionPriorities = cfg.Sync.CollectionPriorities
+	}
+	if cfg.Sync.ExcludedCollections != nil {
+		syncConfig.ExcludedCollections = cfg.Sync.ExcludedCollections
+	}
+
+	return syncConfig
+}
+
+// bootstrapConfigFrom obtiene la configuración de la incorporación a partir de
+// la de la aplicación; los valores no indicados toman el valor por defecto
+func bootstrapConfigFrom(cfg *config.Config) BootstrapConfig {
+	bootstrapConfig := DefaultBootstrapConfig
+	bootstrapConfig.Indexes = cfg.Sync.Bootstrap.Indexes
+	bootstrapConfig.Binaries = cfg.Sync.Bootstrap.Binaries
+
+	if cfg.Sync.Bootstrap.PeerTimeout > 0 {
+		bootstrapConfig.PeerTimeout = time.Duration(cfg.Sync.Bootstrap.PeerTimeout) * time.Second
+	}
+	if cfg.Sync.Bootstrap.MaxAttempts > 0 {
+		bootstrapConfig.MaxAttempts = cfg.Sync.Bootstrap.MaxAttempts
+	}
+	if cfg.Sync.Bootstrap.BatchSize > 0 {
+		bootstrapConfig.BatchSize = cfg.Sync.Bootstrap.BatchSize
+	}
+	if cfg.Sync.ResponseTimeout > 0 {
+		bootstrapConfig.ResponseTimeout = time.Duration(cfg.Sync.ResponseTimeout) * time.Second
+	}
+	if cfg.Sync.CompressionLevel > 0 {
+		bootstrapConfig.CompressionLevel = cfg.Sync.CompressionLevel
+	}
+
+	return bootstrapConfig
+}
+
+// consensusConfigFrom obtiene la configuración del consenso a partir de la de
+// la aplicación; los valores no indicados toman el valor por defecto
+func consensusConfigFrom(cfg *config.Config) ConsensusConfig {
+	consensusConfig := DefaultConsensusConfig
+	consensusConfig.Collections = cfg.Sync.Consensus.Collections
+	consensusConfig.Members = cfg.Sync.Consensus.Members
+	consensusConfig.LeaderReads = cfg.Sync.Consensus.LeaderReads
+
+	if cfg.Sync.Consensus.ElectionTimeout > 0 {
+		consensusConfig.ElectionTimeout = time.Duration(cfg.Sync.Consensus.ElectionTimeout) * time.Millisecond
+	}
+	if cfg.Sync.Consensus.HeartbeatInterval > 0 {
+		consensusConfig.HeartbeatInterval = time.Duration(cfg.Sync.Consensus.HeartbeatInterval) * time.Millisecond
+	}
+	if cfg.Sync.Consensus.SnapshotThreshold > 0 {
+		consensusConfig.SnapshotThreshold = uint64(cfg.Sync.Consensus.SnapshotThreshold)
+	}
+	if cfg.Sync.Consensus.ProposeTimeout > 0 {
+		consensusConfig.ProposeTimeout = time.Duration(cfg.Sync.Consensus.ProposeTimeout) * time.Second
+	}
+
+	return consensusConfig
+}
+
+// shardingConfigFrom obtiene la configuración de la fragmentación a partir de la
+// de la aplicación; los valores no indicados toman el valor por defecto
+func shardingConfigFrom(cfg *config.Config) ShardingConfig {
+	shardingConfig := DefaultShardingConfig
+	shardingConfig.Collections = cfg.Sync.Sharding.Collections
+
+	if cfg.Sync.Sharding.ReplicationFactor > 0 {
+		shardingConfig.ReplicationFactor = cfg.Sync.Sharding.ReplicationFactor
+	}
+	if cfg.Sync.Sharding.VirtualNodes > 0 {
+		shardingConfig.VirtualNodes = cfg.Sync.Sharding.VirtualNodes
+	}
+	if cfg.Sync.Sharding.RebalanceInterval > 0 {
+		shardingConfig.RebalanceInterval = time.Duration(cfg.Sync.Sharding.RebalanceInterval) * time.Second
+	}
+	if cfg.Sync.ResponseTimeout > 0 {
+		shardingConfig.RequestTimeout = time.Duration(cfg.Sync.ResponseTimeout) * time.Second
+	}
+	if cfg.Sync.BatchSize > 0 {
+		shardingConfig.BatchSize = cfg.Sync.BatchSize
+	}
+
+	return shardingConfig
+}
+
+// queryConfigFrom obtiene la configuración de las consultas distribuidas a partir
+// de la de la aplicación; los valores no indicados toman el valor por defecto
+func queryConfigFrom(cfg *config.Config) QueryConfig {
+	queryConfig := DefaultQueryConfig
+
+	if cfg.Sync.Query.PeerTimeout > 0 {
+		queryConfig.PeerTimeout = time.Duration(cfg.Sync.Query.PeerTimeout) * time.Millisecond
+	}
+
+	return queryConfig
+}
+
 // GetConnectedPeers devuelve la lista de peers conectados
 func (n *Node) GetConnectedPeers() []peer.ID {
 	return n.Host.Network().Peers()
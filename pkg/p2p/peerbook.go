@@ -0,0 +1,287 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// peerBookFileName archivo del directorio de datos con los peers conocidos
+	peerBookFileName = "peers.json"
+	// peerBookSaveInterval intervalo entre escrituras de los peers conocidos
+	peerBookSaveInterval = time.Minute
+	// peerBookMaxAge tiempo tras el que se olvida un peer que no se ha vuelto a ver
+	peerBookMaxAge = 30 * 24 * time.Hour
+	// peerBookReconnectLimit peers, de los vistos más recientemente, a los que se
+	// intenta reconectar al arrancar
+	peerBookReconnectLimit = 50
+	// peerBookDialTimeout tiempo máximo de cada intento de reconexión
+	peerBookDialTimeout = 10 * time.Second
+)
+
+// KnownPeer representa un peer con el que el nodo se ha conectado alguna vez
+type KnownPeer struct {
+	ID       string    `json:"id"`
+	Addrs    []string  `json:"addrs"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// PeerBook guarda en el directorio de datos las direcciones de los peers con los
+// que se conecta el nodo y cuándo se vieron por última vez, para volver a
+// conectarse a ellos al arrancar
+type PeerBook struct {
+	host     host.Host
+	path     string
+	peers    map[peer.ID]*KnownPeer
+	dirty    bool
+	notifiee *network.NotifyBundle
+	mutex    sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewPeerBook crea el registro de peers conocidos y carga el del directorio de datos
+func NewPeerBook(ctx context.Context, h host.Host, dataDir string) (*PeerBook, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	book := &PeerBook{
+		host:   h,
+		path:   filepath.Join(dataDir, peerBookFileName),
+		peers:  make(map[peer.ID]*KnownPeer),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	if err := book.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return book, nil
+}
+
+// load lee los peers conocidos, descartando los que hace tiempo que no se ven
+func (b *PeerBook) load() error {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error al leer peers conocidos: %v", err)
+	}
+
+	var peers []KnownPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return fmt.Errorf("error al deserializar peers conocidos: %v", err)
+	}
+
+	for i := range peers {
+		known := peers[i]
+		id, err := peer.Decode(known.ID)
+		if err != nil || time.Since(known.LastSeen) > peerBookMaxAge || id == b.host.ID() {
+			b.dirty = true
+			continue
+		}
+		b.peers[id] = &known
+	}
+	return nil
+}
+
+// Start vuelve a conectar con los peers conocidos y empieza a registrar las conexiones
+func (b *PeerBook) Start() {
+	b.notifiee = &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			b.seen(conn.RemotePeer())
+		},
+		DisconnectedF: func(_ network.Network, conn network.Conn) {
+			b.seen(conn.RemotePeer())
+		},
+	}
+	b.host.Network().Notify(b.notifiee)
+
+	go b.reconnect()
+	go b.saveLoop()
+}
+
+// Stop deja de registrar conexiones y guarda los peers conocidos
+func (b *PeerBook) Stop() {
+	if b.notifiee != nil {
+		b.host.Network().StopNotify(b.notifiee)
+	}
+	b.cancel()
+
+	if err := b.Save(); err != nil {
+		log.Printf("Error al guardar peers conocidos: %v", err)
+	}
+}
+
+// seen anota que un peer está conectado, con las direcciones que se conocen de él
+func (b *PeerBook) seen(id peer.ID) {
+	if id == b.host.ID() {
+		return
+	}
+
+	addrs := b.host.Peerstore().Addrs(id)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	known, exists := b.peers[id]
+	if !exists {
+		known = &KnownPeer{ID: id.String()}
+		b.peers[id] = known
+	}
+	known.LastSeen = time.Now()
+	if len(addrs) > 0 {
+		known.Addrs = known.Addrs[:0]
+		for _, addr := range addrs {
+			known.Addrs = append(known.Addrs, addr.String())
+		}
+	}
+	b.dirty = true
+}
+
+// Peers devuelve los peers conocidos, primero los vistos más recientemente
+func (b *PeerBook) Peers() []KnownPeer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	peers := make([]KnownPeer, 0, len(b.peers))
+	for _, known := range b.peers {
+		copied := *known
+		copied.Addrs = slices.Clone(known.Addrs)
+		peers = append(peers, copied)
+	}
+	slices.SortFunc(peers, func(a, b KnownPeer) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return peers
+}
+
+// reconnect añade las direcciones guardadas al peerstore y se conecta con los
+// peers vistos más recientemente
+func (b *PeerBook) reconnect() {
+	peers := b.Peers()
+	if len(peers) > peerBookReconnectLimit {
+		peers = peers[:peerBookReconnectLimit]
+	}
+
+	var wg sync.WaitGroup
+	for _, known := range peers {
+		info, err := known.addrInfo()
+		if err != nil {
+			log.Printf("Peer conocido %s no válido: %v", known.ID, err)
+			continue
+		}
+		if len(info.Addrs) == 0 {
+			continue
+		}
+		b.host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.RecentlyConnectedAddrTTL)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(b.ctx, peerBookDialTimeout)
+			defer cancel()
+			if err := b.host.Connect(ctx, info); err != nil {
+				log.Printf("No se pudo reconectar con el peer conocido %s: %v", info.ID.String(), err)
+			} else {
+				log.Printf("Reconectado con el peer conocido %s", info.ID.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// addrInfo convierte un peer conocido en la información para conectarse a él
+func (k KnownPeer) addrInfo() (peer.AddrInfo, error) {
+	id, err := peer.Decode(k.ID)
+	if err != nil {
+		return peer.AddrInfo{}, err
+	}
+
+	info := peer.AddrInfo{ID: id}
+	for _, addr := range k.Addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		info.Addrs = append(info.Addrs, ma)
+	}
+	return info, nil
+}
+
+// saveLoop guarda periódicamente los peers conocidos si han cambiado
+func (b *PeerBook) saveLoop() {
+	ticker := time.NewTicker(peerBookSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Los peers conectados siguen vistos aunque no haya nuevas conexiones
+			for _, id := range b.host.Network().Peers() {
+				b.seen(id)
+			}
+			if err := b.Save(); err != nil {
+				log.Printf("Error al guardar peers conocidos: %v", err)
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// Save escribe los peers conocidos en el directorio de datos si han cambiado
+func (b *PeerBook) Save() error {
+	b.mutex.Lock()
+	if !b.dirty {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.dirty = false
+	b.mutex.Unlock()
+
+	if err := b.write(); err != nil {
+		// Reintentar en la siguiente escritura
+		b.mutex.Lock()
+		b.dirty = true
+		b.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// write escribe los peers conocidos en un archivo temporal y lo renombra
+func (b *PeerBook) write() error {
+	data, err := json.MarshalIndent(b.Peers(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error al serializar peers conocidos: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de datos: %v", err)
+	}
+	tmpPath := b.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("error al guardar peers conocidos: %v", err)
+	}
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		return fmt.Errorf("error al guardar peers conocidos: %v", err)
+	}
+	return nil
+}
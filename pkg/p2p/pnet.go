@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/aratan/dbp2p/pkg/config"
+
+	"github.com/libp2p/go-libp2p/core/pnet"
+)
+
+// pskFileName nombre por defecto del archivo con la clave de la red privada
+const pskFileName = "swarm.key"
+
+// clusterIDPattern formato de los identificadores de clúster, válidos como
+// parte del nombre del servicio mDNS
+var clusterIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]{0,31}$`)
+
+// ValidateClusterID comprueba que un identificador de clúster sea válido. Vacío
+// indica que no se separan los clústeres.
+func ValidateClusterID(clusterID string) error {
+	if clusterID != "" && !clusterIDPattern.MatchString(clusterID) {
+		return fmt.Errorf("identificador de clúster no válido %q: solo letras, números y guiones, hasta 32 caracteres", clusterID)
+	}
+	return nil
+}
+
+// clusterServiceName devuelve el nombre del servicio mDNS del clúster
+func clusterServiceName(serviceName, clusterID string) string {
+	if clusterID == "" {
+		return serviceName
+	}
+	return serviceName + "-" + clusterID
+}
+
+// PSKPath devuelve la ruta del archivo con la clave de la red privada
+func PSKPath(cfg *config.Config) string {
+	if cfg.Network.PrivateNetwork.PSKFile != "" {
+		return cfg.Network.PrivateNetwork.PSKFile
+	}
+	return filepath.Join(cfg.General.DataDir, pskFileName)
+}
+
+// LoadPSK lee la clave precompartida de la red privada, en el formato de los
+// archivos swarm.key de libp2p
+func LoadPSK(path string) (pnet.PSK, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no existe la clave de la red privada %s; se genera con 'dbp2p keygen'", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir la clave de la red privada: %v", err)
+	}
+	defer file.Close()
+
+	psk, err := pnet.DecodeV1PSK(file)
+	if err != nil {
+		return nil, fmt.Errorf("clave de la red privada no válida en %s: %v", path, err)
+	}
+	return psk, nil
+}
+
+// GeneratePSK genera una clave precompartida de 256 bits y la guarda en el
+// formato swarm.key, legible solo por su propietario. No sobrescribe una clave
+// existente salvo que se indique force.
+func GeneratePSK(path string, force bool) error {
+	if _, err := os.Stat(path); err == nil && !force {
+		return fmt.Errorf("ya existe la clave %s", path)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("error al generar la clave: %v", err)
+	}
+	data := fmt.Sprintf("/key/swarm/psk/1.0.0/\n/base16/\n%s\n", hex.EncodeToString(key))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error al crear directorio de la clave: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	if err := os.WriteFile(tmpPath, []byte(data), 0600); err != nil {
+		return fmt.Errorf("error al guardar la clave: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error al guardar la clave: %v", err)
+	}
+	return nil
+}
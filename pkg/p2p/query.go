@@ -0,0 +1,265 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// QueryProtocol protocolo con el que un nodo envía una consulta a los demás para
+// ejecutarla sobre sus documentos. Cada stream lleva una consulta y sus resultados.
+const QueryProtocol = protocol.ID("/dbp2p/query/1.0.0")
+
+// QueryConfig configuración de las consultas distribuidas
+type QueryConfig struct {
+	// Tiempo máximo de espera a la respuesta de cada nodo
+	PeerTimeout time.Duration
+}
+
+// DefaultQueryConfig es la configuración por defecto de las consultas distribuidas
+var DefaultQueryConfig = QueryConfig{
+	PeerTimeout: 5 * time.Second,
+}
+
+// QueryResult resultado de una consulta distribuida
+type QueryResult struct {
+	Documents []*db.Document `json:"documents"`
+	Count     int            `json:"count"`
+	Complete  bool           `json:"complete"` // Respondieron todos los nodos consultados
+	Peers     []PeerResult   `json:"peers"`
+}
+
+// PeerResult resultado de una consulta distribuida en un nodo
+type PeerResult struct {
+	Peer      string `json:"peer"`
+	Documents int    `json:"documents"` // Documentos que devolvió el nodo antes de fusionarlos
+	Error     string `json:"error,omitempty"`
+}
+
+// queryRequest es una consulta enviada a otro nodo
+type queryRequest struct {
+	Query *db.Query `json:"query"`
+}
+
+// queryResponse son los resultados de una consulta en un nodo
+type queryResponse struct {
+	Documents []*db.Document `json:"documents,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// DistributedQuery ejecuta consultas sobre los documentos de todo el clúster. La
+// consulta se envía a los nodos que hablan el protocolo, cada uno la ejecuta
+// sobre sus documentos sin omitir ninguno y limitada a Skip+Limit, y el nodo que
+// la recibió fusiona los resultados parciales con los suyos, quita los
+// duplicados y aplica la ordenación y la paginación. Los nodos que no responden
+// a tiempo se omiten y el resultado se marca como incompleto.
+type DistributedQuery struct {
+	node     *Node
+	database *db.Database
+	config   QueryConfig
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewDistributedQuery crea el servicio de consultas distribuidas del nodo
+func NewDistributedQuery(n *Node, database *db.Database, config ...QueryConfig) *DistributedQuery {
+	cfg := DefaultQueryConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	return &DistributedQuery{
+		node:     n,
+		database: database,
+		config:   cfg,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start empieza a atender las consultas de los demás nodos
+func (d *DistributedQuery) Start() {
+	d.node.Host.SetStreamHandler(QueryProtocol, d.handleQueryStream)
+}
+
+// Stop deja de atender consultas y cancela las que están en curso
+func (d *DistributedQuery) Stop() {
+	d.node.Host.RemoveStreamHandler(QueryProtocol)
+	d.cancel()
+}
+
+// Execute ejecuta una consulta en el nodo y en los demás nodos del clúster y
+// fusiona los resultados. timeout es la espera máxima a cada nodo; con 0 se usa
+// la de la configuración. Solo falla si no se puede ejecutar en el propio nodo.
+func (d *DistributedQuery) Execute(query *db.Query, timeout time.Duration) (*QueryResult, error) {
+	if timeout <= 0 {
+		timeout = d.config.PeerTimeout
+	}
+
+	partial := query.Partial()
+	local, err := partial.Execute(d.database)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := d.peers(query.Collection)
+	statuses := make([]PeerResult, len(peers))
+	partials := make([][]*db.Document, len(peers)+1)
+	partials[0] = local
+
+	var wg sync.WaitGroup
+	for i, pid := range peers {
+		wg.Add(1)
+		go func(i int, pid peer.ID) {
+			defer wg.Done()
+
+			statuses[i].Peer = pid.String()
+			docs, err := d.call(d.ctx, pid, partial, timeout)
+			if err != nil {
+				statuses[i].Error = err.Error()
+				return
+			}
+			statuses[i].Documents = len(docs)
+			partials[i+1] = docs
+		}(i, pid)
+	}
+	wg.Wait()
+
+	result := &QueryResult{Complete: true, Peers: statuses}
+	for _, status := range statuses {
+		if status.Error != "" {
+			result.Complete = false
+			log.Printf("Consulta distribuida sobre %s sin respuesta de %s: %s", query.Collection, status.Peer, status.Error)
+		}
+	}
+
+	result.Documents = query.MergeResults(d.database, partials...)
+	result.Count = len(result.Documents)
+	return result, nil
+}
+
+// peers devuelve los nodos a los que se envía una consulta: los conectados y, en
+// las colecciones fragmentadas, los miembros del anillo, si hablan el protocolo
+func (d *DistributedQuery) peers(collection string) []peer.ID {
+	candidates := d.node.Host.Network().Peers()
+	if sharding := d.node.Sharding; sharding != nil && sharding.Sharded(collection) {
+		for _, member := range sharding.currentRing().Members() {
+			if pid, err := peer.Decode(member); err == nil {
+				candidates = append(candidates, pid)
+			}
+		}
+	}
+
+	seen := map[peer.ID]bool{d.node.Host.ID(): true}
+	var peers []peer.ID
+	for _, pid := range candidates {
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+
+		protocols, err := d.node.Host.Peerstore().SupportsProtocols(pid, QueryProtocol)
+		if err == nil && len(protocols) > 0 {
+			peers = append(peers, pid)
+		}
+	}
+	return peers
+}
+
+// call envía una consulta a un nodo en un stream nuevo y devuelve sus resultados
+func (d *DistributedQuery) call(ctx context.Context, pid peer.ID, query *db.Query, timeout time.Duration) ([]*db.Document, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := d.node.Host.NewStream(ctx, pid, QueryProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(stream).Encode(queryRequest{Query: query}); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("error al enviar consulta: %v", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("error al enviar consulta: %v", err)
+	}
+
+	var response queryResponse
+	if err := json.NewDecoder(stream).Decode(&response); err != nil {
+		stream.Reset()
+		return nil, fmt.Errorf("error al leer resultados: %v", err)
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response.Documents, nil
+}
+
+// handleQueryStream responde a una consulta de otro nodo
+func (d *DistributedQuery) handleQueryStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(d.config.PeerTimeout))
+
+	var request queryRequest
+	if err := json.NewDecoder(stream).Decode(&request); err != nil {
+		stream.Reset()
+		log.Printf("Error al leer consulta distribuida: %v", err)
+		return
+	}
+
+	remote := stream.Conn().RemotePeer().String()
+	response := d.answerQueryRequest(remote, request)
+
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		stream.Reset()
+		log.Printf("Error al enviar resultados de consulta distribuida: %v", err)
+	}
+}
+
+// answerQueryRequest ejecuta la consulta de otro nodo sobre los documentos que
+// el nodo publica: solo las colecciones que replica y que el otro nodo puede
+// leer, y solo los documentos que cumplen el filtro de replicación
+func (d *DistributedQuery) answerQueryRequest(remote string, request queryRequest) queryResponse {
+	query := request.Query
+	if query == nil {
+		return queryResponse{Error: "petición sin consulta"}
+	}
+
+	// Un nodo que se está incorporando aún no tiene todos sus documentos
+	if d.database.IsReadOnly() {
+		return queryResponse{Error: "el nodo se está incorporando al clúster"}
+	}
+
+	policy := d.database.ReplicationPolicy()
+	if !policy.Publishes(query.Collection) || !d.database.CanRead(remote, query.Collection) {
+		return queryResponse{Error: fmt.Sprintf("sin permiso para consultar %s", query.Collection)}
+	}
+	if filter := policy.Filters[query.Collection]; filter != nil {
+		if query.Condition == nil {
+			query.Condition = filter
+		} else {
+			query.And(query.Condition, filter)
+		}
+	}
+
+	docs, err := query.Execute(d.database)
+	if err != nil {
+		return queryResponse{Error: err.Error()}
+	}
+	return queryResponse{Documents: docs}
+}
@@ -0,0 +1,533 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// ShardProtocol protocolo con el que los nodos se envían las escrituras y
+// lecturas de los documentos fragmentados que no guardan y se entregan los
+// documentos que cambian de propietario. Cada stream lleva una petición y su
+// respuesta.
+const ShardProtocol = protocol.ID("/dbp2p/shard/1.0.0")
+
+// Tipos de petición de fragmentación
+const (
+	shardWrite   = "write"
+	shardGet     = "get"
+	shardHandoff = "handoff"
+)
+
+// ShardingConfig configuración de la fragmentación de colecciones
+type ShardingConfig struct {
+	// Colecciones repartidas entre los nodos por el ID de sus documentos
+	Collections []string
+
+	// Número de nodos que guardan cada documento
+	ReplicationFactor int
+
+	// Puntos de cada nodo en el anillo; más puntos reparten mejor los documentos
+	VirtualNodes int
+
+	// Intervalo entre revisiones de los miembros del anillo
+	RebalanceInterval time.Duration
+
+	// Tiempo máximo de cada petición a otro nodo
+	RequestTimeout time.Duration
+
+	// Documentos por entrega al cambiar de propietario
+	BatchSize int
+}
+
+// DefaultShardingConfig es la configuración por defecto de la fragmentación
+var DefaultShardingConfig = ShardingConfig{
+	ReplicationFactor: 3,
+	VirtualNodes:      64,
+	RebalanceInterval: 30 * time.Second,
+	RequestTimeout:    10 * time.Second,
+	BatchSize:         100,
+}
+
+// ShardingStatus estado de la fragmentación en el nodo
+type ShardingStatus struct {
+	Members           []string  `json:"members"`
+	Collections       []string  `json:"collections"`
+	ReplicationFactor int       `json:"replication_factor"`
+	Documents         int       `json:"documents"`  // Documentos fragmentados guardados en el nodo
+	Rebalances        int       `json:"rebalances"` // Cambios de miembros del anillo
+	HandedOff         int       `json:"handed_off"` // Documentos entregados a sus nuevos propietarios
+	Released          int       `json:"released"`   // Documentos quitados del nodo tras entregarlos
+	LastRebalance     time.Time `json:"last_rebalance,omitempty"`
+}
+
+// shardRequest es una petición del protocolo de fragmentación
+type shardRequest struct {
+	Type       string          `json:"type"`
+	Command    *db.Command     `json:"command,omitempty"`
+	ID         string          `json:"id,omitempty"`
+	Documents  []*db.Document  `json:"documents,omitempty"`
+	Tombstones []*db.Tombstone `json:"tombstones,omitempty"`
+}
+
+// shardResponse es la respuesta a una petición de fragmentación
+type shardResponse struct {
+	Result   json.RawMessage `json:"result,omitempty"`   // Resultado de una escritura
+	Document *db.Document    `json:"document,omitempty"` // Documento pedido, si el nodo lo guarda
+	Stored   []string        `json:"stored,omitempty"`   // IDs entregados que el nodo guarda
+	Error    string          `json:"error,omitempty"`
+}
+
+// Sharding reparte los documentos de las colecciones fragmentadas entre los
+// nodos con un anillo de hash consistente. Cada documento lo guardan los
+// ReplicationFactor primeros nodos del anillo desde el hash de su ID; los demás
+// les envían sus escrituras y les piden el documento al leerlo. Los miembros
+// del anillo son los nodos de la tabla de rutas del DHT y los conectados que
+// hablan el protocolo. Cuando cambian, cada nodo entrega a sus nuevos
+// propietarios los documentos que guarda y quita los que ya no le pertenecen.
+type Sharding struct {
+	node     *Node
+	database *db.Database
+	config   ShardingConfig
+	self     string
+	ring     *HashRing
+	status   ShardingStatus
+	mutex    sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewSharding crea el reparto de las colecciones fragmentadas del nodo. Hasta
+// conocer a otros nodos, el anillo solo contiene al propio nodo.
+func NewSharding(n *Node, database *db.Database, config ...ShardingConfig) *Sharding {
+	cfg := DefaultShardingConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	cfg.ReplicationFactor = max(cfg.ReplicationFactor, 1)
+
+	self := n.Host.ID().String()
+	ctx, cancel := context.WithCancel(n.ctx)
+	return &Sharding{
+		node:     n,
+		database: database,
+		config:   cfg,
+		self:     self,
+		ring:     NewHashRing([]string{self}, cfg.VirtualNodes),
+		status: ShardingStatus{
+			Members:           []string{self},
+			Collections:       cfg.Collections,
+			ReplicationFactor: cfg.ReplicationFactor,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start empieza a atender a los demás nodos y a revisar los miembros del anillo
+func (s *Sharding) Start() {
+	s.node.Host.SetStreamHandler(ShardProtocol, s.handleShardStream)
+	go s.run()
+	log.Printf("Fragmentación iniciada para las colecciones %v con factor de replicación %d",
+		s.config.Collections, s.config.ReplicationFactor)
+}
+
+// Stop deja de atender a los demás nodos y de revisar el anillo
+func (s *Sharding) Stop() {
+	s.node.Host.RemoveStreamHandler(ShardProtocol)
+	s.cancel()
+}
+
+// Status devuelve el estado de la fragmentación en el nodo
+func (s *Sharding) Status() ShardingStatus {
+	s.mutex.RLock()
+	status := s.status
+	s.mutex.RUnlock()
+
+	status.Members = slices.Clone(status.Members)
+	status.Documents = s.database.CountLocalDocuments(s.Sharded)
+	return status
+}
+
+// Sharded indica si una colección está fragmentada
+func (s *Sharding) Sharded(collection string) bool {
+	return slices.Contains(s.config.Collections, collection)
+}
+
+// Owners devuelve los nodos que guardan un documento
+func (s *Sharding) Owners(id string) []string {
+	return s.currentRing().Owners(id, s.config.ReplicationFactor)
+}
+
+// Owns indica si el nodo es uno de los propietarios de un documento
+func (s *Sharding) Owns(id string) bool {
+	return slices.Contains(s.Owners(id), s.self)
+}
+
+// currentRing devuelve el anillo actual
+func (s *Sharding) currentRing() *HashRing {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.ring
+}
+
+// Forward envía una escritura al primer propietario del documento que responda
+// y devuelve su resultado. Si el nodo ha pasado a ser propietario, la aplica él.
+func (s *Sharding) Forward(command *db.Command) (*db.Document, error) {
+	owners := s.Owners(command.ID)
+	if slices.Contains(owners, s.self) {
+		return s.database.ExecuteCommand(command)
+	}
+
+	var lastErr error
+	for _, owner := range owners {
+		response, err := s.call(s.ctx, owner, shardRequest{Type: shardWrite, Command: command})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return db.DecodeCommandResult(response.Result)
+	}
+	return nil, fmt.Errorf("%w: %v", db.ErrShardUnavailable, lastErr)
+}
+
+// Fetch obtiene un documento de sus propietarios. Falla con
+// db.ErrShardUnavailable si no responde ninguno.
+func (s *Sharding) Fetch(id string) (*db.Document, error) {
+	var lastErr error
+	answered := false
+	for _, owner := range s.Owners(id) {
+		if owner == s.self {
+			continue
+		}
+		response, err := s.call(s.ctx, owner, shardRequest{Type: shardGet, ID: id})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Document != nil {
+			return response.Document, nil
+		}
+		answered = true
+	}
+
+	if answered || lastErr == nil {
+		return nil, errors.New("documento no encontrado")
+	}
+	return nil, fmt.Errorf("%w: %v", db.ErrShardUnavailable, lastErr)
+}
+
+// call envía una petición a un nodo en un stream nuevo y devuelve la respuesta
+func (s *Sharding) call(ctx context.Context, target string, request shardRequest) (shardResponse, error) {
+	var response shardResponse
+
+	pid, err := peer.Decode(target)
+	if err != nil {
+		return response, fmt.Errorf("ID de nodo no válido: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.RequestTimeout)
+	defer cancel()
+
+	stream, err := s.node.Host.NewStream(ctx, pid, ShardProtocol)
+	if err != nil {
+		return response, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(s.config.RequestTimeout))
+
+	if err := json.NewEncoder(stream).Encode(request); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al enviar petición: %v", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al enviar petición: %v", err)
+	}
+
+	if err := json.NewDecoder(stream).Decode(&response); err != nil {
+		stream.Reset()
+		return response, fmt.Errorf("error al leer respuesta: %v", err)
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// handleShardStream responde a una petición de fragmentación de otro nodo
+func (s *Sharding) handleShardStream(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(s.config.RequestTimeout))
+
+	var request shardRequest
+	if err := json.NewDecoder(stream).Decode(&request); err != nil {
+		stream.Reset()
+		log.Printf("Error al leer petición de fragmentación: %v", err)
+		return
+	}
+
+	remote := stream.Conn().RemotePeer().String()
+	response := s.answerShardRequest(remote, request)
+
+	if err := json.NewEncoder(stream).Encode(response); err != nil {
+		stream.Reset()
+		log.Printf("Error al enviar respuesta de fragmentación: %v", err)
+	}
+}
+
+// answerShardRequest calcula la respuesta a una petición de fragmentación. Las
+// escrituras y entregas de otros nodos están sujetas a la ACL de replicación, y
+// las lecturas a la política de replicación y al cifrado de la colección.
+func (s *Sharding) answerShardRequest(remote string, request shardRequest) shardResponse {
+	switch request.Type {
+	case shardWrite:
+		command := request.Command
+		if command == nil {
+			return shardResponse{Error: "petición sin escritura"}
+		}
+		collection := command.Collection
+		if local, exists := s.database.GetLocalDocument(command.ID); exists {
+			collection = local.Collection
+		}
+		if !s.Sharded(collection) {
+			return shardResponse{Error: fmt.Sprintf("la colección %s no está fragmentada", collection)}
+		}
+		if !s.database.AllowsReplication(remote, command.Operation, collection) {
+			s.database.RejectReplication(remote, fmt.Sprintf("sin permiso para %s en %s", command.Operation, collection))
+			return shardResponse{Error: fmt.Sprintf("sin permiso para escribir en %s", collection)}
+		}
+		return shardResponse{Result: db.EncodeCommandResult(s.database.ExecuteCommand(command))}
+
+	case shardGet:
+		doc, _ := s.database.GetLocalDocument(request.ID)
+		if doc == nil || !s.Sharded(doc.Collection) {
+			return shardResponse{}
+		}
+		// Las lecturas siguen las mismas reglas que las consultas distribuidas
+		policy := s.database.ReplicationPolicy()
+		if !policy.Publishes(doc.Collection) || !s.database.CanRead(remote, doc.Collection) {
+			return shardResponse{Error: fmt.Sprintf("sin permiso para leer %s", doc.Collection)}
+		}
+		if !policy.Matches(doc) {
+			return shardResponse{}
+		}
+		return shardResponse{Document: doc}
+
+	case shardHandoff:
+		return shardResponse{Stored: s.receiveHandoff(remote, request)}
+
+	default:
+		return shardResponse{Error: fmt.Sprintf("tipo de petición desconocido: %s", request.Type)}
+	}
+}
+
+// receiveHandoff aplica los documentos y lápidas que entrega otro nodo y
+// devuelve los IDs que el nodo guarda después
+func (s *Sharding) receiveHandoff(remote string, request shardRequest) []string {
+	s.database.AddPeer(remote)
+
+	var stored []string
+	for _, doc := range request.Documents {
+		if !s.Sharded(doc.Collection) {
+			continue
+		}
+		if !s.database.AllowsDocument(remote, doc) {
+			s.database.RejectReplication(remote, fmt.Sprintf("sin permiso para escribir en %s", doc.Collection))
+			continue
+		}
+		if _, err := s.database.ApplyRemoteDocument(doc); err != nil {
+			log.Printf("Error al aplicar documento entregado %s: %v", doc.ID, err)
+			continue
+		}
+		if s.database.Holds(doc.ID) {
+			stored = append(stored, doc.ID)
+		}
+	}
+
+	for _, tombstone := range request.Tombstones {
+		if !s.Sharded(tombstone.Collection) {
+			continue
+		}
+		if !s.database.AllowsReplication(remote, db.OperationDelete, tombstone.Collection) {
+			s.database.RejectReplication(remote, fmt.Sprintf("sin permiso para eliminar en %s", tombstone.Collection))
+			continue
+		}
+		if _, err := s.database.ApplyRemoteDelete(tombstone, remote); err != nil {
+			log.Printf("Error al aplicar eliminación entregada %s: %v", tombstone.ID, err)
+			continue
+		}
+		if s.database.Holds(tombstone.ID) {
+			stored = append(stored, tombstone.ID)
+		}
+	}
+	return stored
+}
+
+// run revisa periódicamente los miembros del anillo
+func (s *Sharding) run() {
+	s.refresh()
+
+	ticker := time.NewTicker(s.config.RebalanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.refresh()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// members devuelve los nodos que forman el anillo: el propio nodo y los de la
+// tabla de rutas del DHT o conectados que hablan el protocolo de fragmentación
+func (s *Sharding) members() []string {
+	candidates := s.node.Host.Network().Peers()
+	if s.node.DHTService != nil {
+		candidates = append(candidates, s.node.DHTService.GetRoutingTable()...)
+	}
+
+	members := []string{s.self}
+	for _, pid := range candidates {
+		protocols, err := s.node.Host.Peerstore().SupportsProtocols(pid, ShardProtocol)
+		if err == nil && len(protocols) > 0 {
+			members = append(members, pid.String())
+		}
+	}
+	return members
+}
+
+// refresh rehace el anillo con los miembros actuales y, si han cambiado,
+// entrega los documentos a sus nuevos propietarios. También reintenta entregar
+// los documentos que el nodo guarda sin ser propietario.
+func (s *Sharding) refresh() {
+	ring := NewHashRing(s.members(), s.config.VirtualNodes)
+
+	s.mutex.Lock()
+	previous := s.ring
+	changed := !ring.Equal(previous)
+	if changed {
+		s.ring = ring
+		s.status.Members = ring.Members()
+		s.status.Rebalances++
+		s.status.LastRebalance = time.Now()
+	}
+	s.mutex.Unlock()
+
+	if changed {
+		log.Printf("Anillo de fragmentación con %d nodos", len(ring.Members()))
+	} else {
+		previous = nil
+	}
+	s.rebalance(ring, previous)
+}
+
+// rebalance entrega los documentos y lápidas del nodo a los propietarios que no
+// lo eran en el anillo anterior y a todos los propietarios de los que el nodo ya
+// no guarda. Estos últimos se quitan del nodo cuando todos sus propietarios
+// confirman que los guardan. Sin anillo anterior solo se entregan los que el
+// nodo no guarda.
+func (s *Sharding) rebalance(ring, previous *HashRing) {
+	snapshot := s.database.Snapshot(s.Sharded)
+
+	documents := make(map[string][]*db.Document)
+	tombstones := make(map[string][]*db.Tombstone)
+	pending := make(map[string][]string) // Propietarios que deben confirmar cada documento ajeno
+	targetsFor := func(id string) []string {
+		owners := ring.Owners(id, s.config.ReplicationFactor)
+		if !slices.Contains(owners, s.self) {
+			pending[id] = owners
+			return owners
+		}
+		if previous == nil {
+			return nil
+		}
+		before := previous.Owners(id, s.config.ReplicationFactor)
+		var targets []string
+		for _, owner := range owners {
+			if owner != s.self && !slices.Contains(before, owner) {
+				targets = append(targets, owner)
+			}
+		}
+		return targets
+	}
+	for _, doc := range snapshot.Documents {
+		for _, target := range targetsFor(doc.ID) {
+			documents[target] = append(documents[target], doc)
+		}
+	}
+	for _, tombstone := range snapshot.Tombstones {
+		for _, target := range targetsFor(tombstone.ID) {
+			tombstones[target] = append(tombstones[target], tombstone)
+		}
+	}
+
+	// Entregar a cada propietario en lotes, anotando lo que confirma
+	confirmed := make(map[string]map[string]bool)
+	handedOff := 0
+	targets := make(map[string]bool, len(documents)+len(tombstones))
+	for target := range documents {
+		targets[target] = true
+	}
+	for target := range tombstones {
+		targets[target] = true
+	}
+	for target := range targets {
+		confirmed[target] = make(map[string]bool)
+		docs, dead := documents[target], tombstones[target]
+		batchSize := max(s.config.BatchSize, 1)
+		for len(docs) > 0 || len(dead) > 0 {
+			if s.ctx.Err() != nil {
+				return
+			}
+			request := shardRequest{Type: shardHandoff}
+			n := min(batchSize, len(docs))
+			request.Documents, docs = docs[:n], docs[n:]
+			n = min(batchSize-len(request.Documents), len(dead))
+			request.Tombstones, dead = dead[:n], dead[n:]
+
+			response, err := s.call(s.ctx, target, request)
+			if err != nil {
+				log.Printf("Error al entregar documentos a %s: %v", target, err)
+				break
+			}
+			for _, id := range response.Stored {
+				confirmed[target][id] = true
+			}
+			handedOff += len(response.Stored)
+		}
+	}
+
+	// Quitar los documentos ajenos que ya guardan todos sus propietarios
+	var released []string
+	for id, owners := range pending {
+		if !slices.ContainsFunc(owners, func(owner string) bool { return !confirmed[owner][id] }) {
+			released = append(released, id)
+		}
+	}
+	if len(released) > 0 {
+		if err := s.database.ReleaseDocuments(released); err != nil {
+			log.Printf("Error al quitar documentos entregados: %v", err)
+		}
+	}
+
+	s.mutex.Lock()
+	s.status.HandedOff += handedOff
+	s.status.Released += len(released)
+	s.mutex.Unlock()
+}
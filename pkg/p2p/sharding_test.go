@@ -0,0 +1,200 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// newTestSharding crea un reparto sin red para el nodo self con los miembros
+// indicados
+func newTestSharding(self string, database *db.Database, members []string, collections ...string) *Sharding {
+	config := DefaultShardingConfig
+	config.Collections = collections
+	return &Sharding{
+		database: database,
+		config:   config,
+		self:     self,
+		ring:     NewHashRing(members, config.VirtualNodes),
+		status:   ShardingStatus{Members: members, Collections: collections, ReplicationFactor: config.ReplicationFactor},
+	}
+}
+
+// TestShardWriteRejectsUnshardedCollections comprueba que otro nodo no pueda
+// escribir por el protocolo de fragmentación en colecciones que no lo están
+func TestShardWriteRejectsUnshardedCollections(t *testing.T) {
+	database := db.NewDatabase()
+	existing, err := database.CreateDocument("usuarios", map[string]interface{}{"rol": "lector"})
+	if err != nil {
+		t.Fatalf("error al crear documento: %v", err)
+	}
+	sharding := newTestSharding("a", database, []string{"a"}, "pedidos")
+
+	requests := []*db.Command{
+		{Operation: db.OperationCreate, Collection: "usuarios", ID: "nuevo", Data: map[string]any{"rol": "admin"}},
+		// La colección del documento local manda sobre la que indica la petición
+		{Operation: db.OperationUpdate, Collection: "pedidos", ID: existing.ID, Data: map[string]any{"rol": "admin"}},
+		{Operation: db.OperationDelete, Collection: "pedidos", ID: existing.ID},
+	}
+	for _, command := range requests {
+		response := sharding.answerShardRequest("b", shardRequest{Type: shardWrite, Command: command})
+		if response.Error == "" {
+			t.Errorf("%s de %s aceptado: %s", command.Operation, command.ID, response.Result)
+		}
+	}
+
+	if doc, exists := database.GetLocalDocument(existing.ID); !exists || doc.Data["rol"] != "lector" {
+		t.Errorf("el documento de una colección sin fragmentar cambió: %v", doc)
+	}
+	if _, exists := database.GetLocalDocument("nuevo"); exists {
+		t.Errorf("se creó un documento en una colección sin fragmentar")
+	}
+
+	response := sharding.answerShardRequest("b", shardRequest{Type: shardWrite, Command: &db.Command{
+		Operation: db.OperationCreate, Collection: "pedidos", ID: "p1", Data: map[string]any{"total": 5},
+	}})
+	if response.Error != "" {
+		t.Errorf("escritura en una colección fragmentada rechazada: %s", response.Error)
+	}
+}
+
+// shardHost abre streams de fragmentación con los repartos de otros nodos
+type shardHost struct {
+	host.Host
+	self  peer.ID
+	peers map[peer.ID]*Sharding
+}
+
+func (h shardHost) NewStream(_ context.Context, pid peer.ID, _ ...protocol.ID) (network.Stream, error) {
+	server, exists := h.peers[pid]
+	if !exists {
+		return nil, errors.New("peer inalcanzable")
+	}
+	return newRequestStream(h.self, pid, server.handleShardStream), nil
+}
+
+// newHandoffNode crea un nodo de la red de prueba que guarda un solo propietario
+// por documento de la colección pedidos
+func newHandoffNode(t *testing.T, peers map[peer.ID]*Sharding, members ...peer.ID) (peer.ID, *Sharding) {
+	t.Helper()
+	id := newTestPeerID(t)
+	names := []string{id.String()}
+	for _, member := range members {
+		names = append(names, member.String())
+	}
+
+	database := db.NewDatabase()
+	sharding := newTestSharding(id.String(), database, names, "pedidos")
+	sharding.config.ReplicationFactor = 1
+	sharding.status.ReplicationFactor = 1
+	sharding.ring = NewHashRing(names, sharding.config.VirtualNodes)
+	sharding.node = &Node{Host: shardHost{self: id, peers: peers}}
+	sharding.ctx = context.Background()
+	database.SetShardRouter(sharding)
+	peers[id] = sharding
+	return id, sharding
+}
+
+// joinRing añade un nodo al anillo de otro y entrega los documentos que cambian
+// de propietario, como al detectar un miembro nuevo
+func joinRing(sharding *Sharding, member peer.ID) {
+	previous := sharding.ring
+	ring := NewHashRing(append(previous.Members(), member.String()), sharding.config.VirtualNodes)
+	sharding.ring = ring
+	sharding.rebalance(ring, previous)
+}
+
+// createOrders crea documentos en pedidos y en una colección sin fragmentar y
+// devuelve los IDs de los pedidos
+func createOrders(t *testing.T, database *db.Database) []string {
+	t.Helper()
+	var ids []string
+	for i := range 40 {
+		doc, err := database.CreateDocument("pedidos", map[string]any{"n": i})
+		if err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+		ids = append(ids, doc.ID)
+	}
+	for i := range 5 {
+		if _, err := database.CreateDocument("notas", map[string]any{"n": i}); err != nil {
+			t.Fatalf("error al crear documento: %v", err)
+		}
+	}
+	return ids
+}
+
+func TestRebalanceHandsOffAndReleasesDocuments(t *testing.T) {
+	peers := make(map[peer.ID]*Sharding)
+	oldID, old := newHandoffNode(t, peers)
+	joinedID, joined := newHandoffNode(t, peers, oldID)
+	ids := createOrders(t, old.database)
+
+	joinRing(old, joinedID)
+
+	var moved []string
+	for _, id := range ids {
+		if old.Owners(id)[0] == joinedID.String() {
+			moved = append(moved, id)
+		}
+	}
+	if len(moved) == 0 || len(moved) == len(ids) {
+		t.Fatalf("el nodo nuevo es propietario de %d documentos de %d", len(moved), len(ids))
+	}
+
+	for _, id := range ids {
+		_, kept := old.database.GetLocalDocument(id)
+		_, received := joined.database.GetLocalDocument(id)
+		handedOff := slices.Contains(moved, id)
+		if kept == handedOff || received != handedOff {
+			t.Errorf("%s: en el nodo anterior %v, en el nuevo %v; entregado %v", id, kept, received, handedOff)
+		}
+	}
+
+	status := old.Status()
+	if status.HandedOff != len(moved) || status.Released != len(moved) {
+		t.Errorf("entregados %d y quitados %d, se esperaban %d", status.HandedOff, status.Released, len(moved))
+	}
+	if status.Documents != len(ids)-len(moved) {
+		t.Errorf("documentos fragmentados = %d, se esperaban %d", status.Documents, len(ids)-len(moved))
+	}
+	if joined.Status().Documents != len(moved) {
+		t.Errorf("documentos fragmentados del nodo nuevo = %d, se esperaban %d", joined.Status().Documents, len(moved))
+	}
+}
+
+func TestRebalanceKeepsDocumentsUntilOwnersConfirm(t *testing.T) {
+	peers := make(map[peer.ID]*Sharding)
+	oldID, old := newHandoffNode(t, peers)
+	joinedID, joined := newHandoffNode(t, peers, oldID)
+	ids := createOrders(t, old.database)
+
+	// El nodo nuevo no acepta escrituras del anterior
+	acl := db.ReplicationACL{Enabled: true, Peers: map[string]db.ACLRule{}}
+	if err := joined.database.SetReplicationACL(acl); err != nil {
+		t.Fatalf("error al establecer la ACL: %v", err)
+	}
+
+	joinRing(old, joinedID)
+
+	for _, id := range ids {
+		if _, kept := old.database.GetLocalDocument(id); !kept {
+			t.Errorf("se quitó %s sin que su propietario lo confirmara", id)
+		}
+	}
+	status := old.Status()
+	if status.HandedOff != 0 || status.Released != 0 || status.Documents != len(ids) {
+		t.Errorf("estado = %+v, no se esperaba ninguna entrega", status)
+	}
+	if joined.Status().Documents != 0 {
+		t.Errorf("el nodo nuevo guardó %d documentos rechazados", joined.Status().Documents)
+	}
+}
@@ -2,19 +2,19 @@ package p2p
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
 
-	"dbp2p/pkg/db"
+	"github.com/aratan/dbp2p/pkg/db"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // SyncConfig contiene la configuración para la sincronización optimizada
 type SyncConfig struct {
-	// Intervalo entre sincronizaciones completas
+	// Intervalo entre sincronizaciones completas, que comparan los árboles
+	// Merkle de los nodos y solo transfieren los documentos que difieren
 	FullSyncInterval time.Duration
 
 	// Intervalo entre sincronizaciones incrementales
@@ -44,7 +44,7 @@ type SyncConfig struct {
 
 // DefaultSyncConfig es la configuración por defecto para la sincronización
 var DefaultSyncConfig = SyncConfig{
-	FullSyncInterval:        time.Hour * 24,
+	FullSyncInterval:        time.Minute * 10,
 	IncrementalSyncInterval: time.Minute * 5,
 	BatchSize:               100,
 	ResponseTimeout:         time.Second * 30,
@@ -63,9 +63,13 @@ type SyncManager struct {
 	lastFullSync   time.Time
 	lastSyncByPeer map[peer.ID]time.Time
 	syncStats      SyncStats
+	conflictsBase  uint64                        // Conflictos de la base de datos al reiniciar las estadísticas
+	rejectedBase   uint64                        // Rechazos de la base de datos al reiniciar las estadísticas
+	pendingAcks    map[peer.ID][]db.TombstoneAck // Eliminaciones recibidas pendientes de confirmar a cada peer
 	syncInProgress bool
 	mutex          sync.RWMutex
 	stopChan       chan struct{}
+	stopOnce       sync.Once
 }
 
 // SyncStats contiene estadísticas de sincronización
@@ -84,6 +88,10 @@ type SyncStats struct {
 	LastSyncTime          time.Time
 	TotalFullSyncs        int
 	TotalIncrementalSyncs int
+	AntiEntropyRounds     int   // Intercambios de las sincronizaciones por árbol Merkle
+	AntiEntropyBytes      int64 // Bytes enviados y recibidos en esas sincronizaciones
+	RejectedMessages      int   // Mensajes y documentos replicados rechazados por firma o ACL
+	OutboxDepth           int   // Escrituras locales pendientes de replicar
 }
 
 // SyncRequest representa una solicitud de sincronización
@@ -93,25 +101,34 @@ type SyncRequest struct {
 	Collection       string    `json:"collection,omitempty"`
 	LastSyncTime     time.Time `json:"last_sync_time,omitempty"`
 	BatchSize        int       `json:"batch_size"`
+	BatchToken       string    `json:"batch_token,omitempty"` // Token del lote anterior para continuar
+	Collections      []string  `json:"collections,omitempty"` // Colecciones que recibe el nodo; vacío para todas
 	IncludeDeleted   bool      `json:"include_deleted"`
 	UseCompression   bool      `json:"use_compression"`
 	CompressionLevel int       `json:"compression_level,omitempty"`
 	RequestID        string    `json:"request_id"`
 	Timestamp        time.Time `json:"timestamp"`
+
+	// Condición de los documentos que recibe el nodo de cada colección
+	Filters map[string]interface{} `json:"filters,omitempty"`
+
+	// Eliminaciones recibidas en respuestas anteriores que el nodo confirma
+	Acks []db.TombstoneAck `json:"acks,omitempty"`
 }
 
 // SyncResponse representa una respuesta a una solicitud de sincronización
 type SyncResponse struct {
-	NodeID           string        `json:"node_id"`
-	RequestID        string        `json:"request_id"`
-	Success          bool          `json:"success"`
-	ErrorMessage     string        `json:"error_message,omitempty"`
-	Documents        []db.Document `json:"documents,omitempty"`
-	DocumentsCount   int           `json:"documents_count"`
-	HasMoreDocuments bool          `json:"has_more_documents"`
-	NextBatchToken   string        `json:"next_batch_token,omitempty"`
-	Compressed       bool          `json:"compressed"`
-	Timestamp        time.Time     `json:"timestamp"`
+	NodeID           string         `json:"node_id"`
+	RequestID        string         `json:"request_id"`
+	Success          bool           `json:"success"`
+	ErrorMessage     string         `json:"error_message,omitempty"`
+	Documents        []db.Document  `json:"documents,omitempty"`
+	Tombstones       []db.Tombstone `json:"tombstones,omitempty"` // Eliminaciones, si se pidieron
+	DocumentsCount   int            `json:"documents_count"`
+	HasMoreDocuments bool           `json:"has_more_documents"`
+	NextBatchToken   string         `json:"next_batch_token,omitempty"`
+	Compressed       bool           `json:"compressed"`
+	Timestamp        time.Time      `json:"timestamp"`
 }
 
 // NewSyncManager crea un nuevo gestor de sincronización
@@ -129,6 +146,7 @@ func NewSyncManager(node *Node, database *db.Database, config ...SyncConfig) *Sy
 		lastFullSync:   time.Time{},
 		lastSyncByPeer: make(map[peer.ID]time.Time),
 		syncStats:      SyncStats{},
+		pendingAcks:    make(map[peer.ID][]db.TombstoneAck),
 		stopChan:       make(chan struct{}),
 	}
 }
@@ -141,15 +159,25 @@ func (sm *SyncManager) Start() {
 	// Iniciar goroutine para sincronización completa
 	go sm.startFullSync()
 
-	// Registrar manejador para solicitudes de sincronización
-	// Nota: Implementación temporal hasta que se añada RegisterTopicHandler
-	// sm.node.PubSub.RegisterTopicHandler("sync_request", sm.handleSyncRequest)
-	// sm.node.PubSub.RegisterTopicHandler("sync_response", sm.handleSyncResponse)
+	// Responder a las solicitudes de sincronización y a las comparaciones de
+	// árboles Merkle de otros nodos
+	sm.node.Host.SetStreamHandler(SyncProtocol, sm.handleSyncStream)
+	sm.node.Host.SetStreamHandler(AntiEntropyProtocol, sm.handleAntiEntropyStream)
 }
 
 // Stop detiene el proceso de sincronización
 func (sm *SyncManager) Stop() {
-	close(sm.stopChan)
+	sm.stopOnce.Do(func() {
+		sm.node.Host.RemoveStreamHandler(SyncProtocol)
+		sm.node.Host.RemoveStreamHandler(AntiEntropyProtocol)
+		close(sm.stopChan)
+	})
+}
+
+// SyncNow sincroniza de inmediato con los peers conectados, sin esperar al
+// siguiente intervalo. La primera sincronización con un peer trae todos sus documentos.
+func (sm *SyncManager) SyncNow() {
+	sm.performIncrementalSync()
 }
 
 // startIncrementalSync inicia la sincronización incremental periódica
@@ -210,10 +238,13 @@ func (sm *SyncManager) performIncrementalSync() {
 	sm.syncStats.TotalIncrementalSyncs++
 	sm.mutex.Unlock()
 
+	// Pedir solo las colecciones y documentos que recibe el nodo
+	policy := sm.policy()
+
 	startTime := time.Now()
 
-	// Crear contexto con timeout
-	ctx, cancel := context.WithTimeout(context.Background(), sm.config.ResponseTimeout)
+	// Cada lote tiene su propio límite de ResponseTimeout
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Crear grupo de espera para sincronización concurrente
@@ -245,23 +276,23 @@ func (sm *SyncManager) performIncrementalSync() {
 				IncludeDeleted:   true,
 				UseCompression:   sm.config.UseCompression,
 				CompressionLevel: sm.config.CompressionLevel,
-				RequestID:        generateRequestID(),
-				Timestamp:        time.Now(),
+				Collections:      policy.Subscribe,
+				Filters:          policy.Filters,
 			}
 
-			// Enviar solicitud
-			err := sm.sendSyncRequest(ctx, pid, request)
+			// Pedir los lotes por el protocolo de sincronización
+			started, err := sm.requestSync(ctx, pid, request)
 			if err != nil {
-				fmt.Printf("Error al enviar solicitud de sincronización a %s: %v\n", pid.String(), err)
+				fmt.Printf("Error en la sincronización con %s: %v\n", pid.String(), err)
 				successMutex.Lock()
 				failCount++
 				successMutex.Unlock()
 				return
 			}
 
-			// Actualizar última sincronización con este peer
+			// La siguiente sincronización parte de la hora del peer, no de la local
 			sm.mutex.Lock()
-			sm.lastSyncByPeer[pid] = time.Now()
+			sm.lastSyncByPeer[pid] = started
 			successMutex.Lock()
 			successCount++
 			successMutex.Unlock()
@@ -285,7 +316,9 @@ func (sm *SyncManager) performIncrementalSync() {
 		duration, successCount, failCount)
 }
 
-// performFullSync realiza una sincronización completa con todos los peers
+// performFullSync realiza una sincronización completa con todos los peers. En
+// lugar de reenviar todos los documentos, compara su árbol Merkle con el de cada
+// peer y solo pide los documentos y eliminaciones que difieren.
 func (sm *SyncManager) performFullSync() {
 	sm.mutex.Lock()
 	if sm.syncInProgress {
@@ -315,8 +348,9 @@ func (sm *SyncManager) performFullSync() {
 
 	startTime := time.Now()
 
-	// Crear contexto con timeout
-	ctx, cancel := context.WithTimeout(context.Background(), sm.config.ResponseTimeout*2)
+	// Cada intercambio tiene su propio límite de ResponseTimeout; el número de
+	// intercambios depende de cuántos documentos difieran
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Crear grupo de espera para sincronización concurrente
@@ -330,22 +364,10 @@ func (sm *SyncManager) performFullSync() {
 		go func(pid peer.ID) {
 			defer wg.Done()
 
-			// Crear solicitud de sincronización
-			request := SyncRequest{
-				NodeID:           sm.node.Host.ID().String(),
-				RequestType:      "full",
-				BatchSize:        sm.config.BatchSize,
-				IncludeDeleted:   true,
-				UseCompression:   sm.config.UseCompression,
-				CompressionLevel: sm.config.CompressionLevel,
-				RequestID:        generateRequestID(),
-				Timestamp:        time.Now(),
-			}
-
-			// Enviar solicitud
-			err := sm.sendSyncRequest(ctx, pid, request)
+			// Sincronizar por anti-entropía
+			err := sm.antiEntropy(ctx, pid)
 			if err != nil {
-				fmt.Printf("Error al enviar solicitud de sincronización a %s: %v\n", pid.String(), err)
+				fmt.Printf("Error en la sincronización completa con %s: %v\n", pid.String(), err)
 				successMutex.Lock()
 				failCount++
 				successMutex.Unlock()
@@ -379,357 +401,42 @@ func (sm *SyncManager) performFullSync() {
 		duration, successCount, failCount)
 }
 
-// sendSyncRequest envía una solicitud de sincronización a un peer
-func (sm *SyncManager) sendSyncRequest(ctx context.Context, peerID peer.ID, request SyncRequest) error {
-	// Serializar solicitud
-	data, err := json.Marshal(request)
-	if err != nil {
-		return fmt.Errorf("error al serializar solicitud: %v", err)
-	}
-
-	// Comprimir datos si es necesario
-	if request.UseCompression {
-		// Aquí se implementaría la compresión
-	}
-
-	// Publicar mensaje
-	err = sm.node.PubSub.Publish("sync_request", data)
-	if err != nil {
-		return fmt.Errorf("error al publicar solicitud: %v", err)
-	}
-
-	return nil
-}
-
-// handleSyncRequest maneja una solicitud de sincronización
-func (sm *SyncManager) handleSyncRequest(topic string, data []byte) {
-	// Deserializar solicitud
-	var request SyncRequest
-	if err := json.Unmarshal(data, &request); err != nil {
-		fmt.Printf("Error al deserializar solicitud de sincronización: %v\n", err)
-		return
-	}
-
-	// Verificar si es una solicitud para este nodo
-	if request.NodeID == sm.node.Host.ID().String() {
-		return // Ignorar solicitudes propias
-	}
-
-	// Procesar solicitud según su tipo
-	var response SyncResponse
-	var err error
-
-	switch request.RequestType {
-	case "full":
-		response, err = sm.handleFullSyncRequest(request)
-	case "incremental":
-		response, err = sm.handleIncrementalSyncRequest(request)
-	case "collection":
-		response, err = sm.handleCollectionSyncRequest(request)
-	default:
-		err = fmt.Errorf("tipo de solicitud desconocido: %s", request.RequestType)
-	}
-
-	if err != nil {
-		// Crear respuesta de error
-		response = SyncResponse{
-			NodeID:       sm.node.Host.ID().String(),
-			RequestID:    request.RequestID,
-			Success:      false,
-			ErrorMessage: err.Error(),
-			Timestamp:    time.Now(),
+// tombstonesSince devuelve las eliminaciones registradas después de since en las
+// colecciones para las que include devuelve true
+func (sm *SyncManager) tombstonesSince(since time.Time, include func(collection string) bool) []db.Tombstone {
+	var tombstones []db.Tombstone
+	for _, tombstone := range sm.database.GetTombstones(since) {
+		if include(tombstone.Collection) {
+			tombstones = append(tombstones, *tombstone)
 		}
 	}
-
-	// Enviar respuesta
-	sm.sendSyncResponse(response)
+	return tombstones
 }
 
-// handleFullSyncRequest maneja una solicitud de sincronización completa
-func (sm *SyncManager) handleFullSyncRequest(request SyncRequest) (SyncResponse, error) {
-	// Obtener todas las colecciones
-	// Nota: Implementación temporal hasta que se añada GetCollections
-	collections := []string{"users", "documents", "settings"}
-
-	// Filtrar colecciones excluidas
-	var filteredCollections []string
-	for _, collection := range collections {
-		excluded := false
-		for _, excludedColl := range sm.config.ExcludedCollections {
-			if collection == excludedColl {
-				excluded = true
-				break
-			}
-		}
-		if !excluded {
-			filteredCollections = append(filteredCollections, collection)
-		}
-	}
-
-	// Ordenar colecciones por prioridad
-	// Aquí se implementaría la ordenación por prioridad
-
-	// Obtener documentos de cada colección
-	var allDocuments []db.Document
-	for _, collection := range filteredCollections {
-		docs, err := sm.database.GetAllDocuments(collection)
-		if err != nil {
-			fmt.Printf("Error al obtener documentos de la colección %s: %v\n", collection, err)
-			continue
-		}
-		for _, doc := range docs {
-			allDocuments = append(allDocuments, *doc)
-		}
-	}
-
-	// Limitar al tamaño del lote
-	documentsToSend := allDocuments
-	hasMore := false
-	if len(allDocuments) > request.BatchSize {
-		documentsToSend = allDocuments[:request.BatchSize]
-		hasMore = true
-	}
-
-	// Crear respuesta
-	response := SyncResponse{
-		NodeID:           sm.node.Host.ID().String(),
-		RequestID:        request.RequestID,
-		Success:          true,
-		Documents:        documentsToSend,
-		DocumentsCount:   len(documentsToSend),
-		HasMoreDocuments: hasMore,
-		Compressed:       request.UseCompression,
-		Timestamp:        time.Now(),
-	}
-
-	// Si hay más documentos, generar token para el siguiente lote
-	if hasMore {
-		// Aquí se implementaría la generación del token
-	}
-
-	return response, nil
-}
-
-// handleIncrementalSyncRequest maneja una solicitud de sincronización incremental
-func (sm *SyncManager) handleIncrementalSyncRequest(request SyncRequest) (SyncResponse, error) {
-	// Obtener documentos modificados desde la última sincronización
-	var modifiedDocuments []db.Document
-
-	// Obtener todas las colecciones
-	// Nota: Implementación temporal hasta que se añada GetCollections
-	collections := []string{"users", "documents", "settings"}
-
-	// Filtrar colecciones excluidas
-	var filteredCollections []string
-	for _, collection := range collections {
-		excluded := false
-		for _, excludedColl := range sm.config.ExcludedCollections {
-			if collection == excludedColl {
-				excluded = true
-				break
-			}
-		}
-		if !excluded {
-			filteredCollections = append(filteredCollections, collection)
-		}
-	}
-
-	// Obtener documentos modificados de cada colección
-	for _, collection := range filteredCollections {
-		docs, err := sm.database.GetAllDocuments(collection)
-		if err != nil {
-			fmt.Printf("Error al obtener documentos de la colección %s: %v\n", collection, err)
-			continue
-		}
-		for _, doc := range docs {
-			if doc.UpdatedAt.After(request.LastSyncTime) {
-				modifiedDocuments = append(modifiedDocuments, *doc)
-			}
-		}
-	}
-
-	// Limitar al tamaño del lote
-	documentsToSend := modifiedDocuments
-	hasMore := false
-	if len(modifiedDocuments) > request.BatchSize {
-		documentsToSend = modifiedDocuments[:request.BatchSize]
-		hasMore = true
-	}
-
-	// Crear respuesta
-	response := SyncResponse{
-		NodeID:           sm.node.Host.ID().String(),
-		RequestID:        request.RequestID,
-		Success:          true,
-		Documents:        documentsToSend,
-		DocumentsCount:   len(documentsToSend),
-		HasMoreDocuments: hasMore,
-		Compressed:       request.UseCompression,
-		Timestamp:        time.Now(),
-	}
-
-	// Si hay más documentos, generar token para el siguiente lote
-	if hasMore {
-		// Aquí se implementaría la generación del token
-	}
-
-	return response, nil
-}
-
-// handleCollectionSyncRequest maneja una solicitud de sincronización de una colección específica
-func (sm *SyncManager) handleCollectionSyncRequest(request SyncRequest) (SyncResponse, error) {
-	// Verificar si la colección está excluida
-	for _, excludedColl := range sm.config.ExcludedCollections {
-		if request.Collection == excludedColl {
-			return SyncResponse{}, fmt.Errorf("colección excluida: %s", request.Collection)
-		}
-	}
-
-	// Obtener documentos de la colección
-	docs, err := sm.database.GetAllDocuments(request.Collection)
-	if err != nil {
-		return SyncResponse{}, fmt.Errorf("error al obtener documentos: %v", err)
-	}
-
-	// Filtrar por fecha de modificación si es una sincronización incremental
-	var filteredDocs []db.Document
-	if !request.LastSyncTime.IsZero() {
-		for _, doc := range docs {
-			if doc.UpdatedAt.After(request.LastSyncTime) {
-				filteredDocs = append(filteredDocs, *doc)
-			}
-		}
-	} else {
-		for _, doc := range docs {
-			filteredDocs = append(filteredDocs, *doc)
-		}
-	}
-
-	// Limitar al tamaño del lote
-	documentsToSend := filteredDocs
-	hasMore := false
-	if len(filteredDocs) > request.BatchSize {
-		documentsToSend = filteredDocs[:request.BatchSize]
-		hasMore = true
-	}
-
-	// Crear respuesta
-	response := SyncResponse{
-		NodeID:           sm.node.Host.ID().String(),
-		RequestID:        request.RequestID,
-		Success:          true,
-		Documents:        documentsToSend,
-		DocumentsCount:   len(documentsToSend),
-		HasMoreDocuments: hasMore,
-		Compressed:       request.UseCompression,
-		Timestamp:        time.Now(),
-	}
-
-	// Si hay más documentos, generar token para el siguiente lote
-	if hasMore {
-		// Aquí se implementaría la generación del token
-	}
-
-	return response, nil
-}
-
-// sendSyncResponse envía una respuesta de sincronización
-func (sm *SyncManager) sendSyncResponse(response SyncResponse) {
-	// Serializar respuesta
-	data, err := json.Marshal(response)
-	if err != nil {
-		fmt.Printf("Error al serializar respuesta: %v\n", err)
-		return
-	}
-
-	// Comprimir datos si es necesario
-	if response.Compressed {
-		// Aquí se implementaría la compresión
-	}
-
-	// Publicar mensaje
-	err = sm.node.PubSub.Publish("sync_response", data)
-	if err != nil {
-		fmt.Printf("Error al publicar respuesta: %v\n", err)
-	}
-
-	// Actualizar estadísticas
-	sm.mutex.Lock()
-	sm.syncStats.DocumentsSent += response.DocumentsCount
-	sm.syncStats.BytesSent += int64(len(data))
-	sm.mutex.Unlock()
-}
-
-// handleSyncResponse maneja una respuesta de sincronización
-func (sm *SyncManager) handleSyncResponse(topic string, data []byte) {
-	// Deserializar respuesta
-	var response SyncResponse
-	if err := json.Unmarshal(data, &response); err != nil {
-		fmt.Printf("Error al deserializar respuesta de sincronización: %v\n", err)
-		return
-	}
-
-	// Verificar si es una respuesta para este nodo
-	if response.NodeID == sm.node.Host.ID().String() {
-		return // Ignorar respuestas propias
-	}
-
-	// Verificar si la respuesta fue exitosa
-	if !response.Success {
-		fmt.Printf("Error en respuesta de sincronización: %s\n", response.ErrorMessage)
-		return
-	}
-
-	// Procesar documentos recibidos
-	for _, doc := range response.Documents {
-		// Verificar si el documento ya existe
-		existingDoc, err := sm.database.GetDocument(doc.ID)
-		if err == nil {
-			// El documento existe, verificar si es más reciente
-			if doc.UpdatedAt.After(existingDoc.UpdatedAt) {
-				// Actualizar documento
-				_, err := sm.database.UpdateDocument(doc.ID, doc.Data)
-				if err != nil {
-					fmt.Printf("Error al actualizar documento %s: %v\n", doc.ID, err)
-				}
-			} else {
-				// Detectar conflicto
-				sm.mutex.Lock()
-				sm.syncStats.ConflictsDetected++
-				sm.mutex.Unlock()
-
-				// Resolver conflicto (aquí se implementaría la estrategia de resolución)
-				// Por ahora, simplemente mantenemos el documento más reciente
-				sm.mutex.Lock()
-				sm.syncStats.ConflictsResolved++
-				sm.mutex.Unlock()
-			}
-		} else {
-			// El documento no existe, crearlo
-			_, err := sm.database.CreateDocument(doc.Collection, doc.Data)
-			if err != nil {
-				fmt.Printf("Error al crear documento %s: %v\n", doc.ID, err)
-			}
-		}
-	}
-
-	// Actualizar estadísticas
-	sm.mutex.Lock()
-	sm.syncStats.DocumentsReceived += response.DocumentsCount
-	sm.syncStats.BytesReceived += int64(len(data))
-	sm.mutex.Unlock()
-
-	// Si hay más documentos, solicitar el siguiente lote
-	if response.HasMoreDocuments && response.NextBatchToken != "" {
-		// Aquí se implementaría la solicitud del siguiente lote
+// policy devuelve la política de replicación de la base de datos junto con las
+// colecciones excluidas y prioritarias de la configuración de sincronización
+func (sm *SyncManager) policy() db.ReplicationPolicy {
+	policy := sm.database.ReplicationPolicy()
+	policy.Excluded = append(policy.Excluded, sm.config.ExcludedCollections...)
+	if len(sm.config.CollectionPriorities) > 0 {
+		policy.Priorities = sm.config.CollectionPriorities
 	}
+	return policy
 }
 
 // GetSyncStats obtiene las estadísticas de sincronización
 func (sm *SyncManager) GetSyncStats() SyncStats {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
-	return sm.syncStats
+
+	// Todas las fusiones con escrituras concurrentes quedan resueltas
+	stats := sm.syncStats
+	conflicts := int(sm.database.ConflictCount() - sm.conflictsBase)
+	stats.ConflictsDetected = conflicts
+	stats.ConflictsResolved = conflicts
+	stats.RejectedMessages = int(sm.database.RejectedCount() - sm.rejectedBase)
+	stats.OutboxDepth = sm.database.OutboxDepth()
+	return stats
 }
 
 // ResetSyncStats reinicia las estadísticas de sincronización
@@ -737,6 +444,8 @@ func (sm *SyncManager) ResetSyncStats() {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 	sm.syncStats = SyncStats{}
+	sm.conflictsBase = sm.database.ConflictCount()
+	sm.rejectedBase = sm.database.RejectedCount()
 }
 
 // generateRequestID genera un ID único para una solicitud
@@ -0,0 +1,476 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aratan/dbp2p/pkg/db"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// SyncProtocol protocolo de sincronización punto a punto. En un mismo stream el
+// nodo que sincroniza envía solicitudes y el otro responde a cada una con un
+// lote de documentos, hasta que no quedan más.
+const SyncProtocol = protocol.ID("/dbp2p/sync/1.0.0")
+
+// maxSyncFrameSize tamaño máximo de una trama del protocolo de sincronización
+const maxSyncFrameSize = 64 << 20
+
+// Codificación del contenido de una trama
+const (
+	frameJSON byte = 0
+	frameGzip byte = 1
+)
+
+// writeFrame escribe un mensaje con el formato de trama del protocolo: la longitud
+// en 4 bytes big-endian, un byte con la codificación y el JSON, comprimido con
+// gzip si se indica. Devuelve los bytes escritos.
+func writeFrame(w io.Writer, v any, compress bool, level int) (int, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, fmt.Errorf("error al serializar mensaje: %v", err)
+	}
+
+	encoding := frameJSON
+	if compress {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			zw = gzip.NewWriter(&buf)
+		}
+		if _, err := zw.Write(data); err != nil {
+			return 0, fmt.Errorf("error al comprimir mensaje: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return 0, fmt.Errorf("error al comprimir mensaje: %v", err)
+		}
+		data = buf.Bytes()
+		encoding = frameGzip
+	}
+	if len(data)+1 > maxSyncFrameSize {
+		return 0, fmt.Errorf("mensaje demasiado grande: %d bytes", len(data))
+	}
+
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)+1))
+	frame[4] = encoding
+	frame = append(frame, data...)
+
+	n, err := w.Write(frame)
+	if err != nil {
+		return n, fmt.Errorf("error al enviar mensaje: %v", err)
+	}
+	return n, nil
+}
+
+// readFrame lee una trama y deserializa su contenido en v. Devuelve los bytes
+// leídos; io.EOF si el otro nodo cerró el stream entre dos tramas.
+func readFrame(r io.Reader, v any) (int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxSyncFrameSize {
+		return 4, fmt.Errorf("tamaño de trama no válido: %d", size)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 4, fmt.Errorf("error al leer mensaje: %v", err)
+	}
+	n := 4 + int(size)
+
+	data := frame[1:]
+	switch frame[0] {
+	case frameJSON:
+	case frameGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return n, fmt.Errorf("error al descomprimir mensaje: %v", err)
+		}
+		data, err = io.ReadAll(io.LimitReader(zr, maxSyncFrameSize))
+		if err != nil {
+			return n, fmt.Errorf("error al descomprimir mensaje: %v", err)
+		}
+	default:
+		return n, fmt.Errorf("codificación de trama desconocida: %d", frame[0])
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return n, fmt.Errorf("error al deserializar mensaje: %v", err)
+	}
+	return n, nil
+}
+
+// syncCursor es la posición de una sincronización paginada: el último documento
+// enviado. Los documentos se recorren por colección, en orden de prioridad y
+// después alfabético, y dentro de cada colección por ID.
+type syncCursor struct {
+	Collection string `json:"c"`
+	ID         string `json:"i"`
+}
+
+// encodeSyncCursor convierte un cursor en un token de lote
+func encodeSyncCursor(cursor syncCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeSyncCursor convierte un token de lote en un cursor; un token vacío es el
+// principio del recorrido
+func decodeSyncCursor(token string) (syncCursor, error) {
+	var cursor syncCursor
+	if token == "" {
+		return cursor, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("token de lote no válido: %v", err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("token de lote no válido: %v", err)
+	}
+	return cursor, nil
+}
+
+// answerSyncRequest devuelve el lote de documentos que sigue al token de la
+// solicitud. Solo incluye los documentos que este nodo publica y que el otro
+// recibe según sus colecciones y filtros, sin las colecciones cifradas que no
+// puede leer. Las eliminaciones se envían con el primer lote.
+func (sm *SyncManager) answerSyncRequest(peerID string, request SyncRequest) (SyncResponse, error) {
+	response := SyncResponse{
+		NodeID:    sm.node.Host.ID().String(),
+		RequestID: request.RequestID,
+		Success:   true,
+		Timestamp: time.Now(),
+	}
+
+	cursor, err := decodeSyncCursor(request.BatchToken)
+	if err != nil {
+		return response, err
+	}
+
+	policy := sm.policy()
+	remote := db.ReplicationPolicy{Subscribe: request.Collections, Filters: request.Filters}
+	if err := remote.Validate(); err != nil {
+		return response, err
+	}
+	include := func(collection string) bool {
+		return policy.Publishes(collection) && remote.Subscribes(collection) &&
+			sm.database.CanRead(peerID, collection)
+	}
+
+	// Elegir las colecciones y los documentos según el tipo de solicitud
+	var collections []string
+	since := request.LastSyncTime
+	switch request.RequestType {
+	case "full":
+		since = time.Time{}
+		collections, err = sm.database.GetCollections()
+	case "incremental":
+		collections, err = sm.database.GetCollections()
+	case "collection":
+		if !include(request.Collection) {
+			return response, fmt.Errorf("colección no replicada: %s", request.Collection)
+		}
+		collections = []string{request.Collection}
+	default:
+		return response, fmt.Errorf("tipo de solicitud desconocido: %s", request.RequestType)
+	}
+	if err != nil {
+		return response, fmt.Errorf("error al obtener colecciones: %v", err)
+	}
+	collections = slices.DeleteFunc(collections, func(collection string) bool {
+		return !include(collection)
+	})
+	slices.SortFunc(collections, policy.CompareCollections)
+
+	batchSize := request.BatchSize
+	if batchSize <= 0 || batchSize > sm.config.BatchSize {
+		batchSize = sm.config.BatchSize
+	}
+
+	// Recorrer las colecciones a partir del cursor hasta llenar el lote
+	for _, collection := range collections {
+		if cursor.Collection != "" && policy.CompareCollections(collection, cursor.Collection) < 0 {
+			continue
+		}
+
+		docs, err := sm.database.GetAllDocuments(collection)
+		if err != nil {
+			return response, fmt.Errorf("error al obtener documentos de la colección %s: %v", collection, err)
+		}
+		slices.SortFunc(docs, func(a, b *db.Document) int {
+			return strings.Compare(a.ID, b.ID)
+		})
+
+		for _, doc := range docs {
+			if collection == cursor.Collection && doc.ID <= cursor.ID {
+				continue
+			}
+			if !doc.UpdatedAt.After(since) || !policy.Matches(doc) || !remote.Matches(doc) {
+				continue
+			}
+			if len(response.Documents) == batchSize {
+				response.HasMoreDocuments = true
+				break
+			}
+			response.Documents = append(response.Documents, *doc)
+		}
+		if response.HasMoreDocuments {
+			break
+		}
+	}
+
+	response.DocumentsCount = len(response.Documents)
+	if response.HasMoreDocuments {
+		last := response.Documents[len(response.Documents)-1]
+		response.NextBatchToken = encodeSyncCursor(syncCursor{Collection: last.Collection, ID: last.ID})
+	}
+
+	if request.IncludeDeleted && request.BatchToken == "" {
+		response.Tombstones = sm.tombstonesSince(since, func(collection string) bool {
+			if request.RequestType == "collection" && collection != request.Collection {
+				return false
+			}
+			return include(collection)
+		})
+	}
+
+	return response, nil
+}
+
+// handleSyncStream responde a las solicitudes de sincronización que llegan por
+// un stream hasta que el otro nodo lo cierra
+func (sm *SyncManager) handleSyncStream(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer().String()
+	sm.database.AddPeer(remote)
+
+	for {
+		stream.SetDeadline(time.Now().Add(sm.config.ResponseTimeout))
+
+		var request SyncRequest
+		received, err := readFrame(stream, &request)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				stream.Reset()
+				fmt.Printf("Error al leer solicitud de sincronización de %s: %v\n", remote, err)
+			}
+			return
+		}
+
+		// Anotar las eliminaciones que confirma el nodo, si la ACL lo conoce
+		if len(request.Acks) > 0 && !sm.database.KnowsPeer(remote) {
+			sm.database.RejectReplication(remote, "nodo no autorizado")
+		} else {
+			sm.database.AcknowledgeTombstones(remote, request.Acks)
+		}
+
+		response, err := sm.answerSyncRequest(remote, request)
+		if err != nil {
+			response = SyncResponse{
+				NodeID:       sm.node.Host.ID().String(),
+				RequestID:    request.RequestID,
+				Success:      false,
+				ErrorMessage: err.Error(),
+				Timestamp:    time.Now(),
+			}
+		}
+
+		level := request.CompressionLevel
+		if level == 0 {
+			level = sm.config.CompressionLevel
+		}
+		response.Compressed = request.UseCompression
+		sent, err := writeFrame(stream, response, response.Compressed, level)
+
+		// Actualizar estadísticas
+		sm.mutex.Lock()
+		sm.syncStats.BytesReceived += int64(received)
+		sm.syncStats.BytesSent += int64(sent)
+		if err == nil {
+			sm.syncStats.DocumentsSent += response.DocumentsCount
+		}
+		sm.mutex.Unlock()
+
+		if err != nil {
+			stream.Reset()
+			fmt.Printf("Error al enviar respuesta de sincronización a %s: %v\n", remote, err)
+			return
+		}
+	}
+}
+
+// requestSync sincroniza con un peer pidiendo lotes hasta recibir todos los
+// documentos de la solicitud. Si el stream falla, lo reintenta hasta MaxRetries
+// veces continuando desde el último lote recibido. Devuelve la hora del peer al
+// responder el primer lote, que sirve de punto de partida para la siguiente
+// sincronización incremental.
+func (sm *SyncManager) requestSync(ctx context.Context, pid peer.ID, request SyncRequest) (time.Time, error) {
+	attempts := max(sm.config.MaxRetries, 1)
+
+	var started time.Time
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			fmt.Printf("Reintentando sincronización con %s (%d/%d): %v\n", pid.String(), attempt, attempts, err)
+			select {
+			case <-time.After(time.Duration(attempt-1) * time.Second):
+			case <-ctx.Done():
+				return started, ctx.Err()
+			}
+		}
+
+		var done bool
+		done, err = sm.syncSession(ctx, pid, &request, &started)
+		if err == nil || done {
+			return started, err
+		}
+	}
+	return started, err
+}
+
+// syncSession pide lotes por un stream nuevo, avanzando el token de la solicitud
+// con cada lote aplicado. Devuelve done si el error no se soluciona reintentando.
+func (sm *SyncManager) syncSession(ctx context.Context, pid peer.ID, request *SyncRequest, started *time.Time) (bool, error) {
+	stream, err := sm.node.Host.NewStream(ctx, pid, SyncProtocol)
+	if err != nil {
+		return false, fmt.Errorf("error al abrir stream: %v", err)
+	}
+	defer stream.Close()
+
+	for {
+		// Las eliminaciones pendientes de confirmar viajan en cada solicitud hasta
+		// que el peer responde
+		request.Acks = sm.pendingAcksFor(pid)
+		request.RequestID = generateRequestID()
+		request.Timestamp = time.Now()
+
+		stream.SetDeadline(time.Now().Add(sm.config.ResponseTimeout))
+		sent, err := writeFrame(stream, request, sm.config.UseCompression, sm.config.CompressionLevel)
+		sm.mutex.Lock()
+		sm.syncStats.BytesSent += int64(sent)
+		sm.mutex.Unlock()
+		if err != nil {
+			stream.Reset()
+			return false, err
+		}
+
+		var response SyncResponse
+		received, err := readFrame(stream, &response)
+		sm.mutex.Lock()
+		sm.syncStats.BytesReceived += int64(received)
+		sm.mutex.Unlock()
+		if err != nil {
+			stream.Reset()
+			return false, fmt.Errorf("error al leer respuesta: %v", err)
+		}
+		if !response.Success {
+			return true, errors.New(response.ErrorMessage)
+		}
+
+		sm.clearPendingAcks(pid, len(request.Acks))
+		if started.IsZero() {
+			*started = response.Timestamp
+		}
+		sm.applySyncResponse(pid, response)
+
+		if !response.HasMoreDocuments {
+			return true, nil
+		}
+		if response.NextBatchToken == "" {
+			return true, errors.New("respuesta con más documentos sin token de lote")
+		}
+		request.BatchToken = response.NextBatchToken
+	}
+}
+
+// applySyncResponse aplica un lote recibido de un peer
+func (sm *SyncManager) applySyncResponse(pid peer.ID, response SyncResponse) {
+	from := pid.String()
+	sm.database.AddPeer(from)
+
+	// Fusionar los documentos recibidos con las versiones locales; los conflictos
+	// se resuelven campo a campo y se cuentan en la base de datos. Las lápidas
+	// impiden resucitar documentos eliminados después de la versión recibida. Lo
+	// que la ACL no permite escribir al peer se descarta.
+	policy := sm.policy()
+	received := 0
+	for i := range response.Documents {
+		doc := &response.Documents[i]
+		if !policy.Accepts(doc) {
+			continue
+		}
+		if !sm.database.AllowsDocument(from, doc) {
+			sm.database.RejectReplication(from, fmt.Sprintf("sin permiso para escribir en %s", doc.Collection))
+			continue
+		}
+		if _, err := sm.database.ApplyRemoteDocument(doc); err != nil {
+			fmt.Printf("Error al aplicar documento %s: %v\n", doc.ID, err)
+			continue
+		}
+		received++
+	}
+
+	// Aplicar las eliminaciones y confirmarlas en la siguiente solicitud
+	acks := make([]db.TombstoneAck, 0, len(response.Tombstones))
+	for i := range response.Tombstones {
+		tombstone := &response.Tombstones[i]
+		if !policy.Subscribes(tombstone.Collection) {
+			continue
+		}
+		if !sm.database.AllowsReplication(from, db.OperationDelete, tombstone.Collection) {
+			sm.database.RejectReplication(from, fmt.Sprintf("sin permiso para eliminar en %s", tombstone.Collection))
+			continue
+		}
+		if _, err := sm.database.ApplyRemoteDelete(tombstone, from); err != nil {
+			fmt.Printf("Error al aplicar eliminación %s: %v\n", tombstone.ID, err)
+			continue
+		}
+		acks = append(acks, tombstone.Ack())
+	}
+
+	// Actualizar estadísticas
+	sm.mutex.Lock()
+	sm.syncStats.DocumentsReceived += received
+	sm.pendingAcks[pid] = append(sm.pendingAcks[pid], acks...)
+	sm.mutex.Unlock()
+}
+
+// pendingAcksFor devuelve las confirmaciones pendientes para un peer
+func (sm *SyncManager) pendingAcksFor(pid peer.ID) []db.TombstoneAck {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	return slices.Clone(sm.pendingAcks[pid])
+}
+
+// clearPendingAcks descarta las n primeras confirmaciones pendientes para un
+// peer, que ya ha recibido
+func (sm *SyncManager) clearPendingAcks(pid peer.ID, n int) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	acks := sm.pendingAcks[pid]
+	if n >= len(acks) {
+		delete(sm.pendingAcks, pid)
+		return
+	}
+	sm.pendingAcks[pid] = acks[n:]
+}
@@ -0,0 +1,99 @@
+package raft
+
+import "slices"
+
+// Suffrage indica si un servidor vota en las elecciones y cuenta para el quórum
+type Suffrage string
+
+const (
+	// Voter vota y cuenta para confirmar las entradas
+	Voter Suffrage = "voter"
+	// Learner recibe el log pero no vota; sirve para poner al día un servidor
+	// antes de convertirlo en votante
+	Learner Suffrage = "learner"
+)
+
+// Server es un miembro del grupo
+type Server struct {
+	ID       string   `json:"id"`
+	Suffrage Suffrage `json:"suffrage"`
+}
+
+// Configuration son los miembros del grupo. Cambia con entradas del log, de un
+// servidor en cada cambio.
+type Configuration struct {
+	Servers []Server `json:"servers"`
+}
+
+// Voters devuelve los IDs de los servidores que votan
+func (c Configuration) Voters() []string {
+	var voters []string
+	for _, server := range c.Servers {
+		if server.Suffrage == Voter {
+			voters = append(voters, server.ID)
+		}
+	}
+	return voters
+}
+
+// IsVoter indica si un servidor vota en el grupo
+func (c Configuration) IsVoter(id string) bool {
+	for _, server := range c.Servers {
+		if server.ID == id {
+			return server.Suffrage == Voter
+		}
+	}
+	return false
+}
+
+// Contains indica si un servidor pertenece al grupo
+func (c Configuration) Contains(id string) bool {
+	return slices.ContainsFunc(c.Servers, func(server Server) bool {
+		return server.ID == id
+	})
+}
+
+// Quorum devuelve cuántos votantes hacen mayoría
+func (c Configuration) Quorum() int {
+	return len(c.Voters())/2 + 1
+}
+
+// with devuelve una copia de la configuración con el servidor añadido o con su
+// voto cambiado
+func (c Configuration) with(server Server) Configuration {
+	next := Configuration{Servers: make([]Server, 0, len(c.Servers)+1)}
+	found := false
+	for _, existing := range c.Servers {
+		if existing.ID == server.ID {
+			existing = server
+			found = true
+		}
+		next.Servers = append(next.Servers, existing)
+	}
+	if !found {
+		next.Servers = append(next.Servers, server)
+	}
+	return next
+}
+
+// without devuelve una copia de la configuración sin el servidor
+func (c Configuration) without(id string) Configuration {
+	next := Configuration{Servers: make([]Server, 0, len(c.Servers))}
+	for _, existing := range c.Servers {
+		if existing.ID != id {
+			next.Servers = append(next.Servers, existing)
+		}
+	}
+	return next
+}
+
+// clone devuelve una copia independiente de la configuración
+func (c Configuration) clone() Configuration {
+	return Configuration{Servers: slices.Clone(c.Servers)}
+}
+
+// configChange es un cambio de miembros pedido al líder
+type configChange struct {
+	Remove bool   `json:"remove,omitempty"`
+	Server Server `json:"server"`
+}
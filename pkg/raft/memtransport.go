@@ -0,0 +1,187 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ErrUnreachable indica que el servidor de destino no es alcanzable en la red
+// simulada
+var ErrUnreachable = errors.New("servidor inalcanzable")
+
+// MemNetwork es una red simulada en memoria para ejecutar un grupo en un solo
+// proceso. Permite desconectar servidores y partir la red para probar la
+// elección de líder y las particiones.
+type MemNetwork struct {
+	handlers     map[string]Handler
+	disconnected map[string]bool
+	groups       map[string]int // Partición de cada servidor; sin particiones está vacío
+	mutex        sync.RWMutex
+}
+
+// NewMemNetwork crea una red simulada vacía
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+		groups:       make(map[string]int),
+	}
+}
+
+// Transport devuelve el transporte de un servidor de la red
+func (net *MemNetwork) Transport(id string) Transport {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	if _, exists := net.handlers[id]; !exists {
+		net.handlers[id] = nil
+	}
+	return &memTransport{net: net, id: id}
+}
+
+// Disconnect aísla un servidor del resto
+func (net *MemNetwork) Disconnect(id string) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	net.disconnected[id] = true
+}
+
+// Reconnect vuelve a conectar un servidor aislado
+func (net *MemNetwork) Reconnect(id string) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	delete(net.disconnected, id)
+}
+
+// Partition parte la red en grupos que solo se comunican entre sí. Los
+// servidores que no aparecen en ningún grupo quedan en uno propio.
+func (net *MemNetwork) Partition(groups ...[]string) {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	net.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			net.groups[id] = i + 1
+		}
+	}
+	for id := range net.handlers {
+		if _, exists := net.groups[id]; !exists {
+			net.groups[id] = -1
+		}
+	}
+}
+
+// Heal elimina las particiones y reconecta todos los servidores
+func (net *MemNetwork) Heal() {
+	net.mutex.Lock()
+	defer net.mutex.Unlock()
+
+	net.groups = make(map[string]int)
+	net.disconnected = make(map[string]bool)
+}
+
+// reachable indica si dos servidores se comunican. Debe llamarse con el mutex
+// bloqueado.
+func (net *MemNetwork) reachable(from, to string) bool {
+	if net.disconnected[from] || net.disconnected[to] {
+		return false
+	}
+	if len(net.groups) == 0 {
+		return true
+	}
+	group, exists := net.groups[from]
+	if !exists || group < 0 {
+		return false
+	}
+	return net.groups[to] == group
+}
+
+// memTransport es el transporte de un servidor en la red simulada. Los
+// mensajes se copian serializándolos, igual que en una red real.
+type memTransport struct {
+	net *MemNetwork
+	id  string
+}
+
+// Call entrega un mensaje al servidor de destino y devuelve su respuesta
+func (t *memTransport) Call(ctx context.Context, target string, msg *Message) (*Message, error) {
+	t.net.mutex.RLock()
+	handler := t.net.handlers[target]
+	reachable := t.net.reachable(t.id, target)
+	t.net.mutex.RUnlock()
+	if handler == nil || !reachable {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, target)
+	}
+
+	request, err := copyMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan *Message, 1)
+	go func() {
+		done <- handler(ctx, t.id, request)
+	}()
+
+	var response *Message
+	select {
+	case response = <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// La partición puede haberse producido mientras se atendía la petición
+	t.net.mutex.RLock()
+	reachable = t.net.reachable(target, t.id)
+	t.net.mutex.RUnlock()
+	if !reachable {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, target)
+	}
+	if response == nil {
+		return nil, fmt.Errorf("el servidor %s no respondió", target)
+	}
+	return copyMessage(response)
+}
+
+// SetHandler registra la función que atiende los mensajes del servidor
+func (t *memTransport) SetHandler(handler Handler) {
+	t.net.mutex.Lock()
+	defer t.net.mutex.Unlock()
+
+	t.net.handlers[t.id] = handler
+}
+
+// Peers devuelve los servidores alcanzables desde este
+func (t *memTransport) Peers() []string {
+	t.net.mutex.RLock()
+	defer t.net.mutex.RUnlock()
+
+	var peers []string
+	for id, handler := range t.net.handlers {
+		if id != t.id && handler != nil && t.net.reachable(t.id, id) {
+			peers = append(peers, id)
+		}
+	}
+	slices.Sort(peers)
+	return peers
+}
+
+// copyMessage devuelve una copia independiente de un mensaje
+func copyMessage(msg *Message) (*Message, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("error al serializar mensaje: %v", err)
+	}
+	var copied Message
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, fmt.Errorf("error al deserializar mensaje: %v", err)
+	}
+	return &copied, nil
+}
@@ -0,0 +1,1585 @@
+// Package raft implementa el algoritmo de consenso Raft: elección de líder,
+// replicación del log, instantáneas y cambios de miembros de un servidor cada
+// vez. El transporte y el almacenamiento se inyectan, de modo que el mismo
+// grupo funciona sobre libp2p o sobre una red simulada en memoria.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader indica que el servidor no es el líder y no reenvía la petición
+	ErrNotLeader = errors.New("el servidor no es el líder del grupo")
+	// ErrNoLeader indica que no se encuentra un líder al que enviar la petición
+	ErrNoLeader = errors.New("no se encuentra el líder del grupo")
+	// ErrLeadershipLost indica que el líder cambió antes de aplicar la entrada;
+	// la entrada puede haberse confirmado o no
+	ErrLeadershipLost = errors.New("el líder cambió antes de confirmar la entrada")
+	// ErrStopped indica que el servidor está detenido
+	ErrStopped = errors.New("el servidor de consenso está detenido")
+	// ErrConfigChangePending indica que hay un cambio de miembros sin confirmar
+	ErrConfigChangePending = errors.New("hay un cambio de miembros pendiente de confirmar")
+	// ErrNotMember indica que el servidor no pertenece al grupo y no tiene su
+	// estado para servir lecturas
+	ErrNotMember = errors.New("el servidor no pertenece al grupo de consenso")
+	// ErrAlreadyBootstrapped indica que el servidor ya tiene estado y no se
+	// puede inicializar el grupo
+	ErrAlreadyBootstrapped = errors.New("el grupo de consenso ya está inicializado")
+	// ErrLeaderOnly indica que la operación solo se atiende en el líder, que no
+	// la acepta reenviada
+	ErrLeaderOnly = errors.New("la operación solo se atiende en el líder")
+)
+
+// State es el papel de un servidor en el grupo
+type State string
+
+const (
+	Follower  State = "follower"
+	Candidate State = "candidate"
+	Leader    State = "leader"
+)
+
+// EntryType es el tipo de una entrada del log
+type EntryType uint8
+
+const (
+	// EntryCommand es un comando para la máquina de estados
+	EntryCommand EntryType = iota
+	// EntryNoop la añade cada líder al ser elegido para confirmar las entradas
+	// de mandatos anteriores
+	EntryNoop
+	// EntryConfiguration contiene la nueva configuración de miembros
+	EntryConfiguration
+)
+
+// Entry es una entrada del log
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// StateMachine es el estado replicado por el grupo. Todas las llamadas se hacen
+// desde una sola goroutine y en el orden del log.
+type StateMachine interface {
+	// Apply aplica un comando confirmado y devuelve el resultado para quien lo
+	// propuso. Debe ser determinista.
+	Apply(index uint64, data []byte) []byte
+	// Snapshot devuelve el estado completo, para compactar el log
+	Snapshot() ([]byte, error)
+	// Restore reemplaza el estado por el de una instantánea
+	Restore(data []byte) error
+}
+
+// Config son los tiempos y límites de un servidor
+type Config struct {
+	ElectionTimeout   time.Duration // Tiempo sin noticias del líder antes de convocar elecciones
+	HeartbeatInterval time.Duration // Intervalo de los latidos del líder
+	SnapshotThreshold uint64        // Entradas aplicadas tras las que se compacta el log; 0 no compacta
+	MaxAppendEntries  int           // Entradas por mensaje de replicación
+	RPCTimeout        time.Duration // Tiempo máximo de una petición a otro servidor
+
+	// AuthorizeForward decide si el líder acepta un comando reenviado por otro
+	// servidor; nil los acepta todos
+	AuthorizeForward func(from string, data []byte) error
+}
+
+// DefaultConfig es la configuración por defecto de un servidor
+var DefaultConfig = Config{
+	ElectionTimeout:   time.Second,
+	HeartbeatInterval: 100 * time.Millisecond,
+	SnapshotThreshold: 1024,
+	MaxAppendEntries:  64,
+	RPCTimeout:        2 * time.Second,
+}
+
+// withDefaults completa los valores no indicados con los de DefaultConfig
+func (c Config) withDefaults() Config {
+	if c.ElectionTimeout <= 0 {
+		c.ElectionTimeout = DefaultConfig.ElectionTimeout
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = DefaultConfig.HeartbeatInterval
+	}
+	if c.MaxAppendEntries <= 0 {
+		c.MaxAppendEntries = DefaultConfig.MaxAppendEntries
+	}
+	if c.RPCTimeout <= 0 {
+		c.RPCTimeout = DefaultConfig.RPCTimeout
+	}
+	return c
+}
+
+// Status es el estado de un servidor, para diagnóstico
+type Status struct {
+	ID            string            `json:"id"`
+	State         State             `json:"state"`
+	Term          uint64            `json:"term"`
+	Leader        string            `json:"leader,omitempty"`
+	CommitIndex   uint64            `json:"commit_index"`
+	AppliedIndex  uint64            `json:"applied_index"`
+	LastIndex     uint64            `json:"last_index"`
+	SnapshotIndex uint64            `json:"snapshot_index"`
+	Configuration Configuration     `json:"configuration"`
+	Replication   map[string]uint64 `json:"replication,omitempty"` // Última entrada replicada en cada servidor, solo en el líder
+}
+
+// progress es el estado de la replicación hacia un servidor, en el líder
+type progress struct {
+	next     uint64    // Siguiente entrada que se le enviará
+	match    uint64    // Última entrada que se sabe replicada
+	inflight bool      // Hay una petición sin respuesta
+	acked    time.Time // Envío de la última petición respondida en el mandato
+}
+
+// proposalResult es el resultado de aplicar una entrada propuesta
+type proposalResult struct {
+	data []byte
+	err  error
+}
+
+// waiter espera a que se aplique una entrada propuesta en un mandato
+type waiter struct {
+	term uint64
+	done chan proposalResult
+}
+
+// Node es un servidor del grupo
+type Node struct {
+	id        string
+	config    Config
+	fsm       StateMachine
+	storage   Storage
+	transport Transport
+
+	state            State
+	term             uint64
+	vote             string
+	leader           string
+	leaderContact    time.Time // Último contacto con el líder; en el líder, última vez que tuvo quórum
+	electionDeadline time.Time
+	votes            map[string]bool // Votos recibidos como candidato
+
+	entries       []Entry   // Entradas posteriores a la instantánea
+	snapshot      *Snapshot // Última instantánea, nil si no hay
+	snapshotIndex uint64
+	snapshotTerm  uint64
+
+	configuration      Configuration // Última configuración del log, confirmada o no
+	configurationIndex uint64
+
+	commitIndex uint64
+	lastApplied uint64
+
+	// Solo en el líder
+	progress     map[string]*progress
+	leaderSince  time.Time
+	heartbeatDue time.Time
+	readRound    time.Time // Ronda de latidos más reciente pedida por una lectura
+
+	waiters map[uint64]*waiter
+	changed chan struct{} // Se cierra y se reemplaza con cada cambio de estado
+	applyCh chan struct{}
+
+	started bool
+	stopped bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mutex      sync.Mutex
+	applyMutex sync.Mutex // Serializa las llamadas a la máquina de estados
+}
+
+// NewNode crea un servidor con el estado guardado en storage. Si hay una
+// instantánea se restaura en la máquina de estados.
+func NewNode(id string, fsm StateMachine, storage Storage, transport Transport, config Config) (*Node, error) {
+	state, err := storage.HardState()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := storage.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := storage.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		id:        id,
+		config:    config.withDefaults(),
+		fsm:       fsm,
+		storage:   storage,
+		transport: transport,
+		state:     Follower,
+		term:      state.Term,
+		vote:      state.Vote,
+		waiters:   make(map[uint64]*waiter),
+		changed:   make(chan struct{}),
+		applyCh:   make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	if snapshot != nil {
+		if err := fsm.Restore(snapshot.Data); err != nil {
+			cancel()
+			return nil, fmt.Errorf("error al restaurar instantánea de consenso: %v", err)
+		}
+		n.snapshot = snapshot
+		n.snapshotIndex = snapshot.Index
+		n.snapshotTerm = snapshot.Term
+		n.commitIndex = snapshot.Index
+		n.lastApplied = snapshot.Index
+	}
+
+	// Un fallo entre guardar la instantánea y reescribir el log deja entradas que
+	// ya cubre la instantánea
+	n.entries = compactEntries(entries, n.snapshotIndex)
+	n.refreshConfigurationLocked()
+	return n, nil
+}
+
+// Bootstrap inicializa un grupo nuevo con los servidores indicados. Todos los
+// servidores iniciales deben llamarlo con la misma lista; los que se añadan
+// después no deben llamarlo. Falla con ErrAlreadyBootstrapped si el servidor
+// ya tiene estado.
+func (n *Node) Bootstrap(servers []Server) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.term != 0 || n.lastIndexLocked() != 0 {
+		return ErrAlreadyBootstrapped
+	}
+
+	data, err := json.Marshal(Configuration{Servers: slices.Clone(servers)})
+	if err != nil {
+		return fmt.Errorf("error al serializar configuración: %v", err)
+	}
+	entry := Entry{Index: 1, Term: 1, Type: EntryConfiguration, Data: data}
+	if err := n.storage.Append([]Entry{entry}); err != nil {
+		return err
+	}
+	n.entries = append(n.entries, entry)
+	n.term = 1
+	if err := n.storage.SetHardState(HardState{Term: n.term}); err != nil {
+		return err
+	}
+	n.refreshConfigurationLocked()
+	return nil
+}
+
+// Start empieza a atender mensajes, a contar el tiempo de elección y a aplicar
+// las entradas confirmadas
+func (n *Node) Start() {
+	n.mutex.Lock()
+	if n.started || n.stopped {
+		n.mutex.Unlock()
+		return
+	}
+	n.started = true
+	n.resetElectionLocked()
+	n.mutex.Unlock()
+
+	n.transport.SetHandler(n.handle)
+
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	n.signalApply()
+}
+
+// Stop detiene el servidor. Las propuestas pendientes fallan con ErrStopped.
+func (n *Node) Stop() {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return
+	}
+	n.stopped = true
+	n.state = Follower
+	n.progress = nil
+	n.cancel()
+	for index, w := range n.waiters {
+		w.done <- proposalResult{err: ErrStopped}
+		delete(n.waiters, index)
+	}
+	n.notifyLocked()
+	n.mutex.Unlock()
+
+	n.wg.Wait()
+}
+
+// ID devuelve el ID del servidor
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader devuelve el ID del líder conocido, o una cadena vacía
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.leader
+}
+
+// IsLeader indica si el servidor es el líder
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.state == Leader
+}
+
+// Configuration devuelve la última configuración de miembros conocida
+func (n *Node) Configuration() Configuration {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.configuration.clone()
+}
+
+// IsMember indica si el servidor pertenece al grupo según su última configuración
+func (n *Node) IsMember() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.configuration.Contains(n.id)
+}
+
+// Status devuelve el estado del servidor
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	status := Status{
+		ID:            n.id,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		LastIndex:     n.lastIndexLocked(),
+		SnapshotIndex: n.snapshotIndex,
+		Configuration: n.configuration.clone(),
+	}
+	if n.state == Leader {
+		status.Replication = map[string]uint64{n.id: status.LastIndex}
+		for id, p := range n.progress {
+			status.Replication[id] = p.match
+		}
+	}
+	return status
+}
+
+// Apply propone un comando y espera a que se aplique, devolviendo el resultado
+// de la máquina de estados. En un servidor que no es el líder la propuesta se
+// reenvía al líder. Mientras no haya líder se reintenta hasta que venza ctx.
+func (n *Node) Apply(ctx context.Context, data []byte) ([]byte, error) {
+	var result []byte
+	err := n.retry(ctx, func() error {
+		var err error
+		result, err = n.propose(ctx, EntryCommand, data, true)
+		return err
+	})
+	return result, err
+}
+
+// Barrier espera a que el servidor haya aplicado todas las entradas confirmadas
+// cuando se llamó, con el líder confirmando que sigue siéndolo. Una lectura del
+// estado local después de Barrier es linealizable. Un servidor que no pertenece
+// al grupo no aplica el log y falla con ErrNotMember.
+func (n *Node) Barrier(ctx context.Context) error {
+	if !n.IsMember() {
+		return ErrNotMember
+	}
+
+	var index uint64
+	err := n.retry(ctx, func() error {
+		var err error
+		index, err = n.readIndex(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return n.waitFor(ctx, func() (bool, error) {
+		return n.lastApplied >= index, nil
+	})
+}
+
+// AddVoter añade un servidor con voto, o da voto a un servidor sin él
+func (n *Node) AddVoter(ctx context.Context, id string) error {
+	return n.changeConfiguration(ctx, configChange{Server: Server{ID: id, Suffrage: Voter}})
+}
+
+// AddLearner añade un servidor sin voto, o quita el voto a un servidor
+func (n *Node) AddLearner(ctx context.Context, id string) error {
+	return n.changeConfiguration(ctx, configChange{Server: Server{ID: id, Suffrage: Learner}})
+}
+
+// RemoveServer quita un servidor del grupo. Si es el líder, deja de serlo al
+// confirmarse el cambio.
+func (n *Node) RemoveServer(ctx context.Context, id string) error {
+	return n.changeConfiguration(ctx, configChange{Remove: true, Server: Server{ID: id}})
+}
+
+// changeConfiguration propone un cambio de miembros y espera a que se aplique.
+// Los cambios de miembros no se reenvían: en un servidor que no es el líder
+// falla con ErrLeaderOnly indicando el líder.
+func (n *Node) changeConfiguration(ctx context.Context, change configChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("error al serializar cambio de miembros: %v", err)
+	}
+	return n.retry(ctx, func() error {
+		_, err := n.propose(ctx, EntryConfiguration, data, false)
+		if errors.Is(err, ErrNotLeader) {
+			leader := n.Leader()
+			if leader == "" {
+				return ErrNoLeader
+			}
+			return fmt.Errorf("%w: el líder es %s", ErrLeaderOnly, leader)
+		}
+		return err
+	})
+}
+
+// retry repite una operación mientras el grupo no tenga líder, hasta que venza ctx
+func (n *Node) retry(ctx context.Context, operation func() error) error {
+	for {
+		err := operation()
+		if !errors.Is(err, ErrNoLeader) && !errors.Is(err, ErrNotLeader) {
+			return err
+		}
+
+		select {
+		case <-time.After(n.config.HeartbeatInterval):
+		case <-ctx.Done():
+			return err
+		case <-n.ctx.Done():
+			return ErrStopped
+		}
+	}
+}
+
+// propose añade una entrada al log si el servidor es el líder y espera a que se
+// aplique. Si no lo es, la reenvía al líder cuando forward es true y si no
+// devuelve ErrNotLeader.
+func (n *Node) propose(ctx context.Context, entryType EntryType, data []byte, forward bool) ([]byte, error) {
+	if entryType == EntryConfiguration {
+		// Un líder nuevo no cambia los miembros hasta confirmar una entrada de su mandato
+		err := n.waitFor(ctx, func() (bool, error) {
+			return n.state != Leader || n.termAtLocked(n.commitIndex) == n.term, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return nil, ErrStopped
+	}
+	if n.state != Leader {
+		n.mutex.Unlock()
+		if !forward {
+			return nil, ErrNotLeader
+		}
+		return n.forward(ctx, entryType, data)
+	}
+	w, err := n.proposeLocked(entryType, data)
+	n.mutex.Unlock()
+	if err != nil || w == nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-w.done:
+		return result.data, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.ctx.Done():
+		return nil, ErrStopped
+	}
+}
+
+// proposeLocked añade una entrada al log del líder y registra quién espera su
+// resultado. Un cambio de miembros que no cambia nada no añade entrada y
+// devuelve un waiter nil. Debe llamarse con el mutex bloqueado.
+func (n *Node) proposeLocked(entryType EntryType, data []byte) (*waiter, error) {
+	if entryType == EntryConfiguration {
+		var change configChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			return nil, fmt.Errorf("cambio de miembros no válido: %v", err)
+		}
+		if n.configurationIndex > n.commitIndex {
+			return nil, ErrConfigChangePending
+		}
+
+		next := n.configuration.with(change.Server)
+		if change.Remove {
+			next = n.configuration.without(change.Server.ID)
+		}
+		if reflect.DeepEqual(next, n.configuration) {
+			return nil, nil
+		}
+		encoded, err := json.Marshal(next)
+		if err != nil {
+			return nil, fmt.Errorf("error al serializar configuración: %v", err)
+		}
+		data = encoded
+	}
+
+	entry, err := n.appendLocked(entryType, data)
+	if err != nil {
+		return nil, err
+	}
+	w := &waiter{term: entry.Term, done: make(chan proposalResult, 1)}
+	n.waiters[entry.Index] = w
+	n.broadcastLocked()
+	return w, nil
+}
+
+// forward reenvía una propuesta al líder
+func (n *Node) forward(ctx context.Context, entryType EntryType, data []byte) ([]byte, error) {
+	resp, err := n.callLeader(ctx, &Message{Type: MessageForward, EntryType: entryType, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, remoteError(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// readIndex devuelve el índice de confirmación del líder tras comprobar que
+// sigue siéndolo
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	n.mutex.Lock()
+	if n.stopped {
+		n.mutex.Unlock()
+		return 0, ErrStopped
+	}
+	if n.state == Leader {
+		n.mutex.Unlock()
+		return n.leaderReadIndex(ctx)
+	}
+	n.mutex.Unlock()
+
+	resp, err := n.callLeader(ctx, &Message{Type: MessageReadIndex})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Error != "" {
+		return 0, remoteError(resp.Error)
+	}
+	return resp.Index, nil
+}
+
+// leaderReadIndex toma el índice de confirmación del líder y espera a que una
+// mayoría responda a latidos enviados después, lo que demuestra que ningún otro
+// líder ha podido confirmar entradas posteriores
+func (n *Node) leaderReadIndex(ctx context.Context) (uint64, error) {
+	// El índice de confirmación solo es completo cuando el líder ha confirmado
+	// una entrada de su mandato
+	err := n.waitFor(ctx, func() (bool, error) {
+		if n.state != Leader {
+			return false, ErrNotLeader
+		}
+		return n.termAtLocked(n.commitIndex) == n.term, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return 0, ErrNotLeader
+	}
+	index, term, round := n.commitIndex, n.term, time.Now()
+	if n.hasQuorumLocked(map[string]bool{n.id: true}) {
+		n.mutex.Unlock()
+		return index, nil
+	}
+	n.readRound = round
+	n.broadcastLocked()
+	n.mutex.Unlock()
+
+	err = n.waitFor(ctx, func() (bool, error) {
+		if n.state != Leader || n.term != term {
+			return false, ErrNotLeader
+		}
+		acked := map[string]bool{n.id: true}
+		for id, p := range n.progress {
+			if !p.acked.Before(round) {
+				acked[id] = true
+			}
+		}
+		return n.hasQuorumLocked(acked), nil
+	})
+	return index, err
+}
+
+// callLeader envía un mensaje al líder. Empieza por el líder conocido y sigue
+// las indicaciones de los servidores que no lo son; un servidor fuera del grupo
+// lo busca entre los servidores alcanzables.
+func (n *Node) callLeader(ctx context.Context, msg *Message) (*Message, error) {
+	n.mutex.Lock()
+	hint := n.leader
+	var candidates []string
+	for _, server := range n.configuration.Servers {
+		candidates = append(candidates, server.ID)
+	}
+	n.mutex.Unlock()
+	candidates = append(candidates, n.transport.Peers()...)
+
+	tried := map[string]bool{n.id: true}
+	for {
+		target := ""
+		if hint != "" && !tried[hint] {
+			target = hint
+		} else {
+			for _, candidate := range candidates {
+				if !tried[candidate] {
+					target = candidate
+					break
+				}
+			}
+		}
+		if target == "" {
+			return nil, ErrNoLeader
+		}
+		tried[target] = true
+
+		resp, err := n.transport.Call(ctx, target, msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			hint = ""
+			continue
+		}
+		if resp.NotLeader {
+			hint = resp.Leader
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// waitFor espera a que cond se cumpla o devuelva un error. cond se evalúa con
+// el mutex bloqueado cada vez que cambia el estado del servidor.
+func (n *Node) waitFor(ctx context.Context, cond func() (bool, error)) error {
+	for {
+		n.mutex.Lock()
+		if n.stopped {
+			n.mutex.Unlock()
+			return ErrStopped
+		}
+		ok, err := cond()
+		changed := n.changed
+		n.mutex.Unlock()
+		if ok || err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.ctx.Done():
+			return ErrStopped
+		}
+	}
+}
+
+// run hace avanzar los temporizadores de elección y de latido
+func (n *Node) run() {
+	defer n.wg.Done()
+
+	interval := max(n.config.HeartbeatInterval/2, time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.tick()
+		}
+	}
+}
+
+// tick envía los latidos del líder y convoca elecciones si vence el plazo
+func (n *Node) tick() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return
+	}
+	now := time.Now()
+
+	if n.state == Leader {
+		// Un líder que no oye a una mayoría, por ejemplo en el lado pequeño de una
+		// partición, deja de serlo para no aceptar propuestas que no confirmará
+		if !n.checkQuorumLocked(now) {
+			log.Printf("Consenso: %s pierde el contacto con la mayoría y deja de ser líder", n.id)
+			n.becomeFollowerLocked(n.term, "")
+			return
+		}
+		if !now.Before(n.heartbeatDue) {
+			n.heartbeatDue = now.Add(n.config.HeartbeatInterval)
+			n.broadcastLocked()
+		}
+		return
+	}
+
+	if now.After(n.electionDeadline) {
+		n.startElectionLocked()
+	}
+}
+
+// checkQuorumLocked indica si el líder ha tenido respuesta de una mayoría dentro
+// del tiempo de elección. Debe llamarse con el mutex bloqueado.
+func (n *Node) checkQuorumLocked(now time.Time) bool {
+	if now.Sub(n.leaderSince) < n.config.ElectionTimeout {
+		return true
+	}
+
+	acked := map[string]bool{n.id: true}
+	for id, p := range n.progress {
+		if now.Sub(p.acked) < n.config.ElectionTimeout {
+			acked[id] = true
+		}
+	}
+	if !n.hasQuorumLocked(acked) {
+		return false
+	}
+	n.leaderContact = now
+	return true
+}
+
+// resetElectionLocked fija un plazo de elección aleatorio entre una y dos veces
+// el tiempo de elección. Debe llamarse con el mutex bloqueado.
+func (n *Node) resetElectionLocked() {
+	timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// startElectionLocked convoca elecciones en un mandato nuevo. Los servidores sin
+// voto no convocan elecciones. Debe llamarse con el mutex bloqueado.
+func (n *Node) startElectionLocked() {
+	n.resetElectionLocked()
+	if !n.configuration.IsVoter(n.id) {
+		return
+	}
+
+	// Sin guardar el voto no se puede convocar: tras reiniciar se podría votar a
+	// otro en el mismo mandato
+	term, vote := n.term, n.vote
+	n.term++
+	n.vote = n.id
+	if err := n.persistStateLocked(); err != nil {
+		log.Printf("Consenso: elección cancelada: %v", err)
+		n.term, n.vote = term, vote
+		return
+	}
+	n.state = Candidate
+	n.leader = ""
+	n.votes = map[string]bool{n.id: true}
+	n.notifyLocked()
+
+	if n.hasQuorumLocked(n.votes) {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	req := &Message{
+		Type:      MessageVote,
+		Term:      n.term,
+		Candidate: n.id,
+		LastIndex: n.lastIndexLocked(),
+		LastTerm:  n.lastTermLocked(),
+	}
+	for _, id := range n.configuration.Voters() {
+		if id != n.id {
+			go n.requestVote(id, req)
+		}
+	}
+}
+
+// requestVote pide el voto a un servidor y cuenta la respuesta
+func (n *Node) requestVote(target string, req *Message) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.RPCTimeout)
+	resp, err := n.transport.Call(ctx, target, req)
+	cancel()
+	if err != nil || resp.Error != "" {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.stopped {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "")
+		return
+	}
+	if n.state != Candidate || n.term != req.Term || !resp.Granted {
+		return
+	}
+	n.votes[target] = true
+	if n.hasQuorumLocked(n.votes) {
+		n.becomeLeaderLocked()
+	}
+}
+
+// becomeLeaderLocked convierte al candidato en líder y añade una entrada vacía
+// de su mandato. Debe llamarse con el mutex bloqueado.
+func (n *Node) becomeLeaderLocked() {
+	now := time.Now()
+	n.state = Leader
+	n.leader = n.id
+	n.votes = nil
+	n.leaderSince = now
+	n.leaderContact = now
+	n.progress = make(map[string]*progress)
+	n.syncProgressLocked()
+	log.Printf("Consenso: %s es el líder del mandato %d", n.id, n.term)
+
+	if _, err := n.appendLocked(EntryNoop, nil); err != nil {
+		log.Printf("Consenso: error al añadir la entrada del nuevo líder: %v", err)
+		n.becomeFollowerLocked(n.term, "")
+		return
+	}
+	n.heartbeatDue = now.Add(n.config.HeartbeatInterval)
+	n.broadcastLocked()
+	n.notifyLocked()
+}
+
+// becomeFollowerLocked pasa a seguidor del líder indicado, en un mandato nuevo
+// si term es mayor que el actual. Debe llamarse con el mutex bloqueado.
+func (n *Node) becomeFollowerLocked(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		// El voto de un mandato se guarda siempre junto con él, así que no
+		// guardar aquí el mandato nuevo no permite votar dos veces
+		if err := n.persistStateLocked(); err != nil {
+			log.Printf("Consenso: %v", err)
+		}
+	}
+	if n.state != Follower || n.leader != leader {
+		n.state = Follower
+		n.leader = leader
+		n.progress = nil
+		n.votes = nil
+		n.notifyLocked()
+	}
+	n.resetElectionLocked()
+}
+
+// syncProgressLocked crea el estado de replicación de los servidores de la
+// configuración que aún no lo tienen. Debe llamarse con el mutex bloqueado.
+func (n *Node) syncProgressLocked() {
+	for _, server := range n.configuration.Servers {
+		if server.ID == n.id {
+			continue
+		}
+		if _, exists := n.progress[server.ID]; !exists {
+			n.progress[server.ID] = &progress{next: n.lastIndexLocked() + 1}
+		}
+	}
+}
+
+// hasQuorumLocked indica si los servidores del conjunto forman mayoría de los
+// votantes. Debe llamarse con el mutex bloqueado.
+func (n *Node) hasQuorumLocked(set map[string]bool) bool {
+	voters := n.configuration.Voters()
+	if len(voters) == 0 {
+		return false
+	}
+	count := 0
+	for _, id := range voters {
+		if set[id] {
+			count++
+		}
+	}
+	return count >= n.configuration.Quorum()
+}
+
+// appendLocked añade una entrada del mandato actual al log del líder. Debe
+// llamarse con el mutex bloqueado.
+func (n *Node) appendLocked(entryType EntryType, data []byte) (Entry, error) {
+	entry := Entry{Index: n.lastIndexLocked() + 1, Term: n.term, Type: entryType, Data: data}
+	if err := n.storage.Append([]Entry{entry}); err != nil {
+		return entry, err
+	}
+	n.entries = append(n.entries, entry)
+	if entryType == EntryConfiguration {
+		n.refreshConfigurationLocked()
+		n.syncProgressLocked()
+	}
+
+	// Con un único votante la entrada queda confirmada al añadirla
+	n.advanceCommitLocked()
+	return entry, nil
+}
+
+// broadcastLocked envía a cada servidor las entradas que le faltan, o un latido.
+// Debe llamarse con el mutex bloqueado.
+func (n *Node) broadcastLocked() {
+	for id := range n.progress {
+		n.replicateLocked(id)
+	}
+}
+
+// replicateLocked envía a un servidor las siguientes entradas que le faltan, o
+// la instantánea si ya no están en el log. Hay como mucho una petición en curso
+// por servidor. Debe llamarse con el mutex bloqueado.
+func (n *Node) replicateLocked(id string) {
+	p := n.progress[id]
+	if p == nil || p.inflight {
+		return
+	}
+
+	msg := &Message{Term: n.term, Leader: n.id, LeaderCommit: n.commitIndex}
+	if p.next <= n.snapshotIndex {
+		msg.Type = MessageSnapshot
+		msg.Snapshot = n.snapshot
+	} else {
+		msg.Type = MessageAppend
+		msg.PrevIndex = p.next - 1
+		msg.PrevTerm = n.termAtLocked(msg.PrevIndex)
+		last := min(n.lastIndexLocked(), msg.PrevIndex+uint64(n.config.MaxAppendEntries))
+		if last >= p.next {
+			// Copiar las entradas: el log puede truncarse si el servidor deja de ser líder
+			msg.Entries = slices.Clone(n.entriesLocked(p.next, last))
+		}
+	}
+
+	p.inflight = true
+	go n.send(id, msg, time.Now())
+}
+
+// send envía una petición de replicación y actualiza el estado del servidor con
+// la respuesta
+func (n *Node) send(id string, msg *Message, sent time.Time) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.RPCTimeout)
+	resp, err := n.transport.Call(ctx, id, msg)
+	cancel()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	p := n.progress[id]
+	if n.stopped || n.state != Leader || n.term != msg.Term || p == nil {
+		return
+	}
+	p.inflight = false
+	if err != nil || resp.Error != "" {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "")
+		return
+	}
+	p.acked = sent
+
+	switch msg.Type {
+	case MessageSnapshot:
+		if resp.Success {
+			p.match = max(p.match, msg.Snapshot.Index)
+			p.next = p.match + 1
+		}
+	case MessageAppend:
+		switch {
+		case resp.Success:
+			p.match = max(p.match, msg.PrevIndex+uint64(len(msg.Entries)))
+			p.next = max(p.next, p.match+1)
+			n.advanceCommitLocked()
+		case resp.ConflictIndex > 0:
+			p.next = max(p.match+1, min(resp.ConflictIndex, n.lastIndexLocked()+1))
+		default:
+			p.next = max(p.match+1, p.next-1)
+		}
+	}
+	n.notifyLocked()
+
+	// Seguir enviando si faltan entradas o si una lectura espera un latido nuevo
+	if n.state == Leader && (p.next <= n.lastIndexLocked() || p.acked.Before(n.readRound)) {
+		n.replicateLocked(id)
+	}
+}
+
+// advanceCommitLocked confirma la última entrada del mandato actual replicada
+// en una mayoría; las de mandatos anteriores se confirman con ella. Debe
+// llamarse con el mutex bloqueado.
+func (n *Node) advanceCommitLocked() {
+	if n.state != Leader {
+		return
+	}
+
+	voters := n.configuration.Voters()
+	if len(voters) == 0 {
+		return
+	}
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if n.termAtLocked(index) != n.term {
+			return
+		}
+
+		count := 0
+		for _, id := range voters {
+			if id == n.id {
+				count++
+			} else if p := n.progress[id]; p != nil && p.match >= index {
+				count++
+			}
+		}
+		if count >= n.configuration.Quorum() {
+			n.setCommitLocked(index)
+			break
+		}
+	}
+
+	if n.configurationIndex > n.commitIndex {
+		return
+	}
+
+	// Con la configuración confirmada se deja de replicar a los servidores
+	// eliminados, y un líder eliminado deja de serlo
+	for id := range n.progress {
+		if !n.configuration.Contains(id) {
+			delete(n.progress, id)
+		}
+	}
+	if !n.configuration.IsVoter(n.id) {
+		log.Printf("Consenso: %s ya no vota en el grupo y deja de ser líder", n.id)
+		n.becomeFollowerLocked(n.term, "")
+	}
+}
+
+// setCommitLocked avanza el índice de confirmación y avisa a la goroutine que
+// aplica las entradas. Debe llamarse con el mutex bloqueado.
+func (n *Node) setCommitLocked(index uint64) {
+	if index <= n.commitIndex {
+		return
+	}
+	n.commitIndex = index
+	n.signalApply()
+	n.notifyLocked()
+}
+
+// signalApply avisa a la goroutine que aplica las entradas sin bloquearse
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLocked despierta a quien espera un cambio de estado. Debe llamarse con
+// el mutex bloqueado.
+func (n *Node) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// persistStateLocked guarda el mandato y el voto. Debe llamarse con el mutex
+// bloqueado.
+func (n *Node) persistStateLocked() error {
+	if err := n.storage.SetHardState(HardState{Term: n.term, Vote: n.vote}); err != nil {
+		return fmt.Errorf("error al guardar el estado: %v", err)
+	}
+	return nil
+}
+
+// handle atiende un mensaje de otro servidor
+func (n *Node) handle(ctx context.Context, from string, msg *Message) *Message {
+	n.mutex.Lock()
+	stopped := n.stopped
+	err := n.checkSenderLocked(from, msg)
+	n.mutex.Unlock()
+	if stopped {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Consenso: mensaje %s de %s rechazado: %v", msg.Type, from, err)
+		return &Message{Type: msg.Type, Error: err.Error()}
+	}
+
+	switch msg.Type {
+	case MessageVote:
+		return n.handleVote(msg)
+	case MessageAppend:
+		return n.handleAppend(msg)
+	case MessageSnapshot:
+		return n.handleSnapshot(msg)
+	case MessageForward:
+		return n.handleForward(ctx, from, msg)
+	case MessageReadIndex:
+		return n.handleReadIndex(ctx)
+	default:
+		return &Message{Type: msg.Type, Error: fmt.Sprintf("tipo de mensaje desconocido: %s", msg.Type)}
+	}
+}
+
+// checkSenderLocked comprueba que el remitente de un mensaje pueda enviarlo: los
+// candidatos y los líderes solo hablan por sí mismos y deben pertenecer al
+// grupo. Los servidores que no son miembros solo pueden reenviar comandos. Debe
+// llamarse con el mutex bloqueado.
+func (n *Node) checkSenderLocked(from string, msg *Message) error {
+	switch msg.Type {
+	case MessageVote:
+		if msg.Candidate != from {
+			return fmt.Errorf("el candidato %s no es el remitente", msg.Candidate)
+		}
+	case MessageAppend, MessageSnapshot:
+		if msg.Leader != from {
+			return fmt.Errorf("el líder %s no es el remitente", msg.Leader)
+		}
+		// Un servidor que aún no tiene configuración acepta al líder que lo añade
+		if len(n.configuration.Servers) == 0 {
+			return nil
+		}
+	case MessageForward:
+		// Los cambios de miembros solo se piden al líder directamente
+		if msg.EntryType != EntryCommand {
+			return fmt.Errorf("solo se reenvían comandos")
+		}
+		return nil
+	}
+
+	if !n.configuration.Contains(from) {
+		return fmt.Errorf("el remitente no pertenece al grupo")
+	}
+	return nil
+}
+
+// handleVote decide si vota al candidato
+func (n *Node) handleVote(msg *Message) *Message {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	resp := &Message{Type: MessageVote, Term: n.term}
+	if msg.Term < n.term {
+		return resp
+	}
+
+	// Mientras se tienen noticias recientes del líder no se vota a otro, para que
+	// un servidor aislado o eliminado no interrumpa al grupo al volver
+	if n.leader != "" && n.leader != msg.Candidate && time.Since(n.leaderContact) < n.config.ElectionTimeout {
+		return resp
+	}
+
+	if msg.Term > n.term {
+		n.becomeFollowerLocked(msg.Term, "")
+	}
+	resp.Term = n.term
+
+	lastTerm := n.lastTermLocked()
+	upToDate := msg.LastTerm > lastTerm || (msg.LastTerm == lastTerm && msg.LastIndex >= n.lastIndexLocked())
+	if upToDate && (n.vote == "" || n.vote == msg.Candidate) {
+		// El voto solo se concede si queda guardado
+		vote := n.vote
+		n.vote = msg.Candidate
+		if err := n.persistStateLocked(); err != nil {
+			log.Printf("Consenso: voto a %s rechazado: %v", msg.Candidate, err)
+			n.vote = vote
+			return resp
+		}
+		n.resetElectionLocked()
+		resp.Granted = true
+	}
+	return resp
+}
+
+// handleAppend añade las entradas del líder que faltan en el log, descartando
+// las que las contradicen, y avanza el índice de confirmación
+func (n *Node) handleAppend(msg *Message) *Message {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	resp := &Message{Type: MessageAppend, Term: n.term}
+	if msg.Term < n.term {
+		return resp
+	}
+	n.becomeFollowerLocked(msg.Term, msg.Leader)
+	n.leaderContact = time.Now()
+	resp.Term = n.term
+
+	// Comprobar que el log coincide con el del líder en la entrada anterior
+	lastIndex := n.lastIndexLocked()
+	if msg.PrevIndex > lastIndex {
+		resp.ConflictIndex = lastIndex + 1
+		return resp
+	}
+	if msg.PrevIndex > n.snapshotIndex {
+		if term := n.termAtLocked(msg.PrevIndex); term != msg.PrevTerm {
+			// Saltar de una vez todas las entradas del mandato en conflicto
+			index := msg.PrevIndex
+			for index > n.snapshotIndex+1 && n.termAtLocked(index-1) == term {
+				index--
+			}
+			resp.ConflictIndex = index
+			return resp
+		}
+	}
+
+	// Saltar las entradas que ya se tienen y truncar en la primera que no coincide
+	var fresh []Entry
+	for i, entry := range msg.Entries {
+		if entry.Index <= n.snapshotIndex {
+			continue
+		}
+		if entry.Index <= n.lastIndexLocked() {
+			if n.termAtLocked(entry.Index) == entry.Term {
+				continue
+			}
+			if err := n.truncateLocked(entry.Index); err != nil {
+				log.Printf("Consenso: error al truncar el log: %v", err)
+				return resp
+			}
+		}
+		fresh = msg.Entries[i:]
+		break
+	}
+	if len(fresh) > 0 {
+		if err := n.storage.Append(fresh); err != nil {
+			log.Printf("Consenso: error al añadir entradas: %v", err)
+			return resp
+		}
+		n.entries = append(n.entries, fresh...)
+		if slices.ContainsFunc(fresh, func(entry Entry) bool { return entry.Type == EntryConfiguration }) {
+			n.refreshConfigurationLocked()
+		}
+	}
+
+	n.setCommitLocked(min(msg.LeaderCommit, msg.PrevIndex+uint64(len(msg.Entries))))
+	resp.Success = true
+	return resp
+}
+
+// handleSnapshot reemplaza el estado por una instantánea del líder
+func (n *Node) handleSnapshot(msg *Message) *Message {
+	n.mutex.Lock()
+	resp := &Message{Type: MessageSnapshot, Term: n.term}
+	if msg.Term < n.term {
+		n.mutex.Unlock()
+		return resp
+	}
+	n.becomeFollowerLocked(msg.Term, msg.Leader)
+	n.leaderContact = time.Now()
+	resp.Term = n.term
+	n.mutex.Unlock()
+
+	snapshot := msg.Snapshot
+	if snapshot == nil {
+		return resp
+	}
+
+	// Con la máquina de estados bloqueada no se aplican entradas mientras se restaura
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	n.mutex.Lock()
+	covered := snapshot.Index <= n.commitIndex
+	n.mutex.Unlock()
+	if covered {
+		resp.Success = true
+		return resp
+	}
+
+	if err := n.fsm.Restore(snapshot.Data); err != nil {
+		log.Printf("Consenso: error al restaurar instantánea: %v", err)
+		return resp
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// Se conservan las entradas posteriores solo si el log coincide con la instantánea
+	keep := snapshot.Index <= n.lastIndexLocked() && n.termAtLocked(snapshot.Index) == snapshot.Term
+	if err := n.storage.SaveSnapshot(snapshot); err != nil {
+		log.Printf("Consenso: error al guardar instantánea: %v", err)
+		return resp
+	}
+	if keep {
+		n.entries = compactEntries(n.entries, snapshot.Index)
+	} else {
+		if err := n.storage.TruncateFrom(snapshot.Index + 1); err != nil {
+			log.Printf("Consenso: error al truncar el log: %v", err)
+			return resp
+		}
+		n.entries = nil
+	}
+	n.snapshot = snapshot
+	n.snapshotIndex = snapshot.Index
+	n.snapshotTerm = snapshot.Term
+	n.refreshConfigurationLocked()
+	n.lastApplied = snapshot.Index
+
+	// El resultado de las entradas que cubre la instantánea ya no se conoce
+	for index, w := range n.waiters {
+		if index <= snapshot.Index {
+			w.done <- proposalResult{err: ErrLeadershipLost}
+			delete(n.waiters, index)
+		}
+	}
+	n.setCommitLocked(snapshot.Index)
+	n.notifyLocked()
+
+	resp.Success = true
+	return resp
+}
+
+// handleForward atiende un comando reenviado por otro servidor
+func (n *Node) handleForward(ctx context.Context, from string, msg *Message) *Message {
+	resp := &Message{Type: MessageForward}
+	if n.config.AuthorizeForward != nil {
+		if err := n.config.AuthorizeForward(from, msg.Data); err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+	}
+
+	result, err := n.propose(ctx, EntryCommand, msg.Data, false)
+	switch {
+	case errors.Is(err, ErrNotLeader):
+		resp.NotLeader = true
+		resp.Leader = n.Leader()
+	case err != nil:
+		resp.Error = err.Error()
+	default:
+		resp.Result = result
+	}
+	return resp
+}
+
+// handleReadIndex devuelve el índice hasta el que es segura una lectura
+func (n *Node) handleReadIndex(ctx context.Context) *Message {
+	resp := &Message{Type: MessageReadIndex}
+	index, err := n.leaderReadIndex(ctx)
+	switch {
+	case errors.Is(err, ErrNotLeader):
+		resp.NotLeader = true
+		resp.Leader = n.Leader()
+	case err != nil:
+		resp.Error = err.Error()
+	default:
+		resp.Index = index
+	}
+	return resp
+}
+
+// truncateLocked descarta las entradas desde index, que contradicen al líder.
+// Quien esperaba esas entradas ya no las verá aplicadas. Debe llamarse con el
+// mutex bloqueado.
+func (n *Node) truncateLocked(index uint64) error {
+	if err := n.storage.TruncateFrom(index); err != nil {
+		return err
+	}
+	n.entries = n.entries[:index-n.snapshotIndex-1]
+	if n.configurationIndex >= index {
+		n.refreshConfigurationLocked()
+	}
+	for waiting, w := range n.waiters {
+		if waiting >= index {
+			w.done <- proposalResult{err: ErrLeadershipLost}
+			delete(n.waiters, waiting)
+		}
+	}
+	return nil
+}
+
+// applyLoop aplica las entradas confirmadas y compacta el log cuando crece
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.applyCh:
+		}
+		n.applyCommitted()
+		n.maybeSnapshot()
+	}
+}
+
+// applyCommitted aplica en orden las entradas confirmadas pendientes y entrega
+// su resultado a quien las propuso
+func (n *Node) applyCommitted() {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	for {
+		n.mutex.Lock()
+		if n.stopped || n.lastApplied >= n.commitIndex {
+			n.mutex.Unlock()
+			return
+		}
+		from := n.lastApplied + 1
+		to := min(n.commitIndex, from+uint64(n.config.MaxAppendEntries)-1)
+		batch := slices.Clone(n.entriesLocked(from, to))
+		n.mutex.Unlock()
+
+		for _, entry := range batch {
+			var result []byte
+			if entry.Type == EntryCommand {
+				result = n.fsm.Apply(entry.Index, entry.Data)
+			}
+
+			n.mutex.Lock()
+			n.lastApplied = entry.Index
+			if w, exists := n.waiters[entry.Index]; exists {
+				delete(n.waiters, entry.Index)
+				if w.term == entry.Term {
+					w.done <- proposalResult{data: result}
+				} else {
+					w.done <- proposalResult{err: ErrLeadershipLost}
+				}
+			}
+			n.notifyLocked()
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// maybeSnapshot guarda una instantánea de la máquina de estados y compacta el
+// log cuando las entradas aplicadas desde la anterior superan el umbral
+func (n *Node) maybeSnapshot() {
+	if n.config.SnapshotThreshold == 0 {
+		return
+	}
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+
+	n.mutex.Lock()
+	index := n.lastApplied
+	due := index-n.snapshotIndex >= n.config.SnapshotThreshold
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	// Con la máquina de estados bloqueada su estado es el de la entrada index
+	data, err := n.fsm.Snapshot()
+	if err != nil {
+		log.Printf("Consenso: error al crear instantánea: %v", err)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	snapshot := &Snapshot{
+		Index:         index,
+		Term:          n.termAtLocked(index),
+		Configuration: n.configurationAtLocked(index),
+		Data:          data,
+	}
+	if err := n.storage.SaveSnapshot(snapshot); err != nil {
+		log.Printf("Consenso: error al guardar instantánea: %v", err)
+		return
+	}
+	n.entries = compactEntries(n.entries, index)
+	n.snapshot = snapshot
+	n.snapshotIndex = snapshot.Index
+	n.snapshotTerm = snapshot.Term
+}
+
+// refreshConfigurationLocked toma la última configuración del log, o la de la
+// instantánea si el log no tiene ninguna. Debe llamarse con el mutex bloqueado.
+func (n *Node) refreshConfigurationLocked() {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if n.entries[i].Type != EntryConfiguration {
+			continue
+		}
+		var configuration Configuration
+		if err := json.Unmarshal(n.entries[i].Data, &configuration); err != nil {
+			log.Printf("Consenso: configuración no válida en la entrada %d: %v", n.entries[i].Index, err)
+			continue
+		}
+		n.configuration = configuration
+		n.configurationIndex = n.entries[i].Index
+		return
+	}
+
+	n.configuration = Configuration{}
+	n.configurationIndex = n.snapshotIndex
+	if n.snapshot != nil {
+		n.configuration = n.snapshot.Configuration.clone()
+	}
+}
+
+// configurationAtLocked devuelve la configuración vigente en una entrada. Debe
+// llamarse con el mutex bloqueado.
+func (n *Node) configurationAtLocked(index uint64) Configuration {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		entry := n.entries[i]
+		if entry.Index > index || entry.Type != EntryConfiguration {
+			continue
+		}
+		var configuration Configuration
+		if err := json.Unmarshal(entry.Data, &configuration); err == nil {
+			return configuration
+		}
+	}
+	if n.snapshot != nil {
+		return n.snapshot.Configuration.clone()
+	}
+	return Configuration{}
+}
+
+// lastIndexLocked devuelve el índice de la última entrada del log
+func (n *Node) lastIndexLocked() uint64 {
+	return n.snapshotIndex + uint64(len(n.entries))
+}
+
+// lastTermLocked devuelve el mandato de la última entrada del log
+func (n *Node) lastTermLocked() uint64 {
+	return n.termAtLocked(n.lastIndexLocked())
+}
+
+// termAtLocked devuelve el mandato de una entrada, o 0 si no está en el log
+func (n *Node) termAtLocked(index uint64) uint64 {
+	switch {
+	case index == n.snapshotIndex:
+		return n.snapshotTerm
+	case index < n.snapshotIndex || index > n.lastIndexLocked():
+		return 0
+	default:
+		return n.entries[index-n.snapshotIndex-1].Term
+	}
+}
+
+// entriesLocked devuelve las entradas entre from y to, ambas incluidas, que
+// deben ser posteriores a la instantánea
+func (n *Node) entriesLocked(from, to uint64) []Entry {
+	return n.entries[from-n.snapshotIndex-1 : to-n.snapshotIndex]
+}
@@ -0,0 +1,559 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testConfig usa tiempos cortos para que las elecciones sean rápidas
+var testConfig = Config{
+	ElectionTimeout:   100 * time.Millisecond,
+	HeartbeatInterval: 20 * time.Millisecond,
+	RPCTimeout:        200 * time.Millisecond,
+}
+
+// testWait es el tiempo máximo que se espera a que el grupo llegue a un estado
+const testWait = 10 * time.Second
+
+// testFSM guarda los comandos aplicados en orden
+type testFSM struct {
+	commands []string
+	mutex    sync.Mutex
+}
+
+func (f *testFSM) Apply(index uint64, data []byte) []byte {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.commands = append(f.commands, string(data))
+	return data
+}
+
+func (f *testFSM) Snapshot() ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return json.Marshal(f.commands)
+}
+
+func (f *testFSM) Restore(data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.commands = nil
+	return json.Unmarshal(data, &f.commands)
+}
+
+// Commands devuelve una copia de los comandos aplicados
+func (f *testFSM) Commands() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return slices.Clone(f.commands)
+}
+
+// testCluster es un grupo de servidores sobre una red simulada
+type testCluster struct {
+	t        *testing.T
+	config   Config
+	net      *MemNetwork
+	nodes    map[string]*Node
+	fsms     map[string]*testFSM
+	storages map[string]*MemoryStorage
+}
+
+// newTestCluster crea e inicia un grupo con los votantes indicados
+func newTestCluster(t *testing.T, config Config, ids ...string) *testCluster {
+	t.Helper()
+	c := &testCluster{
+		t:        t,
+		config:   config,
+		net:      NewMemNetwork(),
+		nodes:    make(map[string]*Node),
+		fsms:     make(map[string]*testFSM),
+		storages: make(map[string]*MemoryStorage),
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+	})
+
+	servers := make([]Server, len(ids))
+	for i, id := range ids {
+		servers[i] = Server{ID: id, Suffrage: Voter}
+	}
+	for _, id := range ids {
+		node := c.add(id)
+		if err := node.Bootstrap(servers); err != nil {
+			t.Fatalf("error al inicializar %s: %v", id, err)
+		}
+	}
+	for _, id := range ids {
+		c.nodes[id].Start()
+	}
+	return c
+}
+
+// add crea un servidor sin estado que aún no pertenece al grupo
+func (c *testCluster) add(id string) *Node {
+	c.t.Helper()
+	c.fsms[id] = &testFSM{}
+	c.storages[id] = NewMemoryStorage()
+	return c.restart(id)
+}
+
+// restart crea de nuevo un servidor con su almacenamiento, como tras un reinicio,
+// con la máquina de estados vacía
+func (c *testCluster) restart(id string) *Node {
+	c.t.Helper()
+	c.fsms[id] = &testFSM{}
+	node, err := NewNode(id, c.fsms[id], c.storages[id], c.net.Transport(id), c.config)
+	if err != nil {
+		c.t.Fatalf("error al crear %s: %v", id, err)
+	}
+	c.nodes[id] = node
+	return node
+}
+
+// waitFor espera a que se cumpla una condición
+func (c *testCluster) waitFor(description string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(testWait)
+	for !cond() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("tiempo agotado esperando %s", description)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitLeader espera a que uno de los servidores indicados sea el líder y los
+// demás lo reconozcan, y lo devuelve
+func (c *testCluster) waitLeader(ids ...string) string {
+	c.t.Helper()
+	var leader string
+	c.waitFor(fmt.Sprintf("un líder entre %v", ids), func() bool {
+		leader = ""
+		for _, id := range ids {
+			if c.nodes[id].IsLeader() {
+				leader = id
+			}
+		}
+		if leader == "" {
+			return false
+		}
+		for _, id := range ids {
+			if c.nodes[id].Leader() != leader {
+				return false
+			}
+		}
+		return true
+	})
+	return leader
+}
+
+// apply propone un comando desde un servidor
+func (c *testCluster) apply(id string, command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	result, err := c.nodes[id].Apply(ctx, []byte(command))
+	if err == nil && string(result) != command {
+		return fmt.Errorf("resultado %q, se esperaba %q", result, command)
+	}
+	return err
+}
+
+// mustApply propone un comando y falla la prueba si no se aplica
+func (c *testCluster) mustApply(id string, commands ...string) {
+	c.t.Helper()
+	for _, command := range commands {
+		if err := c.apply(id, command); err != nil {
+			c.t.Fatalf("error al aplicar %q desde %s: %v", command, id, err)
+		}
+	}
+}
+
+// waitCommands espera a que los servidores indicados hayan aplicado exactamente
+// los comandos esperados
+func (c *testCluster) waitCommands(want []string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		c.waitFor(fmt.Sprintf("los comandos %v en %s", want, id), func() bool {
+			return slices.Equal(c.fsms[id].Commands(), want)
+		})
+	}
+}
+
+// others devuelve los servidores distintos de los indicados
+func others(ids []string, excluded ...string) []string {
+	var result []string
+	for _, id := range ids {
+		if !slices.Contains(excluded, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// TestRaftLeaderFailover comprueba que al caer el líder se elija otro sin perder
+// las escrituras confirmadas, y que el antiguo líder se ponga al día al volver
+func TestRaftLeaderFailover(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, testConfig, ids...)
+
+	leader := c.waitLeader(ids...)
+	follower := others(ids, leader)[0]
+	c.mustApply(leader, "1")
+	c.mustApply(follower, "2")
+	c.waitCommands([]string{"1", "2"}, ids...)
+
+	c.nodes[leader].Stop()
+	rest := others(ids, leader)
+	next := c.waitLeader(rest...)
+	if next == leader {
+		t.Fatalf("el líder detenido sigue siendo el líder")
+	}
+	if term := c.nodes[next].Status().Term; term <= 1 {
+		t.Errorf("el nuevo líder está en el mandato %d", term)
+	}
+	c.mustApply(rest[0], "3")
+	c.waitCommands([]string{"1", "2", "3"}, rest...)
+
+	// Al reiniciar, el antiguo líder conserva su log y recibe lo que le falta
+	c.restart(leader).Start()
+	c.waitCommands([]string{"1", "2", "3"}, ids...)
+	if c.nodes[leader].IsLeader() && c.nodes[next].IsLeader() {
+		t.Errorf("dos líderes a la vez")
+	}
+}
+
+// TestRaftPartition comprueba que el lado pequeño de una partición no confirme
+// escrituras mientras el lado mayor elige líder y sigue confirmando, y que al
+// reparar la red se descarte lo que propuso la minoría
+func TestRaftPartition(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+	c := newTestCluster(t, testConfig, ids...)
+
+	leader := c.waitLeader(ids...)
+	c.mustApply(leader, "1")
+	c.waitCommands([]string{"1"}, ids...)
+
+	minority := []string{leader, others(ids, leader)[0]}
+	majority := others(ids, minority...)
+	commits := make(map[string]uint64)
+	for _, id := range minority {
+		commits[id] = c.nodes[id].Status().CommitIndex
+	}
+	c.net.Partition(minority, majority)
+
+	// El líder aislado acepta la propuesta pero no la confirma
+	if err := c.apply(leader, "minoría"); err == nil {
+		t.Fatalf("la minoría confirmó una escritura")
+	}
+	next := c.waitLeader(majority...)
+	c.mustApply(next, "2", "3")
+	c.waitCommands([]string{"1", "2", "3"}, majority...)
+
+	for _, id := range minority {
+		if commit := c.nodes[id].Status().CommitIndex; commit != commits[id] {
+			t.Errorf("%s avanzó su índice de confirmación de %d a %d en la minoría", id, commits[id], commit)
+		}
+		if commands := c.fsms[id].Commands(); !slices.Equal(commands, []string{"1"}) {
+			t.Errorf("%s aplicó %v en la minoría", id, commands)
+		}
+	}
+	if c.nodes[leader].IsLeader() {
+		t.Errorf("el líder de la minoría no dejó de serlo")
+	}
+
+	c.net.Heal()
+	c.waitLeader(ids...)
+	c.mustApply(next, "4")
+	c.waitCommands([]string{"1", "2", "3", "4"}, ids...)
+}
+
+// TestRaftLogTruncation comprueba que un líder aislado que añadió entradas sin
+// confirmar las descarte al volver y adopte el log del nuevo líder
+func TestRaftLogTruncation(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, testConfig, ids...)
+
+	leader := c.waitLeader(ids...)
+	c.mustApply(leader, "1")
+	c.waitCommands([]string{"1"}, ids...)
+
+	old := c.nodes[leader].Status()
+	c.net.Disconnect(leader)
+
+	// Propuestas concurrentes, para que el líder aislado las añada todas antes
+	// de darse cuenta de que ha perdido la mayoría
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.apply(leader, fmt.Sprintf("perdida-%d", i))
+		}()
+	}
+	c.waitFor("las entradas sin confirmar en el líder aislado", func() bool {
+		return c.nodes[leader].Status().LastIndex >= old.LastIndex+3
+	})
+
+	rest := others(ids, leader)
+	next := c.waitLeader(rest...)
+	c.mustApply(next, "2", "3", "4", "5")
+	wg.Wait()
+
+	c.net.Reconnect(leader)
+	want := []string{"1", "2", "3", "4", "5"}
+	c.waitCommands(want, ids...)
+
+	// Las entradas que propuso el líder aislado se sustituyeron por las del nuevo
+	node := c.nodes[leader]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for index := old.LastIndex + 1; index <= old.LastIndex+3; index++ {
+		if term := node.termAtLocked(index); term == old.Term {
+			t.Errorf("la entrada %d sigue siendo del mandato %d", index, old.Term)
+		}
+	}
+	for _, entry := range node.entries {
+		if entry.Type == EntryCommand && !slices.Contains(want, string(entry.Data)) {
+			t.Errorf("el log conserva la entrada descartada %q", entry.Data)
+		}
+	}
+}
+
+// TestRaftMembershipChange comprueba que se añadan y quiten servidores de uno en
+// uno, que los cambios solo se atiendan en el líder y que al quitar al líder se
+// elija otro entre los que quedan
+func TestRaftMembershipChange(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, testConfig, ids...)
+
+	leader := c.waitLeader(ids...)
+	c.mustApply(leader, "1", "2")
+
+	c.add("d").Start()
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+
+	// Los cambios de miembros no se reenvían al líder
+	follower := others(ids, leader)[0]
+	if err := c.nodes[follower].AddVoter(ctx, "d"); !errors.Is(err, ErrLeaderOnly) {
+		t.Fatalf("AddVoter en un seguidor = %v, se esperaba ErrLeaderOnly", err)
+	}
+
+	// Sin voto recibe el log sin contar para la mayoría
+	if err := c.nodes[leader].AddLearner(ctx, "d"); err != nil {
+		t.Fatalf("error al añadir servidor sin voto: %v", err)
+	}
+	c.waitCommands([]string{"1", "2"}, "d")
+	if c.nodes[leader].Configuration().IsVoter("d") {
+		t.Errorf("el servidor sin voto cuenta como votante")
+	}
+
+	if err := c.nodes[leader].AddVoter(ctx, "d"); err != nil {
+		t.Fatalf("error al dar voto: %v", err)
+	}
+	members := append(slices.Clone(ids), "d")
+	c.waitFor("la configuración con cuatro votantes en todos los servidores", func() bool {
+		for _, id := range members {
+			if len(c.nodes[id].Configuration().Voters()) != 4 {
+				return false
+			}
+		}
+		return true
+	})
+	c.mustApply("d", "3")
+
+	// Al quitar al líder deja de serlo y los demás eligen otro
+	if err := c.nodes[leader].RemoveServer(ctx, leader); err != nil {
+		t.Fatalf("error al quitar al líder: %v", err)
+	}
+	rest := others(members, leader)
+	next := c.waitLeader(rest...)
+	if configuration := c.nodes[next].Configuration(); configuration.Contains(leader) || len(configuration.Voters()) != 3 {
+		t.Errorf("configuración tras quitar al líder: %+v", configuration)
+	}
+	c.mustApply(next, "4")
+	c.waitCommands([]string{"1", "2", "3", "4"}, rest...)
+	if c.nodes[leader].IsMember() && c.nodes[leader].IsLeader() {
+		t.Errorf("el servidor quitado sigue siendo líder")
+	}
+}
+
+// TestRaftSnapshotInstall comprueba que un servidor que se ha quedado atrás y uno
+// nuevo reciban la instantánea cuando el líder ya ha compactado su log
+func TestRaftSnapshotInstall(t *testing.T) {
+	config := testConfig
+	config.SnapshotThreshold = 5
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, config, ids...)
+
+	leader := c.waitLeader(ids...)
+	lagging := others(ids, leader)[0]
+	c.net.Disconnect(lagging)
+
+	var want []string
+	for i := range 20 {
+		command := fmt.Sprintf("%d", i)
+		c.mustApply(leader, command)
+		want = append(want, command)
+	}
+	c.waitFor("la compactación del log del líder", func() bool {
+		return c.nodes[leader].Status().SnapshotIndex > 0
+	})
+
+	c.net.Reconnect(lagging)
+	c.waitCommands(want, ids...)
+	if status := c.nodes[lagging].Status(); status.SnapshotIndex == 0 {
+		t.Errorf("%s se puso al día sin instantánea", lagging)
+	}
+
+	c.add("d").Start()
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	if err := c.nodes[leader].AddLearner(ctx, "d"); err != nil {
+		t.Fatalf("error al añadir servidor: %v", err)
+	}
+	c.waitCommands(want, "d")
+	if configuration := c.nodes["d"].Configuration(); !configuration.Contains("d") || len(configuration.Voters()) != 3 {
+		t.Errorf("configuración del servidor nuevo: %+v", configuration)
+	}
+
+	// La instantánea se conserva al reiniciar
+	c.nodes["d"].Stop()
+	c.restart("d")
+	if commands := c.fsms["d"].Commands(); len(commands) == 0 {
+		t.Errorf("el servidor reiniciado no restauró la instantánea")
+	}
+}
+
+// TestRaftRejectsForeignSenders comprueba que solo se atiendan los mensajes de
+// los miembros que hablan por sí mismos, que no se acepten cambios de miembros
+// reenviados y que los comandos reenviados pasen por AuthorizeForward
+func TestRaftRejectsForeignSenders(t *testing.T) {
+	config := testConfig
+	config.AuthorizeForward = func(from string, data []byte) error {
+		if string(data) == "prohibido" {
+			return fmt.Errorf("%s no puede proponer %q", from, data)
+		}
+		return nil
+	}
+	ids := []string{"a", "b", "c"}
+	c := newTestCluster(t, config, ids...)
+
+	leader := c.waitLeader(ids...)
+	follower := others(ids, leader)[0]
+	status := c.nodes[follower].Status()
+
+	outsider := c.net.Transport("x")
+	member := c.net.Transport(others(ids, leader, follower)[0])
+	call := func(transport Transport, target string, msg *Message) *Message {
+		t.Helper()
+		resp, err := transport.Call(context.Background(), target, msg)
+		if err != nil {
+			t.Fatalf("error al enviar %s: %v", msg.Type, err)
+		}
+		return resp
+	}
+
+	rejected := []struct {
+		name      string
+		transport Transport
+		target    string
+		msg       *Message
+	}{
+		{"latido de un nodo ajeno", outsider, follower, &Message{Type: MessageAppend, Term: status.Term + 10, Leader: "x"}},
+		{"latido en nombre del líder", outsider, follower, &Message{Type: MessageAppend, Term: status.Term + 10, Leader: leader}},
+		{"latido de un miembro en nombre de otro", member, follower, &Message{Type: MessageAppend, Term: status.Term + 10, Leader: leader}},
+		{"instantánea de un nodo ajeno", outsider, follower, &Message{Type: MessageSnapshot, Term: status.Term + 10, Leader: "x", Snapshot: &Snapshot{Index: 100, Term: status.Term + 10}}},
+		{"voto para un nodo ajeno", outsider, follower, &Message{Type: MessageVote, Term: status.Term + 10, Candidate: "x", LastIndex: 100, LastTerm: status.Term + 10}},
+		{"voto en nombre de un miembro", outsider, follower, &Message{Type: MessageVote, Term: status.Term + 10, Candidate: leader, LastIndex: 100, LastTerm: status.Term + 10}},
+		{"cambio de miembros reenviado", member, leader, &Message{Type: MessageForward, EntryType: EntryConfiguration, Data: []byte(`{"server":{"id":"x","suffrage":"voter"}}`)}},
+		{"comando no autorizado", outsider, leader, &Message{Type: MessageForward, EntryType: EntryCommand, Data: []byte("prohibido")}},
+	}
+	for _, test := range rejected {
+		resp := call(test.transport, test.target, test.msg)
+		if resp.Error == "" || resp.Success || resp.Granted {
+			t.Errorf("%s: aceptado (%+v)", test.name, resp)
+		}
+	}
+
+	if term := c.nodes[follower].Status().Term; term != status.Term {
+		t.Errorf("los mensajes rechazados cambiaron el mandato de %d a %d", status.Term, term)
+	}
+	if configuration := c.nodes[leader].Configuration(); configuration.Contains("x") {
+		t.Errorf("se añadió un miembro con un cambio reenviado")
+	}
+
+	// Un nodo ajeno puede reenviar comandos autorizados al líder
+	resp := call(outsider, leader, &Message{Type: MessageForward, EntryType: EntryCommand, Data: []byte("permitido")})
+	if resp.Error != "" || string(resp.Result) != "permitido" {
+		t.Errorf("comando autorizado: %+v", resp)
+	}
+	c.waitCommands([]string{"permitido"}, ids...)
+}
+
+// failingStorage es un almacenamiento en memoria que puede fallar al guardar el
+// mandato y el voto
+type failingStorage struct {
+	*MemoryStorage
+	fail atomic.Bool
+}
+
+func (s *failingStorage) SetHardState(state HardState) error {
+	if s.fail.Load() {
+		return errors.New("disco lleno")
+	}
+	return s.MemoryStorage.SetHardState(state)
+}
+
+// TestRaftUnsavedVote comprueba que un servidor que no puede guardar su estado no
+// vote ni convoque elecciones
+func TestRaftUnsavedVote(t *testing.T) {
+	storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	node, err := NewNode("a", &testFSM{}, storage, NewMemNetwork().Transport("a"), testConfig)
+	if err != nil {
+		t.Fatalf("error al crear servidor: %v", err)
+	}
+	defer node.Stop()
+	if err := node.Bootstrap([]Server{{ID: "a", Suffrage: Voter}, {ID: "b", Suffrage: Voter}}); err != nil {
+		t.Fatalf("error al inicializar: %v", err)
+	}
+
+	vote := &Message{Type: MessageVote, Term: 5, Candidate: "b", LastIndex: 10, LastTerm: 5}
+	storage.fail.Store(true)
+	if resp := node.handle(context.Background(), "b", vote); resp.Granted {
+		t.Errorf("voto concedido sin guardarlo")
+	}
+	if state, _ := storage.HardState(); state.Vote != "" {
+		t.Errorf("voto guardado: %+v", state)
+	}
+
+	node.mutex.Lock()
+	term := node.term
+	node.startElectionLocked()
+	if node.state != Follower || node.term != term || node.vote != "" {
+		t.Errorf("elección convocada sin guardar el estado: %s, mandato %d, voto %q", node.state, node.term, node.vote)
+	}
+	node.mutex.Unlock()
+
+	storage.fail.Store(false)
+	if resp := node.handle(context.Background(), "b", vote); !resp.Granted {
+		t.Errorf("voto denegado con el almacenamiento disponible")
+	}
+	if state, _ := storage.HardState(); state.Vote != "b" || state.Term != 5 {
+		t.Errorf("estado guardado: %+v, se esperaba el voto a b en el mandato 5", state)
+	}
+}
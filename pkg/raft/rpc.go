@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"context"
+	"errors"
+)
+
+// MessageType identifica el tipo de un mensaje entre servidores
+type MessageType string
+
+const (
+	// MessageVote pide el voto de un servidor para una elección
+	MessageVote MessageType = "vote"
+	// MessageAppend replica entradas del log o sirve de latido del líder
+	MessageAppend MessageType = "append"
+	// MessageSnapshot envía una instantánea a un servidor que se ha quedado atrás
+	MessageSnapshot MessageType = "snapshot"
+	// MessageForward reenvía al líder una propuesta de un servidor que no lo es
+	MessageForward MessageType = "forward"
+	// MessageReadIndex pide al líder el índice hasta el que una lectura es segura
+	MessageReadIndex MessageType = "read_index"
+)
+
+// Message es el sobre de todas las peticiones y respuestas del protocolo. Cada
+// tipo usa solo sus campos.
+type Message struct {
+	Type MessageType `json:"type"`
+	Term uint64      `json:"term,omitempty"`
+
+	// Elección
+	Candidate string `json:"candidate,omitempty"`
+	LastIndex uint64 `json:"last_index,omitempty"`
+	LastTerm  uint64 `json:"last_term,omitempty"`
+	Granted   bool   `json:"granted,omitempty"`
+
+	// Replicación
+	Leader        string  `json:"leader,omitempty"`
+	PrevIndex     uint64  `json:"prev_index,omitempty"`
+	PrevTerm      uint64  `json:"prev_term,omitempty"`
+	Entries       []Entry `json:"entries,omitempty"`
+	LeaderCommit  uint64  `json:"leader_commit,omitempty"`
+	Success       bool    `json:"success,omitempty"`
+	ConflictIndex uint64  `json:"conflict_index,omitempty"` // Siguiente índice que debe probar el líder
+
+	// Instantánea
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+
+	// Propuestas reenviadas y lecturas
+	EntryType EntryType `json:"entry_type,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+	Result    []byte    `json:"result,omitempty"`
+	Index     uint64    `json:"index,omitempty"`
+	NotLeader bool      `json:"not_leader,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Handler atiende un mensaje recibido de otro servidor y devuelve la respuesta
+type Handler func(ctx context.Context, from string, msg *Message) *Message
+
+// Transport comunica a los servidores del grupo. Cada llamada es una petición
+// con su respuesta; el transporte no reintenta.
+type Transport interface {
+	// Call envía un mensaje a un servidor y espera su respuesta
+	Call(ctx context.Context, target string, msg *Message) (*Message, error)
+	// SetHandler establece la función que atiende los mensajes recibidos
+	SetHandler(handler Handler)
+	// Peers devuelve los servidores alcanzables, con los que un nodo que no
+	// pertenece al grupo busca al líder
+	Peers() []string
+}
+
+// remoteError convierte el error de una respuesta en el error conocido del
+// mismo texto, de modo que errors.Is funcione al otro lado de la red
+func remoteError(text string) error {
+	for _, known := range []error{ErrNotLeader, ErrNoLeader, ErrLeadershipLost, ErrStopped, ErrConfigChangePending} {
+		if known.Error() == text {
+			return known
+		}
+	}
+	return errors.New(text)
+}
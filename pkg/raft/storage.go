@@ -0,0 +1,410 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	stateFileName    = "state.json"
+	logFileName      = "log.jsonl"
+	snapshotFileName = "snapshot.json"
+)
+
+// HardState es el estado que un servidor debe conservar antes de responder:
+// el mandato actual y a quién votó en él
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// Snapshot es el estado de la máquina hasta una entrada del log, con la
+// configuración vigente en ese punto
+type Snapshot struct {
+	Index         uint64        `json:"index"`
+	Term          uint64        `json:"term"`
+	Configuration Configuration `json:"configuration"`
+	Data          []byte        `json:"data"`
+}
+
+// Storage guarda de forma duradera el estado, el log y la última instantánea
+// de un servidor. Cada llamada debe estar en disco al volver.
+type Storage interface {
+	// HardState devuelve el mandato y el voto guardados
+	HardState() (HardState, error)
+	// SetHardState guarda el mandato y el voto
+	SetHardState(state HardState) error
+	// Entries devuelve las entradas posteriores a la instantánea, en orden
+	Entries() ([]Entry, error)
+	// Append añade entradas consecutivas al final del log
+	Append(entries []Entry) error
+	// TruncateFrom elimina las entradas desde index, incluida
+	TruncateFrom(index uint64) error
+	// Snapshot devuelve la última instantánea, o nil si no hay ninguna
+	Snapshot() (*Snapshot, error)
+	// SaveSnapshot guarda una instantánea y descarta las entradas que cubre
+	SaveSnapshot(snapshot *Snapshot) error
+}
+
+// MemoryStorage guarda el estado en memoria. Sirve para pruebas y para grupos
+// que no necesitan sobrevivir a un reinicio.
+type MemoryStorage struct {
+	state    HardState
+	entries  []Entry
+	snapshot *Snapshot
+	mutex    sync.Mutex
+}
+
+// NewMemoryStorage crea un almacenamiento en memoria vacío
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// HardState devuelve el mandato y el voto guardados
+func (s *MemoryStorage) HardState() (HardState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state, nil
+}
+
+// SetHardState guarda el mandato y el voto
+func (s *MemoryStorage) SetHardState(state HardState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state = state
+	return nil
+}
+
+// Entries devuelve las entradas posteriores a la instantánea
+func (s *MemoryStorage) Entries() ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.entries), nil
+}
+
+// Append añade entradas al final del log
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// TruncateFrom elimina las entradas desde index
+func (s *MemoryStorage) TruncateFrom(index uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries = truncateEntries(s.entries, index)
+	return nil
+}
+
+// Snapshot devuelve la última instantánea
+func (s *MemoryStorage) Snapshot() (*Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.snapshot, nil
+}
+
+// SaveSnapshot guarda una instantánea y descarta las entradas que cubre
+func (s *MemoryStorage) SaveSnapshot(snapshot *Snapshot) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.snapshot = snapshot
+	s.entries = compactEntries(s.entries, snapshot.Index)
+	return nil
+}
+
+// FileStorage guarda el estado en un directorio: el mandato y la instantánea en
+// ficheros que se reemplazan de forma atómica y el log como líneas JSON que se
+// añaden y se sincronizan con cada escritura
+type FileStorage struct {
+	dir     string
+	entries []Entry  // Copia en memoria del log
+	log     *os.File // Fichero del log abierto para añadir
+	mutex   sync.Mutex
+}
+
+// NewFileStorage abre o crea el almacenamiento en un directorio. Una última
+// línea del log incompleta, de una escritura interrumpida, se descarta.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error al crear directorio de consenso: %v", err)
+	}
+
+	s := &FileStorage{dir: dir}
+	entries, torn, err := readLog(filepath.Join(dir, logFileName))
+	if err != nil {
+		return nil, err
+	}
+	s.entries = entries
+	if torn {
+		if err := s.rewriteLog(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.log == nil {
+		file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error al abrir log de consenso: %v", err)
+		}
+		s.log = file
+	}
+	return s, nil
+}
+
+// readLog lee las entradas de un fichero de log e indica si la última línea
+// estaba incompleta
+func readLog(path string) ([]Entry, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error al leer log de consenso: %v", err)
+	}
+
+	var entries []Entry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// Solo la última línea puede quedar a medias
+			if !bytes.HasSuffix(data, []byte("\n")) && bytes.HasSuffix(data, line) {
+				return entries, true, nil
+			}
+			return nil, false, fmt.Errorf("log de consenso corrupto: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("error al leer log de consenso: %v", err)
+	}
+	return entries, false, nil
+}
+
+// Close cierra el fichero del log
+func (s *FileStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+// HardState devuelve el mandato y el voto guardados
+func (s *FileStorage) HardState() (HardState, error) {
+	var state HardState
+	data, err := os.ReadFile(filepath.Join(s.dir, stateFileName))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("error al leer estado de consenso: %v", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error al deserializar estado de consenso: %v", err)
+	}
+	return state, nil
+}
+
+// SetHardState guarda el mandato y el voto
+func (s *FileStorage) SetHardState(state HardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error al serializar estado de consenso: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.replaceFile(stateFileName, data)
+}
+
+// Entries devuelve las entradas posteriores a la instantánea
+func (s *FileStorage) Entries() ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.entries), nil
+}
+
+// Append añade entradas al final del log y lo sincroniza
+func (s *FileStorage) Append(entries []Entry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error al serializar entrada %d: %v", entry.Index, err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.log == nil {
+		return errors.New("almacenamiento de consenso cerrado")
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error al escribir log de consenso: %v", err)
+	}
+	if err := s.log.Sync(); err != nil {
+		return fmt.Errorf("error al sincronizar log de consenso: %v", err)
+	}
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// TruncateFrom elimina las entradas desde index reescribiendo el log
+func (s *FileStorage) TruncateFrom(index uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries = truncateEntries(s.entries, index)
+	return s.rewriteLog()
+}
+
+// Snapshot devuelve la última instantánea
+func (s *FileStorage) Snapshot() (*Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al leer instantánea de consenso: %v", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("error al deserializar instantánea de consenso: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// SaveSnapshot guarda una instantánea y reescribe el log sin las entradas que
+// cubre. La instantánea se guarda antes, de modo que un fallo entre ambos pasos
+// solo deja entradas de más.
+func (s *FileStorage) SaveSnapshot(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("error al serializar instantánea de consenso: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.replaceFile(snapshotFileName, data); err != nil {
+		return err
+	}
+	s.entries = compactEntries(s.entries, snapshot.Index)
+	return s.rewriteLog()
+}
+
+// rewriteLog reemplaza el fichero del log con las entradas en memoria y lo
+// vuelve a abrir para añadir. Debe llamarse con el mutex bloqueado.
+func (s *FileStorage) rewriteLog() error {
+	var buf bytes.Buffer
+	for _, entry := range s.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("error al serializar entrada %d: %v", entry.Index, err)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+	if err := s.replaceFile(logFileName, buf.Bytes()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error al abrir log de consenso: %v", err)
+	}
+	s.log = file
+	return nil
+}
+
+// replaceFile reemplaza un fichero del directorio de forma atómica
+func (s *FileStorage) replaceFile(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error al guardar %s: %v", name, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("error al guardar %s: %v", name, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("error al sincronizar %s: %v", name, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error al guardar %s: %v", name, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error al guardar %s: %v", name, err)
+	}
+
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return fmt.Errorf("error al abrir directorio %s: %v", s.dir, err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return fmt.Errorf("error al sincronizar directorio %s: %v", s.dir, err)
+	}
+	return nil
+}
+
+// truncateEntries devuelve las entradas anteriores a index
+func truncateEntries(entries []Entry, index uint64) []Entry {
+	for i, entry := range entries {
+		if entry.Index >= index {
+			return entries[:i:i]
+		}
+	}
+	return entries
+}
+
+// compactEntries devuelve las entradas posteriores a index
+func compactEntries(entries []Entry, index uint64) []Entry {
+	for i, entry := range entries {
+		if entry.Index > index {
+			return slices.Clone(entries[i:])
+		}
+	}
+	return nil
+}
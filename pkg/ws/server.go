@@ -11,6 +11,7 @@ import (
 	"github.com/aratan/dbp2p/pkg/auth"
 	"github.com/aratan/dbp2p/pkg/binary"
 	"github.com/aratan/dbp2p/pkg/db"
+	"github.com/aratan/dbp2p/pkg/p2p"
 	"github.com/gorilla/websocket"
 )
 
@@ -34,6 +35,7 @@ type WSServer struct {
 	authManager   *auth.AuthManager
 	mutex         sync.RWMutex
 	binaryManager *binary.BinaryManager
+	queries       *p2p.DistributedQuery
 }
 
 // Client representa un cliente WebSocket
@@ -68,6 +70,12 @@ func (s *WSServer) SetBinaryManager(binaryManager *binary.BinaryManager) {
 	s.binaryManager = binaryManager
 }
 
+// SetQueries establece el servicio de consultas distribuidas, que atiende los
+// mensajes query con scope "cluster"
+func (s *WSServer) SetQueries(queries *p2p.DistributedQuery) {
+	s.queries = queries
+}
+
 // getBinaryManager obtiene el gestor de binarios
 func (s *WSServer) getBinaryManager() *binary.BinaryManager {
 	return s.binaryManager
@@ -248,6 +256,10 @@ func (c *Client) readPump() {
 			// Manejar consulta a la base de datos
 			c.handleQuery(msg.Payload)
 
+		case "aggregate":
+			// Manejar pipeline de agregación
+			c.handleAggregate(msg.Payload)
+
 		case "create":
 			// Manejar creación de documento
 			c.handleCreate(msg.Payload)
@@ -354,8 +366,12 @@ func (s *WSServer) PublishEvent(eventType EventType, collection string, document
 // handleQuery maneja consultas a la base de datos
 func (c *Client) handleQuery(payload json.RawMessage) {
 	var req struct {
-		Collection string         `json:"collection"`
-		Query      map[string]any `json:"query"`
+		Collection string          `json:"collection"`
+		Query      map[string]any  `json:"query"`
+		Scope      string          `json:"scope"`     // "cluster" para consultar los documentos de todos los nodos
+		Condition  any             `json:"condition"` // Condición con el formato de las consultas, en lugar de query
+		Options    db.QueryOptions `json:"options"`
+		Timeout    int             `json:"timeout"` // Milisegundos de espera a cada nodo
 	}
 
 	if err := json.Unmarshal(payload, &req); err != nil {
@@ -363,6 +379,11 @@ func (c *Client) handleQuery(payload json.RawMessage) {
 		return
 	}
 
+	if req.Scope == "cluster" {
+		c.handleClusterQuery(req.Collection, req.Query, req.Condition, req.Options, time.Duration(req.Timeout)*time.Millisecond)
+		return
+	}
+
 	// Ejecutar consulta
 	docs, err := c.server.db.QueryDocuments(req.Collection, req.Query)
 	if err != nil {
@@ -387,6 +408,106 @@ func (c *Client) handleQuery(payload json.RawMessage) {
 	c.send <- responseJSON
 }
 
+// handleClusterQuery maneja una consulta sobre los documentos de todos los nodos.
+// Los criterios de igualdad de query se combinan con la condición, si la hay.
+func (c *Client) handleClusterQuery(collection string, criteria map[string]any, condition any, options db.QueryOptions, timeout time.Duration) {
+	if c.server.queries == nil {
+		c.sendErrorMessage("Las consultas distribuidas no están habilitadas")
+		return
+	}
+
+	conditions := make([]interface{}, 0, len(criteria)+1)
+	if condition != nil {
+		conditions = append(conditions, condition)
+	}
+	for field, value := range criteria {
+		conditions = append(conditions, db.QueryCondition{Field: field, Operator: db.OperatorEQ, Value: value})
+	}
+
+	query := &db.Query{Collection: collection, Options: options}
+	switch {
+	case len(conditions) == 1:
+		query.Condition = conditions[0]
+	case len(conditions) > 1:
+		query.And(conditions...)
+	}
+
+	result, err := c.server.queries.Execute(query, timeout)
+	if err != nil {
+		c.sendErrorMessage(fmt.Sprintf("Error al ejecutar consulta: %v", err))
+		return
+	}
+
+	// Enviar respuesta
+	response := map[string]interface{}{
+		"type":       "query_response",
+		"collection": collection,
+		"scope":      "cluster",
+		"count":      result.Count,
+		"documents":  result.Documents,
+		"complete":   result.Complete,
+		"peers":      result.Peers,
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		c.sendErrorMessage(fmt.Sprintf("Error al serializar respuesta: %v", err))
+		return
+	}
+
+	c.send <- responseJSON
+}
+
+// canRead indica si el usuario del cliente puede leer una colección. Los
+// clientes sin autenticar no tienen permisos.
+func (c *Client) canRead(collection string) bool {
+	return c.user != nil && c.server.authManager.CheckUserPermission(c.user.ID, collection, "read")
+}
+
+// handleAggregate maneja pipelines de agregación sobre una colección
+func (c *Client) handleAggregate(payload json.RawMessage) {
+	var req struct {
+		Collection string                `json:"collection"`
+		Pipeline   []db.AggregationStage `json:"pipeline"`
+	}
+
+	if err := json.Unmarshal(payload, &req); err != nil {
+		c.sendErrorMessage(fmt.Sprintf("Error al deserializar agregación: %v", err))
+		return
+	}
+
+	// El pipeline lee la colección y las que une con $lookup
+	for _, collection := range append([]string{req.Collection}, db.LookupCollections(req.Pipeline)...) {
+		if !c.canRead(collection) {
+			c.sendErrorMessage(fmt.Sprintf("Acceso prohibido a la colección %s", collection))
+			return
+		}
+	}
+
+	// Ejecutar agregación
+	results, err := c.server.db.Aggregate(req.Collection, req.Pipeline)
+	if err != nil {
+		c.sendErrorMessage(fmt.Sprintf("Error al ejecutar agregación: %v", err))
+		return
+	}
+
+	// Enviar respuesta
+	response := map[string]interface{}{
+		"type":       "aggregate_response",
+		"collection": req.Collection,
+		"count":      len(results),
+		"results":    results,
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		c.sendErrorMessage(fmt.Sprintf("Error al serializar respuesta: %v", err))
+		return
+	}
+
+	c.send <- responseJSON
+}
+
 // handleCreate maneja la creación de documentos
 func (c *Client) handleCreate(payload json.RawMessage) {
 	var req struct {
@@ -427,6 +548,7 @@ func (c *Client) handleUpdate(payload json.RawMessage) {
 	var req struct {
 		ID   string         `json:"id"`
 		Data map[string]any `json:"data"`
+		Rev  *uint64        `json:"rev,omitempty"` // Revisión esperada del documento
 	}
 
 	if err := json.Unmarshal(payload, &req); err != nil {
@@ -435,7 +557,7 @@ func (c *Client) handleUpdate(payload json.RawMessage) {
 	}
 
 	// Actualizar documento
-	doc, err := c.server.db.UpdateDocument(req.ID, req.Data)
+	doc, err := c.server.db.UpdateDocument(req.ID, req.Data, revisionOptions(req.Rev)...)
 	if err != nil {
 		c.sendErrorMessage(fmt.Sprintf("Error al actualizar documento: %v", err))
 		return
@@ -460,7 +582,8 @@ func (c *Client) handleUpdate(payload json.RawMessage) {
 // handleDelete maneja la eliminación de documentos
 func (c *Client) handleDelete(payload json.RawMessage) {
 	var req struct {
-		ID string `json:"id"`
+		ID  string  `json:"id"`
+		Rev *uint64 `json:"rev,omitempty"` // Revisión esperada del documento
 	}
 
 	if err := json.Unmarshal(payload, &req); err != nil {
@@ -469,7 +592,7 @@ func (c *Client) handleDelete(payload json.RawMessage) {
 	}
 
 	// Eliminar documento
-	if err := c.server.db.DeleteDocument(req.ID); err != nil {
+	if err := c.server.db.DeleteDocument(req.ID, revisionOptions(req.Rev)...); err != nil {
 		c.sendErrorMessage(fmt.Sprintf("Error al eliminar documento: %v", err))
 		return
 	}
@@ -490,6 +613,14 @@ func (c *Client) handleDelete(payload json.RawMessage) {
 	c.send <- responseJSON
 }
 
+// revisionOptions convierte la revisión esperada de un mensaje en una escritura condicional
+func revisionOptions(rev *uint64) []db.WriteOption {
+	if rev == nil {
+		return nil
+	}
+	return []db.WriteOption{db.IfRevision(*rev)}
+}
+
 // handleGet maneja la obtención de documentos
 func (c *Client) handleGet(payload json.RawMessage) {
 	var req struct {